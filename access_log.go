@@ -0,0 +1,287 @@
+package ultrafast
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// defaultAccessLogBuffer is how many entries wait to be written before new
+// ones are dropped
+const defaultAccessLogBuffer = 4096
+
+// clfTimeFormat is the timestamp layout of the Common Log Format
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogEntry describes one answered request
+type AccessLogEntry struct {
+	Time      time.Time // when the request was received
+	Peer      SocketAddr
+	Method    string
+	Path      string
+	Host      string
+	Status    int
+	Bytes     int64 // response bytes sent, headers included
+	Latency   time.Duration
+	RequestID uint32
+}
+
+// AccessLogFormatter renders an entry as one log line, appended to dst
+// without the trailing newline
+type AccessLogFormatter interface {
+	Format(dst []byte, entry *AccessLogEntry) []byte
+}
+
+// AccessLogFormatterFunc adapts a function to AccessLogFormatter
+type AccessLogFormatterFunc func(dst []byte, entry *AccessLogEntry) []byte
+
+// Format calls f
+func (f AccessLogFormatterFunc) Format(dst []byte, entry *AccessLogEntry) []byte {
+	return f(dst, entry)
+}
+
+// CommonLogFormatter writes the Common Log Format:
+// host ident authuser [time] "request" status bytes
+type CommonLogFormatter struct{}
+
+// Format renders entry in Common Log Format
+func (CommonLogFormatter) Format(dst []byte, entry *AccessLogEntry) []byte {
+	dst = append(dst, entry.Peer.IP...)
+	dst = append(dst, " - - ["...)
+	dst = entry.Time.AppendFormat(dst, clfTimeFormat)
+	dst = append(dst, "] \""...)
+	dst = append(dst, entry.Method...)
+	dst = append(dst, ' ')
+	dst = append(dst, entry.Path...)
+	dst = append(dst, " HTTP/1.1\" "...)
+	dst = strconv.AppendInt(dst, int64(entry.Status), 10)
+	dst = append(dst, ' ')
+	return strconv.AppendInt(dst, entry.Bytes, 10)
+}
+
+// JSONLogFormatter writes each entry as a JSON object
+type JSONLogFormatter struct{}
+
+// Format renders entry as JSON
+func (JSONLogFormatter) Format(dst []byte, entry *AccessLogEntry) []byte {
+	dst = append(dst, `{"time":"`...)
+	dst = entry.Time.AppendFormat(dst, time.RFC3339Nano)
+	dst = append(dst, `","peer":`...)
+	dst = appendJSONString(dst, entry.Peer.IP+":"+strconv.Itoa(int(entry.Peer.Port)))
+	dst = append(dst, `,"method":`...)
+	dst = appendJSONString(dst, entry.Method)
+	dst = append(dst, `,"path":`...)
+	dst = appendJSONString(dst, entry.Path)
+	dst = append(dst, `,"host":`...)
+	dst = appendJSONString(dst, entry.Host)
+	dst = append(dst, `,"status":`...)
+	dst = strconv.AppendInt(dst, int64(entry.Status), 10)
+	dst = append(dst, `,"bytes":`...)
+	dst = strconv.AppendInt(dst, entry.Bytes, 10)
+	dst = append(dst, `,"latency_us":`...)
+	dst = strconv.AppendInt(dst, entry.Latency.Microseconds(), 10)
+	dst = append(dst, `,"request_id":`...)
+	dst = strconv.AppendUint(dst, uint64(entry.RequestID), 10)
+	return append(dst, '}')
+}
+
+// appendJSONString appends s as a quoted JSON string
+func appendJSONString(dst []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	dst = append(dst, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			dst = append(dst, '\\', c)
+		case c < 0x20:
+			dst = append(dst, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+		case c < utf8.RuneSelf:
+			dst = append(dst, c)
+		default:
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				dst = append(dst, "\ufffd"...)
+			} else {
+				dst = append(dst, s[i:i+size]...)
+			}
+			i += size
+			continue
+		}
+		i++
+	}
+	return append(dst, '"')
+}
+
+// AccessLogConfig configures an access logger. Zero values take the
+// defaults.
+type AccessLogConfig struct {
+	Formatter  AccessLogFormatter // default CommonLogFormatter
+	BufferSize int                // entries buffered, default 4096
+}
+
+// AccessLogStats counts access log activity
+type AccessLogStats struct {
+	Written uint64
+	Dropped uint64 // entries discarded because the buffer was full
+	Errors  uint64 // failed writes
+}
+
+// AccessLogger writes access log entries from a background goroutine.
+// Log copies the entry into a fixed ring buffer and returns at once, so
+// a slow log destination never blocks the event loop; when the buffer is
+// full new entries are dropped and counted.
+type AccessLogger struct {
+	w         io.Writer
+	formatter AccessLogFormatter
+
+	mu      sync.Mutex
+	ring    []AccessLogEntry
+	head    int // next entry to write
+	count   int
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+	written uint64 // atomic
+	dropped uint64 // atomic
+	errors  uint64 // atomic
+}
+
+// NewAccessLogger starts a logger writing to w
+func NewAccessLogger(w io.Writer, config AccessLogConfig) *AccessLogger {
+	if config.Formatter == nil {
+		config.Formatter = CommonLogFormatter{}
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultAccessLogBuffer
+	}
+	l := &AccessLogger{
+		w:         w,
+		formatter: config.Formatter,
+		ring:      make([]AccessLogEntry, config.BufferSize),
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Log queues an entry, dropping it if the buffer is full
+func (l *AccessLogger) Log(entry *AccessLogEntry) {
+	l.mu.Lock()
+	if l.closed || l.count == len(l.ring) {
+		l.mu.Unlock()
+		atomic.AddUint64(&l.dropped, 1)
+		return
+	}
+	l.ring[(l.head+l.count)%len(l.ring)] = *entry
+	l.count++
+	l.mu.Unlock()
+	notify(l.wake)
+}
+
+// run formats and writes queued entries until the logger is closed
+func (l *AccessLogger) run() {
+	defer close(l.done)
+	var line []byte
+	for {
+		l.mu.Lock()
+		if l.count == 0 {
+			closed := l.closed
+			l.mu.Unlock()
+			if closed {
+				return
+			}
+			<-l.wake
+			continue
+		}
+		entry := l.ring[l.head]
+		l.ring[l.head] = AccessLogEntry{}
+		l.head = (l.head + 1) % len(l.ring)
+		l.count--
+		l.mu.Unlock()
+
+		line = l.formatter.Format(line[:0], &entry)
+		line = append(line, '\n')
+		if _, err := l.w.Write(line); err != nil {
+			atomic.AddUint64(&l.errors, 1)
+			continue
+		}
+		atomic.AddUint64(&l.written, 1)
+	}
+}
+
+// Close writes the queued entries and stops the logger. Entries logged
+// afterwards are dropped.
+func (l *AccessLogger) Close() {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		<-l.done
+		return
+	}
+	l.closed = true
+	l.mu.Unlock()
+	notify(l.wake)
+	<-l.done
+}
+
+// Stats returns the logger's counters
+func (l *AccessLogger) Stats() AccessLogStats {
+	return AccessLogStats{
+		Written: atomic.LoadUint64(&l.written),
+		Dropped: atomic.LoadUint64(&l.dropped),
+		Errors:  atomic.LoadUint64(&l.errors),
+	}
+}
+
+// EnableAccessLog logs every answered request to w, replacing and closing
+// any previous access logger
+func (s *UltraFastHTTPServer) EnableAccessLog(w io.Writer, config AccessLogConfig) *AccessLogger {
+	logger := NewAccessLogger(w, config)
+	if old := s.accessLog.Swap(logger); old != nil {
+		old.Close()
+	}
+	return logger
+}
+
+// DisableAccessLog stops access logging, writing out queued entries first
+func (s *UltraFastHTTPServer) DisableAccessLog() {
+	if old := s.accessLog.Swap(nil); old != nil {
+		old.Close()
+	}
+}
+
+// logAccess counts an answered request against its route, and records
+// it if access logging is on
+func (s *UltraFastHTTPServer) logAccess(request *HTTPRequest, status int, bytes int64) {
+	now := clockNow()
+	var latency time.Duration
+	if !request.received.IsZero() {
+		latency = now.Sub(request.received)
+	}
+	s.metrics.recordRequest(routeLabel(request.vhost, request.route), status, bytes, latency)
+
+	logger := s.accessLog.Load()
+	if logger == nil {
+		return
+	}
+	entry := AccessLogEntry{
+		Time:      request.received,
+		Peer:      request.Peer,
+		Method:    request.Method,
+		Path:      request.Path,
+		Host:      request.Header("Host"),
+		Status:    status,
+		Bytes:     bytes,
+		Latency:   latency,
+		RequestID: request.ID,
+	}
+	if entry.Time.IsZero() {
+		entry.Time = now
+	}
+	logger.Log(&entry)
+}
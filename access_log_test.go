@@ -0,0 +1,144 @@
+package ultrafast
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for the logger goroutine and the test
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// blockingWriter holds every write until released
+type blockingWriter struct {
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+func testAccessLogEntry() *AccessLogEntry {
+	return &AccessLogEntry{
+		Time:      time.Date(2024, 3, 9, 14, 5, 7, 0, time.FixedZone("", -7*3600)),
+		Peer:      SocketAddr{IP: "10.0.0.1", Port: 4242},
+		Method:    "GET",
+		Path:      "/index.html",
+		Host:      "example.com",
+		Status:    200,
+		Bytes:     1234,
+		Latency:   1500 * time.Microsecond,
+		RequestID: 7,
+	}
+}
+
+func TestCommonLogFormatter(t *testing.T) {
+	line := CommonLogFormatter{}.Format(nil, testAccessLogEntry())
+	want := `10.0.0.1 - - [09/Mar/2024:14:05:07 -0700] "GET /index.html HTTP/1.1" 200 1234`
+	if string(line) != want {
+		t.Errorf("Expected %q, got %q", want, line)
+	}
+}
+
+func TestJSONLogFormatter(t *testing.T) {
+	entry := testAccessLogEntry()
+	entry.Path = "/quote\"tab\t\xff"
+	line := JSONLogFormatter{}.Format(nil, entry)
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(line, &decoded); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", line, err)
+	}
+	if decoded["path"] != "/quote\"tab\t�" || decoded["peer"] != "10.0.0.1:4242" ||
+		decoded["status"] != 200.0 || decoded["latency_us"] != 1500.0 || decoded["request_id"] != 7.0 {
+		t.Errorf("Unexpected fields in %s", line)
+	}
+}
+
+func TestAccessLoggerDropsWhenFull(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	logger := NewAccessLogger(w, AccessLogConfig{BufferSize: 2})
+
+	// One entry is taken by the blocked writer, two fill the ring
+	entry := testAccessLogEntry()
+	logger.Log(entry)
+	deadline := time.Now().Add(time.Second)
+	for {
+		logger.mu.Lock()
+		empty := logger.count == 0
+		logger.mu.Unlock()
+		if empty || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		logger.Log(entry)
+	}
+
+	close(w.release)
+	logger.Close()
+	if stats := logger.Stats(); stats.Written != 3 || stats.Dropped != 2 {
+		t.Errorf("Expected 3 written and 2 dropped, got %+v", stats)
+	}
+}
+
+func TestServerAccessLog(t *testing.T) {
+	server := startTestServer(t)
+	var out syncBuffer
+	logger := server.EnableAccessLog(&out, AccessLogConfig{Formatter: JSONLogFormatter{}})
+	client := newTestClient(t, server)
+
+	if _, err := client.Get("/benchmark"); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if _, err := client.Get("/missing"); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	// Entries are logged after the response goes out
+	deadline := time.Now().Add(2 * time.Second)
+	for logger.Stats().Written < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	server.DisableAccessLog()
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || logger.Stats().Written != 2 {
+		t.Fatalf("Expected 2 log lines, got %q", out.String())
+	}
+	for i, want := range []struct {
+		path   string
+		status float64
+	}{{"/benchmark", 200}, {"/missing", 404}} {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(lines[i]), &entry); err != nil {
+			t.Fatalf("Invalid JSON %q: %v", lines[i], err)
+		}
+		if entry["method"] != "GET" || entry["path"] != want.path || entry["status"] != want.status {
+			t.Errorf("Unexpected entry %s", lines[i])
+		}
+		if bytes, _ := entry["bytes"].(float64); bytes <= 0 {
+			t.Errorf("Expected a byte count in %s", lines[i])
+		}
+	}
+}
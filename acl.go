@@ -0,0 +1,230 @@
+package ultrafast
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// AccessList filters packets by source address before any other work is
+// spent on them. A source matching a deny rule is blocked; otherwise,
+// if there are allow rules, it must match one of them. Lists are
+// immutable: the update methods return a new list, sharing the hit
+// counts of the rules it keeps, which the server swaps in atomically.
+type AccessList struct {
+	allow    []*aclRule
+	deny     []*aclRule
+	unlisted *atomic.Uint64 // packets blocked for matching no allow rule
+}
+
+// aclRule is one CIDR of an access list and the packets it matched
+type aclRule struct {
+	prefix netip.Prefix
+	hits   atomic.Uint64
+}
+
+// ACLRule describes a rule of an access list
+type ACLRule struct {
+	CIDR string
+	Deny bool
+	Hits uint64 // packets the rule matched: allowed through, or blocked
+}
+
+// NewAccessList creates an access list from allow and deny CIDRs. A bare
+// address stands for itself alone.
+func NewAccessList(allow, deny []string) (*AccessList, error) {
+	list := &AccessList{unlisted: new(atomic.Uint64)}
+	var err error
+	for _, cidr := range allow {
+		if list, err = list.Allow(cidr); err != nil {
+			return nil, err
+		}
+	}
+	for _, cidr := range deny {
+		if list, err = list.Deny(cidr); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// parseCIDR parses a CIDR, or an address as a prefix covering just it
+func parseCIDR(cidr string) (netip.Prefix, error) {
+	if !strings.Contains(cidr, "/") {
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address: %q", cidr)
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR: %q", cidr)
+	}
+	return prefix.Masked(), nil
+}
+
+// Allow returns a copy of the list with cidr added to the allow rules
+func (l *AccessList) Allow(cidr string) (*AccessList, error) {
+	return l.add(cidr, false)
+}
+
+// Deny returns a copy of the list with cidr added to the deny rules
+func (l *AccessList) Deny(cidr string) (*AccessList, error) {
+	return l.add(cidr, true)
+}
+
+// add returns a copy of the list with a rule added, unless it has it
+func (l *AccessList) add(cidr string, deny bool) (*AccessList, error) {
+	prefix, err := parseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	next := l.clone()
+	rules := &next.allow
+	if deny {
+		rules = &next.deny
+	}
+	for _, rule := range *rules {
+		if rule.prefix == prefix {
+			return next, nil
+		}
+	}
+	*rules = append(*rules, &aclRule{prefix: prefix})
+	return next, nil
+}
+
+// Remove returns a copy of the list without the rules for cidr, allow
+// or deny. It fails if the list has none.
+func (l *AccessList) Remove(cidr string) (*AccessList, error) {
+	prefix, err := parseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	next := l.clone()
+	keep := func(rules []*aclRule) []*aclRule {
+		kept := rules[:0]
+		for _, rule := range rules {
+			if rule.prefix != prefix {
+				kept = append(kept, rule)
+			}
+		}
+		return kept
+	}
+	next.allow, next.deny = keep(next.allow), keep(next.deny)
+	if len(next.allow) == len(l.allow) && len(next.deny) == len(l.deny) {
+		return nil, fmt.Errorf("no rule for %s", prefix)
+	}
+	return next, nil
+}
+
+// clone copies the rule lists, keeping the rules and their counters
+func (l *AccessList) clone() *AccessList {
+	return &AccessList{
+		allow:    append([]*aclRule(nil), l.allow...),
+		deny:     append([]*aclRule(nil), l.deny...),
+		unlisted: l.unlisted,
+	}
+}
+
+// Allows reports whether packets from ip may pass, counting the packet
+// against the rule that decided it. Addresses that do not parse are
+// blocked.
+func (l *AccessList) Allows(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		l.unlisted.Add(1)
+		return false
+	}
+	for _, rule := range l.deny {
+		if rule.prefix.Contains(addr) {
+			rule.hits.Add(1)
+			return false
+		}
+	}
+	if len(l.allow) == 0 {
+		return true
+	}
+	for _, rule := range l.allow {
+		if rule.prefix.Contains(addr) {
+			rule.hits.Add(1)
+			return true
+		}
+	}
+	l.unlisted.Add(1)
+	return false
+}
+
+// Rules lists the allow rules, then the deny rules, with their hits
+func (l *AccessList) Rules() []ACLRule {
+	rules := make([]ACLRule, 0, len(l.allow)+len(l.deny))
+	for _, rule := range l.allow {
+		rules = append(rules, ACLRule{CIDR: rule.prefix.String(), Hits: rule.hits.Load()})
+	}
+	for _, rule := range l.deny {
+		rules = append(rules, ACLRule{CIDR: rule.prefix.String(), Deny: true, Hits: rule.hits.Load()})
+	}
+	return rules
+}
+
+// denyPrefixes returns the CIDRs of the deny rules
+func (l *AccessList) denyPrefixes() []netip.Prefix {
+	prefixes := make([]netip.Prefix, len(l.deny))
+	for i, rule := range l.deny {
+		prefixes[i] = rule.prefix
+	}
+	return prefixes
+}
+
+// Unlisted returns how many packets were blocked for matching no allow
+// rule
+func (l *AccessList) Unlisted() uint64 {
+	return l.unlisted.Load()
+}
+
+// SetAccessList filters incoming packets by source through list, on the
+// main socket and the multipath one. Blocked packets are dropped before
+// they are parsed, rate limited or counted as received, and are counted
+// in ACLBlocked. Passing nil lets every source through.
+func (s *UltraFastHTTPServer) SetAccessList(list *AccessList) {
+	s.acl.Store(list)
+	s.syncXDP()
+}
+
+// AccessList returns the access list in force, or nil for none
+func (s *UltraFastHTTPServer) AccessList() *AccessList {
+	return s.acl.Load()
+}
+
+// UpdateAccessList applies update to the access list in force, or to an
+// empty one, and swaps the result in. Updates racing each other are
+// retried, so none is lost.
+func (s *UltraFastHTTPServer) UpdateAccessList(update func(*AccessList) (*AccessList, error)) error {
+	for {
+		old := s.acl.Load()
+		base := old
+		if base == nil {
+			base, _ = NewAccessList(nil, nil)
+		}
+		next, err := update(base)
+		if err != nil {
+			return err
+		}
+		if s.acl.CompareAndSwap(old, next) {
+			s.syncXDP()
+			return nil
+		}
+	}
+}
+
+// admitSource reports whether the access list lets packets from a source
+// through, counting those it blocks
+func (s *UltraFastHTTPServer) admitSource(from SocketAddr) bool {
+	list := s.acl.Load()
+	if list == nil || list.Allows(from.IP) {
+		return true
+	}
+	atomic.AddUint64(&s.stats.ACLBlocked, 1)
+	return false
+}
@@ -0,0 +1,91 @@
+package ultrafast
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAccessList(t *testing.T) {
+	if _, err := NewAccessList([]string{"10.0.0.0/8"}, []string{"not-an-ip"}); err == nil {
+		t.Error("Expected an invalid CIDR to be rejected")
+	}
+
+	list, err := NewAccessList([]string{"10.0.0.0/8", "192.168.1.7"}, []string{"10.6.6.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{
+		"10.1.2.3":    true,
+		"10.6.6.9":    false, // deny wins over the wider allow
+		"192.168.1.7": true,
+		"192.168.1.8": false, // matches no allow rule
+		"8.8.8.8":     false,
+		"garbage":     false,
+	} {
+		if got := list.Allows(ip); got != allowed {
+			t.Errorf("%s: expected allowed %v, got %v", ip, allowed, got)
+		}
+	}
+	if list.Unlisted() != 3 {
+		t.Errorf("Expected 3 packets blocked as unlisted, got %d", list.Unlisted())
+	}
+
+	// Updates copy the list, and the rules they keep keep counting
+	next, err := list.Remove("10.6.6.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !next.Allows("10.6.6.9") || list.Allows("10.6.6.9") {
+		t.Error("Remove should only change the new list")
+	}
+	if _, err := next.Remove("10.6.6.0/24"); err == nil {
+		t.Error("Removing a missing rule should fail")
+	}
+	next, _ = next.Deny("10.9.9.9/16") // stored masked
+	rules := next.Rules()
+	if len(rules) != 3 || rules[2].CIDR != "10.9.0.0/16" || !rules[2].Deny {
+		t.Fatalf("Unexpected rules %+v", rules)
+	}
+	if rules[0].Hits != 2 {
+		t.Errorf("Expected the 10.0.0.0/8 rule to count across copies, got %d hits", rules[0].Hits)
+	}
+
+	// Without allow rules everything not denied passes
+	open, _ := NewAccessList(nil, []string{"10.0.0.0/8"})
+	if !open.Allows("8.8.8.8") || open.Allows("10.0.0.1") {
+		t.Error("Deny-only list should block just the denied range")
+	}
+}
+
+func TestServerAccessList(t *testing.T) {
+	server := startTestServer(t)
+	admin := NewAdminServer("")
+	server.registerAdminCommands(admin)
+
+	if reply := admin.Execute("acl deny 127.0.0.0/8"); !strings.HasSuffix(reply, "OK\n") {
+		t.Fatalf("acl deny failed: %q", reply)
+	}
+	if err := newTestClient(t, server).Connect(); err == nil {
+		t.Fatal("Handshake from a denied source succeeded")
+	}
+	stats := server.GetStats()
+	if stats.ACLBlocked == 0 || stats.RequestsReceived != 0 {
+		t.Errorf("Expected blocked packets dropped before being counted, got %+v", stats)
+	}
+	if reply := admin.Execute("acl"); !strings.Contains(reply, "deny  127.0.0.0/8") {
+		t.Errorf("Expected the rule listed, got %q", reply)
+	}
+
+	admin.Execute("acl remove 127.0.0.0/8")
+	admin.Execute("acl allow 127.0.0.1")
+	if _, err := newTestClient(t, server).Get("/benchmark"); err != nil {
+		t.Fatalf("Request from an allowed source failed: %v", err)
+	}
+	if reply := admin.Execute("acl remove 10.0.0.0/8"); !strings.HasPrefix(reply, "ERR") {
+		t.Errorf("Expected removing a missing rule to fail, got %q", reply)
+	}
+	admin.Execute("acl off")
+	if server.AccessList() != nil {
+		t.Error("acl off should remove the list")
+	}
+}
@@ -0,0 +1,70 @@
+package ultrafast
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// OPT_RETRY_TOKEN carries an address validation token: server to client
+// on a RETRY, client to server on the SYN that follows it
+const OPT_RETRY_TOKEN = 0x03
+
+// amplificationFactor caps the bytes sent to an address that has not yet
+// proven it can receive, as a multiple of the bytes received from it, so
+// a spoofed SYN cannot turn the server into a reflection amplifier
+const amplificationFactor = 3
+
+// unvalidatedHoldLimit and unvalidatedHoldBytes cap what is held for an
+// address not yet proven; past either, packets are dropped, DATA to be
+// resent once the peer is validated
+const (
+	unvalidatedHoldLimit = 64
+	unvalidatedHoldBytes = 64 << 10
+)
+
+// retryTokenLifetime bounds how long a RETRY token can be echoed back
+const retryTokenLifetime = 10 * time.Second
+
+// retryTokenMACSize is the truncated MAC length in a retry token
+const retryTokenMACSize = 16
+
+// RetryToken mints an address validation token for peer. A client that
+// echoes it back in its next SYN has proven it receives at that address.
+func (j *SynCookieJar) RetryToken(peer SocketAddr) []byte {
+	token := make([]byte, 4, 4+retryTokenMACSize)
+	binary.BigEndian.PutUint32(token, uint32(j.now().Unix()))
+	return append(token, j.retryMAC(peer, token[:4])...)
+}
+
+// ValidateRetryToken checks a token echoed back by peer
+func (j *SynCookieJar) ValidateRetryToken(peer SocketAddr, token []byte) error {
+	if len(token) != 4+retryTokenMACSize {
+		return fmt.Errorf("retry token has wrong length: %d bytes", len(token))
+	}
+	if !hmac.Equal(token[4:], j.retryMAC(peer, token[:4])) {
+		return fmt.Errorf("retry token authentication failed")
+	}
+
+	issuedAt := time.Unix(int64(binary.BigEndian.Uint32(token[:4])), 0)
+	if age := j.now().Sub(issuedAt); age > retryTokenLifetime || age < -time.Second {
+		return fmt.Errorf("retry token expired")
+	}
+	return nil
+}
+
+// retryMAC binds a retry token timestamp to the peer's full address
+func (j *SynCookieJar) retryMAC(peer SocketAddr, timestamp []byte) []byte {
+	h := hmac.New(sha256.New, j.secret[:])
+
+	var buf [3]byte
+	buf[0] = 'R'
+	binary.BigEndian.PutUint16(buf[1:3], peer.Port)
+	h.Write(buf[:])
+	h.Write(timestamp)
+	h.Write([]byte(peer.IP))
+
+	return h.Sum(nil)[:retryTokenMACSize]
+}
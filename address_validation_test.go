@@ -0,0 +1,100 @@
+package ultrafast
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryTokens(t *testing.T) {
+	jar, err := NewSynCookieJar()
+	if err != nil {
+		t.Fatalf("Failed to create cookie jar: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	jar.now = func() time.Time { return now }
+
+	peer := SocketAddr{IP: "192.168.1.10", Port: 5555}
+	token := jar.RetryToken(peer)
+	tampered := append([]byte(nil), token...)
+	tampered[len(tampered)-1] ^= 1
+
+	testCases := []struct {
+		name  string
+		peer  SocketAddr
+		token []byte
+		age   time.Duration
+		valid bool
+	}{
+		{"Valid token", peer, token, 0, true},
+		{"Expired token", peer, token, retryTokenLifetime + time.Second, false},
+		{"Wrong port", SocketAddr{IP: peer.IP, Port: 5556}, token, 0, false},
+		{"Wrong IP", SocketAddr{IP: "192.168.1.11", Port: peer.Port}, token, 0, false},
+		{"Tampered token", peer, tampered, 0, false},
+		{"Truncated token", peer, token[:8], 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			jar.now = func() time.Time { return now.Add(tc.age) }
+			err := jar.ValidateRetryToken(tc.peer, tc.token)
+			if (err == nil) != tc.valid {
+				t.Errorf("Expected valid=%v, got error %v", tc.valid, err)
+			}
+		})
+	}
+}
+
+func TestAmplificationLimit(t *testing.T) {
+	table := NewConnectionTable()
+	conn, _ := table.GetOrCreate(SocketAddr{IP: "203.0.113.9", Port: 7000})
+
+	conn.RecordIn(100)
+
+	first := NewPacket(DATA_PACKET, 0, 1, 0, nil)
+	if conn.HoldUnvalidated(first, 250) {
+		t.Error("Packet within 3x the received bytes should be sent")
+	}
+	conn.RecordOut(250)
+
+	second := NewPacket(DATA_PACKET, 0, 2, 0, nil)
+	if !conn.HoldUnvalidated(second, 100) {
+		t.Error("Packet beyond 3x the received bytes should be held")
+	}
+	third := NewPacket(DATA_PACKET, 0, 3, 0, nil)
+	if !conn.HoldUnvalidated(third, 10) {
+		t.Error("Packets behind a held packet should queue to keep order")
+	}
+
+	held := conn.MarkValidated()
+	if len(held) != 2 || held[0] != second || held[1] != third {
+		t.Fatalf("Expected the two held packets in order, got %d", len(held))
+	}
+	if conn.HoldUnvalidated(NewPacket(DATA_PACKET, 0, 4, 0, nil), 10000) {
+		t.Error("Validated connection should not be limited")
+	}
+}
+
+func TestAmplificationLimitHoldCap(t *testing.T) {
+	table := NewConnectionTable()
+	conn, _ := table.GetOrCreate(SocketAddr{IP: "203.0.113.9", Port: 7000})
+
+	// Nothing received, so everything is held, up to the count cap
+	for i := 0; i < unvalidatedHoldLimit+10; i++ {
+		if !conn.HoldUnvalidated(NewPacket(DATA_PACKET, 0, uint32(i), 0, nil), 10) {
+			t.Fatalf("Packet %d should not be sent to an unvalidated peer", i)
+		}
+	}
+	if held := conn.MarkValidated(); len(held) != unvalidatedHoldLimit {
+		t.Errorf("Expected %d packets held, got %d", unvalidatedHoldLimit, len(held))
+	}
+
+	// And up to the byte cap
+	other, _ := table.GetOrCreate(SocketAddr{IP: "203.0.113.10", Port: 7000})
+	size := unvalidatedHoldBytes / 4
+	for i := 0; i < 6; i++ {
+		other.HoldUnvalidated(NewPacket(DATA_PACKET, 0, uint32(i), 0, nil), size)
+	}
+	if held := other.MarkValidated(); len(held) != 4 {
+		t.Errorf("Expected 4 packets of %d bytes held, got %d", size, len(held))
+	}
+}
@@ -0,0 +1,596 @@
+package ultrafast
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AdminCommand runs one control command and returns its output
+type AdminCommand func(args []string) (string, error)
+
+// adminCommandEntry pairs a command with its help text
+type adminCommandEntry struct {
+	usage   string
+	handler AdminCommand
+}
+
+// AdminServer exposes a line-based control channel over a unix socket.
+// Each request is one line ("command arg..."); the reply is the command
+// output followed by a final "OK" or "ERR <message>" line.
+type AdminServer struct {
+	path     string
+	listenFd int
+	commands map[string]adminCommandEntry
+	mu       sync.RWMutex
+	wg       sync.WaitGroup
+	closed   bool
+}
+
+// NewAdminServer creates an admin server that will listen on a unix socket path
+func NewAdminServer(path string) *AdminServer {
+	as := &AdminServer{
+		path:     path,
+		listenFd: -1,
+		commands: make(map[string]adminCommandEntry),
+	}
+	as.RegisterCommand("help", "help - list available commands", as.helpCommand)
+	return as
+}
+
+// RegisterCommand adds or replaces a control command
+func (as *AdminServer) RegisterCommand(name string, usage string, handler AdminCommand) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.commands[name] = adminCommandEntry{usage: usage, handler: handler}
+}
+
+// Execute runs a single command line and returns the full reply
+func (as *AdminServer) Execute(line string) string {
+	var fields []string
+	for _, field := range splitString(trimSpace(line), " ") {
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) == 0 {
+		return "ERR empty command\n"
+	}
+
+	as.mu.RLock()
+	entry, exists := as.commands[fields[0]]
+	as.mu.RUnlock()
+	if !exists {
+		return fmt.Sprintf("ERR unknown command: %s\n", fields[0])
+	}
+
+	output, err := entry.handler(fields[1:])
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		output += "\n"
+	}
+	if err != nil {
+		return output + fmt.Sprintf("ERR %v\n", err)
+	}
+	return output + "OK\n"
+}
+
+// helpCommand lists the registered commands
+func (as *AdminServer) helpCommand(args []string) (string, error) {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+
+	names := make([]string, 0, len(as.commands))
+	for name := range as.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	output := ""
+	for _, name := range names {
+		output += as.commands[name].usage + "\n"
+	}
+	return output, nil
+}
+
+// registerAdminCommands installs the server's runtime control commands
+func (s *UltraFastHTTPServer) registerAdminCommands(admin *AdminServer) {
+	admin.RegisterCommand("connections", "connections - dump the connection table", func(args []string) (string, error) {
+		output := ""
+		for _, info := range s.Connections() {
+			output += fmt.Sprintf("%s:%d age=%v idle=%v rtt=%v cwnd=%d unacked=%d inflight=%d queued=%d app_limited=%t requests=%d in=%d out=%d\n",
+				info.Peer.IP, info.Peer.Port,
+				time.Since(info.Established).Truncate(time.Millisecond),
+				info.IdleTime.Truncate(time.Millisecond),
+				info.RTT, info.CongestionWindow, info.UnackedPackets,
+				info.BytesInFlight, info.QueuedPackets, info.AppLimited,
+				info.ActiveRequests, info.BytesIn, info.BytesOut)
+		}
+		return output, nil
+	})
+
+	admin.RegisterCommand("loglevel", "loglevel [debug|info|warn|error] - show or set the log level", func(args []string) (string, error) {
+		if len(args) == 0 {
+			return GetLogLevel().String(), nil
+		}
+		level, err := ParseLogLevel(args[0])
+		if err != nil {
+			return "", err
+		}
+		SetLogLevel(level)
+		return level.String(), nil
+	})
+
+	admin.RegisterCommand("peers", "peers - list servers found by discovery", func(args []string) (string, error) {
+		output := ""
+		for _, peer := range s.Peers() {
+			output += fmt.Sprintf("%016x %s seen=%v ago %v\n", peer.NodeID, peer.Addr,
+				time.Since(peer.LastSeen).Truncate(time.Millisecond), peer.Metadata)
+		}
+		return output, nil
+	})
+
+	admin.RegisterCommand("reload", "reload - re-read the config file, as on SIGHUP", func(args []string) (string, error) {
+		if err := s.ReloadConfig(); err != nil {
+			return "", err
+		}
+		return "reloaded", nil
+	})
+
+	admin.RegisterCommand("ready", "ready [on|off] - show or set readiness for /readyz", func(args []string) (string, error) {
+		if len(args) == 0 {
+			if reason := s.readiness(); reason != "" {
+				return "not ready: " + reason, nil
+			}
+			return "ready", nil
+		}
+		if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+			return "", fmt.Errorf("usage: ready [on|off]")
+		}
+		s.SetReady(args[0] == "on")
+		return "ready " + args[0], nil
+	})
+
+	admin.RegisterCommand("capture", "capture on|off - toggle packet capture logging", func(args []string) (string, error) {
+		if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+			return "", fmt.Errorf("usage: capture on|off")
+		}
+		s.SetPacketCapture(args[0] == "on")
+		return "capture " + args[0], nil
+	})
+
+	admin.RegisterCommand("cc", "cc [reno|fixed] - show or set the congestion control algorithm", func(args []string) (string, error) {
+		if len(args) == 0 {
+			return s.reliability.GetCongestionAlgorithm().String(), nil
+		}
+		cc, err := ParseCongestionAlgorithm(args[0])
+		if err != nil {
+			return "", err
+		}
+		s.reliability.SetCongestionAlgorithm(cc)
+		return cc.String(), nil
+	})
+
+	admin.RegisterCommand("ratelimit", "ratelimit [off | pps bps [drop|rst]] - show or set per-source rate limits", func(args []string) (string, error) {
+		if len(args) == 0 {
+			limiter := s.rateLimiter.Load()
+			if limiter == nil {
+				return "off", nil
+			}
+			config := limiter.Config()
+			return fmt.Sprintf("pps=%.0f bps=%.0f dropped=%d sources=%d",
+				config.PacketsPerSecond, config.BytesPerSecond,
+				limiter.Dropped(), limiter.TrackedSources()), nil
+		}
+		if args[0] == "off" {
+			s.DisableRateLimit()
+			return "off", nil
+		}
+		if len(args) < 2 {
+			return "", fmt.Errorf("usage: ratelimit off | pps bps [drop|rst]")
+		}
+
+		var config RateLimitConfig
+		if _, err := fmt.Sscanf(args[0], "%g", &config.PacketsPerSecond); err != nil {
+			return "", fmt.Errorf("invalid packet rate: %s", args[0])
+		}
+		if _, err := fmt.Sscanf(args[1], "%g", &config.BytesPerSecond); err != nil {
+			return "", fmt.Errorf("invalid byte rate: %s", args[1])
+		}
+		if len(args) > 2 && args[2] == "rst" {
+			config.Action = RATE_LIMIT_RST
+		}
+		s.SetRateLimit(config)
+		return fmt.Sprintf("pps=%.0f bps=%.0f", config.PacketsPerSecond, config.BytesPerSecond), nil
+	})
+
+	admin.RegisterCommand("acl", "acl [off | allow cidr | deny cidr | remove cidr] - show or edit the source access list", func(args []string) (string, error) {
+		if len(args) == 0 {
+			list := s.AccessList()
+			if list == nil {
+				return "acl off", nil
+			}
+			var b strings.Builder
+			for _, rule := range list.Rules() {
+				action := "allow"
+				if rule.Deny {
+					action = "deny"
+				}
+				fmt.Fprintf(&b, "%-5s %-18s hits=%d\n", action, rule.CIDR, rule.Hits)
+			}
+			fmt.Fprintf(&b, "blocked=%d unlisted=%d", s.GetStats().ACLBlocked, list.Unlisted())
+			return b.String(), nil
+		}
+		if args[0] == "off" {
+			s.SetAccessList(nil)
+			return "acl off", nil
+		}
+		if len(args) != 2 {
+			return "", fmt.Errorf("usage: acl off | allow cidr | deny cidr | remove cidr")
+		}
+		var update func(*AccessList) (*AccessList, error)
+		switch args[0] {
+		case "allow":
+			update = func(l *AccessList) (*AccessList, error) { return l.Allow(args[1]) }
+		case "deny":
+			update = func(l *AccessList) (*AccessList, error) { return l.Deny(args[1]) }
+		case "remove":
+			update = func(l *AccessList) (*AccessList, error) { return l.Remove(args[1]) }
+		default:
+			return "", fmt.Errorf("usage: acl off | allow cidr | deny cidr | remove cidr")
+		}
+		if err := s.UpdateAccessList(update); err != nil {
+			return "", err
+		}
+		return "acl " + args[0] + " " + args[1], nil
+	})
+
+	admin.RegisterCommand("xdp", "xdp [off | iface] - show, attach or detach the XDP drop program", func(args []string) (string, error) {
+		if len(args) == 0 {
+			offload := s.XDP()
+			if offload == nil {
+				return "xdp off", nil
+			}
+			stats := offload.Stats()
+			return fmt.Sprintf("xdp on %s: denied=%d rate_limited=%d", offload.Interface(), stats.Denied, stats.RateLimited), nil
+		}
+		if args[0] == "off" {
+			s.DisableXDP()
+			return "xdp off", nil
+		}
+		if _, err := s.EnableXDP(args[0]); err != nil {
+			return "", err
+		}
+		return "xdp on " + args[0], nil
+	})
+
+	admin.RegisterCommand("bandwidth", "bandwidth [off | bytes_per_second] - show or set the server-wide egress limit", func(args []string) (string, error) {
+		if len(args) == 0 {
+			pacer := s.pacer.Load()
+			if pacer == nil {
+				return "bandwidth off", nil
+			}
+			return fmt.Sprintf("bandwidth=%.0f throttled=%d", pacer.Rate(), pacer.Throttled()), nil
+		}
+		if args[0] == "off" {
+			s.SetBandwidthLimit(0)
+			return "bandwidth off", nil
+		}
+		var rate float64
+		if _, err := fmt.Sscanf(args[0], "%g", &rate); err != nil || rate <= 0 {
+			return "", fmt.Errorf("invalid byte rate: %s", args[0])
+		}
+		s.SetBandwidthLimit(rate)
+		return fmt.Sprintf("bandwidth=%.0f", rate), nil
+	})
+
+	admin.RegisterCommand("dscp", "dscp [0-63] - show or set the DSCP marking the server's packets", func(args []string) (string, error) {
+		if len(args) == 0 {
+			return fmt.Sprintf("dscp=%d", s.DSCP()), nil
+		}
+		var dscp int
+		if _, err := fmt.Sscanf(args[0], "%d", &dscp); err != nil {
+			return "", fmt.Errorf("invalid DSCP: %s", args[0])
+		}
+		if err := s.SetDSCP(dscp); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("dscp=%d", dscp), nil
+	})
+
+	admin.RegisterCommand("retry", "retry [on|off] - show or set mandatory address validation for new connections", func(args []string) (string, error) {
+		if len(args) == 0 {
+			if s.RetryRequired() {
+				return "retry on", nil
+			}
+			return "retry off", nil
+		}
+		if args[0] != "on" && args[0] != "off" {
+			return "", fmt.Errorf("usage: retry [on|off]")
+		}
+		s.SetRetryRequired(args[0] == "on")
+		return "retry " + args[0], nil
+	})
+
+	admin.RegisterCommand("stateless", "stateless [on|off] - show or set stateless answers to single-packet GETs", func(args []string) (string, error) {
+		if len(args) == 0 {
+			if !s.StatelessEnabled() {
+				return "stateless off", nil
+			}
+			stats := s.GetStats()
+			return fmt.Sprintf("stateless on served=%d refused=%d", stats.StatelessServed, stats.StatelessRefused), nil
+		}
+		switch args[0] {
+		case "on":
+			// A key set through EnableStateless is kept
+			if !s.StatelessEnabled() {
+				if err := s.EnableStateless(nil); err != nil {
+					return "", err
+				}
+			}
+		case "off":
+			s.DisableStateless()
+		default:
+			return "", fmt.Errorf("usage: stateless [on|off]")
+		}
+		return "stateless " + args[0], nil
+	})
+
+	admin.RegisterCommand("workers", "workers [off | size queue [reject|inline|block]] - show or set the handler worker pool", func(args []string) (string, error) {
+		if len(args) == 0 {
+			stats, ok := s.WorkerPoolStats()
+			if !ok {
+				return "workers off", nil
+			}
+			return fmt.Sprintf("workers=%d busy=%d queued=%d rejected=%d",
+				stats.Workers, stats.Busy, stats.Queued, stats.Rejected), nil
+		}
+		if args[0] == "off" {
+			s.DisableWorkerPool()
+			return "workers off", nil
+		}
+		if len(args) < 2 {
+			return "", fmt.Errorf("usage: workers [off | size queue [reject|inline|block]]")
+		}
+		var config WorkerPoolConfig
+		if _, err := fmt.Sscanf(args[0], "%d", &config.Workers); err != nil || config.Workers <= 0 {
+			return "", fmt.Errorf("invalid pool size: %s", args[0])
+		}
+		if _, err := fmt.Sscanf(args[1], "%d", &config.QueueLength); err != nil || config.QueueLength <= 0 {
+			return "", fmt.Errorf("invalid queue length: %s", args[1])
+		}
+		if len(args) > 2 {
+			policy, err := ParsePoolOverflowPolicy(args[2])
+			if err != nil {
+				return "", err
+			}
+			config.Overflow = policy
+		}
+		s.SetWorkerPool(config)
+		return fmt.Sprintf("workers=%d queue=%d overflow=%v", config.Workers, config.QueueLength, config.Overflow), nil
+	})
+
+	admin.RegisterCommand("cache", "cache [off | clear | capacity ttl] - show or configure the response cache", func(args []string) (string, error) {
+		cache := s.ResponseCache()
+		if len(args) == 0 {
+			if cache == nil {
+				return "cache off", nil
+			}
+			stats := cache.Stats()
+			return fmt.Sprintf("entries=%d hits=%d misses=%d evictions=%d ttl=%v",
+				stats.Entries, stats.Hits, stats.Misses, stats.Evictions, cache.Config().TTL), nil
+		}
+		switch args[0] {
+		case "off":
+			s.DisableResponseCache()
+			return "cache off", nil
+		case "clear":
+			if cache != nil {
+				cache.Purge()
+			}
+			return "cache cleared", nil
+		}
+		if len(args) < 2 {
+			return "", fmt.Errorf("usage: cache [off | clear | capacity ttl]")
+		}
+
+		var config ResponseCacheConfig
+		if _, err := fmt.Sscanf(args[0], "%d", &config.Capacity); err != nil || config.Capacity <= 0 {
+			return "", fmt.Errorf("invalid capacity: %s", args[0])
+		}
+		ttl, err := time.ParseDuration(args[1])
+		if err != nil || ttl <= 0 {
+			return "", fmt.Errorf("invalid ttl: %s", args[1])
+		}
+		config.TTL = ttl
+		s.EnableResponseCache(config)
+		return fmt.Sprintf("cache capacity=%d ttl=%v", config.Capacity, config.TTL), nil
+	})
+
+	admin.RegisterCommand("accesslog", "accesslog [off | clf | json] - show or set access logging to standard output", func(args []string) (string, error) {
+		if len(args) == 0 {
+			logger := s.accessLog.Load()
+			if logger == nil {
+				return "accesslog off", nil
+			}
+			stats := logger.Stats()
+			return fmt.Sprintf("written=%d dropped=%d errors=%d", stats.Written, stats.Dropped, stats.Errors), nil
+		}
+		switch args[0] {
+		case "off":
+			s.DisableAccessLog()
+		case "clf":
+			s.EnableAccessLog(os.Stdout, AccessLogConfig{Formatter: CommonLogFormatter{}})
+		case "json":
+			s.EnableAccessLog(os.Stdout, AccessLogConfig{Formatter: JSONLogFormatter{}})
+		default:
+			return "", fmt.Errorf("usage: accesslog [off | clf | json]")
+		}
+		return "accesslog " + args[0], nil
+	})
+
+	admin.RegisterCommand("flows", "flows [off | ip:port] - show or set the IPFIX collector flow records go to", func(args []string) (string, error) {
+		if len(args) == 0 {
+			exporter := s.FlowExporter()
+			if exporter == nil {
+				return "flows off", nil
+			}
+			stats := exporter.Stats()
+			return fmt.Sprintf("collector=%s exported=%d dropped=%d errors=%d",
+				exporter.Collector(), stats.Exported, stats.Dropped, stats.Errors), nil
+		}
+		if args[0] == "off" {
+			s.DisableFlowExport()
+			return "flows off", nil
+		}
+		collector, err := ParseSocketAddr(args[0])
+		if err != nil {
+			return "", err
+		}
+		if _, err := s.EnableFlowExport(collector, FlowExportConfig{}); err != nil {
+			return "", err
+		}
+		return "flows " + collector.String(), nil
+	})
+
+	admin.RegisterCommand("mirror", "mirror [off | ip:port [rate]] - show or set the shadow server a sample of requests is copied to", func(args []string) (string, error) {
+		if len(args) == 0 {
+			mirror := s.Mirror()
+			if mirror == nil {
+				return "mirror off", nil
+			}
+			stats := mirror.Stats()
+			return fmt.Sprintf("target=%s mirrored=%d skipped=%d dropped=%d errors=%d",
+				mirror.Target(), stats.Mirrored, stats.Skipped, stats.Dropped, stats.Errors), nil
+		}
+		if args[0] == "off" {
+			s.DisableMirror()
+			return "mirror off", nil
+		}
+		target, err := ParseSocketAddr(args[0])
+		if err != nil {
+			return "", err
+		}
+		var config MirrorConfig
+		if len(args) > 1 {
+			if _, err := fmt.Sscanf(args[1], "%g", &config.SampleRate); err != nil || config.SampleRate <= 0 {
+				return "", fmt.Errorf("invalid sample rate: %s", args[1])
+			}
+		}
+		if _, err := s.EnableMirror(target, config); err != nil {
+			return "", err
+		}
+		return "mirror " + target.String(), nil
+	})
+
+	admin.RegisterCommand("stats", "stats - show server and reliability counters", func(args []string) (string, error) {
+		stats := s.GetStats()
+		rel := s.reliability.GetStats()
+		return fmt.Sprintf("requests=%d responses=%d bytes_in=%d bytes_out=%d connections=%d errors=%d\n"+
+			"sent=%d received=%d lost=%d retransmitted=%d cwnd=%d rtt=%v\n"+
+			"dropped socket_overflow=%d acl=%d rate_limited=%d accept_queue=%d receive_queue=%d out_of_order=%d handler_rejected=%d",
+			stats.RequestsReceived, stats.ResponsesSent, stats.BytesReceived, stats.BytesSent,
+			stats.ConnectionsActive, stats.Errors,
+			rel.PacketsSent, rel.PacketsReceived, rel.PacketsLost, rel.PacketsRetransmitted,
+			rel.CongestionWindow, rel.RTTEstimate,
+			stats.SocketOverflows, stats.ACLBlocked, stats.RateLimited, stats.AcceptQueueFull, rel.ReceiveQueueFull,
+			stats.OutOfOrderDropped, stats.HandlerRejected), nil
+	})
+
+	admin.RegisterCommand("routes", "routes - show requests, errors and latency per route", func(args []string) (string, error) {
+		output := ""
+		for _, route := range s.RouteStats() {
+			output += fmt.Sprintf("%s requests=%d errors=%d bytes=%d mean=%v max=%v\n",
+				route.Route, route.Requests, route.Errors, route.Bytes, route.MeanLatency, route.MaxLatency)
+		}
+		return output, nil
+	})
+
+	admin.RegisterCommand("talkers", "talkers [n] - show the n source IPs sending the most bytes", func(args []string) (string, error) {
+		n := statsTopTalkers
+		if len(args) > 0 {
+			if _, err := fmt.Sscanf(args[0], "%d", &n); err != nil || n < 1 {
+				return "", fmt.Errorf("invalid count: %s", args[0])
+			}
+		}
+		output := ""
+		for _, talker := range s.TopTalkers(n) {
+			output += fmt.Sprintf("%s packets=%d bytes=%d overcount=%d\n",
+				talker.IP, talker.Packets, talker.Bytes, talker.Overcount)
+		}
+		return output, nil
+	})
+
+	admin.RegisterCommand("pprof", "pprof [profile [file] | cpu file [seconds]] - list, print or save runtime profiles", s.pprofCommand)
+
+	admin.RegisterCommand("vars", "vars - show the expvar variables as JSON", s.varsCommand)
+
+	admin.RegisterCommand("loop", "loop [stall-threshold] - show event loop latency, or set how long a callback may block it", func(args []string) (string, error) {
+		if len(args) > 0 {
+			threshold, err := time.ParseDuration(args[0])
+			if err != nil {
+				return "", err
+			}
+			s.SetStallThreshold(threshold)
+		}
+		stats := s.EventLoopStats()
+		output := fmt.Sprintf("wakeups=%d events_per_wakeup=%.2f max_events=%d wait=%v busy=%v\n",
+			stats.Wakeups, stats.EventsPerWakeup(), stats.MaxEventsPerWakeup, stats.WaitTime, stats.BusyTime)
+		output += fmt.Sprintf("callbacks=%d p50=%v p99=%v max=%v stalls=%d stall_threshold=%v\n",
+			stats.Callbacks, stats.CallbackPercentile(0.5), stats.CallbackPercentile(0.99),
+			stats.MaxCallback, stats.Stalls, stats.StallThreshold)
+		for _, bucket := range stats.CallbackTimes {
+			if bucket.Count == 0 {
+				continue
+			}
+			if bucket.UpperBound == 0 {
+				output += fmt.Sprintf("  longer %d\n", bucket.Count)
+			} else {
+				output += fmt.Sprintf("  <%v %d\n", bucket.UpperBound, bucket.Count)
+			}
+		}
+		return output, nil
+	})
+
+	admin.RegisterCommand("allocs", "allocs - show GC activity and the reliability slabs' live and free objects", func(args []string) (string, error) {
+		gc := s.GCStats()
+		output := fmt.Sprintf("gc runs=%d pause=%v heap=%d allocs=%d per_request=%.1f\n",
+			gc.Collections, gc.PauseTotal, gc.HeapBytes, gc.Allocations, gc.AllocsPerRequest)
+		stats := s.AllocatorStats()
+		for _, slab := range []struct {
+			name  string
+			stats SlabStats
+		}{{"unacked", stats.UnackedEntries}, {"queue", stats.QueueNodes}, {"timers", stats.WheelTimers}} {
+			output += fmt.Sprintf("%s live=%d free=%d chunks=%d\n",
+				slab.name, slab.stats.Live, slab.stats.Free, slab.stats.Chunks)
+		}
+		return output, nil
+	})
+
+	admin.RegisterCommand("features", "features - show which platform fast paths are active", func(args []string) (string, error) {
+		f := PlatformFeatures()
+		return fmt.Sprintf("platform=%s event_loop=%s edge_triggered=%v exclusive_wakeups=%v zero_copy=%v socket_handoff=%v admin_socket=%v avx2_checksum=%v neon_checksum=%v\n",
+			f.Platform, f.EventLoop, f.EdgeTriggered, f.ExclusiveWakeups, f.ZeroCopy, f.SocketHandoff, f.AdminSocket, f.AVX2Checksum, f.NEONChecksum), nil
+	})
+
+	admin.RegisterCommand("capabilities", "capabilities - show which optional kernel features were probed", func(args []string) (string, error) {
+		c := KernelCapabilities()
+		return fmt.Sprintf("kernel=%s reuseport=%v timestamping=%v zerocopy=%v gso=%v gro=%v busy_poll=%v epoll_exclusive=%v\n",
+			c.Kernel, c.ReusePort, c.Timestamping, c.ZeroCopy, c.GSO, c.GRO, c.BusyPoll, c.EpollExclusive), nil
+	})
+
+	admin.RegisterCommand("shutdown", "shutdown [timeout] - drain connections and stop the server", func(args []string) (string, error) {
+		timeout := 5 * time.Second
+		if len(args) > 0 {
+			parsed, err := time.ParseDuration(args[0])
+			if err != nil {
+				return "", err
+			}
+			timeout = parsed
+		}
+		go s.Shutdown(timeout)
+		return fmt.Sprintf("shutting down (drain timeout %v)", timeout), nil
+	})
+}
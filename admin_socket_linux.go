@@ -0,0 +1,160 @@
+package ultrafast
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Start binds the unix socket and begins accepting control clients. The
+// socket is created mode 0600 in a directory only this user can enter,
+// made mode 0700 if it does not exist, and clients connecting as another
+// user are turned away: the commands can stop the server and change its
+// limits.
+func (as *AdminServer) Start() error {
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to create admin socket: %v", err)
+	}
+
+	// A stale socket file left behind by a previous run is replaced
+	if err := bindPrivate(fd, as.path); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to bind admin socket %s: %v", as.path, err)
+	}
+
+	if err := unix.Listen(fd, 16); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to listen on admin socket: %v", err)
+	}
+
+	as.listenFd = fd
+	as.wg.Add(1)
+	go as.acceptLoop()
+	return nil
+}
+
+// Close stops accepting clients and removes the socket file
+func (as *AdminServer) Close() error {
+	as.mu.Lock()
+	if as.closed || as.listenFd < 0 {
+		as.mu.Unlock()
+		return nil
+	}
+	as.closed = true
+	as.mu.Unlock()
+
+	// Shutdown wakes the goroutine blocked in accept()
+	unix.Shutdown(as.listenFd, unix.SHUT_RDWR)
+	as.wg.Wait()
+	err := unix.Close(as.listenFd)
+	unix.Unlink(as.path)
+	return err
+}
+
+// detach stops accepting clients but leaves the socket path alone, since
+// a process that took over from this one has bound it afresh
+func (as *AdminServer) detach() {
+	as.mu.Lock()
+	if as.closed || as.listenFd < 0 {
+		as.mu.Unlock()
+		return
+	}
+	as.closed = true
+	as.mu.Unlock()
+
+	unix.Shutdown(as.listenFd, unix.SHUT_RDWR)
+	as.wg.Wait()
+	unix.Close(as.listenFd)
+}
+
+// acceptLoop accepts control clients until the listener is shut down
+func (as *AdminServer) acceptLoop() {
+	defer as.wg.Done()
+
+	for {
+		clientFd, _, err := unix.Accept(as.listenFd)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			as.mu.RLock()
+			closed := as.closed
+			as.mu.RUnlock()
+			if !closed {
+				logErrorf("Admin accept failed: %v", err)
+			}
+			return
+		}
+		if uid, err := peerUID(clientFd); err != nil || uid != os.Geteuid() {
+			logWarnf("Admin client refused: uid %d is not the server's", uid)
+			unix.Close(clientFd)
+			continue
+		}
+		go as.serveClient(clientFd)
+	}
+}
+
+// serveClient reads command lines from one client until it disconnects
+func (as *AdminServer) serveClient(fd int) {
+	defer unix.Close(fd)
+
+	buffer := make([]byte, 4096)
+	var pending []byte
+
+	for {
+		n, err := unix.Read(fd, buffer)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return
+		}
+		if n == 0 {
+			return
+		}
+		pending = append(pending, buffer[:n]...)
+
+		for {
+			lineEnd := -1
+			for i, c := range pending {
+				if c == '\n' {
+					lineEnd = i
+					break
+				}
+			}
+			if lineEnd < 0 {
+				break
+			}
+
+			line := trimSpace(string(pending[:lineEnd]))
+			pending = pending[lineEnd+1:]
+			if len(line) > 0 && line[len(line)-1] == '\r' {
+				line = line[:len(line)-1]
+			}
+			if line == "" {
+				continue
+			}
+
+			if err := writeAll(fd, []byte(as.Execute(line))); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeAll writes the whole buffer to a blocking file descriptor
+func writeAll(fd int, data []byte) error {
+	for len(data) > 0 {
+		n, err := unix.Write(fd, data)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
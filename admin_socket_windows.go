@@ -0,0 +1,17 @@
+package ultrafast
+
+import "fmt"
+
+// Start is not supported on Windows: the control channel is a unix
+// socket. Commands can still be run with Execute.
+func (as *AdminServer) Start() error {
+	return fmt.Errorf("admin socket is not supported on windows")
+}
+
+// Close does nothing on Windows; Start never listens
+func (as *AdminServer) Close() error {
+	return nil
+}
+
+// detach does nothing on Windows; Start never listens
+func (as *AdminServer) detach() {}
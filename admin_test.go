@@ -0,0 +1,95 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestAdminExecute(t *testing.T) {
+	admin := NewAdminServer("")
+	admin.RegisterCommand("echo", "echo args", func(args []string) (string, error) {
+		return joinStrings(args, " "), nil
+	})
+	admin.RegisterCommand("fail", "fail", func(args []string) (string, error) {
+		return "", fmt.Errorf("boom")
+	})
+
+	testCases := []struct {
+		name     string
+		line     string
+		expected string
+	}{
+		{"Command with args", "echo hello  world", "hello world\nOK\n"},
+		{"Command error", "fail", "ERR boom\n"},
+		{"Unknown command", "nope", "ERR unknown command: nope\n"},
+		{"Empty line", "   ", "ERR empty command\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := admin.Execute(tc.line); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAdminUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "admin.sock")
+	admin := NewAdminServer(path)
+	admin.RegisterCommand("loglevel", "loglevel", func(args []string) (string, error) {
+		return GetLogLevel().String(), nil
+	})
+	if err := admin.Start(); err != nil {
+		t.Fatalf("Failed to start admin server: %v", err)
+	}
+	defer admin.Close()
+
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("Failed to create client socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	if err := syscall.Connect(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := writeAll(fd, []byte("loglevel\n")); err != nil {
+		t.Fatalf("Failed to write command: %v", err)
+	}
+
+	expected := GetLogLevel().String() + "\nOK\n"
+	reply := make([]byte, 0, 64)
+	buffer := make([]byte, 64)
+	for len(reply) < len(expected) {
+		n, err := syscall.Read(fd, buffer)
+		if err != nil || n == 0 {
+			t.Fatalf("Failed to read reply: n=%d err=%v", n, err)
+		}
+		reply = append(reply, buffer[:n]...)
+	}
+
+	if string(reply) != expected {
+		t.Errorf("Expected reply %q, got %q", expected, string(reply))
+	}
+}
+
+func TestAdminRefusesOtherUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "admin.sock")
+	admin := NewAdminServer(path)
+	if err := admin.Start(); err != nil {
+		t.Fatalf("Failed to start admin server: %v", err)
+	}
+	defer admin.Close()
+	exposeSocket(t, path)
+
+	fd := dialUnixAs(t, nobodyUID, syscall.SOCK_STREAM, path)
+	writeAll(fd, []byte("help\n"))
+	if n, err := syscall.Read(fd, make([]byte, 64)); n > 0 {
+		t.Errorf("Expected a client of another user hung up on, got a reply (%v)", err)
+	}
+}
@@ -0,0 +1,98 @@
+package ultrafast
+
+import (
+	"context"
+	"testing"
+)
+
+// Allocation budgets for the request hot paths. Each path may allocate at
+// most its budget per call, so a change that adds an allocation fails
+// here rather than showing up later as GC pressure. A change that removes
+// one should lower the budget to lock the gain in. Run
+//
+//	go test -run TestAllocationBudgets -v
+//
+// to see every path's current count next to its budget.
+var allocationBudgets = map[string]float64{
+	"recv":    6, // includes sending the datagram
+	"parse":   7,
+	"handle":  6,
+	"respond": 3,
+}
+
+// allocationRequest is a typical small request
+const allocationRequest = "GET /benchmark HTTP/1.1\r\nHost: localhost\r\nUser-Agent: alloc-test\r\n\r\n"
+
+func TestAllocationBudgets(t *testing.T) {
+	if raceEnabled {
+		t.Skip("The race detector changes allocation counts")
+	}
+	server, err := NewUltraFastHTTPServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	h := &HTTPSocketHandler{server: server, reader: NewPacketReader(server.socket)}
+
+	// Responses go to a peer that never reads; the kernel drops them
+	sink := newBoundSocket(t).GetLocalAddr()
+	sender := newBoundSocket(t)
+	local := server.socket.GetLocalAddr()
+
+	request := NewPacket(DATA_PACKET, 0, 1, 0, []byte(allocationRequest))
+	request.SetRequestID(1)
+	datagram := request.Serialize()
+	parsed, err := h.parseHTTPRequest([]byte(allocationRequest))
+	if err != nil {
+		t.Fatalf("Failed to parse request: %v", err)
+	}
+	ctx := context.Background()
+	response := h.handleHTTPRequest(ctx, parsed)
+
+	paths := map[string]func(){
+		"recv": func() {
+			sender.SendTo(datagram, local.IP, local.Port)
+			if _, _, err := h.reader.ReadPacket(); err != nil {
+				t.Fatalf("ReadPacket failed: %v", err)
+			}
+		},
+		"parse": func() {
+			h.parseHTTPRequest(request.Payload)
+		},
+		"handle": func() {
+			h.handleHTTPRequest(ctx, parsed)
+		},
+		"respond": func() {
+			h.respond(parsed, response, sink, len(datagram))
+		},
+	}
+
+	for _, name := range []string{"recv", "parse", "handle", "respond"} {
+		path := paths[name]
+		path() // warm pools and caches
+		allocs := testing.AllocsPerRun(100, path)
+		budget := allocationBudgets[name]
+		t.Logf("%-8s %6.1f allocs/op (budget %.0f)", name, allocs, budget)
+		if allocs > budget {
+			t.Errorf("%s allocates %.1f times per call, over its budget of %.0f", name, allocs, budget)
+		}
+	}
+}
+
+func TestGCStatsPerRequest(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+	for i := 0; i < 3; i++ {
+		if _, err := client.Get("/benchmark"); err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+	}
+
+	stats := server.GCStats()
+	if stats.Allocations == 0 || stats.AllocsPerRequest <= 0 {
+		t.Errorf("Expected allocations attributed to requests, got %+v", stats)
+	}
+	if stats.HeapBytes == 0 {
+		t.Error("Expected a non-empty heap")
+	}
+}
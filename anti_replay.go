@@ -0,0 +1,89 @@
+package ultrafast
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// replayWindowSize is how many packet numbers below the highest seen a
+// connection still accepts, for packets reordered on the way
+const replayWindowSize = 1024
+
+// replayWindow is a connection's anti-replay window over the packet
+// numbers of authenticated packets, as in IPsec (RFC 4303 section 3.4.3):
+// a number is accepted once, and only if it is above the highest seen or
+// within replayWindowSize of it. The bitmap is a ring indexed by number,
+// as in RFC 6479, so advancing the window only clears the slots it
+// passes over.
+type replayWindow struct {
+	mu      sync.Mutex
+	highest uint64
+	bits    [replayWindowSize / 64]uint64
+}
+
+// seed starts the window at the packet that established the connection:
+// that number and everything below it count as seen, so no packet
+// captured from before the connection is accepted on it
+func (w *replayWindow) seed(number uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.highest = number
+	for i := range w.bits {
+		w.bits[i] = ^uint64(0)
+	}
+}
+
+// accept reports whether a packet number is new to the window, and
+// records it if so
+func (w *replayWindow) accept(number uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch {
+	case number > w.highest:
+		if number-w.highest >= replayWindowSize {
+			w.bits = [replayWindowSize / 64]uint64{}
+		} else {
+			for n := w.highest + 1; n < number; n++ {
+				w.bits[n/64%uint64(len(w.bits))] &^= 1 << (n % 64)
+			}
+		}
+		w.highest = number
+	case w.highest-number >= replayWindowSize:
+		return false
+	case w.bits[number/64%uint64(len(w.bits))]&(1<<(number%64)) != 0:
+		return false
+	}
+	w.bits[number/64%uint64(len(w.bits))] |= 1 << (number % 64)
+	return true
+}
+
+// checkReplay reports whether an authenticated packet is new to its
+// connection's replay window, counting it as a replay if not. It runs
+// before the packet can move its connection to a new address. Packets
+// outside a connection are left to the handshake and to handleDataPacket.
+func (h *HTTPSocketHandler) checkReplay(packet *Packet, from SocketAddr) bool {
+	number, ok := packetNumber(packet)
+	if !ok || !h.server.socket.PacketAuthEnabled() {
+		return true
+	}
+	conn := h.server.connections.Get(from)
+	if id, hasID := packet.ConnectionID(); hasID {
+		if byID := h.server.connections.GetByID(id); byID != nil {
+			conn = byID
+		}
+	}
+	if conn == nil || conn.replay.accept(number) {
+		return true
+	}
+	atomic.AddUint64(&h.server.stats.ReplaysRejected, 1)
+	return false
+}
+
+// seedReplayWindow starts a new connection's replay window at the packet
+// that established it
+func (h *HTTPSocketHandler) seedReplayWindow(conn *Connection, packet *Packet) {
+	if number, ok := packetNumber(packet); ok && h.server.socket.PacketAuthEnabled() {
+		conn.replay.seed(number)
+	}
+}
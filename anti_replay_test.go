@@ -0,0 +1,106 @@
+package ultrafast
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	w.seed(5000)
+
+	for _, step := range []struct {
+		number uint64
+		accept bool
+	}{
+		{5000, false}, // the packet that established the connection
+		{4999, false}, // from before the connection
+		{5001, true},
+		{5001, false},
+		{5003, true},
+		{5002, true}, // reordered, still in the window
+		{5002, false},
+		{5003 + replayWindowSize - 1, true},
+		{5002, false}, // now too old
+		{5003, false},
+		{5004, true},                       // the oldest still in the window
+		{5004 + 10*replayWindowSize, true}, // a jump clears the window
+		{5004 + 10*replayWindowSize - 1, true},
+		{5004 + 9*replayWindowSize, false},
+	} {
+		if got := w.accept(step.number); got != step.accept {
+			t.Errorf("Packet %d: expected accepted %v, got %v", step.number, step.accept, got)
+		}
+	}
+
+	// An unseeded window takes the first number it sees
+	var fresh replayWindow
+	if !fresh.accept(1) || fresh.accept(1) {
+		t.Error("Unseeded window should accept a number once")
+	}
+}
+
+func TestServerRejectsReplays(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	server := startTestServer(t)
+	server.SetPacketAuth(key)
+	var calls atomic.Int32
+	server.HandleFunc("/count", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		calls.Add(1)
+		return &HTTPResponse{StatusCode: 200, Body: []byte("counted")}
+	})
+
+	client := newTestClient(t, server)
+	client.SetPacketAuth(key)
+	if _, err := client.Get("/count"); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	// A request tagged once and sent twice, as if captured and replayed
+	request := NewPacket(DATA_PACKET, 0, client.nextSeq, 0, buildGetRequest("/count", client.server))
+	request.SetRequestID(client.newRequestID())
+	id, _ := client.ConnectionID()
+	request.SetConnectionID(id)
+	client.socket.signPacket(request)
+	captured := request.Serialize()
+
+	addr := server.socket.GetLocalAddr()
+	waitFor := func(replays uint64) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for server.GetStats().ReplaysRejected < replays && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if rejected := server.GetStats().ReplaysRejected; rejected != replays {
+			t.Fatalf("Expected %d replays rejected, got %d", replays, rejected)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := client.socket.SendTo(captured, addr.IP, addr.Port); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(1)
+	deadline := time.Now().Add(time.Second)
+	for calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Once the connection is gone the replay has no window to be checked
+	// against, but is not served outside a connection either
+	client.Close()
+	attacker, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+	if _, err := attacker.SendTo(captured, addr.IP, addr.Port); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(2)
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Expected the handler to run twice, got %d", n)
+	}
+}
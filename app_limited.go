@@ -0,0 +1,24 @@
+package ultrafast
+
+import "sync/atomic"
+
+// appLimitedSend reports whether a DATA packet sent with inFlight packets
+// in flight, itself included, leaves the congestion window less than half
+// used. The sender is then limited by how much the application gives it
+// rather than by the window, and the packet's ACK shows nothing about
+// whether a larger window would be safe, so it does not grow the window
+// (RFC 7661). Without this a connection trickling small responses would
+// inflate its window to the limit, and a later burst would go out at a
+// rate the path was never shown to carry.
+func (rf *LockFreeReliabilityLayer) appLimitedSend(inFlight int64) bool {
+	window := min(atomic.LoadUint32(&rf.congWindow), atomic.LoadUint32(&rf.windowSize))
+	return 2*inFlight < int64(window)
+}
+
+// AppLimited reports whether the connection is application-limited: it
+// has nothing in flight, or the last packet it sent left the congestion
+// window less than half used. ACKs for packets sent while it is do not
+// grow the window.
+func (rf *LockFreeReliabilityLayer) AppLimited() bool {
+	return atomic.LoadInt64(&rf.inFlight) == 0 || atomic.LoadUint32(&rf.appLimited) != 0
+}
@@ -0,0 +1,88 @@
+package ultrafast
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAppLimitedAcksDoNotGrowWindow(t *testing.T) {
+	rel := newFastRetransmitLayer(0, 8)
+	ack := func(seq uint32) {
+		t.Helper()
+		if !rel.ProcessAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, seq+1, nil)).Matched {
+			t.Fatalf("ACK for %d was not matched", seq)
+		}
+	}
+	if !rel.AppLimited() {
+		t.Error("An idle connection should be application-limited")
+	}
+
+	// One packet at a time never uses half the window
+	for i := 0; i < 4; i++ {
+		seq := rel.GetNextSeqNum()
+		rel.SendPacket(NewPacket(DATA_PACKET, 0, seq, 0, nil))
+		if !rel.AppLimited() {
+			t.Fatalf("Packet %d alone in flight should be application-limited", seq)
+		}
+		ack(seq)
+	}
+	if cwnd := rel.GetStats().CongestionWindow; cwnd != 8 {
+		t.Errorf("Application-limited ACKs should not grow the window, got %d", cwnd)
+	}
+
+	// Packets sent once half of it is used test the window, and their
+	// ACKs grow it
+	var seqs []uint32
+	for i := 0; i < 6; i++ {
+		seqs = append(seqs, rel.GetNextSeqNum())
+		rel.SendPacket(NewPacket(DATA_PACKET, 0, seqs[i], 0, nil))
+	}
+	if rel.AppLimited() {
+		t.Error("A window more than half used should not be application-limited")
+	}
+	for _, seq := range seqs {
+		ack(seq)
+	}
+	if cwnd := rel.GetStats().CongestionWindow; cwnd != 11 {
+		t.Errorf("Expected the last 3 of 6 ACKs to grow the window to 11, got %d", cwnd)
+	}
+}
+
+func TestHandleAckSkipsAppLimitedGrowth(t *testing.T) {
+	rel := NewLockFreeReliabilityLayer()
+	atomic.StoreUint32(&rel.congWindow, 4)
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, 1, 0, nil))
+	rel.HandleAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, 2, nil))
+	if cwnd := rel.GetStats().CongestionWindow; cwnd != 4 {
+		t.Errorf("Expected the window left at 4, got %d", cwnd)
+	}
+
+	// The flow control window bounds how much of it can be used
+	atomic.StoreUint32(&rel.windowSize, 2)
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, 2, 0, nil))
+	rel.HandleAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, 3, nil))
+	if cwnd := rel.GetStats().CongestionWindow; cwnd != 2 {
+		t.Errorf("Expected growth capped at the flow control window, got %d", cwnd)
+	}
+}
+
+func TestConnectionInfoAppLimited(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+	if _, err := client.Get("/benchmark"); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	waitForConnections(t, server, 1)
+
+	// Once the response is acknowledged the connection sits idle
+	deadline := time.Now().Add(2 * time.Second)
+	info := server.Connections()[0]
+	for info.BytesInFlight != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		info = server.Connections()[0]
+	}
+	if !info.AppLimited {
+		t.Errorf("Expected an idle connection reported application-limited, got %+v", info)
+	}
+}
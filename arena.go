@@ -0,0 +1,106 @@
+package ultrafast
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// slabChunkSize is how many objects a slab allocates at once
+const slabChunkSize = 256
+
+// Slab allocates fixed-size objects in chunks and recycles them through a
+// free list. Unlike a sync.Pool, whose contents the GC may drop at any
+// collection, a slab keeps what it allocated: at high connection rates
+// the same objects are handed out again instead of being reallocated
+// after every GC cycle, and Stats tells how many are in use.
+//
+// Objects must be returned with Put only once nothing refers to them;
+// structures read without locks retire them through an EpochDomain
+// first. A slab never gives its memory back.
+type Slab[T any] struct {
+	mu        sync.Mutex
+	free      []*T
+	chunk     []T // the unused rest of the newest chunk
+	chunkSize int
+	chunks    int
+	live      int
+}
+
+// SlabStats describes a slab's objects
+type SlabStats struct {
+	Live   int // handed out and not yet returned
+	Free   int // ready to be handed out
+	Chunks int // chunks allocated so far
+}
+
+// NewSlab creates a slab allocating chunkSize objects at a time
+func NewSlab[T any](chunkSize int) *Slab[T] {
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	return &Slab[T]{chunkSize: chunkSize}
+}
+
+// Get returns a zeroed object
+func (s *Slab[T]) Get() *T {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.live++
+	if n := len(s.free); n > 0 {
+		obj := s.free[n-1]
+		s.free[n-1] = nil
+		s.free = s.free[:n-1]
+		return obj
+	}
+	if len(s.chunk) == 0 {
+		s.chunk = make([]T, s.chunkSize)
+		s.chunks++
+	}
+	obj := &s.chunk[0]
+	s.chunk = s.chunk[1:]
+	return obj
+}
+
+// Put clears obj and makes it available to Get again
+func (s *Slab[T]) Put(obj *T) {
+	var zero T
+	*obj = zero
+
+	s.mu.Lock()
+	s.free = append(s.free, obj)
+	s.live--
+	s.mu.Unlock()
+}
+
+// release is Put for an EpochDomain's free function
+func (s *Slab[T]) release(ptr unsafe.Pointer) {
+	s.Put((*T)(ptr))
+}
+
+// Stats returns the slab's current object counts
+func (s *Slab[T]) Stats() SlabStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SlabStats{
+		Live:   s.live,
+		Free:   len(s.free) + len(s.chunk),
+		Chunks: s.chunks,
+	}
+}
+
+// AllocatorStats describes the slabs behind the reliability layers
+type AllocatorStats struct {
+	UnackedEntries SlabStats // packets awaiting acknowledgment
+	QueueNodes     SlabStats // received packets not yet consumed
+	WheelTimers    SlabStats // retransmission timers, including those of packets acknowledged since
+}
+
+// AllocatorStats returns the reliability slabs' object counts. The slabs
+// are shared by every server in the process.
+func (s *UltraFastHTTPServer) AllocatorStats() AllocatorStats {
+	return AllocatorStats{
+		UnackedEntries: unackedEntries.Stats(),
+		QueueNodes:     queueNodes.Stats(),
+		WheelTimers:    wheelTimers.Stats(),
+	}
+}
@@ -0,0 +1,104 @@
+package ultrafast
+
+import "testing"
+
+func TestSlabRecyclesObjects(t *testing.T) {
+	slab := NewSlab[UnackedEntry](4)
+
+	var entries []*UnackedEntry
+	for i := 0; i < 6; i++ {
+		entry := slab.Get()
+		entry.RetryCount = uint32(i + 1)
+		entries = append(entries, entry)
+	}
+	if stats := slab.Stats(); stats != (SlabStats{Live: 6, Free: 2, Chunks: 2}) {
+		t.Errorf("Expected 6 live and 2 free in 2 chunks, got %+v", stats)
+	}
+
+	slab.Put(entries[5])
+	if reused := slab.Get(); reused != entries[5] {
+		t.Error("Get should hand out the object just returned")
+	} else if reused.RetryCount != 0 {
+		t.Errorf("Returned object was not cleared: %+v", *reused)
+	}
+
+	for _, entry := range entries {
+		slab.Put(entry)
+	}
+	if stats := slab.Stats(); stats != (SlabStats{Live: 0, Free: 8, Chunks: 2}) {
+		t.Errorf("Expected every object free, got %+v", stats)
+	}
+}
+
+func TestDetachReleasesReliabilityState(t *testing.T) {
+	shards := NewReliabilityShards(1)
+	conn := &Connection{}
+	shards.Attach(conn, SocketAddr{IP: "127.0.0.1", Port: 9000})
+	layer := conn.reliability
+	before := unackedEntries.Stats().Live
+
+	for i := 0; i < 10; i++ {
+		if !layer.SendPacket(NewPacket(DATA_PACKET, 0, layer.GetNextSeqNum(), 0, nil)) {
+			t.Fatalf("SendPacket %d failed", i)
+		}
+	}
+	layer.ReceivePacket(NewPacket(DATA_PACKET, 0, 1, 0, nil))
+	if live := unackedEntries.Stats().Live; live != before+10 {
+		t.Fatalf("Expected 10 more live entries, got %d more", live-before)
+	}
+
+	shards.Detach(conn)
+	if count := layer.UnackedCount(); count != 0 {
+		t.Errorf("Expected the unacked table drained, %d left", count)
+	}
+	// Nothing is pinned, so two advances free everything retired
+	shard := &shards.shards[0]
+	for _, domain := range []*EpochDomain{shard.entries, shard.nodes} {
+		domain.TryAdvance()
+		domain.TryAdvance()
+		if stats := domain.Stats(); stats.Freed != stats.Retired {
+			t.Errorf("Expected every retired object freed, got %+v", stats)
+		}
+	}
+	if freed := shard.entries.Stats().Freed; freed != 10 {
+		t.Errorf("Expected 10 entries back in the slab, got %d", freed)
+	}
+	if freed := shard.nodes.Stats().Freed; freed != 1 {
+		t.Errorf("Expected the queued packet's node back in the slab, got %d", freed)
+	}
+
+	// A closed layer keeps nothing new
+	if layer.SendPacket(NewPacket(DATA_PACKET, 0, layer.GetNextSeqNum(), 0, nil)) {
+		t.Error("SendPacket should be refused after Detach")
+	}
+	if count := layer.UnackedCount(); count != 0 {
+		t.Errorf("Expected nothing tracked after Detach, %d left", count)
+	}
+}
+
+func TestClosedConnectionsRetireEveryEntry(t *testing.T) {
+	server := startTestServer(t)
+	server.SetKeepAlive(KeepAliveConfig{MaxRequests: 1})
+	client := newTestClient(t, server)
+
+	for i := 0; i < 4; i++ {
+		if _, err := client.Get("/benchmark"); err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		waitForConnections(t, server, 0)
+	}
+
+	// Every entry a connection inserted was acked, expired or released
+	// when it closed, so none is left for the GC
+	var sent, retired uint64
+	for i := range server.reliability.shards {
+		shard := &server.reliability.shards[i]
+		shard.mu.Lock()
+		sent += shard.detached.PacketsSent
+		shard.mu.Unlock()
+		retired += shard.entries.Stats().Retired
+	}
+	if sent == 0 || retired != sent {
+		t.Errorf("Expected all %d entries retired, got %d", sent, retired)
+	}
+}
@@ -0,0 +1,32 @@
+package ultrafast
+
+import "sync"
+
+// Capabilities reports which optional kernel features this host
+// supports. Each is probed at run time rather than assumed from the
+// kernel version, since distributions backport features and configs
+// leave them out.
+type Capabilities struct {
+	Kernel         string // kernel release, as uname reports it
+	ReusePort      bool   // SO_REUSEPORT
+	Timestamping   bool   // SO_TIMESTAMPING software timestamps
+	ZeroCopy       bool   // SO_ZEROCOPY, so MSG_ZEROCOPY sends avoid the copy (UDP: Linux 5.0+)
+	GSO            bool   // UDP_SEGMENT, one send split into datagrams by the kernel (4.18+)
+	GRO            bool   // UDP_GRO, coalesced receives (5.0+)
+	BusyPoll       bool   // SO_BUSY_POLL (CONFIG_NET_RX_BUSY_POLL)
+	EpollExclusive bool   // EPOLLEXCLUSIVE (4.5+)
+}
+
+var (
+	capabilitiesProbe sync.Once
+	capabilities      Capabilities
+)
+
+// KernelCapabilities returns the host's optional kernel features,
+// probing them on first use
+func KernelCapabilities() Capabilities {
+	capabilitiesProbe.Do(func() {
+		capabilities = probeCapabilities()
+	})
+	return capabilities
+}
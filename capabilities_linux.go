@@ -0,0 +1,32 @@
+package ultrafast
+
+import "golang.org/x/sys/unix"
+
+// probeCapabilities tries each socket option on a scratch UDP socket;
+// kernels without a feature reject its option with ENOPROTOOPT or
+// EOPNOTSUPP
+func probeCapabilities() Capabilities {
+	caps := Capabilities{EpollExclusive: epollExclusiveSupported()}
+
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err == nil {
+		caps.Kernel = unix.ByteSliceToString(uname.Release[:])
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return caps
+	}
+	defer unix.Close(fd)
+
+	caps.ReusePort = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1) == nil
+	caps.Timestamping = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPING,
+		unix.SOF_TIMESTAMPING_RX_SOFTWARE|unix.SOF_TIMESTAMPING_TX_SOFTWARE) == nil
+	caps.ZeroCopy = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ZEROCOPY, 1) == nil
+	caps.GSO = unix.SetsockoptInt(fd, unix.SOL_UDP, unix.UDP_SEGMENT, 1400) == nil
+	caps.GRO = unix.SetsockoptInt(fd, unix.SOL_UDP, unix.UDP_GRO, 1) == nil
+	// Reading needs no privilege, unlike raising the value
+	_, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_BUSY_POLL)
+	caps.BusyPoll = err == nil
+	return caps
+}
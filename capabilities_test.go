@@ -0,0 +1,34 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKernelCapabilities(t *testing.T) {
+	caps := KernelCapabilities()
+	t.Logf("%+v", caps)
+	if caps.Kernel == "" {
+		t.Error("Expected the kernel release")
+	}
+	// Every kernel this code runs on has had these for years
+	if !caps.ReusePort || !caps.Timestamping {
+		t.Errorf("Expected SO_REUSEPORT and SO_TIMESTAMPING, got %+v", caps)
+	}
+	if caps.EpollExclusive != epollExclusiveSupported() {
+		t.Error("EpollExclusive disagrees with the epoll probe")
+	}
+	if again := KernelCapabilities(); again != caps {
+		t.Errorf("Probing again gave %+v", again)
+	}
+
+	server := startTestServer(t)
+	admin := NewAdminServer("")
+	server.registerAdminCommands(admin)
+	reply := admin.Execute("capabilities")
+	if !strings.Contains(reply, "kernel="+caps.Kernel) || !strings.HasSuffix(reply, "OK\n") {
+		t.Errorf("Unexpected capabilities reply: %q", reply)
+	}
+}
@@ -0,0 +1,7 @@
+package ultrafast
+
+// probeCapabilities reports nothing on Windows: every capability is a
+// Linux socket option
+func probeCapabilities() Capabilities {
+	return Capabilities{}
+}
@@ -0,0 +1,40 @@
+package ultrafast
+
+import "encoding/binary"
+
+// sumPadded adds up data as big-endian 32-bit words, wrapping at 32 bits,
+// with a trailing partial word padded with zero bytes
+func sumPadded(data []byte) uint32 {
+	n := len(data) &^ 3
+	sum := sumWords(data[:n])
+	if n < len(data) {
+		var word uint32
+		for j := n; j < len(data); j++ {
+			word |= uint32(data[j]) << (8 * (3 - (j - n)))
+		}
+		sum += word
+	}
+	return sum
+}
+
+// foldChecksum folds a word sum to 16 bits and complements it
+func foldChecksum(sum uint32) uint32 {
+	for (sum >> 16) > 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return ^sum & 0xFFFFFFFF
+}
+
+// sumWordsGeneric is the portable sumWords, taking two words per load
+func sumWordsGeneric(data []byte) uint32 {
+	var sum uint32
+	i := 0
+	for ; i+8 <= len(data); i += 8 {
+		v := binary.BigEndian.Uint64(data[i:])
+		sum += uint32(v>>32) + uint32(v)
+	}
+	if i < len(data) {
+		sum += binary.BigEndian.Uint32(data[i:])
+	}
+	return sum
+}
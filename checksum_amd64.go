@@ -0,0 +1,26 @@
+package ultrafast
+
+import "golang.org/x/sys/cpu"
+
+// useAVX2 is set when the CPU and OS support AVX2, which sums 32 bytes of
+// words per instruction
+var useAVX2 = cpu.X86.HasAVX2
+
+// useNEON is always false here; see checksum_arm64.go
+const useNEON = false
+
+// sumWordsAVX2 is sumWords for data whose length is a multiple of 32
+//
+//go:noescape
+func sumWordsAVX2(data []byte) uint32
+
+// sumWords adds up data as big-endian 32-bit words, wrapping at 32 bits.
+// len(data) must be a multiple of 4. Below 64 bytes the vector setup
+// costs more than it saves.
+func sumWords(data []byte) uint32 {
+	if !useAVX2 || len(data) < 64 {
+		return sumWordsGeneric(data)
+	}
+	n := len(data) &^ 31
+	return sumWordsAVX2(data[:n]) + sumWordsGeneric(data[n:])
+}
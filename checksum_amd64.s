@@ -0,0 +1,55 @@
+#include "textflag.h"
+
+// func sumWordsAVX2(data []byte) uint32
+//
+// Each 32-byte block is byte-swapped to host order within its 32-bit
+// words and added lane-wise; lanes wrap at 32 bits like the scalar sum,
+// so adding them together at the end gives the same result.
+TEXT ·sumWordsAVX2(SB), NOSPLIT, $0-28
+	MOVQ    data_base+0(FP), SI
+	MOVQ    data_len+8(FP), CX
+	VMOVDQU bswapMask<>(SB), Y2
+	VPXOR   Y0, Y0, Y0
+	VPXOR   Y1, Y1, Y1
+
+	// Two accumulators, 64 bytes per iteration
+loop64:
+	CMPQ    CX, $64
+	JB      tail32
+	VMOVDQU (SI), Y3
+	VMOVDQU 32(SI), Y4
+	VPSHUFB Y2, Y3, Y3
+	VPSHUFB Y2, Y4, Y4
+	VPADDD  Y3, Y0, Y0
+	VPADDD  Y4, Y1, Y1
+	ADDQ    $64, SI
+	SUBQ    $64, CX
+	JMP     loop64
+
+tail32:
+	CMPQ    CX, $32
+	JB      reduce
+	VMOVDQU (SI), Y3
+	VPSHUFB Y2, Y3, Y3
+	VPADDD  Y3, Y0, Y0
+
+	// Add the eight lanes together
+reduce:
+	VPADDD       Y1, Y0, Y0
+	VEXTRACTI128 $1, Y0, X1
+	VPADDD       X1, X0, X0
+	VPSHUFD      $0x4E, X0, X1
+	VPADDD       X1, X0, X0
+	VPSHUFD      $0xB1, X0, X1
+	VPADDD       X1, X0, X0
+	VMOVD        X0, AX
+	VZEROUPPER
+	MOVL         AX, ret+24(FP)
+	RET
+
+// Reverses the bytes of each 32-bit word, within both 128-bit lanes
+DATA bswapMask<>+0(SB)/8, $0x0405060700010203
+DATA bswapMask<>+8(SB)/8, $0x0c0d0e0f08090a0b
+DATA bswapMask<>+16(SB)/8, $0x0405060700010203
+DATA bswapMask<>+24(SB)/8, $0x0c0d0e0f08090a0b
+GLOBL bswapMask<>(SB), RODATA|NOPTR, $32
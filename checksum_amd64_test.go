@@ -0,0 +1,19 @@
+package ultrafast
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestSumWordsAVX2(t *testing.T) {
+	if !useAVX2 {
+		t.Skip("CPU has no AVX2")
+	}
+	data := make([]byte, 32*9)
+	rand.New(rand.NewSource(2)).Read(data)
+	for size := 0; size <= len(data); size += 32 {
+		if got, want := sumWordsAVX2(data[:size]), sumWordsReference(data[:size]); got != want {
+			t.Errorf("%d bytes: expected 0x%08X, got 0x%08X", size, want, got)
+		}
+	}
+}
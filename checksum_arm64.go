@@ -0,0 +1,27 @@
+package ultrafast
+
+import "golang.org/x/sys/cpu"
+
+// useNEON is set when the CPU has Advanced SIMD, which sums 16 bytes of
+// words per instruction. Every arm64 CPU Go runs on has it, but it is
+// checked like AVX2 is.
+var useNEON = cpu.ARM64.HasASIMD
+
+// useAVX2 is always false here; see checksum_amd64.go
+const useAVX2 = false
+
+// sumWordsNEON is sumWords for data whose length is a multiple of 32
+//
+//go:noescape
+func sumWordsNEON(data []byte) uint32
+
+// sumWords adds up data as big-endian 32-bit words, wrapping at 32 bits.
+// len(data) must be a multiple of 4. Below 64 bytes the vector setup
+// costs more than it saves.
+func sumWords(data []byte) uint32 {
+	if !useNEON || len(data) < 64 {
+		return sumWordsGeneric(data)
+	}
+	n := len(data) &^ 31
+	return sumWordsNEON(data[:n]) + sumWordsGeneric(data[n:])
+}
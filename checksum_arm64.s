@@ -0,0 +1,45 @@
+#include "textflag.h"
+
+// func sumWordsNEON(data []byte) uint32
+//
+// Each 16-byte register is byte-swapped to host order within its 32-bit
+// words and added lane-wise; lanes wrap at 32 bits like the scalar sum,
+// so adding them together at the end gives the same result.
+TEXT ·sumWordsNEON(SB), NOSPLIT, $0-28
+	MOVD data_base+0(FP), R0
+	MOVD data_len+8(FP), R1
+	VEOR V0.B16, V0.B16, V0.B16
+	VEOR V1.B16, V1.B16, V1.B16
+
+	// Two accumulators, 64 bytes per iteration
+loop64:
+	CMP    $64, R1
+	BLO    tail32
+	VLD1.P 64(R0), [V2.B16, V3.B16, V4.B16, V5.B16]
+	VREV32 V2.B16, V2.B16
+	VREV32 V3.B16, V3.B16
+	VREV32 V4.B16, V4.B16
+	VREV32 V5.B16, V5.B16
+	VADD   V2.S4, V0.S4, V0.S4
+	VADD   V3.S4, V1.S4, V1.S4
+	VADD   V4.S4, V0.S4, V0.S4
+	VADD   V5.S4, V1.S4, V1.S4
+	SUB    $64, R1, R1
+	B      loop64
+
+tail32:
+	CMP    $32, R1
+	BLO    reduce
+	VLD1   (R0), [V2.B16, V3.B16]
+	VREV32 V2.B16, V2.B16
+	VREV32 V3.B16, V3.B16
+	VADD   V2.S4, V0.S4, V0.S4
+	VADD   V3.S4, V1.S4, V1.S4
+
+	// Add the four lanes together
+reduce:
+	VADD  V1.S4, V0.S4, V0.S4
+	VADDV V0.S4, V0
+	VMOV  V0.S[0], R2
+	MOVW  R2, ret+24(FP)
+	RET
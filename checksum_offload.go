@@ -0,0 +1,81 @@
+package ultrafast
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// ChecksumMode chooses when a socket computes and verifies the packet
+// checksum in software. The kernel's UDP checksum covers every datagram
+// as well, so the packet checksum can be skipped where that is enough.
+type ChecksumMode int32
+
+const (
+	CHECKSUM_ALWAYS   ChecksumMode = iota // Compute and verify on every packet (default)
+	CHECKSUM_LOOPBACK                     // Skip for loopback peers, which never cross a wire
+	CHECKSUM_OFFLOAD                      // Skip for every peer, relying on the UDP checksum
+)
+
+// ParseChecksumMode converts a mode name into a ChecksumMode
+func ParseChecksumMode(name string) (ChecksumMode, error) {
+	switch name {
+	case "always":
+		return CHECKSUM_ALWAYS, nil
+	case "loopback":
+		return CHECKSUM_LOOPBACK, nil
+	case "offload":
+		return CHECKSUM_OFFLOAD, nil
+	}
+	return 0, fmt.Errorf("unknown checksum mode: %s", name)
+}
+
+// SetChecksumMode sets when the socket checksums packets. Both ends of a
+// connection must skip for the same peers: a socket that verifies drops
+// packets sent without a checksum. Skipping makes sure the kernel still
+// checksums outgoing datagrams.
+func (s *LinuxUDPSocket) SetChecksumMode(mode ChecksumMode) error {
+	if mode < CHECKSUM_ALWAYS || mode > CHECKSUM_OFFLOAD {
+		return fmt.Errorf("invalid checksum mode: %d", mode)
+	}
+	if mode != CHECKSUM_ALWAYS {
+		if err := keepUDPChecksum(s.sock()); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt32(&s.checksumMode, int32(mode))
+	return nil
+}
+
+// ChecksumMode returns when the socket checksums packets
+func (s *LinuxUDPSocket) ChecksumMode() ChecksumMode {
+	return ChecksumMode(atomic.LoadInt32(&s.checksumMode))
+}
+
+// checksumsFor reports whether packets to or from peer carry a software
+// checksum under the socket's mode
+func (s *LinuxUDPSocket) checksumsFor(peer SocketAddr) bool {
+	switch s.ChecksumMode() {
+	case CHECKSUM_OFFLOAD:
+		return false
+	case CHECKSUM_LOOPBACK:
+		return !isLoopback(peer.IP)
+	}
+	return true
+}
+
+// isLoopback reports whether ip is in 127.0.0.0/8
+func isLoopback(ip string) bool {
+	return strings.HasPrefix(ip, "127.")
+}
+
+// SetChecksumMode sets when the server's socket checksums packets
+func (s *UltraFastHTTPServer) SetChecksumMode(mode ChecksumMode) error {
+	return s.socket.SetChecksumMode(mode)
+}
+
+// SetChecksumMode sets when the client's socket checksums packets; it has
+// to match the server's
+func (c *UltraFastClient) SetChecksumMode(mode ChecksumMode) error {
+	return c.socket.SetChecksumMode(mode)
+}
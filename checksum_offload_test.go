@@ -0,0 +1,89 @@
+package ultrafast
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChecksumModeSkipsLoopback(t *testing.T) {
+	receiver := newBoundSocket(t)
+	sender := newBoundSocket(t)
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	addr := receiver.GetLocalAddr()
+	reader := NewPacketReader(receiver)
+
+	// A verifying receiver drops a packet sent without a checksum
+	if err := sender.SetChecksumMode(CHECKSUM_LOOPBACK); err != nil {
+		t.Fatalf("SetChecksumMode failed: %v", err)
+	}
+	packet := NewPacket(DATA_PACKET, 0, 1, 0, []byte("unchecked"))
+	sender.SendPacket(packet, addr.IP, addr.Port)
+	if packet.Checksum != CHECKSUM_NONE {
+		t.Fatalf("Expected no checksum to a loopback peer, got 0x%08X", packet.Checksum)
+	}
+	if _, _, err := reader.ReadPacket(); err == nil {
+		t.Fatal("A verifying receiver should reject a packet without a checksum")
+	}
+
+	// Once it skips too, the packet is accepted
+	receiver.SetChecksumMode(CHECKSUM_LOOPBACK)
+	sender.SendPacket(packet, addr.IP, addr.Port)
+	got, _, err := reader.ReadPacket()
+	if err != nil || string(got.Payload) != "unchecked" {
+		t.Fatalf("Expected the packet accepted, got %v, %v", got, err)
+	}
+
+	// Remote peers are still checksummed
+	if !sender.checksumsFor(SocketAddr{IP: "10.0.0.1", Port: 80}) {
+		t.Error("CHECKSUM_LOOPBACK should checksum non-loopback peers")
+	}
+	if err := sender.SetChecksumMode(ChecksumMode(7)); err == nil {
+		t.Error("An unknown mode should be rejected")
+	}
+}
+
+func TestChecksumOffloadEndToEnd(t *testing.T) {
+	server := startTestServer(t)
+	server.SetChecksumMode(CHECKSUM_OFFLOAD)
+	client := newTestClient(t, server)
+	client.SetChecksumMode(CHECKSUM_OFFLOAD)
+	if _, err := client.Get("/benchmark"); err != nil {
+		t.Fatalf("Request without checksums failed: %v", err)
+	}
+
+	// A client still verifying discards the server's replies
+	verifying := newTestClient(t, server)
+	verifying.SetTimeout(50 * time.Millisecond)
+	if _, err := verifying.Get("/benchmark"); err == nil {
+		t.Error("A verifying client should not accept replies without checksums")
+	}
+}
+
+// Checksum cost at full-size packets, with and without the software
+// checksum, for sending and receiving
+func BenchmarkChecksumModes(b *testing.B) {
+	packet := NewPacket(DATA_PACKET, 0, 1, 0, make([]byte, MAX_PAYLOAD_SIZE))
+	packet.SetRequestID(1)
+	data := packet.Serialize()
+	header := make([]byte, 0, 64)
+
+	for _, mode := range []struct {
+		name     string
+		checksum bool
+	}{{"software", true}, {"offload", false}} {
+		b.Run("encode/"+mode.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				header = packet.encodeHeader(header[:0], mode.checksum)
+			}
+		})
+		b.Run("decode/"+mode.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := decodePacket(data[:PACKET_HEADER_SIZE], data[PACKET_HEADER_SIZE:], mode.checksum); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
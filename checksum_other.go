@@ -0,0 +1,17 @@
+//go:build !amd64 && !arm64
+
+package ultrafast
+
+// sumWords adds up data as big-endian 32-bit words, wrapping at 32 bits.
+// len(data) must be a multiple of 4. Only amd64 and arm64 have a vector
+// version.
+func sumWords(data []byte) uint32 {
+	return sumWordsGeneric(data)
+}
+
+// useAVX2 and useNEON are always false here; see checksum_amd64.go and
+// checksum_arm64.go
+const (
+	useAVX2 = false
+	useNEON = false
+)
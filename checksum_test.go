@@ -0,0 +1,55 @@
+package ultrafast
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// sumWordsReference is the word sum written out the slow way
+func sumWordsReference(data []byte) uint32 {
+	var sum uint32
+	for i := 0; i+4 <= len(data); i += 4 {
+		sum += uint32(data[i])<<24 | uint32(data[i+1])<<16 | uint32(data[i+2])<<8 | uint32(data[i+3])
+	}
+	return sum
+}
+
+func TestSumWordsMatchesReference(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 2048+3)
+	rng.Read(random)
+	// All ones makes every lane wrap many times over
+	ones := bytes.Repeat([]byte{0xFF}, len(random))
+
+	for _, data := range [][]byte{random, ones} {
+		for offset := 0; offset < 4; offset++ {
+			for size := 0; size+offset <= len(data); size += 4 {
+				words := data[offset : offset+size]
+				want := sumWordsReference(words)
+				if got := sumWords(words); got != want {
+					t.Fatalf("%d bytes at offset %d: expected 0x%08X, got 0x%08X", size, offset, want, got)
+				}
+				if got := sumWordsGeneric(words); got != want {
+					t.Fatalf("Generic, %d bytes at offset %d: expected 0x%08X, got 0x%08X", size, offset, want, got)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkSumWords(b *testing.B) {
+	data := make([]byte, MAX_PAYLOAD_SIZE)
+	b.Run("dispatch", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for b.Loop() {
+			sumWords(data)
+		}
+	})
+	b.Run("generic", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for b.Loop() {
+			sumWordsGeneric(data)
+		}
+	})
+}
@@ -0,0 +1,154 @@
+package ultrafast
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+)
+
+// chunkFlushSize is how much body a streaming ResponseWriter buffers
+// before Write sends it as a chunk
+const chunkFlushSize = 16 * 1024
+
+// responseSink delivers a streamed response as it is produced. final
+// marks the last bytes of the response.
+type responseSink interface {
+	send(data []byte, final bool) error
+}
+
+// packetSink streams a response over DATA packets. Each packet is an
+// open-ended fragment until the last one, which carries the total length.
+type packetSink struct {
+	handler   *HTTPSocketHandler
+	ctx       context.Context
+	conn      *Connection
+	requestID uint32
+	offset    int64
+	bytesSent uint64
+}
+
+// send splits data into packets and sends them to the connection's peer
+func (ps *packetSink) send(data []byte, final bool) error {
+	if err := ps.ctx.Err(); err != nil {
+		return err
+	}
+	if ps.offset+int64(len(data)) >= FRAGMENT_TOTAL_OPEN {
+		return fmt.Errorf("streamed response exceeds %d bytes", uint32(FRAGMENT_TOTAL_OPEN-1))
+	}
+
+	to := ps.handler.server.connections.PeerOf(ps.conn)
+	for {
+		size := len(data)
+		if size > MAX_PAYLOAD_SIZE {
+			size = MAX_PAYLOAD_SIZE
+		}
+		last := final && size == len(data)
+		if size == 0 && !last {
+			return nil
+		}
+
+		total := uint32(FRAGMENT_TOTAL_OPEN)
+		if last {
+			total = uint32(ps.offset) + uint32(size)
+		}
+
+		// The writer reuses its buffer, but the packet is kept for
+		// retransmission, so each payload gets its own copy
+		payload := append([]byte(nil), data[:size]...)
+		sent, err := ps.handler.sendResponsePacket(payload, uint32(ps.offset), total, ps.conn, to, ps.requestID)
+		if err != nil {
+			atomic.AddUint64(&ps.handler.server.stats.Errors, 1)
+			return err
+		}
+		ps.bytesSent += uint64(sent)
+		ps.offset += int64(size)
+		data = data[size:]
+
+		if last {
+			atomic.AddUint64(&ps.handler.server.stats.ResponsesSent, 1)
+			atomic.AddUint64(&ps.handler.server.stats.BytesSent, ps.bytesSent)
+			return nil
+		}
+	}
+}
+
+// writerSink streams a response to a byte stream such as a TLS connection
+type writerSink struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+// send writes data to the stream
+func (ws *writerSink) send(data []byte, final bool) error {
+	if err := ws.ctx.Err(); err != nil {
+		return err
+	}
+	_, err := ws.w.Write(data)
+	return err
+}
+
+// Flush sends the headers and any buffered body immediately, switching the
+// response to chunked transfer encoding. Later writes are sent as further
+// chunks, so the body never has to be held in memory whole. Flush does
+// nothing for requests that cannot be streamed, such as those from peers
+// without a connection; their responses are sent whole as usual.
+func (w *ResponseWriter) Flush() error {
+	if w.sink == nil {
+		return nil
+	}
+	if w.sendErr != nil {
+		return w.sendErr
+	}
+
+	out := w.out[:0]
+	if !w.streaming {
+		out = w.appendStreamHead(out)
+		w.streaming = true
+	}
+	out = appendChunk(out, w.body)
+	w.out = out
+	w.body = w.body[:0]
+	if len(out) == 0 {
+		return nil
+	}
+
+	w.sent += int64(len(out))
+	w.sendErr = w.sink.send(out, false)
+	return w.sendErr
+}
+
+// finishStream sends the remaining body and the terminating chunk
+func (w *ResponseWriter) finishStream() error {
+	if w.sendErr != nil {
+		return w.sendErr
+	}
+	out := appendChunk(w.out[:0], w.body)
+	out = append(out, "0\r\n\r\n"...)
+	w.out = out
+	w.body = w.body[:0]
+	w.sent += int64(len(out))
+	return w.sink.send(out, true)
+}
+
+// appendStreamHead appends the status line and headers of a chunked response
+func (w *ResponseWriter) appendStreamHead(dst []byte) []byte {
+	dst = appendStatusLine(dst, w.Status())
+	dst = append(dst, w.header...)
+	dst = append(dst, "Server: "+serverHeader+"\r\nTransfer-Encoding: chunked\r\n"...)
+	dst = w.appendConnection(dst)
+	return append(dst, "\r\n"...)
+}
+
+// appendChunk appends data in chunked transfer encoding; empty data
+// appends nothing, since a zero-length chunk ends the body
+func appendChunk(dst []byte, data []byte) []byte {
+	if len(data) == 0 {
+		return dst
+	}
+	dst = strconv.AppendInt(dst, int64(len(data)), 16)
+	dst = append(dst, "\r\n"...)
+	dst = append(dst, data...)
+	return append(dst, "\r\n"...)
+}
@@ -0,0 +1,56 @@
+package ultrafast
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendChunk(t *testing.T) {
+	out := appendChunk(nil, []byte("hello, chunked world"))
+	out = appendChunk(out, nil) // empty data must not end the body
+	if string(out) != "14\r\nhello, chunked world\r\n" {
+		t.Errorf("Unexpected chunk encoding %q", out)
+	}
+}
+
+func TestServerStreamedResponse(t *testing.T) {
+	server := startTestServer(t)
+
+	large := strings.Repeat("0123456789abcdef", 3*chunkFlushSize/16) // flushes on its own
+	server.HandleWriter("/stream", func(ctx context.Context, w *ResponseWriter, r *HTTPRequest) {
+		w.Header("Content-Type", "text/plain")
+		w.WriteString("first ")
+		if err := w.Flush(); err != nil {
+			t.Errorf("Flush failed: %v", err)
+		}
+		w.Header("X-Ignored", "headers are already sent")
+		time.Sleep(50 * time.Millisecond)
+		w.WriteString(large)
+		w.WriteString(" last")
+	})
+
+	client := newTestClient(t, server)
+	response, err := client.Get("/stream")
+	if err != nil {
+		t.Fatalf("Streamed request failed: %v", err)
+	}
+	headers, body := splitResponse(t, response)
+	if !containsString(headers, "Transfer-Encoding: chunked") || containsString(headers, "Content-Length") ||
+		containsString(headers, "X-Ignored") {
+		t.Errorf("Unexpected headers for a streamed response: %q", headers)
+	}
+
+	decoded, err := io.ReadAll(httputil.NewChunkedReader(bufio.NewReader(bytes.NewReader(body))))
+	if err != nil {
+		t.Fatalf("Invalid chunked body: %v", err)
+	}
+	if string(decoded) != "first "+large+" last" {
+		t.Errorf("Decoded body mismatch: got %d bytes, want %d", len(decoded), len("first "+large+" last"))
+	}
+}
@@ -0,0 +1,560 @@
+package ultrafast
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+// UltraFastClient speaks the custom protocol to an UltraFastHTTPServer:
+// handshake, request/response over DATA packets, and 0-RTT resumption
+// with a session ticket from a previous connection
+type UltraFastClient struct {
+	socket    *LinuxUDPSocket
+	server    SocketAddr
+	nextSeq   uint32
+	nextReqID uint32
+	connID    uint64
+	hasConnID bool
+	ticket    []byte
+	authToken []byte // sent on every SYN for the server's HandshakeAuthenticator
+	cookie    []byte // for stateless requests, from the server's RETRY
+	connected bool
+	timeout   time.Duration
+	retries   int
+	buffer    []byte
+	partial   map[uint32]*partialResponse // multi-packet responses by request ID
+	batched   []*Packet                   // responses split from a batch packet, not yet returned
+	paths     []SocketAddr                // further server addresses opened by AddPath
+	ping      pingState                   // latency probes and their measurements
+	// ACKs for the server's DATA packets on the connection, sent at once
+	// as nothing polls for delayed ones
+	reliability *LockFreeReliabilityLayer
+}
+
+// maxAssembledResponse caps the size of a multi-packet response the
+// client will buffer
+const maxAssembledResponse = 64 * 1024 * 1024
+
+// partialResponse collects the fragments of a multi-packet response
+type partialResponse struct {
+	data     []byte
+	received map[uint32]bool // fragment offsets already copied in
+	filled   int
+	total    int // -1 until known; streamed responses learn it from the last fragment
+}
+
+// NewUltraFastClient creates a client for the server at serverIP:serverPort
+func NewUltraFastClient(serverIP string, serverPort uint16) (*UltraFastClient, error) {
+	if parseIPv4(serverIP) == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", serverIP)
+	}
+
+	socket, err := NewLinuxUDPSocket()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client socket: %v", err)
+	}
+
+	return &UltraFastClient{
+		socket:  socket,
+		server:  SocketAddr{IP: serverIP, Port: serverPort},
+		timeout: 500 * time.Millisecond,
+		retries: 3,
+		buffer:  make([]byte, 65536),
+		partial: make(map[uint32]*partialResponse),
+		reliability: newConnectionReliabilityLayer(NewEpochDomain(releaseUnackedEntry),
+			NewEpochDomain(releaseQueueNode)),
+	}, nil
+}
+
+// SetTimeout sets how long to wait for each reply before retransmitting
+func (c *UltraFastClient) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// SessionTicket returns the most recent resumption ticket, if any
+func (c *UltraFastClient) SessionTicket() []byte {
+	return c.ticket
+}
+
+// SetSessionTicket installs a ticket saved from an earlier client
+func (c *UltraFastClient) SetSessionTicket(ticket []byte) {
+	c.ticket = ticket
+}
+
+// SetAuthToken sets the credential carried by every SYN, such as a
+// pre-shared key or a token from HMACAuthToken. Tokens are at most 255
+// bytes, the most an option holds; nil sends none.
+func (c *UltraFastClient) SetAuthToken(token []byte) error {
+	if len(token) > 255 {
+		return fmt.Errorf("auth token is %d bytes, at most 255 fit an option", len(token))
+	}
+	c.authToken = token
+	return nil
+}
+
+// ConnectionID returns the connection ID assigned by the server
+func (c *UltraFastClient) ConnectionID() (uint64, bool) {
+	return c.connID, c.hasConnID
+}
+
+// Connect performs the SYN, SYN-ACK, ACK handshake
+func (c *UltraFastClient) Connect() error {
+	isn := uint32(randomUint64())
+	syn := NewPacket(SYN_PACKET, SYN_FLAG, isn, 0, nil)
+	if c.authToken != nil {
+		syn.SetOption(OPT_AUTH_TOKEN, c.authToken)
+	}
+
+	synAck, err := c.handshake(syn)
+	if busy, ok := err.(*ServerBusyError); ok {
+		return busy // left intact so callers can honour the hint
+	}
+	if err != nil {
+		return fmt.Errorf("handshake failed: %v", err)
+	}
+
+	return c.completeHandshake(isn, synAck)
+}
+
+// completeHandshake answers a SYN-ACK and records the connection ID
+func (c *UltraFastClient) completeHandshake(isn uint32, synAck *Packet) error {
+	c.adoptConnectionID(synAck)
+	c.nextSeq = isn + 1
+	c.connected = true
+	c.reliability.acks.sync(synAck.SeqNum + 1) // the server's DATA follows its SYN-ACK
+
+	ack := NewPacket(ACK_PACKET, ACK_FLAG, isn+1, synAck.SeqNum+1, nil)
+	return c.send(ack)
+}
+
+// Resume sends request in the SYN together with the session ticket,
+// skipping the handshake round trip. If the server refuses the ticket the
+// client completes a normal handshake and sends the request afterwards.
+func (c *UltraFastClient) Resume(request []byte) ([]byte, error) {
+	if c.ticket == nil {
+		return nil, fmt.Errorf("no session ticket available")
+	}
+
+	isn := uint32(randomUint64())
+	syn := NewPacket(SYN_PACKET, SYN_FLAG, isn, 0, request)
+	syn.SetOption(OPT_SESSION_TICKET, c.ticket)
+	if c.authToken != nil {
+		syn.SetOption(OPT_AUTH_TOKEN, c.authToken)
+	}
+	requestID := c.newRequestID()
+	syn.SetRequestID(requestID)
+	c.ticket = nil // tickets are single-use
+
+	synAck, err := c.handshake(syn)
+	if err != nil {
+		return nil, fmt.Errorf("resumption failed: %v", err)
+	}
+
+	// An empty ticket option on the SYN-ACK means the 0-RTT data was
+	// accepted. Acknowledging the SYN-ACK proves our address, lifting the
+	// server's amplification limit if the response did not fit under it.
+	if accepted, ok := synAck.GetOption(OPT_SESSION_TICKET); ok && len(accepted) == 0 {
+		if err := c.completeHandshake(isn, synAck); err != nil {
+			return nil, err
+		}
+		return c.awaitResponse(requestID)
+	}
+
+	if err := c.completeHandshake(isn, synAck); err != nil {
+		return nil, err
+	}
+	return c.Do(request)
+}
+
+// Do sends one request and waits for its response
+func (c *UltraFastClient) Do(request []byte) ([]byte, error) {
+	responses, err := c.Pipeline([][]byte{request})
+	if err != nil {
+		return nil, err
+	}
+	return responses[0], nil
+}
+
+// Send sends one request that expects no response, as to a server
+// running the DISCARD service, and returns once the server has
+// acknowledged every packet of it
+func (c *UltraFastClient) Send(request []byte) error {
+	if !c.connected {
+		if err := c.Connect(); err != nil {
+			return err
+		}
+	}
+	for _, packet := range c.requestPackets(c.newRequestID(), request) {
+		seq := packet.SeqNum
+		if _, err := c.exchange(packet, func(p *Packet) bool {
+			return p.IsAckPacket() && p.acknowledges(seq, seq+1)
+		}); err != nil {
+			return fmt.Errorf("send failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// Pipeline sends several requests on the connection without waiting for
+// each response, then returns the responses in request order. Each request
+// carries an ID the server echoes, so responses may arrive in any order;
+// unanswered requests are retransmitted on timeout.
+func (c *UltraFastClient) Pipeline(requests [][]byte) ([][]byte, error) {
+	if !c.connected {
+		if err := c.Connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	ids := make([]uint32, len(requests))
+	pending := make(map[uint32][]*Packet, len(requests))
+	index := make(map[uint32]int, len(requests))
+	for i, request := range requests {
+		id := c.newRequestID()
+		ids[i] = id
+		pending[id] = c.requestPackets(id, request)
+		index[id] = i
+	}
+
+	isPending := func(p *Packet) bool {
+		if !p.IsDataPacket() {
+			return false
+		}
+		id, ok := p.RequestID()
+		_, waiting := pending[id]
+		return ok && waiting
+	}
+
+	responses := make([][]byte, len(requests))
+	for attempt := 0; attempt <= c.retries && len(pending) > 0; attempt++ {
+		for _, id := range ids {
+			for _, packet := range pending[id] {
+				if err := c.send(packet); err != nil {
+					return nil, fmt.Errorf("request failed: %v", err)
+				}
+			}
+		}
+
+		deadline := time.Now().Add(c.timeout)
+		for len(pending) > 0 {
+			reply, err := c.receive(deadline, isPending)
+			if err == errClientTimeout {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("request failed: %v", err)
+			}
+			id, _ := reply.RequestID()
+			payload, complete := c.assemble(id, reply)
+			if !complete {
+				// A large response is still arriving; wait before resending
+				deadline = time.Now().Add(c.timeout)
+				continue
+			}
+			responses[index[id]] = payload
+			delete(pending, id)
+
+			// The server ends the connection after this response; the
+			// next request reconnects
+			if closesConnection(payload) {
+				c.connected = false
+			}
+		}
+	}
+
+	if len(pending) > 0 {
+		for id := range pending {
+			delete(c.partial, id)
+		}
+		return nil, fmt.Errorf("request failed: %d of %d requests unanswered after %d attempts",
+			len(pending), len(requests), c.retries+1)
+	}
+	return responses, nil
+}
+
+// closesConnection reports whether a response carries "Connection: close"
+func closesConnection(response []byte) bool {
+	header := response
+	if end := bytes.Index(response, []byte("\r\n\r\n")); end >= 0 {
+		header = response[:end]
+	}
+	for _, line := range bytes.Split(header, []byte("\r\n")) {
+		name, value, found := bytes.Cut(line, []byte(":"))
+		if found && bytes.EqualFold(bytes.TrimSpace(name), []byte("Connection")) &&
+			bytes.EqualFold(bytes.TrimSpace(value), []byte("close")) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestPackets splits a request into DATA packets. A request larger than
+// one packet is sent as fragments the server reassembles.
+func (c *UltraFastClient) requestPackets(requestID uint32, request []byte) []*Packet {
+	return splitRequest(&c.nextSeq, requestID, request)
+}
+
+// splitRequest is requestPackets numbering the packets from *seq, which
+// it advances past them
+func splitRequest(seq *uint32, requestID uint32, request []byte) []*Packet {
+	if len(request) <= MAX_PAYLOAD_SIZE {
+		packet := NewPacket(DATA_PACKET, 0, *seq, 0, request)
+		packet.SetRequestID(requestID)
+		*seq++
+		return []*Packet{packet}
+	}
+
+	var packets []*Packet
+	for offset := 0; offset < len(request); offset += MAX_PAYLOAD_SIZE {
+		end := offset + MAX_PAYLOAD_SIZE
+		if end > len(request) {
+			end = len(request)
+		}
+		packet := NewPacket(DATA_PACKET, 0, *seq, 0, request[offset:end])
+		packet.SetRequestID(requestID)
+		packet.SetFragment(uint32(offset), uint32(len(request)))
+		*seq++
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+// Get sends a GET request for path and returns the raw HTTP response
+func (c *UltraFastClient) Get(path string) ([]byte, error) {
+	return c.Do(buildGetRequest(path, c.server))
+}
+
+// Close sends FIN if connected and releases the socket
+func (c *UltraFastClient) Close() error {
+	if c.connected {
+		fin := NewPacket(FIN_PACKET, FIN_FLAG, c.nextSeq, 0, nil)
+		c.send(fin)
+		c.connected = false
+	}
+	c.reliability.Release()
+	return c.socket.Close()
+}
+
+// buildGetRequest formats a minimal HTTP/1.1 GET request
+func buildGetRequest(path string, server SocketAddr) []byte {
+	return []byte(fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s:%d\r\n\r\n", path, server.IP, server.Port))
+}
+
+// handshake sends a SYN and returns the server's SYN-ACK. If the server
+// demands address validation it answers with a RETRY, and the SYN is sent
+// again carrying the RETRY's token.
+func (c *UltraFastClient) handshake(syn *Packet) (*Packet, error) {
+	isn := syn.SeqNum
+	accept := func(p *Packet) bool {
+		return (p.IsRetryPacket() || p.IsSynPacket() && p.HasAck()) && p.AckNum == isn+1
+	}
+
+	for retried := false; ; retried = true {
+		reply, err := c.exchange(syn, accept)
+		if err != nil {
+			return nil, err
+		}
+		if !reply.IsRetryPacket() {
+			return reply, nil
+		}
+		if retried {
+			return nil, fmt.Errorf("server sent a second RETRY")
+		}
+
+		token, ok := reply.GetOption(OPT_RETRY_TOKEN)
+		if !ok {
+			return nil, fmt.Errorf("RETRY packet carries no token")
+		}
+		syn.SetOption(OPT_RETRY_TOKEN, token)
+	}
+}
+
+// exchange sends a packet and waits for a reply matching accept,
+// retransmitting on timeout
+func (c *UltraFastClient) exchange(packet *Packet, accept func(*Packet) bool) (*Packet, error) {
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if err := c.send(packet); err != nil {
+			return nil, err
+		}
+
+		reply, err := c.receive(time.Now().Add(c.timeout), accept)
+		if err == nil {
+			return reply, nil
+		}
+		if err != errClientTimeout {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no reply after %d attempts", c.retries+1)
+}
+
+// awaitResponse waits for the response to a request without sending
+// anything, reassembling it if it spans several packets
+func (c *UltraFastClient) awaitResponse(requestID uint32) ([]byte, error) {
+	for {
+		reply, err := c.receive(time.Now().Add(c.timeout), func(p *Packet) bool {
+			id, _ := p.RequestID()
+			return p.IsDataPacket() && id == requestID
+		})
+		if err != nil {
+			delete(c.partial, requestID)
+			return nil, err
+		}
+		if payload, complete := c.assemble(requestID, reply); complete {
+			return payload, nil
+		}
+	}
+}
+
+// assemble adds a response packet to its request's reassembly buffer and
+// returns the whole payload once every fragment has arrived. Packets that
+// are not fragments are complete responses on their own.
+func (c *UltraFastClient) assemble(requestID uint32, packet *Packet) ([]byte, bool) {
+	offset, total, fragmented := packet.Fragment()
+	if !fragmented {
+		delete(c.partial, requestID)
+		return packet.Payload, true
+	}
+	end := uint64(offset) + uint64(len(packet.Payload))
+	if end > maxAssembledResponse || total != FRAGMENT_TOTAL_OPEN && end > uint64(total) {
+		return nil, false
+	}
+
+	partial := c.partial[requestID]
+	if partial == nil {
+		partial = &partialResponse{received: make(map[uint32]bool), total: -1}
+		c.partial[requestID] = partial
+	}
+	if total != FRAGMENT_TOTAL_OPEN {
+		partial.total = int(total)
+	}
+	if !partial.received[offset] {
+		partial.received[offset] = true
+		if int(end) > len(partial.data) {
+			partial.data = append(partial.data, make([]byte, int(end)-len(partial.data))...)
+		}
+		partial.filled += copy(partial.data[offset:], packet.Payload)
+	}
+
+	if partial.total < 0 || partial.filled < partial.total {
+		return nil, false
+	}
+	delete(c.partial, requestID)
+	return partial.data[:partial.total], true
+}
+
+// newRequestID returns the next request ID; IDs are never 0
+func (c *UltraFastClient) newRequestID() uint32 {
+	c.nextReqID++
+	if c.nextReqID == 0 {
+		c.nextReqID = 1
+	}
+	return c.nextReqID
+}
+
+// errClientTimeout is returned by receive when the deadline passes
+var errClientTimeout = fmt.Errorf("timed out waiting for reply")
+
+// receive reads packets from the server until one matches accept. DATA
+// packets are acknowledged and tickets are collected along the way. A
+// batch packet yields its responses one at a time, as if each had
+// arrived in a packet of its own.
+func (c *UltraFastClient) receive(deadline time.Time, accept func(*Packet) bool) (*Packet, error) {
+	for {
+		if len(c.batched) > 0 {
+			packet := c.batched[0]
+			c.batched = c.batched[1:]
+			if accept(packet) {
+				return packet, nil
+			}
+			continue
+		}
+
+		c.maybePing()
+		c.socket.SetReadDeadline(deadline)
+		n, from, err := c.socket.RecvFrom(c.buffer)
+		if err == os.ErrDeadlineExceeded {
+			return nil, errClientTimeout
+		}
+		if err != nil {
+			continue
+		}
+		if from != c.server && !slices.Contains(c.paths, from) {
+			continue
+		}
+
+		packet, err := deserializePacket(c.buffer[:n], c.socket.checksumsFor(from))
+		if err != nil || !c.socket.verifyPacket(packet) {
+			continue
+		}
+
+		if packet.IsRstPacket() {
+			c.connected = false
+			if delay, ok := retryAfter(packet); ok {
+				return nil, &ServerBusyError{RetryAfter: delay}
+			}
+			return nil, closedError("connection reset by server")
+		}
+		if packet.IsFinPacket() {
+			// The server closed the connection, e.g. after an idle timeout
+			c.connected = false
+			if accept(packet) {
+				return packet, nil
+			}
+			continue
+		}
+		if ticket, ok := packet.GetOption(OPT_SESSION_TICKET); ok && len(ticket) > 0 {
+			c.ticket = ticket
+		}
+		if packet.Type == ECHO_REPLY_PACKET {
+			c.recordEcho(packet)
+		}
+		if packet.Type == PATH_CHALLENGE_PACKET {
+			// Prove we receive at the address the server sees now
+			c.sendTo(NewPacket(PATH_RESPONSE_PACKET, 0, c.nextSeq, 0, packet.Payload), from)
+			continue
+		}
+		if _, stateless := packet.GetOption(OPT_STATELESS); packet.IsDataPacket() && !stateless {
+			ack := NewPacket(ACK_PACKET, ACK_FLAG, 0, packet.SeqNum+1, nil)
+			if c.connected {
+				ack = c.reliability.AckReceived(packet)
+			}
+			ack.SeqNum = c.nextSeq
+			c.sendTo(ack, from) // over the path the packet took
+		}
+		if _, ok := packet.GetOption(OPT_BATCH); ok && packet.IsDataPacket() {
+			packet.Payload = bytes.Clone(packet.Payload) // the buffer is reused
+			c.batched = splitBatch(packet)
+			continue
+		}
+
+		if accept(packet) {
+			return packet, nil
+		}
+	}
+}
+
+// adoptConnectionID records the connection ID offered by the server
+func (c *UltraFastClient) adoptConnectionID(packet *Packet) {
+	if id, ok := packet.ConnectionID(); ok {
+		c.connID = id
+		c.hasConnID = true
+	}
+}
+
+// send serializes a packet to the server, tagging it with the connection ID
+func (c *UltraFastClient) send(packet *Packet) error {
+	return c.sendTo(packet, c.server)
+}
+
+// sendTo is send to one of the server's addresses
+func (c *UltraFastClient) sendTo(packet *Packet, addr SocketAddr) error {
+	if c.hasConnID && !packet.IsSynPacket() {
+		packet.SetConnectionID(c.connID)
+	}
+	_, err := c.socket.SendPacket(packet, addr.IP, addr.Port)
+	return err
+}
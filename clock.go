@@ -0,0 +1,30 @@
+package ultrafast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// virtualTime, when non-zero, is the time in Unix nanoseconds the
+// protocol stack's timers read instead of the wall clock. Replay sets it
+// so captured traffic meets the same timeouts it met when captured.
+var virtualTime atomic.Int64
+
+// clockNow returns the protocol stack's current time: the virtual time
+// while a replay runs, otherwise the wall clock
+func clockNow() time.Time {
+	if virtual := virtualTime.Load(); virtual != 0 {
+		return time.Unix(0, virtual)
+	}
+	return time.Now()
+}
+
+// setVirtualTime moves the virtual clock to t; the zero time goes back
+// to the wall clock
+func setVirtualTime(t time.Time) {
+	if t.IsZero() {
+		virtualTime.Store(0)
+		return
+	}
+	virtualTime.Store(t.UnixNano())
+}
@@ -0,0 +1,106 @@
+package ultrafast
+
+import (
+	"fmt"
+	"time"
+)
+
+// Clock offset estimation, after NTP's on-wire protocol (RFC 5905): an
+// ECHO_REQUEST and its reply carry four timestamps, two from each clock,
+// from which the offset between the clocks and the round trip follow
+// without assuming the clocks agree. The offset is exact when both
+// directions take equally long, and off by at most half the round trip
+// otherwise, so the sample with the shortest round trip of the last few
+// is trusted, as NTP's clock filter does.
+
+// clockFilterSize is how many recent samples the filter chooses from
+const clockFilterSize = 8
+
+// ClockSample is one timestamp exchange with a peer
+type ClockSample struct {
+	Sent     time.Time // local clock, when the probe left
+	Received time.Time // peer clock, when the probe arrived
+	Replied  time.Time // peer clock, when the reply left
+	Returned time.Time // local clock, when the reply arrived
+}
+
+// Offset is how far the peer's clock is ahead of the local one, as this
+// sample measures it
+func (s ClockSample) Offset() time.Duration {
+	return (s.Received.Sub(s.Sent) + s.Replied.Sub(s.Returned)) / 2
+}
+
+// Delay is the round trip, less the time the peer held the probe
+func (s ClockSample) Delay() time.Duration {
+	return s.Returned.Sub(s.Sent) - s.Replied.Sub(s.Received)
+}
+
+// ClockEstimate is the best current estimate of a peer's clock
+type ClockEstimate struct {
+	Offset  time.Duration // the peer's clock minus the local clock
+	Error   time.Duration // the true offset lies within Offset ± Error
+	Samples uint64        // exchanges measured, including those discarded
+}
+
+// PeerTime converts a local time to the peer's clock
+func (e ClockEstimate) PeerTime(local time.Time) time.Time {
+	return local.Add(e.Offset)
+}
+
+// LocalTime converts a time read from the peer's clock to the local clock
+func (e ClockEstimate) LocalTime(peer time.Time) time.Time {
+	return peer.Add(-e.Offset)
+}
+
+// OneWayDelay is the transit time of a message the peer stamped sent
+// and that arrived at received, by the local clock. It is accurate to
+// the estimate's Error, so it may come out slightly negative.
+func (e ClockEstimate) OneWayDelay(sent, received time.Time) time.Duration {
+	return received.Sub(e.LocalTime(sent))
+}
+
+// ClockSync estimates a peer's clock from timestamp exchanges. The zero
+// value is ready to use; it is not safe for concurrent use.
+type ClockSync struct {
+	samples [clockFilterSize]ClockSample
+	count   uint64
+}
+
+// Add records an exchange
+func (c *ClockSync) Add(sample ClockSample) {
+	c.samples[c.count%clockFilterSize] = sample
+	c.count++
+}
+
+// Estimate returns the estimate from the recent sample with the shortest
+// round trip, or a zero estimate before any sample
+func (c *ClockSync) Estimate() ClockEstimate {
+	if c.count == 0 {
+		return ClockEstimate{}
+	}
+	best := c.samples[0]
+	for _, sample := range c.samples[1:min(c.count, clockFilterSize)] {
+		if sample.Delay() < best.Delay() {
+			best = sample
+		}
+	}
+	return ClockEstimate{Offset: best.Offset(), Error: max(best.Delay(), 0) / 2, Samples: c.count}
+}
+
+// ClockOffset returns the estimate of the server's clock from the
+// client's latency probes so far, see EnablePing and SyncClock
+func (c *UltraFastClient) ClockOffset() ClockEstimate {
+	return c.ping.clock.Estimate()
+}
+
+// SyncClock sends probes latency probes one after another and returns
+// the estimate of the server's clock they give, together with any
+// earlier probes still in the filter
+func (c *UltraFastClient) SyncClock(probes int) (ClockEstimate, error) {
+	for i := 0; i < probes; i++ {
+		if _, err := c.Ping(); err != nil {
+			return c.ClockOffset(), fmt.Errorf("clock sync failed: %v", err)
+		}
+	}
+	return c.ClockOffset(), nil
+}
@@ -0,0 +1,108 @@
+package ultrafast
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// exchangeAt builds a sample with a peer clock skew ahead of the local
+// one, the given one-way delays, and the peer holding the probe for 1ms
+func exchangeAt(start time.Time, skew, forward, back time.Duration) ClockSample {
+	received := start.Add(forward).Add(skew)
+	replied := received.Add(time.Millisecond)
+	return ClockSample{
+		Sent:     start,
+		Received: received,
+		Replied:  replied,
+		Returned: replied.Add(-skew).Add(back),
+	}
+}
+
+func TestClockSample(t *testing.T) {
+	start := time.Now()
+	sample := exchangeAt(start, time.Hour, 5*time.Millisecond, 5*time.Millisecond)
+	if sample.Offset() != time.Hour || sample.Delay() != 10*time.Millisecond {
+		t.Errorf("Expected a 1h offset and 10ms delay, got %v and %v", sample.Offset(), sample.Delay())
+	}
+
+	// Asymmetric paths skew the offset by half the difference
+	sample = exchangeAt(start, -time.Minute, 2*time.Millisecond, 8*time.Millisecond)
+	if sample.Offset() != -time.Minute-3*time.Millisecond || sample.Delay() != 10*time.Millisecond {
+		t.Errorf("Expected a -1m3ms offset and 10ms delay, got %v and %v", sample.Offset(), sample.Delay())
+	}
+}
+
+func TestClockSyncFilter(t *testing.T) {
+	var clock ClockSync
+	if estimate := clock.Estimate(); estimate != (ClockEstimate{}) {
+		t.Fatalf("Expected a zero estimate before samples, got %+v", estimate)
+	}
+
+	skew := 30 * time.Second
+	start := time.Now()
+	clock.Add(exchangeAt(start, skew, 40*time.Millisecond, 2*time.Millisecond)) // queued on the way out
+	clock.Add(exchangeAt(start, skew, time.Millisecond, time.Millisecond))
+	clock.Add(exchangeAt(start, skew, 2*time.Millisecond, 30*time.Millisecond)) // queued on the way back
+
+	estimate := clock.Estimate()
+	if estimate.Offset != skew || estimate.Error != time.Millisecond || estimate.Samples != 3 {
+		t.Errorf("Expected the shortest exchange chosen, got %+v", estimate)
+	}
+	peer := start.Add(skew)
+	if !estimate.PeerTime(start).Equal(peer) || !estimate.LocalTime(peer).Equal(start) {
+		t.Errorf("Conversions do not use the offset: %v, %v", estimate.PeerTime(start), estimate.LocalTime(peer))
+	}
+	if delay := estimate.OneWayDelay(peer, start.Add(4*time.Millisecond)); delay != 4*time.Millisecond {
+		t.Errorf("Expected a 4ms one-way delay, got %v", delay)
+	}
+
+	// Once the best sample leaves the window the next best takes over
+	for i := 0; i < clockFilterSize; i++ {
+		clock.Add(exchangeAt(start, skew+time.Second, 3*time.Millisecond, 3*time.Millisecond))
+	}
+	if estimate := clock.Estimate(); estimate.Offset != skew+time.Second || estimate.Error != 3*time.Millisecond {
+		t.Errorf("Expected the old samples forgotten, got %+v", estimate)
+	}
+}
+
+func TestRecordEchoClockOffset(t *testing.T) {
+	client := &UltraFastClient{}
+	skew := -2 * time.Hour
+
+	// The server's clock is two hours behind; 1ms each way
+	now := time.Now()
+	payload := make([]byte, echoReplySize)
+	binary.BigEndian.PutUint64(payload[0:], uint64(now.Add(-2*time.Millisecond).UnixNano()))
+	binary.BigEndian.PutUint64(payload[8:], uint64(now.Add(skew-time.Millisecond).UnixNano()))
+	binary.BigEndian.PutUint64(payload[16:], uint64(now.Add(skew-time.Millisecond).UnixNano()))
+	client.recordEcho(NewPacket(ECHO_REPLY_PACKET, 0, 0, 1, payload))
+
+	estimate := client.ClockOffset()
+	if diff := estimate.Offset - skew; diff < -time.Millisecond || diff > time.Millisecond {
+		t.Errorf("Expected an offset near %v, got %+v", skew, estimate)
+	}
+	stats := client.Latency()
+	for _, delay := range []time.Duration{stats.ForwardDelay, stats.ReturnDelay} {
+		if delay < 0 || delay > 2*time.Millisecond {
+			t.Errorf("Expected one-way delays near 1ms, got %+v", stats)
+		}
+	}
+}
+
+func TestSyncClock(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+
+	estimate, err := client.SyncClock(4)
+	if err != nil {
+		t.Fatalf("SyncClock failed: %v", err)
+	}
+	if estimate.Samples != 4 {
+		t.Errorf("Expected 4 samples, got %+v", estimate)
+	}
+	// Both ends read the same clock, so the offset is within the error
+	if estimate.Offset < -estimate.Error-time.Millisecond || estimate.Offset > estimate.Error+time.Millisecond {
+		t.Errorf("Expected no offset on one machine, got %+v", estimate)
+	}
+}
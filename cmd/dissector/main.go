@@ -0,0 +1,450 @@
+// Command dissector generates a Wireshark Lua dissector for the server's
+// packet protocol. Packet types, flags and option types are read from the
+// constants in the Go sources, so regenerating after a protocol change
+// keeps captures readable:
+//
+//	go run ./cmd/dissector -o ultrafast.lua
+//	wireshark -X lua_script:ultrafast.lua capture.pcap
+//
+// The fixed header layout is written out here; the tool refuses to run
+// if PACKET_HEADER_SIZE or PROTOCOL_VERSION no longer match it.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/parser"
+	"go/token"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The layout written by Packet.Serialize
+const (
+	headerSize      = 16
+	protocolVersion = 1
+)
+
+// protocolConst is one constant of the protocol
+type protocolConst struct {
+	name  string // Go name
+	label string // name shown in Wireshark
+	value uint64
+	doc   string
+}
+
+// protocol is the set of constants the dissector is built from
+type protocol struct {
+	packetTypes []protocolConst
+	flags       []protocolConst
+	options     []protocolConst
+	optFlag     uint64
+	optEnd      uint64
+}
+
+// optionDecoders lay out the values of options with a known structure;
+// other options are shown as bytes
+var optionDecoders = map[string][]struct {
+	field string
+	label string
+	size  int
+}{
+	"OPT_CONNECTION_ID": {{"connection_id", "Connection ID", 8}},
+	"OPT_REQUEST_ID":    {{"request_id", "Request ID", 4}},
+	"OPT_FRAGMENT":      {{"fragment_offset", "Fragment Offset", 4}, {"fragment_total", "Fragment Total", 4}},
+}
+
+func main() {
+	src := flag.String("src", ".", "directory holding the protocol's Go sources")
+	out := flag.String("o", "", "output file (default stdout)")
+	ports := flag.String("ports", "8080,7946", "comma-separated UDP ports to register the dissector on")
+	flag.Parse()
+
+	proto, err := loadProtocol(*src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var udpPorts []int
+	for _, p := range strings.Split(*ports, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			log.Fatalf("invalid port %q", p)
+		}
+		udpPorts = append(udpPorts, port)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeDissector(w, proto, udpPorts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadProtocol parses the non-test Go files in dir and collects the
+// protocol constants: *_PACKET types, *_FLAG flags and OPT_* options
+func loadProtocol(dir string) (*protocol, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+	fset := token.NewFileSet()
+	values := make(map[string]constant.Value)
+	docs := make(map[string]string)
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, name, nil, parser.ParseComments)
+		if err != nil {
+			return nil, err
+		}
+		collectConsts(file, values, docs)
+	}
+
+	get := func(name string) (uint64, error) {
+		v, ok := values[name]
+		if !ok {
+			return 0, fmt.Errorf("constant %s not found in %s", name, dir)
+		}
+		n, exact := constant.Uint64Val(v)
+		if !exact {
+			return 0, fmt.Errorf("constant %s is not an unsigned integer", name)
+		}
+		return n, nil
+	}
+	if n, err := get("PACKET_HEADER_SIZE"); err != nil || n != headerSize {
+		return nil, fmt.Errorf("PACKET_HEADER_SIZE is %d, not %d: the header layout changed, update cmd/dissector (%v)", n, headerSize, err)
+	}
+	if n, err := get("PROTOCOL_VERSION"); err != nil || n != protocolVersion {
+		return nil, fmt.Errorf("PROTOCOL_VERSION is %d, not %d: update cmd/dissector (%v)", n, protocolVersion, err)
+	}
+
+	p := &protocol{}
+	if p.optFlag, err = get("OPT_FLAG"); err != nil {
+		return nil, err
+	}
+	if p.optEnd, err = get("OPT_END"); err != nil {
+		return nil, err
+	}
+	for name := range values {
+		c := protocolConst{name: name, doc: docs[name]}
+		if c.value, err = get(name); err != nil {
+			continue // not a protocol constant
+		}
+		switch {
+		case name == "OPT_END":
+		case strings.HasSuffix(name, "_PACKET"):
+			c.label = strings.TrimSuffix(name, "_PACKET")
+			p.packetTypes = append(p.packetTypes, c)
+		case strings.HasSuffix(name, "_FLAG"):
+			c.label = strings.TrimSuffix(name, "_FLAG")
+			p.flags = append(p.flags, c)
+		case strings.HasPrefix(name, "OPT_"):
+			c.label = strings.TrimPrefix(name, "OPT_")
+			p.options = append(p.options, c)
+		}
+	}
+	for _, list := range [][]protocolConst{p.packetTypes, p.flags, p.options} {
+		sort.Slice(list, func(i, j int) bool { return list[i].value < list[j].value })
+	}
+	if len(p.packetTypes) == 0 {
+		return nil, fmt.Errorf("no packet types found in %s", dir)
+	}
+	return p, nil
+}
+
+// collectConsts evaluates the top-level constants of a file that are
+// integer literals or expressions of earlier constants
+func collectConsts(file *ast.File, values map[string]constant.Value, docs map[string]string) {
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.CONST {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			vs := spec.(*ast.ValueSpec)
+			for i, name := range vs.Names {
+				if i >= len(vs.Values) {
+					break // iota sequences are not used by the protocol
+				}
+				if v := evalConst(vs.Values[i], values); v != nil {
+					values[name.Name] = v
+					docs[name.Name] = constDoc(name.Name, gen, vs)
+				}
+			}
+		}
+	}
+}
+
+// evalConst evaluates an integer constant expression, or returns nil
+func evalConst(expr ast.Expr, values map[string]constant.Value) constant.Value {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		if e.Kind != token.INT {
+			return nil
+		}
+		return constant.MakeFromLiteral(e.Value, e.Kind, 0)
+	case *ast.Ident:
+		return values[e.Name]
+	case *ast.ParenExpr:
+		return evalConst(e.X, values)
+	case *ast.BinaryExpr:
+		x, y := evalConst(e.X, values), evalConst(e.Y, values)
+		if x == nil || y == nil {
+			return nil
+		}
+		switch e.Op {
+		case token.SHL, token.SHR:
+			s, ok := constant.Uint64Val(y)
+			if !ok {
+				return nil
+			}
+			return constant.Shift(x, e.Op, uint(s))
+		case token.ADD, token.SUB, token.MUL, token.OR, token.AND:
+			return constant.BinaryOp(x, e.Op, y)
+		}
+	}
+	return nil
+}
+
+// constDoc returns a constant's trailing comment, or else its doc
+// comment with the leading name dropped, flattened to one line
+func constDoc(name string, gen *ast.GenDecl, vs *ast.ValueSpec) string {
+	group := vs.Comment
+	if group == nil {
+		group = vs.Doc
+	}
+	if group == nil && len(gen.Specs) == 1 {
+		group = gen.Doc
+	}
+	if group == nil {
+		return ""
+	}
+	text := strings.Join(strings.Fields(group.Text()), " ")
+	if rest, ok := strings.CutPrefix(text, name+" "); ok && rest != "" {
+		text = strings.ToUpper(rest[:1]) + rest[1:]
+	}
+	return text
+}
+
+// writeDissector writes the Lua dissector
+func writeDissector(w io.Writer, p *protocol, ports []int) error {
+	var b strings.Builder
+	b.WriteString(`-- Wireshark dissector for the UltraFast HTTP-over-UDP protocol.
+-- Generated by cmd/dissector from the Go sources; do not edit.
+
+local proto = Proto("ultrafast", "UltraFast HTTP over UDP")
+
+`)
+	fmt.Fprintf(&b, "local HEADER_SIZE = %d\nlocal VERSION = %d\nlocal OPT_FLAG = 0x%02x\nlocal OPT_END = 0x%02x\n\n",
+		headerSize, protocolVersion, p.optFlag, p.optEnd)
+
+	writeTable(&b, "packet_types", p.packetTypes)
+	writeTable(&b, "option_types", p.options)
+
+	b.WriteString(`local f = proto.fields
+f.version = ProtoField.uint8("ultrafast.version", "Version", base.DEC, nil, 0xf0)
+f.type = ProtoField.uint8("ultrafast.type", "Type", base.HEX, packet_types, 0x0f)
+f.flags = ProtoField.uint8("ultrafast.flags", "Flags", base.HEX)
+`)
+	for _, flag := range p.flags {
+		fmt.Fprintf(&b, "f.flag_%s = ProtoField.bool(\"ultrafast.flags.%s\", %q, 8, nil, 0x%02x)\n",
+			strings.ToLower(flag.label), strings.ToLower(flag.label), flagDescription(flag), flag.value)
+	}
+	b.WriteString(`f.length = ProtoField.uint16("ultrafast.length", "Length", base.DEC)
+f.seq = ProtoField.uint32("ultrafast.seq", "Sequence Number", base.DEC)
+f.ack = ProtoField.uint32("ultrafast.ack", "Acknowledgment Number", base.DEC)
+f.checksum = ProtoField.uint32("ultrafast.checksum", "Checksum", base.HEX)
+f.options = ProtoField.none("ultrafast.options", "Options")
+f.option_type = ProtoField.uint8("ultrafast.option.type", "Type", base.HEX, option_types)
+f.option_length = ProtoField.uint8("ultrafast.option.length", "Length", base.DEC)
+f.option_value = ProtoField.bytes("ultrafast.option.value", "Value")
+`)
+	var decoded []protocolConst
+	for _, c := range p.options {
+		if _, ok := optionDecoders[c.name]; ok {
+			decoded = append(decoded, c)
+		}
+	}
+	for _, c := range decoded {
+		for _, field := range optionDecoders[c.name] {
+			kind, display := "uint32", "base.DEC"
+			if field.size == 8 {
+				kind, display = "uint64", "base.HEX"
+			}
+			fmt.Fprintf(&b, "f.%s = ProtoField.%s(\"ultrafast.option.%s\", %q, %s)\n",
+				field.field, kind, field.field, field.label, display)
+		}
+	}
+	b.WriteString(`f.payload = ProtoField.bytes("ultrafast.payload", "Payload")
+
+-- Fields of options with a known layout, by option type
+local option_fields = {
+`)
+	for _, c := range decoded {
+		var fields []string
+		for _, field := range optionDecoders[c.name] {
+			fields = append(fields, fmt.Sprintf("{f.%s, %d}", field.field, field.size))
+		}
+		fmt.Fprintf(&b, "    [0x%02x] = {%s},\n", c.value, strings.Join(fields, ", "))
+	}
+	b.WriteString(`}
+
+-- flag_names lists the set flags for the info column
+local function flag_names(flags)
+    local names = {}
+`)
+	for _, flag := range p.flags {
+		fmt.Fprintf(&b, "    if bit.band(flags, 0x%02x) ~= 0 then table.insert(names, %q) end\n", flag.value, flag.label)
+	}
+	b.WriteString(`    return table.concat(names, ",")
+end
+
+-- looks_like_ours checks the version nibble, packet type and length field;
+-- QUIC and other traffic sharing the port is left to other dissectors
+local function looks_like_ours(buffer)
+    if buffer:len() < HEADER_SIZE then
+        return false
+    end
+    local first = buffer(0, 1):uint()
+    return bit.rshift(first, 4) == VERSION
+        and packet_types[bit.band(first, 0x0f)] ~= nil
+        and buffer(2, 2):uint() == buffer:len()
+end
+
+function proto.dissector(buffer, pinfo, tree)
+    if not looks_like_ours(buffer) then
+        return 0
+    end
+    pinfo.cols.protocol = "UltraFast"
+
+    local ptype = bit.band(buffer(0, 1):uint(), 0x0f)
+    local flags = buffer(1, 1):uint()
+    local subtree = tree:add(proto, buffer(), "UltraFast " .. packet_types[ptype])
+    subtree:add(f.version, buffer(0, 1))
+    subtree:add(f.type, buffer(0, 1))
+    local flag_tree = subtree:add(f.flags, buffer(1, 1))
+`)
+	for _, flag := range p.flags {
+		fmt.Fprintf(&b, "    flag_tree:add(f.flag_%s, buffer(1, 1))\n", strings.ToLower(flag.label))
+	}
+	b.WriteString(`    subtree:add(f.length, buffer(2, 2))
+    subtree:add(f.seq, buffer(4, 4))
+    subtree:add(f.ack, buffer(8, 4))
+    subtree:add(f.checksum, buffer(12, 4))
+
+    local info = packet_types[ptype]
+    local names = flag_names(flags)
+    if names ~= "" then
+        info = info .. " [" .. names .. "]"
+    end
+    info = info .. " Seq=" .. buffer(4, 4):uint() .. " Ack=" .. buffer(8, 4):uint()
+
+    local offset = HEADER_SIZE
+    if bit.band(flags, OPT_FLAG) ~= 0 then
+        local start = offset
+        local options_tree = subtree:add(f.options, buffer(offset, 0))
+        while offset < buffer:len() do
+            local otype = buffer(offset, 1):uint()
+            if otype == OPT_END then
+                offset = offset + 1
+                break
+            end
+            if offset + 2 > buffer:len() then
+                options_tree:add_expert_info(PI_MALFORMED, PI_ERROR, "Truncated option")
+                return buffer:len()
+            end
+            local olen = buffer(offset + 1, 1):uint()
+            if offset + 2 + olen > buffer:len() then
+                options_tree:add_expert_info(PI_MALFORMED, PI_ERROR, "Option overruns packet")
+                return buffer:len()
+            end
+            local name = option_types[otype] or string.format("0x%02x", otype)
+            local option_tree = options_tree:add(buffer(offset, 2 + olen), "Option: " .. name)
+            option_tree:add(f.option_type, buffer(offset, 1))
+            option_tree:add(f.option_length, buffer(offset + 1, 1))
+            local layout = option_fields[otype]
+            local size = 0
+            if layout then
+                for _, field in ipairs(layout) do
+                    size = size + field[2]
+                end
+            end
+            if layout and size == olen then
+                local pos = offset + 2
+                for _, field in ipairs(layout) do
+                    option_tree:add(field[1], buffer(pos, field[2]))
+                    pos = pos + field[2]
+                end
+            elseif olen > 0 then
+                option_tree:add(f.option_value, buffer(offset + 2, olen))
+            end
+            offset = offset + 2 + olen
+        end
+        options_tree:set_len(offset - start)
+    end
+
+    if offset < buffer:len() then
+        subtree:add(f.payload, buffer(offset))
+        info = info .. " Len=" .. (buffer:len() - offset)
+    end
+    pinfo.cols.info = info
+    return buffer:len()
+end
+
+local function heuristic(buffer, pinfo, tree)
+    if not looks_like_ours(buffer) then
+        return false
+    end
+    proto.dissector(buffer, pinfo, tree)
+    return true
+end
+
+local udp_port = DissectorTable.get("udp.port")
+`)
+	for _, port := range ports {
+		fmt.Fprintf(&b, "udp_port:add(%d, proto)\n", port)
+	}
+	b.WriteString("proto:register_heuristic(\"udp\", heuristic)\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// writeTable writes a Lua table of value to label
+func writeTable(b *strings.Builder, name string, consts []protocolConst) {
+	fmt.Fprintf(b, "local %s = {\n", name)
+	for _, c := range consts {
+		fmt.Fprintf(b, "    [0x%02x] = %q,", c.value, c.label)
+		if c.doc != "" {
+			fmt.Fprintf(b, " -- %s", c.doc)
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("}\n\n")
+}
+
+// flagDescription names a flag for its field, with its doc comment
+func flagDescription(flag protocolConst) string {
+	if flag.doc == "" {
+		return flag.label
+	}
+	return flag.label + " (" + flag.doc + ")"
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDissectorMatchesSources(t *testing.T) {
+	proto, err := loadProtocol("../..")
+	if err != nil {
+		t.Fatalf("loadProtocol failed: %v", err)
+	}
+
+	var b strings.Builder
+	if err := writeDissector(&b, proto, []int{8080}); err != nil {
+		t.Fatal(err)
+	}
+	lua := b.String()
+	for _, want := range []string{
+		`[0x01] = "DATA"`,
+		`[0x08] = "BINDING"`,
+		`[0x02] = "SESSION_TICKET"`,
+		`[0x05] = {{f.fragment_offset, 4}, {f.fragment_total, 4}}`,
+		`f.flag_opt = ProtoField.bool("ultrafast.flags.opt"`,
+		"local OPT_FLAG = 0x10",
+		"udp_port:add(8080, proto)",
+	} {
+		if !strings.Contains(lua, want) {
+			t.Errorf("Generated dissector lacks %q", want)
+		}
+	}
+	if strings.Contains(lua, `"END"`) {
+		t.Error("OPT_END should not be listed as an option type")
+	}
+}
+
+func TestDissectorRejectsChangedLayout(t *testing.T) {
+	dir := t.TempDir()
+	source := "package main\n\nconst (\n\tPROTOCOL_VERSION = 1\n\tPACKET_HEADER_SIZE = 4 + 16\n" +
+		"\tDATA_PACKET = 0x01\n\tOPT_FLAG = 0x10\n\tOPT_END = 0x00\n)\n"
+	if err := os.WriteFile(filepath.Join(dir, "packet.go"), []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadProtocol(dir); err == nil || !strings.Contains(err.Error(), "PACKET_HEADER_SIZE is 20") {
+		t.Errorf("Expected the header size change to be caught, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+// Command frecv fetches files offered by cmd/fsend:
+//
+//	frecv -o downloads 10.0.0.2:9000            # every offered file
+//	frecv -o downloads 10.0.0.2:9000 photos.zip # just the ones named
+//
+// Files arrive as name.part and are renamed once their SHA-256 digest
+// matches the sender's. Running frecv again after an interruption resumes
+// from the bytes already received.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	ultrafast "claude-go-http"
+)
+
+// progressInterval is how often the progress line is redrawn
+const progressInterval = 250 * time.Millisecond
+
+func main() {
+	dir := flag.String("o", ".", "`directory` to write files to")
+	chunk := flag.Int("chunk", 1024*1024, "`bytes` per range request, at most 16MB")
+	window := flag.Int("window", 8, "range requests in flight")
+	quiet := flag.Bool("q", false, "no progress output")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] ip:port [name...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	sender, err := ultrafast.ParseSocketAddr(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Invalid sender address: %v", err)
+	}
+	var output io.Writer = os.Stderr
+	if *quiet {
+		output = io.Discard
+	}
+	progress := &progressLine{w: output}
+	receiver, err := ultrafast.NewFileReceiver(sender, ultrafast.ReceiveConfig{
+		ChunkSize: *chunk,
+		Window:    *window,
+		Progress:  progress.update,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create receiver: %v", err)
+	}
+	defer receiver.Close()
+
+	files, err := receiver.Manifest()
+	if err != nil {
+		log.Fatal(err)
+	}
+	names := flag.Args()[1:]
+	for _, name := range names {
+		if !slices.ContainsFunc(files, func(f ultrafast.TransferFile) bool { return f.Name == name }) {
+			log.Fatalf("%s is not offered by %s", name, sender)
+		}
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	failed := false
+	for _, file := range files {
+		if len(names) > 0 && !slices.Contains(names, file.Name) {
+			continue
+		}
+		if err := receiver.Receive(file, *dir); err != nil {
+			progress.finish()
+			log.Printf("Failed: %v", err)
+			failed = true
+			continue
+		}
+		progress.finish()
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// progressLine redraws one status line per file as it is received
+type progressLine struct {
+	w         io.Writer
+	last      ultrafast.TransferProgress
+	lastDrawn time.Time
+}
+
+// update records progress, redrawing at most every progressInterval
+func (p *progressLine) update(progress ultrafast.TransferProgress) {
+	p.last = progress
+	if time.Since(p.lastDrawn) >= progressInterval || progress.Received == progress.File.Size {
+		p.draw()
+	}
+}
+
+// draw writes the current status over the previous one
+func (p *progressLine) draw() {
+	p.lastDrawn = time.Now()
+	file := p.last.File
+	percent := 100.0
+	if file.Size > 0 {
+		percent = 100 * float64(p.last.Received) / float64(file.Size)
+	}
+	rate := 0.0
+	if seconds := p.last.Elapsed.Seconds(); seconds > 0 {
+		rate = float64(p.last.Received-p.last.Resumed) / seconds / (1024 * 1024)
+	}
+	fmt.Fprintf(p.w, "\r%-32s %6.1f%% %12d/%d bytes %8.1f MB/s", file.Name, percent, p.last.Received, file.Size, rate)
+}
+
+// finish ends the current file's line
+func (p *progressLine) finish() {
+	if p.last.File.Name == "" {
+		return
+	}
+	p.draw()
+	if p.last.Resumed == p.last.File.Size {
+		fmt.Fprint(p.w, " (already complete)")
+	}
+	fmt.Fprintln(p.w)
+	p.last = ultrafast.TransferProgress{}
+}
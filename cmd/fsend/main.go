@@ -0,0 +1,53 @@
+// Command fsend offers files for cmd/frecv to fetch over the custom
+// protocol:
+//
+//	fsend -listen 0.0.0.0:9000 backup.tar photos.zip
+//
+// Each file is hashed first; receivers check what they fetch against the
+// digests. fsend serves until interrupted.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	ultrafast "claude-go-http"
+)
+
+func main() {
+	listen := flag.String("listen", "0.0.0.0:9000", "`ip:port` to serve on")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-listen ip:port] file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	sender, err := ultrafast.NewFileSender(flag.Args())
+	if err != nil {
+		log.Fatalf("Failed to offer files: %v", err)
+	}
+	server, err := ultrafast.New(*listen)
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
+	server.Engine().HandlePrefix("/", sender.ServeRequest)
+	for _, file := range sender.Files() {
+		log.Printf("Offering %s (%d bytes, sha256 %s)", file.Name, file.Size, file.SHA256)
+	}
+	log.Printf("Receive with: frecv %s", server.Addr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := server.Start(ctx); err != nil && err != context.Canceled {
+		log.Fatalf("Server error: %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	ultrafast "claude-go-http"
+)
+
+// maxRequestBody caps the request body read from a TCP client; the
+// request travels in one message over the custom protocol
+const maxRequestBody = 16 * 1024 * 1024
+
+// hopHeaders are meaningful only on one hop and are never forwarded
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// udpBackend is an http.Handler sending each request to a server that
+// speaks the custom protocol. A client handles one request at a time, so
+// the backend keeps a pool of them, each its own connection.
+type udpBackend struct {
+	target  ultrafast.SocketAddr
+	timeout time.Duration
+	pool    chan *ultrafast.UltraFastClient // nil entries are connections not made yet
+}
+
+// newUDPBackend creates a bridge to target with up to clients requests in
+// flight at once
+func newUDPBackend(target ultrafast.SocketAddr, clients int, timeout time.Duration) *udpBackend {
+	if clients < 1 {
+		clients = 1
+	}
+	b := &udpBackend{
+		target:  target,
+		timeout: timeout,
+		pool:    make(chan *ultrafast.UltraFastClient, clients),
+	}
+	for i := 0; i < clients; i++ {
+		b.pool <- nil
+	}
+	return b
+}
+
+// ServeHTTP translates the request, sends it over the custom protocol and
+// writes the response back
+func (b *udpBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBody+1))
+	if err != nil {
+		http.Error(w, "400 Bad Request", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxRequestBody {
+		http.Error(w, "413 Request Entity Too Large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var client *ultrafast.UltraFastClient
+	select {
+	case client = <-b.pool:
+	case <-r.Context().Done():
+		return
+	}
+	if client == nil {
+		if client, err = ultrafast.NewUltraFastClient(b.target.IP, b.target.Port); err != nil {
+			b.pool <- nil
+			log.Printf("Backend client failed: %v", err)
+			http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		client.SetTimeout(b.timeout)
+	}
+	raw, err := client.Do(encodeRequest(r, body))
+	if err != nil {
+		// The connection may be broken; the next request makes a new one
+		client.Close()
+		b.pool <- nil
+		log.Printf("Request to %s failed: %v", b.target, err)
+		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	b.pool <- client
+
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), r)
+	if err != nil {
+		log.Printf("Malformed response from %s: %v", b.target, err)
+		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer response.Body.Close()
+	for _, name := range hopHeaders {
+		response.Header.Del(name)
+	}
+	for name, values := range response.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(response.StatusCode)
+	io.Copy(w, response.Body)
+}
+
+// encodeRequest writes a request in the HTTP/1.1 form the server parses,
+// with its body buffered and hop-by-hop headers left out
+func encodeRequest(r *http.Request, body []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\nHost: %s\r\n", r.Method, r.URL.RequestURI(), r.Host)
+	forwardedFor := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		forwardedFor = host
+	}
+	if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+		forwardedFor = prior + ", " + forwardedFor
+	}
+	fmt.Fprintf(&b, "X-Forwarded-For: %s\r\n", forwardedFor)
+	for name, values := range r.Header {
+		if isHopHeader(name) || name == "Content-Length" || name == "X-Forwarded-For" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", name, strings.Join(values, ", "))
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+	return b.Bytes()
+}
+
+// isHopHeader reports whether a header, in canonical form, is hop-by-hop
+func isHopHeader(name string) bool {
+	for _, hop := range hopHeaders {
+		if name == hop {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the pooled connections
+func (b *udpBackend) Close() {
+	for i := 0; i < cap(b.pool); i++ {
+		if client := <-b.pool; client != nil {
+			client.Close()
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Command gateway bridges plain HTTP over TCP and the custom UDP protocol,
+// so existing clients and servers can use a fast hop between two
+// gateways. The schemes of the two addresses choose the direction:
+//
+//	gateway -listen tcp://0.0.0.0:8080 -backend udp://10.0.0.2:9000
+//
+// accepts HTTP clients over TCP and sends their requests to a server
+// speaking the custom protocol, and
+//
+//	gateway -listen udp://0.0.0.0:9000 -backend tcp://127.0.0.1:8080
+//
+// accepts the custom protocol and forwards to a conventional HTTP server.
+// Chained, the two carry HTTP from TCP clients to TCP servers with the
+// UDP transport in between.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	ultrafast "claude-go-http"
+)
+
+func main() {
+	listen := flag.String("listen", "", "`scheme://ip:port` to accept on, tcp or udp")
+	backend := flag.String("backend", "", "`scheme://ip:port` to forward to, the other scheme")
+	clients := flag.Int("clients", 16, "UDP connections to the backend, the requests in flight at once")
+	timeout := flag.Duration("timeout", 30*time.Second, "for each request to the backend")
+	flag.Parse()
+
+	listenScheme, listenAddr, err := splitEndpoint(*listen)
+	if err != nil {
+		log.Fatalf("Invalid -listen: %v", err)
+	}
+	backendScheme, backendAddr, err := splitEndpoint(*backend)
+	if err != nil {
+		log.Fatalf("Invalid -backend: %v", err)
+	}
+	if listenScheme == backendScheme {
+		log.Fatalf("-listen and -backend must use different schemes, not both %s", listenScheme)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("Gateway %s -> %s", *listen, *backend)
+	if listenScheme == "tcp" {
+		err = serveTCP(ctx, listenAddr, backendAddr, *clients, *timeout)
+	} else {
+		err = serveUDP(ctx, listenAddr, backendAddr, *timeout)
+	}
+	if err != nil && err != context.Canceled {
+		log.Fatalf("Gateway error: %v", err)
+	}
+}
+
+// splitEndpoint splits "tcp://ip:port" or "udp://ip:port"
+func splitEndpoint(endpoint string) (scheme, addr string, err error) {
+	scheme, addr, found := strings.Cut(endpoint, "://")
+	if !found || scheme != "tcp" && scheme != "udp" {
+		return "", "", fmt.Errorf("expected tcp://ip:port or udp://ip:port, got %q", endpoint)
+	}
+	if _, err := ultrafast.ParseSocketAddr(addr); err != nil {
+		return "", "", err
+	}
+	return scheme, addr, nil
+}
+
+// serveTCP accepts HTTP over TCP and forwards over the custom protocol
+// until ctx is done
+func serveTCP(ctx context.Context, listen, backend string, clients int, timeout time.Duration) error {
+	target, _ := ultrafast.ParseSocketAddr(backend)
+	bridge := newUDPBackend(target, clients, timeout)
+	defer bridge.Close()
+
+	server := &http.Server{Addr: listen, Handler: bridge}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		server.Shutdown(shutdown)
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return ctx.Err()
+}
+
+// serveUDP accepts the custom protocol and forwards over HTTP/TCP until
+// ctx is done
+func serveUDP(ctx context.Context, listen, backend string, timeout time.Duration) error {
+	server, proxy, err := newUDPFrontend(listen, backend, timeout)
+	if err != nil {
+		return err
+	}
+	defer proxy.Close()
+	return server.Start(ctx)
+}
+
+// newUDPFrontend creates a server whose every path is proxied to backend
+func newUDPFrontend(listen, backend string, timeout time.Duration) (*ultrafast.Server, *ultrafast.ReverseProxy, error) {
+	proxy, err := ultrafast.NewReverseProxy([]string{"http://" + backend}, ultrafast.ProxyConfig{Timeout: timeout})
+	if err != nil {
+		return nil, nil, err
+	}
+	server, err := ultrafast.New(listen)
+	if err != nil {
+		return nil, nil, err
+	}
+	server.Engine().HandlePrefix("/", proxy.ServeRequest)
+	return server, proxy, nil
+}
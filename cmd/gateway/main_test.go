@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ultrafast "claude-go-http"
+)
+
+func TestSplitEndpoint(t *testing.T) {
+	scheme, addr, err := splitEndpoint("udp://127.0.0.1:9000")
+	if err != nil || scheme != "udp" || addr != "127.0.0.1:9000" {
+		t.Errorf("Unexpected split %q %q %v", scheme, addr, err)
+	}
+	for _, endpoint := range []string{"127.0.0.1:9000", "http://127.0.0.1:80", "tcp://127.0.0.1"} {
+		if _, _, err := splitEndpoint(endpoint); err == nil {
+			t.Errorf("Expected an error for %q", endpoint)
+		}
+	}
+}
+
+// startUDPServer runs a server for the custom protocol for the test
+func startUDPServer(t *testing.T, server *ultrafast.Server) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Start(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestTCPToUDP(t *testing.T) {
+	server, err := ultrafast.New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.RegisterHandler("/hello", func(ctx context.Context, r *ultrafast.HTTPRequest) *ultrafast.HTTPResponse {
+		return &ultrafast.HTTPResponse{
+			StatusCode: 201,
+			Headers:    map[string]string{"X-Seen": r.Header("X-Test")},
+			Body:       []byte("hello over udp"),
+		}
+	})
+	startUDPServer(t, server)
+
+	bridge := newUDPBackend(server.Addr(), 2, time.Second)
+	defer bridge.Close()
+	gateway := httptest.NewServer(bridge)
+	defer gateway.Close()
+
+	request, _ := http.NewRequest("GET", gateway.URL+"/hello", nil)
+	request.Header.Set("X-Test", "passed")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != 201 || string(body) != "hello over udp" {
+		t.Errorf("Unexpected response %d %q", response.StatusCode, body)
+	}
+	if seen := response.Header.Get("X-Seen"); seen != "passed" {
+		t.Errorf("Expected the request header to reach the server, got %q", seen)
+	}
+}
+
+func TestTCPToUDPUnreachable(t *testing.T) {
+	bridge := newUDPBackend(ultrafast.SocketAddr{IP: "127.0.0.1", Port: 1}, 1, 100*time.Millisecond)
+	defer bridge.Close()
+	gateway := httptest.NewServer(bridge)
+	defer gateway.Close()
+
+	response, err := http.Get(gateway.URL + "/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502, got %d", response.StatusCode)
+	}
+}
+
+func TestUDPToTCP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Method+" "+r.URL.Path+" "+string(body))
+	}))
+	defer backend.Close()
+
+	server, proxy, err := newUDPFrontend("127.0.0.1:0", strings.TrimPrefix(backend.URL, "http://"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	startUDPServer(t, server)
+
+	addr := server.Addr()
+	client, err := ultrafast.NewUltraFastClient(addr.IP, addr.Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetTimeout(time.Second)
+
+	response, err := client.Do([]byte("POST /echo HTTP/1.1\r\nHost: test\r\nContent-Length: 4\r\n\r\nping"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !strings.Contains(string(response), "POST /echo ping") {
+		t.Errorf("Expected the backend's answer, got %q", response)
+	}
+}
+
+func TestChainedGateways(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "from tcp "+r.URL.RequestURI())
+	}))
+	defer backend.Close()
+
+	server, proxy, err := newUDPFrontend("127.0.0.1:0", strings.TrimPrefix(backend.URL, "http://"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	startUDPServer(t, server)
+
+	bridge := newUDPBackend(server.Addr(), 4, time.Second)
+	defer bridge.Close()
+	gateway := httptest.NewServer(bridge)
+	defer gateway.Close()
+
+	response, err := http.Get(gateway.URL + "/a/b?c=d")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != 200 || string(body) != "from tcp /a/b?c=d" {
+		t.Errorf("Unexpected response %d %q", response.StatusCode, body)
+	}
+}
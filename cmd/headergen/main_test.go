@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGeneratedAccessorsAreCurrent(t *testing.T) {
+	source, err := generate(layout)
+	if err != nil {
+		t.Fatalf("generate failed: %v", err)
+	}
+	current, err := os.ReadFile("../../header_fields.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(source, current) {
+		t.Error("header_fields.go is stale; run go generate in the repository root")
+	}
+}
+
+func TestGenerateRejectsFieldsOutsideHeader(t *testing.T) {
+	fields := []field{{name: "Extra", offset: 14, bits: 32, doc: "field past the end"}}
+	if _, err := generate(fields); err == nil || !strings.Contains(err.Error(), "does not fit") {
+		t.Errorf("Expected a field past the header to be refused, got %v", err)
+	}
+}
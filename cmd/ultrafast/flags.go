@@ -0,0 +1,178 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+
+	ultrafast "claude-go-http"
+)
+
+// commandLine is the server binary's command line. Every flag falls back
+// to an environment variable, then to its default.
+type commandLine struct {
+	addr        string
+	port        uint16
+	listen      []ultrafast.SocketAddr // addresses served besides addr:port
+	echoPort    uint16                 // port on addr for the ECHO service, 0 for none
+	discardPort uint16                 // port on addr for the DISCARD service, 0 for none
+	loops       int                    // event loops per address
+	recvBuffer  int                    // socket buffer sizes in bytes, 0 for the default
+	sendBuffer  int
+	logLevel    string
+	config      string // JSON runtime or TOML startup config, "" for none
+}
+
+// commandLineEnv maps each flag to its environment variable
+var commandLineEnv = map[string]string{
+	"addr":         "ULTRAFAST_ADDR",
+	"port":         "ULTRAFAST_PORT",
+	"listen":       "ULTRAFAST_LISTEN",
+	"echo-port":    "ULTRAFAST_ECHO_PORT",
+	"discard-port": "ULTRAFAST_DISCARD_PORT",
+	"loops":        "ULTRAFAST_LOOPS",
+	"rcvbuf":       "ULTRAFAST_RCVBUF",
+	"sndbuf":       "ULTRAFAST_SNDBUF",
+	"log-level":    "ULTRAFAST_LOG_LEVEL",
+}
+
+// listenFlag collects -listen addresses, given once each or comma-separated
+type listenFlag struct {
+	addrs *[]ultrafast.SocketAddr
+}
+
+func (f listenFlag) String() string {
+	if f.addrs == nil {
+		return ""
+	}
+	texts := make([]string, len(*f.addrs))
+	for i, addr := range *f.addrs {
+		texts[i] = addr.String()
+	}
+	return strings.Join(texts, ",")
+}
+
+func (f listenFlag) Set(value string) error {
+	for _, text := range strings.Split(value, ",") {
+		addr, err := ultrafast.ParseSocketAddr(strings.TrimSpace(text))
+		if err != nil {
+			return err
+		}
+		*f.addrs = append(*f.addrs, addr)
+	}
+	return nil
+}
+
+// parseCommandLine parses the arguments after the program name, reading
+// environment variables through getenv. Usage and errors go to output.
+func parseCommandLine(args []string, getenv func(string) string, output io.Writer) (*commandLine, error) {
+	cl := &commandLine{}
+	flags := flag.NewFlagSet("claude-go-http", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Usage = func() {
+		fmt.Fprintf(output, "Usage: claude-go-http [flags] [config.json | startup.toml]\n"+
+			"       claude-go-http replay capture.pcap [port] [config.json]\n\nFlags:\n")
+		flags.PrintDefaults()
+		fmt.Fprintf(output, "\nEach flag can be set through its environment variable instead:\n")
+		for _, name := range []string{"addr", "port", "listen", "echo-port", "discard-port", "loops", "rcvbuf", "sndbuf", "log-level"} {
+			fmt.Fprintf(output, "  %-10s %s\n", name, commandLineEnv[name])
+		}
+	}
+
+	var port, echoPort, discardPort uint
+	flags.StringVar(&cl.addr, "addr", "127.0.0.1", "IPv4 address to bind, unless a startup config gives one")
+	flags.UintVar(&port, "port", 8080, "UDP port to bind")
+	flags.Var(listenFlag{&cl.listen}, "listen", "further `ip:port` to serve on; repeat or separate with commas")
+	flags.UintVar(&echoPort, "echo-port", 0, "port on addr answering with the ECHO service, for transport benchmarks")
+	flags.UintVar(&discardPort, "discard-port", 0, "port on addr answering with the DISCARD service, for transport benchmarks")
+	flags.IntVar(&cl.loops, "loops", 1, "event loops per address, sharing its port through SO_REUSEPORT")
+	flags.IntVar(&cl.recvBuffer, "rcvbuf", 0, "socket receive buffer in `bytes` (default 2MB)")
+	flags.IntVar(&cl.sendBuffer, "sndbuf", 0, "socket send buffer in `bytes` (default 2MB)")
+	flags.StringVar(&cl.logLevel, "log-level", "", "debug, info, warn or error")
+
+	// Environment variables are applied as if given first, so flags win
+	for name, variable := range commandLineEnv {
+		if value := getenv(variable); value != "" {
+			if err := flags.Set(name, value); err != nil {
+				return nil, fmt.Errorf("%s: %v", variable, err)
+			}
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	for _, p := range []uint{port, echoPort, discardPort} {
+		if p > 65535 {
+			return nil, fmt.Errorf("invalid port: %d", p)
+		}
+	}
+	cl.port, cl.echoPort, cl.discardPort = uint16(port), uint16(echoPort), uint16(discardPort)
+	if ip, err := netip.ParseAddr(cl.addr); err != nil || !ip.Is4() {
+		return nil, fmt.Errorf("invalid address: %q", cl.addr)
+	}
+	if cl.loops < 1 {
+		return nil, fmt.Errorf("loops must be at least 1")
+	}
+	if cl.loops > 1 && cl.port == 0 {
+		return nil, fmt.Errorf("several loops need a fixed port to share")
+	}
+	if cl.recvBuffer < 0 || cl.sendBuffer < 0 {
+		return nil, fmt.Errorf("buffer sizes must not be negative")
+	}
+	if cl.logLevel != "" {
+		if _, err := ultrafast.ParseLogLevel(cl.logLevel); err != nil {
+			return nil, err
+		}
+	}
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		cl.config = flags.Arg(0)
+	default:
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args()[1:], " "))
+	}
+	return cl, nil
+}
+
+// addresses lists every address to serve on, addr:port first
+func (cl *commandLine) addresses() []ultrafast.SocketAddr {
+	return append([]ultrafast.SocketAddr{{IP: cl.addr, Port: cl.port}}, cl.listen...)
+}
+
+// serviceAddr is a port given to a raw benchmarking service
+type serviceAddr struct {
+	addr    ultrafast.SocketAddr
+	service ultrafast.Service
+}
+
+// services lists the ports on ip given to the ECHO and DISCARD services
+func (cl *commandLine) services(ip string) []serviceAddr {
+	var services []serviceAddr
+	if cl.echoPort != 0 {
+		services = append(services, serviceAddr{ultrafast.SocketAddr{IP: ip, Port: cl.echoPort}, ultrafast.SERVICE_ECHO})
+	}
+	if cl.discardPort != 0 {
+		services = append(services, serviceAddr{ultrafast.SocketAddr{IP: ip, Port: cl.discardPort}, ultrafast.SERVICE_DISCARD})
+	}
+	return services
+}
+
+// newCommandLineServer creates one of the binary's servers, on addr. Only
+// the first takes the startup config's multipath address, privilege drop
+// and sandbox: the latter two act on the whole process, once every
+// server has bound.
+func newCommandLineServer(addr ultrafast.SocketAddr, startup *ultrafast.StartupConfig, first bool) (*ultrafast.UltraFastHTTPServer, error) {
+	if startup == nil {
+		return ultrafast.NewUltraFastHTTPServer(addr.IP, addr.Port)
+	}
+	config := *startup
+	config.Listen = addr.String()
+	if !first {
+		config.Multipath = ""
+		config.Privileges, config.Sandbox = nil, nil
+	}
+	return ultrafast.NewServerFromConfig(&config)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+
+	ultrafast "claude-go-http"
+)
+
+func TestParseCommandLine(t *testing.T) {
+	env := map[string]string{
+		"ULTRAFAST_PORT":      "9000",
+		"ULTRAFAST_LOOPS":     "4",
+		"ULTRAFAST_LISTEN":    "10.0.0.1:80,10.0.0.2:80",
+		"ULTRAFAST_LOG_LEVEL": "debug",
+	}
+	var output bytes.Buffer
+	cl, err := parseCommandLine([]string{"-port", "9001", "-rcvbuf", "8388608", "-listen", "10.0.0.3:80", "server.toml"},
+		func(name string) string { return env[name] }, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl.port != 9001 || cl.loops != 4 || cl.recvBuffer != 8388608 || cl.logLevel != "debug" || cl.config != "server.toml" {
+		t.Errorf("Expected flags to override the environment, got %+v", cl)
+	}
+	addrs := cl.addresses()
+	if len(addrs) != 4 || addrs[0] != (ultrafast.SocketAddr{IP: "127.0.0.1", Port: 9001}) || addrs[3].IP != "10.0.0.3" {
+		t.Errorf("Unexpected addresses %v", addrs)
+	}
+
+	noEnv := func(string) string { return "" }
+	if _, err := parseCommandLine([]string{"-h"}, noEnv, &output); err != flag.ErrHelp {
+		t.Errorf("Expected -h to ask for help, got %v", err)
+	}
+	if !strings.Contains(output.String(), "ULTRAFAST_LOOPS") {
+		t.Error("Expected the usage to list the environment variables")
+	}
+	cl, err = parseCommandLine([]string{"-echo-port", "7", "-discard-port", "9"}, noEnv, &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services := cl.services("10.0.0.1")
+	if len(services) != 2 || services[0].addr != (ultrafast.SocketAddr{IP: "10.0.0.1", Port: 7}) ||
+		services[0].service != ultrafast.SERVICE_ECHO || services[1].service != ultrafast.SERVICE_DISCARD {
+		t.Errorf("Unexpected services %v", services)
+	}
+	for _, args := range [][]string{
+		{"-port", "70000"},
+		{"-addr", "localhost"},
+		{"-listen", "10.0.0.1"},
+		{"-echo-port", "70000"},
+		{"-loops", "0"},
+		{"-loops", "2", "-port", "0"},
+		{"-sndbuf", "-1"},
+		{"-log-level", "loud"},
+		{"a.json", "b.json"},
+	} {
+		if _, err := parseCommandLine(args, noEnv, &output); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
+	if _, err := parseCommandLine(nil, func(string) string { return "x" }, &output); err == nil ||
+		!strings.Contains(err.Error(), "ULTRAFAST_") {
+		t.Errorf("Expected a bad environment variable to be named, got %v", err)
+	}
+}
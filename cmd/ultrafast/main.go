@@ -0,0 +1,156 @@
+// Command ultrafast runs the server from the command line, configured
+// through flags, environment variables and config files.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ultrafast "claude-go-http"
+)
+
+// socketDir is the directory, private to this user, that holds the
+// server's unix sockets: ultrafast under $XDG_RUNTIME_DIR, or one per uid
+// under the temporary directory. The server creates it mode 0700 and
+// refuses one that others can enter.
+func socketDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "ultrafast")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("ultrafast-%d", os.Getuid()))
+}
+
+// adminSocketPath is where the control channel listens
+var adminSocketPath = filepath.Join(socketDir(), "admin.sock")
+
+// upgradeSocketPath is where a running server waits to hand over to a new
+// binary started with ULTRAFAST_UPGRADE=1
+var upgradeSocketPath = filepath.Join(socketDir(), "upgrade.sock")
+
+// main runs the ultra-fast server. The server itself is the ultrafast
+// package; this is only its command line.
+func main() {
+	// "replay capture.pcap" debugs captured traffic instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		return
+	}
+
+	cl, err := parseCommandLine(os.Args[1:], os.Getenv, os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid command line: %v", err)
+	}
+
+	// A TOML startup config is checked in full before anything is bound;
+	// any other file is a runtime config, loaded once the servers exist
+	var startup *ultrafast.StartupConfig
+	addrs := cl.addresses()
+	if strings.HasSuffix(cl.config, ".toml") {
+		if startup, err = ultrafast.LoadStartupConfig(cl.config); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		if addrs[0], err = ultrafast.ParseSocketAddr(startup.Listen); err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+	}
+
+	// Each address gets its loops as servers of their own, which the
+	// kernel balances datagrams between through SO_REUSEPORT
+	var servers []*ultrafast.UltraFastHTTPServer
+	if os.Getenv("ULTRAFAST_UPGRADE") != "" {
+		server, err := ultrafast.InheritServer(upgradeSocketPath)
+		if err != nil {
+			log.Fatalf("Failed to create server: %v", err)
+		}
+		defer server.Close()
+		servers = append(servers, server)
+	} else {
+		for _, addr := range addrs {
+			for loop := 0; loop < cl.loops; loop++ {
+				server, err := newCommandLineServer(addr, startup, len(servers) == 0)
+				if err != nil {
+					log.Fatalf("Failed to create server: %v", err)
+				}
+				defer server.Close()
+				servers = append(servers, server)
+			}
+		}
+		for _, raw := range cl.services(addrs[0].IP) {
+			for loop := 0; loop < cl.loops; loop++ {
+				server, err := newCommandLineServer(raw.addr, startup, false)
+				if err != nil {
+					log.Fatalf("Failed to create %v server: %v", raw.service, err)
+				}
+				defer server.Close()
+				server.SetService(raw.service)
+				servers = append(servers, server)
+			}
+			log.Printf("Serving %v on %v", raw.service, raw.addr)
+		}
+	}
+	for _, server := range servers {
+		if err := server.SetSocketBuffers(cl.recvBuffer, cl.sendBuffer); err != nil {
+			log.Fatalf("Failed to size socket buffers: %v", err)
+		}
+	}
+	if cl.logLevel != "" {
+		level, _ := ultrafast.ParseLogLevel(cl.logLevel)
+		ultrafast.SetLogLevel(level)
+	}
+	server := servers[0]
+	addr := server.LocalAddr()
+
+	log.Printf("Starting Ultra-Fast HTTP Server...")
+	log.Printf("Features:")
+	log.Printf("  - Raw Linux syscalls (no net package)")
+	log.Printf("  - Zero-copy operations with mmap/sendfile")
+	log.Printf("  - Epoll-based async I/O (10k+ concurrent connections)")
+	log.Printf("  - Lock-free reliability layer")
+	log.Printf("  - Custom binary protocol over UDP")
+	log.Printf("  - Target: <100μs latency, >1M requests/second")
+	log.Printf("")
+	log.Printf("Try:")
+	log.Printf("  curl http://%v/", addr)
+	log.Printf("  curl http://%v/stats", addr)
+	log.Printf("  curl http://%v/benchmark", addr)
+	log.Printf("  echo help | socat - UNIX-CONNECT:%s", adminSocketPath)
+
+	if err := server.EnableAdmin(adminSocketPath); err != nil {
+		log.Printf("Admin channel disabled: %v", err)
+	}
+
+	if err := server.EnableUpgrade(upgradeSocketPath, 0); err != nil {
+		log.Printf("Live upgrade disabled: %v", err)
+	}
+
+	// A runtime config given on the command line is reloaded on SIGHUP;
+	// a startup config names its own
+	if cl.config != "" && startup == nil {
+		for _, server := range servers {
+			if err := server.LoadConfig(cl.config); err != nil {
+				log.Fatalf("Failed to load config: %v", err)
+			}
+		}
+		log.Printf("Loaded %s; send SIGHUP to reload it", cl.config)
+	}
+
+	for _, other := range servers[1:] {
+		go func(other *ultrafast.UltraFastHTTPServer) {
+			if err := other.Start(); err != nil {
+				log.Fatalf("Server error: %v", err)
+			}
+		}(other)
+	}
+	if err := server.Start(); err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	ultrafast "claude-go-http"
+)
+
+// runReplay is the replay command: it replays a capture into a server
+// configured from an optional config file and prints the timeline, then
+// how the server's packets compare with the captured ones
+func runReplay(args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return fmt.Errorf("usage: %s replay capture.pcap [port [config]]", os.Args[0])
+	}
+	var config ultrafast.ReplayConfig
+	if len(args) > 1 {
+		if _, err := fmt.Sscanf(args[1], "%d", &config.Server.Port); err != nil {
+			return fmt.Errorf("invalid port: %s", args[1])
+		}
+	}
+
+	server, err := ultrafast.NewUltraFastHTTPServer("127.0.0.1", 0)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	if len(args) > 2 {
+		if err := server.LoadConfig(args[2]); err != nil {
+			return fmt.Errorf("failed to load config: %v", err)
+		}
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	result, err := server.Replay(file, config)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range result.Events {
+		fmt.Println(event)
+	}
+	fmt.Printf("\nreplayed %d datagrams over %v, skipped %d\n", result.Fed, result.Duration, result.Skipped)
+	kinds := make(map[string]bool)
+	for kind := range result.Captured {
+		kinds[kind] = true
+	}
+	for kind := range result.Replayed {
+		kinds[kind] = true
+	}
+	sorted := make([]string, 0, len(kinds))
+	for kind := range kinds {
+		sorted = append(sorted, kind)
+	}
+	sort.Strings(sorted)
+	fmt.Printf("%-24s %9s %9s\n", "sent", "captured", "replayed")
+	for _, kind := range sorted {
+		fmt.Printf("%-24s %9d %9d\n", kind, result.Captured[kind], result.Replayed[kind])
+	}
+	if diverged := result.Diverged(); len(diverged) > 0 {
+		fmt.Printf("diverged: %s\n", strings.Join(diverged, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package ultrafast
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// OPT_BATCH marks a DATA packet whose payload holds several small
+// responses instead of one. Each is a record of request ID (4 bytes),
+// length (2 bytes) and the response bytes. The option value is empty.
+const OPT_BATCH = 0x06
+
+// batchRecordHeader is the request ID and length in front of each record
+const batchRecordHeader = 6
+
+// defaultCoalesceMaxSize is the largest response coalesced by default;
+// bigger ones gain little from sharing a packet
+const defaultCoalesceMaxSize = 512
+
+// CoalesceConfig controls write coalescing, the equivalent of Nagle's
+// algorithm: small responses to the same peer are held for up to Window
+// so that several can share one packet, which goes out early once full.
+// Connections with NoDelay set are never held.
+type CoalesceConfig struct {
+	Window  time.Duration // how long a small response may wait; 0 turns coalescing off
+	MaxSize int           // responses up to this many bytes are coalesced, default 512
+}
+
+// SetCoalescing configures write coalescing. It is off until enabled
+// with a non-zero Window. Only responses to requests that carry a
+// request ID are held, since the client matches records by that ID.
+func (s *UltraFastHTTPServer) SetCoalescing(config CoalesceConfig) {
+	if config.Window <= 0 {
+		s.coalesce.Store(nil)
+		return
+	}
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultCoalesceMaxSize
+	}
+	config.MaxSize = min(config.MaxSize, MAX_PAYLOAD_SIZE-batchRecordHeader)
+	s.coalesce.Store(&config)
+}
+
+// Coalescing returns the write coalescing configuration
+func (s *UltraFastHTTPServer) Coalescing() CoalesceConfig {
+	if config := s.coalesce.Load(); config != nil {
+		return *config
+	}
+	return CoalesceConfig{}
+}
+
+// SetNoDelay stops responses on the connection from being held for
+// coalescing, like TCP_NODELAY. Anything already held is sent at the
+// next flush.
+func (c *Connection) SetNoDelay(noDelay bool) {
+	value := int32(0)
+	if noDelay {
+		value = 1
+	}
+	atomic.StoreInt32(&c.noDelay, value)
+}
+
+// NoDelay reports whether coalescing is disabled for the connection
+func (c *Connection) NoDelay() bool {
+	return atomic.LoadInt32(&c.noDelay) == 1
+}
+
+// SetNoDelay disables coalescing for the connection the request arrived on
+func (r *HTTPRequest) SetNoDelay(noDelay bool) error {
+	if r.handler == nil {
+		return fmt.Errorf("request was not received over a connection")
+	}
+	conn := r.handler.server.connections.Get(r.Peer)
+	if conn == nil {
+		return fmt.Errorf("no connection for %v", r.Peer)
+	}
+	conn.SetNoDelay(noDelay)
+	return nil
+}
+
+// coalesceResponse holds a small response for the connection's next batch
+// and reports whether it did; otherwise the caller sends it on its own
+func (h *HTTPSocketHandler) coalesceResponse(conn *Connection, data []byte, requestID uint32) bool {
+	config := h.server.coalesce.Load()
+	if config == nil || conn == nil || requestID == 0 || len(data) > config.MaxSize ||
+		conn.NoDelay() || atomic.LoadInt32(&conn.closing) == 1 {
+		return false
+	}
+
+	// Make room first if this response would overflow the batch
+	conn.batchMu.Lock()
+	if len(conn.batch)+batchRecordHeader+len(data) > MAX_PAYLOAD_SIZE {
+		conn.batchMu.Unlock()
+		h.flushBatch(conn)
+		conn.batchMu.Lock()
+	}
+
+	conn.batch = binary.BigEndian.AppendUint32(conn.batch, requestID)
+	conn.batch = binary.BigEndian.AppendUint16(conn.batch, uint16(len(data)))
+	conn.batch = append(conn.batch, data...)
+	conn.batchCount++
+	if conn.batchTimer == nil {
+		conn.batchTimer = time.AfterFunc(config.Window, func() {
+			h.server.sendOnLoop(func() { h.flushBatch(conn) })
+		})
+	}
+	full := len(conn.batch)+batchRecordHeader >= MAX_PAYLOAD_SIZE
+	conn.batchMu.Unlock()
+
+	if full {
+		h.flushBatch(conn)
+	}
+	return true
+}
+
+// flushBatch sends the responses held for a connection. A lone response
+// goes out as an ordinary packet.
+func (h *HTTPSocketHandler) flushBatch(conn *Connection) {
+	conn.batchMu.Lock()
+	batch, count := conn.batch, conn.batchCount
+	conn.batch, conn.batchCount = nil, 0
+	if conn.batchTimer != nil {
+		conn.batchTimer.Stop()
+		conn.batchTimer = nil
+	}
+	conn.batchMu.Unlock()
+
+	peer := h.server.connections.PeerOf(conn)
+	if count == 0 || h.server.connections.Get(peer) != conn {
+		return // nothing held, or the connection is gone
+	}
+
+	var sent int
+	var err error
+	if count == 1 {
+		requestID := binary.BigEndian.Uint32(batch)
+		sent, err = h.sendResponsePacket(batch[batchRecordHeader:], 0, 0, conn, peer, requestID)
+	} else {
+		packet := NewPacket(DATA_PACKET, 0, 0, 0, batch)
+		packet.SetOption(OPT_BATCH, nil)
+		sent, err = h.sendDataPacket(packet, true, conn, peer)
+	}
+	if err != nil {
+		atomic.AddUint64(&h.server.stats.Errors, 1)
+		return
+	}
+	atomic.AddUint64(&h.server.stats.ResponsesSent, uint64(count))
+	atomic.AddUint64(&h.server.stats.BytesSent, uint64(sent))
+}
+
+// splitBatch decodes the records of a batch packet into one DATA packet
+// per response, tagged with its request ID. A truncated record ends the
+// batch.
+func splitBatch(packet *Packet) []*Packet {
+	var responses []*Packet
+	payload := packet.Payload
+	for len(payload) >= batchRecordHeader {
+		requestID := binary.BigEndian.Uint32(payload)
+		size := int(binary.BigEndian.Uint16(payload[4:]))
+		payload = payload[batchRecordHeader:]
+		if size > len(payload) {
+			break
+		}
+		response := NewPacket(DATA_PACKET, 0, packet.SeqNum, 0, payload[:size])
+		response.SetRequestID(requestID)
+		responses = append(responses, response)
+		payload = payload[size:]
+	}
+	return responses
+}
@@ -0,0 +1,116 @@
+package ultrafast
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startCoalescingServer runs a test server that holds responses for window
+// and answers /item/N with a body of size bytes naming N. Requests for
+// /item/N/nodelay turn coalescing off for their connection.
+func startCoalescingServer(t *testing.T, window time.Duration, size int) *UltraFastHTTPServer {
+	t.Helper()
+	server := startTestServer(t)
+	server.SetCoalescing(CoalesceConfig{Window: window})
+	server.HandlePrefix("/item/", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		body, noDelay := strings.CutSuffix(strings.TrimPrefix(request.Path, "/item/"), "/nodelay")
+		if noDelay {
+			if err := request.SetNoDelay(true); err != nil {
+				t.Errorf("SetNoDelay failed: %v", err)
+			}
+		}
+		return &HTTPResponse{
+			StatusCode: 200,
+			Headers:    map[string]string{"Content-Type": "text/plain"},
+			Body:       []byte(body + strings.Repeat(".", size-len(body))),
+		}
+	})
+	return server
+}
+
+// pipelineItems requests /item/0 to /item/n-1, each followed by suffix, in
+// one pipeline and checks each response answers its own request
+func pipelineItems(t *testing.T, server *UltraFastHTTPServer, n int, suffix string) {
+	t.Helper()
+	client := newTestClient(t, server)
+	addr := server.socket.GetLocalAddr()
+
+	requests := make([][]byte, n)
+	for i := range requests {
+		requests[i] = buildGetRequest(fmt.Sprintf("/item/%d%s", i, suffix), addr)
+	}
+	responses, err := client.Pipeline(requests)
+	if err != nil {
+		t.Fatalf("Pipeline failed: %v", err)
+	}
+	for i, response := range responses {
+		if !strings.Contains(string(response), fmt.Sprintf("\r\n\r\n%d.", i)) {
+			t.Errorf("Response %d answers the wrong request: %q", i, response)
+		}
+	}
+
+	// The server counts a response just after sending it
+	deadline := time.Now().Add(time.Second)
+	for server.GetStats().ResponsesSent < uint64(n) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCoalescingBatchesSmallResponses(t *testing.T) {
+	server := startCoalescingServer(t, 50*time.Millisecond, 16)
+	pipelineItems(t, server, 10, "")
+
+	responses := server.GetStats().ResponsesSent
+	packets := server.reliability.GetStats().PacketsSent
+	if responses != 10 || packets >= responses {
+		t.Errorf("Expected 10 responses in fewer packets, got %d in %d", responses, packets)
+	}
+}
+
+func TestCoalescingSplitsFullBatches(t *testing.T) {
+	server := startCoalescingServer(t, time.Second, 300)
+
+	// Roughly four responses fit a packet; a full batch goes out at once
+	// rather than waiting out the window
+	start := time.Now()
+	pipelineItems(t, server, 12, "")
+	if packets := server.reliability.GetStats().PacketsSent; packets < 3 || packets >= 12 {
+		t.Errorf("Expected 12 responses split over a few packets, got %d", packets)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Full batches should not wait for the window, took %v", elapsed)
+	}
+}
+
+func TestCoalescingNoDelay(t *testing.T) {
+	server := startCoalescingServer(t, time.Second, 16)
+
+	start := time.Now()
+	pipelineItems(t, server, 5, "/nodelay")
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("NoDelay responses waited for the window: %v", elapsed)
+	}
+	if packets := server.reliability.GetStats().PacketsSent; packets != 5 {
+		t.Errorf("Expected one packet per response with NoDelay, got %d", packets)
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	payload := []byte{0, 0, 0, 7, 0, 2, 'h', 'i', 0, 0, 0, 9, 0, 0, 0, 0, 0, 1, 0, 5, 'x'}
+	responses := splitBatch(NewPacket(DATA_PACKET, 0, 4, 0, payload))
+	if len(responses) != 2 {
+		t.Fatalf("Expected 2 complete records, got %d", len(responses))
+	}
+	for i, expected := range []struct {
+		id   uint32
+		body string
+	}{{7, "hi"}, {9, ""}} {
+		id, _ := responses[i].RequestID()
+		if id != expected.id || string(responses[i].Payload) != expected.body {
+			t.Errorf("Record %d: expected %d %q, got %d %q", i, expected.id, expected.body, id, responses[i].Payload)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package ultrafast
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CompressionConfig controls response compression. Zero values take the
+// defaults.
+type CompressionConfig struct {
+	MinSize int // bodies smaller than this are sent as is, default 1024
+	Level   int // compress/flate level, default flate.DefaultCompression
+}
+
+// contentEncoder compresses bodies with pooled writers and buffers, so
+// steady-state compression does not allocate per response
+type contentEncoder struct {
+	config  CompressionConfig
+	gzip    sync.Pool // *gzip.Writer
+	deflate sync.Pool // *zlib.Writer
+	buffers sync.Pool // *bytes.Buffer
+}
+
+// newContentEncoder creates an encoder; an invalid level falls back to
+// the default
+func newContentEncoder(config CompressionConfig) *contentEncoder {
+	if config.MinSize <= 0 {
+		config.MinSize = 1024
+	}
+	if _, err := gzip.NewWriterLevel(io.Discard, config.Level); err != nil || config.Level == 0 {
+		config.Level = gzip.DefaultCompression
+	}
+
+	e := &contentEncoder{config: config}
+	e.gzip.New = func() interface{} {
+		w, _ := gzip.NewWriterLevel(io.Discard, e.config.Level)
+		return w
+	}
+	e.deflate.New = func() interface{} {
+		w, _ := zlib.NewWriterLevel(io.Discard, e.config.Level)
+		return w
+	}
+	e.buffers.New = func() interface{} {
+		return new(bytes.Buffer)
+	}
+	return e
+}
+
+// compressingWriter is the interface shared by gzip and zlib writers
+type compressingWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+// compress appends body, encoded with encoding, to dst
+func (e *contentEncoder) compress(dst []byte, body []byte, encoding string) ([]byte, error) {
+	pool := &e.gzip
+	if encoding == "deflate" {
+		pool = &e.deflate
+	}
+	writer := pool.Get().(compressingWriter)
+	defer pool.Put(writer)
+
+	buffer := e.buffers.Get().(*bytes.Buffer)
+	buffer.Reset()
+	defer e.buffers.Put(buffer)
+
+	writer.Reset(buffer)
+	if _, err := writer.Write(body); err != nil {
+		return dst, err
+	}
+	if err := writer.Close(); err != nil {
+		return dst, err
+	}
+	return append(dst, buffer.Bytes()...), nil
+}
+
+// encodeResponse compresses a response body when the client accepts a
+// supported coding and the body is large and compressible enough
+func (e *contentEncoder) encodeResponse(request *HTTPRequest, response *HTTPResponse) {
+	if response.StatusCode < 200 || response.StatusCode == 204 || response.StatusCode == 206 ||
+		response.StatusCode == 304 || response.file != nil || request.Method == "HEAD" {
+		return
+	}
+
+	if w := response.writer; w != nil {
+		if w.streaming || len(w.body) < e.config.MinSize || w.hasEncoding || !compressibleType(w.contentType) {
+			return
+		}
+		w.Header("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(request.Header("Accept-Encoding"))
+		if encoding == "" {
+			return
+		}
+		// compress finishes reading the body before appending to dst,
+		// so the writer's own buffer can take the result
+		compressed, err := e.compress(w.body[:0], w.body, encoding)
+		if err != nil {
+			return
+		}
+		w.body = compressed
+		w.Header("Content-Encoding", encoding)
+		return
+	}
+
+	if len(response.Body) < e.config.MinSize || response.Headers["Content-Encoding"] != "" ||
+		!compressibleType(response.Headers["Content-Type"]) {
+		return
+	}
+	addVary(response, "Accept-Encoding")
+	encoding := negotiateEncoding(request.Header("Accept-Encoding"))
+	if encoding == "" {
+		return
+	}
+	compressed, err := e.compress(nil, response.Body, encoding)
+	if err != nil || len(compressed) >= len(response.Body) {
+		return
+	}
+
+	// The cache keeps the identity body, so a new slice is built rather
+	// than compressing in place; the ETag becomes weak because the bytes
+	// differ from the identity representation
+	response.Body = compressed
+	response.Headers["Content-Encoding"] = encoding
+	if etag := response.Headers["ETag"]; etag != "" && !strings.HasPrefix(etag, "W/") {
+		response.Headers["ETag"] = "W/" + etag
+	}
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip on a tie, or "" if neither is acceptable
+func negotiateEncoding(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	gzipQ, deflateQ, anyQ := -1.0, -1.0, -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, q := strings.TrimSpace(part), 1.0
+		if semi := strings.IndexByte(coding, ';'); semi >= 0 {
+			param := strings.TrimSpace(coding[semi+1:])
+			coding = strings.TrimSpace(coding[:semi])
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		switch strings.ToLower(coding) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "deflate":
+			deflateQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	if deflateQ < 0 {
+		deflateQ = anyQ
+	}
+
+	switch {
+	case gzipQ > 0 && gzipQ >= deflateQ:
+		return "gzip"
+	case deflateQ > 0:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+// compressibleType reports whether a Content-Type is worth compressing.
+// Responses without a type are assumed to be text.
+func compressibleType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	contentType = strings.ToLower(contentType)
+	if strings.HasPrefix(contentType, "text/") {
+		return true
+	}
+	for _, suffix := range []string{"json", "javascript", "xml", "svg", "wasm"} {
+		if strings.Contains(contentType, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// addVary adds a field to a response's Vary header
+func addVary(response *HTTPResponse, field string) {
+	vary := response.Headers["Vary"]
+	if vary == "" {
+		response.Headers["Vary"] = field
+		return
+	}
+	for _, existing := range strings.Split(vary, ",") {
+		if strings.EqualFold(strings.TrimSpace(existing), field) {
+			return
+		}
+	}
+	response.Headers["Vary"] = vary + ", " + field
+}
+
+// EnableCompression compresses responses for clients that accept gzip or
+// deflate, replacing any previous configuration
+func (s *UltraFastHTTPServer) EnableCompression(config CompressionConfig) {
+	s.encoder.Store(newContentEncoder(config))
+}
+
+// DisableCompression sends every response uncompressed
+func (s *UltraFastHTTPServer) DisableCompression() {
+	s.encoder.Store(nil)
+}
@@ -0,0 +1,110 @@
+package ultrafast
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header, encoding string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0, deflate;q=0", ""},
+		{"br, *", "gzip"},
+		{"*;q=0, deflate", "deflate"},
+		{"identity", ""},
+	}
+	for _, test := range tests {
+		if got := negotiateEncoding(test.header); got != test.encoding {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", test.header, got, test.encoding)
+		}
+	}
+}
+
+func TestCompressAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("The race detector changes allocation counts")
+	}
+	encoder := newContentEncoder(CompressionConfig{})
+	body := []byte(strings.Repeat("compressible text ", 200))
+	dst := make([]byte, 0, len(body))
+	encoder.compress(dst, body, "gzip") // warm the pools
+
+	allocs := testing.AllocsPerRun(50, func() {
+		encoder.compress(dst[:0], body, "gzip")
+	})
+	if allocs != 0 {
+		t.Errorf("Expected pooled compression not to allocate, got %v allocations", allocs)
+	}
+}
+
+func TestServerCompression(t *testing.T) {
+	server := startTestServer(t)
+	server.EnableCompression(CompressionConfig{MinSize: 256})
+
+	text := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 40)
+	server.HandleFunc("/text", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{"Content-Type": "text/plain"}, Body: []byte(text)}
+	})
+	server.HandleWriter("/written", func(ctx context.Context, w *ResponseWriter, r *HTTPRequest) {
+		w.Header("Content-Type", "text/plain")
+		w.WriteString(text)
+	})
+	client := newTestClient(t, server)
+
+	get := func(path, acceptEncoding string) (string, []byte) {
+		request := "GET " + path + " HTTP/1.1\r\n"
+		if acceptEncoding != "" {
+			request += "Accept-Encoding: " + acceptEncoding + "\r\n"
+		}
+		response, err := client.Do([]byte(request + "\r\n"))
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", path, err)
+		}
+		return splitResponse(t, response)
+	}
+
+	for _, path := range []string{"/text", "/written"} {
+		headers, body := get(path, "gzip")
+		if !containsString(headers, "Content-Encoding: gzip") || !containsString(headers, "Vary: Accept-Encoding") {
+			t.Fatalf("Expected a gzip response for %s, got headers %q", path, headers)
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Invalid gzip body for %s: %v", path, err)
+		}
+		if decoded, _ := io.ReadAll(reader); string(decoded) != text {
+			t.Errorf("gzip body for %s does not decode to the original", path)
+		}
+	}
+
+	headers, body := get("/text", "deflate")
+	if !containsString(headers, "Content-Encoding: deflate") {
+		t.Fatalf("Expected a deflate response, got headers %q", headers)
+	}
+	reader, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Invalid deflate body: %v", err)
+	}
+	if decoded, _ := io.ReadAll(reader); string(decoded) != text {
+		t.Error("deflate body does not decode to the original")
+	}
+
+	headers, body = get("/text", "")
+	if containsString(headers, "Content-Encoding") || string(body) != text {
+		t.Errorf("A client without Accept-Encoding should get the identity body, got headers %q", headers)
+	}
+	if headers, _ := get("/benchmark", "gzip"); containsString(headers, "Content-Encoding") {
+		t.Error("Bodies under the size threshold should not be compressed")
+	}
+}
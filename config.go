@@ -0,0 +1,294 @@
+package ultrafast
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// ServerConfig is the part of the server's configuration that can be
+// read from a JSON file and reloaded while the server runs. Settings left
+// out of the file keep their current values; routes are replaced as a set.
+//
+//	{
+//	  "log_level": "info",
+//	  "rate_limit": {"packets_per_second": 1000, "bytes_per_second": 1e6, "action": "rst"},
+//	  "flow_collector": "10.0.0.9:4739",
+//	  "acl": {"allow": ["10.0.0.0/8"], "deny": ["10.6.6.0/24"]},
+//	  "routes": [
+//	    {"path": "/hello", "body": "hello\n"},
+//	    {"path": "/assets/", "prefix": true, "dir": "./public"}
+//	  ]
+//	}
+type ServerConfig struct {
+	LogLevel      string         `json:"log_level"`
+	RateLimit     *RateLimitFile `json:"rate_limit"`
+	FlowCollector *string        `json:"flow_collector"` // IPFIX collector as ip:port, "" for none
+	ACL           *ACLFile       `json:"acl"`
+	Routes        []RouteConfig  `json:"routes"`
+}
+
+// RateLimitFile is a rate limit as written in a config file. Zero rates
+// turn rate limiting off.
+type RateLimitFile struct {
+	PacketsPerSecond float64 `json:"packets_per_second"`
+	PacketBurst      float64 `json:"packet_burst"`
+	BytesPerSecond   float64 `json:"bytes_per_second"`
+	ByteBurst        float64 `json:"byte_burst"`
+	Action           string  `json:"action"`      // "drop" (default) or "rst"
+	MaxSources       int     `json:"max_sources"` // sources tracked at once, 0 for the default
+}
+
+// ACLFile is an access list as written in a config file. It replaces
+// the one in force, edits made over the admin socket included; with no
+// rules access is not filtered.
+type ACLFile struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// RouteConfig is a route registered from a config file: a directory of
+// files, upstream servers to proxy to, or a fixed response
+type RouteConfig struct {
+	Path        string   `json:"path"`
+	Prefix      bool     `json:"prefix"`       // match every path under Path
+	Dir         string   `json:"dir"`          // serve files from this directory
+	Status      int      `json:"status"`       // fixed response status, default 200
+	ContentType string   `json:"content_type"` // default text/plain
+	Body        string   `json:"body"`
+	Upstreams   []string `json:"upstreams"` // forward to these HTTP servers in turn, see ReverseProxy
+}
+
+// configuredRoute is a route built from the config file, ready to register
+type configuredRoute struct {
+	path    string
+	prefix  bool
+	handler RequestHandler
+}
+
+// ParseServerConfig reads and validates a JSON config
+func ParseServerConfig(data []byte) (*ServerConfig, error) {
+	var config ServerConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	if config.LogLevel != "" {
+		if _, err := ParseLogLevel(config.LogLevel); err != nil {
+			return nil, err
+		}
+	}
+	if limit := config.RateLimit; limit != nil && limit.Action != "" &&
+		limit.Action != "drop" && limit.Action != "rst" {
+		return nil, fmt.Errorf("invalid rate limit action: %s", limit.Action)
+	}
+	if collector := config.FlowCollector; collector != nil && *collector != "" {
+		if _, err := ParseSocketAddr(*collector); err != nil {
+			return nil, fmt.Errorf("invalid flow collector: %v", err)
+		}
+	}
+	if acl := config.ACL; acl != nil {
+		if _, err := NewAccessList(acl.Allow, acl.Deny); err != nil {
+			return nil, fmt.Errorf("invalid acl: %v", err)
+		}
+	}
+	if err := validateRoutes(config.Routes); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// validateRoutes checks configured routes
+func validateRoutes(routes []RouteConfig) error {
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, "/") {
+			return fmt.Errorf("route path must start with /: %q", route.Path)
+		}
+		if route.Dir != "" {
+			info, err := os.Stat(route.Dir)
+			if err != nil {
+				return fmt.Errorf("route %s: %v", route.Path, err)
+			}
+			if !info.IsDir() {
+				return fmt.Errorf("route %s: %s is not a directory", route.Path, route.Dir)
+			}
+		}
+		for _, upstream := range route.Upstreams {
+			if _, err := parseUpstream(upstream); err != nil {
+				return fmt.Errorf("route %s: %v", route.Path, err)
+			}
+		}
+		if route.Status != 0 && (route.Status < 100 || route.Status > 599) {
+			return fmt.Errorf("route %s: invalid status %d", route.Path, route.Status)
+		}
+	}
+	return nil
+}
+
+// rateLimitConfig converts the file form of a rate limit
+func (f *RateLimitFile) rateLimitConfig() RateLimitConfig {
+	config := RateLimitConfig{
+		PacketsPerSecond: f.PacketsPerSecond,
+		PacketBurst:      f.PacketBurst,
+		BytesPerSecond:   f.BytesPerSecond,
+		ByteBurst:        f.ByteBurst,
+		MaxSources:       f.MaxSources,
+	}
+	if f.Action == "rst" {
+		config.Action = RATE_LIMIT_RST
+	}
+	return config
+}
+
+// handler builds the request handler for a configured route
+func (route RouteConfig) handler() RequestHandler {
+	if len(route.Upstreams) > 0 {
+		// The upstreams were checked with the rest of the config
+		proxy, _ := NewReverseProxy(route.Upstreams, ProxyConfig{})
+		return proxy.ServeRequest
+	}
+	if route.Dir != "" {
+		fs := NewFileServer(route.Dir)
+		prefix := route.Path
+		return func(ctx context.Context, r *HTTPRequest) *HTTPResponse {
+			return fs.ServeFile(r, strings.TrimPrefix(r.Path, prefix))
+		}
+	}
+	status := route.Status
+	if status == 0 {
+		status = 200
+	}
+	contentType := route.ContentType
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+	body := []byte(route.Body)
+	return func(ctx context.Context, r *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{
+			StatusCode: status,
+			Headers:    map[string]string{"Content-Type": contentType},
+			Body:       body,
+		}
+	}
+}
+
+// ApplyConfig applies a parsed config to the running server. Connections
+// are left alone; routes from the previous config are swapped for the new
+// ones on the server's own router, overriding routes registered in code
+// at the same paths.
+func (s *UltraFastHTTPServer) ApplyConfig(config *ServerConfig) {
+	if config.LogLevel != "" {
+		level, _ := ParseLogLevel(config.LogLevel)
+		SetLogLevel(level)
+	}
+
+	if limit := config.RateLimit; limit != nil {
+		if limit.PacketsPerSecond == 0 && limit.BytesPerSecond == 0 {
+			s.DisableRateLimit()
+		} else {
+			s.SetRateLimit(limit.rateLimitConfig())
+		}
+	}
+
+	// A reload naming the same collector keeps the exporter, and with it
+	// the record sequence the collector tracks
+	if collector := config.FlowCollector; collector != nil {
+		if *collector == "" {
+			s.DisableFlowExport()
+		} else if addr, _ := ParseSocketAddr(*collector); s.FlowExporter() == nil || s.FlowExporter().Collector() != addr {
+			if _, err := s.EnableFlowExport(addr, FlowExportConfig{}); err != nil {
+				logWarnf("Failed to start flow export to %s: %v", addr, err)
+			}
+		}
+	}
+
+	if acl := config.ACL; acl != nil {
+		if len(acl.Allow) == 0 && len(acl.Deny) == 0 {
+			s.SetAccessList(nil)
+		} else {
+			list, _ := NewAccessList(acl.Allow, acl.Deny)
+			s.SetAccessList(list)
+		}
+	}
+
+	routes := make([]configuredRoute, len(config.Routes))
+	for i, route := range config.Routes {
+		routes[i] = configuredRoute{path: route.Path, prefix: route.Prefix, handler: route.handler()}
+	}
+	s.configMu.Lock()
+	s.router.replaceRoutes(s.configRoutes, routes)
+	s.configRoutes = routes
+	s.configMu.Unlock()
+	s.purgeResponseCache()
+}
+
+// LoadConfig reads a config file, applies it and remembers its path for
+// ReloadConfig. From then on SIGHUP reloads the file.
+func (s *UltraFastHTTPServer) LoadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	config, err := ParseServerConfig(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	s.ApplyConfig(config)
+
+	s.configMu.Lock()
+	s.configPath = path
+	s.configMu.Unlock()
+	s.reloadOnce.Do(s.handleReloadSignal)
+	return nil
+}
+
+// ReloadConfig re-reads the config file given to LoadConfig. A file that
+// fails to parse leaves the running configuration untouched.
+func (s *UltraFastHTTPServer) ReloadConfig() error {
+	s.configMu.Lock()
+	path := s.configPath
+	s.configMu.Unlock()
+	if path == "" {
+		return fmt.Errorf("no config file loaded")
+	}
+	return s.LoadConfig(path)
+}
+
+// handleReloadSignal reloads the config file on SIGHUP. The reload runs as
+// an event loop task, between packets, so connections carry on across it.
+//
+// The signal itself arrives through os/signal rather than a signalfd:
+// signalfd only sees signals blocked in every thread, and the Go runtime
+// gives no way to block one in threads it has yet to start.
+func (s *UltraFastHTTPServer) handleReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	s.signals = signals
+	go func() {
+		for range signals {
+			s.eventLoop.Submit(func() {
+				if err := s.ReloadConfig(); err != nil {
+					logErrorf("Config reload failed: %v", err)
+					return
+				}
+				logInfof("Configuration reloaded")
+			})
+		}
+	}()
+}
+
+// stopReloadSignal stops watching for SIGHUP
+func (s *UltraFastHTTPServer) stopReloadSignal() {
+	s.reloadOnce.Do(func() {})
+	if s.signals != nil {
+		signal.Stop(s.signals)
+		close(s.signals)
+		s.signals = nil
+	}
+}
@@ -0,0 +1,118 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseServerConfig(t *testing.T) {
+	config, err := ParseServerConfig([]byte(`{
+		"log_level": "warn",
+		"rate_limit": {"packets_per_second": 100, "action": "rst"},
+		"flow_collector": "10.0.0.9:4739",
+		"acl": {"allow": ["10.0.0.0/8", "192.168.1.7"], "deny": ["10.6.6.0/24"]},
+		"routes": [{"path": "/hello", "body": "hi"}, {"path": "/files/", "prefix": true, "dir": "."}]
+	}`))
+	if err != nil {
+		t.Fatalf("Valid config rejected: %v", err)
+	}
+	if config.LogLevel != "warn" || len(config.Routes) != 2 || !config.Routes[1].Prefix ||
+		config.FlowCollector == nil || *config.FlowCollector != "10.0.0.9:4739" ||
+		config.ACL == nil || len(config.ACL.Allow) != 2 || len(config.ACL.Deny) != 1 {
+		t.Errorf("Unexpected config %+v", config)
+	}
+	if limit := config.RateLimit.rateLimitConfig(); limit.PacketsPerSecond != 100 || limit.Action != RATE_LIMIT_RST {
+		t.Errorf("Unexpected rate limit %+v", limit)
+	}
+
+	invalid := []string{
+		`{"log_level": "loud"}`,
+		`{"rate_limit": {"action": "block"}}`,
+		`{"flow_collector": "collector:4739"}`,
+		`{"flow_collector": "10.0.0.9"}`,
+		`{"acl": {"deny": ["10.0.0.0/33"]}}`,
+		`{"acl": {"allow": ["example.com"]}}`,
+		`{"routes": [{"path": "hello"}]}`,
+		`{"routes": [{"path": "/x", "status": 42}]}`,
+		`{"routes": [{"path": "/x", "dir": "/nonexistent/dir"}]}`,
+		`{"routes": [{"path": "/x", "upstreams": ["localhost:80"]}]}`,
+		`{"unknown": true}`,
+		`not json`,
+	}
+	for _, data := range invalid {
+		if _, err := ParseServerConfig([]byte(data)); err == nil {
+			t.Errorf("Expected %s to be rejected", data)
+		}
+	}
+}
+
+func TestServerReloadConfig(t *testing.T) {
+	defer SetLogLevel(GetLogLevel())
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+
+	path := filepath.Join(t.TempDir(), "server.json")
+	write := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(path string) string {
+		t.Helper()
+		response, err := client.Get(path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		return string(response)
+	}
+
+	write(`{"routes": [{"path": "/hello", "body": "hello v1"}]}`)
+	if err := server.LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if response := get("/hello"); !containsString(response, "hello v1") {
+		t.Errorf("Expected the configured route, got %q", response)
+	}
+	id, _ := client.ConnectionID()
+
+	// SIGHUP swaps the routes and settings without touching connections
+	write(`{"log_level": "error", "rate_limit": {"packets_per_second": 10000},
+		"routes": [{"path": "/bye", "status": 410, "body": "gone"}]}`)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for GetLogLevel() != LOG_ERROR && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if GetLogLevel() != LOG_ERROR {
+		t.Fatal("SIGHUP did not reload the config")
+	}
+	if limiter := server.rateLimiter.Load(); limiter == nil || limiter.Config().PacketsPerSecond != 10000 {
+		t.Error("Expected the rate limit from the reloaded config")
+	}
+	if response := get("/hello"); !containsString(response, "404 Not Found") {
+		t.Errorf("Expected the old route to be gone, got %q", response)
+	}
+	if response := get("/bye"); !containsString(response, "410") || !containsString(response, "gone") {
+		t.Errorf("Expected the new route, got %q", response)
+	}
+	if current, _ := client.ConnectionID(); current != id {
+		t.Errorf("Reload should keep the connection, got %x then %x", id, current)
+	}
+
+	// A broken file leaves the running config in place
+	write(`{"routes": [{"path": "nope"}]}`)
+	if err := server.ReloadConfig(); err == nil {
+		t.Error("Expected the broken config to be rejected")
+	}
+	if response := get("/bye"); !containsString(response, "gone") {
+		t.Errorf("Expected the previous routes to stay, got %q", response)
+	}
+}
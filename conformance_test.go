@@ -0,0 +1,542 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// The conformance suite replays golden packet transcripts from
+// testdata/conformance against the server and client state machines, so a
+// change to the wire format or to how either side answers a packet shows
+// up as a transcript mismatch.
+//
+// A transcript is a list of directives, one per line; indented lines
+// continue the previous directive and # starts a comment:
+//
+//	role server|client   which side is under test (default server)
+//	send <pattern>       send a datagram to the side under test
+//	expect <pattern>     the next datagram received must match
+//	silence              nothing arrives for a short while
+//	call connect|get <path>|close
+//	                     client role only: start a client operation
+//	returns <pattern>    wait for the call; its result must match
+//	returns error        wait for the call; it must fail
+//
+// A pattern is a sequence of tokens: hex bytes ("11 10", "00000001"),
+// quoted Go strings, ".." for any byte, "*" for any run of bytes,
+// <name:N> to capture N bytes, <name> or <name+K> to reuse a capture
+// (adding K as a big-endian integer), and <length> and <checksum> for the
+// header fields, which are filled in on send and verified on expect. The
+// capture <port> holds the harness socket's port.
+
+const (
+	conformanceReplyTimeout = time.Second
+	conformanceSilence      = 150 * time.Millisecond
+)
+
+// conformanceToken is one element of a pattern
+type conformanceToken struct {
+	kind  string // "bytes", "any", "rest", "capture", "ref", "length", "checksum"
+	bytes []byte
+	name  string
+	size  int
+	add   uint64
+}
+
+// conformanceStep is one directive of a transcript
+type conformanceStep struct {
+	line    int
+	action  string
+	pattern []conformanceToken
+	args    []string
+}
+
+// conformanceCall is a client operation running in the background
+type conformanceCall struct {
+	done   chan struct{}
+	result []byte
+	err    error
+}
+
+func TestConformance(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "conformance", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("No conformance transcripts found")
+	}
+
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".txt"), func(t *testing.T) {
+			role, steps, err := parseTranscript(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch role {
+			case "server":
+				runServerTranscript(t, steps)
+			case "client":
+				runClientTranscript(t, steps)
+			default:
+				t.Fatalf("Unknown role %q", role)
+			}
+		})
+	}
+}
+
+// runServerTranscript plays the client's side against a fresh server
+func runServerTranscript(t *testing.T, steps []conformanceStep) {
+	server := startTestServer(t)
+	server.HandleFunc("/conformance", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{
+			StatusCode: 200,
+			Headers:    map[string]string{"Content-Type": "text/plain"},
+			Body:       []byte("conformant"),
+		}
+	})
+
+	socket := newConformanceSocket(t)
+	player := newTranscriptPlayer(t, socket)
+	player.peer = server.socket.GetLocalAddr()
+	for _, step := range steps {
+		if step.action == "call" || step.action == "returns" {
+			t.Fatalf("line %d: %s is only valid in client transcripts", step.line, step.action)
+		}
+		player.play(step)
+	}
+}
+
+// runClientTranscript plays the server's side against a real client
+func runClientTranscript(t *testing.T, steps []conformanceStep) {
+	socket := newConformanceSocket(t)
+	addr := socket.GetLocalAddr()
+	client, err := NewUltraFastClient(addr.IP, addr.Port)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	client.SetTimeout(conformanceReplyTimeout)
+	t.Cleanup(func() { client.socket.Close() })
+
+	player := newTranscriptPlayer(t, socket)
+	var call *conformanceCall
+	for _, step := range steps {
+		switch step.action {
+		case "call":
+			if call != nil {
+				t.Fatalf("line %d: previous call has not returned", step.line)
+			}
+			call = startConformanceCall(t, client, step)
+		case "returns":
+			if call == nil {
+				t.Fatalf("line %d: no call in progress", step.line)
+			}
+			select {
+			case <-call.done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("line %d: call did not return", step.line)
+			}
+			if len(step.args) == 1 && step.args[0] == "error" {
+				if call.err == nil {
+					t.Fatalf("line %d: expected an error, call returned %q", step.line, call.result)
+				}
+			} else if call.err != nil {
+				t.Fatalf("line %d: call failed: %v", step.line, call.err)
+			} else if err := player.match(step.pattern, call.result, false); err != nil {
+				t.Fatalf("line %d: result %q: %v", step.line, call.result, err)
+			}
+			call = nil
+		default:
+			player.play(step)
+		}
+	}
+	if call != nil {
+		t.Fatal("Transcript ended with a call still in progress")
+	}
+}
+
+// startConformanceCall runs a client operation in the background
+func startConformanceCall(t *testing.T, client *UltraFastClient, step conformanceStep) *conformanceCall {
+	call := &conformanceCall{done: make(chan struct{})}
+	var run func() ([]byte, error)
+	switch {
+	case len(step.args) == 1 && step.args[0] == "connect":
+		run = func() ([]byte, error) { return nil, client.Connect() }
+	case len(step.args) == 2 && step.args[0] == "get":
+		run = func() ([]byte, error) { return client.Get(step.args[1]) }
+	case len(step.args) == 1 && step.args[0] == "close":
+		run = func() ([]byte, error) { return nil, client.Close() }
+	default:
+		t.Fatalf("line %d: unknown call %q", step.line, strings.Join(step.args, " "))
+	}
+	go func() {
+		defer close(call.done)
+		call.result, call.err = run()
+	}()
+	return call
+}
+
+// newConformanceSocket opens the harness's end of the exchange
+func newConformanceSocket(t *testing.T) *LinuxUDPSocket {
+	t.Helper()
+
+	socket, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	t.Cleanup(func() { socket.Close() })
+	if err := socket.Bind("127.0.0.1", 0); err != nil {
+		t.Fatalf("Failed to bind socket: %v", err)
+	}
+	return socket
+}
+
+// transcriptPlayer sends and checks datagrams, keeping the captures
+type transcriptPlayer struct {
+	t        *testing.T
+	socket   *LinuxUDPSocket
+	peer     SocketAddr // learned from the first datagram in client role
+	captures map[string][]byte
+}
+
+// newTranscriptPlayer starts with the harness socket's port captured
+func newTranscriptPlayer(t *testing.T, socket *LinuxUDPSocket) *transcriptPlayer {
+	port := binary.BigEndian.AppendUint16(nil, socket.GetLocalAddr().Port)
+	return &transcriptPlayer{t: t, socket: socket, captures: map[string][]byte{"port": port}}
+}
+
+// play executes a send, expect or silence directive
+func (p *transcriptPlayer) play(step conformanceStep) {
+	t := p.t
+	switch step.action {
+	case "send":
+		if p.peer.Port == 0 {
+			t.Fatalf("line %d: nothing to send to before the first datagram arrives", step.line)
+		}
+		data, err := p.build(step.pattern)
+		if err != nil {
+			t.Fatalf("line %d: %v", step.line, err)
+		}
+		if _, err := p.socket.SendTo(data, p.peer.IP, p.peer.Port); err != nil {
+			t.Fatalf("line %d: %v", step.line, err)
+		}
+	case "expect":
+		data, from, ok := p.receive(conformanceReplyTimeout)
+		if !ok {
+			t.Fatalf("line %d: no datagram arrived", step.line)
+		}
+		if p.peer.Port == 0 {
+			p.peer = from
+		}
+		if err := p.match(step.pattern, data, true); err != nil {
+			t.Fatalf("line %d: got %s: %v", step.line, hex.EncodeToString(data), err)
+		}
+	case "silence":
+		if data, _, ok := p.receive(conformanceSilence); ok {
+			t.Fatalf("line %d: expected silence, got %s", step.line, hex.EncodeToString(data))
+		}
+	default:
+		t.Fatalf("line %d: unknown directive %q", step.line, step.action)
+	}
+}
+
+// receive waits up to timeout for a datagram
+func (p *transcriptPlayer) receive(timeout time.Duration) ([]byte, SocketAddr, bool) {
+	deadline := time.Now().Add(timeout)
+	buffer := make([]byte, 65536)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, SocketAddr{}, false
+		}
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+		syscall.SetsockoptTimeval(p.socket.GetFD(), syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+		n, from, err := p.socket.RecvFrom(buffer)
+		if err == nil {
+			return buffer[:n], from, true
+		}
+	}
+}
+
+// build renders a send pattern, filling in the length and checksum
+func (p *transcriptPlayer) build(pattern []conformanceToken) ([]byte, error) {
+	var data []byte
+	lengthAt, checksumAt := -1, -1
+	for _, token := range pattern {
+		switch token.kind {
+		case "bytes":
+			data = append(data, token.bytes...)
+		case "ref":
+			value, err := p.reference(token)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, value...)
+		case "length":
+			lengthAt = len(data)
+			data = append(data, 0, 0)
+		case "checksum":
+			checksumAt = len(data)
+			data = append(data, 0, 0, 0, 0)
+		default:
+			return nil, fmt.Errorf("%s is only valid in expect patterns", token.kind)
+		}
+	}
+
+	if lengthAt >= 0 {
+		binary.BigEndian.PutUint16(data[lengthAt:], uint16(len(data)))
+	}
+	if checksumAt >= 0 {
+		if checksumAt != 12 || len(data) < PACKET_HEADER_SIZE {
+			return nil, fmt.Errorf("<checksum> must be the header's checksum field")
+		}
+		binary.BigEndian.PutUint32(data[12:], calculateChecksum(data[:12], data[PACKET_HEADER_SIZE:]))
+	}
+	return data, nil
+}
+
+// match checks data against a pattern, recording captures. A "*" token
+// skips whatever the fixed-size tokens after it leave over.
+func (p *transcriptPlayer) match(pattern []conformanceToken, data []byte, packet bool) error {
+	offset := 0
+	for i, token := range pattern {
+		if token.kind == "rest" {
+			tail := 0
+			for _, after := range pattern[i+1:] {
+				tail += p.tokenSize(after)
+			}
+			if len(data)-offset < tail {
+				return fmt.Errorf("too short at offset %d", offset)
+			}
+			offset = len(data) - tail
+			continue
+		}
+
+		size := p.tokenSize(token)
+		if offset+size > len(data) {
+			return fmt.Errorf("too short at offset %d", offset)
+		}
+		field := data[offset : offset+size]
+		var want []byte
+		switch token.kind {
+		case "bytes":
+			want = token.bytes
+		case "ref":
+			value, err := p.reference(token)
+			if err != nil {
+				return err
+			}
+			want = value
+		case "capture":
+			p.captures[token.name] = append([]byte(nil), field...)
+		case "length":
+			want = binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+		case "checksum":
+			if !packet || offset != 12 || len(data) < PACKET_HEADER_SIZE {
+				return fmt.Errorf("<checksum> must be the header's checksum field")
+			}
+			want = binary.BigEndian.AppendUint32(nil, calculateChecksum(data[:12], data[PACKET_HEADER_SIZE:]))
+		}
+		if want != nil && string(field) != string(want) {
+			return fmt.Errorf("offset %d: want %x, got %x", offset, want, field)
+		}
+		offset += size
+	}
+	if offset != len(data) {
+		return fmt.Errorf("%d unexpected trailing bytes", len(data)-offset)
+	}
+	return nil
+}
+
+// tokenSize returns the number of bytes a fixed-size token covers
+func (p *transcriptPlayer) tokenSize(token conformanceToken) int {
+	switch token.kind {
+	case "bytes":
+		return len(token.bytes)
+	case "ref":
+		return len(p.captures[token.name])
+	case "length":
+		return 2
+	case "checksum":
+		return 4
+	default:
+		return token.size
+	}
+}
+
+// reference returns a capture's value plus the token's offset
+func (p *transcriptPlayer) reference(token conformanceToken) ([]byte, error) {
+	value, ok := p.captures[token.name]
+	if !ok {
+		return nil, fmt.Errorf("<%s> has not been captured", token.name)
+	}
+	value = append([]byte(nil), value...)
+	carry := token.add
+	for i := len(value) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(value[i]) + carry&0xFF
+		value[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	return value, nil
+}
+
+// parseTranscript reads a transcript file into its role and steps
+func parseTranscript(path string) (string, []conformanceStep, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	// Join continuation lines onto their directive first
+	type logicalLine struct {
+		number int
+		text   string
+	}
+	var lines []logicalLine
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 && !strings.Contains(text[:i], `"`) {
+			text = text[:i]
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if text[0] == ' ' || text[0] == '\t' {
+			if len(lines) == 0 {
+				return "", nil, fmt.Errorf("%s:%d: continuation without a directive", path, number)
+			}
+			lines[len(lines)-1].text += " " + strings.TrimSpace(text)
+			continue
+		}
+		lines = append(lines, logicalLine{number, text})
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+
+	role := "server"
+	var steps []conformanceStep
+	for _, line := range lines {
+		fields, err := splitTranscriptLine(line.text)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s:%d: %v", path, line.number, err)
+		}
+		step := conformanceStep{line: line.number, action: fields[0], args: fields[1:]}
+		switch step.action {
+		case "role":
+			if len(steps) > 0 || len(step.args) != 1 {
+				return "", nil, fmt.Errorf("%s:%d: role must come first and name one side", path, line.number)
+			}
+			role = step.args[0]
+			continue
+		case "send", "expect", "returns":
+			if step.action == "returns" && len(step.args) == 1 && step.args[0] == "error" {
+				break
+			}
+			step.pattern, err = parsePattern(step.args)
+			if err != nil {
+				return "", nil, fmt.Errorf("%s:%d: %v", path, line.number, err)
+			}
+		}
+		steps = append(steps, step)
+	}
+	return role, steps, nil
+}
+
+// splitTranscriptLine splits a line on spaces, keeping quoted strings whole
+func splitTranscriptLine(text string) ([]string, error) {
+	var fields []string
+	for text = strings.TrimSpace(text); text != ""; text = strings.TrimSpace(text) {
+		if text[0] != '"' {
+			end := strings.IndexAny(text, " \t")
+			if end < 0 {
+				end = len(text)
+			}
+			fields = append(fields, text[:end])
+			text = text[end:]
+			continue
+		}
+		quoted, err := strconv.QuotedPrefix(text)
+		if err != nil {
+			return nil, fmt.Errorf("bad string: %v", err)
+		}
+		fields = append(fields, quoted)
+		text = text[len(quoted):]
+	}
+	return fields, nil
+}
+
+// parsePattern turns the fields of a send, expect or returns line into tokens
+func parsePattern(fields []string) ([]conformanceToken, error) {
+	var pattern []conformanceToken
+	rest := false
+	for _, field := range fields {
+		switch {
+		case field == "..":
+			pattern = append(pattern, conformanceToken{kind: "any", size: 1})
+		case field == "*":
+			if rest {
+				return nil, fmt.Errorf("only one * per pattern")
+			}
+			rest = true
+			pattern = append(pattern, conformanceToken{kind: "rest"})
+		case field[0] == '"':
+			text, err := strconv.Unquote(field)
+			if err != nil {
+				return nil, fmt.Errorf("bad string %s: %v", field, err)
+			}
+			pattern = append(pattern, conformanceToken{kind: "bytes", bytes: []byte(text)})
+		case strings.HasPrefix(field, "<") && strings.HasSuffix(field, ">"):
+			token, err := parsePlaceholder(field[1 : len(field)-1])
+			if err != nil {
+				return nil, err
+			}
+			pattern = append(pattern, token)
+		default:
+			value, err := hex.DecodeString(field)
+			if err != nil {
+				return nil, fmt.Errorf("bad hex %q", field)
+			}
+			pattern = append(pattern, conformanceToken{kind: "bytes", bytes: value})
+		}
+	}
+	return pattern, nil
+}
+
+// parsePlaceholder parses the inside of a <...> token
+func parsePlaceholder(text string) (conformanceToken, error) {
+	switch {
+	case text == "length" || text == "checksum":
+		return conformanceToken{kind: text}, nil
+	case strings.Contains(text, ":"):
+		name, size, _ := strings.Cut(text, ":")
+		n, err := strconv.Atoi(size)
+		if err != nil || n <= 0 {
+			return conformanceToken{}, fmt.Errorf("bad capture size in <%s>", text)
+		}
+		return conformanceToken{kind: "capture", name: name, size: n}, nil
+	case strings.Contains(text, "+"):
+		name, add, _ := strings.Cut(text, "+")
+		n, err := strconv.ParseUint(add, 10, 64)
+		if err != nil {
+			return conformanceToken{}, fmt.Errorf("bad offset in <%s>", text)
+		}
+		return conformanceToken{kind: "ref", name: name, add: n}, nil
+	default:
+		return conformanceToken{kind: "ref", name: text}, nil
+	}
+}
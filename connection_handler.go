@@ -0,0 +1,125 @@
+package ultrafast
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// connectionReadSize is how much OnConnectionData reads at a time
+const connectionReadSize = 64 * 1024
+
+// ConnectionHandler serves one connection carrying an application
+// protocol instead of HTTP
+type ConnectionHandler func(*Connection)
+
+// OnConnection hands every new connection to handler as an ordered byte
+// stream, for protocols other than HTTP. The handler runs on its own
+// goroutine, reading with conn.Read and answering with conn.Write; the
+// connection ends when the handler returns. Connections in the accept
+// queue start once accepted. Streams have no idle timeout of their own,
+// so handlers set one through conn.Stream() if they need it. Passing nil
+// returns new connections to HTTP.
+func (s *UltraFastHTTPServer) OnConnection(handler ConnectionHandler) {
+	if handler == nil {
+		s.connHandler.Store(nil)
+		return
+	}
+	s.connHandler.Store(&handler)
+}
+
+// OnConnectionData is the callback form of OnConnection: the server reads
+// each connection and calls handler with every chunk of data, in order
+// and one at a time per connection. The data is only valid during the
+// call. The connection ends when the peer closes it.
+func (s *UltraFastHTTPServer) OnConnectionData(handler func(conn *Connection, data []byte)) {
+	if handler == nil {
+		s.OnConnection(nil)
+		return
+	}
+	s.OnConnection(func(conn *Connection) {
+		buffer := make([]byte, connectionReadSize)
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				return
+			}
+			handler(conn, buffer[:n])
+		}
+	})
+}
+
+// startConnection switches a newly established connection to a stream
+// and runs the connection handler on it, if one is registered
+func (h *HTTPSocketHandler) startConnection(conn *Connection) {
+	handler := h.server.connHandler.Load()
+	if handler == nil {
+		return
+	}
+	stream := h.newServerStream(conn)
+	if !conn.stream.CompareAndSwap(nil, stream) {
+		return
+	}
+
+	go func() {
+		defer h.server.eventLoop.Submit(func() {
+			peer := h.server.connections.PeerOf(conn)
+			if h.server.connections.Get(peer) == conn {
+				h.dropConnection(peer)
+			}
+		})
+		// Closing waits for what the handler wrote to be acknowledged,
+		// which the event loop must be free to process
+		defer stream.Close()
+		(*handler)(conn)
+	}()
+}
+
+// serveEarlyData handles the data a SYN resuming a connection carried:
+// stream bytes on a connection with a handler, otherwise a request
+func (h *HTTPSocketHandler) serveEarlyData(packet *Packet, from SocketAddr) {
+	if conn := h.server.connections.Get(from); conn != nil {
+		if stream := conn.stream.Load(); stream != nil {
+			if !stream.deliver(packet.SeqNum, packet.Payload) {
+				atomic.AddUint64(&h.server.stats.OutOfOrderDropped, 1)
+			}
+			return
+		}
+	}
+	requestID, _ := packet.RequestID()
+	h.serveRequest(packet.Payload, requestID, from, true)
+}
+
+// Read reads the connection's stream bytes in order. It is for
+// connections served by an OnConnection handler.
+func (c *Connection) Read(b []byte) (int, error) {
+	stream := c.stream.Load()
+	if stream == nil {
+		return 0, fmt.Errorf("connection does not carry a stream")
+	}
+	return stream.Read(b)
+}
+
+// Write sends bytes on the connection's stream, returning once they are
+// sent or queued for the window
+func (c *Connection) Write(b []byte) (int, error) {
+	stream := c.stream.Load()
+	if stream == nil {
+		return 0, fmt.Errorf("connection does not carry a stream")
+	}
+	return stream.Write(b)
+}
+
+// Close ends the connection's stream with a FIN
+func (c *Connection) Close() error {
+	stream := c.stream.Load()
+	if stream == nil {
+		return errUseOfClosed
+	}
+	return stream.Close()
+}
+
+// Stream returns the connection's stream as a net.Conn, for deadlines
+// and addresses, or nil if it carries none
+func (c *Connection) Stream() *StreamConn {
+	return c.stream.Load()
+}
@@ -0,0 +1,112 @@
+package ultrafast
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// dialTestStream opens a stream to a test server
+func dialTestStream(t *testing.T, server *UltraFastHTTPServer) *StreamConn {
+	t.Helper()
+	addr := server.socket.GetLocalAddr()
+	stream, err := DialStream(addr.IP, addr.Port)
+	if err != nil {
+		t.Fatalf("DialStream failed: %v", err)
+	}
+	t.Cleanup(func() { stream.Close() })
+	stream.SetDeadline(time.Now().Add(2 * time.Second))
+	return stream
+}
+
+func TestOnConnectionEcho(t *testing.T) {
+	server := startTestServer(t)
+	server.OnConnection(func(conn *Connection) {
+		io.Copy(conn, conn)
+	})
+
+	stream := dialTestStream(t, server)
+	for _, message := range []string{"hello", "over the reliable transport"} {
+		if _, err := stream.Write([]byte(message)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		echo := make([]byte, len(message))
+		if _, err := io.ReadFull(stream, echo); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if string(echo) != message {
+			t.Errorf("Expected echo %q, got %q", message, echo)
+		}
+	}
+
+	// Closing the stream ends the handler and the connection
+	stream.Close()
+	waitForConnections(t, server, 0)
+}
+
+func TestOnConnectionHandlerCloses(t *testing.T) {
+	server := startTestServer(t)
+	server.OnConnection(func(conn *Connection) {
+		conn.Write([]byte("bye"))
+	})
+
+	stream := dialTestStream(t, server)
+	stream.Write([]byte("hi")) // the server learns of a stream with its first data
+	data, err := io.ReadAll(stream)
+	if err != nil || string(data) != "bye" {
+		t.Fatalf("Expected %q then EOF, got %q, %v", "bye", data, err)
+	}
+	waitForConnections(t, server, 0)
+}
+
+func TestOnConnectionData(t *testing.T) {
+	server := startTestServer(t)
+	server.OnConnectionData(func(conn *Connection, data []byte) {
+		conn.Write(bytes.ToUpper(data))
+	})
+
+	stream := dialTestStream(t, server)
+	if _, err := stream.Write([]byte("shout")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(stream, reply); err != nil || string(reply) != "SHOUT" {
+		t.Fatalf("Expected %q, got %q, %v", "SHOUT", reply, err)
+	}
+
+	// Without a handler new connections are HTTP again
+	server.OnConnection(nil)
+	if _, err := newTestClient(t, server).Get("/benchmark"); err != nil {
+		t.Errorf("HTTP request after removing the handler failed: %v", err)
+	}
+}
+
+func TestStreamWindowGrows(t *testing.T) {
+	server := startTestServer(t)
+	server.OnConnection(func(conn *Connection) {
+		io.Copy(conn, conn)
+	})
+
+	// Both sides send through their reliability layers, whose windows
+	// open as ACKs come back rather than one segment per round trip
+	stream := dialTestStream(t, server)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 16<<10)
+	go stream.Write(data)
+	echo := make([]byte, len(data))
+	if _, err := io.ReadFull(stream, echo); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(echo, data) {
+		t.Fatal("Echo does not match what was written")
+	}
+
+	client := stream.transport.(clientStreamTransport).c
+	if window := client.reliability.GetStats().CongestionWindow; window <= 1 {
+		t.Errorf("Expected the client's window opened, got %d", window)
+	}
+	conn := server.connections.Snapshot()[0]
+	if window := conn.Reliability().GetStats().CongestionWindow; window <= 1 {
+		t.Errorf("Expected the server's window opened, got %d", window)
+	}
+}
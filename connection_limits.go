@@ -0,0 +1,213 @@
+package ultrafast
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// OPT_RETRY_AFTER on a RST refusing a connection tells the client how
+// long to wait before trying again, in milliseconds (4 bytes)
+const OPT_RETRY_AFTER = 0x07
+
+// acceptHoldLimit caps the DATA packets kept for a connection waiting in
+// the accept queue; later ones go unacknowledged so the peer resends them
+const acceptHoldLimit = 16
+
+// ConnectionLimits bounds how many connections the server takes on. Unlike
+// KeepAliveConfig.MaxConnections, which evicts idle connections to make
+// room, MaxConnections here refuses the newcomer. A zero value sets no
+// limit and serves connections as soon as they are established.
+type ConnectionLimits struct {
+	MaxConnections int           // concurrent connections; SYNs beyond it get a RST, 0 for no limit
+	RetryAfter     time.Duration // hint carried by the RST, 0 for none
+	Backlog        int           // established connections waiting for Accept, 0 to serve them without Accept
+}
+
+// acceptQueue holds established connections until the application
+// accepts them
+type acceptQueue struct {
+	conns chan *Connection
+}
+
+// SetConnectionLimits configures connection admission. With a Backlog,
+// established connections wait in a queue of that size until Accept
+// takes them, and only then are their requests served; a SYN arriving
+// while the queue is full is refused like one over MaxConnections.
+// Connections still queued when the backlog is changed are served without
+// being accepted.
+func (s *UltraFastHTTPServer) SetConnectionLimits(limits ConnectionLimits) {
+	old := s.accept.Load()
+	if limits.Backlog > 0 {
+		s.accept.Store(&acceptQueue{conns: make(chan *Connection, limits.Backlog)})
+	} else {
+		s.accept.Store(nil)
+	}
+	s.connLimits.Store(&limits)
+
+	if old != nil {
+		for {
+			select {
+			case conn := <-old.conns:
+				s.acceptConnection(conn)
+			default:
+				return
+			}
+		}
+	}
+}
+
+// ConnectionLimits returns the connection admission configuration
+func (s *UltraFastHTTPServer) ConnectionLimits() ConnectionLimits {
+	if limits := s.connLimits.Load(); limits != nil {
+		return *limits
+	}
+	return ConnectionLimits{}
+}
+
+// Accept waits for the next established connection and lets its requests
+// be served. It is only useful with a Backlog set; connections that closed
+// while queued are skipped.
+func (s *UltraFastHTTPServer) Accept(ctx context.Context) (*Connection, error) {
+	for {
+		queue := s.accept.Load()
+		if queue == nil {
+			return nil, fmt.Errorf("accept queue is not enabled")
+		}
+
+		select {
+		case conn := <-queue.conns:
+			if s.acceptConnection(conn) {
+				return conn, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// acceptConnection marks a queued connection accepted and serves what
+// arrived on it meanwhile. It reports whether the connection is still open.
+func (s *UltraFastHTTPServer) acceptConnection(conn *Connection) bool {
+	if conn.Context().Err() != nil {
+		return false
+	}
+
+	// Packets are held on the loop, so releasing them there keeps them
+	// ahead of any that arrive later
+	s.eventLoop.Submit(func() {
+		conn.acceptMu.Lock()
+		atomic.StoreInt32(&conn.pendingAccept, 0)
+		held := conn.acceptHeld
+		conn.acceptHeld = nil
+		conn.acceptMu.Unlock()
+
+		h := s.handler.Load()
+		peer := s.connections.PeerOf(conn)
+		if s.connections.Get(peer) != conn {
+			return // closed since Accept checked
+		}
+		h.startConnection(conn)
+		for _, packet := range held {
+			if packet.IsSynPacket() {
+				h.serveEarlyData(packet, peer)
+			} else {
+				h.dispatchData(packet, peer)
+			}
+		}
+	})
+	return true
+}
+
+// admitConnection reports whether a new connection fits the limits
+func (s *UltraFastHTTPServer) admitConnection() bool {
+	limits := s.connLimits.Load()
+	if limits == nil {
+		return true
+	}
+	if limits.MaxConnections > 0 && s.connections.Len() >= limits.MaxConnections {
+		return false
+	}
+	if queue := s.accept.Load(); queue != nil && len(queue.conns) == cap(queue.conns) {
+		return false
+	}
+	return true
+}
+
+// refuseConnection answers a SYN over the limits with a RST, telling the
+// peer when to retry if configured
+func (h *HTTPSocketHandler) refuseConnection(packet *Packet, from SocketAddr) {
+	atomic.AddUint64(&h.server.stats.ConnectionsRefused, 1)
+	rstPacket := NewPacket(RST_PACKET, RST_FLAG, 0, packet.SeqNum+1, nil)
+	if retryAfter := h.server.ConnectionLimits().RetryAfter; retryAfter > 0 {
+		rstPacket.SetOption(OPT_RETRY_AFTER, binary.BigEndian.AppendUint32(nil, uint32(retryAfter.Milliseconds())))
+	}
+	h.sendPacket(rstPacket, from)
+}
+
+// queueForAccept puts a newly established connection in the accept queue,
+// if there is one. It reports false, having dropped the connection, when
+// the queue filled since the SYN was admitted.
+func (h *HTTPSocketHandler) queueForAccept(conn *Connection, peer SocketAddr) bool {
+	queue := h.server.accept.Load()
+	if queue == nil {
+		return true
+	}
+
+	atomic.StoreInt32(&conn.pendingAccept, 1)
+	select {
+	case queue.conns <- conn:
+		return true
+	default:
+		atomic.AddUint64(&h.server.stats.ConnectionsRefused, 1)
+		h.sendPacket(NewPacket(RST_PACKET, RST_FLAG, 0, 0, nil), peer)
+		h.dropConnection(peer)
+		return false
+	}
+}
+
+// pendingAcceptance reports whether the connection waits in the accept queue
+func (c *Connection) pendingAcceptance() bool {
+	return atomic.LoadInt32(&c.pendingAccept) == 1
+}
+
+// holdUntilAccepted keeps a packet for a connection still in the accept
+// queue and reports whether it did. A packet beyond acceptHoldLimit is
+// reported held but discarded; the caller must not acknowledge it.
+func (c *Connection) holdUntilAccepted(packet *Packet) (held, kept bool) {
+	if atomic.LoadInt32(&c.pendingAccept) == 0 {
+		return false, false
+	}
+
+	c.acceptMu.Lock()
+	defer c.acceptMu.Unlock()
+	if atomic.LoadInt32(&c.pendingAccept) == 0 {
+		return false, false
+	}
+	if len(c.acceptHeld) >= acceptHoldLimit {
+		return true, false
+	}
+	c.acceptHeld = append(c.acceptHeld, packet)
+	return true, true
+}
+
+// ServerBusyError is returned when a server refuses a connection over its
+// limits with a hint of when to retry
+type ServerBusyError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ServerBusyError) Error() string {
+	return fmt.Sprintf("server busy, retry after %v", e.RetryAfter)
+}
+
+// retryAfter returns the hint carried by a refusing RST, if any
+func retryAfter(packet *Packet) (time.Duration, bool) {
+	value, ok := packet.GetOption(OPT_RETRY_AFTER)
+	if !ok || len(value) != 4 {
+		return 0, false
+	}
+	return time.Duration(binary.BigEndian.Uint32(value)) * time.Millisecond, true
+}
@@ -0,0 +1,79 @@
+package ultrafast
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimitRefusesSYN(t *testing.T) {
+	server := startTestServer(t)
+	server.SetConnectionLimits(ConnectionLimits{MaxConnections: 1, RetryAfter: 250 * time.Millisecond})
+
+	if _, err := newTestClient(t, server).Get("/benchmark"); err != nil {
+		t.Fatalf("Request within the limit failed: %v", err)
+	}
+	err := newTestClient(t, server).Connect()
+	busy, ok := err.(*ServerBusyError)
+	if !ok || busy.RetryAfter != 250*time.Millisecond {
+		t.Fatalf("Expected a busy error with the retry hint, got %v", err)
+	}
+
+	// Without a hint the refusal is a plain reset
+	server.SetConnectionLimits(ConnectionLimits{MaxConnections: 1})
+	if err := newTestClient(t, server).Connect(); err == nil || !strings.Contains(err.Error(), "reset") {
+		t.Errorf("Expected the connection reset, got %v", err)
+	}
+	if refused := server.GetStats().ConnectionsRefused; refused != 2 {
+		t.Errorf("Expected 2 refused connections, got %d", refused)
+	}
+}
+
+func TestAcceptQueue(t *testing.T) {
+	server := startTestServer(t)
+	if _, err := server.Accept(context.Background()); err == nil {
+		t.Fatal("Accept without a backlog should fail")
+	}
+	server.SetConnectionLimits(ConnectionLimits{Backlog: 1})
+
+	client := newTestClient(t, server)
+	client.SetTimeout(time.Second)
+	done := make(chan error, 1)
+	go func() {
+		_, err := client.Get("/benchmark")
+		done <- err
+	}()
+
+	// The request waits until the connection is accepted
+	waitForConnections(t, server, 1)
+	select {
+	case err := <-done:
+		t.Fatalf("Request answered before Accept: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The queue is full, so another connection is refused
+	if err := newTestClient(t, server).Connect(); err == nil {
+		t.Error("Connection beyond the backlog should be refused")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := server.Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	if conn != server.connections.Snapshot()[0] {
+		t.Error("Accept should return the queued connection")
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Request after Accept failed: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := server.Accept(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Accept to time out with nothing queued, got %v", err)
+	}
+}
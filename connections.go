@@ -0,0 +1,522 @@
+package ultrafast
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connection tracks the state the server keeps for one peer. A connection
+// with an ID can move to a new address when the peer's NAT rebinds.
+type Connection struct {
+	ID           uint64     // 0 when the peer did not negotiate a connection ID
+	peer         SocketAddr // guarded by the owning table's mutex
+	Established  time.Time
+	lastActive   int64 // unix nanoseconds, atomic
+	bytesIn      uint64
+	bytesOut     uint64
+	packetsIn    uint64
+	packetsOut   uint64
+	ticketIssued int32                      // atomic bool, a resumption ticket was sent
+	stream       atomic.Pointer[StreamConn] // set once DATA is carried as a byte stream
+
+	// Sends the connection's DATA packets, see WriteMessage; set by the
+	// server once the connection is established
+	handler atomic.Pointer[HTTPSocketHandler]
+	writeMu sync.Mutex // keeps one message's packets together
+
+	// Cancelled when the connection is removed, aborting its requests;
+	// the cause is set when the server aborted the connection
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	// This peer's sequence space, retransmissions and congestion window,
+	// on the shard given by the owning table's ReliabilityShards
+	reliability *LockFreeReliabilityLayer
+	shard       int
+
+	// In-flight DATA packets to this peer, for unacked count and RTT samples
+	inflightMu sync.Mutex
+	inflight   map[uint32]time.Time
+	rtt        time.Duration
+
+	// Requests currently being handled, by client-assigned request ID
+	requestsMu     sync.Mutex
+	activeRequests map[uint32]time.Time
+	priorities     map[uint32]int // urgency of active requests given one by SetPriority
+
+	// Requests received, and whether the connection closes once they are answered
+	requestsServed uint64 // atomic
+	closing        int32  // atomic bool
+
+	// Requests split over several DATA packets, until every fragment arrives
+	partialMu       sync.Mutex
+	partialRequests map[uint32]*partialRequest
+
+	// Until the peer proves it receives at its address, sends are capped
+	// at amplificationFactor times the bytes received and the excess is held
+	validated    int32 // atomic bool
+	validationMu sync.Mutex
+	held         []*Packet
+	heldBytes    int
+
+	// Small responses held for coalescing into one packet, and whether
+	// the connection opted out of that
+	batchMu    sync.Mutex
+	batch      []byte
+	batchCount int
+	batchTimer *time.Timer
+	noDelay    int32 // atomic bool
+
+	// DSCP marking the connection's packets in place of the socket's,
+	// plus one so that zero means none; see tos.go
+	dscp int32 // atomic
+
+	// DATA packets waiting for the congestion window to open, by weighted
+	// fair queueing over their responses
+	windowMu    sync.Mutex
+	windowQueue outboundQueue
+
+	// Paths DATA packets are striped over, set once the peer opens a
+	// second path in multipath mode
+	paths atomic.Pointer[multipath]
+
+	// While waiting in the accept queue, packets are kept until Accept
+	acceptMu      sync.Mutex
+	pendingAccept int32 // atomic bool
+	acceptHeld    []*Packet
+
+	// Packet numbers already seen, with packet authentication on
+	replay replayWindow
+}
+
+// ConnectionInfo is a point-in-time view of one connection's state
+type ConnectionInfo struct {
+	ID               uint64
+	Peer             SocketAddr
+	Established      time.Time
+	IdleTime         time.Duration
+	RTT              time.Duration
+	CongestionWindow uint32
+	UnackedPackets   int
+	BytesInFlight    int64      // payload bytes sent and not yet acknowledged or presumed lost
+	QueuedPackets    int        // DATA packets waiting for the congestion window
+	AppLimited       bool       // sending too little to use the congestion window, which does not grow
+	Paths            []PathInfo // multipath only, nil otherwise
+	ActiveRequests   int
+	BytesIn          uint64
+	BytesOut         uint64
+}
+
+// ConnectionTable maps peers to their connection state, indexed both by
+// current address and by connection ID. Each connection gets a
+// reliability layer from the table's shards for as long as it is tracked.
+// With a capacity set, a new connection at the cap evicts the least
+// recently active one.
+type ConnectionTable struct {
+	mu          sync.RWMutex
+	conns       map[SocketAddr]*Connection
+	byID        map[uint64]*Connection
+	reliability *ReliabilityShards
+	capacity    int               // 0 for no limit
+	onEvict     func(*Connection) // called outside the lock for each evicted connection
+}
+
+// evictionSamples is how many connections are compared to pick one to
+// evict. Sampling approximates LRU without keeping every connection in a
+// list that each packet would have to reorder.
+const evictionSamples = 16
+
+// NewConnectionTable creates an empty connection table with one
+// reliability shard per CPU
+func NewConnectionTable() *ConnectionTable {
+	return &ConnectionTable{
+		conns:       make(map[SocketAddr]*Connection),
+		byID:        make(map[uint64]*Connection),
+		reliability: NewReliabilityShards(runtime.GOMAXPROCS(0)),
+	}
+}
+
+// Reliability returns the shards holding the connections' reliability state
+func (ct *ConnectionTable) Reliability() *ReliabilityShards {
+	return ct.reliability
+}
+
+// SetCapacity caps the number of tracked connections; 0 removes the cap
+func (ct *ConnectionTable) SetCapacity(capacity int) {
+	ct.mu.Lock()
+	ct.capacity = capacity
+	ct.mu.Unlock()
+}
+
+// OnEvict registers a function called with each connection evicted to
+// make room for a new one, after it has been removed from the table
+func (ct *ConnectionTable) OnEvict(fn func(*Connection)) {
+	ct.mu.Lock()
+	ct.onEvict = fn
+	ct.mu.Unlock()
+}
+
+// GetOrCreate returns the connection for a peer, creating it if needed
+func (ct *ConnectionTable) GetOrCreate(peer SocketAddr) (*Connection, bool) {
+	ct.mu.RLock()
+	conn, exists := ct.conns[peer]
+	ct.mu.RUnlock()
+	if exists {
+		return conn, false
+	}
+
+	ct.mu.Lock()
+	conn, created, evicted := ct.getOrCreateLocked(peer)
+	onEvict := ct.onEvict
+	ct.mu.Unlock()
+
+	if evicted != nil && onEvict != nil {
+		onEvict(evicted)
+	}
+	return conn, created
+}
+
+// getOrCreateLocked does the work of GetOrCreate under the write lock,
+// also returning the connection evicted to make room, if any
+func (ct *ConnectionTable) getOrCreateLocked(peer SocketAddr) (*Connection, bool, *Connection) {
+	if conn, exists := ct.conns[peer]; exists {
+		return conn, false, nil
+	}
+
+	var evicted *Connection
+	if ct.capacity > 0 && len(ct.conns) >= ct.capacity {
+		evicted = ct.leastRecentlyActive()
+		ct.removeLocked(evicted.peer)
+	}
+
+	now := clockNow()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	conn := &Connection{
+		ctx:            ctx,
+		cancel:         cancel,
+		peer:           peer,
+		Established:    now,
+		lastActive:     now.UnixNano(),
+		inflight:       make(map[uint32]time.Time),
+		activeRequests: make(map[uint32]time.Time),
+	}
+	ct.reliability.Attach(conn, peer)
+	ct.conns[peer] = conn
+	return conn, true, evicted
+}
+
+// leastRecentlyActive returns the idlest of a sample of connections; map
+// iteration starts at a random entry. The table must not be empty.
+func (ct *ConnectionTable) leastRecentlyActive() *Connection {
+	var oldest *Connection
+	sampled := 0
+	for _, conn := range ct.conns {
+		if oldest == nil || atomic.LoadInt64(&conn.lastActive) < atomic.LoadInt64(&oldest.lastActive) {
+			oldest = conn
+		}
+		if sampled++; sampled == evictionSamples {
+			break
+		}
+	}
+	return oldest
+}
+
+// Get returns the connection for a peer, or nil
+func (ct *ConnectionTable) Get(peer SocketAddr) *Connection {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.conns[peer]
+}
+
+// GetByID returns the connection with the given ID, or nil
+func (ct *ConnectionTable) GetByID(id uint64) *Connection {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return ct.byID[id]
+}
+
+// AssignID indexes a connection under a connection ID
+func (ct *ConnectionTable) AssignID(conn *Connection, id uint64) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if conn.ID != 0 {
+		delete(ct.byID, conn.ID)
+	}
+	conn.ID = id
+	ct.byID[id] = conn
+}
+
+// Migrate re-keys a connection to a new peer address, e.g. after a NAT
+// rebinding. Any other connection already at that address is replaced.
+func (ct *ConnectionTable) Migrate(conn *Connection, newPeer SocketAddr) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if ct.conns[conn.peer] == conn {
+		delete(ct.conns, conn.peer)
+	}
+	if stale := ct.conns[newPeer]; stale != nil {
+		if stale.ID != 0 {
+			delete(ct.byID, stale.ID)
+		}
+		stale.cancel(nil)
+		ct.reliability.Detach(stale)
+	}
+	conn.peer = newPeer
+	ct.conns[newPeer] = conn
+}
+
+// PeerOf returns the connection's current peer address
+func (ct *ConnectionTable) PeerOf(conn *Connection) SocketAddr {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return conn.peer
+}
+
+// Remove deletes a peer's connection and returns it
+func (ct *ConnectionTable) Remove(peer SocketAddr) *Connection {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	return ct.removeLocked(peer)
+}
+
+// removeLocked does the work of Remove under the write lock
+func (ct *ConnectionTable) removeLocked(peer SocketAddr) *Connection {
+	conn := ct.conns[peer]
+	delete(ct.conns, peer)
+	if conn != nil {
+		if conn.ID != 0 {
+			delete(ct.byID, conn.ID)
+		}
+		conn.cancel(nil)
+		ct.reliability.Detach(conn)
+	}
+	return conn
+}
+
+// Len returns the number of tracked connections
+func (ct *ConnectionTable) Len() int {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	return len(ct.conns)
+}
+
+// Snapshot returns the tracked connections at this instant
+func (ct *ConnectionTable) Snapshot() []*Connection {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	conns := make([]*Connection, 0, len(ct.conns))
+	for _, conn := range ct.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Infos returns a snapshot of every connection's state
+func (ct *ConnectionTable) Infos() []ConnectionInfo {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	infos := make([]ConnectionInfo, 0, len(ct.conns))
+	for peer, conn := range ct.conns {
+		info := conn.Info()
+		info.Peer = peer
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Context returns a context that is cancelled when the connection closes
+func (c *Connection) Context() context.Context {
+	return c.ctx
+}
+
+// Err returns why the server aborted the connection, a
+// *ConnAbortedError once the peer stopped acknowledging, or nil while the
+// connection is open or after it closed normally
+func (c *Connection) Err() error {
+	if err := context.Cause(c.ctx); err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+// RecordIn accounts a packet of n bytes received from the peer
+func (c *Connection) RecordIn(n int) {
+	atomic.AddUint64(&c.bytesIn, uint64(n))
+	atomic.AddUint64(&c.packetsIn, 1)
+	atomic.StoreInt64(&c.lastActive, clockNow().UnixNano())
+}
+
+// RecordOut accounts a packet of n bytes sent to the peer
+func (c *Connection) RecordOut(n int) {
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+	atomic.AddUint64(&c.packetsOut, 1)
+	atomic.StoreInt64(&c.lastActive, clockNow().UnixNano())
+}
+
+// LastActive returns the time of the last packet in either direction
+func (c *Connection) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActive))
+}
+
+// BytesIn returns the bytes received from the peer
+func (c *Connection) BytesIn() uint64 {
+	return atomic.LoadUint64(&c.bytesIn)
+}
+
+// BytesOut returns the bytes sent to the peer
+func (c *Connection) BytesOut() uint64 {
+	return atomic.LoadUint64(&c.bytesOut)
+}
+
+// PacketsIn returns the packets received from the peer
+func (c *Connection) PacketsIn() uint64 {
+	return atomic.LoadUint64(&c.packetsIn)
+}
+
+// PacketsOut returns the packets sent to the peer
+func (c *Connection) PacketsOut() uint64 {
+	return atomic.LoadUint64(&c.packetsOut)
+}
+
+// BeginRequest marks a request ID as being handled. It returns false if
+// that request is already in progress, e.g. for a retransmitted copy.
+func (c *Connection) BeginRequest(id uint32) bool {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+	if _, active := c.activeRequests[id]; active {
+		return false
+	}
+	c.activeRequests[id] = clockNow()
+	return true
+}
+
+// EndRequest marks a request ID as answered
+func (c *Connection) EndRequest(id uint32) {
+	c.requestsMu.Lock()
+	delete(c.activeRequests, id)
+	delete(c.priorities, id)
+	c.requestsMu.Unlock()
+}
+
+// ActiveRequests returns the number of requests being handled
+func (c *Connection) ActiveRequests() int {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+	return len(c.activeRequests)
+}
+
+// Validated reports whether the peer has proven it receives at its address
+func (c *Connection) Validated() bool {
+	return atomic.LoadInt32(&c.validated) == 1
+}
+
+// MarkValidated lifts the amplification limit and returns any packets it
+// held back, in the order they were sent
+func (c *Connection) MarkValidated() []*Packet {
+	c.validationMu.Lock()
+	defer c.validationMu.Unlock()
+
+	atomic.StoreInt32(&c.validated, 1)
+	held := c.held
+	c.held, c.heldBytes = nil, 0
+	return held
+}
+
+// HoldUnvalidated queues a packet of size bytes if sending it now would
+// exceed the amplification limit, and reports whether it did. A packet
+// past unvalidatedHoldLimit or unvalidatedHoldBytes is reported held but
+// dropped.
+func (c *Connection) HoldUnvalidated(packet *Packet, size int) bool {
+	if c.Validated() {
+		return false
+	}
+
+	c.validationMu.Lock()
+	defer c.validationMu.Unlock()
+	if atomic.LoadInt32(&c.validated) == 1 {
+		return false
+	}
+
+	// Once anything is held, later packets queue behind it to keep order
+	budget := amplificationFactor * c.BytesIn()
+	if len(c.held) == 0 && c.BytesOut()+uint64(size) <= budget {
+		return false
+	}
+	if len(c.held) >= unvalidatedHoldLimit || c.heldBytes+size > unvalidatedHoldBytes {
+		return true
+	}
+	c.held = append(c.held, packet)
+	c.heldBytes += size
+	return true
+}
+
+// TrackSent records a DATA packet sent to the peer that awaits an ACK
+func (c *Connection) TrackSent(seqNum uint32, sentAt time.Time) {
+	c.inflightMu.Lock()
+	c.inflight[seqNum] = sentAt
+	c.inflightMu.Unlock()
+}
+
+// TrackAcked removes an acknowledged packet and folds its RTT into the
+// connection's smoothed estimate. It reports whether the packet was in flight.
+func (c *Connection) TrackAcked(seqNum uint32, ackedAt time.Time) bool {
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+
+	sentAt, exists := c.inflight[seqNum]
+	if !exists {
+		return false
+	}
+	delete(c.inflight, seqNum)
+
+	// Same 7/8 smoothing as the reliability layer's estimate
+	sample := ackedAt.Sub(sentAt)
+	if c.rtt == 0 {
+		c.rtt = sample
+	} else {
+		c.rtt = (c.rtt*7 + sample) / 8
+	}
+	return true
+}
+
+// Reliability returns the connection's own reliability layer
+func (c *Connection) Reliability() *LockFreeReliabilityLayer {
+	return c.reliability
+}
+
+// Info returns a snapshot of the connection. Peer is filled in by the
+// table, which owns the address.
+func (c *Connection) Info() ConnectionInfo {
+	c.inflightMu.Lock()
+	unacked := len(c.inflight)
+	rtt := c.rtt
+	c.inflightMu.Unlock()
+
+	return ConnectionInfo{
+		ID:               c.ID,
+		Established:      c.Established,
+		IdleTime:         clockNow().Sub(c.LastActive()),
+		RTT:              rtt,
+		CongestionWindow: c.reliability.GetStats().CongestionWindow,
+		UnackedPackets:   unacked,
+		BytesInFlight:    c.reliability.BytesInFlight(),
+		QueuedPackets:    c.windowQueued(),
+		AppLimited:       c.reliability.AppLimited(),
+		Paths:            c.Paths(),
+		ActiveRequests:   c.ActiveRequests(),
+		BytesIn:          c.BytesIn(),
+		BytesOut:         c.BytesOut(),
+	}
+}
+
+// activeRequests counts requests being handled across all connections
+func (s *UltraFastHTTPServer) activeRequests() int {
+	active := 0
+	for _, info := range s.Connections() {
+		active += info.ActiveRequests
+	}
+	return active
+}
@@ -0,0 +1,115 @@
+package ultrafast
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionTable(t *testing.T) {
+	table := NewConnectionTable()
+	peer := SocketAddr{IP: "127.0.0.1", Port: 9000}
+
+	conn, created := table.GetOrCreate(peer)
+	if !created {
+		t.Error("First GetOrCreate should create the connection")
+	}
+	if again, created := table.GetOrCreate(peer); created || again != conn {
+		t.Error("Second GetOrCreate should return the existing connection")
+	}
+	if table.Len() != 1 {
+		t.Errorf("Expected 1 connection, got %d", table.Len())
+	}
+
+	if table.Remove(peer) != conn {
+		t.Error("Remove should return the removed connection")
+	}
+	if table.Get(peer) != nil {
+		t.Error("Connection should be gone after Remove")
+	}
+}
+
+func TestConnectionInfo(t *testing.T) {
+	table := NewConnectionTable()
+	conn, _ := table.GetOrCreate(SocketAddr{IP: "10.0.0.1", Port: 4000})
+
+	conn.RecordIn(100)
+	conn.RecordOut(250)
+
+	sentAt := time.Now()
+	conn.TrackSent(1, sentAt)
+	conn.TrackSent(2, sentAt)
+
+	if !conn.TrackAcked(1, sentAt.Add(20*time.Millisecond)) {
+		t.Error("ACK for an in-flight packet should be tracked")
+	}
+	if conn.TrackAcked(1, sentAt.Add(30*time.Millisecond)) {
+		t.Error("Duplicate ACK should not be tracked twice")
+	}
+
+	info := conn.Info()
+	if info.UnackedPackets != 1 {
+		t.Errorf("Expected 1 unacked packet, got %d", info.UnackedPackets)
+	}
+	if info.RTT != 20*time.Millisecond {
+		t.Errorf("Expected RTT 20ms, got %v", info.RTT)
+	}
+	if info.BytesIn != 100 || info.BytesOut != 250 {
+		t.Errorf("Expected bytes in/out 100/250, got %d/%d", info.BytesIn, info.BytesOut)
+	}
+	if info.CongestionWindow != 1 {
+		t.Errorf("Expected the connection's initial cwnd 1, got %d", info.CongestionWindow)
+	}
+}
+
+func TestServerConnectionsEndpoint(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+
+	// Other clients' addresses are not for every client to see
+	response, err := client.Get("/connections")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !strings.Contains(string(response), "404") || strings.Contains(string(response), `"peer"`) {
+		t.Errorf("Expected /connections not found by default, got %q", response)
+	}
+
+	server.SetPeerInfoPublic(true)
+	if response, err = client.Get("/connections"); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !strings.Contains(string(response), `"peer": "127.0.0.1:`) {
+		t.Errorf("Expected the client listed once opted in, got %q", response)
+	}
+}
+
+func TestConnectionMigration(t *testing.T) {
+	table := NewConnectionTable()
+	oldPeer := SocketAddr{IP: "203.0.113.5", Port: 40000}
+	newPeer := SocketAddr{IP: "203.0.113.5", Port: 40123}
+
+	conn, _ := table.GetOrCreate(oldPeer)
+	table.AssignID(conn, 0xC0FFEE)
+
+	if table.GetByID(0xC0FFEE) != conn {
+		t.Fatal("Connection should be found by ID")
+	}
+
+	table.Migrate(conn, newPeer)
+
+	if table.Get(oldPeer) != nil {
+		t.Error("Old address should no longer map to the connection")
+	}
+	if table.Get(newPeer) != conn {
+		t.Error("New address should map to the migrated connection")
+	}
+	if table.PeerOf(conn) != newPeer {
+		t.Errorf("Expected peer %v, got %v", newPeer, table.PeerOf(conn))
+	}
+
+	table.Remove(newPeer)
+	if table.GetByID(0xC0FFEE) != nil {
+		t.Error("Removing the connection should drop its ID index")
+	}
+}
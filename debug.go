@@ -0,0 +1,280 @@
+package ultrafast
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Paths of the debug endpoints, as in net/http/pprof and expvar
+const (
+	debugPprofPrefix = "/debug/pprof/"
+	debugVarsPath    = "/debug/vars"
+)
+
+// defaultCPUProfileSeconds is how long a CPU profile runs if the request
+// does not say, short enough to fit in the default handler timeout
+const defaultCPUProfileSeconds = 5
+
+// DebugConfig configures the runtime profiling endpoints
+type DebugConfig struct {
+	// AdminOnly serves profiles and variables only through the admin
+	// socket's pprof and vars commands, never to network clients
+	AdminOnly bool
+
+	// MutexProfileFraction and BlockProfileRate turn on the mutex and
+	// block profiles, as runtime.SetMutexProfileFraction and
+	// runtime.SetBlockProfileRate. Zero leaves them as they are.
+	MutexProfileFraction int
+	BlockProfileRate     int
+
+	// ProfileDir is where the admin socket's pprof command writes the
+	// profiles it is asked to save, under the file name it is given,
+	// which cannot lead out of the directory. Empty refuses to write any.
+	ProfileDir string
+}
+
+// EnableDebug serves CPU, heap, goroutine, mutex and the other runtime
+// profiles under /debug/pprof/, and the expvar variables at /debug/vars,
+// over the server's own transport. The profiles reveal the program's
+// internals, so unless only trusted clients can reach the server, set
+// AdminOnly.
+func (s *UltraFastHTTPServer) EnableDebug(config DebugConfig) {
+	if config.MutexProfileFraction > 0 {
+		runtime.SetMutexProfileFraction(config.MutexProfileFraction)
+	}
+	if config.BlockProfileRate > 0 {
+		runtime.SetBlockProfileRate(config.BlockProfileRate)
+	}
+	s.debug.Store(&config)
+	if !config.AdminOnly {
+		s.registerDebugRoutes()
+	}
+}
+
+// DisableDebug stops serving profiles and variables, and turns off the
+// mutex and block profiles if EnableDebug turned them on
+func (s *UltraFastHTTPServer) DisableDebug() {
+	old := s.debug.Swap(nil)
+	if old == nil {
+		return
+	}
+	if old.MutexProfileFraction > 0 {
+		runtime.SetMutexProfileFraction(0)
+	}
+	if old.BlockProfileRate > 0 {
+		runtime.SetBlockProfileRate(0)
+	}
+}
+
+// DebugEnabled reports whether profiles are served, and whether only to
+// the admin socket
+func (s *UltraFastHTTPServer) DebugEnabled() (enabled, adminOnly bool) {
+	config := s.debug.Load()
+	return config != nil, config != nil && config.AdminOnly
+}
+
+// registerDebugRoutes adds the debug endpoints to the server's router.
+// They answer 404 while debugging is off or admin only.
+func (s *UltraFastHTTPServer) registerDebugRoutes() {
+	s.router.HandlePrefix(debugPprofPrefix, s.servePprof)
+	s.router.HandleFunc(debugVarsPath, s.serveVars)
+}
+
+// debugServed reports whether the debug endpoints answer network clients
+func (s *UltraFastHTTPServer) debugServed() bool {
+	config := s.debug.Load()
+	return config != nil && !config.AdminOnly
+}
+
+// servePprof answers /debug/pprof/ with the list of profiles,
+// /debug/pprof/profile?seconds=N with a CPU profile, and
+// /debug/pprof/<name>?debug=N with a named profile: in the binary format
+// go tool pprof reads, or as text if debug is non-zero
+func (s *UltraFastHTTPServer) servePprof(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+	if !s.debugServed() {
+		return debugResponse(404, "text/plain", []byte("404 Not Found"))
+	}
+	path, rawQuery, _ := strings.Cut(request.Path, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return debugResponse(400, "text/plain", []byte(err.Error()))
+	}
+	name := strings.TrimPrefix(path, debugPprofPrefix)
+
+	var body bytes.Buffer
+	switch name {
+	case "":
+		body.WriteString(profileIndex())
+		return debugResponse(200, "text/plain", body.Bytes())
+	case "profile":
+		seconds := defaultCPUProfileSeconds
+		if value := query.Get("seconds"); value != "" {
+			if seconds, err = strconv.Atoi(value); err != nil || seconds <= 0 {
+				return debugResponse(400, "text/plain", []byte("invalid seconds: "+value))
+			}
+		}
+		duration := time.Duration(seconds) * time.Second
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= duration {
+			return debugResponse(400, "text/plain", []byte("profile duration exceeds the handler timeout"))
+		}
+		if err := writeCPUProfile(ctx, &body, duration); err != nil {
+			return debugResponse(500, "text/plain", []byte(err.Error()))
+		}
+		return debugResponse(200, "application/octet-stream", body.Bytes())
+	}
+
+	debug, _ := strconv.Atoi(query.Get("debug"))
+	if err := writeProfile(&body, name, debug); err != nil {
+		return debugResponse(404, "text/plain", []byte(err.Error()))
+	}
+	if debug != 0 {
+		return debugResponse(200, "text/plain", body.Bytes())
+	}
+	return debugResponse(200, "application/octet-stream", body.Bytes())
+}
+
+// serveVars answers /debug/vars with the expvar variables as JSON
+func (s *UltraFastHTTPServer) serveVars(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+	if !s.debugServed() {
+		return debugResponse(404, "text/plain", []byte("404 Not Found"))
+	}
+	return debugResponse(200, "application/json", []byte(s.varsJSON()))
+}
+
+// varsJSON renders the published expvar variables, with the server's
+// counters under "server", in the format of expvar's own handler
+func (s *UltraFastHTTPServer) varsJSON() string {
+	var body strings.Builder
+	body.WriteString("{\n")
+	stats, _ := json.Marshal(s.GetStats())
+	fmt.Fprintf(&body, "%q: %s", "server", stats)
+	expvar.Do(func(kv expvar.KeyValue) {
+		fmt.Fprintf(&body, ",\n%q: %s", kv.Key, kv.Value)
+	})
+	body.WriteString("\n}\n")
+	return body.String()
+}
+
+// debugResponse builds an uncacheable debug endpoint response
+func debugResponse(status int, contentType string, body []byte) *HTTPResponse {
+	return &HTTPResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": contentType, "Cache-Control": "no-store"},
+		Body:       body,
+	}
+}
+
+// profileIndex lists the named profiles and their sample counts
+func profileIndex() string {
+	profiles := pprof.Profiles()
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name() < profiles[j].Name() })
+	output := "profile\n"
+	for _, profile := range profiles {
+		output += fmt.Sprintf("%s %d\n", profile.Name(), profile.Count())
+	}
+	return output
+}
+
+// writeProfile writes the named profile, such as heap or goroutine
+func writeProfile(dst *bytes.Buffer, name string, debug int) error {
+	profile := pprof.Lookup(name)
+	if profile == nil {
+		return fmt.Errorf("unknown profile: %s", name)
+	}
+	return profile.WriteTo(dst, debug)
+}
+
+// writeCPUProfile profiles the CPU for duration, or until ctx is done.
+// Only one CPU profile can run at a time.
+func writeCPUProfile(ctx context.Context, dst *bytes.Buffer, duration time.Duration) error {
+	if err := pprof.StartCPUProfile(dst); err != nil {
+		return fmt.Errorf("could not start CPU profile: %v", err)
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	pprof.StopCPUProfile()
+	return ctx.Err()
+}
+
+// pprofCommand is the admin socket's pprof command: with no arguments
+// it lists the profiles, with a name it prints the profile as text, and
+// with a file it writes the binary profile there, within the configured
+// ProfileDir. The CPU profile always goes to a file.
+func (s *UltraFastHTTPServer) pprofCommand(args []string) (string, error) {
+	config := s.debug.Load()
+	if config == nil {
+		return "", fmt.Errorf("debugging is disabled")
+	}
+	if len(args) == 0 {
+		return profileIndex(), nil
+	}
+
+	if len(args) > 1 && config.ProfileDir == "" {
+		return "", fmt.Errorf("no ProfileDir is configured to write profiles to")
+	}
+
+	var body bytes.Buffer
+	name := args[0]
+	if name == "cpu" {
+		if len(args) < 2 {
+			return "", fmt.Errorf("usage: pprof cpu file [seconds]")
+		}
+		seconds := defaultCPUProfileSeconds
+		if len(args) > 2 {
+			if _, err := fmt.Sscanf(args[2], "%d", &seconds); err != nil || seconds <= 0 {
+				return "", fmt.Errorf("invalid seconds: %s", args[2])
+			}
+		}
+		if err := writeCPUProfile(context.Background(), &body, time.Duration(seconds)*time.Second); err != nil {
+			return "", err
+		}
+	} else {
+		debug := 1
+		if len(args) > 1 {
+			debug = 0
+		}
+		if err := writeProfile(&body, name, debug); err != nil {
+			return "", err
+		}
+		if debug != 0 {
+			return body.String(), nil
+		}
+	}
+
+	// The root keeps the file inside the directory, whatever its name or
+	// the symlinks along it
+	root, err := os.OpenRoot(config.ProfileDir)
+	if err != nil {
+		return "", err
+	}
+	defer root.Close()
+	if err := root.WriteFile(args[1], body.Bytes(), 0600); err != nil {
+		return "", err
+	}
+	file := filepath.Join(config.ProfileDir, args[1])
+	return fmt.Sprintf("wrote %s profile to %s (%d bytes)", name, file, body.Len()), nil
+}
+
+// varsCommand is the admin socket's vars command
+func (s *UltraFastHTTPServer) varsCommand(args []string) (string, error) {
+	if s.debug.Load() == nil {
+		return "", fmt.Errorf("debugging is disabled")
+	}
+	return s.varsJSON(), nil
+}
@@ -0,0 +1,108 @@
+package ultrafast
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+
+	get := func(path string) string {
+		t.Helper()
+		response, err := client.Get(path)
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", path, err)
+		}
+		return string(response)
+	}
+
+	if response := get("/debug/vars"); !strings.Contains(response, "404 Not Found") {
+		t.Errorf("Expected no debug endpoints until enabled, got %q", response)
+	}
+
+	server.EnableDebug(DebugConfig{})
+	if response := get("/debug/pprof/"); !strings.Contains(response, "goroutine ") || !strings.Contains(response, "heap ") {
+		t.Errorf("Expected the profile index, got %q", response)
+	}
+	if response := get("/debug/pprof/goroutine?debug=1"); !strings.Contains(response, "goroutine profile:") {
+		t.Errorf("Expected a text goroutine profile, got %q", response)
+	}
+	if response := get("/debug/pprof/nonexistent"); !strings.Contains(response, "404") {
+		t.Errorf("Expected an unknown profile refused, got %q", response)
+	}
+	response := get("/debug/vars")
+	for _, want := range []string{`"server": {`, `"RequestsReceived":`, `"memstats": {`, `"cmdline": [`} {
+		if !strings.Contains(response, want) {
+			t.Errorf("Expected %s in /debug/vars, got %q", want, response)
+		}
+	}
+
+	// A CPU profile must finish before the handler is abandoned
+	if response := get("/debug/pprof/profile?seconds=60"); !strings.Contains(response, "400") {
+		t.Errorf("Expected a profile longer than the handler timeout refused, got %q", response)
+	}
+
+	server.EnableDebug(DebugConfig{AdminOnly: true})
+	if response := get("/debug/pprof/heap"); !strings.Contains(response, "404 Not Found") {
+		t.Errorf("Expected admin only debugging hidden from clients, got %q", response)
+	}
+	if enabled, adminOnly := server.DebugEnabled(); !enabled || !adminOnly {
+		t.Errorf("Expected debugging enabled admin only, got %t, %t", enabled, adminOnly)
+	}
+}
+
+func TestDebugAdminCommands(t *testing.T) {
+	server := startTestServer(t)
+	admin := NewAdminServer("")
+	server.registerAdminCommands(admin)
+
+	if reply := admin.Execute("vars"); !strings.HasPrefix(reply, "ERR") {
+		t.Errorf("Expected vars refused while debugging is off, got %q", reply)
+	}
+
+	dir := t.TempDir()
+	server.EnableDebug(DebugConfig{AdminOnly: true, MutexProfileFraction: 5, ProfileDir: dir})
+	defer server.DisableDebug()
+	if reply := admin.Execute("vars"); !strings.Contains(reply, `"memstats": {`) || !strings.HasSuffix(reply, "OK\n") {
+		t.Errorf("Unexpected vars reply: %.200q", reply)
+	}
+	if reply := admin.Execute("pprof"); !strings.Contains(reply, "\nmutex ") {
+		t.Errorf("Expected the profile index, got %q", reply)
+	}
+	if reply := admin.Execute("pprof goroutine"); !strings.HasPrefix(reply, "goroutine profile:") {
+		t.Errorf("Expected a text goroutine profile, got %.200q", reply)
+	}
+
+	if reply := admin.Execute("pprof heap heap.pprof"); !strings.HasPrefix(reply, "wrote heap profile") {
+		t.Fatalf("Unexpected pprof reply: %q", reply)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "heap.pprof")); err != nil || len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		t.Errorf("Expected a gzipped profile written, got %d bytes, %v", len(data), err)
+	}
+
+	if reply := admin.Execute("pprof cpu cpu.pprof 1"); !strings.HasPrefix(reply, "wrote cpu profile") {
+		t.Fatalf("Unexpected pprof cpu reply: %q", reply)
+	}
+	if reply := admin.Execute("pprof cpu"); !strings.HasPrefix(reply, "ERR usage") {
+		t.Errorf("Expected a CPU profile without a file refused, got %q", reply)
+	}
+
+	// Profiles stay inside ProfileDir
+	outside := filepath.Join(t.TempDir(), "heap.pprof")
+	for _, file := range []string{outside, "../" + filepath.Base(filepath.Dir(outside)) + "/heap.pprof"} {
+		if reply := admin.Execute("pprof heap " + file); !strings.HasPrefix(reply, "ERR") {
+			t.Errorf("Expected %s refused, got %q", file, reply)
+		}
+	}
+	if _, err := os.Stat(outside); err == nil {
+		t.Error("Expected nothing written outside ProfileDir")
+	}
+	server.EnableDebug(DebugConfig{AdminOnly: true})
+	if reply := admin.Execute("pprof heap heap.pprof"); !strings.HasPrefix(reply, "ERR") {
+		t.Errorf("Expected profiles refused without a ProfileDir, got %q", reply)
+	}
+}
@@ -0,0 +1,110 @@
+package ultrafast
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// The reliability layer that tracks what a connection sends also decides
+// when to acknowledge what it receives, so the server, the client and
+// anything else reading DATA packets off a connection send the same ACKs.
+// By default every packet is acknowledged at once. With a delay an ACK
+// for in-order data waits for the next packet, halving the ACKs of a
+// bulk transfer, while anything out of order is still answered at once.
+
+// maxAckDelay caps the ACK delay well below minRTO, so a held ACK never
+// makes the peer time out
+const maxAckDelay = minRTO / 2
+
+// AckReceived records the arrival of a DATA packet and returns the ACK to
+// send for it, or nil while the ACK is delayed, see SetAckDelay. The ACK
+// carries no sequence number of its own. On the connectionless layer it
+// acknowledges the packet alone.
+func (rf *LockFreeReliabilityLayer) AckReceived(packet *Packet) *Packet {
+	if rf.selective {
+		return NewPacket(ACK_PACKET, ACK_FLAG, 0, packet.SeqNum+1, nil)
+	}
+	return rf.acks.ack(packet.SeqNum, time.Duration(atomic.LoadInt64(&rf.ackDelay)))
+}
+
+// DueAck returns the delayed ACK once its delay has run out at now, nil
+// if none is due. Whoever sends what AckReceived returns polls it too.
+func (rf *LockFreeReliabilityLayer) DueAck(now time.Time) *Packet {
+	return rf.acks.flush(now)
+}
+
+// SetAckDelay lets the ACK for an in-order packet wait up to delay for the
+// next packet, so one ACK answers both. It is capped at maxAckDelay; 0,
+// the default, acknowledges every packet at once. The connectionless
+// layer always does.
+func (rf *LockFreeReliabilityLayer) SetAckDelay(delay time.Duration) {
+	atomic.StoreInt64(&rf.ackDelay, int64(min(max(delay, 0), maxAckDelay)))
+}
+
+// AckDelay returns how long an ACK may be delayed
+func (rf *LockFreeReliabilityLayer) AckDelay() time.Duration {
+	return time.Duration(atomic.LoadInt64(&rf.ackDelay))
+}
+
+// dueAck is a delayed ACK to send to its connection's peer
+type dueAck struct {
+	conn *Connection
+	ack  *Packet
+}
+
+// appendDueAcks appends the delayed ACKs of one shard's connections that
+// are due at now. They are sent after the shard is unlocked, as sending
+// looks up the connection's peer.
+func (rs *ReliabilityShards) appendDueAcks(index int, now time.Time, dst []dueAck) []dueAck {
+	shard := &rs.shards[index]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	for layer, conn := range shard.layers {
+		if ack := layer.DueAck(now); ack != nil {
+			dst = append(dst, dueAck{conn: conn, ack: ack})
+		}
+	}
+	return dst
+}
+
+// SetAckDelay applies an ACK delay to every connection's layer, and those
+// created later
+func (rs *ReliabilityShards) SetAckDelay(delay time.Duration) {
+	rs.ackDelay.Store(int64(delay))
+	rs.forEachLayer(func(layer *LockFreeReliabilityLayer) {
+		layer.SetAckDelay(delay)
+	})
+}
+
+// AckDelay returns the ACK delay new layers start with
+func (rs *ReliabilityShards) AckDelay() time.Duration {
+	return min(max(time.Duration(rs.ackDelay.Load()), 0), maxAckDelay)
+}
+
+// SetAckDelay lets the server hold the ACK for in-order data from a
+// connection up to delay, capped at 50ms, waiting for the next packet so
+// one ACK answers both. Out-of-order, gap-filling and duplicate packets
+// are still acknowledged at once. 0, the default, acknowledges every
+// packet as it arrives.
+func (s *UltraFastHTTPServer) SetAckDelay(delay time.Duration) {
+	s.connections.Reliability().SetAckDelay(delay)
+}
+
+// AckDelay returns the ACK delay
+func (s *UltraFastHTTPServer) AckDelay() time.Duration {
+	return s.connections.Reliability().AckDelay()
+}
+
+// sendDueAcks sends the delayed ACKs of one shard's connections that are
+// due, to peers still connected, reusing dst
+func (s *UltraFastHTTPServer) sendDueAcks(shard int, dst []dueAck) []dueAck {
+	dst = s.reliability.appendDueAcks(shard, clockNow(), dst[:0])
+	h := s.handler.Load()
+	for _, due := range dst {
+		if peer := s.connections.PeerOf(due.conn); h != nil && s.connections.Get(peer) == due.conn {
+			h.sendPacket(due.ack, peer)
+		}
+	}
+	clear(dst)
+	return dst
+}
@@ -0,0 +1,128 @@
+package ultrafast
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAckReceivedDelayed(t *testing.T) {
+	rel := newConnectionReliabilityLayer(NewEpochDomain(releaseUnackedEntry), NewEpochDomain(releaseQueueNode))
+	rel.SetAckDelay(time.Second)
+	if delay := rel.AckDelay(); delay != maxAckDelay {
+		t.Fatalf("Expected the delay capped at %v, got %v", maxAckDelay, delay)
+	}
+	rel.acks.sync(1)
+	data := func(seq uint32) *Packet { return NewPacket(DATA_PACKET, 0, seq, 0, nil) }
+
+	// The first in-order packet waits, the second is acknowledged with it
+	if ack := rel.AckReceived(data(1)); ack != nil {
+		t.Fatalf("Expected the ACK for packet 1 delayed, got %d", ack.AckNum)
+	}
+	if ack := rel.AckReceived(data(2)); ack == nil || ack.AckNum != 3 {
+		t.Fatalf("Expected an immediate ACK up to 3, got %v", ack)
+	}
+	if ack := rel.DueAck(time.Now().Add(time.Second)); ack != nil {
+		t.Errorf("Expected nothing left to flush, got %d", ack.AckNum)
+	}
+
+	// A held ACK goes out once due
+	if ack := rel.AckReceived(data(3)); ack != nil {
+		t.Fatalf("Expected the ACK for packet 3 delayed, got %d", ack.AckNum)
+	}
+	if ack := rel.DueAck(time.Now()); ack != nil {
+		t.Errorf("Expected the ACK not yet due, got %d", ack.AckNum)
+	}
+	if ack := rel.DueAck(time.Now().Add(maxAckDelay)); ack == nil || ack.AckNum != 4 {
+		t.Fatalf("Expected the delayed ACK up to 4, got %v", ack)
+	}
+
+	// Out of order, filling the gap and duplicates are acknowledged at once
+	tests := []struct {
+		seq    uint32
+		ackNum uint32
+		blocks []SACKBlock
+	}{
+		{5, 4, []SACKBlock{{5, 6}}},
+		{4, 6, nil},
+		{2, 6, nil},
+	}
+	for _, tt := range tests {
+		ack := rel.AckReceived(data(tt.seq))
+		if ack == nil || ack.AckNum != tt.ackNum || !reflect.DeepEqual(ack.SACK(), tt.blocks) {
+			t.Errorf("After %d: expected an immediate ACK up to %d %v, got %v", tt.seq, tt.ackNum, tt.blocks, ack)
+		}
+	}
+
+	// An immediate ACK covers the one held back
+	rel.AckReceived(data(6))
+	rel.AckReceived(data(8))
+	if ack := rel.DueAck(time.Now().Add(maxAckDelay)); ack != nil {
+		t.Errorf("Expected the held ACK superseded, got %d", ack.AckNum)
+	}
+}
+
+func TestAckReceivedImmediateByDefault(t *testing.T) {
+	shards := NewReliabilityShards(1)
+	conn := &Connection{}
+	shards.Attach(conn, SocketAddr{IP: "127.0.0.1", Port: 9000})
+	for seq := uint32(10); seq < 13; seq++ {
+		if ack := conn.Reliability().AckReceived(NewPacket(DATA_PACKET, 0, seq, 0, nil)); ack == nil || ack.AckNum != seq+1 {
+			t.Errorf("Expected packet %d acknowledged at once, got %v", seq, ack)
+		}
+	}
+
+	// The connectionless layer acknowledges each packet alone, never late
+	shards.SetAckDelay(10 * time.Millisecond)
+	if ack := shards.Connectionless().AckReceived(NewPacket(DATA_PACKET, 0, 40, 0, nil)); ack == nil || ack.AckNum != 41 {
+		t.Errorf("Expected a connectionless ACK for 40 alone, got %v", ack)
+	}
+}
+
+func TestReliabilityShardsDueAcks(t *testing.T) {
+	shards := NewReliabilityShards(1)
+	shards.SetAckDelay(10 * time.Millisecond)
+	conns := make([]*Connection, 3)
+	for i := range conns {
+		conns[i] = &Connection{}
+		shards.Attach(conns[i], SocketAddr{IP: "127.0.0.1", Port: uint16(9000 + i)})
+	}
+	if delay := conns[0].Reliability().AckDelay(); delay != 10*time.Millisecond {
+		t.Fatalf("Expected new layers to take the delay, got %v", delay)
+	}
+
+	// Only the connections holding an ACK have one due
+	conns[0].Reliability().AckReceived(NewPacket(DATA_PACKET, 0, 1, 0, nil))
+	conns[2].Reliability().AckReceived(NewPacket(DATA_PACKET, 0, 5, 0, nil))
+	due := shards.appendDueAcks(0, time.Now().Add(10*time.Millisecond), nil)
+	if len(due) != 2 {
+		t.Fatalf("Expected 2 due ACKs, got %d", len(due))
+	}
+	for _, d := range due {
+		if want := map[*Connection]uint32{conns[0]: 2, conns[2]: 6}[d.conn]; d.ack.AckNum != want {
+			t.Errorf("Expected an ACK up to %d, got %d", want, d.ack.AckNum)
+		}
+	}
+	if due = shards.appendDueAcks(0, time.Now().Add(time.Second), due[:0]); len(due) != 0 {
+		t.Errorf("Expected each ACK sent once, got %d more", len(due))
+	}
+}
+
+func TestServerDelayedAck(t *testing.T) {
+	server := startTestServer(t)
+	server.SetAckDelay(40 * time.Millisecond)
+
+	// The segment's ACK comes from the reliability worker once the delay
+	// runs out, well before the RTO would resend it
+	stream := dialTestStream(t, server)
+	start := time.Now()
+	if _, err := stream.Write([]byte("hi")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := stream.drain(); err != nil {
+		t.Fatalf("No ACK arrived: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond || elapsed >= initialRTO {
+		t.Errorf("Expected the ACK after about 40ms, got it after %v", elapsed)
+	}
+}
@@ -0,0 +1,378 @@
+package ultrafast
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Discovery defaults: an administratively scoped group, so announcements
+// stay within the site
+const (
+	defaultDiscoveryGroup    = "239.255.77.77"
+	defaultDiscoveryPort     = 7946
+	defaultDiscoveryInterval = time.Second
+	discoveryPollInterval    = 100 * time.Millisecond
+)
+
+// helloHeaderSize is the fixed part of a HELLO payload: node ID, service
+// port, TTL in seconds and the metadata entry count
+const helloHeaderSize = 8 + 2 + 2 + 1
+
+// DiscoveryConfig configures peer discovery. Zero values take the defaults.
+type DiscoveryConfig struct {
+	Group       string            // multicast group, default 239.255.77.77
+	Port        uint16            // group port, default 7946
+	Interface   string            // address of the interface to use, "" for the kernel's choice
+	Interval    time.Duration     // time between HELLOs, default 1s
+	TTL         time.Duration     // how long peers keep us without a HELLO, default 3 intervals
+	ServicePort uint16            // port this node serves on, announced to peers
+	Metadata    map[string]string // announced with every HELLO; keys and values up to 255 bytes
+}
+
+// Peer is a node found by discovery
+type Peer struct {
+	NodeID   uint64
+	Addr     SocketAddr // the peer's service address
+	Metadata map[string]string
+	LastSeen time.Time
+	Expires  time.Time
+}
+
+// PeerCallback is told when a peer appears (up) or leaves or expires
+type PeerCallback func(peer Peer, up bool)
+
+// Discovery finds other nodes on the network. Each node multicasts a HELLO
+// packet every interval carrying its ID, service port and metadata, and
+// keeps a table of the peers it hears from. Entries expire after the TTL
+// the peer announced, and a node leaving says so with a final HELLO whose
+// TTL is zero.
+type Discovery struct {
+	config DiscoveryConfig
+	nodeID uint64
+	socket *LinuxUDPSocket
+	group  *MulticastGroup
+	hello  []byte
+
+	mu       sync.Mutex
+	peers    map[uint64]*Peer
+	callback PeerCallback
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewDiscovery joins the discovery group. Call Start to begin announcing.
+func NewDiscovery(config DiscoveryConfig) (*Discovery, error) {
+	if config.Group == "" {
+		config.Group = defaultDiscoveryGroup
+	}
+	if config.Port == 0 {
+		config.Port = defaultDiscoveryPort
+	}
+	if config.Interval <= 0 {
+		config.Interval = defaultDiscoveryInterval
+	}
+	if config.TTL <= 0 {
+		config.TTL = 3 * config.Interval
+	}
+
+	d := &Discovery{
+		config: config,
+		nodeID: randomUint64(),
+		peers:  make(map[uint64]*Peer),
+		stop:   make(chan struct{}),
+	}
+	hello, err := encodeHello(d.nodeID, config.ServicePort, config.TTL, config.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	d.hello = hello
+
+	// Every node on a host binds the group port; SO_REUSEPORT, set on all
+	// our sockets, lets them share it and each gets a copy of the traffic
+	socket, err := NewLinuxUDPSocket()
+	if err != nil {
+		return nil, err
+	}
+	if err := socket.Bind("0.0.0.0", config.Port); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	if config.Interface != "" {
+		if err := socket.SetMulticastInterface(config.Interface); err != nil {
+			socket.Close()
+			return nil, err
+		}
+	}
+	if err := socket.SetMulticastLoopback(true); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	group, err := socket.JoinGroup(config.Group, config.Interface)
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+
+	// Receives time out so the loop notices Close
+	setTimeoutOption(socket.sock(), soRcvTimeo, discoveryPollInterval.Nanoseconds())
+
+	d.socket = socket
+	d.group = group
+	return d, nil
+}
+
+// NodeID returns this node's randomly chosen ID
+func (d *Discovery) NodeID() uint64 {
+	return d.nodeID
+}
+
+// OnPeerChange registers a callback for peers appearing and disappearing
+func (d *Discovery) OnPeerChange(callback PeerCallback) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.callback = callback
+}
+
+// Start begins announcing this node and listening for others
+func (d *Discovery) Start() {
+	d.wg.Add(2)
+	go d.announceLoop()
+	go d.receiveLoop()
+}
+
+// Close announces that this node is leaving, leaves the group and stops
+func (d *Discovery) Close() error {
+	select {
+	case <-d.stop:
+		return nil
+	default:
+	}
+	close(d.stop)
+	d.wg.Wait()
+
+	if bye, err := encodeHello(d.nodeID, d.config.ServicePort, 0, nil); err == nil {
+		d.group.Send(bye, d.config.Port)
+	}
+	d.group.Leave()
+	return d.socket.Close()
+}
+
+// Peers returns the live peers ordered by node ID
+func (d *Discovery) Peers() []Peer {
+	d.expire(time.Now())
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	peers := make([]Peer, 0, len(d.peers))
+	for _, peer := range d.peers {
+		peers = append(peers, *peer)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].NodeID < peers[j].NodeID })
+	return peers
+}
+
+// announceLoop sends a HELLO every interval until Close
+func (d *Discovery) announceLoop() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.group.Send(d.hello, d.config.Port); err != nil {
+			logDebugf("Discovery HELLO failed: %v", err)
+		}
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// receiveLoop reads HELLOs into the peer table until Close
+func (d *Discovery) receiveLoop() {
+	defer d.wg.Done()
+	buffer := make([]byte, MAX_PACKET_SIZE)
+	for {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+
+		n, from, err := d.socket.RecvFrom(buffer)
+		now := time.Now()
+		d.expire(now)
+		if err != nil {
+			continue // timeout; check for Close
+		}
+		packet, err := DeserializePacket(buffer[:n])
+		if err != nil || packet.Type != HELLO_PACKET {
+			continue
+		}
+		d.receiveHello(packet.Payload, from, now)
+	}
+}
+
+// receiveHello records or removes the peer a HELLO describes
+func (d *Discovery) receiveHello(payload []byte, from SocketAddr, now time.Time) {
+	nodeID, port, ttl, metadata, err := decodeHello(payload)
+	if err != nil {
+		logDebugf("Bad HELLO from %s: %v", from, err)
+		return
+	}
+	if nodeID == d.nodeID {
+		return // our own HELLO looped back
+	}
+
+	d.mu.Lock()
+	existing, known := d.peers[nodeID]
+	if ttl == 0 {
+		delete(d.peers, nodeID)
+		callback := d.callback
+		d.mu.Unlock()
+		if known && callback != nil {
+			callback(*existing, false)
+		}
+		return
+	}
+
+	peer := &Peer{
+		NodeID:   nodeID,
+		Addr:     SocketAddr{IP: from.IP, Port: port},
+		Metadata: metadata,
+		LastSeen: now,
+		Expires:  now.Add(ttl),
+	}
+	d.peers[nodeID] = peer
+	callback := d.callback
+	d.mu.Unlock()
+	if !known && callback != nil {
+		callback(*peer, true)
+	}
+}
+
+// expire drops peers whose TTL has run out
+func (d *Discovery) expire(now time.Time) {
+	var expired []Peer
+	d.mu.Lock()
+	for id, peer := range d.peers {
+		if now.After(peer.Expires) {
+			expired = append(expired, *peer)
+			delete(d.peers, id)
+		}
+	}
+	callback := d.callback
+	d.mu.Unlock()
+	if callback != nil {
+		for _, peer := range expired {
+			callback(peer, false)
+		}
+	}
+}
+
+// encodeHello builds a HELLO packet: node ID, service port, TTL in whole
+// seconds (0 when leaving) and length-prefixed metadata pairs
+func encodeHello(nodeID uint64, port uint16, ttl time.Duration, metadata map[string]string) ([]byte, error) {
+	if len(metadata) > 255 {
+		return nil, fmt.Errorf("too many metadata entries: %d", len(metadata))
+	}
+	seconds := (ttl + time.Second - 1) / time.Second
+	if seconds > 0xFFFF {
+		seconds = 0xFFFF
+	}
+
+	payload := make([]byte, helloHeaderSize, MAX_PAYLOAD_SIZE)
+	binary.BigEndian.PutUint64(payload[0:8], nodeID)
+	binary.BigEndian.PutUint16(payload[8:10], port)
+	binary.BigEndian.PutUint16(payload[10:12], uint16(seconds))
+	payload[12] = byte(len(metadata))
+
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := metadata[key]
+		if len(key) > 255 || len(value) > 255 {
+			return nil, fmt.Errorf("metadata %q too long", key)
+		}
+		payload = append(payload, byte(len(key)))
+		payload = append(payload, key...)
+		payload = append(payload, byte(len(value)))
+		payload = append(payload, value...)
+	}
+	if len(payload) > MAX_PAYLOAD_SIZE {
+		return nil, fmt.Errorf("metadata does not fit in one packet")
+	}
+	return NewPacket(HELLO_PACKET, 0, 0, 0, payload).Serialize(), nil
+}
+
+// decodeHello parses a HELLO payload
+func decodeHello(payload []byte) (nodeID uint64, port uint16, ttl time.Duration, metadata map[string]string, err error) {
+	if len(payload) < helloHeaderSize {
+		return 0, 0, 0, nil, fmt.Errorf("HELLO too short: %d bytes", len(payload))
+	}
+	nodeID = binary.BigEndian.Uint64(payload[0:8])
+	port = binary.BigEndian.Uint16(payload[8:10])
+	ttl = time.Duration(binary.BigEndian.Uint16(payload[10:12])) * time.Second
+	count := int(payload[12])
+
+	metadata = make(map[string]string, count)
+	rest := payload[helloHeaderSize:]
+	for i := 0; i < count; i++ {
+		var key, value string
+		if key, rest, err = readHelloString(rest); err != nil {
+			return 0, 0, 0, nil, err
+		}
+		if value, rest, err = readHelloString(rest); err != nil {
+			return 0, 0, 0, nil, err
+		}
+		metadata[key] = value
+	}
+	return nodeID, port, ttl, metadata, nil
+}
+
+// readHelloString reads one length-prefixed string
+func readHelloString(data []byte) (string, []byte, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", nil, fmt.Errorf("truncated HELLO metadata")
+	}
+	end := 1 + int(data[0])
+	return string(data[1:end]), data[end:], nil
+}
+
+// EnableDiscovery announces this server to its peers and tracks theirs,
+// replacing any previous discovery. The service port defaults to the
+// server's own.
+func (s *UltraFastHTTPServer) EnableDiscovery(config DiscoveryConfig) (*Discovery, error) {
+	if config.ServicePort == 0 {
+		config.ServicePort = s.socket.GetLocalAddr().Port
+	}
+	d, err := NewDiscovery(config)
+	if err != nil {
+		return nil, err
+	}
+	s.DisableDiscovery()
+	s.discovery.Store(d)
+	d.Start()
+	return d, nil
+}
+
+// DisableDiscovery says goodbye to peers and stops discovery
+func (s *UltraFastHTTPServer) DisableDiscovery() {
+	if d := s.discovery.Swap(nil); d != nil {
+		d.Close()
+	}
+}
+
+// Peers returns the servers found by discovery, or nil if it is off
+func (s *UltraFastHTTPServer) Peers() []Peer {
+	if d := s.discovery.Load(); d != nil {
+		return d.Peers()
+	}
+	return nil
+}
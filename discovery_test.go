@@ -0,0 +1,121 @@
+package ultrafast
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHelloEncoding(t *testing.T) {
+	metadata := map[string]string{"role": "edge", "zone": "eu-1"}
+	data, err := encodeHello(0x1122334455667788, 8080, 2500*time.Millisecond, metadata)
+	if err != nil {
+		t.Fatalf("encodeHello failed: %v", err)
+	}
+	packet, err := DeserializePacket(data)
+	if err != nil || packet.Type != HELLO_PACKET {
+		t.Fatalf("Expected a HELLO packet, got %v, %v", packet, err)
+	}
+
+	nodeID, port, ttl, decoded, err := decodeHello(packet.Payload)
+	if err != nil {
+		t.Fatalf("decodeHello failed: %v", err)
+	}
+	if nodeID != 0x1122334455667788 || port != 8080 || ttl != 3*time.Second {
+		t.Errorf("Unexpected HELLO fields: %x %d %v", nodeID, port, ttl)
+	}
+	if len(decoded) != 2 || decoded["role"] != "edge" || decoded["zone"] != "eu-1" {
+		t.Errorf("Unexpected metadata %v", decoded)
+	}
+
+	if _, _, _, _, err := decodeHello(packet.Payload[:len(packet.Payload)-1]); err == nil {
+		t.Error("Expected truncated metadata to be rejected")
+	}
+}
+
+func TestDiscoveryPeerExpiry(t *testing.T) {
+	d := &Discovery{nodeID: 1, peers: make(map[uint64]*Peer)}
+	var events []bool
+	d.OnPeerChange(func(peer Peer, up bool) { events = append(events, up) })
+
+	hello, _ := encodeHello(2, 9000, time.Second, nil)
+	packet, _ := DeserializePacket(hello)
+	now := time.Now()
+	d.receiveHello(packet.Payload, SocketAddr{IP: "10.0.0.2", Port: 7946}, now)
+	d.receiveHello(packet.Payload, SocketAddr{IP: "10.0.0.2", Port: 7946}, now)
+	if peers := d.Peers(); len(peers) != 1 || peers[0].Addr != (SocketAddr{IP: "10.0.0.2", Port: 9000}) {
+		t.Fatalf("Expected one peer at its service port, got %+v", peers)
+	}
+
+	d.expire(now.Add(2 * time.Second))
+	if len(d.peers) != 0 {
+		t.Error("Peer should expire after its TTL")
+	}
+	if len(events) != 2 || !events[0] || events[1] {
+		t.Errorf("Expected one up and one down event, got %v", events)
+	}
+}
+
+func TestDiscoveryFindsPeers(t *testing.T) {
+	// A free port for the group, shared by both nodes
+	probe, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	probe.Bind("0.0.0.0", 0)
+	port := probe.GetLocalAddr().Port
+	probe.Close()
+
+	config := DiscoveryConfig{
+		Group:     "239.255.77.78",
+		Port:      port,
+		Interface: "127.0.0.1",
+		Interval:  20 * time.Millisecond,
+	}
+	newNode := func(servicePort uint16, zone string) *Discovery {
+		t.Helper()
+		config.ServicePort = servicePort
+		config.Metadata = map[string]string{"zone": zone}
+		d, err := NewDiscovery(config)
+		if err != nil {
+			t.Skipf("Multicast unavailable on loopback: %v", err)
+		}
+		return d
+	}
+	a := newNode(8001, "a")
+	defer a.Close()
+	b := newNode(8002, "b")
+	defer b.Close()
+
+	left := make(chan uint64, 1)
+	a.OnPeerChange(func(peer Peer, up bool) {
+		if !up {
+			left <- peer.NodeID
+		}
+	})
+	a.Start()
+	b.Start()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for (len(a.Peers()) == 0 || len(b.Peers()) == 0) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	peers := a.Peers()
+	if len(peers) != 1 || peers[0].NodeID != b.NodeID() || peers[0].Addr.Port != 8002 ||
+		peers[0].Metadata["zone"] != "b" {
+		t.Fatalf("Expected node a to find node b, got %+v", peers)
+	}
+	if peers := b.Peers(); len(peers) != 1 || peers[0].NodeID != a.NodeID() {
+		t.Fatalf("Expected node b to find node a, got %+v", peers)
+	}
+
+	// A node leaving says goodbye rather than waiting to expire
+	b.Close()
+	select {
+	case id := <-left:
+		if id != b.NodeID() {
+			t.Errorf("Expected node b to leave, got %x", id)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected a goodbye from node b")
+	}
+}
@@ -0,0 +1,10 @@
+package ultrafast
+
+import "sync/atomic"
+
+// RxqOverflows returns how many datagrams the kernel has dropped because
+// the socket's receive buffer was full, as last reported with a datagram
+// read through a PacketReader. It stays 0 unless SetRxqOverflow is on.
+func (s *LinuxUDPSocket) RxqOverflows() uint64 {
+	return uint64(atomic.LoadUint32(&s.rxqOverflows))
+}
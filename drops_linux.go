@@ -0,0 +1,43 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// rxqOverflowControlSize is room for the SO_RXQ_OVFL control message, and
+// for an IP_TOS one should SetRecvTOS be on too
+const rxqOverflowControlSize = 64
+
+// SetRxqOverflow asks the kernel to report, with each datagram received,
+// how many it has dropped because the socket's receive buffer was full.
+// PacketReader records the count, which RxqOverflows returns.
+func (s *LinuxUDPSocket) SetRxqOverflow(enabled bool) error {
+	value := 0
+	if enabled {
+		value = 1
+	}
+	if err := unix.SetsockoptInt(s.sock(), unix.SOL_SOCKET, unix.SO_RXQ_OVFL, value); err != nil {
+		return fmt.Errorf("SO_RXQ_OVFL: %v", err)
+	}
+	return nil
+}
+
+// noteOverflows records the drop count from a datagram's control
+// messages. The kernel only attaches it once a datagram has been dropped.
+func (s *LinuxUDPSocket) noteOverflows(control []byte) {
+	messages, err := unix.ParseSocketControlMessage(control)
+	if err != nil {
+		return
+	}
+	for _, m := range messages {
+		if m.Header.Level == unix.SOL_SOCKET && m.Header.Type == unix.SO_RXQ_OVFL && len(m.Data) >= 4 {
+			atomic.StoreUint32(&s.rxqOverflows, binary.NativeEndian.Uint32(m.Data))
+		}
+	}
+}
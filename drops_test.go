@@ -0,0 +1,107 @@
+package ultrafast
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSocketOverflowCounted(t *testing.T) {
+	sender := newBoundSocket(t)
+	receiver := newBoundSocket(t)
+	if err := receiver.SetRxqOverflow(true); err != nil {
+		t.Skipf("SO_RXQ_OVFL unavailable: %v", err)
+	}
+	to := receiver.GetLocalAddr()
+	reader := NewPacketReader(receiver)
+
+	// Overrun the receive buffer, drain it, and read one more datagram:
+	// the first queued after the drops reports them
+	datagram := make([]byte, 1400)
+	for i := 0; i < 8000; i++ {
+		sender.SendTo(datagram, to.IP, to.Port)
+	}
+	receiver.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		if _, _, _, err := reader.ReadDatagram(); err != nil {
+			break
+		}
+	}
+	sender.SendTo(datagram, to.IP, to.Port)
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, _, err := reader.ReadDatagram(); err != nil {
+		t.Fatalf("ReadDatagram failed: %v", err)
+	}
+	if receiver.RxqOverflows() == 0 {
+		t.Error("Expected the kernel's drops counted")
+	}
+}
+
+func TestStreamDeliverReportsOutOfOrder(t *testing.T) {
+	sc := newStreamConn(SocketAddr{}, func() SocketAddr { return SocketAddr{} }, newOrderedReader(),
+		&fakeTransport{}, nil)
+	if !sc.deliver(10, []byte("a")) || !sc.deliver(11, []byte("b")) {
+		t.Fatal("In order segments should be accepted")
+	}
+	if !sc.deliver(10, []byte("a")) {
+		t.Error("A duplicate is not lost data")
+	}
+	if !sc.deliver(13, []byte("d")) {
+		t.Error("Expected a segment past a gap held")
+	}
+	if sc.deliver(12+ackTrackerSpan, []byte("e")) {
+		t.Error("Expected a segment too far past a gap reported dropped")
+	}
+}
+
+func TestReceiveQueueFullCounted(t *testing.T) {
+	rf := NewLockFreeReliabilityLayer()
+	window := int(rf.recvWindow)
+	for seq := 0; seq <= window; seq++ {
+		rf.ReceivePacket(NewPacket(DATA_PACKET, 0, uint32(seq), 0, nil))
+	}
+	if dropped := rf.GetStats().ReceiveQueueFull; dropped != 1 {
+		t.Errorf("Expected 1 packet dropped past the window, got %d", dropped)
+	}
+	rf.GetOrderedPackets()
+}
+
+func TestHandlerRejectionsCounted(t *testing.T) {
+	server := startTestServer(t)
+	server.SetWorkerPool(WorkerPoolConfig{Workers: 1, QueueLength: 1, Overflow: POOL_OVERFLOW_REJECT})
+	release := make(chan struct{})
+	var once sync.Once
+	t.Cleanup(func() { once.Do(func() { close(release) }) })
+	server.HandleFunc("/slow", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		<-release
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}}
+	})
+
+	client := newTestClient(t, server)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	// One request runs, one waits, and the third has no room
+	for id := uint32(1); id <= 3; id++ {
+		for _, packet := range client.requestPackets(id, buildGetRequest("/slow", client.server)) {
+			client.send(packet)
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for server.GetStats().HandlerRejected == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if rejected := server.GetStats().HandlerRejected; rejected != 1 {
+		t.Errorf("Expected 1 request rejected, got %d", rejected)
+	}
+	once.Do(func() { close(release) })
+
+	admin := NewAdminServer("")
+	server.registerAdminCommands(admin)
+	if reply := admin.Execute("stats"); !strings.Contains(reply, "handler_rejected=1") {
+		t.Errorf("Expected the rejection in the stats reply, got %q", reply)
+	}
+}
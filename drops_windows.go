@@ -0,0 +1,8 @@
+package ultrafast
+
+import "fmt"
+
+// SetRxqOverflow is not supported on Windows; RxqOverflows stays 0
+func (s *LinuxUDPSocket) SetRxqOverflow(enabled bool) error {
+	return fmt.Errorf("SO_RXQ_OVFL is not supported on this platform")
+}
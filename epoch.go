@@ -0,0 +1,154 @@
+package ultrafast
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// epochSlots bounds how many goroutines can be pinned at once; Pin waits
+// for a free slot beyond that
+const epochSlots = 256
+
+// epochCollectEvery is how many retirements pass between attempts to
+// advance the epoch
+const epochCollectEvery = 64
+
+// EpochDomain implements epoch-based reclamation for lock-free
+// structures whose nodes are recycled. Readers pin the current epoch for
+// the duration of an operation; a node unlinked from the structure is
+// retired rather than reused, and handed to the free function only once
+// every goroutine that could still hold a pointer to it has unpinned.
+//
+// The global epoch advances when every pinned goroutine has observed it.
+// Nodes retired in epoch e are freed when the epoch reaches e+2: by then
+// no goroutine pinned at e or earlier remains. Three limbo lists are
+// enough, one per epoch that may still have readers.
+type EpochDomain struct {
+	epoch atomic.Uint64
+	slots [epochSlots]epochSlot
+	next  atomic.Uint32 // where Pin starts looking for a free slot
+
+	limbo   [3]epochLimbo
+	retires atomic.Uint64
+	free    func(unsafe.Pointer)
+
+	freed atomic.Uint64
+}
+
+// epochSlot records one pinned goroutine's epoch as epoch<<1|1, or 0 when
+// free. Slots are padded so pinning does not bounce a shared cache line.
+type epochSlot struct {
+	state atomic.Uint64
+	_     [56]byte
+}
+
+// epochLimbo holds the nodes retired during one epoch
+type epochLimbo struct {
+	mu    sync.Mutex
+	nodes []unsafe.Pointer
+}
+
+// EpochGuard is held while a goroutine reads nodes of a structure
+type EpochGuard struct {
+	domain *EpochDomain
+	slot   *epochSlot
+}
+
+// NewEpochDomain creates a domain that passes each safely reclaimable
+// node to free, which typically returns it to a pool
+func NewEpochDomain(free func(unsafe.Pointer)) *EpochDomain {
+	return &EpochDomain{free: free}
+}
+
+// Pin announces that the caller is about to read nodes. Nodes it loads
+// stay valid until Unpin.
+func (d *EpochDomain) Pin() EpochGuard {
+	start := d.next.Add(1)
+	for {
+		for i := uint32(0); i < epochSlots; i++ {
+			slot := &d.slots[(start+i)%epochSlots]
+			for {
+				epoch := d.epoch.Load()
+				if !slot.state.CompareAndSwap(0, epoch<<1|1) {
+					break // taken; try the next slot
+				}
+				// An advance between the load and the announcement would
+				// let the caller read under an epoch already collected
+				if d.epoch.Load() == epoch {
+					return EpochGuard{domain: d, slot: slot}
+				}
+				slot.state.Store(0)
+			}
+		}
+		runtime.Gosched() // every slot is pinned
+	}
+}
+
+// Unpin ends the read section started by Pin
+func (g EpochGuard) Unpin() {
+	g.slot.state.Store(0)
+}
+
+// Retire hands over a node that has been unlinked from the structure. It
+// is freed once no pinned goroutine can still reach it. The node is filed
+// under the epoch current after the unlink, since a goroutine pinned at
+// that epoch may have loaded it just before; holding g keeps that epoch
+// from being collected while the node is filed.
+func (g EpochGuard) Retire(node unsafe.Pointer) {
+	d := g.domain
+	limbo := &d.limbo[d.epoch.Load()%3]
+	limbo.mu.Lock()
+	limbo.nodes = append(limbo.nodes, node)
+	limbo.mu.Unlock()
+
+	if d.retires.Add(1)%epochCollectEvery == 0 {
+		d.TryAdvance()
+	}
+}
+
+// TryAdvance moves the epoch forward if every pinned goroutine has seen
+// the current one, and frees the nodes retired two epochs ago. It reports
+// whether the epoch advanced.
+func (d *EpochDomain) TryAdvance() bool {
+	epoch := d.epoch.Load()
+	for i := range d.slots {
+		state := d.slots[i].state.Load()
+		if state != 0 && state>>1 != epoch {
+			return false
+		}
+	}
+	if !d.epoch.CompareAndSwap(epoch, epoch+1) {
+		return false
+	}
+
+	// Only the goroutine that advanced to epoch+1 collects epoch-1
+	limbo := &d.limbo[(epoch+2)%3]
+	limbo.mu.Lock()
+	nodes := limbo.nodes
+	limbo.nodes = nil
+	limbo.mu.Unlock()
+
+	for _, node := range nodes {
+		d.free(node)
+	}
+	d.freed.Add(uint64(len(nodes)))
+	return true
+}
+
+// EpochStats is a snapshot of a domain's reclamation progress
+type EpochStats struct {
+	Epoch   uint64
+	Retired uint64
+	Freed   uint64
+}
+
+// Stats returns the current epoch and how many nodes were retired and freed
+func (d *EpochDomain) Stats() EpochStats {
+	return EpochStats{
+		Epoch:   d.epoch.Load(),
+		Retired: d.retires.Load(),
+		Freed:   d.freed.Load(),
+	}
+}
@@ -0,0 +1,156 @@
+package ultrafast
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+)
+
+// These tests recycle nodes while other goroutines read them; run them
+// with -race to check that reclamation waits for readers.
+
+func TestEpochRetireWaitsForPinned(t *testing.T) {
+	var freed []unsafe.Pointer
+	domain := NewEpochDomain(func(node unsafe.Pointer) { freed = append(freed, node) })
+
+	reader := domain.Pin()
+	writer := domain.Pin()
+	node := unsafe.Pointer(new(UnackedEntry))
+	writer.Retire(node)
+	writer.Unpin()
+
+	for i := 0; i < 4; i++ {
+		domain.TryAdvance()
+	}
+	if len(freed) != 0 {
+		t.Fatal("Node was freed while a reader was pinned")
+	}
+	if epoch := domain.Stats().Epoch; epoch > 1 {
+		t.Errorf("Epoch advanced to %d past a pinned reader", epoch)
+	}
+
+	reader.Unpin()
+	for i := 0; i < 2; i++ {
+		if !domain.TryAdvance() {
+			t.Fatalf("Advance %d failed with nothing pinned", i+1)
+		}
+	}
+	if len(freed) != 1 || freed[0] != node {
+		t.Fatalf("Expected the retired node to be freed, got %v", freed)
+	}
+	if stats := domain.Stats(); stats.Retired != 1 || stats.Freed != 1 {
+		t.Errorf("Expected 1 retired and 1 freed, got %+v", stats)
+	}
+}
+
+func TestEpochReliabilityRecyclesEntries(t *testing.T) {
+	rel := NewLockFreeReliabilityLayer()
+
+	const senders, perSender = 4, 2000
+	var scanning atomic.Bool
+	scanning.Store(true)
+	var scans sync.WaitGroup
+	scans.Add(1)
+	go func() {
+		defer scans.Done()
+		for scanning.Load() {
+			// Every entry a scan sees must still describe a live packet
+			guard := rel.entries.Pin()
+			rel.unackedTable.ForEach(func(key uint64, valuePtr unsafe.Pointer) bool {
+				entry := (*UnackedEntry)(valuePtr)
+				if entry.Packet == nil || uint64(entry.Packet.SeqNum) != key {
+					t.Errorf("Entry for %d was recycled while visible", key)
+					return false
+				}
+				return true
+			})
+			guard.Unpin()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perSender; i++ {
+				seq := rel.GetNextSeqNum()
+				if !rel.SendPacket(NewPacket(DATA_PACKET, 0, seq, 0, nil)) {
+					t.Errorf("SendPacket %d failed", seq)
+					return
+				}
+				// Selectively, as a cumulative ACK would cover other senders' packets
+				if !rel.HandleAck(sackPacket(0, SACKBlock{Start: seq, End: seq + 1})) {
+					t.Errorf("ACK for %d was not matched", seq)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	scanning.Store(false)
+	scans.Wait()
+
+	if count := rel.UnackedCount(); count != 0 {
+		t.Errorf("Expected every packet acked, %d left", count)
+	}
+	// With nothing pinned, two advances free everything retired
+	rel.entries.TryAdvance()
+	rel.entries.TryAdvance()
+	if stats := rel.entries.Stats(); stats.Retired != senders*perSender || stats.Freed != stats.Retired {
+		t.Errorf("Expected %d entries retired and freed, got %+v", senders*perSender, stats)
+	}
+}
+
+func TestEpochQueueRecyclesNodes(t *testing.T) {
+	q := NewLockFreeQueue(0)
+
+	const producers, perProducer = 4, 5000
+	values := make([]int, producers*perProducer)
+	delivered := make([]atomic.Int32, len(values))
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				id := p*perProducer + i
+				values[id] = id
+				q.Enqueue(unsafe.Pointer(&values[id]))
+			}
+		}()
+	}
+
+	var received atomic.Int64
+	for c := 0; c < producers; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for received.Load() < int64(len(values)) {
+				ptr := q.Dequeue()
+				if ptr == nil {
+					runtime.Gosched() // empty: let the producers run
+					continue
+				}
+				delivered[*(*int)(ptr)].Add(1)
+				received.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for id := range delivered {
+		if count := delivered[id].Load(); count != 1 {
+			t.Fatalf("Value %d delivered %d times", id, count)
+		}
+	}
+	if q.Dequeue() != nil {
+		t.Error("Queue should be empty")
+	}
+	if stats := q.nodes.Stats(); stats.Retired != uint64(len(values)) {
+		t.Errorf("Expected %d retired nodes, got %+v", len(values), stats)
+	}
+}
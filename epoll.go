@@ -1,55 +1,95 @@
-package main
+//go:build linux
+
+package ultrafast
 
 import (
 	"fmt"
-	"syscall"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
-// EpollEventLoop manages high-performance async I/O using Linux epoll
+// EpollEventLoop manages high-performance async I/O using Linux epoll.
+// Run drives the loop on one goroutine; AddSocket, RemoveSocket, Submit,
+// Stop and Close may be called from any goroutine.
 type EpollEventLoop struct {
 	epollFd   int
 	eventsFd  int
 	maxEvents int
-	events    []syscall.EpollEvent
-	handlers  map[int]EventHandler
-	running   bool
-}
+	events    []unix.EpollEvent
+	running   atomic.Bool
+	closed    atomic.Bool
 
-// EventHandler defines the interface for handling socket events
-type EventHandler interface {
-	OnRead(fd int) error
-	OnWrite(fd int) error
-	OnError(fd int, err error)
-	OnClose(fd int)
-}
+	handlersMu sync.RWMutex
+	handlers   map[int]EventHandler
+	oneshot    map[int]uint32 // events to re-arm one-shot descriptors with
+
+	// Held by Run for as long as the loop runs; Close takes it to wait
+	// for the loop to exit before closing the descriptors under it
+	runMu sync.Mutex
 
-// SocketEventHandler implements EventHandler for UDP sockets
-type SocketEventHandler struct {
-	socket    *LinuxUDPSocket
-	onData    func(data []byte, from SocketAddr)
-	onError   func(error)
-	buffer    []byte
+	// Tasks submitted from other goroutines, run on the loop; eventsFd is
+	// an eventfd that wakes epoll_wait when the queue becomes non-empty
+	tasksMu sync.Mutex
+	tasks   []func()
+
+	latency loopLatency
 }
 
 // NewEpollEventLoop creates a new epoll-based event loop
 func NewEpollEventLoop(maxEvents int) (*EpollEventLoop, error) {
 	// Create epoll instance
-	epollFd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	epollFd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create epoll instance: %v", err)
 	}
 
-	return &EpollEventLoop{
+	// Create the eventfd used to wake the loop for submitted tasks
+	eventsFd, err := newWakeFD()
+	if err != nil {
+		unix.Close(epollFd)
+		return nil, err
+	}
+
+	wakeEvent := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(eventsFd)}
+	if err := unix.EpollCtl(epollFd, unix.EPOLL_CTL_ADD, eventsFd, &wakeEvent); err != nil {
+		closeWakeFD(eventsFd)
+		unix.Close(epollFd)
+		return nil, fmt.Errorf("failed to add eventfd to epoll: %v", err)
+	}
+
+	el := &EpollEventLoop{
 		epollFd:   epollFd,
+		eventsFd:  eventsFd,
 		maxEvents: maxEvents,
-		events:    make([]syscall.EpollEvent, maxEvents),
+		events:    make([]unix.EpollEvent, maxEvents),
 		handlers:  make(map[int]EventHandler),
-		running:   false,
-	}, nil
+		oneshot:   make(map[int]uint32),
+	}
+	el.SetStallThreshold(defaultStallThreshold)
+	return el, nil
 }
 
-// AddSocket adds a socket to the epoll event loop
+// AddSocket adds a socket to the epoll event loop, edge-triggered
 func (el *EpollEventLoop) AddSocket(socket *LinuxUDPSocket, handler EventHandler) error {
+	return el.AddSocketMode(socket, handler, TRIGGER_EDGE)
+}
+
+// AddSocketMode adds a socket to the epoll event loop with the given
+// trigger mode
+func (el *EpollEventLoop) AddSocketMode(socket *LinuxUDPSocket, handler EventHandler, mode TriggerMode) error {
+	events, err := mode.events(unix.EPOLLIN)
+	if err != nil {
+		return err
+	}
+	return el.addSocket(socket, handler, events, mode == TRIGGER_ONESHOT)
+}
+
+// addSocket adds a socket watched for events; a one-shot socket is
+// re-armed with the same events after each report
+func (el *EpollEventLoop) addSocket(socket *LinuxUDPSocket, handler EventHandler, events uint32, oneshot bool) error {
 	fd := socket.GetFD()
 	
 	// Set socket to non-blocking mode
@@ -57,343 +97,229 @@ func (el *EpollEventLoop) AddSocket(socket *LinuxUDPSocket, handler EventHandler
 		return fmt.Errorf("failed to set non-blocking: %v", err)
 	}
 
+	// Store the handler first: a one-shot event may fire, and be re-armed,
+	// as soon as the socket is added
+	el.handlersMu.Lock()
+	el.handlers[fd] = handler
+	if oneshot {
+		el.oneshot[fd] = events
+	}
+	el.handlersMu.Unlock()
+
 	// Add socket to epoll with read events
-	event := syscall.EpollEvent{
-		Events: syscall.EPOLLIN | syscall.EPOLLET, // Edge-triggered for better performance
+	event := unix.EpollEvent{
+		Events: events,
 		Fd:     int32(fd),
 	}
 
-	if err := syscall.EpollCtl(el.epollFd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+	if err := unix.EpollCtl(el.epollFd, unix.EPOLL_CTL_ADD, fd, &event); err != nil {
+		el.handlersMu.Lock()
+		delete(el.handlers, fd)
+		delete(el.oneshot, fd)
+		el.handlersMu.Unlock()
 		return fmt.Errorf("failed to add socket to epoll: %v", err)
 	}
 
-	// Store the handler
-	el.handlers[fd] = handler
+	return nil
+}
 
+// AddFD watches a descriptor other than a socket, such as an eventfd,
+// for reads. It is level-triggered: the handler is called again until the
+// descriptor is drained.
+func (el *EpollEventLoop) AddFD(fd int, handler EventHandler) error {
+	event := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(fd)}
+	if err := unix.EpollCtl(el.epollFd, unix.EPOLL_CTL_ADD, fd, &event); err != nil {
+		return fmt.Errorf("failed to add fd %d to epoll: %v", fd, err)
+	}
+
+	el.handlersMu.Lock()
+	el.handlers[fd] = handler
+	el.handlersMu.Unlock()
 	return nil
 }
 
 // RemoveSocket removes a socket from the epoll event loop
 func (el *EpollEventLoop) RemoveSocket(fd int) error {
 	// Remove from epoll
-	if err := syscall.EpollCtl(el.epollFd, syscall.EPOLL_CTL_DEL, fd, nil); err != nil {
+	if err := unix.EpollCtl(el.epollFd, unix.EPOLL_CTL_DEL, fd, nil); err != nil {
 		return fmt.Errorf("failed to remove socket from epoll: %v", err)
 	}
 
 	// Remove handler
-	if handler, exists := el.handlers[fd]; exists {
+	el.handlersMu.Lock()
+	handler, exists := el.handlers[fd]
+	delete(el.handlers, fd)
+	delete(el.oneshot, fd)
+	el.handlersMu.Unlock()
+	if exists {
 		handler.OnClose(fd)
-		delete(el.handlers, fd)
 	}
 
 	return nil
 }
 
-// Run starts the event loop (blocking)
+// Run starts the event loop (blocking). It returns when Stop is called
+// while it runs, or when the loop is closed; only one Run may be active at
+// a time.
 func (el *EpollEventLoop) Run() error {
-	el.running = true
-	
-	for el.running {
+	if !el.runMu.TryLock() {
+		return fmt.Errorf("event loop is already running")
+	}
+	defer el.runMu.Unlock()
+	if el.closed.Load() {
+		return fmt.Errorf("event loop is closed")
+	}
+
+	el.running.Store(true)
+	defer el.running.Store(false)
+
+	for el.running.Load() && !el.closed.Load() {
 		// Wait for events with 1 second timeout
-		n, err := syscall.EpollWait(el.epollFd, el.events, 1000)
+		waitStart := time.Now()
+		n, err := unix.EpollWait(el.epollFd, el.events, 1000)
 		if err != nil {
-			if err == syscall.EINTR {
+			if err == unix.EINTR {
 				continue // Interrupted system call, continue
 			}
 			return fmt.Errorf("epoll_wait failed: %v", err)
 		}
+		el.latency.wokeUp(n, time.Since(waitStart))
 
 		// Process events
 		for i := 0; i < n; i++ {
 			event := el.events[i]
 			fd := int(event.Fd)
+
+			if fd == el.eventsFd {
+				el.runTasks()
+				continue
+			}
 			
+			el.handlersMu.RLock()
 			handler, exists := el.handlers[fd]
+			_, oneshot := el.oneshot[fd]
+			el.handlersMu.RUnlock()
 			if !exists {
 				continue
 			}
+			start := time.Now()
 
 			// Handle different event types
-			if event.Events&syscall.EPOLLIN != 0 {
+			if event.Events&unix.EPOLLIN != 0 {
 				// Data available for reading
 				if err := handler.OnRead(fd); err != nil {
 					handler.OnError(fd, err)
 				}
 			}
 
-			if event.Events&syscall.EPOLLOUT != 0 {
+			if event.Events&unix.EPOLLOUT != 0 {
 				// Socket ready for writing
 				if err := handler.OnWrite(fd); err != nil {
 					handler.OnError(fd, err)
 				}
 			}
 
-			if event.Events&(syscall.EPOLLERR|syscall.EPOLLHUP) != 0 {
+			if event.Events&(unix.EPOLLERR|unix.EPOLLHUP) != 0 {
 				// Error or hang-up occurred
-				handler.OnError(fd, fmt.Errorf("socket error/hangup"))
+				if err := socketError(fd, event.Events); err != nil {
+					handler.OnError(fd, err)
+				}
 			}
-		}
-	}
 
-	return nil
-}
-
-// Stop stops the event loop
-func (el *EpollEventLoop) Stop() {
-	el.running = false
-}
-
-// Close cleans up the event loop
-func (el *EpollEventLoop) Close() error {
-	el.Stop()
-	
-	// Close all managed sockets
-	for fd := range el.handlers {
-		el.RemoveSocket(fd)
+			if oneshot {
+				el.rearm(fd)
+			}
+			el.latency.ran(start, fd)
+		}
 	}
 
-	// Close epoll instance
-	if el.epollFd > 0 {
-		return syscall.Close(el.epollFd)
-	}
 	return nil
 }
 
-// GetStats returns event loop statistics
-func (el *EpollEventLoop) GetStats() EventLoopStats {
-	return EventLoopStats{
-		ActiveConnections: len(el.handlers),
-		MaxEvents:        el.maxEvents,
-		Running:          el.running,
-	}
-}
-
-// EventLoopStats holds statistics for the event loop
-type EventLoopStats struct {
-	ActiveConnections int
-	MaxEvents        int
-	Running          bool
-}
+// Submit queues a task to run on the event loop goroutine and wakes the
+// loop. It is safe to call from any goroutine.
+func (el *EpollEventLoop) Submit(task func()) {
+	el.tasksMu.Lock()
+	el.tasks = append(el.tasks, task)
+	wake := len(el.tasks) == 1
+	el.tasksMu.Unlock()
 
-// NewSocketEventHandler creates a new socket event handler
-func NewSocketEventHandler(socket *LinuxUDPSocket, bufferSize int) *SocketEventHandler {
-	return &SocketEventHandler{
-		socket: socket,
-		buffer: make([]byte, bufferSize),
+	if wake {
+		el.wake()
 	}
 }
 
-// SetDataCallback sets the callback for received data
-func (h *SocketEventHandler) SetDataCallback(callback func(data []byte, from SocketAddr)) {
-	h.onData = callback
-}
-
-// SetErrorCallback sets the callback for errors
-func (h *SocketEventHandler) SetErrorCallback(callback func(error)) {
-	h.onError = callback
+// wake interrupts epoll_wait through the eventfd
+func (el *EpollEventLoop) wake() {
+	signalWakeFD(el.eventsFd)
 }
 
-// OnRead handles read events
-func (h *SocketEventHandler) OnRead(fd int) error {
-	for {
-		n, fromAddr, err := h.socket.RecvFrom(h.buffer)
-		if err != nil {
-			if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
-				// No more data available, normal for edge-triggered epoll
-				break
-			}
-			return fmt.Errorf("recv error: %v", err)
-		}
-
-		if n > 0 && h.onData != nil {
-			// Make a copy of the data for the callback
-			data := make([]byte, n)
-			copy(data, h.buffer[:n])
-			h.onData(data, fromAddr)
-		}
-	}
-	return nil
-}
+// runTasks clears the eventfd and runs every submitted task
+func (el *EpollEventLoop) runTasks() {
+	clearWakeFD(el.eventsFd)
 
-// OnWrite handles write events
-func (h *SocketEventHandler) OnWrite(fd int) error {
-	// For UDP, we typically don't need to handle write events
-	// since UDP sends are usually non-blocking
-	return nil
-}
+	el.tasksMu.Lock()
+	tasks := el.tasks
+	el.tasks = nil
+	el.tasksMu.Unlock()
 
-// OnError handles error events
-func (h *SocketEventHandler) OnError(fd int, err error) {
-	if h.onError != nil {
-		h.onError(err)
+	for _, task := range tasks {
+		start := time.Now()
+		task()
+		el.latency.ran(start, -1)
 	}
 }
 
-// OnClose handles close events
-func (h *SocketEventHandler) OnClose(fd int) {
-	// Cleanup if needed
-}
-
-// HighPerformanceServer demonstrates a high-performance UDP server using epoll
-type HighPerformanceServer struct {
-	socket     *LinuxUDPSocket
-	eventLoop  *EpollEventLoop
-	handler    *SocketEventHandler
-	stats      ServerStats
+// Stop makes a running event loop return from Run without waiting for
+// the epoll_wait timeout
+func (el *EpollEventLoop) Stop() {
+	el.running.Store(false)
+	el.wake()
 }
 
-// Note: ServerStats is defined in ultra_fast_server.go to avoid duplicate definition
-
-// NewHighPerformanceServer creates a new high-performance UDP server
-func NewHighPerformanceServer(bindIP string, bindPort uint16) (*HighPerformanceServer, error) {
-	// Create socket
-	socket, err := NewLinuxUDPSocket()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create socket: %v", err)
-	}
-
-	// Bind to address
-	if err := socket.Bind(bindIP, bindPort); err != nil {
-		socket.Close()
-		return nil, fmt.Errorf("failed to bind: %v", err)
+// Close stops the event loop, waits for Run to return and releases the
+// epoll instance. Later calls do nothing; Run fails once closed.
+func (el *EpollEventLoop) Close() error {
+	if el.closed.Swap(true) {
+		return nil
 	}
+	el.Stop()
+	el.runMu.Lock()
+	defer el.runMu.Unlock()
 
-	// Create event loop
-	eventLoop, err := NewEpollEventLoop(1000) // Handle up to 1000 concurrent events
-	if err != nil {
-		socket.Close()
-		return nil, fmt.Errorf("failed to create event loop: %v", err)
+	// Close all managed sockets
+	el.handlersMu.RLock()
+	fds := make([]int, 0, len(el.handlers))
+	for fd := range el.handlers {
+		fds = append(fds, fd)
 	}
-
-	// Create handler
-	handler := NewSocketEventHandler(socket, 65536) // 64KB buffer
-
-	server := &HighPerformanceServer{
-		socket:    socket,
-		eventLoop: eventLoop,
-		handler:   handler,
+	el.handlersMu.RUnlock()
+	for _, fd := range fds {
+		el.RemoveSocket(fd)
 	}
 
-	// Set up callbacks
-	handler.SetDataCallback(server.handleData)
-	handler.SetErrorCallback(server.handleError)
-
-	// Add socket to event loop
-	if err := eventLoop.AddSocket(socket, handler); err != nil {
-		socket.Close()
-		eventLoop.Close()
-		return nil, fmt.Errorf("failed to add socket to event loop: %v", err)
+	if el.eventsFd > 0 {
+		closeWakeFD(el.eventsFd)
 	}
 
-	return server, nil
-}
-
-// handleData processes received data
-func (s *HighPerformanceServer) handleData(data []byte, from SocketAddr) {
-	s.stats.RequestsReceived++
-	s.stats.BytesReceived += uint64(len(data))
-
-	// Echo the data back (simple echo server)
-	n, err := s.socket.SendTo(data, from.IP, from.Port)
-	if err != nil {
-		s.stats.Errors++
-		return
+	// Close epoll instance
+	if el.epollFd > 0 {
+		return unix.Close(el.epollFd)
 	}
-
-	s.stats.ResponsesSent++
-	s.stats.BytesSent += uint64(n)
-}
-
-// handleError processes errors
-func (s *HighPerformanceServer) handleError(err error) {
-	s.stats.Errors++
-}
-
-// Run starts the server (blocking)
-func (s *HighPerformanceServer) Run() error {
-	return s.eventLoop.Run()
-}
-
-// Stop stops the server
-func (s *HighPerformanceServer) Stop() {
-	s.eventLoop.Stop()
-}
-
-// Close cleans up the server
-func (s *HighPerformanceServer) Close() error {
-	s.eventLoop.Close()
-	return s.socket.Close()
-}
-
-// GetStats returns server statistics
-func (s *HighPerformanceServer) GetStats() ServerStats {
-	return s.stats
-}
-
-// GetAddress returns the server's bound address
-func (s *HighPerformanceServer) GetAddress() SocketAddr {
-	return s.socket.GetLocalAddr()
-}
-
-// ConnectionPool manages a pool of client connections for high throughput
-type ConnectionPool struct {
-	sockets   []*LinuxUDPSocket
-	eventLoop *EpollEventLoop
-	poolSize  int
-	roundRobin int
+	return nil
 }
 
-// NewConnectionPool creates a connection pool for high-performance clients
-func NewConnectionPool(poolSize int) (*ConnectionPool, error) {
-	eventLoop, err := NewEpollEventLoop(poolSize * 2)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create event loop: %v", err)
-	}
-
-	pool := &ConnectionPool{
-		sockets:   make([]*LinuxUDPSocket, poolSize),
-		eventLoop: eventLoop,
-		poolSize:  poolSize,
-	}
-
-	// Create pool of sockets
-	for i := 0; i < poolSize; i++ {
-		socket, err := NewLinuxUDPSocket()
-		if err != nil {
-			pool.Close()
-			return nil, fmt.Errorf("failed to create socket %d: %v", i, err)
-		}
-		pool.sockets[i] = socket
+// GetStats returns event loop statistics
+func (el *EpollEventLoop) GetStats() EventLoopStats {
+	el.handlersMu.RLock()
+	active := len(el.handlers)
+	el.handlersMu.RUnlock()
 
-		// Add to event loop with a simple handler
-		handler := NewSocketEventHandler(socket, 65536)
-		if err := eventLoop.AddSocket(socket, handler); err != nil {
-			pool.Close()
-			return nil, fmt.Errorf("failed to add socket %d to event loop: %v", i, err)
-		}
+	stats := EventLoopStats{
+		ActiveConnections: active,
+		MaxEvents:        el.maxEvents,
+		Running:          el.running.Load(),
 	}
-
-	return pool, nil
+	el.latency.fill(&stats)
+	return stats
 }
-
-// GetSocket returns the next socket in round-robin fashion
-func (cp *ConnectionPool) GetSocket() *LinuxUDPSocket {
-	socket := cp.sockets[cp.roundRobin]
-	cp.roundRobin = (cp.roundRobin + 1) % cp.poolSize
-	return socket
-}
-
-// Close closes all sockets in the pool
-func (cp *ConnectionPool) Close() error {
-	if cp.eventLoop != nil {
-		cp.eventLoop.Close()
-	}
-
-	for _, socket := range cp.sockets {
-		if socket != nil {
-			socket.Close()
-		}
-	}
-
-	return nil
-}
\ No newline at end of file
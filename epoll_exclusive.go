@@ -0,0 +1,68 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	exclusiveProbe     sync.Once
+	exclusiveSupported bool
+)
+
+// epollExclusiveSupported reports whether the kernel accepts
+// EPOLLEXCLUSIVE. It probes once, adding an eventfd to a scratch epoll
+// instance with the flag; older kernels reject it with EINVAL.
+func epollExclusiveSupported() bool {
+	exclusiveProbe.Do(func() {
+		epollFd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+		if err != nil {
+			return
+		}
+		defer unix.Close(epollFd)
+
+		eventFd, err := newWakeFD()
+		if err != nil {
+			return
+		}
+		defer closeWakeFD(eventFd)
+
+		event := unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLEXCLUSIVE, Fd: int32(eventFd)}
+		exclusiveSupported = unix.EpollCtl(epollFd, unix.EPOLL_CTL_ADD, eventFd, &event) == nil
+	})
+	return exclusiveSupported
+}
+
+// AddSharedSocket adds a socket that other event loops watch as well,
+// each with its own handler. Otherwise every datagram wakes every loop
+// waiting on the socket, and all but one find nothing to read; with
+// EPOLLEXCLUSIVE the kernel wakes only loops that are idle, one per
+// datagram, so the work spreads over them. Kernels before 4.5 lack the
+// flag, and the socket is then added without it. AddSharedSocket reports
+// whether wakeups are exclusive.
+//
+// One-shot mode is refused: the kernel does not allow it together with
+// EPOLLEXCLUSIVE, and exclusive wakeups already keep idle loops from
+// racing for the same datagram.
+func (el *EpollEventLoop) AddSharedSocket(socket *LinuxUDPSocket, handler EventHandler, mode TriggerMode) (bool, error) {
+	if mode == TRIGGER_ONESHOT {
+		return false, fmt.Errorf("a shared socket cannot be one-shot")
+	}
+	events, err := mode.events(unix.EPOLLIN)
+	if err != nil {
+		return false, err
+	}
+
+	exclusive := epollExclusiveSupported()
+	if exclusive {
+		events |= unix.EPOLLEXCLUSIVE
+	}
+	if err := el.addSocket(socket, handler, events, false); err != nil {
+		return false, err
+	}
+	return exclusive, nil
+}
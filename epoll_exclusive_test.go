@@ -0,0 +1,106 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// wakeupHandler counts the wakeups of one of several loops sharing a
+// socket, and how many of them found nothing to read. It holds on to
+// each wakeup for a while, as a handler doing real work would.
+type wakeupHandler struct {
+	socket  *LinuxUDPSocket
+	wakeups atomic.Int64
+	empty   atomic.Int64
+	reads   *atomic.Int64
+}
+
+func (h *wakeupHandler) OnRead(fd int) error {
+	h.wakeups.Add(1)
+	buffer := make([]byte, 2048)
+	read := 0
+	for {
+		if _, _, err := h.socket.RecvFrom(buffer); err != nil {
+			break
+		}
+		read++
+	}
+	if read == 0 {
+		h.empty.Add(1)
+	}
+	h.reads.Add(int64(read))
+	time.Sleep(5 * time.Millisecond)
+	return nil
+}
+
+func (h *wakeupHandler) OnWrite(fd int) error      { return nil }
+func (h *wakeupHandler) OnError(fd int, err error) {}
+func (h *wakeupHandler) OnClose(fd int)            {}
+
+// shareSocket runs loops event loops on one shared socket, sends it
+// datagrams one at a time and returns each loop's handler once all were
+// read
+func shareSocket(t *testing.T, loops, datagrams int) []*wakeupHandler {
+	t.Helper()
+	socket := newBoundSocket(t)
+	var reads atomic.Int64
+
+	var handlers []*wakeupHandler
+	for i := 0; i < loops; i++ {
+		el := newTestEventLoop(t)
+		handler := &wakeupHandler{socket: socket, reads: &reads}
+		if exclusive, err := el.AddSharedSocket(socket, handler, TRIGGER_EDGE); err != nil || !exclusive {
+			t.Fatalf("AddSharedSocket failed: exclusive %v, %v", exclusive, err)
+		}
+		go el.Run()
+		waitForLoop(t, el)
+		handlers = append(handlers, handler)
+	}
+
+	sender := newBoundSocket(t)
+	addr := socket.GetLocalAddr()
+	for i := 0; i < datagrams; i++ {
+		sender.SendTo([]byte("ping"), addr.IP, addr.Port)
+		time.Sleep(300 * time.Microsecond)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for reads.Load() < int64(datagrams) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := reads.Load(); got != int64(datagrams) {
+		t.Fatalf("Expected %d datagrams read, got %d", datagrams, got)
+	}
+	time.Sleep(20 * time.Millisecond) // let the last wakeups finish
+	return handlers
+}
+
+func TestSharedSocketExclusiveWakeups(t *testing.T) {
+	if !epollExclusiveSupported() {
+		t.Skip("Kernel lacks EPOLLEXCLUSIVE")
+	}
+	const loops, datagrams = 4, 200
+
+	// A loop busy with one datagram is not woken for the next, so the
+	// datagrams spread over all of them
+	for i, handler := range shareSocket(t, loops, datagrams) {
+		wakeups := handler.wakeups.Load()
+		t.Logf("Loop %d: %d wakeups, %d empty", i, wakeups, handler.empty.Load())
+		if wakeups < datagrams/(4*loops) {
+			t.Errorf("Loop %d woke only %d times for %d datagrams", i, wakeups, datagrams)
+		}
+	}
+}
+
+func TestSharedSocketRefusesOneShot(t *testing.T) {
+	el := newTestEventLoop(t)
+	socket := newBoundSocket(t)
+	if _, err := el.AddSharedSocket(socket, &countingHandler{socket: socket}, TRIGGER_ONESHOT); err == nil {
+		t.Error("Expected a one-shot shared socket to be refused")
+	}
+	if active := el.GetStats().ActiveConnections; active != 0 {
+		t.Errorf("Refused socket should not be registered, have %d", active)
+	}
+}
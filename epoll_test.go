@@ -0,0 +1,227 @@
+package ultrafast
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// These tests drive one event loop from several goroutines; run them with
+// -race to check the loop's synchronization.
+
+// newTestEventLoop creates an event loop closed at the end of the test
+func newTestEventLoop(t *testing.T) *EpollEventLoop {
+	t.Helper()
+
+	el, err := NewEpollEventLoop(64)
+	if err != nil {
+		t.Fatalf("Failed to create event loop: %v", err)
+	}
+	t.Cleanup(func() { el.Close() })
+	return el
+}
+
+// newBoundSocket creates a UDP socket on a loopback port
+func newBoundSocket(t *testing.T) *LinuxUDPSocket {
+	t.Helper()
+
+	socket, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	t.Cleanup(func() { socket.Close() })
+	if err := socket.Bind("127.0.0.1", 0); err != nil {
+		t.Fatalf("Failed to bind socket: %v", err)
+	}
+	return socket
+}
+
+// waitForLoop waits until the event loop reports that it is running
+func waitForLoop(t *testing.T, el *EpollEventLoop) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !el.GetStats().Running {
+		if time.Now().After(deadline) {
+			t.Fatal("Event loop did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEpollStopReturnsPromptly(t *testing.T) {
+	el := newTestEventLoop(t)
+
+	done := make(chan error, 1)
+	go func() { done <- el.Run() }()
+	waitForLoop(t, el)
+
+	start := time.Now()
+	el.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned %v", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Run did not return after Stop")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Stop took %v; it should wake epoll_wait", elapsed)
+	}
+	if el.GetStats().Running {
+		t.Error("Loop should not report running after Run returns")
+	}
+}
+
+func TestEpollSingleRun(t *testing.T) {
+	el := newTestEventLoop(t)
+
+	done := make(chan error, 1)
+	go func() { done <- el.Run() }()
+	waitForLoop(t, el)
+
+	if err := el.Run(); err == nil {
+		t.Error("A second concurrent Run should fail")
+	}
+
+	el.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+	if err := el.Run(); err == nil {
+		t.Error("Run after Close should fail")
+	}
+}
+
+func TestEpollConcurrentRunStop(t *testing.T) {
+	el := newTestEventLoop(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			el.Run()
+		}()
+		go func() {
+			defer wg.Done()
+			el.Stop()
+			el.GetStats()
+		}()
+	}
+
+	// Whichever Run is left holding the loop returns on Close
+	closed := make(chan struct{})
+	go func() {
+		el.Close()
+		wg.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+}
+
+// countingHandler counts datagrams read from a socket
+type countingHandler struct {
+	socket *LinuxUDPSocket
+	reads  atomic.Int64
+	closed atomic.Bool
+}
+
+func (h *countingHandler) OnRead(fd int) error {
+	buffer := make([]byte, 2048)
+	for {
+		if _, _, err := h.socket.RecvFrom(buffer); err != nil {
+			return nil
+		}
+		h.reads.Add(1)
+	}
+}
+
+func (h *countingHandler) OnWrite(fd int) error      { return nil }
+func (h *countingHandler) OnError(fd int, err error) {}
+func (h *countingHandler) OnClose(fd int)            { h.closed.Store(true) }
+
+func TestEpollConcurrentAddRemoveSocket(t *testing.T) {
+	el := newTestEventLoop(t)
+	go el.Run()
+	waitForLoop(t, el)
+
+	sender := newBoundSocket(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			socket := newBoundSocket(t)
+			handler := &countingHandler{socket: socket}
+			if err := el.AddSocket(socket, handler); err != nil {
+				t.Errorf("AddSocket failed: %v", err)
+				return
+			}
+
+			addr := socket.GetLocalAddr()
+			deadline := time.Now().Add(time.Second)
+			for handler.reads.Load() == 0 && time.Now().Before(deadline) {
+				sender.SendTo([]byte("ping"), addr.IP, addr.Port)
+				time.Sleep(5 * time.Millisecond)
+			}
+			if handler.reads.Load() == 0 {
+				t.Errorf("Socket %d never saw a datagram", socket.GetFD())
+			}
+
+			// Tasks submitted concurrently run on the loop goroutine
+			ran := make(chan struct{})
+			el.Submit(func() { close(ran) })
+			<-ran
+
+			if err := el.RemoveSocket(socket.GetFD()); err != nil {
+				t.Errorf("RemoveSocket failed: %v", err)
+			}
+			if !handler.closed.Load() {
+				t.Error("RemoveSocket should call OnClose")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if active := el.GetStats().ActiveConnections; active != 0 {
+		t.Errorf("Expected no sockets left, got %d", active)
+	}
+}
+
+func TestEpollCloseWhileRunning(t *testing.T) {
+	el := newTestEventLoop(t)
+	socket := newBoundSocket(t)
+	handler := &countingHandler{socket: socket}
+	if err := el.AddSocket(socket, handler); err != nil {
+		t.Fatalf("AddSocket failed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- el.Run() }()
+	waitForLoop(t, el)
+
+	if err := el.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned %v after Close", err)
+		}
+	default:
+		t.Error("Close should wait for Run to return")
+	}
+	if !handler.closed.Load() {
+		t.Error("Close should remove the loop's sockets")
+	}
+	if err := el.Close(); err != nil {
+		t.Errorf("Second Close failed: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package ultrafast
+
+import "fmt"
+
+// TriggerMode chooses how the event loop reports a socket's readiness
+type TriggerMode int
+
+const (
+	TRIGGER_EDGE    TriggerMode = iota // Report only new readiness; handlers must drain the socket (default)
+	TRIGGER_LEVEL                      // Report for as long as the socket is readable
+	TRIGGER_ONESHOT                    // Report once, then disarm until the handler has returned
+)
+
+// String returns the mode's name
+func (m TriggerMode) String() string {
+	switch m {
+	case TRIGGER_EDGE:
+		return "edge"
+	case TRIGGER_LEVEL:
+		return "level"
+	case TRIGGER_ONESHOT:
+		return "oneshot"
+	}
+	return fmt.Sprintf("TriggerMode(%d)", int(m))
+}
+
+// valid reports whether m is one of the defined modes
+func (m TriggerMode) valid() bool {
+	return m >= TRIGGER_EDGE && m <= TRIGGER_ONESHOT
+}
+
+// ParseTriggerMode converts a mode name into a TriggerMode
+func ParseTriggerMode(name string) (TriggerMode, error) {
+	switch name {
+	case "edge":
+		return TRIGGER_EDGE, nil
+	case "level":
+		return TRIGGER_LEVEL, nil
+	case "oneshot":
+		return TRIGGER_ONESHOT, nil
+	}
+	return 0, fmt.Errorf("unknown trigger mode: %s", name)
+}
+
+// SetTriggerMode chooses how the event loop watches the server's socket.
+// It takes effect when the server starts.
+func (s *UltraFastHTTPServer) SetTriggerMode(mode TriggerMode) error {
+	if !mode.valid() {
+		return fmt.Errorf("invalid trigger mode: %d", int(mode))
+	}
+	s.triggerMode.Store(int32(mode))
+	return nil
+}
+
+// TriggerMode returns how the event loop watches the server's socket
+func (s *UltraFastHTTPServer) TriggerMode() TriggerMode {
+	return TriggerMode(s.triggerMode.Load())
+}
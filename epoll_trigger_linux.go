@@ -0,0 +1,56 @@
+package ultrafast
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// events adds the mode's flags to an epoll event mask. One-shot sockets
+// are level-triggered once re-armed, so data that arrived while the
+// handler ran is reported again.
+func (m TriggerMode) events(events uint32) (uint32, error) {
+	switch m {
+	case TRIGGER_EDGE:
+		return events | unix.EPOLLET, nil
+	case TRIGGER_LEVEL:
+		return events, nil
+	case TRIGGER_ONESHOT:
+		return events | unix.EPOLLONESHOT, nil
+	}
+	return 0, fmt.Errorf("invalid trigger mode: %d", int(m))
+}
+
+// rearm re-enables a one-shot descriptor once its handler has returned,
+// unless the handler removed it meanwhile. Holding the lock keeps
+// RemoveSocket from finishing while the descriptor is re-armed.
+func (el *EpollEventLoop) rearm(fd int) {
+	el.handlersMu.RLock()
+	defer el.handlersMu.RUnlock()
+	events, oneshot := el.oneshot[fd]
+	if !oneshot {
+		return
+	}
+	event := unix.EpollEvent{Events: events, Fd: int32(fd)}
+	if err := unix.EpollCtl(el.epollFd, unix.EPOLL_CTL_MOD, fd, &event); err != nil && err != unix.ENOENT {
+		logWarnf("Failed to re-arm fd %d: %v", fd, err)
+	}
+}
+
+// socketError drains a descriptor's error queue and reads its pending
+// error, returning nil if there is none. The queue collects transmit
+// timestamps as well as errors; unless it is emptied, a level-triggered
+// socket is reported again straight away, and an edge-triggered one for
+// every packet sent.
+func socketError(fd int, events uint32) error {
+	drainErrorQueue(fd)
+
+	errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err == nil && errno != 0 {
+		return fmt.Errorf("socket error: %v", unix.Errno(errno))
+	}
+	if events&unix.EPOLLHUP != 0 {
+		return fmt.Errorf("socket hangup")
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// singleReadHandler reads one datagram per OnRead and, before reading,
+// polls the loop's epoll descriptor to see whether its own socket is
+// still reported while the handler runs
+type singleReadHandler struct {
+	el             *EpollEventLoop
+	socket         *LinuxUDPSocket
+	reads          atomic.Int64
+	reportedDuring atomic.Int64
+}
+
+func (h *singleReadHandler) OnRead(fd int) error {
+	events := make([]syscall.EpollEvent, 8)
+	n, _ := syscall.EpollWait(h.el.epollFd, events, 0)
+	for _, event := range events[:n] {
+		if int(event.Fd) == fd {
+			h.reportedDuring.Add(1)
+		}
+	}
+
+	buffer := make([]byte, 2048)
+	if _, _, err := h.socket.RecvFrom(buffer); err == nil {
+		h.reads.Add(1)
+	}
+	return nil
+}
+
+func (h *singleReadHandler) OnWrite(fd int) error      { return nil }
+func (h *singleReadHandler) OnError(fd int, err error) {}
+func (h *singleReadHandler) OnClose(fd int)            {}
+
+func TestTriggerModes(t *testing.T) {
+	for _, mode := range []TriggerMode{TRIGGER_LEVEL, TRIGGER_ONESHOT} {
+		t.Run(mode.String(), func(t *testing.T) {
+			el := newTestEventLoop(t)
+			socket := newBoundSocket(t)
+			handler := &singleReadHandler{el: el, socket: socket}
+			if err := el.AddSocketMode(socket, handler, mode); err != nil {
+				t.Fatalf("AddSocketMode failed: %v", err)
+			}
+
+			// Queued before the loop runs, so a handler reading one at a
+			// time only gets them all if the socket is reported again
+			sender := newBoundSocket(t)
+			addr := socket.GetLocalAddr()
+			for i := 0; i < 5; i++ {
+				sender.SendTo([]byte("ping"), addr.IP, addr.Port)
+			}
+			go el.Run()
+			waitForLoop(t, el)
+
+			deadline := time.Now().Add(time.Second)
+			for handler.reads.Load() < 5 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+			if reads := handler.reads.Load(); reads != 5 {
+				t.Fatalf("Expected 5 datagrams read, got %d", reads)
+			}
+
+			// A one-shot socket stays disarmed until its handler returns
+			reported := handler.reportedDuring.Load()
+			if mode == TRIGGER_ONESHOT && reported != 0 {
+				t.Errorf("One-shot socket was reported %d times while its handler ran", reported)
+			}
+			if mode == TRIGGER_LEVEL && reported == 0 {
+				t.Error("Level-triggered socket should be reported while data remains")
+			}
+		})
+	}
+}
+
+func TestParseTriggerMode(t *testing.T) {
+	for _, mode := range []TriggerMode{TRIGGER_EDGE, TRIGGER_LEVEL, TRIGGER_ONESHOT} {
+		if parsed, err := ParseTriggerMode(mode.String()); err != nil || parsed != mode {
+			t.Errorf("ParseTriggerMode(%q) = %v, %v", mode.String(), parsed, err)
+		}
+	}
+	if _, err := ParseTriggerMode("sometimes"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
+
+func TestServerTriggerModes(t *testing.T) {
+	for _, mode := range []TriggerMode{TRIGGER_LEVEL, TRIGGER_ONESHOT} {
+		t.Run(mode.String(), func(t *testing.T) {
+			server, err := NewUltraFastHTTPServer("127.0.0.1", 0)
+			if err != nil {
+				t.Fatalf("Failed to create server: %v", err)
+			}
+			if err := server.SetTriggerMode(mode); err != nil {
+				t.Fatalf("SetTriggerMode failed: %v", err)
+			}
+			go server.Start()
+			t.Cleanup(func() { server.Close() })
+
+			client := newTestClient(t, server)
+			for i := 0; i < 3; i++ {
+				if _, err := client.Get("/benchmark"); err != nil {
+					t.Fatalf("Request %d failed: %v", i, err)
+				}
+			}
+		})
+	}
+
+	server := startTestServer(t)
+	if err := server.SetTriggerMode(TriggerMode(7)); err == nil {
+		t.Error("Expected an invalid mode to be rejected")
+	}
+}
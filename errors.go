@@ -0,0 +1,99 @@
+package ultrafast
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Errors callers can tell apart with errors.Is, whichever layer returned
+// them. Socket, packet and connection errors carry more detail as the
+// types below, which errors.As extracts.
+var (
+	// ErrWouldBlock: a non-blocking socket or OrderedReader.TryRead had
+	// nothing to read, or a socket had no room to send
+	ErrWouldBlock = errors.New("operation would block")
+
+	// ErrChecksum: a packet's checksum does not match its contents
+	ErrChecksum = errors.New("checksum mismatch")
+
+	// ErrVersion: a packet carries a protocol version this code does
+	// not speak
+	ErrVersion = errors.New("unsupported protocol version")
+
+	// ErrMalformed: a packet is truncated, or its length or options are
+	// inconsistent
+	ErrMalformed = errors.New("malformed packet")
+
+	// ErrProtocol: a well-formed packet breaks the protocol, such as an
+	// ACK for data never sent or a sequence number outside the window
+	ErrProtocol = errors.New("protocol violation")
+
+	// ErrConnClosed: a connection was used after it closed, or the peer
+	// closed or reset it
+	ErrConnClosed = errors.New("connection closed")
+
+	// ErrConnAborted: the server reset a connection whose peer stopped
+	// acknowledging within the retransmission budget
+	ErrConnAborted = errors.New("connection aborted")
+)
+
+// SocketError is a failed socket call. It unwraps to the system error,
+// so errors.Is matches errno values such as syscall.ECONNREFUSED, and it
+// matches ErrWouldBlock when the socket was not ready.
+type SocketError struct {
+	Op  string // the call that failed, e.g. "sendto"
+	Err error
+}
+
+func (e *SocketError) Error() string {
+	return e.Op + " failed: " + e.Err.Error()
+}
+
+func (e *SocketError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports a would-block failure as ErrWouldBlock. Both errnos are
+// checked as they differ on some platforms.
+func (e *SocketError) Is(target error) bool {
+	return target == ErrWouldBlock && (e.Err == syscall.EAGAIN || e.Err == syscall.EWOULDBLOCK)
+}
+
+// PacketError is a packet that could not be decoded or was refused by
+// the reliability layer. It unwraps to its Kind: ErrMalformed,
+// ErrVersion, ErrChecksum or ErrProtocol.
+type PacketError struct {
+	Kind error
+	Msg  string
+}
+
+func (e *PacketError) Error() string {
+	return e.Msg
+}
+
+func (e *PacketError) Unwrap() error {
+	return e.Kind
+}
+
+// packetErrorf returns a PacketError of the given kind
+func packetErrorf(kind error, format string, args ...any) error {
+	return &PacketError{Kind: kind, Msg: fmt.Sprintf(format, args...)}
+}
+
+// closedError reports a closed connection. It matches ErrConnClosed, and
+// net.ErrClosed too, since the connection types follow the net
+// package's conventions.
+type closedError string
+
+func (e closedError) Error() string {
+	return string(e)
+}
+
+func (e closedError) Is(target error) bool {
+	return target == ErrConnClosed || target == net.ErrClosed
+}
+
+// errUseOfClosed is returned by reads and writes on a closed connection
+var errUseOfClosed error = closedError("use of closed connection")
@@ -0,0 +1,100 @@
+package ultrafast
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSocketErrorsMatchWouldBlock(t *testing.T) {
+	socket := newBoundSocket(t)
+	if err := socket.SetNonBlocking(true); err != nil {
+		t.Fatalf("SetNonBlocking failed: %v", err)
+	}
+
+	_, _, err := socket.RecvFrom(make([]byte, 64))
+	if !errors.Is(err, ErrWouldBlock) || !errors.Is(err, syscall.EAGAIN) {
+		t.Errorf("Expected a would-block error, got %v", err)
+	}
+	var socketErr *SocketError
+	if !errors.As(err, &socketErr) || socketErr.Op != "recvfrom" {
+		t.Errorf("Expected a SocketError from recvfrom, got %#v", err)
+	}
+
+	_, _, _, err = NewPacketReader(socket).ReadDatagram()
+	if !errors.Is(err, ErrWouldBlock) {
+		t.Errorf("Expected ReadDatagram to report a would-block error, got %v", err)
+	}
+	if errors.Is(err, ErrChecksum) || errors.Is(err, ErrConnClosed) {
+		t.Errorf("Would-block error matched another kind: %v", err)
+	}
+}
+
+func TestPacketErrorKinds(t *testing.T) {
+	valid := NewPacket(DATA_PACKET, 0, 1000, 2000, []byte("test")).Serialize()
+	corrupt := func(change func(data []byte)) []byte {
+		data := append([]byte(nil), valid...)
+		change(data)
+		return data
+	}
+
+	testCases := []struct {
+		name string
+		data []byte
+		kind error
+	}{
+		{"Too short", valid[:PACKET_HEADER_SIZE-1], ErrMalformed},
+		{"Length mismatch", valid[:len(valid)-2], ErrMalformed},
+		{"Wrong version", corrupt(func(data []byte) { data[0] = (0x02 << 4) | DATA_PACKET }), ErrVersion},
+		{"Bad checksum", corrupt(func(data []byte) { data[len(data)-1] ^= 0xFF }), ErrChecksum},
+	}
+	kinds := []error{ErrMalformed, ErrVersion, ErrChecksum, ErrProtocol}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := DeserializePacket(tc.data)
+			var packetErr *PacketError
+			if !errors.As(err, &packetErr) || packetErr.Kind != tc.kind {
+				t.Fatalf("Expected a PacketError of kind %v, got %v", tc.kind, err)
+			}
+			for _, kind := range kinds {
+				if errors.Is(err, kind) != (kind == tc.kind) {
+					t.Errorf("errors.Is(%v, %v) = %v", err, kind, !(kind == tc.kind))
+				}
+			}
+		})
+	}
+
+	layer := NewReliabilityLayer()
+	err := layer.HandleAck(NewPacket(DATA_PACKET, 0, 1, 0, nil))
+	if !errors.Is(err, ErrProtocol) {
+		t.Errorf("Expected a protocol error for a non-ACK, got %v", err)
+	}
+}
+
+func TestClosedConnectionErrors(t *testing.T) {
+	err := (&Connection{}).Close()
+	if !errors.Is(err, ErrConnClosed) || !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected a closed-connection error, got %v", err)
+	}
+	if reset := closedError("connection reset by server"); !errors.Is(reset, ErrConnClosed) {
+		t.Error("A reset should match ErrConnClosed")
+	}
+}
+
+func TestDrainedSocketIsNotAnError(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+	for i := 0; i < 3; i++ {
+		if _, err := client.Get("/benchmark"); err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+	}
+
+	// Every read drains the socket until it would block, which is how
+	// the loop knows to wait again, not a failure
+	if errs := server.GetStats().Errors; errs != 0 {
+		t.Errorf("Expected no socket errors, got %d", errs)
+	}
+}
@@ -0,0 +1,289 @@
+package ultrafast
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// WSAPoll event flags, and the socket option holding a pending error
+const (
+	wsaPOLLERR    = 0x0001
+	wsaPOLLHUP    = 0x0002
+	wsaPOLLNVAL   = 0x0004
+	wsaPOLLRDNORM = 0x0100
+
+	wsaSO_ERROR = 0x1007
+)
+
+var procWSAPoll = syscall.NewLazyDLL("ws2_32.dll").NewProc("WSAPoll")
+
+// wsaPollFD is WSAPOLLFD
+type wsaPollFD struct {
+	fd      syscall.Handle
+	events  int16
+	revents int16
+}
+
+// EpollEventLoop is the Windows fallback for the epoll event loop. It
+// waits in WSAPoll, which only reports level-triggered readiness: every
+// trigger mode behaves as TRIGGER_LEVEL, which handlers that drain their
+// socket cannot tell apart from edge-triggering. Handlers run on the loop
+// goroutine one at a time, so a one-shot socket is never reported while
+// its handler runs either. Run, AddSocket, RemoveSocket, Submit, Stop and
+// Close behave as on Linux.
+type EpollEventLoop struct {
+	wakeFd    int
+	maxEvents int
+	pollFds   []wsaPollFD
+	running   atomic.Bool
+	closed    atomic.Bool
+
+	handlersMu sync.RWMutex
+	handlers   map[int]EventHandler
+
+	// Held by Run for as long as the loop runs; Close takes it to wait
+	// for the loop to exit before closing the sockets under it
+	runMu sync.Mutex
+
+	// Tasks submitted from other goroutines, run on the loop; wakeFd is a
+	// socket that wakes WSAPoll when the queue becomes non-empty
+	tasksMu sync.Mutex
+	tasks   []func()
+
+	latency loopLatency
+}
+
+// NewEpollEventLoop creates a new WSAPoll-based event loop
+func NewEpollEventLoop(maxEvents int) (*EpollEventLoop, error) {
+	if err := procWSAPoll.Find(); err != nil {
+		return nil, fmt.Errorf("WSAPoll is not available: %v", err)
+	}
+	wakeFd, err := newWakeFD()
+	if err != nil {
+		return nil, err
+	}
+	el := &EpollEventLoop{
+		wakeFd:    wakeFd,
+		maxEvents: maxEvents,
+		handlers:  make(map[int]EventHandler),
+	}
+	el.SetStallThreshold(defaultStallThreshold)
+	return el, nil
+}
+
+// AddSocket adds a socket to the event loop
+func (el *EpollEventLoop) AddSocket(socket *LinuxUDPSocket, handler EventHandler) error {
+	return el.AddSocketMode(socket, handler, TRIGGER_EDGE)
+}
+
+// AddSocketMode adds a socket to the event loop. WSAPoll is always
+// level-triggered, so the mode is only checked.
+func (el *EpollEventLoop) AddSocketMode(socket *LinuxUDPSocket, handler EventHandler, mode TriggerMode) error {
+	if !mode.valid() {
+		return fmt.Errorf("invalid trigger mode: %d", int(mode))
+	}
+	if err := socket.SetNonBlocking(true); err != nil {
+		return fmt.Errorf("failed to set non-blocking: %v", err)
+	}
+	return el.AddFD(socket.GetFD(), handler)
+}
+
+// AddSharedSocket adds a socket that other event loops watch as well.
+// WSAPoll has no exclusive wakeups, so it always reports false, and every
+// loop is woken for each datagram.
+func (el *EpollEventLoop) AddSharedSocket(socket *LinuxUDPSocket, handler EventHandler, mode TriggerMode) (bool, error) {
+	if mode == TRIGGER_ONESHOT {
+		return false, fmt.Errorf("a shared socket cannot be one-shot")
+	}
+	return false, el.AddSocketMode(socket, handler, mode)
+}
+
+// AddFD watches a socket handle for reads
+func (el *EpollEventLoop) AddFD(fd int, handler EventHandler) error {
+	el.handlersMu.Lock()
+	if _, exists := el.handlers[fd]; exists {
+		el.handlersMu.Unlock()
+		return fmt.Errorf("failed to add fd %d: already watched", fd)
+	}
+	el.handlers[fd] = handler
+	el.handlersMu.Unlock()
+
+	// A running WSAPoll only watches the sockets it was given
+	signalWakeFD(el.wakeFd)
+	return nil
+}
+
+// RemoveSocket removes a socket from the event loop
+func (el *EpollEventLoop) RemoveSocket(fd int) error {
+	el.handlersMu.Lock()
+	handler, exists := el.handlers[fd]
+	delete(el.handlers, fd)
+	el.handlersMu.Unlock()
+	if !exists {
+		return fmt.Errorf("failed to remove socket: fd %d is not watched", fd)
+	}
+	handler.OnClose(fd)
+	return nil
+}
+
+// Run starts the event loop (blocking). It returns when Stop is called
+// while it runs, or when the loop is closed; only one Run may be active at
+// a time.
+func (el *EpollEventLoop) Run() error {
+	if !el.runMu.TryLock() {
+		return fmt.Errorf("event loop is already running")
+	}
+	defer el.runMu.Unlock()
+	if el.closed.Load() {
+		return fmt.Errorf("event loop is closed")
+	}
+
+	el.running.Store(true)
+	defer el.running.Store(false)
+
+	for el.running.Load() && !el.closed.Load() {
+		el.pollFds = append(el.pollFds[:0], wsaPollFD{fd: syscall.Handle(el.wakeFd), events: wsaPOLLRDNORM})
+		el.handlersMu.RLock()
+		for fd := range el.handlers {
+			el.pollFds = append(el.pollFds, wsaPollFD{fd: syscall.Handle(fd), events: wsaPOLLRDNORM})
+		}
+		el.handlersMu.RUnlock()
+
+		// Wait for events with 1 second timeout
+		waitStart := time.Now()
+		r1, _, errno := procWSAPoll.Call(uintptr(unsafe.Pointer(&el.pollFds[0])), uintptr(len(el.pollFds)), 1000)
+		if int32(r1) < 0 {
+			return fmt.Errorf("WSAPoll failed: %v", errno)
+		}
+		el.latency.wokeUp(int(r1), time.Since(waitStart))
+
+		for _, pollFd := range el.pollFds {
+			if pollFd.revents == 0 {
+				continue
+			}
+			fd := int(pollFd.fd)
+			if fd == el.wakeFd {
+				el.runTasks()
+				continue
+			}
+
+			el.handlersMu.RLock()
+			handler, exists := el.handlers[fd]
+			el.handlersMu.RUnlock()
+			if !exists {
+				continue
+			}
+
+			if pollFd.revents&wsaPOLLNVAL != 0 {
+				// Closed without being removed; stop polling it
+				el.RemoveSocket(fd)
+				continue
+			}
+			start := time.Now()
+			if pollFd.revents&wsaPOLLRDNORM != 0 {
+				if err := handler.OnRead(fd); err != nil {
+					handler.OnError(fd, err)
+				}
+			}
+			if pollFd.revents&(wsaPOLLERR|wsaPOLLHUP) != 0 {
+				if err := socketError(fd, pollFd.revents); err != nil {
+					handler.OnError(fd, err)
+				}
+			}
+			el.latency.ran(start, fd)
+		}
+	}
+
+	return nil
+}
+
+// Submit queues a task to run on the event loop goroutine and wakes the
+// loop. It is safe to call from any goroutine.
+func (el *EpollEventLoop) Submit(task func()) {
+	el.tasksMu.Lock()
+	el.tasks = append(el.tasks, task)
+	wake := len(el.tasks) == 1
+	el.tasksMu.Unlock()
+
+	if wake {
+		signalWakeFD(el.wakeFd)
+	}
+}
+
+// runTasks clears the wakeup socket and runs every submitted task
+func (el *EpollEventLoop) runTasks() {
+	clearWakeFD(el.wakeFd)
+
+	el.tasksMu.Lock()
+	tasks := el.tasks
+	el.tasks = nil
+	el.tasksMu.Unlock()
+
+	for _, task := range tasks {
+		start := time.Now()
+		task()
+		el.latency.ran(start, -1)
+	}
+}
+
+// Stop makes a running event loop return from Run without waiting for
+// the WSAPoll timeout
+func (el *EpollEventLoop) Stop() {
+	el.running.Store(false)
+	signalWakeFD(el.wakeFd)
+}
+
+// Close stops the event loop, waits for Run to return and releases the
+// wakeup socket. Later calls do nothing; Run fails once closed.
+func (el *EpollEventLoop) Close() error {
+	if el.closed.Swap(true) {
+		return nil
+	}
+	el.Stop()
+	el.runMu.Lock()
+	defer el.runMu.Unlock()
+
+	el.handlersMu.RLock()
+	fds := make([]int, 0, len(el.handlers))
+	for fd := range el.handlers {
+		fds = append(fds, fd)
+	}
+	el.handlersMu.RUnlock()
+	for _, fd := range fds {
+		el.RemoveSocket(fd)
+	}
+
+	return closeWakeFD(el.wakeFd)
+}
+
+// GetStats returns event loop statistics
+func (el *EpollEventLoop) GetStats() EventLoopStats {
+	el.handlersMu.RLock()
+	active := len(el.handlers)
+	el.handlersMu.RUnlock()
+
+	stats := EventLoopStats{
+		ActiveConnections: active,
+		MaxEvents:         el.maxEvents,
+		Running:           el.running.Load(),
+	}
+	el.latency.fill(&stats)
+	return stats
+}
+
+// socketError reads a socket's pending error, returning nil if there is
+// none
+func socketError(fd int, revents int16) error {
+	errno, err := syscall.GetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, wsaSO_ERROR)
+	if err == nil && errno != 0 {
+		return fmt.Errorf("socket error: %v", syscall.Errno(errno))
+	}
+	if revents&wsaPOLLHUP != 0 {
+		return fmt.Errorf("socket hangup")
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const testZone = `
+example.com                   192.0.2.1
+example.com                   2001:db8::1
+www.example.com         60    192.0.2.10   # two A records
+www.example.com         60    192.0.2.11
+www.example.com         60    2001:db8::10
+`
+
+// newTestServer creates a server for zone without running it
+func newTestServer(t *testing.T, zoneText string) *server {
+	t.Helper()
+	z, err := parseZone(strings.NewReader(zoneText))
+	if err != nil {
+		t.Fatalf("Failed to parse zone: %v", err)
+	}
+	s, err := newServer("127.0.0.1:0", z)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	return s
+}
+
+// run serves queries until the test ends
+func run(t *testing.T, s *server) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Run failed: %v", err)
+		}
+	})
+}
+
+// dial connects a client socket to the server
+func dial(t *testing.T, s *server) *net.UDPConn {
+	t.Helper()
+	conn, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*net.UDPConn)
+}
+
+// buildQuery packs a query for one question
+func buildQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type, class dnsmessage.Class) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: class,
+		}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Failed to pack query: %v", err)
+	}
+	return packed
+}
+
+// exchange sends query and parses the response, failing the test if none
+// arrives
+func exchange(t *testing.T, conn *net.UDPConn, query []byte) (dnsmessage.Message, int) {
+	t.Helper()
+	if _, err := conn.Write(query); err != nil {
+		t.Fatalf("Failed to send query: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 2048)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("No response: %v", err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buffer[:n]); err != nil {
+		t.Fatalf("Failed to unpack response: %v", err)
+	}
+	return msg, n
+}
+
+// expectSilence fails the test if a response arrives
+func expectSilence(t *testing.T, conn *net.UDPConn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 2048)); err == nil {
+		t.Fatalf("Expected no response, got %d bytes", n)
+	}
+}
+
+// addresses returns the addresses in a response's answers
+func addresses(msg dnsmessage.Message) []string {
+	var addrs []string
+	for _, answer := range msg.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, net.IP(body.A[:]).String())
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, net.IP(body.AAAA[:]).String())
+		}
+	}
+	return addrs
+}
+
+func TestAnswers(t *testing.T) {
+	s := newTestServer(t, testZone)
+	run(t, s)
+	conn := dial(t, s)
+
+	tests := []struct {
+		name  string
+		qtype dnsmessage.Type
+		class dnsmessage.Class
+		rcode dnsmessage.RCode
+		addrs string
+		ttl   uint32
+	}{
+		{"www.example.com.", dnsmessage.TypeA, dnsmessage.ClassINET, dnsmessage.RCodeSuccess, "192.0.2.10 192.0.2.11", 60},
+		{"www.example.com.", dnsmessage.TypeAAAA, dnsmessage.ClassINET, dnsmessage.RCodeSuccess, "2001:db8::10", 60},
+		{"www.example.com.", dnsmessage.TypeALL, dnsmessage.ClassINET, dnsmessage.RCodeSuccess, "192.0.2.10 192.0.2.11 2001:db8::10", 60},
+		{"Example.COM.", dnsmessage.TypeA, dnsmessage.ClassINET, dnsmessage.RCodeSuccess, "192.0.2.1", defaultTTL},
+		{"example.com.", dnsmessage.TypeMX, dnsmessage.ClassINET, dnsmessage.RCodeSuccess, "", 0},
+		{"missing.example.com.", dnsmessage.TypeA, dnsmessage.ClassINET, dnsmessage.RCodeNameError, "", 0},
+		{"www.example.com.", dnsmessage.TypeA, dnsmessage.ClassCHAOS, dnsmessage.RCodeRefused, "", 0},
+	}
+	for i, tt := range tests {
+		id := uint16(1000 + i)
+		msg, _ := exchange(t, conn, buildQuery(t, id, tt.name, tt.qtype, tt.class))
+		if msg.ID != id || !msg.Response || !msg.RecursionDesired {
+			t.Errorf("%s %v: bad header %+v", tt.name, tt.qtype, msg.Header)
+		}
+		if msg.RCode != tt.rcode {
+			t.Errorf("%s %v: expected %v, got %v", tt.name, tt.qtype, tt.rcode, msg.RCode)
+		}
+		if msg.Authoritative != (tt.rcode != dnsmessage.RCodeRefused) {
+			t.Errorf("%s %v: authoritative flag %v", tt.name, tt.qtype, msg.Authoritative)
+		}
+		if len(msg.Questions) != 1 || msg.Questions[0].Name.String() != tt.name {
+			t.Errorf("%s %v: question not echoed: %v", tt.name, tt.qtype, msg.Questions)
+		}
+		if got := strings.Join(addresses(msg), " "); got != tt.addrs {
+			t.Errorf("%s %v: expected %q, got %q", tt.name, tt.qtype, tt.addrs, got)
+		}
+		for _, answer := range msg.Answers {
+			if answer.Header.TTL != tt.ttl || answer.Header.Name.String() != tt.name {
+				t.Errorf("%s %v: bad answer header %+v", tt.name, tt.qtype, answer.Header)
+			}
+		}
+	}
+	if stats := s.Stats(); stats.Answered != uint64(len(tests)) || stats.NameErrors != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestMalformedQueries(t *testing.T) {
+	s := newTestServer(t, testZone)
+	run(t, s)
+	conn := dial(t, s)
+
+	valid := buildQuery(t, 7, "www.example.com.", dnsmessage.TypeA, dnsmessage.ClassINET)
+
+	// Too short for a header, and a response rather than a query: dropped
+	for _, datagram := range [][]byte{{0, 1, 2}, append([]byte{0, 7, 0x80}, valid[3:]...)} {
+		conn.Write(datagram)
+		expectSilence(t, conn)
+	}
+
+	twoQuestions := append([]byte(nil), valid...)
+	twoQuestions[5] = 2
+	status := append([]byte(nil), valid...)
+	status[2] |= 2 << 3 // opcode STATUS
+	loop := append(append([]byte(nil), valid[:headerSize]...), 0xC0, headerSize, 0, 1, 0, 1)
+	truncated := valid[:len(valid)-3]
+
+	for _, tt := range []struct {
+		name  string
+		query []byte
+		rcode dnsmessage.RCode
+	}{
+		{"two questions", twoQuestions, dnsmessage.RCodeFormatError},
+		{"opcode", status, dnsmessage.RCodeNotImplemented},
+		{"pointer loop", loop, dnsmessage.RCodeFormatError},
+		{"truncated", truncated, dnsmessage.RCodeFormatError},
+	} {
+		msg, _ := exchange(t, conn, tt.query)
+		if msg.ID != 7 || msg.RCode != tt.rcode || len(msg.Answers) != 0 {
+			t.Errorf("%s: expected %v, got %v with %d answers", tt.name, tt.rcode, msg.RCode, len(msg.Answers))
+		}
+	}
+
+	// The server still answers
+	if msg, _ := exchange(t, conn, valid); len(msg.Answers) != 2 {
+		t.Errorf("Expected 2 answers after malformed queries, got %d", len(msg.Answers))
+	}
+	if stats := s.Stats(); stats.Malformed != 2 || stats.Answered != 5 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	var zoneText strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&zoneText, "big.example.com 10.0.0.%d\n", i+1)
+	}
+	s := newTestServer(t, zoneText.String())
+	run(t, s)
+	conn := dial(t, s)
+
+	msg, n := exchange(t, conn, buildQuery(t, 1, "big.example.com.", dnsmessage.TypeA, dnsmessage.ClassINET))
+	if !msg.Truncated {
+		t.Error("Expected the truncated flag")
+	}
+	if n > maxUDPResponse || len(msg.Answers) == 0 || len(msg.Answers) >= 100 {
+		t.Errorf("Expected a partial answer within %d bytes, got %d answers in %d bytes",
+			maxUDPResponse, len(msg.Answers), n)
+	}
+}
+
+// TestBatch queues queries before the loop runs, so its first wakeup
+// drains them all at once
+func TestBatch(t *testing.T) {
+	const queries = 50
+	s := newTestServer(t, testZone)
+	conn := dial(t, s)
+	for i := 0; i < queries; i++ {
+		if _, err := conn.Write(buildQuery(t, uint16(i), "www.example.com.", dnsmessage.TypeA, dnsmessage.ClassINET)); err != nil {
+			t.Fatalf("Failed to send query: %v", err)
+		}
+	}
+	run(t, s)
+
+	seen := make(map[uint16]bool)
+	buffer := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(seen) < queries {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			t.Fatalf("Received %d of %d responses: %v", len(seen), queries, err)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buffer[:n]); err != nil || len(msg.Answers) != 2 {
+			t.Fatalf("Bad response: %v, %+v", err, msg)
+		}
+		seen[msg.ID] = true
+	}
+	if stats := s.Stats(); stats.Batches != 1 || stats.MaxBatch != queries {
+		t.Errorf("Expected one batch of %d, got %+v", queries, stats)
+	}
+}
+
+func TestParseZone(t *testing.T) {
+	z, err := parseZone(strings.NewReader(testZone))
+	if err != nil {
+		t.Fatalf("Failed to parse zone: %v", err)
+	}
+	if len(z) != 2 || len(z["www.example.com"]) != 3 || z["example.com"][0].ttl != defaultTTL {
+		t.Errorf("Unexpected zone: %v", z)
+	}
+
+	for _, text := range []string{
+		"www.example.com",
+		"www.example.com 60 192.0.2.1 extra",
+		"www.example.com soon 192.0.2.1",
+		"www.example.com 192.0.2.300",
+		"www.example.com fe80::1%eth0",
+	} {
+		if _, err := parseZone(strings.NewReader(text)); err == nil {
+			t.Errorf("Expected an error for %q", text)
+		}
+	}
+}
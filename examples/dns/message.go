@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// DNS wire format, RFC 1035 section 4: a 12-byte header, then the
+// question, answer, authority and additional sections. Only what an
+// authoritative A/AAAA responder needs is handled: one question per
+// query, answers pointing back at the question's name.
+
+// headerSize is the length of the fixed DNS header
+const headerSize = 12
+
+// maxUDPResponse is the classic limit on a DNS response over UDP. Larger
+// answers are truncated, telling the client to retry over TCP.
+const maxUDPResponse = 512
+
+// Header flags
+const (
+	FLAG_RESPONSE          = 1 << 15
+	FLAG_AUTHORITATIVE     = 1 << 10
+	FLAG_TRUNCATED         = 1 << 9
+	FLAG_RECURSION_DESIRED = 1 << 8
+)
+
+// Opcodes, in bits 11-14 of the flags
+const (
+	OPCODE_QUERY = 0
+)
+
+// Response codes, in the low 4 bits of the flags
+const (
+	RCODE_SUCCESS         = 0
+	RCODE_FORMAT_ERROR    = 1
+	RCODE_NAME_ERROR      = 3 // NXDOMAIN
+	RCODE_NOT_IMPLEMENTED = 4
+	RCODE_REFUSED         = 5
+)
+
+// Record types and classes
+const (
+	TYPE_A    = 1
+	TYPE_AAAA = 28
+	TYPE_ANY  = 255
+
+	CLASS_IN  = 1
+	CLASS_ANY = 255
+)
+
+// maxNameLength bounds a domain name in presentation form, RFC 1035
+// section 2.3.4
+const maxNameLength = 253
+
+var (
+	errShortMessage = errors.New("message truncated")
+	errBadName      = errors.New("malformed name")
+)
+
+// header is the fixed part of a message
+type header struct {
+	id      uint16
+	flags   uint16
+	qdcount uint16
+	ancount uint16
+	nscount uint16
+	arcount uint16
+}
+
+// parseHeader reads the header at the start of msg
+func parseHeader(msg []byte) (header, error) {
+	if len(msg) < headerSize {
+		return header{}, errShortMessage
+	}
+	return header{
+		id:      binary.BigEndian.Uint16(msg[0:]),
+		flags:   binary.BigEndian.Uint16(msg[2:]),
+		qdcount: binary.BigEndian.Uint16(msg[4:]),
+		ancount: binary.BigEndian.Uint16(msg[6:]),
+		nscount: binary.BigEndian.Uint16(msg[8:]),
+		arcount: binary.BigEndian.Uint16(msg[10:]),
+	}, nil
+}
+
+// opcode returns the header's opcode
+func (h header) opcode() int {
+	return int(h.flags>>11) & 0xF
+}
+
+// putHeader writes h at the start of dst
+func putHeader(dst []byte, h header) {
+	binary.BigEndian.PutUint16(dst[0:], h.id)
+	binary.BigEndian.PutUint16(dst[2:], h.flags)
+	binary.BigEndian.PutUint16(dst[4:], h.qdcount)
+	binary.BigEndian.PutUint16(dst[6:], h.ancount)
+	binary.BigEndian.PutUint16(dst[8:], h.nscount)
+	binary.BigEndian.PutUint16(dst[10:], h.arcount)
+}
+
+// question is a parsed question section entry
+type question struct {
+	name   []byte // lower case, dot separated, no trailing dot; "" for the root
+	qtype  uint16
+	qclass uint16
+	end    int // offset in the message just past the question
+}
+
+// parseQuestion reads the question starting at offset, decoding its
+// name into scratch so no memory is allocated. Compression pointers are
+// followed, though queries seldom use them.
+func parseQuestion(msg []byte, offset int, scratch *[maxNameLength]byte) (question, error) {
+	name, end, err := readName(msg, offset, scratch)
+	if err != nil {
+		return question{}, err
+	}
+	if end+4 > len(msg) {
+		return question{}, errShortMessage
+	}
+	return question{
+		name:   name,
+		qtype:  binary.BigEndian.Uint16(msg[end:]),
+		qclass: binary.BigEndian.Uint16(msg[end+2:]),
+		end:    end + 4,
+	}, nil
+}
+
+// readName decodes the name at offset into scratch, lower-casing it. It
+// returns the name and the offset just past it where it started, which
+// is before any compression pointer's target.
+func readName(msg []byte, offset int, scratch *[maxNameLength]byte) ([]byte, int, error) {
+	n, end := 0, -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return nil, 0, errShortMessage
+		}
+		length := int(msg[offset])
+		switch length & 0xC0 {
+		case 0x00:
+		case 0xC0:
+			if offset+1 >= len(msg) {
+				return nil, 0, errShortMessage
+			}
+			// A pointer may only point backwards, and a name cannot
+			// hold more pointers than it has room for labels
+			target := int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+			if jumps++; target >= offset || jumps > maxNameLength/2 {
+				return nil, 0, errBadName
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = target
+			continue
+		default:
+			return nil, 0, errBadName
+		}
+
+		offset++
+		if length == 0 {
+			break
+		}
+		if offset+length > len(msg) {
+			return nil, 0, errShortMessage
+		}
+		if n > 0 {
+			if n >= maxNameLength {
+				return nil, 0, errBadName
+			}
+			scratch[n] = '.'
+			n++
+		}
+		if n+length > maxNameLength {
+			return nil, 0, errBadName
+		}
+		for _, c := range msg[offset : offset+length] {
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			scratch[n] = c
+			n++
+		}
+		offset += length
+	}
+	if end < 0 {
+		end = offset
+	}
+	return scratch[:n], end, nil
+}
+
+// appendAnswer appends a resource record for the question's name, which
+// starts right after the header, holding data
+func appendAnswer(dst []byte, rtype uint16, ttl uint32, data []byte) []byte {
+	dst = binary.BigEndian.AppendUint16(dst, 0xC000|headerSize)
+	dst = binary.BigEndian.AppendUint16(dst, rtype)
+	dst = binary.BigEndian.AppendUint16(dst, CLASS_IN)
+	dst = binary.BigEndian.AppendUint32(dst, ttl)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(data)))
+	return append(dst, data...)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	ultrafast "claude-go-http"
+)
+
+// responseOffset is where responses are built in the socket's mmap
+// buffer, past the largest datagram a query can be received into
+const responseOffset = 64 * 1024
+
+// stats counts what the server has done
+type stats struct {
+	Queries    uint64 // datagrams received
+	Answered   uint64 // responses sent, errors included
+	NameErrors uint64 // NXDOMAIN responses
+	Malformed  uint64 // datagrams dropped without a response
+	SendErrors uint64 // responses the socket refused
+	Batches    uint64 // wakeups that found queries waiting
+	MaxBatch   uint64 // most queries drained in one wakeup
+}
+
+// server answers queries from a zone on one socket, driven by an
+// edge-triggered event loop. Each wakeup drains every waiting datagram in
+// one batch; queries are received into the socket's mmap buffer, parsed
+// where they land, and answered from a response built in the same buffer.
+// Responses are sent with an ordinary copying send, which is cheaper than
+// MSG_ZEROCOPY for datagrams this small and leaves the buffer free to
+// build the next one at once.
+type server struct {
+	socket *ultrafast.ZeroCopySocket
+	loop   *ultrafast.EpollEventLoop
+	zone   zone
+
+	// Used only on the loop goroutine
+	scratch  [maxNameLength]byte
+	response []byte // maxUDPResponse bytes of the mmap buffer
+
+	queries    uint64 // atomic
+	answered   uint64 // atomic
+	nameErrors uint64 // atomic
+	malformed  uint64 // atomic
+	sendErrors uint64 // atomic
+	batches    uint64 // atomic
+	maxBatch   uint64 // atomic
+}
+
+// newServer binds a socket to the "ip:port" address listen and registers
+// it with a new event loop. Run serves queries.
+func newServer(listen string, z zone) (*server, error) {
+	addr, err := ultrafast.ParseSocketAddr(listen)
+	if err != nil {
+		return nil, err
+	}
+	socket, err := ultrafast.NewZeroCopySocket()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket: %v", err)
+	}
+	if err := socket.Bind(addr.IP, addr.Port); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	loop, err := ultrafast.NewEpollEventLoop(64)
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+
+	buffer := socket.GetMmapBuffer()
+	s := &server{
+		socket:   socket,
+		loop:     loop,
+		zone:     z,
+		response: buffer[responseOffset : responseOffset : responseOffset+maxUDPResponse],
+	}
+	if err := loop.AddSocket(socket.LinuxUDPSocket, s); err != nil {
+		loop.Close()
+		socket.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Addr returns the address the server answers on
+func (s *server) Addr() ultrafast.SocketAddr {
+	return s.socket.GetLocalAddr()
+}
+
+// Run serves queries until Close
+func (s *server) Run() error {
+	return s.loop.Run()
+}
+
+// Close stops the event loop, waiting for Run to return, and closes the
+// socket
+func (s *server) Close() error {
+	s.loop.Close()
+	return s.socket.Close()
+}
+
+// Stats returns the server's counters
+func (s *server) Stats() stats {
+	return stats{
+		Queries:    atomic.LoadUint64(&s.queries),
+		Answered:   atomic.LoadUint64(&s.answered),
+		NameErrors: atomic.LoadUint64(&s.nameErrors),
+		Malformed:  atomic.LoadUint64(&s.malformed),
+		SendErrors: atomic.LoadUint64(&s.sendErrors),
+		Batches:    atomic.LoadUint64(&s.batches),
+		MaxBatch:   atomic.LoadUint64(&s.maxBatch),
+	}
+}
+
+// OnRead answers every query waiting on the socket
+func (s *server) OnRead(fd int) error {
+	batch := uint64(0)
+	defer func() { s.recordBatch(batch) }()
+	for {
+		query, from, err := s.socket.RecvMmapped()
+		if err != nil {
+			if errors.Is(err, ultrafast.ErrWouldBlock) {
+				return nil
+			}
+			return err
+		}
+		batch++
+		atomic.AddUint64(&s.queries, 1)
+
+		response := s.answer(s.response, query)
+		if response == nil {
+			atomic.AddUint64(&s.malformed, 1)
+			continue
+		}
+		if _, err := s.socket.SendTo(response, from.IP, from.Port); err != nil {
+			atomic.AddUint64(&s.sendErrors, 1)
+			continue
+		}
+		atomic.AddUint64(&s.answered, 1)
+	}
+}
+
+// recordBatch counts a wakeup that drained batch queries
+func (s *server) recordBatch(batch uint64) {
+	if batch == 0 {
+		return
+	}
+	atomic.AddUint64(&s.batches, 1)
+	for {
+		largest := atomic.LoadUint64(&s.maxBatch)
+		if batch <= largest || atomic.CompareAndSwapUint64(&s.maxBatch, largest, batch) {
+			return
+		}
+	}
+}
+
+// OnWrite is unused: responses are sent as queries are read
+func (s *server) OnWrite(fd int) error {
+	return nil
+}
+
+// OnError drops a failed read; the next wakeup reads again
+func (s *server) OnError(fd int, err error) {}
+
+// OnClose has nothing to release: Close closes the socket
+func (s *server) OnClose(fd int) {}
+
+// answer builds the response to query in dst, which has room for
+// maxUDPResponse bytes. It returns nil for a datagram that gets no
+// response: one too short to hold a header, or itself a response.
+func (s *server) answer(dst, query []byte) []byte {
+	request, err := parseHeader(query)
+	if err != nil || request.flags&FLAG_RESPONSE != 0 {
+		return nil
+	}
+	reply := header{
+		id:    request.id,
+		flags: FLAG_RESPONSE | request.flags&(0xF<<11|FLAG_RECURSION_DESIRED),
+	}
+	dst = dst[:headerSize]
+	if request.opcode() != OPCODE_QUERY {
+		return finish(dst, reply, RCODE_NOT_IMPLEMENTED)
+	}
+	if request.qdcount != 1 {
+		return finish(dst, reply, RCODE_FORMAT_ERROR)
+	}
+	q, err := parseQuestion(query, headerSize, &s.scratch)
+	if err != nil {
+		return finish(dst, reply, RCODE_FORMAT_ERROR)
+	}
+
+	// The question goes back as it came, keeping the case of its name
+	dst = append(dst, query[headerSize:q.end]...)
+	reply.qdcount = 1
+	if q.qclass != CLASS_IN && q.qclass != CLASS_ANY {
+		return finish(dst, reply, RCODE_REFUSED)
+	}
+	reply.flags |= FLAG_AUTHORITATIVE
+	records, exists := s.zone[string(q.name)]
+	if !exists {
+		atomic.AddUint64(&s.nameErrors, 1)
+		return finish(dst, reply, RCODE_NAME_ERROR)
+	}
+
+	for _, r := range records {
+		rtype, data := uint16(TYPE_AAAA), r.addr.As16()
+		size := 16
+		if r.addr.Is4() {
+			v4 := r.addr.As4()
+			rtype, size = TYPE_A, copy(data[:], v4[:])
+		}
+		if q.qtype != rtype && q.qtype != TYPE_ANY {
+			continue
+		}
+		// Name pointer, type, class, ttl and length come first
+		if len(dst)+12+size > maxUDPResponse {
+			reply.flags |= FLAG_TRUNCATED
+			break
+		}
+		dst = appendAnswer(dst, rtype, r.ttl, data[:size])
+		reply.ancount++
+	}
+	return finish(dst, reply, RCODE_SUCCESS)
+}
+
+// finish writes the header, with rcode, in front of a response
+func finish(dst []byte, reply header, rcode uint16) []byte {
+	reply.flags |= rcode
+	putHeader(dst, reply)
+	return dst
+}
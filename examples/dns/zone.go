@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// defaultTTL is the TTL of records that do not give one, in seconds
+const defaultTTL = 300
+
+// record is one address a name resolves to
+type record struct {
+	addr netip.Addr
+	ttl  uint32
+}
+
+// zone maps lower-case names, without the trailing dot, to their
+// addresses
+type zone map[string][]record
+
+// parseZone reads a zone: one record per line, as "name [ttl] address",
+// with blank lines and text after # ignored. The address decides whether
+// the record is A or AAAA.
+//
+//	www.example.com       192.0.2.10
+//	www.example.com  60   2001:db8::10
+func parseZone(r io.Reader) (zone, error) {
+	z := make(zone)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected name, optional ttl and address", line)
+		}
+
+		name := strings.ToLower(strings.TrimSuffix(fields[0], "."))
+		if len(name) > maxNameLength {
+			return nil, fmt.Errorf("line %d: name %q too long", line, fields[0])
+		}
+		ttl := uint64(defaultTTL)
+		if len(fields) == 3 {
+			var err error
+			if ttl, err = strconv.ParseUint(fields[1], 10, 31); err != nil {
+				return nil, fmt.Errorf("line %d: invalid ttl %q", line, fields[1])
+			}
+		}
+		addr, err := netip.ParseAddr(fields[len(fields)-1])
+		if err != nil || addr.Zone() != "" {
+			return nil, fmt.Errorf("line %d: invalid address %q", line, fields[len(fields)-1])
+		}
+		z[name] = append(z[name], record{addr: addr.Unmap(), ttl: uint32(ttl)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
@@ -0,0 +1,79 @@
+// Command grpc runs a gRPC service over the reliable UDP transport. The
+// transport only supplies the net.Listener and the dialer; the service,
+// stubs and client are standard gRPC:
+//
+//	go run ./examples/grpc -listen 127.0.0.1:9000
+//	go run ./examples/grpc -dial 127.0.0.1:9000
+//
+// The service is gRPC's health checking service, which needs no generated
+// code of its own.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"time"
+
+	ultrafast "claude-go-http"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func main() {
+	listen := flag.String("listen", "", "`ip:port` to serve gRPC on")
+	dial := flag.String("dial", "", "`ip:port` of a server to check")
+	flag.Parse()
+
+	switch {
+	case *listen != "":
+		server, err := ultrafast.New(*listen)
+		if err != nil {
+			log.Fatalf("Failed to create server: %v", err)
+		}
+		go server.Start(context.Background())
+		log.Printf("Serving gRPC on %s", server.Addr())
+		if err := serve(server.Engine().ListenStreams()); err != nil {
+			log.Fatalf("gRPC server error: %v", err)
+		}
+	case *dial != "":
+		conn, err := dialGRPC(*dial)
+		if err != nil {
+			log.Fatalf("Failed to dial: %v", err)
+		}
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		response, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			log.Fatalf("Check failed: %v", err)
+		}
+		log.Printf("Server is %v", response.Status)
+	default:
+		flag.Usage()
+	}
+}
+
+// newGRPCServer creates a gRPC server offering the health service
+func newGRPCServer() (*grpc.Server, *health.Server) {
+	server := grpc.NewServer()
+	status := health.NewServer()
+	healthpb.RegisterHealthServer(server, status)
+	return server, status
+}
+
+// serve runs the service on listener until it is closed
+func serve(listener net.Listener) error {
+	server, _ := newGRPCServer()
+	return server.Serve(listener)
+}
+
+// dialGRPC connects a gRPC client over the reliable transport
+func dialGRPC(addr string) (*grpc.ClientConn, error) {
+	return grpc.NewClient("passthrough:///"+addr,
+		grpc.WithContextDialer(ultrafast.DialStreamContext),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	ultrafast "claude-go-http"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// transport runs the same gRPC service over one kind of connection
+type transport struct {
+	name  string
+	start func(t *testing.T, server *grpc.Server) string // serves, returning the address
+	dial  func(addr string) (*grpc.ClientConn, error)
+}
+
+var transports = []transport{
+	{
+		name: "tcp",
+		start: func(t *testing.T, server *grpc.Server) string {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go server.Serve(listener)
+			return listener.Addr().String()
+		},
+		dial: func(addr string) (*grpc.ClientConn, error) {
+			return grpc.NewClient("passthrough:///"+addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		},
+	},
+	{
+		name: "udp",
+		start: func(t *testing.T, server *grpc.Server) string {
+			udp, err := ultrafast.New("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- udp.Start(ctx) }()
+			go server.Serve(udp.Engine().ListenStreams())
+			t.Cleanup(func() {
+				// gRPC first, so nothing writes to a closed socket
+				server.Stop()
+				cancel()
+				<-done
+			})
+			return udp.Addr().String()
+		},
+		dial: dialGRPC,
+	},
+}
+
+// startHealth serves the health service over a transport and connects a
+// client to it
+func startHealth(t *testing.T, tr transport) (*health.Server, healthpb.HealthClient) {
+	t.Helper()
+	server, status := newGRPCServer()
+	t.Cleanup(server.Stop)
+	conn, err := tr.dial(tr.start(t, server))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return status, healthpb.NewHealthClient(conn)
+}
+
+// checkOutcome is what a Check returned, comparable across transports
+type checkOutcome struct {
+	status healthpb.HealthCheckResponse_ServingStatus
+	code   codes.Code
+}
+
+func check(client healthpb.HealthClient, service string) checkOutcome {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	response, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return checkOutcome{code: status.Code(err)}
+	}
+	return checkOutcome{status: response.Status}
+}
+
+func TestUnaryInterop(t *testing.T) {
+	results := make(map[string][]checkOutcome)
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			status, client := startHealth(t, tr)
+			status.SetServingStatus("orders", healthpb.HealthCheckResponse_NOT_SERVING)
+			outcomes := []checkOutcome{check(client, ""), check(client, "orders"), check(client, "missing")}
+			if outcomes[0].status != healthpb.HealthCheckResponse_SERVING || outcomes[2].code != codes.NotFound {
+				t.Errorf("Unexpected outcomes %+v", outcomes)
+			}
+			results[tr.name] = outcomes
+		})
+	}
+	for i, outcome := range results["udp"] {
+		if tcp := results["tcp"]; i < len(tcp) && tcp[i] != outcome {
+			t.Errorf("Check %d: tcp %+v, udp %+v", i, tcp[i], outcome)
+		}
+	}
+}
+
+func TestStreamingInterop(t *testing.T) {
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			status, client := startHealth(t, tr)
+			status.SetServingStatus("orders", healthpb.HealthCheckResponse_SERVING)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			watch, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "orders"})
+			if err != nil {
+				t.Fatalf("Watch failed: %v", err)
+			}
+			first, err := watch.Recv()
+			if err != nil || first.Status != healthpb.HealthCheckResponse_SERVING {
+				t.Fatalf("Expected SERVING first, got %v, %v", first, err)
+			}
+			status.SetServingStatus("orders", healthpb.HealthCheckResponse_NOT_SERVING)
+			second, err := watch.Recv()
+			if err != nil || second.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+				t.Fatalf("Expected NOT_SERVING after the change, got %v, %v", second, err)
+			}
+		})
+	}
+}
+
+func TestDeadlineInterop(t *testing.T) {
+	for _, tr := range transports {
+		t.Run(tr.name, func(t *testing.T) {
+			_, client := startHealth(t, tr)
+			check(client, "") // connect first, so the deadline only covers the call
+
+			ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+			defer cancel()
+			_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+			if code := status.Code(err); code != codes.DeadlineExceeded {
+				t.Errorf("Expected DeadlineExceeded, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConcurrentCallsOverUDP(t *testing.T) {
+	_, client := startHealth(t, transports[1])
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if outcome := check(client, ""); outcome.status != healthpb.HealthCheckResponse_SERVING {
+				t.Errorf("Unexpected outcome %+v", outcome)
+			}
+		}()
+	}
+	wg.Wait()
+}
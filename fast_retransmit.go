@@ -0,0 +1,207 @@
+package ultrafast
+
+import (
+	"sync/atomic"
+)
+
+// dupAckThreshold is how many duplicate ACKs signal a lost packet, as in
+// TCP (RFC 5681)
+const dupAckThreshold = 3
+
+// AckResult describes what an ACK did to a connection's reliability layer
+type AckResult struct {
+	Matched    bool    // the ACK acknowledged a packet in flight
+	Retransmit *Packet // lost packet to resend now, nil if none
+}
+
+// ProcessAck handles an ACK like HandleAck, and also runs fast retransmit
+// and fast recovery (RFC 5681 3.2). An ACK that leaves the oldest packet
+// in flight unacknowledged while acknowledging later ones, in its SACK
+// blocks, plays the part of TCP's duplicate ACK: it shows later packets
+// got through while that one did not. On the third,
+// the missing packet is returned for immediate retransmission and the
+// layer enters fast recovery: the congestion window is halved and then
+// inflated by one for each further duplicate, until the retransmitted
+// packet is acknowledged and the window deflates to the halved value.
+//
+// The oldest packet in flight is only meaningful for a single peer's
+// sequence space, so ProcessAck is for connection layers; ACKs from
+// peers sharing the connectionless layer go to HandleAck. Sequence
+// numbers must be sent in order on one goroutine, as the event loop does.
+func (rf *LockFreeReliabilityLayer) ProcessAck(ackPacket *Packet) AckResult {
+	return rf.processAck(ackPacket, nil)
+}
+
+// processAck is ProcessAck calling each, if set, with the sequence number
+// of every packet the ACK acknowledged
+func (rf *LockFreeReliabilityLayer) processAck(ackPacket *Packet, each func(seqNum uint32)) AckResult {
+	if !ackPacket.HasAck() {
+		return AckResult{}
+	}
+
+	guard := rf.entries.Pin()
+	defer guard.Unpin()
+	acked := ackedPackets{each: each}
+	if !rf.removeAcked(ackPacket, &acked, guard) {
+		return AckResult{} // an old or repeated ACK says nothing new
+	}
+	una := rf.advanceUna()
+
+	if atomic.LoadUint32(&rf.inRecovery) == 1 {
+		if int32(una-atomic.LoadUint32(&rf.recoverSeq)) > 0 {
+			rf.exitRecovery(true)
+		} else {
+			rf.inflateWindow()
+		}
+		return AckResult{Matched: true}
+	}
+
+	if int32(una-acked.newest) > 0 {
+		// Nothing older is missing
+		atomic.StoreUint32(&rf.dupAcks, 0)
+		for i := acked.count - acked.appLimited; i > 0; i-- {
+			rf.updateCongestionWindow(true)
+		}
+		return AckResult{Matched: true}
+	}
+	if atomic.AddUint32(&rf.dupAcks, 1) != dupAckThreshold {
+		return AckResult{Matched: true}
+	}
+
+	entry := rf.lookup(una)
+	if entry == nil {
+		return AckResult{Matched: true} // acked meanwhile
+	}
+	atomic.AddUint32(&entry.RetryCount, 1) // its ACK is ambiguous now
+	atomic.StoreUint64(&entry.SendTime, uint64(clockNow().UnixNano()))
+	atomic.AddUint64(&rf.packetsRetr, 1)
+	atomic.AddUint64(&rf.fastRetr, 1)
+	rf.enterRecovery(una)
+	return AckResult{Matched: true, Retransmit: entry.Packet}
+}
+
+// advanceUna moves sndUna past sequence numbers sent and resolved:
+// acknowledged, given up on, or never tracked such as those of SYN-ACKs
+// and FINs. A number handed out by GetNextSeqNum but not yet sent holds
+// it back, as its packet is still to be tracked. It returns the oldest
+// sequence number still in flight, or the next one to be sent if none
+// is. Sequence numbers wrap, so they compare in serial arithmetic.
+func (rf *LockFreeReliabilityLayer) advanceUna() uint32 {
+	for {
+		una := atomic.LoadUint32(&rf.sndUna)
+		if int32(una-atomic.LoadUint32(&rf.sentNext)) >= 0 || rf.lookup(una) != nil || !rf.isResolved(una) {
+			return una
+		}
+		if atomic.CompareAndSwapUint32(&rf.sndUna, una, una+1) {
+			atomic.StoreUint32(&rf.dupAcks, 0) // a new oldest packet
+		}
+	}
+}
+
+// resolve records that no ACK is awaited for seqNum any longer
+func (rf *LockFreeReliabilityLayer) resolve(seqNum uint32) {
+	atomic.StoreUint64(&rf.resolved[seqNum%uint32(len(rf.resolved))], 1<<32|uint64(seqNum))
+}
+
+// isResolved reports whether seqNum was resolved. Its slot taken by a
+// later number counts too: far fewer than the table holds are in flight.
+func (rf *LockFreeReliabilityLayer) isResolved(seqNum uint32) bool {
+	mark := atomic.LoadUint64(&rf.resolved[seqNum%uint32(len(rf.resolved))])
+	return mark != 0 && int32(uint32(mark)-seqNum) >= 0
+}
+
+// nextUntrackedSeqNum takes the next sequence number for a packet never
+// tracked for retransmission, a SYN-ACK or FIN, so sndUna moves past it
+func (rf *LockFreeReliabilityLayer) nextUntrackedSeqNum() uint32 {
+	seqNum := rf.GetNextSeqNum()
+	rf.resolve(seqNum)
+	return seqNum
+}
+
+// markSent moves sentNext past a DATA packet sent, whose sequence number
+// the caller may have chosen rather than taken from GetNextSeqNum
+func (rf *LockFreeReliabilityLayer) markSent(seqNum uint32) {
+	for {
+		sent := atomic.LoadUint32(&rf.sentNext)
+		if int32(seqNum+1-sent) <= 0 || atomic.CompareAndSwapUint32(&rf.sentNext, sent, seqNum+1) {
+			return
+		}
+	}
+}
+
+// sendNext is the sequence number after every one sent so far
+func (rf *LockFreeReliabilityLayer) sendNext() uint32 {
+	next := uint32(atomic.LoadUint64(&rf.nextSeqNum))
+	if sent := atomic.LoadUint32(&rf.sentNext); int32(sent-next) > 0 {
+		return sent
+	}
+	return next
+}
+
+// startAt numbers the layer's packets from seqNum on, continuing a
+// sequence space the connection already used. It must be called before
+// the layer sends anything.
+func (rf *LockFreeReliabilityLayer) startAt(seqNum uint32) {
+	atomic.StoreUint64(&rf.nextSeqNum, uint64(seqNum))
+	atomic.StoreUint32(&rf.sndUna, seqNum)
+	atomic.StoreUint32(&rf.sentNext, seqNum)
+}
+
+// outstanding returns how many sequence numbers from the oldest that may
+// be unacknowledged have been handed out
+func (rf *LockFreeReliabilityLayer) outstanding() int {
+	return int(uint32(atomic.LoadUint64(&rf.nextSeqNum)) - atomic.LoadUint32(&rf.sndUna))
+}
+
+// lookup returns the in-flight entry for a sequence number, or nil. The
+// caller must be pinned.
+func (rf *LockFreeReliabilityLayer) lookup(seqNum uint32) *UnackedEntry {
+	entry := (*UnackedEntry)(rf.unackedTable.Get(uint64(seqNum)))
+	if entry == nil || entry.Packet.SeqNum != seqNum {
+		return nil
+	}
+	return entry
+}
+
+// enterRecovery halves the congestion window, remembering the halved
+// value as ssthresh, and inflates it by the three duplicate ACKs that
+// left the network
+func (rf *LockFreeReliabilityLayer) enterRecovery(lost uint32) {
+	atomic.StoreUint32(&rf.recoverSeq, lost)
+	atomic.StoreUint32(&rf.inRecovery, 1)
+	if rf.GetCongestionAlgorithm() == CC_FIXED {
+		return
+	}
+
+	ssthresh := max(atomic.LoadUint32(&rf.congWindow)/2, 2)
+	atomic.StoreUint32(&rf.ssthresh, ssthresh)
+	atomic.StoreUint32(&rf.congWindow, min(ssthresh+dupAckThreshold, atomic.LoadUint32(&rf.windowSize)))
+}
+
+// inflateWindow grows the window by one packet for each duplicate ACK
+// during recovery, since each means a packet has left the network
+func (rf *LockFreeReliabilityLayer) inflateWindow() {
+	if rf.GetCongestionAlgorithm() == CC_FIXED {
+		return
+	}
+	for {
+		oldWindow := atomic.LoadUint32(&rf.congWindow)
+		newWindow := min(oldWindow+1, atomic.LoadUint32(&rf.windowSize))
+		if atomic.CompareAndSwapUint32(&rf.congWindow, oldWindow, newWindow) {
+			return
+		}
+	}
+}
+
+// exitRecovery leaves fast recovery. When the lost packet was
+// acknowledged the window deflates to ssthresh; after a timeout the
+// timeout's own reduction stands.
+func (rf *LockFreeReliabilityLayer) exitRecovery(deflate bool) {
+	if !atomic.CompareAndSwapUint32(&rf.inRecovery, 1, 0) {
+		return
+	}
+	atomic.StoreUint32(&rf.dupAcks, 0)
+	if deflate && rf.GetCongestionAlgorithm() != CC_FIXED {
+		atomic.StoreUint32(&rf.congWindow, atomic.LoadUint32(&rf.ssthresh))
+	}
+}
@@ -0,0 +1,140 @@
+package ultrafast
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// newFastRetransmitLayer creates a connection layer with n DATA packets in
+// flight and the congestion window at cwnd
+func newFastRetransmitLayer(n int, cwnd uint32) *LockFreeReliabilityLayer {
+	rel := newConnectionReliabilityLayer(NewEpochDomain(releaseUnackedEntry), NewEpochDomain(releaseQueueNode))
+	for i := 0; i < n; i++ {
+		rel.SendPacket(NewPacket(DATA_PACKET, 0, rel.GetNextSeqNum(), 0, nil))
+	}
+	atomic.StoreUint32(&rel.congWindow, cwnd)
+	return rel
+}
+
+func TestFastRetransmitAndRecovery(t *testing.T) {
+	rel := newFastRetransmitLayer(6, 8)
+	ack := func(ackNum uint32, blocks ...SACKBlock) AckResult {
+		t.Helper()
+		result := rel.ProcessAck(sackPacket(ackNum, blocks...))
+		if !result.Matched {
+			t.Fatalf("ACK up to %d with %v was not matched", ackNum, blocks)
+		}
+		return result
+	}
+
+	// Packet 1 is lost; ACKs selecting 2 and 3 stay below the threshold
+	for _, seq := range []uint32{2, 3} {
+		if result := ack(1, SACKBlock{Start: 2, End: seq + 1}); result.Retransmit != nil {
+			t.Fatalf("ACK for %d retransmitted before the threshold", seq)
+		}
+	}
+	if cwnd := rel.GetStats().CongestionWindow; cwnd != 8 {
+		t.Errorf("Duplicate ACKs should not grow the window, got %d", cwnd)
+	}
+
+	result := ack(1, SACKBlock{Start: 2, End: 5})
+	if result.Retransmit == nil || result.Retransmit.SeqNum != 1 {
+		t.Fatalf("Third duplicate ACK should retransmit packet 1, got %+v", result.Retransmit)
+	}
+	stats := rel.GetStats()
+	if stats.CongestionWindow != 7 {
+		t.Errorf("Expected cwnd halved to 4 and inflated by 3, got %d", stats.CongestionWindow)
+	}
+	if stats.FastRetransmits != 1 || stats.PacketsRetransmitted != 1 {
+		t.Errorf("Expected 1 fast retransmit, got %+v", stats)
+	}
+
+	// Further duplicates inflate the window and retransmit nothing
+	if result := ack(1, SACKBlock{Start: 2, End: 6}); result.Retransmit != nil {
+		t.Error("Only the third duplicate ACK should retransmit")
+	}
+	if cwnd := rel.GetStats().CongestionWindow; cwnd != 8 {
+		t.Errorf("Expected cwnd inflated to 8, got %d", cwnd)
+	}
+
+	// The retransmission's ACK ends recovery and deflates to ssthresh
+	before := atomic.LoadUint64(&rel.rttState)
+	ack(6)
+	if cwnd := rel.GetStats().CongestionWindow; cwnd != 4 {
+		t.Errorf("Expected cwnd deflated to 4, got %d", cwnd)
+	}
+	if atomic.LoadUint64(&rel.rttState) != before {
+		t.Error("ACK of the retransmitted packet should give no RTT sample")
+	}
+
+	ack(7)
+	if cwnd := rel.GetStats().CongestionWindow; cwnd != 5 {
+		t.Errorf("Expected normal growth after recovery, got %d", cwnd)
+	}
+}
+
+func TestFastRetransmitIgnoresOrderlyAcks(t *testing.T) {
+	rel := newFastRetransmitLayer(3, 4)
+
+	// A FIN takes a sequence number without being tracked
+	rel.GetNextSeqNum()
+	for i := 0; i < 3; i++ {
+		rel.SendPacket(NewPacket(DATA_PACKET, 0, rel.GetNextSeqNum(), 0, nil))
+	}
+
+	for _, seq := range []uint32{1, 2, 3, 5, 6, 7} {
+		if result := rel.ProcessAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, seq+1, nil)); result.Retransmit != nil {
+			t.Fatalf("In-order ACK for %d triggered a retransmit", seq)
+		}
+	}
+
+	// Repeated ACKs for packets already acknowledged say nothing new
+	for i := 0; i < dupAckThreshold; i++ {
+		if result := rel.ProcessAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, 8, nil)); result.Matched || result.Retransmit != nil {
+			t.Fatal("Repeated ACK should be ignored")
+		}
+	}
+	if stats := rel.GetStats(); stats.FastRetransmits != 0 {
+		t.Errorf("Expected no fast retransmits, got %d", stats.FastRetransmits)
+	}
+}
+
+func TestFastRetransmitTimeoutEndsRecovery(t *testing.T) {
+	rel := newFastRetransmitLayer(5, 8)
+	for _, seq := range []uint32{2, 3, 4} {
+		rel.ProcessAck(sackPacket(1, SACKBlock{Start: 2, End: seq + 1}))
+	}
+	if atomic.LoadUint32(&rel.inRecovery) != 1 {
+		t.Fatal("Expected fast recovery")
+	}
+
+	atomic.StoreUint64(&rel.timeoutBase, 0)
+	rel.GetTimedOutPackets()
+	if atomic.LoadUint32(&rel.inRecovery) != 0 {
+		t.Error("A retransmission timeout should end fast recovery")
+	}
+}
+
+func TestAdvanceUnaWaitsForUnsentNumbers(t *testing.T) {
+	rel := newFastRetransmitLayer(0, 4)
+	fin := rel.nextUntrackedSeqNum()
+	first, second := rel.GetNextSeqNum(), rel.GetNextSeqNum()
+
+	// The second packet leaves first; its ACK must not move sndUna past
+	// the first, taken but not yet sent
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, second, 0, nil))
+	if result := rel.ProcessAck(sackPacket(fin, SACKBlock{Start: second, End: second + 1})); !result.Matched {
+		t.Fatalf("ACK for %d was not matched", second)
+	}
+	if una := rel.advanceUna(); una != first {
+		t.Fatalf("Expected sndUna held at %d, got %d", first, una)
+	}
+
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, first, 0, nil))
+	if result := rel.ProcessAck(sackPacket(first + 1)); !result.Matched {
+		t.Fatalf("ACK for %d was not matched", first)
+	}
+	if una := rel.advanceUna(); una != second+1 {
+		t.Errorf("Expected sndUna past both packets at %d, got %d", second+1, una)
+	}
+}
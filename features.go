@@ -0,0 +1,28 @@
+package ultrafast
+
+import "runtime"
+
+// Features reports which of the platform-specific fast paths are active
+// where the server runs. On Linux all of them can be; the Windows build
+// falls back to portable code for the rest, so the packet, reliability
+// and HTTP layers work unchanged.
+type Features struct {
+	Platform         string // runtime.GOOS
+	EventLoop        string // "epoll", or "wsapoll" on Windows
+	EdgeTriggered    bool   // the event loop honors TRIGGER_EDGE and TRIGGER_ONESHOT
+	ExclusiveWakeups bool   // AddSharedSocket wakes one idle loop per datagram
+	ZeroCopy         bool   // ZeroCopySocket uses mmap, splice and MSG_ZEROCOPY
+	SocketHandoff    bool   // EnableUpgrade and InheritServer can pass the socket on
+	AdminSocket      bool   // EnableAdmin can listen on a unix socket
+	AVX2Checksum     bool   // packet checksums are summed with AVX2
+	NEONChecksum     bool   // packet checksums are summed with NEON on arm64
+}
+
+// PlatformFeatures returns the fast paths available to this process
+func PlatformFeatures() Features {
+	features := platformFeatures()
+	features.Platform = runtime.GOOS
+	features.AVX2Checksum = useAVX2
+	features.NEONChecksum = useNEON
+	return features
+}
@@ -0,0 +1,13 @@
+package ultrafast
+
+// platformFeatures reports the Linux fast paths
+func platformFeatures() Features {
+	return Features{
+		EventLoop:        "epoll",
+		EdgeTriggered:    true,
+		ExclusiveWakeups: epollExclusiveSupported(),
+		ZeroCopy:         true,
+		SocketHandoff:    true,
+		AdminSocket:      true,
+	}
+}
@@ -0,0 +1,38 @@
+package ultrafast
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPlatformFeatures(t *testing.T) {
+	features := PlatformFeatures()
+	if features.Platform != runtime.GOOS {
+		t.Errorf("Expected platform %s, got %s", runtime.GOOS, features.Platform)
+	}
+	if features.AVX2Checksum != useAVX2 {
+		t.Errorf("AVX2Checksum %v does not match the checksum code's choice", features.AVX2Checksum)
+	}
+	if features.NEONChecksum != useNEON {
+		t.Errorf("NEONChecksum %v does not match the checksum code's choice", features.NEONChecksum)
+	}
+	switch runtime.GOOS {
+	case "linux":
+		if features.EventLoop != "epoll" || !features.EdgeTriggered || !features.SocketHandoff {
+			t.Errorf("Expected the Linux fast paths, got %+v", features)
+		}
+	case "windows":
+		if features.EventLoop != "wsapoll" || features.EdgeTriggered || features.ZeroCopy {
+			t.Errorf("Expected the Windows fallbacks, got %+v", features)
+		}
+	}
+
+	server := startTestServer(t)
+	admin := NewAdminServer("")
+	server.registerAdminCommands(admin)
+	reply := admin.Execute("features")
+	if !strings.Contains(reply, "event_loop="+features.EventLoop) || !strings.HasSuffix(reply, "OK\n") {
+		t.Errorf("Unexpected features reply: %q", reply)
+	}
+}
@@ -0,0 +1,7 @@
+package ultrafast
+
+// platformFeatures reports the Windows fallbacks, none of which are the
+// Linux fast paths
+func platformFeatures() Features {
+	return Features{EventLoop: "wsapoll"}
+}
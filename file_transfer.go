@@ -0,0 +1,345 @@
+package ultrafast
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File transfer: a sender offers a set of files and a receiver fetches
+// them in ranges, many requests pipelined on one connection. The ranges
+// travel as fragmented responses read straight from the file, are
+// retransmitted by the reliability layer when lost, and land in a .part
+// file, so an interrupted transfer resumes where it stopped. Each file
+// is checked against the SHA-256 digest the sender published before it
+// takes its final name.
+
+// Defaults for ReceiveConfig
+const (
+	defaultTransferChunk  = 1024 * 1024
+	defaultTransferWindow = 8
+)
+
+// maxTransferChunk keeps a range within what the client reassembles
+const maxTransferChunk = 16 * 1024 * 1024
+
+// partSuffix marks a file still being received
+const partSuffix = ".part"
+
+// TransferFile describes a file a sender offers
+type TransferFile struct {
+	Name   string // base name, unique among the offered files
+	Size   int64
+	SHA256 string // hex digest of the contents
+}
+
+// TransferProgress reports how far a file has been received
+type TransferProgress struct {
+	File     TransferFile
+	Received int64 // bytes on disk, including those resumed
+	Resumed  int64 // bytes already on disk when the transfer started
+	Elapsed  time.Duration
+}
+
+// FileSender serves a fixed set of files to receivers. The manifest is
+// at /manifest, one "digest size name" line per file with the name
+// escaped as a URL path segment, and each file at /files/name, with
+// Range requests for its parts.
+type FileSender struct {
+	files    []TransferFile
+	byName   map[string]*FileServer // serving each file from its directory
+	manifest []byte
+}
+
+// NewFileSender hashes the files at paths and offers them under their
+// base names
+func NewFileSender(paths []string) (*FileSender, error) {
+	s := &FileSender{byName: make(map[string]*FileServer, len(paths))}
+	var manifest bytes.Buffer
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if _, exists := s.byName[name]; exists {
+			return nil, fmt.Errorf("two files named %q", name)
+		}
+		file, err := hashFile(path)
+		if err != nil {
+			return nil, err
+		}
+		file.Name = name
+		s.files = append(s.files, file)
+		s.byName[name] = NewFileServer(filepath.Dir(path))
+		fmt.Fprintf(&manifest, "%s %d %s\n", file.SHA256, file.Size, url.PathEscape(name))
+	}
+	s.manifest = manifest.Bytes()
+	return s, nil
+}
+
+// Files returns the offered files
+func (s *FileSender) Files() []TransferFile {
+	return s.files
+}
+
+// ServeRequest answers manifest and file requests. It is a
+// RequestHandler, to register for every path:
+//
+//	server.HandlePrefix("/", sender.ServeRequest)
+func (s *FileSender) ServeRequest(ctx context.Context, r *HTTPRequest) *HTTPResponse {
+	path, _, _ := strings.Cut(r.Path, "?")
+	if path == "/manifest" {
+		return &HTTPResponse{
+			StatusCode: 200,
+			Headers:    map[string]string{"Content-Type": "text/plain"},
+			Body:       s.manifest,
+		}
+	}
+	escaped, found := strings.CutPrefix(path, "/files/")
+	if !found {
+		return fileErrorResponse(404)
+	}
+	name, err := url.PathUnescape(escaped)
+	if err != nil {
+		return fileErrorResponse(404)
+	}
+	server, exists := s.byName[name]
+	if !exists {
+		return fileErrorResponse(404)
+	}
+	return server.ServeFile(r, name)
+}
+
+// ReceiveConfig configures a FileReceiver. Zero values take the defaults.
+type ReceiveConfig struct {
+	ChunkSize int                    // bytes per range request, default 1MB, at most 16MB
+	Window    int                    // range requests in flight, default 8
+	Progress  func(TransferProgress) // called as ranges arrive, if set
+}
+
+// FileReceiver fetches files from a FileSender over one connection
+type FileReceiver struct {
+	client *UltraFastClient
+	server SocketAddr
+	config ReceiveConfig
+}
+
+// NewFileReceiver creates a receiver for the sender at server
+func NewFileReceiver(server SocketAddr, config ReceiveConfig) (*FileReceiver, error) {
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = defaultTransferChunk
+	}
+	if config.ChunkSize > maxTransferChunk {
+		return nil, fmt.Errorf("chunk size %d over the %d byte limit", config.ChunkSize, maxTransferChunk)
+	}
+	if config.Window <= 0 {
+		config.Window = defaultTransferWindow
+	}
+	client, err := NewUltraFastClient(server.IP, server.Port)
+	if err != nil {
+		return nil, err
+	}
+	return &FileReceiver{client: client, server: server, config: config}, nil
+}
+
+// Manifest returns the files the sender offers
+func (fr *FileReceiver) Manifest() ([]TransferFile, error) {
+	status, body, err := fr.get("/manifest", "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %v", err)
+	}
+	if status != 200 {
+		return nil, fmt.Errorf("failed to fetch manifest: status %d", status)
+	}
+
+	var files []TransferFile
+	for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed manifest line: %q", line)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("malformed manifest line: %q", line)
+		}
+		name, err := url.PathUnescape(fields[2])
+		if err != nil || !validTransferName(name) {
+			return nil, fmt.Errorf("unsafe file name in manifest: %q", fields[2])
+		}
+		files = append(files, TransferFile{Name: name, Size: size, SHA256: fields[0]})
+	}
+	return files, nil
+}
+
+// validTransferName reports whether a name from a sender is a plain file
+// name, which cannot write outside the receiving directory
+func validTransferName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name &&
+		!strings.ContainsAny(name, `/\`)
+}
+
+// Receive fetches file into dir. Bytes already in dir from an earlier,
+// interrupted attempt are kept, and a complete file already there with
+// the right digest is not fetched again. If the digest of what arrived
+// does not match, the data is discarded and an error returned.
+func (fr *FileReceiver) Receive(file TransferFile, dir string) error {
+	if !validTransferName(file.Name) {
+		return fmt.Errorf("unsafe file name: %q", file.Name)
+	}
+	final := filepath.Join(dir, file.Name)
+	if existing, err := hashFile(final); err == nil && existing.SHA256 == file.SHA256 {
+		fr.report(TransferProgress{File: file, Received: file.Size, Resumed: file.Size})
+		return nil
+	}
+
+	part, err := os.OpenFile(final+partSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+	info, err := part.Stat()
+	if err != nil {
+		return err
+	}
+	offset := info.Size()
+	if offset > file.Size {
+		if err := part.Truncate(0); err != nil {
+			return err
+		}
+		offset = 0
+	}
+
+	start := time.Now()
+	progress := TransferProgress{File: file, Received: offset, Resumed: offset}
+	fr.report(progress)
+	for offset < file.Size {
+		n, err := fr.receiveRanges(file, part, offset)
+		if err != nil {
+			return fmt.Errorf("receiving %s at byte %d: %v", file.Name, offset, err)
+		}
+		offset += n
+		progress.Received, progress.Elapsed = offset, time.Since(start)
+		fr.report(progress)
+	}
+	if err := part.Sync(); err != nil {
+		return err
+	}
+
+	received, err := hashFile(part.Name())
+	if err != nil {
+		return err
+	}
+	if received.SHA256 != file.SHA256 {
+		part.Close()
+		os.Remove(part.Name())
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", file.Name, file.SHA256, received.SHA256)
+	}
+	if err := part.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part.Name(), final)
+}
+
+// receiveRanges fetches up to a window of ranges from offset, pipelined,
+// and writes them to part. It returns how many bytes were written.
+func (fr *FileReceiver) receiveRanges(file TransferFile, part *os.File, offset int64) (int64, error) {
+	var requests [][]byte
+	var lengths []int64
+	for at := offset; at < file.Size && len(requests) < fr.config.Window; {
+		length := min(int64(fr.config.ChunkSize), file.Size-at)
+		rangeHeader := fmt.Sprintf("bytes=%d-%d", at, at+length-1)
+		requests = append(requests, fr.request("/files/"+url.PathEscape(file.Name), rangeHeader))
+		lengths = append(lengths, length)
+		at += length
+	}
+
+	responses, err := fr.client.Pipeline(requests)
+	if err != nil {
+		return 0, err
+	}
+	written := int64(0)
+	for i, raw := range responses {
+		status, body, err := parseRawResponse(raw)
+		if err != nil {
+			return written, err
+		}
+		if status != 200 && status != 206 || int64(len(body)) != lengths[i] {
+			return written, fmt.Errorf("unexpected response: status %d with %d bytes", status, len(body))
+		}
+		if _, err := part.WriteAt(body, offset+written); err != nil {
+			return written, err
+		}
+		written += lengths[i]
+	}
+	return written, nil
+}
+
+// get sends one request and returns the response's status and body
+func (fr *FileReceiver) get(path, rangeHeader string) (int, []byte, error) {
+	raw, err := fr.client.Do(fr.request(path, rangeHeader))
+	if err != nil {
+		return 0, nil, err
+	}
+	return parseRawResponse(raw)
+}
+
+// request builds a GET request, for a range if rangeHeader is set
+func (fr *FileReceiver) request(path, rangeHeader string) []byte {
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n", path, fr.server)
+	if rangeHeader != "" {
+		request += "Range: " + rangeHeader + "\r\n"
+	}
+	return []byte(request + "\r\n")
+}
+
+// parseRawResponse splits a raw response into status and body
+func parseRawResponse(raw []byte) (int, []byte, error) {
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("malformed response: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("malformed response: %v", err)
+	}
+	return response.StatusCode, body, nil
+}
+
+// report passes progress to the configured callback
+func (fr *FileReceiver) report(progress TransferProgress) {
+	if fr.config.Progress != nil {
+		fr.config.Progress(progress)
+	}
+}
+
+// Close closes the connection to the sender
+func (fr *FileReceiver) Close() error {
+	return fr.client.Close()
+}
+
+// hashFile returns the size and SHA-256 digest of the file at path
+func hashFile(path string) (TransferFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return TransferFile{}, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return TransferFile{}, err
+	}
+	return TransferFile{Name: filepath.Base(path), Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
@@ -0,0 +1,179 @@
+package ultrafast
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startFileSender offers files, written with the given contents, from a
+// test server
+func startFileSender(t *testing.T, contents map[string][]byte) (*UltraFastHTTPServer, *FileSender) {
+	t.Helper()
+	dir := t.TempDir()
+	var paths []string
+	for name, data := range contents {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	sender, err := NewFileSender(paths)
+	if err != nil {
+		t.Fatalf("NewFileSender failed: %v", err)
+	}
+	server := startTestServer(t)
+	server.HandlePrefix("/", sender.ServeRequest)
+	return server, sender
+}
+
+// newTestReceiver creates a receiver for a test server
+func newTestReceiver(t *testing.T, server *UltraFastHTTPServer, config ReceiveConfig) *FileReceiver {
+	t.Helper()
+	receiver, err := NewFileReceiver(server.socket.GetLocalAddr(), config)
+	if err != nil {
+		t.Fatalf("NewFileReceiver failed: %v", err)
+	}
+	t.Cleanup(func() { receiver.Close() })
+	return receiver
+}
+
+// randomBytes returns n bytes that do not compress or repeat
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(rand.Uint32())
+	}
+	return data
+}
+
+func TestFileTransfer(t *testing.T) {
+	large := randomBytes(3*64*1024 + 123)
+	server, _ := startFileSender(t, map[string][]byte{
+		"large.bin":      large,
+		"with space.txt": []byte("small"),
+		"empty":          nil,
+	})
+
+	var reports int
+	receiver := newTestReceiver(t, server, ReceiveConfig{
+		ChunkSize: 64 * 1024,
+		Window:    2,
+		Progress:  func(TransferProgress) { reports++ },
+	})
+	files, err := receiver.Manifest()
+	if err != nil {
+		t.Fatalf("Manifest failed: %v", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected 3 files in the manifest, got %+v", files)
+	}
+
+	dir := t.TempDir()
+	for _, file := range files {
+		if err := receiver.Receive(file, dir); err != nil {
+			t.Fatalf("Receive %s failed: %v", file.Name, err)
+		}
+	}
+	got, _ := os.ReadFile(filepath.Join(dir, "large.bin"))
+	if !bytes.Equal(got, large) {
+		t.Error("Received file differs from the one sent")
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "with space.txt")); string(got) != "small" {
+		t.Errorf("Expected %q, got %q", "small", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "empty")); err != nil {
+		t.Errorf("Empty file not created: %v", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*"+partSuffix)); len(matches) != 0 {
+		t.Errorf("Part files left behind: %v", matches)
+	}
+	if reports < 4 {
+		t.Errorf("Expected progress for every window, got %d reports", reports)
+	}
+}
+
+func TestFileTransferResumes(t *testing.T) {
+	data := randomBytes(200 * 1024)
+	server, sender := startFileSender(t, map[string][]byte{"resume.bin": data})
+	file := sender.Files()[0]
+
+	// An earlier attempt stopped partway
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "resume.bin"+partSuffix), data[:150*1024], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var last TransferProgress
+	receiver := newTestReceiver(t, server, ReceiveConfig{
+		ChunkSize: 32 * 1024,
+		Progress:  func(p TransferProgress) { last = p },
+	})
+	if err := receiver.Receive(file, dir); err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	if last.Resumed != 150*1024 || last.Received != file.Size {
+		t.Errorf("Expected the transfer to resume at 150KB, got %+v", last)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "resume.bin")); !bytes.Equal(got, data) {
+		t.Error("Resumed file differs from the one sent")
+	}
+
+	// Already complete: nothing is fetched again
+	server.Close()
+	if err := receiver.Receive(file, dir); err != nil {
+		t.Errorf("Receiving a complete file should not contact the sender: %v", err)
+	}
+}
+
+func TestFileTransferChecksumMismatch(t *testing.T) {
+	data := randomBytes(100 * 1024)
+	server, sender := startFileSender(t, map[string][]byte{"bad.bin": data})
+	file := sender.Files()[0]
+
+	// A stale part file from a different version of the file
+	dir := t.TempDir()
+	part := filepath.Join(dir, "bad.bin"+partSuffix)
+	if err := os.WriteFile(part, bytes.Repeat([]byte{0xFF}, 50*1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := newTestReceiver(t, server, ReceiveConfig{})
+	err := receiver.Receive(file, dir)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("Expected a checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Error("The corrupt part file should be discarded")
+	}
+	if err := receiver.Receive(file, dir); err != nil {
+		t.Errorf("A second attempt should start over and succeed: %v", err)
+	}
+}
+
+func TestFileTransferRejectsUnsafeNames(t *testing.T) {
+	for _, name := range []string{"", ".", "..", "../escape", "a/b", `a\b`} {
+		if validTransferName(name) {
+			t.Errorf("%q should be rejected", name)
+		}
+	}
+	receiver := &FileReceiver{}
+	if err := receiver.Receive(TransferFile{Name: "../escape"}, t.TempDir()); err == nil {
+		t.Error("Expected Receive to refuse a name outside the directory")
+	}
+}
+
+func TestFileSenderDuplicateNames(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"a", "b"} {
+		os.Mkdir(filepath.Join(dir, sub), 0755)
+		os.WriteFile(filepath.Join(dir, sub, "same"), nil, 0644)
+	}
+	if _, err := NewFileSender([]string{filepath.Join(dir, "a", "same"), filepath.Join(dir, "b", "same")}); err == nil {
+		t.Error("Expected an error for two files with one name")
+	}
+}
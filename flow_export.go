@@ -0,0 +1,374 @@
+package ultrafast
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IPFIX (RFC 7011, NetFlow version 10) export of per-connection flow
+// records. Each connection that closes yields two records, one per
+// direction, sent to a collector over UDP from a background goroutine.
+
+// IPFIX message and set identifiers
+const (
+	ipfixVersion       = 10
+	ipfixHeaderSize    = 16
+	ipfixTemplateSetID = 2
+	flowTemplateID     = 256 // the first ID available to data sets
+)
+
+// flowEnterpriseNumber qualifies the fields IANA does not define:
+// connection ID and retransmissions. It is the private enterprise number
+// RFC 5612 reserves for documentation, so collectors show the fields
+// without mistaking them for another vendor's.
+const flowEnterpriseNumber = 32473
+
+// Enterprise-specific field IDs under flowEnterpriseNumber
+const (
+	flowFieldConnectionID = 1
+	flowFieldRetransmits  = 2
+)
+
+// flowField is one field of the template: an information element ID,
+// its length, and the enterprise it belongs to, 0 for IANA
+type flowField struct {
+	id         uint16
+	length     uint16
+	enterprise uint32
+}
+
+// flowTemplate lists the fields of every data record, in order
+var flowTemplate = []flowField{
+	{id: 8, length: 4},   // sourceIPv4Address
+	{id: 12, length: 4},  // destinationIPv4Address
+	{id: 7, length: 2},   // sourceTransportPort
+	{id: 11, length: 2},  // destinationTransportPort
+	{id: 4, length: 1},   // protocolIdentifier
+	{id: 1, length: 8},   // octetDeltaCount
+	{id: 2, length: 8},   // packetDeltaCount
+	{id: 152, length: 8}, // flowStartMilliseconds
+	{id: 153, length: 8}, // flowEndMilliseconds
+	{id: 136, length: 1}, // flowEndReason
+	{id: 61, length: 1},  // flowDirection: 0 into the server, 1 out of it
+	{id: flowFieldConnectionID, length: 8, enterprise: flowEnterpriseNumber},
+	{id: flowFieldRetransmits, length: 8, enterprise: flowEnterpriseNumber},
+}
+
+// flowRecordSize is the encoded length of one data record
+const flowRecordSize = 4 + 4 + 2 + 2 + 1 + 8 + 8 + 8 + 8 + 1 + 1 + 8 + 8
+
+// flowMessageSize bounds an export message so it fits one datagram
+const flowMessageSize = MAX_PACKET_SIZE
+
+// Defaults for FlowExportConfig
+const (
+	defaultFlowExportBuffer = 4096
+	defaultTemplateInterval = 30 * time.Second
+)
+
+// FlowEndReason says why a flow ended, as IPFIX's flowEndReason
+type FlowEndReason uint8
+
+const (
+	FLOW_END_IDLE              FlowEndReason = 1 // idle timeout
+	FLOW_END_OF_FLOW           FlowEndReason = 3 // closed by either side
+	FLOW_END_FORCED            FlowEndReason = 4 // aborted, or the server shut down
+	FLOW_END_LACK_OF_RESOURCES FlowEndReason = 5 // evicted to make room
+)
+
+// FlowRecord summarizes one connection once it has closed
+type FlowRecord struct {
+	ConnectionID uint64
+	Peer         SocketAddr
+	Local        SocketAddr
+	Start        time.Time
+	End          time.Time
+	BytesIn      uint64
+	BytesOut     uint64
+	PacketsIn    uint64
+	PacketsOut   uint64
+	Retransmits  uint64 // DATA packets the server sent again
+	EndReason    FlowEndReason
+}
+
+// FlowExportConfig configures a flow exporter. Zero values take the
+// defaults.
+type FlowExportConfig struct {
+	ObservationDomain uint32        // identifies this server to the collector
+	BufferSize        int           // records queued, default 4096
+	TemplateInterval  time.Duration // how often the template is sent again, default 30s
+}
+
+// FlowExportStats counts flow export activity
+type FlowExportStats struct {
+	Exported uint64 // flows sent, each as two data records
+	Dropped  uint64 // flows discarded because the buffer was full
+	Errors   uint64 // messages that failed to send
+}
+
+// FlowExporter sends flow records to an IPFIX collector. Export queues
+// the record and returns at once; a background goroutine packs queued
+// records into messages. Over UDP the collector may start listening at
+// any time, so the template goes out with the first message and again
+// every TemplateInterval.
+type FlowExporter struct {
+	socket    *LinuxUDPSocket
+	collector SocketAddr
+	config    FlowExportConfig
+
+	mu     sync.Mutex
+	queue  []FlowRecord
+	closed bool
+	wake   chan struct{}
+	done   chan struct{}
+
+	// Owned by the export goroutine
+	sequence     uint32 // data records sent, as the next message header gives it
+	templateSent time.Time
+
+	exported uint64 // atomic
+	dropped  uint64 // atomic
+	errors   uint64 // atomic
+}
+
+// NewFlowExporter starts an exporter sending to collector
+func NewFlowExporter(collector SocketAddr, config FlowExportConfig) (*FlowExporter, error) {
+	if parseIPv4(collector.IP) == nil {
+		return nil, fmt.Errorf("invalid collector address: %s", collector.IP)
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultFlowExportBuffer
+	}
+	if config.TemplateInterval <= 0 {
+		config.TemplateInterval = defaultTemplateInterval
+	}
+	socket, err := NewLinuxUDPSocket()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create flow export socket: %v", err)
+	}
+	e := &FlowExporter{
+		socket:    socket,
+		collector: collector,
+		config:    config,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// Collector returns the address records are sent to
+func (e *FlowExporter) Collector() SocketAddr {
+	return e.collector
+}
+
+// Export queues a record, dropping it if the buffer is full
+func (e *FlowExporter) Export(record *FlowRecord) {
+	e.mu.Lock()
+	if e.closed || len(e.queue) == e.config.BufferSize {
+		e.mu.Unlock()
+		atomic.AddUint64(&e.dropped, 1)
+		return
+	}
+	e.queue = append(e.queue, *record)
+	e.mu.Unlock()
+	notify(e.wake)
+}
+
+// run sends queued records until the exporter is closed
+func (e *FlowExporter) run() {
+	defer close(e.done)
+	var batch []FlowRecord
+	var message []byte
+	for {
+		e.mu.Lock()
+		if len(e.queue) == 0 {
+			closed := e.closed
+			e.mu.Unlock()
+			if closed {
+				return
+			}
+			<-e.wake
+			continue
+		}
+		batch, e.queue = e.queue, batch[:0]
+		e.mu.Unlock()
+
+		for records := batch; len(records) > 0; {
+			now := clockNow()
+			withTemplate := e.templateSent.IsZero() || now.Sub(e.templateSent) >= e.config.TemplateInterval
+			n := min(flowsPerMessage(withTemplate), len(records))
+			message = appendFlowMessage(message[:0], now, e.sequence, e.config.ObservationDomain, withTemplate, records[:n])
+			if _, err := e.socket.SendTo(message, e.collector.IP, e.collector.Port); err != nil {
+				atomic.AddUint64(&e.errors, 1)
+			} else {
+				if withTemplate {
+					e.templateSent = now
+				}
+				e.sequence += uint32(2 * n)
+				atomic.AddUint64(&e.exported, uint64(n))
+			}
+			records = records[n:]
+		}
+	}
+}
+
+// Close sends the queued records and stops the exporter. Records
+// exported afterwards are dropped.
+func (e *FlowExporter) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		<-e.done
+		return
+	}
+	e.closed = true
+	e.mu.Unlock()
+	notify(e.wake)
+	<-e.done
+	e.socket.Close()
+}
+
+// Stats returns the exporter's counters
+func (e *FlowExporter) Stats() FlowExportStats {
+	return FlowExportStats{
+		Exported: atomic.LoadUint64(&e.exported),
+		Dropped:  atomic.LoadUint64(&e.dropped),
+		Errors:   atomic.LoadUint64(&e.errors),
+	}
+}
+
+// flowTemplateSetSize is the encoded length of the template set
+func flowTemplateSetSize() int {
+	size := 4 + 4 // set header, template record header
+	for _, field := range flowTemplate {
+		size += 4
+		if field.enterprise != 0 {
+			size += 4
+		}
+	}
+	return size
+}
+
+// flowsPerMessage returns how many flows, at two records each, fit in
+// one message
+func flowsPerMessage(withTemplate bool) int {
+	room := flowMessageSize - ipfixHeaderSize - 4 // data set header
+	if withTemplate {
+		room -= flowTemplateSetSize()
+	}
+	return room / (2 * flowRecordSize)
+}
+
+// appendFlowMessage appends an IPFIX message carrying records, preceded
+// by the template set if withTemplate, to dst
+func appendFlowMessage(dst []byte, exportTime time.Time, sequence, domain uint32, withTemplate bool, records []FlowRecord) []byte {
+	start := len(dst)
+	dst = binary.BigEndian.AppendUint16(dst, ipfixVersion)
+	dst = binary.BigEndian.AppendUint16(dst, 0) // length, filled in below
+	dst = binary.BigEndian.AppendUint32(dst, uint32(exportTime.Unix()))
+	dst = binary.BigEndian.AppendUint32(dst, sequence)
+	dst = binary.BigEndian.AppendUint32(dst, domain)
+
+	if withTemplate {
+		dst = binary.BigEndian.AppendUint16(dst, ipfixTemplateSetID)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(flowTemplateSetSize()))
+		dst = binary.BigEndian.AppendUint16(dst, flowTemplateID)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(len(flowTemplate)))
+		for _, field := range flowTemplate {
+			if field.enterprise != 0 {
+				dst = binary.BigEndian.AppendUint16(dst, field.id|0x8000)
+				dst = binary.BigEndian.AppendUint16(dst, field.length)
+				dst = binary.BigEndian.AppendUint32(dst, field.enterprise)
+				continue
+			}
+			dst = binary.BigEndian.AppendUint16(dst, field.id)
+			dst = binary.BigEndian.AppendUint16(dst, field.length)
+		}
+	}
+
+	dst = binary.BigEndian.AppendUint16(dst, flowTemplateID)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(4+2*flowRecordSize*len(records)))
+	for i := range records {
+		record := &records[i]
+		dst = appendFlowDirection(dst, record, record.Peer, record.Local, record.BytesIn, record.PacketsIn, 0, 0)
+		dst = appendFlowDirection(dst, record, record.Local, record.Peer, record.BytesOut, record.PacketsOut, record.Retransmits, 1)
+	}
+
+	binary.BigEndian.PutUint16(dst[start+2:], uint16(len(dst)-start))
+	return dst
+}
+
+// appendFlowDirection appends the data record for one direction of a flow
+func appendFlowDirection(dst []byte, record *FlowRecord, from, to SocketAddr,
+	bytes, packets, retransmits uint64, direction uint8) []byte {
+	dst = appendIPv4(dst, from.IP)
+	dst = appendIPv4(dst, to.IP)
+	dst = binary.BigEndian.AppendUint16(dst, from.Port)
+	dst = binary.BigEndian.AppendUint16(dst, to.Port)
+	dst = append(dst, 17) // UDP
+	dst = binary.BigEndian.AppendUint64(dst, bytes)
+	dst = binary.BigEndian.AppendUint64(dst, packets)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(record.Start.UnixMilli()))
+	dst = binary.BigEndian.AppendUint64(dst, uint64(record.End.UnixMilli()))
+	dst = append(dst, byte(record.EndReason), direction)
+	dst = binary.BigEndian.AppendUint64(dst, record.ConnectionID)
+	return binary.BigEndian.AppendUint64(dst, retransmits)
+}
+
+// appendIPv4 appends an address's four bytes, zeros if it is not IPv4
+func appendIPv4(dst []byte, ip string) []byte {
+	if b := parseIPv4(ip); b != nil {
+		return append(dst, b...)
+	}
+	return append(dst, 0, 0, 0, 0)
+}
+
+// EnableFlowExport sends a flow record to the collector for every
+// connection that closes, replacing and closing any previous exporter
+func (s *UltraFastHTTPServer) EnableFlowExport(collector SocketAddr, config FlowExportConfig) (*FlowExporter, error) {
+	exporter, err := NewFlowExporter(collector, config)
+	if err != nil {
+		return nil, err
+	}
+	if old := s.flowExport.Swap(exporter); old != nil {
+		old.Close()
+	}
+	return exporter, nil
+}
+
+// DisableFlowExport stops flow export, sending queued records first
+func (s *UltraFastHTTPServer) DisableFlowExport() {
+	if old := s.flowExport.Swap(nil); old != nil {
+		old.Close()
+	}
+}
+
+// FlowExporter returns the active flow exporter, or nil
+func (s *UltraFastHTTPServer) FlowExporter() *FlowExporter {
+	return s.flowExport.Load()
+}
+
+// exportFlow records a connection that ended, if flow export is on
+func (s *UltraFastHTTPServer) exportFlow(conn *Connection, reason FlowEndReason) {
+	exporter := s.flowExport.Load()
+	if exporter == nil {
+		return
+	}
+	exporter.Export(&FlowRecord{
+		ConnectionID: conn.ID,
+		Peer:         s.connections.PeerOf(conn),
+		Local:        s.socket.GetLocalAddr(),
+		Start:        conn.Established,
+		End:          clockNow(),
+		BytesIn:      conn.BytesIn(),
+		BytesOut:     conn.BytesOut(),
+		PacketsIn:    conn.PacketsIn(),
+		PacketsOut:   conn.PacketsOut(),
+		Retransmits:  conn.Reliability().GetStats().PacketsRetransmitted,
+		EndReason:    reason,
+	})
+}
@@ -0,0 +1,225 @@
+package ultrafast
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// ipfixMessage is an export message taken apart by the test collector
+type ipfixMessage struct {
+	exportTime uint32
+	sequence   uint32
+	domain     uint32
+	template   []flowField // nil if the message carried none
+	records    [][]byte
+}
+
+// parseIPFIX splits a message into its template and data records,
+// checking every length on the way
+func parseIPFIX(t *testing.T, data []byte) ipfixMessage {
+	t.Helper()
+	if len(data) < ipfixHeaderSize || binary.BigEndian.Uint16(data) != ipfixVersion {
+		t.Fatalf("Not an IPFIX message: %x", data)
+	}
+	if length := int(binary.BigEndian.Uint16(data[2:])); length != len(data) {
+		t.Fatalf("Header gives length %d for a %d byte message", length, len(data))
+	}
+	message := ipfixMessage{
+		exportTime: binary.BigEndian.Uint32(data[4:]),
+		sequence:   binary.BigEndian.Uint32(data[8:]),
+		domain:     binary.BigEndian.Uint32(data[12:]),
+	}
+
+	for sets := data[ipfixHeaderSize:]; len(sets) > 0; {
+		id, length := binary.BigEndian.Uint16(sets), int(binary.BigEndian.Uint16(sets[2:]))
+		if length < 4 || length > len(sets) {
+			t.Fatalf("Set %d has bad length %d", id, length)
+		}
+		body := sets[4:length]
+		sets = sets[length:]
+
+		switch id {
+		case ipfixTemplateSetID:
+			if templateID := binary.BigEndian.Uint16(body); templateID != flowTemplateID {
+				t.Fatalf("Expected template %d, got %d", flowTemplateID, templateID)
+			}
+			count := int(binary.BigEndian.Uint16(body[2:]))
+			body = body[4:]
+			for i := 0; i < count; i++ {
+				field := flowField{id: binary.BigEndian.Uint16(body), length: binary.BigEndian.Uint16(body[2:])}
+				body = body[4:]
+				if field.id&0x8000 != 0 {
+					field.id &^= 0x8000
+					field.enterprise = binary.BigEndian.Uint32(body)
+					body = body[4:]
+				}
+				message.template = append(message.template, field)
+			}
+			if len(body) != 0 {
+				t.Fatalf("%d bytes left over after the template", len(body))
+			}
+		case flowTemplateID:
+			if len(body)%flowRecordSize != 0 {
+				t.Fatalf("Data set of %d bytes is not whole records", len(body))
+			}
+			for ; len(body) > 0; body = body[flowRecordSize:] {
+				message.records = append(message.records, body[:flowRecordSize])
+			}
+		default:
+			t.Fatalf("Unexpected set %d", id)
+		}
+	}
+	return message
+}
+
+// flowRecordField returns field i of a data record, laid out per the template
+func flowRecordField(record []byte, i int) []byte {
+	offset := 0
+	for _, field := range flowTemplate[:i] {
+		offset += int(field.length)
+	}
+	return record[offset : offset+int(flowTemplate[i].length)]
+}
+
+func TestFlowMessageEncoding(t *testing.T) {
+	start := time.UnixMilli(1700000000123)
+	record := FlowRecord{
+		ConnectionID: 0xfeedface,
+		Peer:         SocketAddr{IP: "10.0.0.1", Port: 4242},
+		Local:        SocketAddr{IP: "10.0.0.2", Port: 8080},
+		Start:        start,
+		End:          start.Add(2500 * time.Millisecond),
+		BytesIn:      300,
+		BytesOut:     9000,
+		PacketsIn:    3,
+		PacketsOut:   8,
+		Retransmits:  2,
+		EndReason:    FLOW_END_IDLE,
+	}
+	data := appendFlowMessage(nil, start.Add(3*time.Second), 40, 7, true, []FlowRecord{record})
+	message := parseIPFIX(t, data)
+
+	if message.sequence != 40 || message.domain != 7 || message.exportTime != uint32(start.Unix()+3) {
+		t.Errorf("Unexpected header %+v", message)
+	}
+	if len(message.template) != len(flowTemplate) {
+		t.Fatalf("Expected %d template fields, got %v", len(flowTemplate), message.template)
+	}
+	for i, field := range message.template {
+		if field != flowTemplate[i] {
+			t.Errorf("Template field %d: expected %+v, got %+v", i, flowTemplate[i], field)
+		}
+	}
+	if len(message.records) != 2 {
+		t.Fatalf("Expected a record for each direction, got %d", len(message.records))
+	}
+
+	u64 := func(b []byte) uint64 { return binary.BigEndian.Uint64(b) }
+	for i, want := range []struct {
+		from, to               [4]byte
+		fromPort, toPort       uint16
+		bytes, packets, resent uint64
+		direction              byte
+	}{
+		{[4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, 4242, 8080, 300, 3, 0, 0},
+		{[4]byte{10, 0, 0, 2}, [4]byte{10, 0, 0, 1}, 8080, 4242, 9000, 8, 2, 1},
+	} {
+		r := message.records[i]
+		if [4]byte(flowRecordField(r, 0)) != want.from || [4]byte(flowRecordField(r, 1)) != want.to {
+			t.Errorf("Record %d: unexpected addresses %x", i, r[:8])
+		}
+		if binary.BigEndian.Uint16(flowRecordField(r, 2)) != want.fromPort ||
+			binary.BigEndian.Uint16(flowRecordField(r, 3)) != want.toPort {
+			t.Errorf("Record %d: unexpected ports %x", i, r[8:12])
+		}
+		if flowRecordField(r, 4)[0] != 17 {
+			t.Errorf("Record %d: expected protocol 17, got %d", i, flowRecordField(r, 4)[0])
+		}
+		if u64(flowRecordField(r, 5)) != want.bytes || u64(flowRecordField(r, 6)) != want.packets {
+			t.Errorf("Record %d: expected %d bytes in %d packets, got %d in %d", i, want.bytes, want.packets,
+				u64(flowRecordField(r, 5)), u64(flowRecordField(r, 6)))
+		}
+		if u64(flowRecordField(r, 7)) != 1700000000123 || u64(flowRecordField(r, 8)) != 1700000002623 {
+			t.Errorf("Record %d: unexpected times %d to %d", i, u64(flowRecordField(r, 7)), u64(flowRecordField(r, 8)))
+		}
+		if flowRecordField(r, 9)[0] != byte(FLOW_END_IDLE) || flowRecordField(r, 10)[0] != want.direction {
+			t.Errorf("Record %d: unexpected end reason %d or direction %d", i, flowRecordField(r, 9)[0], flowRecordField(r, 10)[0])
+		}
+		if u64(flowRecordField(r, 11)) != 0xfeedface || u64(flowRecordField(r, 12)) != want.resent {
+			t.Errorf("Record %d: unexpected connection ID %x or retransmits %d", i,
+				u64(flowRecordField(r, 11)), u64(flowRecordField(r, 12)))
+		}
+	}
+
+	// Without the template a message fits more flows, and every full
+	// message still fits a datagram
+	if without := flowsPerMessage(false); without <= flowsPerMessage(true) {
+		t.Errorf("Expected more flows without the template, got %d", without)
+	}
+	full := appendFlowMessage(nil, start, 0, 0, true, make([]FlowRecord, flowsPerMessage(true)))
+	if len(full) > flowMessageSize {
+		t.Errorf("A full message takes %d bytes, more than %d", len(full), flowMessageSize)
+	}
+}
+
+func TestServerFlowExport(t *testing.T) {
+	collector, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatalf("Failed to create collector: %v", err)
+	}
+	defer collector.Close()
+	if err := collector.Bind("127.0.0.1", 0); err != nil {
+		t.Fatalf("Failed to bind collector: %v", err)
+	}
+
+	server := startTestServer(t)
+	exporter, err := server.EnableFlowExport(collector.GetLocalAddr(), FlowExportConfig{ObservationDomain: 3})
+	if err != nil {
+		t.Fatalf("Failed to enable flow export: %v", err)
+	}
+	client := newTestClient(t, server)
+	if _, err := client.Get("/benchmark"); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	client.Close() // the FIN ends the flow
+
+	buffer := make([]byte, 65536)
+	collector.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := collector.RecvFrom(buffer)
+	if err != nil {
+		t.Fatalf("No flow record arrived: %v", err)
+	}
+	message := parseIPFIX(t, buffer[:n])
+	if message.template == nil || message.domain != 3 || message.sequence != 0 || len(message.records) != 2 {
+		t.Fatalf("Expected the template and one flow, got %+v", message)
+	}
+
+	in, out := message.records[0], message.records[1]
+	if port := binary.BigEndian.Uint16(flowRecordField(in, 3)); port != server.socket.GetLocalAddr().Port {
+		t.Errorf("Expected the flow into port %d, got %d", server.socket.GetLocalAddr().Port, port)
+	}
+	for i, record := range [][]byte{in, out} {
+		// The handshake, the request and its acknowledgments
+		if packets := binary.BigEndian.Uint64(flowRecordField(record, 6)); packets < 2 {
+			t.Errorf("Record %d: expected at least 2 packets, got %d", i, packets)
+		}
+		if bytes := binary.BigEndian.Uint64(flowRecordField(record, 5)); bytes == 0 {
+			t.Errorf("Record %d: expected a byte count", i)
+		}
+		if reason := FlowEndReason(flowRecordField(record, 9)[0]); reason != FLOW_END_OF_FLOW {
+			t.Errorf("Record %d: expected the flow to end by FIN, got reason %d", i, reason)
+		}
+	}
+	if id, _ := client.ConnectionID(); binary.BigEndian.Uint64(flowRecordField(in, 11)) != id {
+		t.Errorf("Expected connection ID %x in the record", id)
+	}
+	// The count follows the send
+	deadline := time.Now().Add(time.Second)
+	for exporter.Stats().Exported == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := exporter.Stats(); stats.Exported != 1 || stats.Dropped != 0 || stats.Errors != 0 {
+		t.Errorf("Expected one flow exported, got %+v", stats)
+	}
+}
@@ -0,0 +1,43 @@
+package ultrafast
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// GCStats shows how much garbage the server makes. The runtime counters
+// are process-wide; AllocsPerRequest divides the allocations made since
+// the server was created by the requests it received.
+type GCStats struct {
+	Collections      uint32
+	PauseTotal       time.Duration
+	HeapBytes        uint64 // live and not yet swept heap objects
+	Allocations      uint64 // heap allocations since the server was created
+	AllocsPerRequest float64
+}
+
+// GCStats reads the runtime's memory statistics, which briefly stops the
+// world; it is meant for dashboards, not for every request
+func (s *UltraFastHTTPServer) GCStats() GCStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := GCStats{
+		Collections: mem.NumGC,
+		PauseTotal:  time.Duration(mem.PauseTotalNs),
+		HeapBytes:   mem.HeapAlloc,
+		Allocations: mem.Mallocs - s.startMallocs,
+	}
+	if requests := atomic.LoadUint64(&s.stats.RequestsReceived); requests > 0 {
+		stats.AllocsPerRequest = float64(stats.Allocations) / float64(requests)
+	}
+	return stats
+}
+
+// heapAllocations returns the number of heap allocations made so far
+func heapAllocations() uint64 {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return mem.Mallocs
+}
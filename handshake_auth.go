@@ -0,0 +1,100 @@
+package ultrafast
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// OPT_AUTH_TOKEN carries the client's credential on a SYN, up to 255
+// bytes, for the server's HandshakeAuthenticator to check
+const OPT_AUTH_TOKEN = 0x09
+
+// hmacTokenSize is an HMAC auth token: a millisecond timestamp and the
+// HMAC-SHA256 of it
+const hmacTokenSize = 8 + sha256.Size
+
+// HandshakeAuthenticator decides whether a peer may connect. It is given
+// the token from the SYN's OPT_AUTH_TOKEN, nil if the SYN carried none,
+// and returns an error to refuse the connection.
+type HandshakeAuthenticator func(peer SocketAddr, token []byte) error
+
+// OnHandshake registers an authenticator called for every SYN, once its
+// address is validated if SetRetryRequired is on, and before a session
+// ticket is redeemed or a SYN cookie is sent. A refused SYN is answered
+// with a RST and leaves no state behind. The authenticator runs on the
+// event loop, so it should not block. Passing nil admits every peer.
+func (s *UltraFastHTTPServer) OnHandshake(auth HandshakeAuthenticator) {
+	if auth == nil {
+		s.handshakeAuth.Store(nil)
+		return
+	}
+	s.handshakeAuth.Store(&auth)
+}
+
+// authenticateHandshake runs the authenticator, if any, on a SYN
+func (s *UltraFastHTTPServer) authenticateHandshake(packet *Packet, from SocketAddr) error {
+	auth := s.handshakeAuth.Load()
+	if auth == nil {
+		return nil
+	}
+	token, _ := packet.GetOption(OPT_AUTH_TOKEN)
+	return (*auth)(from, token)
+}
+
+// rejectHandshake answers a SYN the authenticator refused with a RST.
+// No reason is given, so a prober learns nothing from it.
+func (h *HTTPSocketHandler) rejectHandshake(packet *Packet, from SocketAddr, err error) {
+	logDebugf("Rejected handshake from %s:%d: %v", from.IP, from.Port, err)
+	atomic.AddUint64(&h.server.stats.HandshakesRejected, 1)
+	rstPacket := NewPacket(RST_PACKET, RST_FLAG, 0, packet.SeqNum+1, nil)
+	h.sendPacket(rstPacket, from)
+}
+
+// PSKAuthenticator admits peers whose token is the pre-shared key,
+// compared in constant time
+func PSKAuthenticator(key []byte) HandshakeAuthenticator {
+	key = append([]byte(nil), key...)
+	return func(peer SocketAddr, token []byte) error {
+		if subtle.ConstantTimeCompare(token, key) != 1 {
+			return fmt.Errorf("wrong pre-shared key")
+		}
+		return nil
+	}
+}
+
+// HMACAuthToken makes a token for HMACTokenAuthenticator: the time,
+// authenticated with key. Unlike a bare pre-shared key, a token seen on
+// the wire stops working once it is maxAge old.
+func HMACAuthToken(key []byte, now time.Time) []byte {
+	token := binary.BigEndian.AppendUint64(make([]byte, 0, hmacTokenSize), uint64(now.UnixMilli()))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(token)
+	return mac.Sum(token)
+}
+
+// HMACTokenAuthenticator admits peers presenting a token from
+// HMACAuthToken under the same key, made no more than maxAge from now
+// either way to allow for clock skew
+func HMACTokenAuthenticator(key []byte, maxAge time.Duration) HandshakeAuthenticator {
+	key = append([]byte(nil), key...)
+	return func(peer SocketAddr, token []byte) error {
+		if len(token) != hmacTokenSize {
+			return fmt.Errorf("auth token is %d bytes, expected %d", len(token), hmacTokenSize)
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(token[:8])
+		if !hmac.Equal(mac.Sum(nil), token[8:]) {
+			return fmt.Errorf("auth token does not verify")
+		}
+		age := clockNow().Sub(time.UnixMilli(int64(binary.BigEndian.Uint64(token))))
+		if age > maxAge || age < -maxAge {
+			return fmt.Errorf("auth token is %v old", age.Round(time.Millisecond))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,93 @@
+package ultrafast
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandshakeAuthenticator(t *testing.T) {
+	server := startTestServer(t)
+	var seen atomic.Pointer[[]byte] // set on the event loop
+	psk := PSKAuthenticator([]byte("opensesame"))
+	server.OnHandshake(func(peer SocketAddr, token []byte) error {
+		seen.Store(&token)
+		return psk(peer, token)
+	})
+
+	for _, token := range [][]byte{nil, []byte("opensesamf")} {
+		client := newTestClient(t, server)
+		if err := client.SetAuthToken(token); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Connect(); err == nil || !strings.Contains(err.Error(), "reset") {
+			t.Errorf("Token %q: expected the connection reset, got %v", token, err)
+		}
+	}
+	if rejected := server.GetStats().HandshakesRejected; rejected != 2 {
+		t.Errorf("Expected 2 rejected handshakes, got %d", rejected)
+	}
+	if n := server.connections.Len(); n != 0 {
+		t.Errorf("Rejected handshakes left %d connections behind", n)
+	}
+
+	client := newTestClient(t, server)
+	client.SetAuthToken([]byte("opensesame"))
+	if _, err := client.Get("/benchmark"); err != nil {
+		t.Fatalf("Request with the right key failed: %v", err)
+	}
+	if token := *seen.Load(); string(token) != "opensesame" {
+		t.Errorf("Authenticator was given token %q", token)
+	}
+
+	// A resuming SYN is authenticated too, before its ticket is spent
+	ticket := client.SessionTicket()
+	if ticket == nil {
+		t.Fatal("No session ticket was issued")
+	}
+	resumer := newTestClient(t, server)
+	resumer.SetSessionTicket(ticket)
+	if _, err := resumer.Resume(buildGetRequest("/benchmark", resumer.server)); err == nil {
+		t.Error("Resumption without the key should be refused")
+	}
+	if rejected := server.GetStats().HandshakesRejected; rejected != 3 {
+		t.Errorf("Expected 3 rejected handshakes, got %d", rejected)
+	}
+
+	server.OnHandshake(nil)
+	if err := newTestClient(t, server).Connect(); err != nil {
+		t.Errorf("Handshake without an authenticator failed: %v", err)
+	}
+	if err := newTestClient(t, server).SetAuthToken(make([]byte, 256)); err == nil {
+		t.Error("A token longer than an option should be refused")
+	}
+}
+
+func TestHMACTokenAuthenticator(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	auth := HMACTokenAuthenticator(key, time.Minute)
+	peer := SocketAddr{IP: "127.0.0.1", Port: 4000}
+
+	if err := auth(peer, HMACAuthToken(key, time.Now())); err != nil {
+		t.Errorf("Fresh token refused: %v", err)
+	}
+	if err := auth(peer, HMACAuthToken(key, time.Now().Add(30*time.Second))); err != nil {
+		t.Errorf("Token within the skew refused: %v", err)
+	}
+
+	tampered := HMACAuthToken(key, time.Now())
+	tampered[len(tampered)-1] ^= 1
+	for name, token := range map[string][]byte{
+		"stale":     HMACAuthToken(key, time.Now().Add(-2*time.Minute)),
+		"future":    HMACAuthToken(key, time.Now().Add(2*time.Minute)),
+		"wrong key": HMACAuthToken([]byte("fedcba9876543210"), time.Now()),
+		"tampered":  tampered,
+		"truncated": HMACAuthToken(key, time.Now())[:20],
+		"missing":   nil,
+	} {
+		if err := auth(peer, token); err == nil {
+			t.Errorf("%s token accepted", name)
+		}
+	}
+}
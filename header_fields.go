@@ -0,0 +1,85 @@
+// Code generated by go run ./cmd/headergen; DO NOT EDIT.
+
+package ultrafast
+
+import "encoding/binary"
+
+// Offsets of the fixed header fields
+const (
+	headerVersionTypeOffset = 0
+	headerFlagsOffset       = 1
+	headerLengthOffset      = 2
+	headerSeqNumOffset      = 4
+	headerAckNumOffset      = 8
+	headerChecksumOffset    = 12
+)
+
+// Version returns the protocol version, the high nibble of the first byte
+func (h PacketHeader) Version() uint8 {
+	return h[headerVersionTypeOffset] >> 4 & 0x0F
+}
+
+// SetVersion sets the protocol version, the high nibble of the first byte
+func (h PacketHeader) SetVersion(v uint8) {
+	h[headerVersionTypeOffset] = h[headerVersionTypeOffset]&^0xF0 | v&0x0F<<4
+}
+
+// Type returns the packet type, the low nibble of the first byte
+func (h PacketHeader) Type() uint8 {
+	return h[headerVersionTypeOffset] & 0x0F
+}
+
+// SetType sets the packet type, the low nibble of the first byte
+func (h PacketHeader) SetType(v uint8) {
+	h[headerVersionTypeOffset] = h[headerVersionTypeOffset]&^0x0F | v&0x0F
+}
+
+// Flags returns the control flags
+func (h PacketHeader) Flags() uint8 {
+	return h[headerFlagsOffset]
+}
+
+// SetFlags sets the control flags
+func (h PacketHeader) SetFlags(v uint8) {
+	h[headerFlagsOffset] = v
+}
+
+// Length returns the total packet length, options and payload included
+func (h PacketHeader) Length() uint16 {
+	return binary.BigEndian.Uint16(h[headerLengthOffset:])
+}
+
+// SetLength sets the total packet length, options and payload included
+func (h PacketHeader) SetLength(v uint16) {
+	binary.BigEndian.PutUint16(h[headerLengthOffset:], v)
+}
+
+// SeqNum returns the sequence number
+func (h PacketHeader) SeqNum() uint32 {
+	return binary.BigEndian.Uint32(h[headerSeqNumOffset:])
+}
+
+// SetSeqNum sets the sequence number
+func (h PacketHeader) SetSeqNum(v uint32) {
+	binary.BigEndian.PutUint32(h[headerSeqNumOffset:], v)
+}
+
+// AckNum returns the acknowledgment number
+func (h PacketHeader) AckNum() uint32 {
+	return binary.BigEndian.Uint32(h[headerAckNumOffset:])
+}
+
+// SetAckNum sets the acknowledgment number
+func (h PacketHeader) SetAckNum(v uint32) {
+	binary.BigEndian.PutUint32(h[headerAckNumOffset:], v)
+}
+
+// Checksum returns the checksum
+func (h PacketHeader) Checksum() uint32 {
+	return binary.BigEndian.Uint32(h[headerChecksumOffset:])
+}
+
+// SetChecksum sets the checksum
+func (h PacketHeader) SetChecksum(v uint32) {
+	binary.BigEndian.PutUint32(h[headerChecksumOffset:], v)
+}
@@ -0,0 +1,70 @@
+package ultrafast
+
+import "sync/atomic"
+
+// Built-in probe endpoints, answered on every host unless a route
+// overrides them
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+)
+
+// SetReady marks the server ready or not ready for traffic. A server is
+// ready by default once its event loop is running; SetReady(false) takes
+// it out of a load balancer's rotation without stopping it, for example
+// while warming caches or before maintenance.
+func (s *UltraFastHTTPServer) SetReady(ready bool) {
+	value := int32(1)
+	if ready {
+		value = 0
+	}
+	atomic.StoreInt32(&s.notReady, value)
+}
+
+// Ready reports whether the server should receive traffic: its event
+// loop is running, it is not draining for shutdown, and it has not been
+// marked not ready with SetReady
+func (s *UltraFastHTTPServer) Ready() bool {
+	return s.readiness() == ""
+}
+
+// readiness returns why the server is not ready, or "" if it is
+func (s *UltraFastHTTPServer) readiness() string {
+	switch {
+	case atomic.LoadInt32(&s.loopRunning) == 0:
+		return "event loop not running"
+	case s.IsDraining():
+		return "draining"
+	case atomic.LoadInt32(&s.notReady) == 1:
+		return "marked not ready"
+	}
+	return ""
+}
+
+// probeResponse answers the liveness and readiness probes, returning nil
+// for other paths. /healthz succeeds whenever the server can answer at
+// all; /readyz fails with 503 while the server is not ready.
+func (s *UltraFastHTTPServer) probeResponse(path string) *HTTPResponse {
+	var status int
+	var body string
+	switch path {
+	case healthzPath:
+		status, body = 200, "ok"
+	case readyzPath:
+		if reason := s.readiness(); reason != "" {
+			status, body = 503, "not ready: "+reason
+		} else {
+			status, body = 200, "ready"
+		}
+	default:
+		return nil
+	}
+	return &HTTPResponse{
+		StatusCode: status,
+		Headers: map[string]string{
+			"Content-Type":  "text/plain",
+			"Cache-Control": "no-store",
+		},
+		Body: []byte(body),
+	}
+}
@@ -0,0 +1,56 @@
+package ultrafast
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestServerReadiness(t *testing.T) {
+	server, err := NewUltraFastHTTPServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if server.Ready() {
+		t.Error("Server should not be ready before its event loop starts")
+	}
+	go server.Start()
+	t.Cleanup(func() { server.Close() })
+
+	// Probes are answered even when a virtual host takes every request
+	server.SetDefaultHost("app.example")
+	client := newTestClient(t, server)
+	probe := func(path string) string {
+		t.Helper()
+		response, err := client.Get(path)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		return string(response)
+	}
+
+	if response := probe("/healthz"); !containsString(response, "200 OK") {
+		t.Errorf("Expected /healthz to succeed, got %q", response)
+	}
+	if response := probe("/readyz"); !containsString(response, "200 OK") || !server.Ready() {
+		t.Errorf("Expected /readyz to succeed once serving, got %q", response)
+	}
+
+	server.SetReady(false)
+	if response := probe("/readyz"); !containsString(response, "503 Service Unavailable") ||
+		!containsString(response, "marked not ready") {
+		t.Errorf("Expected /readyz to fail after SetReady(false), got %q", response)
+	}
+	if response := probe("/healthz"); !containsString(response, "200 OK") {
+		t.Errorf("Liveness should not depend on readiness, got %q", response)
+	}
+	server.SetReady(true)
+
+	atomic.StoreInt32(&server.draining, 1)
+	if server.Ready() {
+		t.Error("Server should not be ready while draining")
+	}
+	atomic.StoreInt32(&server.draining, 0)
+	if !server.Ready() {
+		t.Error("Server should be ready again")
+	}
+}
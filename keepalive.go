@@ -0,0 +1,195 @@
+package ultrafast
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Keep-alive defaults
+const (
+	defaultIdleTimeout              = 30 * time.Second
+	defaultMaxRequestsPerConnection = 1000
+	defaultMaxConnections           = 65536
+)
+
+// KeepAliveConfig controls how long connections serve requests. Zero
+// values take the defaults.
+type KeepAliveConfig struct {
+	IdleTimeout    time.Duration // close a connection with no traffic for this long, default 30s
+	MaxRequests    uint64        // requests served before the connection is closed, default 1000
+	MaxConnections int           // connections tracked at once, default 65536
+}
+
+// SetKeepAlive configures connection reuse. Each connection serves
+// requests until it has been idle for IdleTimeout or has answered
+// MaxRequests; the last response says "Connection: close" and the server
+// then ends the connection with a FIN. A new connection beyond
+// MaxConnections evicts the least recently active one, bounding the
+// memory held for peers that vanished without closing.
+func (s *UltraFastHTTPServer) SetKeepAlive(config KeepAliveConfig) {
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = defaultIdleTimeout
+	}
+	if config.MaxRequests == 0 {
+		config.MaxRequests = defaultMaxRequestsPerConnection
+	}
+	if config.MaxConnections <= 0 {
+		config.MaxConnections = defaultMaxConnections
+	}
+	s.keepAlive.Store(&config)
+	s.connections.SetCapacity(config.MaxConnections)
+}
+
+// KeepAlive returns the keep-alive configuration
+func (s *UltraFastHTTPServer) KeepAlive() KeepAliveConfig {
+	return *s.keepAlive.Load()
+}
+
+// countRequest records a request on the connection and reports whether
+// the connection stays open after answering it
+func (c *Connection) countRequest(request *HTTPRequest, config KeepAliveConfig) bool {
+	served := atomic.AddUint64(&c.requestsServed, 1)
+	if served >= config.MaxRequests || strings.EqualFold(request.Header("Connection"), "close") {
+		atomic.StoreInt32(&c.closing, 1)
+	}
+	return atomic.LoadInt32(&c.closing) == 0
+}
+
+// RequestsServed returns the number of requests received on the connection
+func (c *Connection) RequestsServed() uint64 {
+	return atomic.LoadUint64(&c.requestsServed)
+}
+
+// idle reports whether the connection has had no traffic and no requests
+// in progress for longer than timeout
+func (c *Connection) idle(now time.Time, timeout time.Duration) bool {
+	return c.ActiveRequests() == 0 && now.Sub(c.LastActive()) > timeout
+}
+
+// closeAfterResponse ends a connection marked for closing once its last
+// request has been answered
+func (h *HTTPSocketHandler) closeAfterResponse(conn *Connection) {
+	if atomic.LoadInt32(&conn.closing) == 1 && conn.ActiveRequests() == 0 {
+		h.closeConnection(conn)
+	}
+}
+
+// closeConnection sends FIN to a connection's peer and forgets the
+// connection, unless it is already gone. While data waits for the
+// congestion window the FIN is put off, and sent once it has gone out.
+func (h *HTTPSocketHandler) closeConnection(conn *Connection) {
+	peer := h.server.connections.PeerOf(conn)
+	if h.server.connections.Get(peer) != conn {
+		return
+	}
+	h.flushBatch(conn)
+	if conn.windowQueued() > 0 {
+		atomic.StoreInt32(&conn.closing, 1)
+		return
+	}
+	h.sendPacket(NewPacket(FIN_PACKET, FIN_FLAG, conn.Reliability().nextUntrackedSeqNum(), 0, nil), peer)
+	h.dropConnection(peer)
+}
+
+// dropConnection forgets a peer's connection, cancelling its requests
+func (h *HTTPSocketHandler) dropConnection(peer SocketAddr) {
+	if conn := h.server.connections.Remove(peer); conn != nil {
+		h.connectionRemoved(conn)
+	}
+}
+
+// connectionRemoved does the bookkeeping for a connection the table no
+// longer tracks
+func (h *HTTPSocketHandler) connectionRemoved(conn *Connection) {
+	reason := FLOW_END_OF_FLOW
+	if conn.Err() != nil {
+		reason = FLOW_END_FORCED
+	} else if conn.idle(clockNow(), h.server.KeepAlive().IdleTimeout) {
+		reason = FLOW_END_IDLE
+	}
+	h.connectionEnded(conn, reason)
+}
+
+// connectionEnded does the work of connectionRemoved, for a connection
+// that ended for reason
+func (h *HTTPSocketHandler) connectionEnded(conn *Connection, reason FlowEndReason) {
+	h.server.exportFlow(conn, reason)
+	atomic.AddUint64(&h.server.stats.ConnectionsActive, ^uint64(0)) // Atomic decrement
+	if stream := conn.stream.Load(); stream != nil {
+		if err := conn.Err(); err != nil {
+			stream.fail(err)
+		} else {
+			stream.remoteClosed()
+		}
+	} else if reader := conn.Reliability().reader.Load(); reader != nil {
+		if err := conn.Err(); err != nil {
+			reader.fail(err)
+		} else {
+			reader.finish()
+		}
+	}
+}
+
+// evictConnection ends a connection the table dropped to make room for a
+// new one. The FIN tells the peer, should it still be there, to reconnect.
+func (h *HTTPSocketHandler) evictConnection(conn *Connection) {
+	atomic.AddUint64(&h.server.stats.ConnectionsEvicted, 1)
+	peer := h.server.connections.PeerOf(conn)
+	h.sendPacket(NewPacket(FIN_PACKET, FIN_FLAG, conn.Reliability().nextUntrackedSeqNum(), 0, nil), peer)
+	h.connectionEnded(conn, FLOW_END_LACK_OF_RESOURCES)
+}
+
+// connectionWorker periodically expires stalled requests, closes idle
+// connections and aborts those whose peer has stopped acknowledging
+func (s *UltraFastHTTPServer) connectionWorker(h *HTTPSocketHandler) {
+	ticker := time.NewTicker(requestSweepInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt32(&s.running) == 1 {
+		<-ticker.C
+		s.sweepConnections(h, clockNow())
+	}
+}
+
+// sweepConnections runs the connection worker's checks once, as of now,
+// submitting what they find to the event loop
+func (s *UltraFastHTTPServer) sweepConnections(h *HTTPSocketHandler, now time.Time) {
+	idleTimeout := s.KeepAlive().IdleTimeout
+	for _, conn := range s.connections.Snapshot() {
+		if conn.peerGone() {
+			conn := conn
+			s.eventLoop.Submit(func() {
+				h.abortConnection(conn)
+			})
+			continue
+		}
+		s.expireRequests(h, conn, now)
+		conn.expirePaths(now)
+
+		// Timeouts open the window without an ACK to release the queue
+		if conn.windowQueued() > 0 && conn.Reliability().CanSend() {
+			conn := conn
+			s.eventLoop.Submit(func() {
+				h.releaseWindow(conn, s.connections.PeerOf(conn))
+			})
+		}
+
+		// Streams time out their own reads
+		if conn.stream.Load() == nil && conn.idle(now, idleTimeout) {
+			conn := conn
+			s.eventLoop.Submit(func() {
+				// A request may have arrived since the sweep
+				if conn.idle(clockNow(), idleTimeout) {
+					h.closeConnection(conn)
+				}
+			})
+		}
+	}
+
+	if endpoint := s.quic.Load(); endpoint != nil {
+		s.eventLoop.Submit(func() {
+			endpoint.tick(clockNow())
+		})
+	}
+}
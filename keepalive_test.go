@@ -0,0 +1,87 @@
+package ultrafast
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForConnections polls until the server tracks n connections
+func waitForConnections(t *testing.T, server *UltraFastHTTPServer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for server.connections.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d connections, have %d", n, server.connections.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClosesConnection(t *testing.T) {
+	tests := map[string]bool{
+		"HTTP/1.1 200 OK\r\nConnection: close\r\n\r\n":       true,
+		"HTTP/1.1 200 OK\r\nconnection:  Close \r\n\r\nbody": true,
+		"HTTP/1.1 200 OK\r\nConnection: keep-alive\r\n\r\n":  false,
+		"HTTP/1.1 200 OK\r\n\r\nConnection: close\r\n\r\n":   false,
+		"HTTP/1.1 200 OK\r\nX-Connection: close\r\n\r\nbody": false,
+	}
+	for response, closes := range tests {
+		if got := closesConnection([]byte(response)); got != closes {
+			t.Errorf("closesConnection(%q) = %v, want %v", response, got, closes)
+		}
+	}
+}
+
+func TestServerKeepAlive(t *testing.T) {
+	server := startTestServer(t)
+	server.SetKeepAlive(KeepAliveConfig{MaxRequests: 3})
+	client := newTestClient(t, server)
+
+	// Sequential requests share one connection until the request limit
+	for i := 1; i <= 3; i++ {
+		response, err := client.Get("/benchmark")
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		want := "Connection: keep-alive\r\n"
+		if i == 3 {
+			want = "Connection: close\r\n"
+		}
+		if !strings.Contains(string(response), want) {
+			t.Errorf("Request %d: expected %q in %q", i, want, response)
+		}
+		if i < 3 && server.connections.Len() != 1 {
+			t.Errorf("Request %d: expected 1 connection, have %d", i, server.connections.Len())
+		}
+	}
+	waitForConnections(t, server, 0)
+
+	// The client reconnects for the next request
+	if _, err := client.Get("/benchmark"); err != nil {
+		t.Fatalf("Request after close failed: %v", err)
+	}
+	waitForConnections(t, server, 1)
+
+	// A request asking to close ends the connection
+	response, err := client.Do([]byte("GET /benchmark HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !strings.Contains(string(response), "Connection: close\r\n") {
+		t.Errorf("Expected Connection: close, got %q", response)
+	}
+	waitForConnections(t, server, 0)
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	server := startTestServer(t)
+	server.SetKeepAlive(KeepAliveConfig{IdleTimeout: 100 * time.Millisecond})
+	client := newTestClient(t, server)
+
+	if _, err := client.Get("/benchmark"); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	waitForConnections(t, server, 1)
+	waitForConnections(t, server, 0)
+}
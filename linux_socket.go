@@ -1,78 +1,106 @@
-package main
+//go:build linux
+
+package ultrafast
 
 import (
 	"fmt"
-	"syscall"
-)
+	"os"
+	"time"
 
-// LinuxUDPSocket represents a high-performance Linux UDP socket
-type LinuxUDPSocket struct {
-	fd          int
-	localAddr   SocketAddr
-	nonBlocking bool
-}
+	"golang.org/x/sys/unix"
+)
 
-// SocketAddr represents an IP address and port
-type SocketAddr struct {
-	IP   string
-	Port uint16
-}
+// socketFD is how the platform names a socket: a file descriptor here, a
+// handle on Windows
+type socketFD = int
 
 // NewLinuxUDPSocket creates a new Linux UDP socket optimized for performance
 func NewLinuxUDPSocket() (*LinuxUDPSocket, error) {
 	// Create UDP socket with optimizations
-	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, unix.IPPROTO_UDP)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create socket: %v", err)
 	}
 
-	socket := &LinuxUDPSocket{
-		fd: fd,
-	}
+	socket := wrapSocketFD(fd)
 
 	// Set socket options for better performance
 	if err := socket.setSocketOptions(); err != nil {
-		syscall.Close(fd)
+		unix.Close(fd)
 		return nil, fmt.Errorf("failed to set socket options: %v", err)
 	}
 
 	return socket, nil
 }
 
+// newLinuxUDPSocketFromFD wraps an already bound UDP socket, such as one
+// inherited from another process
+func newLinuxUDPSocketFromFD(fd int) (*LinuxUDPSocket, error) {
+	socket := wrapSocketFD(fd)
+	boundAddr, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bound address: %v", err)
+	}
+	boundInet4, ok := boundAddr.(*unix.SockaddrInet4)
+	if !ok {
+		return nil, fmt.Errorf("fd %d is not an IPv4 socket", fd)
+	}
+	socket.localAddr = SocketAddr{
+		IP: fmt.Sprintf("%d.%d.%d.%d",
+			boundInet4.Addr[0], boundInet4.Addr[1],
+			boundInet4.Addr[2], boundInet4.Addr[3]),
+		Port: uint16(boundInet4.Port),
+	}
+	return socket, nil
+}
+
 // setSocketOptions configures the socket for high performance
 func (s *LinuxUDPSocket) setSocketOptions() error {
 	// Enable address reuse
-	if err := syscall.SetsockoptInt(s.fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+	if err := unix.SetsockoptInt(s.sock(), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
 		return fmt.Errorf("SO_REUSEADDR: %v", err)
 	}
 
 	// Enable port reuse (Linux specific)
-	if err := syscall.SetsockoptInt(s.fd, syscall.SOL_SOCKET, unix_SO_REUSEPORT, 1); err != nil {
+	if err := unix.SetsockoptInt(s.sock(), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
 		// Not critical if this fails on older kernels
 	}
 
 	// Increase receive buffer size for high throughput
-	if err := syscall.SetsockoptInt(s.fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 2*1024*1024); err != nil {
+	if err := unix.SetsockoptInt(s.sock(), unix.SOL_SOCKET, unix.SO_RCVBUF, 2*1024*1024); err != nil {
 		return fmt.Errorf("SO_RCVBUF: %v", err)
 	}
 
 	// Increase send buffer size
-	if err := syscall.SetsockoptInt(s.fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, 2*1024*1024); err != nil {
+	if err := unix.SetsockoptInt(s.sock(), unix.SOL_SOCKET, unix.SO_SNDBUF, 2*1024*1024); err != nil {
 		return fmt.Errorf("SO_SNDBUF: %v", err)
 	}
 
 	// Enable timestamp reception for precise RTT measurements
-	if err := syscall.SetsockoptInt(s.fd, syscall.SOL_SOCKET, unix_SO_TIMESTAMPING,
-		unix_SOF_TIMESTAMPING_RX_SOFTWARE|unix_SOF_TIMESTAMPING_TX_SOFTWARE); err != nil {
+	if err := unix.SetsockoptInt(s.sock(), unix.SOL_SOCKET, unix.SO_TIMESTAMPING,
+		unix.SOF_TIMESTAMPING_RX_SOFTWARE|unix.SOF_TIMESTAMPING_TX_SOFTWARE); err != nil {
 		// Not critical if this fails
 	}
 
 	return nil
 }
 
-// GetFD returns the socket file descriptor
-func (s *LinuxUDPSocket) GetFD() int {
-	return s.fd
+// SetBufferSizes sets the kernel's receive and send buffers, in bytes,
+// overriding the 2MB given to new sockets; 0 leaves one unchanged. The
+// kernel doubles the values and caps them at net.core.rmem_max and
+// wmem_max.
+func (s *LinuxUDPSocket) SetBufferSizes(recv, send int) error {
+	if recv > 0 {
+		if err := unix.SetsockoptInt(s.sock(), unix.SOL_SOCKET, unix.SO_RCVBUF, recv); err != nil {
+			return fmt.Errorf("SO_RCVBUF: %v", err)
+		}
+	}
+	if send > 0 {
+		if err := unix.SetsockoptInt(s.sock(), unix.SOL_SOCKET, unix.SO_SNDBUF, send); err != nil {
+			return fmt.Errorf("SO_SNDBUF: %v", err)
+		}
+	}
+	return nil
 }
 
 // Bind binds the socket to a local address and port
@@ -82,22 +110,22 @@ func (s *LinuxUDPSocket) Bind(ip string, port uint16) error {
 		return fmt.Errorf("invalid IP address: %s", ip)
 	}
 
-	addr := syscall.SockaddrInet4{
+	addr := unix.SockaddrInet4{
 		Port: int(port),
 		Addr: [4]byte{ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3]},
 	}
 
-	if err := syscall.Bind(s.fd, &addr); err != nil {
+	if err := unix.Bind(s.sock(), &addr); err != nil {
 		return fmt.Errorf("failed to bind socket: %v", err)
 	}
 
 	// Get the actual bound address
-	boundAddr, err := syscall.Getsockname(s.fd)
+	boundAddr, err := unix.Getsockname(s.sock())
 	if err != nil {
 		return fmt.Errorf("failed to get bound address: %v", err)
 	}
 
-	if boundInet4, ok := boundAddr.(*syscall.SockaddrInet4); ok {
+	if boundInet4, ok := boundAddr.(*unix.SockaddrInet4); ok {
 		s.localAddr = SocketAddr{
 			IP: fmt.Sprintf("%d.%d.%d.%d",
 				boundInet4.Addr[0], boundInet4.Addr[1],
@@ -109,11 +137,6 @@ func (s *LinuxUDPSocket) Bind(ip string, port uint16) error {
 	return nil
 }
 
-// GetLocalAddr returns the local address
-func (s *LinuxUDPSocket) GetLocalAddr() SocketAddr {
-	return s.localAddr
-}
-
 // SendTo sends data to a specific address
 func (s *LinuxUDPSocket) SendTo(data []byte, ip string, port uint16) (int, error) {
 	if len(data) == 0 {
@@ -125,27 +148,44 @@ func (s *LinuxUDPSocket) SendTo(data []byte, ip string, port uint16) (int, error
 		return 0, fmt.Errorf("invalid IP address: %s", ip)
 	}
 
-	destAddr := &syscall.SockaddrInet4{
+	destAddr := &unix.SockaddrInet4{
 		Port: int(port),
 		Addr: [4]byte{ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3]},
 	}
 
-	err := syscall.Sendto(s.fd, data, 0, destAddr)
+	if err := s.applyDeadline(soSndTimeo, &s.writeDeadline, &s.sendTimeout); err != nil {
+		return 0, err
+	}
+	err := unix.Sendto(s.sock(), data, 0, destAddr)
 	if err != nil {
-		return 0, fmt.Errorf("sendto failed: %v", err)
+		if s.deadlinePassed(&s.writeDeadline, err) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return 0, &SocketError{Op: "sendto", Err: err}
 	}
 	return len(data), nil
 }
 
 // RecvFrom receives data and returns sender address
 func (s *LinuxUDPSocket) RecvFrom(buffer []byte) (int, SocketAddr, error) {
-	n, from, err := syscall.Recvfrom(s.fd, buffer, 0)
+	if err := s.applyDeadline(soRcvTimeo, &s.readDeadline, &s.recvTimeout); err != nil {
+		return 0, SocketAddr{}, err
+	}
+	n, from, err := unix.Recvfrom(s.sock(), buffer, 0)
 	if err != nil {
-		return 0, SocketAddr{}, fmt.Errorf("failed to receive: %v", err)
+		if s.deadlinePassed(&s.readDeadline, err) {
+			return 0, SocketAddr{}, os.ErrDeadlineExceeded
+		}
+		return 0, SocketAddr{}, &SocketError{Op: "recvfrom", Err: err}
 	}
 
+	// Nothing else empties the error queue of a socket read outside the
+	// event loop, and its transmit timestamps count against the receive
+	// buffer until datagrams are dropped
+	drainErrorQueue(s.sock())
+
 	var fromAddr SocketAddr
-	if fromInet4, ok := from.(*syscall.SockaddrInet4); ok {
+	if fromInet4, ok := from.(*unix.SockaddrInet4); ok {
 		fromAddr = SocketAddr{
 			IP: fmt.Sprintf("%d.%d.%d.%d",
 				fromInet4.Addr[0], fromInet4.Addr[1],
@@ -157,103 +197,67 @@ func (s *LinuxUDPSocket) RecvFrom(buffer []byte) (int, SocketAddr, error) {
 	return n, fromAddr, nil
 }
 
-// SetNonBlocking sets non-blocking mode
-func (s *LinuxUDPSocket) SetNonBlocking(nonBlocking bool) error {
-	// Use direct syscall for Linux compatibility
-	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(s.fd), syscall.F_GETFL, 0)
-	if errno != 0 {
-		return fmt.Errorf("failed to get socket flags: %v", errno)
-	}
-
-	if nonBlocking {
-		flags |= syscall.O_NONBLOCK
-	} else {
-		flags &^= syscall.O_NONBLOCK
+// drainErrorQueue discards whatever waits on a socket's error queue:
+// transmit timestamps, and errors its pending error also reports
+func drainErrorQueue(fd int) {
+	var data [256]byte
+	var control [512]byte
+	for {
+		iov := unix.Iovec{Base: &data[0]}
+		iov.SetLen(len(data))
+		msg := unix.Msghdr{Iov: &iov, Iovlen: 1, Control: &control[0]}
+		msg.SetControllen(len(control))
+		if _, err := recvmsg(fd, &msg, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT); err != nil {
+			return
+		}
 	}
+}
 
-	_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, uintptr(s.fd), syscall.F_SETFL, flags)
-	if errno != 0 {
-		return fmt.Errorf("failed to set non-blocking mode: %v", errno)
+// SetNonBlocking sets non-blocking mode
+func (s *LinuxUDPSocket) SetNonBlocking(nonBlocking bool) error {
+	if err := unix.SetNonblock(s.sock(), nonBlocking); err != nil {
+		return fmt.Errorf("failed to set non-blocking mode: %v", err)
 	}
 
 	s.nonBlocking = nonBlocking
 	return nil
 }
 
-// IsNonBlocking returns whether socket is in non-blocking mode
-func (s *LinuxUDPSocket) IsNonBlocking() bool {
-	return s.nonBlocking
-}
-
 // Close closes the socket
 func (s *LinuxUDPSocket) Close() error {
-	if s.fd > 0 {
-		err := syscall.Close(s.fd)
-		s.fd = -1
-		return err
+	if fd := s.fd.Swap(-1); fd > 0 {
+		return unix.Close(int(fd))
 	}
 	return nil
 }
 
-// Linux-specific constants
+// Socket timeout options, named alike on every platform
 const (
-	unix_SO_REUSEPORT                 = 15
-	unix_SO_TIMESTAMPING              = 37
-	unix_SOF_TIMESTAMPING_RX_SOFTWARE = 1 << 0
-	unix_SOF_TIMESTAMPING_TX_SOFTWARE = 1 << 1
+	soRcvTimeo = unix.SO_RCVTIMEO
+	soSndTimeo = unix.SO_SNDTIMEO
 )
 
-// parseIPv4 converts IP string to byte array
-func parseIPv4(ip string) []byte {
-	var result [4]byte
-	var octet int
-	var octetIndex int
-
-	for i := 0; i < len(ip); i++ {
-		c := ip[i]
-		if c >= '0' && c <= '9' {
-			octet = octet*10 + int(c-'0')
-			if octet > 255 {
-				return nil
-			}
-		} else if c == '.' {
-			if octetIndex >= 3 {
-				return nil
-			}
-			result[octetIndex] = byte(octet)
-			octet = 0
-			octetIndex++
-		} else {
-			return nil
-		}
-	}
-
-	if octetIndex != 3 {
-		return nil
+// setTimeoutOption sets SO_RCVTIMEO or SO_SNDTIMEO to timeout, 0 for
+// none. A timeval rounds below a microsecond down to zero, which would
+// mean no timeout at all, so shorter timeouts are rounded up.
+func setTimeoutOption(fd socketFD, option int, timeout int64) error {
+	if timeout > 0 {
+		timeout = max(timeout, int64(time.Microsecond))
 	}
-	result[octetIndex] = byte(octet)
-	return result[:]
+	tv := unix.NsecToTimeval(timeout)
+	return unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, option, &tv)
 }
 
-// Network byte order conversion functions
-func htons(host uint16) uint16 {
-	return (host<<8)&0xff00 | (host>>8)&0x00ff
+// isTimeout reports whether a blocking call failed because its socket
+// timeout expired, which here looks like a non-blocking socket not ready
+func isTimeout(err error) bool {
+	return err == unix.EAGAIN
 }
 
-func ntohs(network uint16) uint16 {
-	return (network<<8)&0xff00 | (network>>8)&0x00ff
-}
-
-func htonl(host uint32) uint32 {
-	return ((host & 0x000000ff) << 24) |
-		((host & 0x0000ff00) << 8) |
-		((host & 0x00ff0000) >> 8) |
-		((host & 0xff000000) >> 24)
-}
-
-func ntohl(network uint32) uint32 {
-	return ((network & 0x000000ff) << 24) |
-		((network & 0x0000ff00) << 8) |
-		((network & 0x00ff0000) >> 8) |
-		((network & 0xff000000) >> 24)
+// keepUDPChecksum makes sure the kernel checksums outgoing datagrams
+func keepUDPChecksum(fd socketFD) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_NO_CHECK, 0); err != nil {
+		return fmt.Errorf("SO_NO_CHECK: %v", err)
+	}
+	return nil
 }
@@ -1,6 +1,7 @@
-package main
+package ultrafast
 
 import (
+	"os"
 	"testing"
 	"time"
 )
@@ -128,13 +129,20 @@ func TestLinuxSocketPerformance(t *testing.T) {
 	testData := make([]byte, 1024) // 1KB test packets
 	numPackets := 1000
 
-	// Start receiving in background
+	// Start receiving in background; the receiver stops quietly once the
+	// test has finished and the sockets are closed
+	done := make(chan struct{})
+	defer close(done)
 	go func() {
 		buffer := make([]byte, 2048)
 		for i := 0; i < numPackets; i++ {
 			_, _, err := server.RecvFrom(buffer)
 			if err != nil {
-				t.Errorf("Failed to receive packet %d: %v", i, err)
+				select {
+				case <-done:
+				default:
+					t.Errorf("Failed to receive packet %d: %v", i, err)
+				}
 				return
 			}
 		}
@@ -192,4 +200,95 @@ func TestLinuxSocketNonBlocking(t *testing.T) {
 	if err == nil {
 		t.Error("Expected error when no data available in non-blocking mode")
 	}
-}
\ No newline at end of file
+}
+func TestLinuxSocketReadDeadline(t *testing.T) {
+	socket, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	defer socket.Close()
+	if err := socket.Bind("127.0.0.1", 0); err != nil {
+		t.Fatalf("Failed to bind: %v", err)
+	}
+
+	buffer := make([]byte, 1024)
+	start := time.Now()
+	socket.SetReadDeadline(start.Add(50 * time.Millisecond))
+	if _, _, err := socket.RecvFrom(buffer); err != os.ErrDeadlineExceeded {
+		t.Fatalf("Expected the deadline exceeded, got %v", err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond || waited > time.Second {
+		t.Errorf("Expected to wait about 50ms, waited %v", waited)
+	}
+
+	// A passed deadline fails at once
+	if _, _, err := socket.RecvFrom(buffer); err != os.ErrDeadlineExceeded {
+		t.Errorf("Expected a passed deadline to fail, got %v", err)
+	}
+
+	// Clearing the deadline blocks again until data arrives
+	socket.SetReadDeadline(time.Time{})
+	addr := socket.GetLocalAddr()
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		time.Sleep(20 * time.Millisecond)
+		socket.SendTo([]byte("late"), addr.IP, addr.Port)
+	}()
+	if n, _, err := socket.RecvFrom(buffer); err != nil || string(buffer[:n]) != "late" {
+		t.Errorf("Expected the data without a deadline, got %q, %v", buffer[:n], err)
+	}
+	<-sent // before the deferred Close
+}
+
+func TestLinuxSocketCloseDuringSend(t *testing.T) {
+	socket, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	if err := socket.Bind("127.0.0.1", 0); err != nil {
+		t.Fatalf("Failed to bind: %v", err)
+	}
+
+	// Sends and deadline changes racing Close fail once it has run
+	addr := socket.GetLocalAddr()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			socket.SetWriteDeadline(time.Now().Add(time.Second))
+			socket.SendTo([]byte("x"), addr.IP, addr.Port)
+		}
+	}()
+	time.Sleep(time.Millisecond)
+	socket.Close()
+	<-done
+	if _, err := socket.SendTo([]byte("x"), addr.IP, addr.Port); err == nil {
+		t.Error("Expected a send on the closed socket to fail")
+	}
+}
+
+func TestLinuxSocketErrorQueueDrained(t *testing.T) {
+	socket, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	defer socket.Close()
+	if err := socket.Bind("127.0.0.1", 0); err != nil {
+		t.Fatalf("Failed to bind: %v", err)
+	}
+
+	// Every send queues a transmit timestamp; were they left on the error
+	// queue they would fill the receive buffer after a few thousand
+	addr := socket.GetLocalAddr()
+	buffer := make([]byte, 1024)
+	for i := 0; i < 20000; i++ {
+		if _, err := socket.SendTo([]byte("echo"), addr.IP, addr.Port); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+		socket.SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := socket.RecvFrom(buffer); err != nil {
+			t.Fatalf("Datagram %d was not received: %v", i, err)
+		}
+	}
+}
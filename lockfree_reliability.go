@@ -1,6 +1,7 @@
-package main
+package ultrafast
 
 import (
+	"fmt"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -11,11 +12,16 @@ type LockFreeReliabilityLayer struct {
 	// Atomic sequence number management
 	nextSeqNum uint64
 	
-	// Lock-free hash table for unacknowledged packets
+	// Lock-free hash table for unacknowledged packets; its entries are
+	// pooled, and recycled only once no reader can still hold them
 	unackedTable  *LockFreeHashTable
+	entries       *EpochDomain
+	timers        timingWheel // their retransmission timers
 	
-	// Lock-free queue for received packets
+	// Lock-free queue for received packets, holding at most recvWindow
 	recvQueue     *LockFreeQueue
+	recvQueued    int64
+	recvWindow    int64
 	
 	// Lock-free circular buffer for packet ordering
 	orderBuffer   *LockFreeRingBuffer
@@ -23,30 +29,139 @@ type LockFreeReliabilityLayer struct {
 	// Atomic configuration values
 	windowSize    uint32
 	congWindow    uint32
-	rttEstimate   uint64 // nanoseconds
-	timeoutBase   uint64 // nanoseconds
+	rttState      uint64 // rttEstimator.pack()
+	timeoutBase   uint64 // nanoseconds, the current RTO
+	ccAlgorithm   uint32 // CongestionAlgorithm
+	
+	// Fast retransmit and recovery state (atomic), see ProcessAck
+	sndUna        uint32 // oldest sequence number that may be unacknowledged
+	sentNext      uint32 // one past the latest DATA sequence number sent
+	resolved      []uint64 // per slot, 1<<32 | the last sequence number acked, given up on or never tracked
+	dupAcks       uint32 // ACKs received past sndUna since it was last acked
+	inRecovery    uint32 // atomic bool
+	recoverSeq    uint32 // the fast-retransmitted packet that ends recovery
+	ssthresh      uint32 // congestion window to fall back to after recovery
+	
+	// Set on the connectionless layer, whose peers share its sequence
+	// space: an ACK acknowledges AckNum-1 alone rather than cumulatively
+	selective     bool
+	
+	// Receive side: the ACKs owed for the peer's DATA packets
+	acks          ackTracker
+	ackDelay      int64 // nanoseconds (atomic), see SetAckDelay
+	reader        atomic.Pointer[OrderedReader] // set once taken, see Reader
+	
+	// Retransmission budget (atomic), see SetRetransmissionBudget
+	maxRetries      uint32
+	maxRetransmit   int64  // nanoseconds, 0 for no limit
+	retransmitSince uint64 // unix nanoseconds of the first timeout since the last ACK, 0 if none
+	onFailure       atomic.Pointer[func(*Packet)] // see OnDeliveryFailure
+	
+	// DATA packets sent and neither acknowledged nor presumed lost (atomic)
+	inFlight      int64
+	bytesInFlight int64 // their payload bytes
+	appLimited    uint32 // atomic bool, see AppLimited
+	
+	// Set once the connection closed, see Release
+	closed        uint32
 	
 	// Performance counters (atomic)
-	packetsSent   uint64
-	packetsRecv   uint64
-	packetsLost   uint64
-	packetsRetr   uint64
+	packetsSent    uint64
+	packetsRecv    uint64
+	packetsLost    uint64
+	packetsRetr    uint64
+	fastRetr       uint64
+	packetsExpired uint64
+	recvDropped    uint64
 }
 
 // NewLockFreeReliabilityLayer creates a new lock-free reliability layer
 func NewLockFreeReliabilityLayer() *LockFreeReliabilityLayer {
+	rf := newReliabilityLayer(NewEpochDomain(releaseUnackedEntry), NewEpochDomain(releaseQueueNode))
+	rf.unackedTable = NewLockFreeHashTable(16384) // 16K entries
+	rf.resolved = make([]uint64, 16384)
+	rf.orderBuffer = NewLockFreeRingBuffer(4096)  // 4K ordering buffer
+	rf.recvWindow = 4096
+	return rf
+}
+
+// connectionTableSize sizes the unacked table and ordering buffer of a
+// layer owned by one connection; sequence numbers only collide once this
+// many packets separate them
+const connectionTableSize = 1024
+
+// newConnectionReliabilityLayer creates the smaller layer a single
+// connection owns. Its entries and queue nodes are reclaimed through the
+// shard's epoch domains rather than a pair per connection.
+func newConnectionReliabilityLayer(entries, nodes *EpochDomain) *LockFreeReliabilityLayer {
+	rf := newReliabilityLayer(entries, nodes)
+	rf.unackedTable = NewLockFreeHashTable(connectionTableSize)
+	rf.resolved = make([]uint64, connectionTableSize)
+	rf.orderBuffer = NewLockFreeRingBuffer(connectionTableSize)
+	rf.recvWindow = connectionTableSize
+	return rf
+}
+
+// newReliabilityLayer sets up everything but the sized tables
+func newReliabilityLayer(entries, nodes *EpochDomain) *LockFreeReliabilityLayer {
 	return &LockFreeReliabilityLayer{
 		nextSeqNum:   1,
-		unackedTable: NewLockFreeHashTable(16384), // 16K entries
-		recvQueue:    NewLockFreeQueue(8192),      // 8K packet queue
-		orderBuffer:  NewLockFreeRingBuffer(4096), // 4K ordering buffer
+		sndUna:       1,
+		sentNext:     1,
+		entries:      entries,
+		recvQueue:    newLockFreeQueue(nodes),
 		windowSize:   32,
 		congWindow:   1,
-		rttEstimate:  uint64(100 * time.Millisecond), // 100ms initial RTT
-		timeoutBase:  uint64(1000 * time.Millisecond), // 1s base timeout
+		timeoutBase:  uint64(initialRTO), // until the first RTT sample
+		maxRetries:   maxRetransmissions,
+	}
+}
+
+// CongestionAlgorithm selects how the congestion window reacts to ACKs and loss
+type CongestionAlgorithm uint32
+
+const (
+	CC_RENO  CongestionAlgorithm = iota // Slow start, additive increase, multiplicative decrease
+	CC_FIXED                            // Window pinned to the flow control window (trusted LANs, benchmarks)
+)
+
+// ParseCongestionAlgorithm converts an algorithm name into a CongestionAlgorithm
+func ParseCongestionAlgorithm(name string) (CongestionAlgorithm, error) {
+	switch name {
+	case "reno":
+		return CC_RENO, nil
+	case "fixed":
+		return CC_FIXED, nil
+	default:
+		return CC_RENO, fmt.Errorf("unknown congestion algorithm: %s", name)
+	}
+}
+
+// String returns the algorithm name
+func (cc CongestionAlgorithm) String() string {
+	switch cc {
+	case CC_RENO:
+		return "reno"
+	case CC_FIXED:
+		return "fixed"
+	default:
+		return fmt.Sprintf("cc(%d)", uint32(cc))
 	}
 }
 
+// SetCongestionAlgorithm switches the congestion control algorithm at runtime
+func (rf *LockFreeReliabilityLayer) SetCongestionAlgorithm(cc CongestionAlgorithm) {
+	atomic.StoreUint32(&rf.ccAlgorithm, uint32(cc))
+	if cc == CC_FIXED {
+		atomic.StoreUint32(&rf.congWindow, atomic.LoadUint32(&rf.windowSize))
+	}
+}
+
+// GetCongestionAlgorithm returns the active congestion control algorithm
+func (rf *LockFreeReliabilityLayer) GetCongestionAlgorithm() CongestionAlgorithm {
+	return CongestionAlgorithm(atomic.LoadUint32(&rf.ccAlgorithm))
+}
+
 // GetNextSeqNum atomically gets the next sequence number
 func (rf *LockFreeReliabilityLayer) GetNextSeqNum() uint32 {
 	return uint32(atomic.AddUint64(&rf.nextSeqNum, 1) - 1)
@@ -55,103 +170,402 @@ func (rf *LockFreeReliabilityLayer) GetNextSeqNum() uint32 {
 // SendPacket records a packet for potential retransmission (lock-free)
 func (rf *LockFreeReliabilityLayer) SendPacket(packet *Packet) bool {
 	if !packet.IsDataPacket() {
+		rf.resolve(packet.SeqNum)
 		return true // Don't track non-data packets
 	}
 
-	now := uint64(time.Now().UnixNano())
-	entry := &UnackedEntry{
-		Packet:    packet,
-		SendTime:  now,
-		RetryCount: 0,
+	now := uint64(clockNow().UnixNano())
+	entry := unackedEntries.Get()
+	entry.Packet = packet
+	entry.SendTime = now
+	entry.RetryCount = 0
+	entry.Timeout = 0
+	entry.Landed = 0
+	entry.AppLimited = 0
+	if rf.appLimitedSend(atomic.LoadInt64(&rf.inFlight) + 1) {
+		entry.AppLimited = 1
 	}
+	atomic.StoreUint32(&rf.appLimited, entry.AppLimited)
+	timeout := atomic.LoadUint64(&rf.timeoutBase)
+	timer := wheelTimers.Get()
+	timer.deadline = wheelDeadline(now, timeout)
+	timer.key = uint64(packet.SeqNum)
+	timer.entry = unsafe.Pointer(entry)
+	entry.Timer = unsafe.Pointer(timer)
 
 	// Insert into lock-free hash table
 	success := rf.unackedTable.Insert(uint64(packet.SeqNum), unsafe.Pointer(entry))
 	if success {
+		rf.markSent(packet.SeqNum)
 		atomic.AddUint64(&rf.packetsSent, 1)
+		atomic.AddInt64(&rf.inFlight, 1)
+		atomic.AddInt64(&rf.bytesInFlight, int64(len(packet.Payload)))
+		rf.timers.schedule(timer, timeout)
+	} else {
+		wheelTimers.Put(timer)
+		releaseUnackedEntry(unsafe.Pointer(entry)) // never published
+		rf.resolve(packet.SeqNum)
+	}
+	
+	// A Release that ran concurrently may have missed the entry
+	if success && atomic.LoadUint32(&rf.closed) != 0 {
+		rf.releaseUnacked()
+		return false
 	}
 	return success
 }
 
-// HandleAck processes acknowledgment (lock-free)
+// HandleAck processes acknowledgment (lock-free). An ACK acknowledges
+// every packet before its AckNum, as long as AckNum is not past the next
+// sequence number to be sent, and the packets in its SACK blocks.
 func (rf *LockFreeReliabilityLayer) HandleAck(ackPacket *Packet) bool {
 	if !ackPacket.HasAck() {
 		return false
 	}
 
-	seqNum := ackPacket.AckNum - 1 // ACK number is next expected sequence
-	
-	// Remove from unacked table
-	entryPtr := rf.unackedTable.Remove(uint64(seqNum))
-	if entryPtr == nil {
-		return false // Already acked or invalid
+	guard := rf.entries.Pin()
+	defer guard.Unpin()
+	var acked ackedPackets
+	if !rf.removeAcked(ackPacket, &acked, guard) {
+		return false
+	}
+	if !rf.selective {
+		rf.advanceUna()
 	}
-
-	entry := (*UnackedEntry)(entryPtr)
 	
-	// Calculate RTT and update estimate
-	now := uint64(time.Now().UnixNano())
-	rtt := now - entry.SendTime
-	rf.updateRTTAtomic(rtt)
+	// Update congestion window, except for packets that never tested it
+	for i := acked.count - acked.appLimited; i > 0; i-- {
+		rf.updateCongestionWindow(true)
+	}
 	
-	// Update congestion window
-	rf.updateCongestionWindow(true)
+	return true
+}
+
+// ackedPackets sums up the packets one ACK acknowledged
+type ackedPackets struct {
+	each       func(seqNum uint32) // called with each of them, if set
+	count      int
+	appLimited int    // of them sent application-limited
+	newest     uint32 // the highest sequence number among them
+	sentAt     uint64 // the latest send time among those never retransmitted, 0 if none
+}
+
+// removeAcked drops the packets an ACK acknowledges from the unacked
+// table, adding them to acked, and samples the RTT from the most recently
+// sent of them. It reports whether the ACK acknowledged any.
+func (rf *LockFreeReliabilityLayer) removeAcked(ackPacket *Packet, acked *ackedPackets, guard EpochGuard) bool {
+	if rf.selective {
+		rf.removeRange(ackPacket.AckNum-1, ackPacket.AckNum, acked, guard)
+	} else {
+		// Only what is in flight, from sndUna up to the next to be sent
+		una := atomic.LoadUint32(&rf.sndUna)
+		window := rf.sendNext() - una
+		if ahead := ackPacket.AckNum - una; ahead > 0 && ahead <= window {
+			rf.removeRange(una, ackPacket.AckNum, acked, guard)
+		}
+		var buf [maxSACKBlocks]SACKBlock
+		for _, block := range ackPacket.sackBlocks(&buf) {
+			if int32(block.Start-una) < 0 && int32(block.End-una) > 0 {
+				block.Start = una
+			}
+			if block.Start-una <= window && block.End-una <= window {
+				rf.removeRange(block.Start, block.End, acked, guard)
+			}
+		}
+	}
+	if acked.count == 0 {
+		return false // already acked or invalid
+	}
+	atomic.StoreUint64(&rf.retransmitSince, 0) // the peer is still there
 	
+	// Calculate RTT and update estimate; per Karn's algorithm an ACK for a
+	// retransmitted packet is ambiguous and gives no sample
+	if acked.sentAt != 0 {
+		rf.updateRTTAtomic(uint64(clockNow().UnixNano()) - acked.sentAt)
+	}
 	return true
 }
 
+// removeRange drops the packets from start up to end from the unacked
+// table, adding them to acked
+func (rf *LockFreeReliabilityLayer) removeRange(start, end uint32, acked *ackedPackets, guard EpochGuard) {
+	for seq := start; seq != end; seq++ {
+		entry := rf.lookup(seq)
+		if entry == nil || !rf.unackedTable.CompareAndRemove(uint64(seq), unsafe.Pointer(entry)) {
+			continue
+		}
+		if acked.count == 0 || int32(seq-acked.newest) > 0 {
+			acked.newest = seq
+		}
+		acked.count++
+		if atomic.LoadUint32(&entry.AppLimited) != 0 {
+			acked.appLimited++
+		}
+		if atomic.LoadUint32(&entry.RetryCount) == 0 {
+			acked.sentAt = max(acked.sentAt, atomic.LoadUint64(&entry.SendTime))
+		}
+		rf.land(entry)
+		rf.resolve(seq)
+		guard.Retire(unsafe.Pointer(entry)) // a retransmission scan may still be reading it
+		if acked.each != nil {
+			acked.each(seq)
+		}
+	}
+}
+
 // ReceivePacket handles incoming packet (lock-free)
 func (rf *LockFreeReliabilityLayer) ReceivePacket(packet *Packet) bool {
 	if !packet.IsDataPacket() {
 		return true // Don't queue non-data packets
 	}
+	
+	// Once the reader is taken, payloads go to it rather than the queue
+	if reader := rf.reader.Load(); reader != nil {
+		if atomic.LoadUint32(&rf.closed) != 0 || !reader.push(packet.SeqNum, packet.Payload) {
+			atomic.AddUint64(&rf.recvDropped, 1)
+			return false
+		}
+		atomic.AddUint64(&rf.packetsRecv, 1)
+		return true
+	}
 
 	// Check for duplicates using atomic operations
 	if rf.isDuplicate(packet.SeqNum) {
 		return false
 	}
 
+	// A full receive window drops the packet; the peer retransmits it
+	if atomic.AddInt64(&rf.recvQueued, 1) > rf.recvWindow {
+		atomic.AddInt64(&rf.recvQueued, -1)
+		atomic.AddUint64(&rf.recvDropped, 1)
+		return false
+	}
+
 	// Add to receive queue
 	success := rf.recvQueue.Enqueue(unsafe.Pointer(packet))
 	if success {
 		atomic.AddUint64(&rf.packetsRecv, 1)
 		rf.markReceived(packet.SeqNum)
+	} else {
+		atomic.AddInt64(&rf.recvQueued, -1)
+		atomic.AddUint64(&rf.recvDropped, 1)
+	}
+	
+	if success && atomic.LoadUint32(&rf.closed) != 0 {
+		rf.GetOrderedPackets() // return the node a Release missed
+		return false
 	}
 	return success
 }
 
-// GetTimedOutPackets returns packets that need retransmission (lock-free scan)
+// Release recycles a closed connection's state: packets still awaiting
+// acknowledgment are dropped and their entries, like the nodes of the
+// receive queue, go back to their slabs once no reader holds them.
+// Packets sent or received afterwards are refused rather than tracked,
+// so nothing the layer allocates outlives the connection.
+func (rf *LockFreeReliabilityLayer) Release() {
+	atomic.StoreUint32(&rf.closed, 1)
+	rf.releaseUnacked()
+	rf.GetOrderedPackets()
+}
+
+// releaseUnacked retires every entry in the unacked table and frees
+// their timers
+func (rf *LockFreeReliabilityLayer) releaseUnacked() {
+	rf.expireUnacked(false)
+	rf.timers.clear()
+}
+
+// expireUnacked retires every entry in the unacked table. With expired
+// they were given up on, and are counted and reported as such.
+func (rf *LockFreeReliabilityLayer) expireUnacked(expired bool) {
+	guard := rf.entries.Pin()
+	defer guard.Unpin()
+	rf.unackedTable.ForEach(func(key uint64, valuePtr unsafe.Pointer) bool {
+		if rf.unackedTable.CompareAndRemove(key, valuePtr) {
+			entry := (*UnackedEntry)(valuePtr)
+			rf.land(entry)
+			rf.resolve(entry.Packet.SeqNum)
+			if expired {
+				rf.deliveryFailed(entry.Packet)
+			}
+			guard.Retire(valuePtr)
+		}
+		return true
+	})
+}
+
+// OnDeliveryFailure registers fn to be called with every packet given up
+// on past the retransmission budget. It runs during the timeout scan, or
+// as the connection is aborted, so it must not block. Passing nil
+// removes it.
+func (rf *LockFreeReliabilityLayer) OnDeliveryFailure(fn func(packet *Packet)) {
+	if fn == nil {
+		rf.onFailure.Store(nil)
+		return
+	}
+	rf.onFailure.Store(&fn)
+}
+
+// deliveryFailed counts a packet given up on and reports it
+func (rf *LockFreeReliabilityLayer) deliveryFailed(packet *Packet) {
+	atomic.AddUint64(&rf.packetsExpired, 1)
+	if fn := rf.onFailure.Load(); fn != nil {
+		(*fn)(packet)
+	}
+}
+
+// land stops counting a packet as in flight, once whether it was
+// acknowledged, presumed lost or dropped
+func (rf *LockFreeReliabilityLayer) land(entry *UnackedEntry) {
+	if atomic.CompareAndSwapUint32(&entry.Landed, 0, 1) {
+		atomic.AddInt64(&rf.inFlight, -1)
+		atomic.AddInt64(&rf.bytesInFlight, -int64(len(entry.Packet.Payload)))
+	}
+}
+
+// CanSend reports whether the congestion window, bounded by the flow
+// control window, has room for another DATA packet
+func (rf *LockFreeReliabilityLayer) CanSend() bool {
+	window := min(atomic.LoadUint32(&rf.congWindow), atomic.LoadUint32(&rf.windowSize))
+	return atomic.LoadInt64(&rf.inFlight) < int64(window)
+}
+
+// BytesInFlight returns the payload bytes of DATA packets sent and
+// neither acknowledged nor presumed lost
+func (rf *LockFreeReliabilityLayer) BytesInFlight() int64 {
+	return atomic.LoadInt64(&rf.bytesInFlight)
+}
+
+// GetTimedOutPackets returns packets that need retransmission (lock-free
+// scan). Packets past the retransmission budget are given up on instead:
+// one already retransmitted the maximum number of times, or every packet
+// once the layer has retransmitted for the maximum time without an ACK.
+// The peer is then presumed gone. A timed-out packet is presumed lost and
+// no longer counts as in flight, so it cannot hold the window shut.
 func (rf *LockFreeReliabilityLayer) GetTimedOutPackets() []*Packet {
-	now := uint64(time.Now().UnixNano())
+	return rf.AppendTimedOutPackets(nil)
+}
+
+// AppendTimedOutPackets is GetTimedOutPackets appending to dst, so a
+// caller scanning every tick can reuse one slice instead of allocating
+func (rf *LockFreeReliabilityLayer) AppendTimedOutPackets(dst []*Packet) []*Packet {
+	rf.ForEachTimedOutPacket(func(packet *Packet) {
+		dst = append(dst, packet)
+	})
+	return dst
+}
+
+// ForEachTimedOutPacket is GetTimedOutPackets calling fn with each packet
+// instead of collecting them. fn runs during the scan, so it must not
+// block. Only packets whose timer fired are visited, see timingWheel.
+//
+// Each packet backs off on its own as well: once retransmitted it waits
+// twice as long as the timeout that expired, up to maxRTO, even after a
+// fresh RTT sample from other packets shortens the RTO again.
+func (rf *LockFreeReliabilityLayer) ForEachTimedOutPacket(fn func(*Packet)) {
+	now := uint64(clockNow().UnixNano())
+	if rf.retransmitTimeSpent(now) {
+		rf.expireUnacked(true) // their timers are dropped as they fire
+		return
+	}
 	timeout := atomic.LoadUint64(&rf.timeoutBase)
+	maxRetries := atomic.LoadUint32(&rf.maxRetries)
 	
-	var timedOut []*Packet
+	timedOut := uint64(0)
+	var retransmitted *wheelTimer
 	
-	// Scan hash table for timed out packets
-	rf.unackedTable.ForEach(func(key uint64, valuePtr unsafe.Pointer) bool {
-		entry := (*UnackedEntry)(valuePtr)
+	// Entries stay valid while pinned
+	guard := rf.entries.Pin()
+	defer guard.Unpin()
+	w := &rf.timers
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	
+	// Deadlines computed from a longer RTO than the current one would fire
+	// late; the RTO rarely shrinks by much, so recheck every packet then
+	if armed := w.armed.Load(); timeout < armed - armed/8 {
+		w.expedite(timeout)
+	}
+	
+	w.advance(now / uint64(wheelTick), func(timer *wheelTimer) {
+		entry := (*UnackedEntry)(timer.entry)
+		if rf.unackedTable.Get(timer.key) != timer.entry || atomic.LoadPointer(&entry.Timer) != unsafe.Pointer(timer) {
+			wheelTimers.Put(timer) // acknowledged or given up on since
+			return
+		}
 		
-		if now - entry.SendTime > timeout {
-			timedOut = append(timedOut, entry.Packet)
-			// Update retry count atomically
-			atomic.AddUint32(&entry.RetryCount, 1)
-			atomic.AddUint64(&rf.packetsRetr, 1)
-			
-			// Update send time for next timeout calculation
-			atomic.StoreUint64(&entry.SendTime, now)
-			
-			// Handle congestion (packet loss detected)
-			rf.updateCongestionWindow(false)
+		// Fast retransmitted since, or the RTO grew
+		sent := atomic.LoadUint64(&entry.SendTime)
+		wait := entryTimeout(entry, timeout)
+		if now - sent <= wait {
+			w.rearm(timer, wheelDeadline(sent, wait), timeout)
+			return
 		}
 		
-		return true // Continue iteration
+		if atomic.LoadUint32(&entry.RetryCount) >= maxRetries {
+			if rf.unackedTable.CompareAndRemove(timer.key, timer.entry) {
+				rf.land(entry)
+				rf.resolve(entry.Packet.SeqNum)
+				rf.deliveryFailed(entry.Packet)
+				guard.Retire(timer.entry)
+			}
+			wheelTimers.Put(timer)
+			return
+		}
+		fn(entry.Packet)
+		timedOut++
+		rf.land(entry)
+		// Update retry count atomically, and back the packet off
+		atomic.AddUint32(&entry.RetryCount, 1)
+		atomic.StoreUint64(&entry.Timeout, min(2*wait, uint64(maxRTO)))
+		atomic.AddUint64(&rf.packetsRetr, 1)
+		
+		// Update send time for next timeout calculation
+		atomic.StoreUint64(&entry.SendTime, now)
+		
+		// Handle congestion (packet loss detected)
+		rf.updateCongestionWindow(false)
+		
+		// Rearmed once the RTO has backed off
+		timer.next = retransmitted
+		retransmitted = timer
 	})
 	
-	if len(timedOut) > 0 {
-		atomic.AddUint64(&rf.packetsLost, uint64(len(timedOut)))
+	if timedOut > 0 {
+		atomic.CompareAndSwapUint64(&rf.retransmitSince, 0, now)
+		atomic.AddUint64(&rf.packetsLost, timedOut)
+		rf.backoffTimeout()
+		rf.exitRecovery(false) // a timeout overrides fast recovery
+	}
+	timeout = atomic.LoadUint64(&rf.timeoutBase)
+	for retransmitted != nil {
+		timer := retransmitted
+		retransmitted = timer.next
+		w.rearm(timer, wheelDeadline(now, entryTimeout((*UnackedEntry)(timer.entry), timeout)), timeout)
 	}
-	
-	return timedOut
+}
+
+// entryTimeout is how long a packet waits for its ACK: the RTO, or its
+// own backed off timeout once it has been retransmitted
+func entryTimeout(entry *UnackedEntry, timeout uint64) uint64 {
+	return max(timeout, atomic.LoadUint64(&entry.Timeout))
+}
+
+// SetRetransmissionBudget bounds how long the layer retransmits to a
+// silent peer: budget.MaxRetries per packet, and budget.MaxTime from the
+// first timeout with no ACK since
+func (rf *LockFreeReliabilityLayer) SetRetransmissionBudget(budget RetransmissionBudget) {
+	atomic.StoreUint32(&rf.maxRetries, uint32(budget.MaxRetries))
+	atomic.StoreInt64(&rf.maxRetransmit, int64(budget.MaxTime))
+}
+
+// retransmitTimeSpent reports whether the layer has been retransmitting
+// without an ACK for longer than its budget allows
+func (rf *LockFreeReliabilityLayer) retransmitTimeSpent(now uint64) bool {
+	limit := atomic.LoadInt64(&rf.maxRetransmit)
+	since := atomic.LoadUint64(&rf.retransmitSince)
+	return limit > 0 && since != 0 && now - since > uint64(limit)
 }
 
 // GetOrderedPackets returns packets in sequence order (lock-free)
@@ -164,6 +578,7 @@ func (rf *LockFreeReliabilityLayer) GetOrderedPackets() []*Packet {
 		if packetPtr == nil {
 			break
 		}
+		atomic.AddInt64(&rf.recvQueued, -1)
 		packet := (*Packet)(packetPtr)
 		orderedPackets = append(orderedPackets, packet)
 	}
@@ -173,23 +588,28 @@ func (rf *LockFreeReliabilityLayer) GetOrderedPackets() []*Packet {
 	return orderedPackets
 }
 
-// updateRTTAtomic updates RTT estimate using atomic operations
+// updateRTTAtomic folds an RTT sample into SRTT and RTTVAR (RFC 6298)
+// using atomic operations, and recomputes the RTO from them
 func (rf *LockFreeReliabilityLayer) updateRTTAtomic(sampleRTT uint64) {
-	// Exponential weighted moving average: RTT = 0.875 * RTT + 0.125 * sample
 	for {
-		oldRTT := atomic.LoadUint64(&rf.rttEstimate)
-		newRTT := (oldRTT * 7 + sampleRTT) / 8
+		oldState := atomic.LoadUint64(&rf.rttState)
+		estimate := unpackRTT(oldState).sample(time.Duration(sampleRTT))
 		
-		if atomic.CompareAndSwapUint64(&rf.rttEstimate, oldRTT, newRTT) {
-			// Update timeout based on new RTT estimate
-			newTimeout := newRTT * 4 // RTO = 4 * RTT (simplified)
-			if newTimeout < uint64(100 * time.Millisecond) {
-				newTimeout = uint64(100 * time.Millisecond)
-			}
-			if newTimeout > uint64(5 * time.Second) {
-				newTimeout = uint64(5 * time.Second)
-			}
-			atomic.StoreUint64(&rf.timeoutBase, newTimeout)
+		if atomic.CompareAndSwapUint64(&rf.rttState, oldState, estimate.pack()) {
+			// A fresh sample also ends any backoff
+			atomic.StoreUint64(&rf.timeoutBase, uint64(estimate.rto()))
+			break
+		}
+	}
+}
+
+// backoffTimeout doubles the RTO after a retransmission (RFC 6298 5.5)
+func (rf *LockFreeReliabilityLayer) backoffTimeout() {
+	for {
+		oldTimeout := atomic.LoadUint64(&rf.timeoutBase)
+		newTimeout := uint64(backoffRTO(time.Duration(oldTimeout)))
+		
+		if atomic.CompareAndSwapUint64(&rf.timeoutBase, oldTimeout, newTimeout) {
 			break
 		}
 	}
@@ -197,6 +617,10 @@ func (rf *LockFreeReliabilityLayer) updateRTTAtomic(sampleRTT uint64) {
 
 // updateCongestionWindow updates congestion window atomically
 func (rf *LockFreeReliabilityLayer) updateCongestionWindow(success bool) {
+	if rf.GetCongestionAlgorithm() == CC_FIXED {
+		return
+	}
+
 	if success {
 		// Successful ACK - increase window (slow start or congestion avoidance)
 		for {
@@ -247,8 +671,19 @@ func (rf *LockFreeReliabilityLayer) markReceived(seqNum uint32) {
 	// TODO: Implement lock-free received packet tracking
 }
 
+// UnackedCount returns the number of packets awaiting acknowledgment
+func (rf *LockFreeReliabilityLayer) UnackedCount() int {
+	count := 0
+	rf.unackedTable.ForEach(func(key uint64, valuePtr unsafe.Pointer) bool {
+		count++
+		return true
+	})
+	return count
+}
+
 // GetStats returns performance statistics
 func (rf *LockFreeReliabilityLayer) GetStats() ReliabilityStats {
+	estimate := unpackRTT(atomic.LoadUint64(&rf.rttState))
 	return ReliabilityStats{
 		PacketsSent:        atomic.LoadUint64(&rf.packetsSent),
 		PacketsReceived:    atomic.LoadUint64(&rf.packetsRecv),
@@ -256,7 +691,12 @@ func (rf *LockFreeReliabilityLayer) GetStats() ReliabilityStats {
 		PacketsRetransmitted: atomic.LoadUint64(&rf.packetsRetr),
 		CongestionWindow:   atomic.LoadUint32(&rf.congWindow),
 		WindowSize:         atomic.LoadUint32(&rf.windowSize),
-		RTTEstimate:        time.Duration(atomic.LoadUint64(&rf.rttEstimate)),
+		FastRetransmits:    atomic.LoadUint64(&rf.fastRetr),
+		PacketsExpired:     atomic.LoadUint64(&rf.packetsExpired),
+		ReceiveQueueFull:   atomic.LoadUint64(&rf.recvDropped),
+		BytesInFlight:      uint64(max(atomic.LoadInt64(&rf.bytesInFlight), 0)),
+		RTTEstimate:        estimate.srtt,
+		RTTVariance:        estimate.rttvar,
 		TimeoutValue:       time.Duration(atomic.LoadUint64(&rf.timeoutBase)),
 	}
 }
@@ -267,17 +707,34 @@ type ReliabilityStats struct {
 	PacketsReceived      uint64
 	PacketsLost          uint64
 	PacketsRetransmitted uint64
+	FastRetransmits      uint64 // retransmissions triggered by duplicate ACKs, also in PacketsRetransmitted
+	PacketsExpired       uint64 // packets given up on past the retransmission budget
+	ReceiveQueueFull     uint64 // DATA packets dropped because the receive queue was full
 	CongestionWindow     uint32
 	WindowSize           uint32
-	RTTEstimate          time.Duration
-	TimeoutValue         time.Duration
+	BytesInFlight        uint64        // payload bytes sent and neither acknowledged nor presumed lost
+	RTTEstimate          time.Duration // SRTT, 0 before the first sample
+	RTTVariance          time.Duration // RTTVAR
+	TimeoutValue         time.Duration // current RTO, including any backoff
 }
 
 // UnackedEntry represents an unacknowledged packet
 type UnackedEntry struct {
 	Packet     *Packet
 	SendTime   uint64
+	Timeout    uint64 // nanoseconds, the packet's backed off RTO once retransmitted, atomic
 	RetryCount uint32
+	Landed     uint32 // atomic bool, no longer counted in flight
+	AppLimited uint32 // sent application-limited, its ACK does not grow the window
+	Timer      unsafe.Pointer // *wheelTimer armed for this send, atomic
+}
+
+// unackedEntries recycles entries retired from unacked tables
+var unackedEntries = NewSlab[UnackedEntry](slabChunkSize)
+
+// releaseUnackedEntry clears an entry and returns it to the slab
+func releaseUnackedEntry(ptr unsafe.Pointer) {
+	unackedEntries.release(ptr)
 }
 
 // Lock-Free Data Structures
@@ -335,6 +792,18 @@ func (ht *LockFreeHashTable) Remove(key uint64) unsafe.Pointer {
 	}
 }
 
+// CompareAndRemove removes a key only while it still maps to value, and
+// reports whether it did
+func (ht *LockFreeHashTable) CompareAndRemove(key uint64, value unsafe.Pointer) bool {
+	return atomic.CompareAndSwapPointer(&ht.buckets[key&ht.mask], value, nil)
+}
+
+// Get returns the value stored for a key's bucket, or nil. Keys sharing a
+// bucket are not told apart; callers check the value.
+func (ht *LockFreeHashTable) Get(key uint64) unsafe.Pointer {
+	return atomic.LoadPointer(&ht.buckets[key&ht.mask])
+}
+
 // ForEach iterates over all entries (not guaranteed to be consistent)
 func (ht *LockFreeHashTable) ForEach(fn func(key uint64, value unsafe.Pointer) bool) {
 	for i := uint64(0); i < ht.size; i++ {
@@ -347,10 +816,14 @@ func (ht *LockFreeHashTable) ForEach(fn func(key uint64, value unsafe.Pointer) b
 	}
 }
 
-// LockFreeQueue implements a lock-free FIFO queue
+// LockFreeQueue implements a lock-free FIFO queue. Dequeued nodes are
+// pooled; the epoch domain keeps a node from being reused while another
+// goroutine may still follow a pointer to it, which also rules out ABA
+// on the head and tail swaps.
 type LockFreeQueue struct {
-	head unsafe.Pointer
-	tail unsafe.Pointer
+	head  unsafe.Pointer
+	tail  unsafe.Pointer
+	nodes *EpochDomain
 }
 
 // QueueNode represents a node in the lock-free queue
@@ -359,20 +832,38 @@ type QueueNode struct {
 	data unsafe.Pointer
 }
 
+// queueNodes recycles nodes retired from lock-free queues
+var queueNodes = NewSlab[QueueNode](slabChunkSize)
+
+// releaseQueueNode clears a node and returns it to the slab
+func releaseQueueNode(ptr unsafe.Pointer) {
+	queueNodes.release(ptr)
+}
+
 // NewLockFreeQueue creates a new lock-free queue
 func NewLockFreeQueue(capacity int) *LockFreeQueue {
+	return newLockFreeQueue(NewEpochDomain(releaseQueueNode))
+}
+
+// newLockFreeQueue creates a queue reclaiming its nodes through a domain
+// that may be shared with other queues
+func newLockFreeQueue(nodes *EpochDomain) *LockFreeQueue {
 	dummy := &QueueNode{}
 	return &LockFreeQueue{
-		head: unsafe.Pointer(dummy),
-		tail: unsafe.Pointer(dummy),
+		head:  unsafe.Pointer(dummy),
+		tail:  unsafe.Pointer(dummy),
+		nodes: nodes,
 	}
 }
 
 // Enqueue adds an item to the queue
 func (q *LockFreeQueue) Enqueue(data unsafe.Pointer) bool {
-	newNode := &QueueNode{data: data}
+	newNode := queueNodes.Get()
+	newNode.data = data
 	newNodePtr := unsafe.Pointer(newNode)
 	
+	guard := q.nodes.Pin()
+	defer guard.Unpin()
 	for {
 		tail := atomic.LoadPointer(&q.tail)
 		tailNode := (*QueueNode)(tail)
@@ -396,6 +887,8 @@ func (q *LockFreeQueue) Enqueue(data unsafe.Pointer) bool {
 
 // Dequeue removes and returns an item from the queue
 func (q *LockFreeQueue) Dequeue() unsafe.Pointer {
+	guard := q.nodes.Pin()
+	defer guard.Unpin()
 	for {
 		head := atomic.LoadPointer(&q.head)
 		tail := atomic.LoadPointer(&q.tail)
@@ -414,10 +907,12 @@ func (q *LockFreeQueue) Dequeue() unsafe.Pointer {
 					continue // Inconsistent state, retry
 				}
 				
-				data := (*QueueNode)(next).data
+				data := atomic.LoadPointer(&(*QueueNode)(next).data)
 				
-				// Try to advance head
+				// Try to advance head; the old dummy is retired, and next
+				// becomes the new dummy
 				if atomic.CompareAndSwapPointer(&q.head, head, next) {
+					guard.Retire(head)
 					return data
 				}
 			}
@@ -0,0 +1,76 @@
+package ultrafast
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// LogLevel controls which messages the server writes to the log
+type LogLevel int32
+
+// Log levels, from most to least verbose
+const (
+	LOG_DEBUG LogLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+// currentLogLevel is read on every log call, so it is kept atomic
+var currentLogLevel int32 = int32(LOG_INFO)
+
+// SetLogLevel changes the active log level at runtime
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&currentLogLevel, int32(level))
+}
+
+// GetLogLevel returns the active log level
+func GetLogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&currentLogLevel))
+}
+
+// ParseLogLevel converts a level name into a LogLevel
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch name {
+	case "debug":
+		return LOG_DEBUG, nil
+	case "info":
+		return LOG_INFO, nil
+	case "warn":
+		return LOG_WARN, nil
+	case "error":
+		return LOG_ERROR, nil
+	default:
+		return LOG_INFO, fmt.Errorf("unknown log level: %s", name)
+	}
+}
+
+// String returns the level name
+func (l LogLevel) String() string {
+	switch l {
+	case LOG_DEBUG:
+		return "debug"
+	case LOG_INFO:
+		return "info"
+	case LOG_WARN:
+		return "warn"
+	case LOG_ERROR:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+}
+
+// logAt writes a message if the level is enabled
+func logAt(level LogLevel, format string, args ...interface{}) {
+	if level < GetLogLevel() {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func logDebugf(format string, args ...interface{}) { logAt(LOG_DEBUG, format, args...) }
+func logInfof(format string, args ...interface{})  { logAt(LOG_INFO, format, args...) }
+func logWarnf(format string, args ...interface{})  { logAt(LOG_WARN, format, args...) }
+func logErrorf(format string, args ...interface{}) { logAt(LOG_ERROR, format, args...) }
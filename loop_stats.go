@@ -0,0 +1,162 @@
+package ultrafast
+
+import (
+	"fmt"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// loopLatencyBuckets is how many buckets the callback time distribution
+// has: under 1µs, then one per power of two up to the last, which holds
+// everything from about half a second
+const loopLatencyBuckets = 21
+
+// defaultStallThreshold is how long one callback may hold the event loop
+// before it is counted, and logged, as a stall
+const defaultStallThreshold = 50 * time.Millisecond
+
+// stallWarningInterval limits stall warnings to one per interval, so a
+// loop that stalls on every packet does not flood the log
+const stallWarningInterval = time.Second
+
+// LoopLatencyBucket counts the callbacks that ran for less than
+// UpperBound and at least the previous bucket's bound. The last bucket's
+// UpperBound is 0: it has none.
+type LoopLatencyBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// loopLatency instruments an event loop: how long it waits for events,
+// how many each wakeup brings, and how long each callback holds it. Only
+// the loop goroutine writes it; any goroutine may read it.
+type loopLatency struct {
+	wakeups        atomic.Uint64
+	events         atomic.Uint64
+	maxEvents      atomic.Int64 // most events from one wakeup
+	waitTime       atomic.Int64
+	busyTime       atomic.Int64
+	callbacks      atomic.Uint64
+	maxCallback    atomic.Int64
+	buckets        [loopLatencyBuckets]atomic.Uint64
+	stalls         atomic.Uint64
+	stallThreshold atomic.Int64 // 0 disables stall detection
+	lastWarning    atomic.Int64 // unix nanoseconds of the last stall warning
+}
+
+// wokeUp records a return from waiting after waited, with events ready
+func (l *loopLatency) wokeUp(events int, waited time.Duration) {
+	l.wakeups.Add(1)
+	l.events.Add(uint64(events))
+	l.waitTime.Add(int64(waited))
+	if int64(events) > l.maxEvents.Load() {
+		l.maxEvents.Store(int64(events))
+	}
+}
+
+// ran records a callback that started at start, and warns if it stalled
+// the loop. fd is the descriptor it handled, or -1 for a submitted task.
+func (l *loopLatency) ran(start time.Time, fd int) {
+	now := time.Now()
+	took := now.Sub(start)
+	l.callbacks.Add(1)
+	l.busyTime.Add(int64(took))
+	if int64(took) > l.maxCallback.Load() {
+		l.maxCallback.Store(int64(took))
+	}
+	l.buckets[latencyBucket(took)].Add(1)
+
+	threshold := time.Duration(l.stallThreshold.Load())
+	if threshold <= 0 || took < threshold {
+		return
+	}
+	l.stalls.Add(1)
+	last := l.lastWarning.Load()
+	if now.UnixNano()-last < int64(stallWarningInterval) || !l.lastWarning.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	if fd < 0 {
+		logWarnf("Event loop stalled for %v by a submitted task", took)
+	} else {
+		logWarnf("Event loop stalled for %v handling fd %d", took, fd)
+	}
+}
+
+// latencyBucket returns the bucket a callback duration falls in
+func latencyBucket(took time.Duration) int {
+	return min(bits.Len64(uint64(took/time.Microsecond)), loopLatencyBuckets-1)
+}
+
+// fill copies the counters into stats
+func (l *loopLatency) fill(stats *EventLoopStats) {
+	stats.Wakeups = l.wakeups.Load()
+	stats.Events = l.events.Load()
+	stats.MaxEventsPerWakeup = int(l.maxEvents.Load())
+	stats.WaitTime = time.Duration(l.waitTime.Load())
+	stats.BusyTime = time.Duration(l.busyTime.Load())
+	stats.Callbacks = l.callbacks.Load()
+	stats.MaxCallback = time.Duration(l.maxCallback.Load())
+	stats.Stalls = l.stalls.Load()
+	stats.StallThreshold = time.Duration(l.stallThreshold.Load())
+	stats.CallbackTimes = make([]LoopLatencyBucket, loopLatencyBuckets)
+	for i := range stats.CallbackTimes {
+		stats.CallbackTimes[i].Count = l.buckets[i].Load()
+		if i < loopLatencyBuckets-1 {
+			stats.CallbackTimes[i].UpperBound = time.Microsecond << i
+		}
+	}
+}
+
+// SetStallThreshold sets how long a single callback may run before the
+// loop counts a stall and logs a warning naming what blocked it. Zero
+// disables stall detection.
+func (el *EpollEventLoop) SetStallThreshold(threshold time.Duration) {
+	el.latency.stallThreshold.Store(int64(max(threshold, 0)))
+}
+
+// EventsPerWakeup returns the mean number of events each wakeup handled
+func (stats EventLoopStats) EventsPerWakeup() float64 {
+	if stats.Wakeups == 0 {
+		return 0
+	}
+	return float64(stats.Events) / float64(stats.Wakeups)
+}
+
+// CallbackPercentile estimates the callback duration below which the
+// fraction p of callbacks ran, such as 0.99, to within a factor of two
+func (stats EventLoopStats) CallbackPercentile(p float64) time.Duration {
+	rank := uint64(p * float64(stats.Callbacks))
+	var seen uint64
+	for _, bucket := range stats.CallbackTimes {
+		seen += bucket.Count
+		if seen > rank || seen == stats.Callbacks && seen > 0 {
+			if bucket.UpperBound == 0 || bucket.UpperBound > stats.MaxCallback {
+				return stats.MaxCallback
+			}
+			return bucket.UpperBound
+		}
+	}
+	return 0
+}
+
+// EventLoopStats returns the event loop's latency instrumentation
+func (s *UltraFastHTTPServer) EventLoopStats() EventLoopStats {
+	return s.eventLoop.GetStats()
+}
+
+// SetStallThreshold sets how long a callback may hold the event loop
+// before it is logged as a stall, as EpollEventLoop.SetStallThreshold
+func (s *UltraFastHTTPServer) SetStallThreshold(threshold time.Duration) {
+	s.eventLoop.SetStallThreshold(threshold)
+}
+
+// formatLoopStatsJSON renders the event loop's instrumentation as a JSON
+// object
+func formatLoopStatsJSON(stats EventLoopStats) string {
+	return fmt.Sprintf(`{"wakeups": %d, "events_per_wakeup": %.2f, "max_events_per_wakeup": %d, "wait_seconds": %.3f, "busy_seconds": %.3f, "callbacks": %d, "callback_p50_us": %d, "callback_p99_us": %d, "max_callback_us": %d, "stalls": %d}`,
+		stats.Wakeups, stats.EventsPerWakeup(), stats.MaxEventsPerWakeup,
+		stats.WaitTime.Seconds(), stats.BusyTime.Seconds(), stats.Callbacks,
+		stats.CallbackPercentile(0.5).Microseconds(), stats.CallbackPercentile(0.99).Microseconds(),
+		stats.MaxCallback.Microseconds(), stats.Stalls)
+}
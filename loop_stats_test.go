@@ -0,0 +1,112 @@
+package ultrafast
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyBucket(t *testing.T) {
+	tests := []struct {
+		took   time.Duration
+		bucket int
+	}{
+		{500 * time.Nanosecond, 0},
+		{time.Microsecond, 1},
+		{3 * time.Microsecond, 2},
+		{time.Millisecond, 10},
+		{time.Hour, loopLatencyBuckets - 1},
+	}
+	for _, tt := range tests {
+		bucket := latencyBucket(tt.took)
+		if bucket != tt.bucket {
+			t.Errorf("latencyBucket(%v) = %d, want %d", tt.took, bucket, tt.bucket)
+		}
+		if bound := time.Microsecond << bucket; bucket < loopLatencyBuckets-1 && tt.took >= bound {
+			t.Errorf("%v is not under its bucket's bound %v", tt.took, bound)
+		}
+	}
+}
+
+func TestCallbackPercentile(t *testing.T) {
+	var latency loopLatency
+	for i := 0; i < 99; i++ {
+		latency.ran(time.Now().Add(-3*time.Microsecond), 0)
+	}
+	latency.ran(time.Now().Add(-time.Millisecond), 0)
+
+	var stats EventLoopStats
+	latency.fill(&stats)
+	if p50 := stats.CallbackPercentile(0.5); p50 != 4*time.Microsecond {
+		t.Errorf("Expected p50 of 4µs, got %v", p50)
+	}
+	if p99 := stats.CallbackPercentile(0.99); p99 != stats.MaxCallback || p99 < time.Millisecond {
+		t.Errorf("Expected p99 capped at the slowest callback, got %v, max %v", p99, stats.MaxCallback)
+	}
+	if (EventLoopStats{}).CallbackPercentile(0.5) != 0 {
+		t.Error("Expected no percentile without callbacks")
+	}
+}
+
+func TestEventLoopStallDetection(t *testing.T) {
+	el := newTestEventLoop(t)
+	el.SetStallThreshold(5 * time.Millisecond)
+	go el.Run()
+	waitForLoop(t, el)
+
+	before := el.GetStats()
+	el.Submit(func() { time.Sleep(10 * time.Millisecond) })
+	el.Submit(func() {})
+
+	deadline := time.Now().Add(time.Second)
+	stats := el.GetStats()
+	for stats.Callbacks < before.Callbacks+2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		stats = el.GetStats()
+	}
+	if stats.Stalls != before.Stalls+1 {
+		t.Errorf("Expected one stall, got %d", stats.Stalls-before.Stalls)
+	}
+	if stats.MaxCallback < 10*time.Millisecond || stats.BusyTime < 10*time.Millisecond {
+		t.Errorf("Expected the slow task timed, got max %v busy %v", stats.MaxCallback, stats.BusyTime)
+	}
+	if stats.Wakeups <= before.Wakeups || stats.EventsPerWakeup() < 1 {
+		t.Errorf("Expected the wakeup counted, got %d wakeups, %.2f events each", stats.Wakeups, stats.EventsPerWakeup())
+	}
+
+	el.SetStallThreshold(0)
+	el.Submit(func() { time.Sleep(10 * time.Millisecond) })
+	deadline = time.Now().Add(time.Second)
+	for el.GetStats().Callbacks < stats.Callbacks+1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stalls := el.GetStats().Stalls; stalls != stats.Stalls {
+		t.Errorf("Expected no stall counted with detection off, got %d", stalls-stats.Stalls)
+	}
+}
+
+func TestServerEventLoopStats(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+	if _, err := client.Get("/benchmark"); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	admin := NewAdminServer("")
+	server.registerAdminCommands(admin)
+	reply := admin.Execute("loop 20ms")
+	if !strings.Contains(reply, "stall_threshold=20ms") || !strings.HasSuffix(reply, "OK\n") {
+		t.Errorf("Unexpected loop reply: %q", reply)
+	}
+	if server.EventLoopStats().Callbacks == 0 {
+		t.Error("Expected the request's callbacks timed")
+	}
+
+	response, err := client.Get("/stats")
+	if err != nil {
+		t.Fatalf("Stats request failed: %v", err)
+	}
+	if !strings.Contains(string(response), `"event_loop": {"wakeups": `) {
+		t.Errorf("Expected event loop stats in /stats, got %s", response)
+	}
+}
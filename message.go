@@ -0,0 +1,168 @@
+package ultrafast
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// messageUpgradeToken is the Upgrade header value that switches a
+// connection from request/response to bidirectional messages
+const messageUpgradeToken = "ultrafast-message"
+
+// maxMessageSize bounds one message so a peer cannot force a huge allocation
+const maxMessageSize = 16 * 1024 * 1024
+
+// messageHeaderSize is the length prefix in front of every message
+const messageHeaderSize = 4
+
+// MessageConn carries discrete messages in both directions over a
+// connection's reliable stream, so either side can send at any time.
+// Each message is framed with a 4-byte big-endian length and may span
+// several DATA packets. On the server a handler obtains one with
+// HTTPRequest.Upgrade; clients use UltraFastClient.Upgrade.
+type MessageConn struct {
+	stream *StreamConn
+
+	ready    chan struct{} // closed once the upgrade response is sent
+	accepted bool          // written before ready is closed
+
+	sendMu sync.Mutex
+	recvMu sync.Mutex
+}
+
+// Upgrade switches the request's connection to messages. The handler
+// must return UpgradeResponse(); messages sent before that response has
+// gone out are held until it has. Upgrade fails unless the client asked
+// for it with an "Upgrade: ultrafast-message" header.
+func (r *HTTPRequest) Upgrade() (*MessageConn, error) {
+	if r.upgraded != nil {
+		return r.upgraded, nil
+	}
+	if r.handler == nil {
+		return nil, fmt.Errorf("request was not received over a connection that can be upgraded")
+	}
+	if !strings.EqualFold(r.Headers["Upgrade"], messageUpgradeToken) {
+		return nil, fmt.Errorf("client did not request an upgrade to %s", messageUpgradeToken)
+	}
+
+	conn := r.handler.server.connections.Get(r.Peer)
+	if conn == nil {
+		return nil, fmt.Errorf("no connection for %v", r.Peer)
+	}
+	stream := r.handler.newServerStream(conn)
+	if !conn.stream.CompareAndSwap(nil, stream) {
+		return nil, fmt.Errorf("connection to %v already carries a stream", r.Peer)
+	}
+
+	r.upgraded = &MessageConn{stream: stream, ready: make(chan struct{})}
+	return r.upgraded, nil
+}
+
+// UpgradeResponse is the response a handler returns after Upgrade
+func UpgradeResponse() *HTTPResponse {
+	return &HTTPResponse{
+		StatusCode: 101,
+		Headers: map[string]string{
+			"Upgrade":    messageUpgradeToken,
+			"Connection": "Upgrade",
+		},
+	}
+}
+
+// finishUpgrade releases held messages once the upgrade response is sent,
+// or tears the stream down if the handler answered with something else
+func (mc *MessageConn) finishUpgrade(accepted bool) {
+	mc.accepted = accepted
+	close(mc.ready)
+	if !accepted {
+		mc.stream.Close()
+	}
+}
+
+// Send sends one message to the peer, blocking while the stream's send
+// buffer is full
+func (mc *MessageConn) Send(message []byte) error {
+	if len(message) > maxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds limit of %d", len(message), maxMessageSize)
+	}
+
+	select {
+	case <-mc.ready:
+	case <-mc.stream.done:
+		return errUseOfClosed
+	}
+	if !mc.accepted {
+		return fmt.Errorf("connection was not upgraded")
+	}
+
+	frame := make([]byte, messageHeaderSize+len(message))
+	binary.BigEndian.PutUint32(frame, uint32(len(message)))
+	copy(frame[messageHeaderSize:], message)
+
+	mc.sendMu.Lock()
+	defer mc.sendMu.Unlock()
+	_, err := mc.stream.Write(frame)
+	return err
+}
+
+// Receive blocks until the next message arrives. It returns io.EOF once
+// the peer has closed the connection.
+func (mc *MessageConn) Receive() ([]byte, error) {
+	mc.recvMu.Lock()
+	defer mc.recvMu.Unlock()
+
+	var header [messageHeaderSize]byte
+	if _, err := io.ReadFull(mc.stream, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes exceeds limit of %d", size, maxMessageSize)
+	}
+
+	message := make([]byte, size)
+	if _, err := io.ReadFull(mc.stream, message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return message, nil
+}
+
+// RemoteAddr returns the peer's current address
+func (mc *MessageConn) RemoteAddr() SocketAddr {
+	return mc.stream.remote()
+}
+
+// Close closes the connection; the peer's Receive returns io.EOF
+func (mc *MessageConn) Close() error {
+	return mc.stream.Close()
+}
+
+// Upgrade asks the server to switch the connection at path to messages.
+// The client must not be used directly afterwards; closing the returned
+// MessageConn closes the client.
+func (c *UltraFastClient) Upgrade(path string) (*MessageConn, error) {
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s:%d\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n",
+		path, c.server.IP, c.server.Port, messageUpgradeToken)
+	response, err := c.Do([]byte(request))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 101 ") {
+		statusLine, _, _ := strings.Cut(string(response), "\r\n")
+		return nil, fmt.Errorf("upgrade refused: %s", statusLine)
+	}
+
+	stream, err := c.Stream()
+	if err != nil {
+		return nil, err
+	}
+	ready := make(chan struct{})
+	close(ready)
+	return &MessageConn{stream: stream, ready: ready, accepted: true}, nil
+}
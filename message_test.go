@@ -0,0 +1,90 @@
+package ultrafast
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+)
+
+func TestMessageUpgrade(t *testing.T) {
+	server := startTestServer(t)
+	serverDone := make(chan error, 1)
+
+	// Echo handler: greets first, then returns every message it receives
+	server.HandleFunc("/echo", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		conn, err := request.Upgrade()
+		if err != nil {
+			return &HTTPResponse{StatusCode: 400, Body: []byte(err.Error())}
+		}
+		go func() {
+			defer conn.Close()
+			if err := conn.Send([]byte("hello")); err != nil {
+				serverDone <- err
+				return
+			}
+			for {
+				message, err := conn.Receive()
+				if err != nil {
+					serverDone <- err
+					return
+				}
+				if err := conn.Send(message); err != nil {
+					serverDone <- err
+					return
+				}
+			}
+		}()
+		return UpgradeResponse()
+	})
+
+	client := newTestClient(t, server)
+	conn, err := client.Upgrade("/echo")
+	if err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+
+	greeting, err := conn.Receive()
+	if err != nil || string(greeting) != "hello" {
+		t.Fatalf("Expected server-initiated greeting, got %q (%v)", greeting, err)
+	}
+
+	// Large enough to span several DATA packets
+	large := bytes.Repeat([]byte("0123456789"), 500)
+	for _, message := range [][]byte{[]byte("ping"), large, {}} {
+		if err := conn.Send(message); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		echo, err := conn.Receive()
+		if err != nil {
+			t.Fatalf("Receive failed: %v", err)
+		}
+		if !bytes.Equal(echo, message) {
+			t.Errorf("Echo mismatch: sent %d bytes, got %d", len(message), len(echo))
+		}
+	}
+
+	conn.Close()
+	if err := <-serverDone; err != io.EOF {
+		t.Errorf("Server should see EOF after the client closes, got %v", err)
+	}
+}
+
+func TestMessageUpgradeRequiresHeader(t *testing.T) {
+	server := startTestServer(t)
+	server.HandleFunc("/echo", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		if _, err := request.Upgrade(); err != nil {
+			return &HTTPResponse{StatusCode: 400, Body: []byte(err.Error())}
+		}
+		return UpgradeResponse()
+	})
+
+	client := newTestClient(t, server)
+	response, err := client.Get("/echo")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !containsString(string(response), "HTTP/1.1 400") {
+		t.Errorf("Upgrade without the Upgrade header should be refused, got %q", response)
+	}
+}
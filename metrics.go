@@ -0,0 +1,245 @@
+package ultrafast
+
+import (
+	"fmt"
+	"hash/maphash"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// talkerSlots bounds each shard of the top talkers table. Peers are
+// counted with the Space-Saving algorithm, so a flood from many spoofed
+// addresses cannot grow it, and any peer sending more than 1/talkerSlots
+// of the traffic, and so of its shard's, is guaranteed a slot.
+const talkerSlots = 64
+
+// statsTopTalkers is how many peers /stats lists
+const statsTopTalkers = 10
+
+// unroutedLabel names requests no registered route matched: the built-in
+// endpoints and unknown paths
+const unroutedLabel = "-"
+
+// RouteStats counts the requests answered by one route
+type RouteStats struct {
+	Route       string // registered path or prefix, after its virtual host if any; "-" if none matched
+	Requests    uint64
+	Errors      uint64 // answered with a 5xx status
+	Bytes       uint64 // response bytes
+	MeanLatency time.Duration
+	MaxLatency  time.Duration
+}
+
+// TalkerStats counts the datagrams received from one source IP. A peer
+// that took over the slot of an evicted one inherits its counts, so
+// Bytes may overstate its traffic by up to Overcount.
+type TalkerStats struct {
+	IP        string
+	Packets   uint64
+	Bytes     uint64
+	Overcount uint64
+}
+
+// routeCounters accumulates RouteStats
+type routeCounters struct {
+	requests     uint64
+	errors       uint64
+	bytes        uint64
+	totalLatency time.Duration
+	maxLatency   time.Duration
+}
+
+// serverMetrics breaks the server's counters down by route and by peer.
+// Every datagram is counted against its peer, so peers are spread over
+// shards by IP, each with its own lock and talker table, and the event
+// loops do not contend on one mutex.
+type serverMetrics struct {
+	mu     sync.Mutex
+	routes map[string]*routeCounters
+
+	talkers []talkerShard
+	mask    uint64
+	seed    maphash.Seed
+}
+
+// talkerShard counts the peers whose IPs hash to it
+type talkerShard struct {
+	mu      sync.Mutex
+	talkers map[string]*TalkerStats
+
+	_ [64]byte // keep neighbouring shards' locks on separate cache lines
+}
+
+func newServerMetrics() *serverMetrics {
+	size := 1
+	for size < runtime.GOMAXPROCS(0) {
+		size <<= 1
+	}
+	m := &serverMetrics{
+		routes:  make(map[string]*routeCounters),
+		talkers: make([]talkerShard, size),
+		mask:    uint64(size - 1),
+		seed:    maphash.MakeSeed(),
+	}
+	for i := range m.talkers {
+		m.talkers[i].talkers = make(map[string]*TalkerStats, talkerSlots)
+	}
+	return m
+}
+
+// recordRequest counts an answered request against its route
+func (m *serverMetrics) recordRequest(route string, status int, bytes int64, latency time.Duration) {
+	if route == "" {
+		route = unroutedLabel
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counters := m.routes[route]
+	if counters == nil {
+		counters = &routeCounters{}
+		m.routes[route] = counters
+	}
+	counters.requests++
+	if status >= 500 {
+		counters.errors++
+	}
+	counters.bytes += uint64(bytes)
+	counters.totalLatency += latency
+	counters.maxLatency = max(counters.maxLatency, latency)
+}
+
+// countPeer counts a datagram of size bytes from ip. When its shard's
+// table is full the peer with the fewest bytes makes way, and the
+// newcomer starts from its counts.
+func (m *serverMetrics) countPeer(ip string, size int) {
+	shard := &m.talkers[maphash.String(m.seed, ip)&m.mask]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if talker := shard.talkers[ip]; talker != nil {
+		talker.Packets++
+		talker.Bytes += uint64(size)
+		return
+	}
+	if len(shard.talkers) < talkerSlots {
+		shard.talkers[ip] = &TalkerStats{IP: ip, Packets: 1, Bytes: uint64(size)}
+		return
+	}
+
+	var smallest *TalkerStats
+	for _, talker := range shard.talkers {
+		if smallest == nil || talker.Bytes < smallest.Bytes {
+			smallest = talker
+		}
+	}
+	delete(shard.talkers, smallest.IP)
+	smallest.IP = ip
+	smallest.Overcount = smallest.Bytes
+	smallest.Packets++
+	smallest.Bytes += uint64(size)
+	shard.talkers[ip] = smallest
+}
+
+// routeStats returns every route's counts, busiest first
+func (m *serverMetrics) routeStats() []RouteStats {
+	m.mu.Lock()
+	stats := make([]RouteStats, 0, len(m.routes))
+	for route, counters := range m.routes {
+		stats = append(stats, RouteStats{
+			Route:       route,
+			Requests:    counters.requests,
+			Errors:      counters.errors,
+			Bytes:       counters.bytes,
+			MeanLatency: counters.totalLatency / time.Duration(counters.requests),
+			MaxLatency:  counters.maxLatency,
+		})
+	}
+	m.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Requests != stats[j].Requests {
+			return stats[i].Requests > stats[j].Requests
+		}
+		return stats[i].Route < stats[j].Route
+	})
+	return stats
+}
+
+// topTalkers returns up to n peers by bytes sent, largest first
+func (m *serverMetrics) topTalkers(n int) []TalkerStats {
+	var talkers []TalkerStats
+	for i := range m.talkers {
+		shard := &m.talkers[i]
+		shard.mu.Lock()
+		for _, talker := range shard.talkers {
+			talkers = append(talkers, *talker)
+		}
+		shard.mu.Unlock()
+	}
+
+	sort.Slice(talkers, func(i, j int) bool {
+		if talkers[i].Bytes != talkers[j].Bytes {
+			return talkers[i].Bytes > talkers[j].Bytes
+		}
+		return talkers[i].IP < talkers[j].IP
+	})
+	return talkers[:min(n, len(talkers))]
+}
+
+// RouteStats returns request counts and latency for each route that has
+// answered a request, busiest first
+func (s *UltraFastHTTPServer) RouteStats() []RouteStats {
+	return s.metrics.routeStats()
+}
+
+// TopTalkers returns the n source IPs that sent the most bytes, largest
+// first. Datagrams are counted before rate limiting, so peers the rate
+// limiter drops show up too.
+func (s *UltraFastHTTPServer) TopTalkers(n int) []TalkerStats {
+	return s.metrics.topTalkers(n)
+}
+
+// routeLabel names the route that matched a request, for the metrics
+func routeLabel(vhost, pattern string) string {
+	if pattern == "" {
+		return ""
+	}
+	return vhost + pattern
+}
+
+// formatRoutesJSON renders route stats as a JSON array
+func formatRoutesJSON(routes []RouteStats) string {
+	body := "["
+	for i, route := range routes {
+		if i > 0 {
+			body += ","
+		}
+		body += fmt.Sprintf(`
+    {"route": %s, "requests": %d, "errors": %d, "bytes": %d, "mean_latency_us": %d, "max_latency_us": %d}`,
+			strconv.Quote(route.Route), route.Requests, route.Errors, route.Bytes,
+			route.MeanLatency.Microseconds(), route.MaxLatency.Microseconds())
+	}
+	if len(routes) > 0 {
+		body += "\n  "
+	}
+	return body + "]"
+}
+
+// formatTalkersJSON renders top talkers as a JSON array
+func formatTalkersJSON(talkers []TalkerStats) string {
+	body := "["
+	for i, talker := range talkers {
+		if i > 0 {
+			body += ","
+		}
+		body += fmt.Sprintf(`
+    {"ip": %q, "packets": %d, "bytes": %d, "overcount": %d}`,
+			talker.IP, talker.Packets, talker.Bytes, talker.Overcount)
+	}
+	if len(talkers) > 0 {
+		body += "\n  "
+	}
+	return body + "]"
+}
@@ -0,0 +1,127 @@
+package ultrafast
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopTalkersSpaceSaving(t *testing.T) {
+	metrics := newServerMetrics()
+
+	// A heavy peer keeps its slot while a flood of one-packet peers churns
+	// through the rest of the table
+	for i := 0; i < 10*talkerSlots; i++ {
+		metrics.countPeer("10.0.0.1", 1000)
+		metrics.countPeer(fmt.Sprintf("192.0.2.%d", i%250), 100)
+		metrics.countPeer(fmt.Sprintf("198.51.100.%d", i%250), 100)
+	}
+	tracked := 0
+	for i := range metrics.talkers {
+		if n := len(metrics.talkers[i].talkers); n > talkerSlots {
+			t.Fatalf("Expected at most %d peers tracked in shard %d, got %d", talkerSlots, i, n)
+		}
+		tracked += len(metrics.talkers[i].talkers)
+	}
+	top := metrics.topTalkers(3)
+	if len(top) != 3 {
+		t.Fatalf("Expected 3 talkers, got %d", len(top))
+	}
+	if top[0].IP != "10.0.0.1" || top[0].Bytes != 10*talkerSlots*1000 || top[0].Overcount != 0 {
+		t.Errorf("Expected the heavy peer counted exactly, got %+v", top[0])
+	}
+	for _, talker := range top {
+		if talker.Overcount > talker.Bytes {
+			t.Errorf("Overcount exceeds bytes: %+v", talker)
+		}
+	}
+	if n := len(metrics.topTalkers(1000)); n != tracked {
+		t.Errorf("Expected every tracked peer listed, got %d", n)
+	}
+}
+
+func TestRouteStats(t *testing.T) {
+	metrics := newServerMetrics()
+	metrics.recordRequest("/api/", 200, 100, 2*time.Millisecond)
+	metrics.recordRequest("/api/", 503, 50, 4*time.Millisecond)
+	metrics.recordRequest("", 404, 13, 0)
+
+	stats := metrics.routeStats()
+	if len(stats) != 2 {
+		t.Fatalf("Expected 2 routes, got %+v", stats)
+	}
+	api := stats[0]
+	if api.Route != "/api/" || api.Requests != 2 || api.Errors != 1 || api.Bytes != 150 {
+		t.Errorf("Unexpected route counts: %+v", api)
+	}
+	if api.MeanLatency != 3*time.Millisecond || api.MaxLatency != 4*time.Millisecond {
+		t.Errorf("Unexpected route latency: mean %v max %v", api.MeanLatency, api.MaxLatency)
+	}
+	if stats[1].Route != unroutedLabel {
+		t.Errorf("Expected unmatched requests under %q, got %q", unroutedLabel, stats[1].Route)
+	}
+}
+
+func TestServerMetricsBreakdown(t *testing.T) {
+	server := startTestServer(t)
+	server.HandlePrefix("/items/", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: []byte("item")}
+	})
+	client := newTestClient(t, server)
+
+	for _, path := range []string{"/items/1", "/items/2", "/missing"} {
+		if _, err := client.Get(path); err != nil {
+			t.Fatalf("Request for %s failed: %v", path, err)
+		}
+	}
+
+	// Requests are counted once answered, just after the response is sent
+	var routes []RouteStats
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if routes = server.RouteStats(); len(routes) == 2 && routes[1].Requests == 1 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(routes) != 2 || routes[0].Route != "/items/" || routes[0].Requests != 2 || routes[1].Route != unroutedLabel {
+		t.Fatalf("Unexpected routes: %+v", routes)
+	}
+
+	talkers := server.TopTalkers(statsTopTalkers)
+	if len(talkers) != 1 || talkers[0].IP != "127.0.0.1" || talkers[0].Packets < 4 {
+		t.Errorf("Expected the client as the only talker, got %+v", talkers)
+	}
+
+	// Peers' addresses are only published once opted in
+	response, err := client.Get("/stats")
+	if err != nil {
+		t.Fatalf("Stats request failed: %v", err)
+	}
+	if strings.Contains(string(response), "top_talkers") {
+		t.Errorf("Expected no top talkers in /stats by default, got %s", response)
+	}
+	server.SetPeerInfoPublic(true)
+	if response, err = client.Get("/stats"); err != nil {
+		t.Fatalf("Stats request failed: %v", err)
+	}
+	for _, want := range []string{`"route": "/items/", "requests": 2`, `"top_talkers": [`, `"ip": "127.0.0.1"`} {
+		if !strings.Contains(string(response), want) {
+			t.Errorf("Expected %s in /stats, got %s", want, response)
+		}
+	}
+
+	admin := NewAdminServer("")
+	server.registerAdminCommands(admin)
+	if reply := admin.Execute("routes"); !strings.Contains("\n"+reply, "\n/items/ requests=2 errors=0") {
+		t.Errorf("Unexpected routes reply: %q", reply)
+	}
+	if reply := admin.Execute("talkers 1"); !strings.HasPrefix(reply, "127.0.0.1 packets=") {
+		t.Errorf("Unexpected talkers reply: %q", reply)
+	}
+	if reply := admin.Execute("talkers 0"); !strings.HasPrefix(reply, "ERR") {
+		t.Errorf("Expected a zero count refused, got %q", reply)
+	}
+}
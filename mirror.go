@@ -0,0 +1,207 @@
+package ultrafast
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic mirroring: a sample of the requests the server receives is sent
+// again, unchanged, to a shadow server over the same protocol, so a new
+// version can be tried under real traffic. The shadow's responses are
+// read and thrown away; clients only ever see the server's own.
+
+// Defaults for MirrorConfig
+const (
+	defaultMirrorBuffer  = 1024
+	defaultMirrorTimeout = time.Second
+)
+
+// mirrorBatch is how many queued requests go out to the shadow at once,
+// pipelined on its connection
+const mirrorBatch = 16
+
+// MirrorConfig configures traffic mirroring. Zero values take the
+// defaults.
+type MirrorConfig struct {
+	SampleRate float64       // fraction of requests mirrored, from 0 to 1, default 1
+	BufferSize int           // requests queued for the shadow, default 1024
+	Timeout    time.Duration // wait for the shadow's responses, default 1s
+}
+
+// MirrorStats counts mirroring activity
+type MirrorStats struct {
+	Mirrored uint64 // requests the shadow answered
+	Skipped  uint64 // requests left out by sampling
+	Dropped  uint64 // requests discarded because the buffer was full
+	Errors   uint64 // requests the shadow did not answer
+}
+
+// Mirror sends copies of requests to a shadow server. Mirror queues the
+// request and returns at once; a background goroutine sends queued
+// requests on a connection of its own, so a slow or absent shadow never
+// holds up the server.
+type Mirror struct {
+	target    SocketAddr
+	config    MirrorConfig
+	client    *UltraFastClient
+	threshold uint64 // a request is sampled when a random uint64 falls below it
+
+	mu     sync.Mutex
+	queue  [][]byte
+	closed bool
+	wake   chan struct{}
+	done   chan struct{}
+
+	mirrored uint64 // atomic
+	skipped  uint64 // atomic
+	dropped  uint64 // atomic
+	errors   uint64 // atomic
+}
+
+// NewMirror starts a mirror sending to target
+func NewMirror(target SocketAddr, config MirrorConfig) (*Mirror, error) {
+	if config.SampleRate == 0 {
+		config.SampleRate = 1
+	}
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		return nil, fmt.Errorf("invalid sample rate: %v", config.SampleRate)
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultMirrorBuffer
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultMirrorTimeout
+	}
+	client, err := NewUltraFastClient(target.IP, target.Port)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mirror client: %v", err)
+	}
+	client.SetTimeout(config.Timeout)
+
+	m := &Mirror{
+		target:    target,
+		config:    config,
+		client:    client,
+		threshold: math.MaxUint64,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+	if config.SampleRate < 1 {
+		m.threshold = uint64(config.SampleRate * math.MaxUint64)
+	}
+	go m.run()
+	return m, nil
+}
+
+// Target returns the address requests are mirrored to
+func (m *Mirror) Target() SocketAddr {
+	return m.target
+}
+
+// Mirror queues a copy of a request if the sample takes it, dropping it
+// if the buffer is full
+func (m *Mirror) Mirror(request []byte) {
+	if m.threshold != math.MaxUint64 && rand.Uint64() >= m.threshold {
+		atomic.AddUint64(&m.skipped, 1)
+		return
+	}
+	m.mu.Lock()
+	if m.closed || len(m.queue) == m.config.BufferSize {
+		m.mu.Unlock()
+		atomic.AddUint64(&m.dropped, 1)
+		return
+	}
+	m.queue = append(m.queue, append([]byte(nil), request...))
+	m.mu.Unlock()
+	notify(m.wake)
+}
+
+// run sends queued requests until the mirror is closed
+func (m *Mirror) run() {
+	defer close(m.done)
+	for {
+		m.mu.Lock()
+		if len(m.queue) == 0 {
+			closed := m.closed
+			m.mu.Unlock()
+			if closed {
+				return
+			}
+			<-m.wake
+			continue
+		}
+		n := min(len(m.queue), mirrorBatch)
+		batch := m.queue[:n:n]
+		m.queue = m.queue[n:]
+		m.mu.Unlock()
+
+		if _, err := m.client.Pipeline(batch); err != nil {
+			logDebugf("Mirroring to %s failed: %v", m.target, err)
+			atomic.AddUint64(&m.errors, uint64(n))
+			continue
+		}
+		atomic.AddUint64(&m.mirrored, uint64(n))
+	}
+}
+
+// Close sends the queued requests and stops the mirror. Requests
+// mirrored afterwards are dropped.
+func (m *Mirror) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		<-m.done
+		return
+	}
+	m.closed = true
+	m.mu.Unlock()
+	notify(m.wake)
+	<-m.done
+	m.client.Close()
+}
+
+// Stats returns the mirror's counters
+func (m *Mirror) Stats() MirrorStats {
+	return MirrorStats{
+		Mirrored: atomic.LoadUint64(&m.mirrored),
+		Skipped:  atomic.LoadUint64(&m.skipped),
+		Dropped:  atomic.LoadUint64(&m.dropped),
+		Errors:   atomic.LoadUint64(&m.errors),
+	}
+}
+
+// EnableMirror copies a sample of incoming requests to target, replacing
+// and closing any previous mirror. Responses are never mirrored.
+func (s *UltraFastHTTPServer) EnableMirror(target SocketAddr, config MirrorConfig) (*Mirror, error) {
+	mirror, err := NewMirror(target, config)
+	if err != nil {
+		return nil, err
+	}
+	if old := s.mirror.Swap(mirror); old != nil {
+		old.Close()
+	}
+	return mirror, nil
+}
+
+// DisableMirror stops mirroring, sending queued requests first
+func (s *UltraFastHTTPServer) DisableMirror() {
+	if old := s.mirror.Swap(nil); old != nil {
+		old.Close()
+	}
+}
+
+// Mirror returns the active mirror, or nil
+func (s *UltraFastHTTPServer) Mirror() *Mirror {
+	return s.mirror.Load()
+}
+
+// mirrorRequest hands a request being served to the mirror, if one is on
+func (s *UltraFastHTTPServer) mirrorRequest(request []byte) {
+	if mirror := s.mirror.Load(); mirror != nil {
+		mirror.Mirror(request)
+	}
+}
@@ -0,0 +1,73 @@
+package ultrafast
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirrorCopiesRequests(t *testing.T) {
+	server := startTestServer(t)
+	shadow := startTestServer(t)
+	var shadowed atomic.Int64
+	shadow.HandleFunc("/mirrored", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		shadowed.Add(1)
+		return &HTTPResponse{StatusCode: 500, Body: []byte("shadow")}
+	})
+	server.HandleFunc("/mirrored", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Body: []byte("primary")}
+	})
+	mirror, err := server.EnableMirror(shadow.LocalAddr(), MirrorConfig{})
+	if err != nil {
+		t.Fatalf("EnableMirror failed: %v", err)
+	}
+
+	client := newTestClient(t, server)
+	for i := 0; i < 5; i++ {
+		response, err := client.Get("/mirrored")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if !containsString(string(response), "primary") {
+			t.Fatalf("Expected the primary's response, got %q", response)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for shadowed.Load() < 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := shadowed.Load(); n != 5 {
+		t.Errorf("Expected the shadow to see 5 requests, saw %d", n)
+	}
+	server.DisableMirror()
+	if stats := mirror.Stats(); stats.Mirrored != 5 || stats.Errors != 0 {
+		t.Errorf("Unexpected mirror stats %+v", stats)
+	}
+}
+
+func TestMirrorSampling(t *testing.T) {
+	shadow := startTestServer(t)
+	mirror, err := NewMirror(shadow.LocalAddr(), MirrorConfig{SampleRate: 0.25, BufferSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := buildGetRequest("/benchmark", shadow.LocalAddr())
+	for i := 0; i < 400; i++ {
+		mirror.Mirror(request)
+	}
+	mirror.Close()
+
+	stats := mirror.Stats()
+	if stats.Skipped+stats.Mirrored+stats.Dropped+stats.Errors != 400 {
+		t.Errorf("Expected every request counted once, got %+v", stats)
+	}
+	if stats.Skipped < 240 || stats.Skipped > 360 {
+		t.Errorf("Expected about 300 requests skipped at a 0.25 sample rate, got %d", stats.Skipped)
+	}
+
+	if _, err := NewMirror(shadow.LocalAddr(), MirrorConfig{SampleRate: 1.5}); err == nil {
+		t.Error("Expected a sample rate above 1 to be rejected")
+	}
+}
@@ -0,0 +1,155 @@
+package ultrafast
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+// MulticastGroup is an IPv4 multicast group joined on a socket. Datagrams
+// sent to the group's address on the socket's port arrive through the
+// socket's usual RecvFrom until the group is left.
+type MulticastGroup struct {
+	socket *LinuxUDPSocket
+	mreq   syscall.IPMreq
+	group  string
+
+	mu     sync.Mutex
+	joined bool
+}
+
+// parseMulticastIPv4 parses an address in 224.0.0.0/4
+func parseMulticastIPv4(ip string) ([4]byte, error) {
+	var addr [4]byte
+	parsed := parseIPv4(ip)
+	if parsed == nil || parsed[0]&0xF0 != 0xE0 {
+		return addr, fmt.Errorf("not an IPv4 multicast address: %s", ip)
+	}
+	copy(addr[:], parsed)
+	return addr, nil
+}
+
+// parseInterfaceIPv4 parses the address naming a local interface; an
+// empty address lets the kernel pick one by route
+func parseInterfaceIPv4(iface string) ([4]byte, error) {
+	var addr [4]byte
+	if iface == "" {
+		return addr, nil
+	}
+	parsed := parseIPv4(iface)
+	if parsed == nil {
+		return addr, fmt.Errorf("invalid interface address: %s", iface)
+	}
+	copy(addr[:], parsed)
+	return addr, nil
+}
+
+// JoinGroup joins a multicast group on the interface with address iface,
+// or on the kernel's choice of interface if iface is empty. The socket
+// must be bound to the port the group traffic is sent to, and to the
+// wildcard or group address to receive it.
+func (s *LinuxUDPSocket) JoinGroup(group string, iface string) (*MulticastGroup, error) {
+	groupAddr, err := parseMulticastIPv4(group)
+	if err != nil {
+		return nil, err
+	}
+	ifaceAddr, err := parseInterfaceIPv4(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &MulticastGroup{
+		socket: s,
+		mreq:   syscall.IPMreq{Multiaddr: groupAddr, Interface: ifaceAddr},
+		group:  group,
+	}
+	if err := syscall.SetsockoptIPMreq(s.sock(), syscall.IPPROTO_IP, syscall.IP_ADD_MEMBERSHIP, &g.mreq); err != nil {
+		return nil, fmt.Errorf("failed to join %s: %v", group, err)
+	}
+	g.joined = true
+	return g, nil
+}
+
+// Group returns the group's address
+func (g *MulticastGroup) Group() string {
+	return g.group
+}
+
+// Joined reports whether the socket is still a member of the group
+func (g *MulticastGroup) Joined() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.joined
+}
+
+// Send sends a datagram to every member of the group listening on port
+func (g *MulticastGroup) Send(data []byte, port uint16) (int, error) {
+	return g.socket.SendTo(data, g.group, port)
+}
+
+// Leave drops the socket's membership. Leaving twice is an error.
+func (g *MulticastGroup) Leave() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.joined {
+		return fmt.Errorf("not a member of %s", g.group)
+	}
+	if err := syscall.SetsockoptIPMreq(g.socket.sock(), syscall.IPPROTO_IP, syscall.IP_DROP_MEMBERSHIP, &g.mreq); err != nil {
+		return fmt.Errorf("failed to leave %s: %v", g.group, err)
+	}
+	g.joined = false
+	return nil
+}
+
+// SetMulticastTTL sets how many router hops multicast datagrams sent on
+// the socket may cross. The kernel default of 1 keeps them on the local
+// network.
+func (s *LinuxUDPSocket) SetMulticastTTL(ttl int) error {
+	if ttl < 0 || ttl > 255 {
+		return fmt.Errorf("invalid multicast TTL: %d", ttl)
+	}
+	if err := syscall.SetsockoptInt(s.sock(), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl); err != nil {
+		return fmt.Errorf("IP_MULTICAST_TTL: %v", err)
+	}
+	return nil
+}
+
+// SetMulticastLoopback controls whether multicast datagrams sent on the
+// socket are also delivered to group members on this host, including the
+// socket itself. The kernel enables it by default.
+func (s *LinuxUDPSocket) SetMulticastLoopback(enabled bool) error {
+	value := 0
+	if enabled {
+		value = 1
+	}
+	if err := syscall.SetsockoptInt(s.sock(), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, value); err != nil {
+		return fmt.Errorf("IP_MULTICAST_LOOP: %v", err)
+	}
+	return nil
+}
+
+// SetMulticastInterface picks the interface, by its address, that
+// multicast datagrams are sent from; empty restores the route lookup
+func (s *LinuxUDPSocket) SetMulticastInterface(iface string) error {
+	addr, err := parseInterfaceIPv4(iface)
+	if err != nil {
+		return err
+	}
+	if err := syscall.SetsockoptInet4Addr(s.sock(), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, addr); err != nil {
+		return fmt.Errorf("IP_MULTICAST_IF: %v", err)
+	}
+	return nil
+}
+
+// SetBroadcast permits sending to broadcast addresses such as
+// 255.255.255.255, which the kernel otherwise refuses with EACCES
+func (s *LinuxUDPSocket) SetBroadcast(enabled bool) error {
+	value := 0
+	if enabled {
+		value = 1
+	}
+	if err := syscall.SetsockoptInt(s.sock(), syscall.SOL_SOCKET, syscall.SO_BROADCAST, value); err != nil {
+		return fmt.Errorf("SO_BROADCAST: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMulticastGroupValidation(t *testing.T) {
+	socket, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	defer socket.Close()
+
+	if _, err := socket.JoinGroup("10.0.0.1", ""); err == nil {
+		t.Error("Expected a unicast address to be rejected")
+	}
+	if _, err := socket.JoinGroup("239.1.2.3", "not-an-ip"); err == nil {
+		t.Error("Expected an invalid interface address to be rejected")
+	}
+	if err := socket.SetMulticastTTL(256); err == nil {
+		t.Error("Expected TTL 256 to be rejected")
+	}
+
+	if err := socket.SetBroadcast(true); err != nil {
+		t.Fatalf("SetBroadcast failed: %v", err)
+	}
+	if value, _ := syscall.GetsockoptInt(socket.GetFD(), syscall.SOL_SOCKET, syscall.SO_BROADCAST); value != 1 {
+		t.Errorf("Expected SO_BROADCAST to be set, got %d", value)
+	}
+	if err := socket.SetMulticastLoopback(false); err != nil {
+		t.Fatalf("SetMulticastLoopback failed: %v", err)
+	}
+	if value, _ := syscall.GetsockoptInt(socket.GetFD(), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP); value != 0 {
+		t.Errorf("Expected multicast loopback off, got %d", value)
+	}
+}
+
+func TestMulticastSendReceive(t *testing.T) {
+	receiver, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	defer receiver.Close()
+	if err := receiver.Bind("0.0.0.0", 0); err != nil {
+		t.Fatalf("Failed to bind: %v", err)
+	}
+
+	group, err := receiver.JoinGroup("239.255.42.99", "127.0.0.1")
+	if err != nil {
+		t.Skipf("Multicast unavailable on loopback: %v", err)
+	}
+
+	sender, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatalf("Failed to create socket: %v", err)
+	}
+	defer sender.Close()
+	if err := sender.SetMulticastInterface("127.0.0.1"); err != nil {
+		t.Fatalf("SetMulticastInterface failed: %v", err)
+	}
+	if err := sender.SetMulticastTTL(1); err != nil {
+		t.Fatalf("SetMulticastTTL failed: %v", err)
+	}
+	port := receiver.GetLocalAddr().Port
+	if _, err := sender.SendTo([]byte("hello group"), group.Group(), port); err != nil {
+		t.Skipf("Multicast send unavailable: %v", err)
+	}
+
+	timeout := syscall.NsecToTimeval((500 * time.Millisecond).Nanoseconds())
+	syscall.SetsockoptTimeval(receiver.GetFD(), syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout)
+	buffer := make([]byte, 64)
+	n, _, err := receiver.RecvFrom(buffer)
+	if err != nil {
+		t.Fatalf("Expected the group datagram, got %v", err)
+	}
+	if string(buffer[:n]) != "hello group" {
+		t.Errorf("Expected %q, got %q", "hello group", buffer[:n])
+	}
+
+	if err := group.Leave(); err != nil {
+		t.Fatalf("Leave failed: %v", err)
+	}
+	if group.Joined() || group.Leave() == nil {
+		t.Error("Leaving twice should fail")
+	}
+}
@@ -0,0 +1,439 @@
+package ultrafast
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxPaths bounds the paths one connection stripes over, its main path
+// included
+const maxPaths = 4
+
+// pathFailureLosses is how many packets in a row a path may lose before
+// the scheduler stops using it; an ACK for one of its packets brings it
+// back
+const pathFailureLosses = 3
+
+// PathInfo is a point-in-time view of one path of a multipath connection.
+// The main path, listed first, leaves Local and Peer zero: it is the
+// server's own socket and the connection's peer.
+type PathInfo struct {
+	Local    SocketAddr
+	Peer     SocketAddr
+	RTT      time.Duration // smoothed, 0 until a packet on the path is acknowledged
+	Sent     uint64
+	Acked    uint64
+	Lost     uint64 // presumed lost after a timeout or fast retransmit
+	InFlight int
+}
+
+// sendPath is one way to reach a connection's peer: a local socket and
+// the address the peer's packets arrive at it from
+type sendPath struct {
+	socket   *LinuxUDPSocket // nil for the main path
+	peer     SocketAddr      // unused for the main path, which follows the connection
+	rtt      time.Duration
+	inflight map[uint32]time.Time
+	sent     uint64
+	acked    uint64
+	lost     uint64
+	lossRun  int // losses since the last ACK
+}
+
+// multipath holds the paths a connection's DATA packets are striped over.
+// paths[0] is the main path through the server's own socket.
+type multipath struct {
+	mu    sync.Mutex
+	paths []*sendPath
+}
+
+// newMultipath creates the paths of a connection with only its main one,
+// whose RTT the connection has measured so far
+func newMultipath(rtt time.Duration) *multipath {
+	return &multipath{paths: []*sendPath{{rtt: rtt, inflight: make(map[uint32]time.Time)}}}
+}
+
+// addPath adds the path through socket to peer, unless the connection
+// has it already or has run out of paths
+func (m *multipath) addPath(socket *LinuxUDPSocket, peer SocketAddr) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, path := range m.paths {
+		if path.socket == socket && path.peer == peer {
+			return false
+		}
+	}
+	if len(m.paths) >= maxPaths {
+		return false
+	}
+	m.paths = append(m.paths, &sendPath{socket: socket, peer: peer, inflight: make(map[uint32]time.Time)})
+	return true
+}
+
+// schedule picks the path for DATA packet seqNum, lowest RTT first.
+// A path not yet measured counts as the fastest, so each gets probed.
+// The congestion window is shared between the paths that have not
+// failed: one with its share in flight is passed over for the next
+// fastest, which is what stripes a burst across them. With every path
+// full or failed the packet takes the main path.
+func (m *multipath) schedule(seqNum uint32, window int, now time.Time) *sendPath {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	usable := 0
+	for _, path := range m.paths {
+		if path.lossRun < pathFailureLosses {
+			usable++
+		}
+	}
+	share := (window + usable - 1) / max(usable, 1)
+
+	var best *sendPath
+	for _, path := range m.paths {
+		if path.lossRun >= pathFailureLosses || len(path.inflight) >= share {
+			continue
+		}
+		if best == nil || path.rtt < best.rtt {
+			best = path
+		}
+	}
+	if best == nil {
+		best = m.paths[0]
+	}
+	best.inflight[seqNum] = now
+	best.sent++
+	return best
+}
+
+// take removes seqNum from the path it was sent on and returns the path
+// and send time; caller must hold m.mu
+func (m *multipath) take(seqNum uint32) (*sendPath, time.Time) {
+	for _, path := range m.paths {
+		if sentAt, ok := path.inflight[seqNum]; ok {
+			delete(path.inflight, seqNum)
+			return path, sentAt
+		}
+	}
+	return nil, time.Time{}
+}
+
+// acked folds the RTT of an acknowledged packet into its path's estimate
+func (m *multipath) acked(seqNum uint32, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path, sentAt := m.take(seqNum)
+	if path == nil {
+		return
+	}
+	path.acked++
+	path.lossRun = 0
+
+	// Same 7/8 smoothing as the connection's estimate
+	sample := now.Sub(sentAt)
+	if path.rtt == 0 {
+		path.rtt = sample
+	} else {
+		path.rtt = (path.rtt*7 + sample) / 8
+	}
+}
+
+// lost charges a packet presumed lost to the path it was sent on
+func (m *multipath) lost(seqNum uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if path, _ := m.take(seqNum); path != nil {
+		path.markLost()
+	}
+}
+
+// expire presumes lost the packets in flight on any path for longer than
+// timeout
+func (m *multipath) expire(now time.Time, timeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, path := range m.paths {
+		for seqNum, sentAt := range path.inflight {
+			if now.Sub(sentAt) > timeout {
+				delete(path.inflight, seqNum)
+				path.markLost()
+			}
+		}
+	}
+}
+
+// markLost counts a lost packet; caller must hold the multipath's mu
+func (p *sendPath) markLost() {
+	p.lost++
+	p.lossRun++
+}
+
+// infos returns a snapshot of every path
+func (m *multipath) infos() []PathInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	infos := make([]PathInfo, len(m.paths))
+	for i, path := range m.paths {
+		infos[i] = PathInfo{
+			Peer:     path.peer,
+			RTT:      path.rtt,
+			Sent:     path.sent,
+			Acked:    path.acked,
+			Lost:     path.lost,
+			InFlight: len(path.inflight),
+		}
+		if path.socket != nil {
+			infos[i].Local = path.socket.GetLocalAddr()
+		}
+	}
+	return infos
+}
+
+// Paths returns the connection's paths, or nil unless its peer opened a
+// second one
+func (c *Connection) Paths() []PathInfo {
+	if paths := c.paths.Load(); paths != nil {
+		return paths.infos()
+	}
+	return nil
+}
+
+// pathHandler serves the second local socket of multipath mode. Packets
+// arriving on it must carry the connection ID of an established
+// connection; each new peer address they come from opens a path, and
+// the packets are then handled as if they had come over the main path.
+type pathHandler struct {
+	server *UltraFastHTTPServer
+	socket *LinuxUDPSocket
+	reader *PacketReader
+}
+
+// EnableMultipath turns on experimental multipath mode: a second socket
+// bound to ip:port, normally on another interface, over which the
+// server also reaches its clients. A client opens a path by sending any
+// packet with its connection ID to that address, as AddPath does, and
+// the connection's DATA packets are then striped over its paths by a
+// lowest-RTT-first scheduler that tracks each path's RTT and losses.
+// ACKs and other control packets keep to the main path.
+func (s *UltraFastHTTPServer) EnableMultipath(ip string, port uint16) error {
+	socket, err := NewLinuxUDPSocket()
+	if err != nil {
+		return err
+	}
+	if err := socket.Bind(ip, port); err != nil {
+		socket.Close()
+		return err
+	}
+
+	socket.packetAuth.Store(s.socket.packetAuth.Load())
+
+	handler := &pathHandler{server: s, socket: socket, reader: NewPacketReader(socket)}
+	if err := s.eventLoop.AddSocket(socket, handler); err != nil {
+		socket.Close()
+		return err
+	}
+	s.DisableMultipath()
+	s.multipath.Store(handler)
+	return nil
+}
+
+// DisableMultipath closes the second socket; connections go back to
+// their main path
+func (s *UltraFastHTTPServer) DisableMultipath() {
+	handler := s.multipath.Swap(nil)
+	if handler == nil {
+		return
+	}
+	for _, conn := range s.connections.Snapshot() {
+		conn.paths.Store(nil)
+	}
+	handler.close()
+}
+
+// MultipathAddr returns the address of the second socket, and false if
+// multipath mode is off
+func (s *UltraFastHTTPServer) MultipathAddr() (SocketAddr, bool) {
+	if handler := s.multipath.Load(); handler != nil {
+		return handler.socket.GetLocalAddr(), true
+	}
+	return SocketAddr{}, false
+}
+
+// close stops serving the socket and closes it, on the event loop while
+// it runs so that no read is under way
+func (p *pathHandler) close() {
+	closeSocket := func() {
+		p.server.eventLoop.RemoveSocket(p.socket.GetFD())
+		p.socket.Close()
+	}
+	if atomic.LoadInt32(&p.server.loopRunning) == 1 {
+		p.server.eventLoop.Submit(closeSocket)
+	} else {
+		closeSocket()
+	}
+}
+
+// OnRead handles packets arriving over the second socket
+func (p *pathHandler) OnRead(fd int) error {
+	for {
+		header, body, from, err := p.reader.ReadDatagram()
+		if err != nil {
+			if errors.Is(err, ErrWouldBlock) {
+				break
+			}
+			return fmt.Errorf("recv error: %v", err)
+		}
+		if len(header) > 0 {
+			p.receive(header, body, from)
+		}
+	}
+	return nil
+}
+
+// receive opens or refreshes the path a packet came over and hands it to
+// the main handler, as from the connection's main peer
+func (p *pathHandler) receive(header, body []byte, from SocketAddr) {
+	if !p.server.admitSource(from) {
+		return
+	}
+	h := p.server.handler.Load()
+	packet, err := decodePacket(header, body, p.socket.checksumsFor(from))
+	if err != nil || h == nil {
+		atomic.AddUint64(&p.server.stats.Errors, 1)
+		return
+	}
+	if !p.socket.verifyPacket(packet) {
+		atomic.AddUint64(&p.server.stats.AuthFailed, 1)
+		return
+	}
+	id, hasID := packet.ConnectionID()
+	if !hasID {
+		return
+	}
+	conn := p.server.connections.GetByID(id)
+	if conn == nil {
+		return // paths only join established connections
+	}
+
+	size := len(header) + len(body)
+	atomic.AddUint64(&p.server.stats.RequestsReceived, 1)
+	atomic.AddUint64(&p.server.stats.BytesReceived, uint64(size))
+	p.server.capturePacket("in", packet, from)
+
+	paths := conn.paths.Load()
+	if paths == nil {
+		conn.paths.CompareAndSwap(nil, newMultipath(conn.Info().RTT))
+		paths = conn.paths.Load()
+	}
+	if paths.addPath(p.socket, from) {
+		logInfof("Connection %016x opened a path from %s:%d", id, from.IP, from.Port)
+	}
+
+	// A BINDING request is answered over the path it probes
+	if packet.Type == BINDING_PACKET {
+		if !packet.HasAck() {
+			reply := NewPacket(BINDING_PACKET, ACK_FLAG, 0, packet.SeqNum, encodeBindingAddress(from))
+			if _, err := p.socket.SendPacket(reply, from.IP, from.Port); err != nil {
+				atomic.AddUint64(&p.server.stats.Errors, 1)
+			}
+		}
+		return
+	}
+	h.handlePacket(packet, size, p.server.connections.PeerOf(conn))
+}
+
+// OnWrite handles write events
+func (p *pathHandler) OnWrite(fd int) error {
+	return nil
+}
+
+// OnError handles error events
+func (p *pathHandler) OnError(fd int, err error) {
+	atomic.AddUint64(&p.server.stats.Errors, 1)
+	logWarnf("Path socket error on fd %d: %v", fd, err)
+}
+
+// OnClose handles close events
+func (p *pathHandler) OnClose(fd int) {}
+
+// sendOnPath sends a DATA packet over the path the scheduler chose
+func (h *HTTPSocketHandler) sendOnPath(path *sendPath, packet *Packet, conn *Connection, to SocketAddr) (int, error) {
+	if path.socket == nil {
+		return h.sendPacket(packet, to)
+	}
+	size := packet.encodedSize()
+	if _, err := path.socket.SendPacket(packet, path.peer.IP, path.peer.Port); err != nil {
+		return 0, err
+	}
+	h.server.capturePacket("out", packet, path.peer)
+	h.server.pacer.Load().Charge(size)
+	conn.RecordOut(size)
+	return size, nil
+}
+
+// retransmit resends a packet fast retransmit found lost. On a multipath
+// connection the loss is charged to its path and the resend scheduled
+// afresh.
+func (h *HTTPSocketHandler) retransmit(packet *Packet, conn *Connection, to SocketAddr) {
+	paths := conn.paths.Load()
+	if paths == nil {
+		h.sendPacket(packet, to)
+		return
+	}
+	paths.lost(packet.SeqNum)
+	window := int(conn.Reliability().GetStats().CongestionWindow)
+	h.sendOnPath(paths.schedule(packet.SeqNum, window, time.Now()), packet, conn, to)
+}
+
+// pathAcked records an ACK against the path its packet took
+func (c *Connection) pathAcked(seqNum uint32, now time.Time) {
+	if paths := c.paths.Load(); paths != nil {
+		paths.acked(seqNum, now)
+	}
+}
+
+// expirePaths presumes lost the packets that have been in flight on a
+// path for longer than the connection's retransmission timeout
+func (c *Connection) expirePaths(now time.Time) {
+	if paths := c.paths.Load(); paths != nil {
+		paths.expire(now, c.reliability.GetStats().TimeoutValue)
+	}
+}
+
+// AddPath opens a second path to a server in multipath mode, at the
+// address given by its MultipathAddr. The client probes it with a
+// BINDING request carrying its connection ID, which the server answers
+// over the new path; from then on responses may arrive over either path
+// and each is acknowledged over the path it came by.
+func (c *UltraFastClient) AddPath(ip string, port uint16) error {
+	if !c.hasConnID {
+		return fmt.Errorf("multipath needs a connection ID; connect first")
+	}
+	addr := SocketAddr{IP: ip, Port: port}
+	if !slices.Contains(c.paths, addr) {
+		c.paths = append(c.paths, addr)
+	}
+
+	transaction := uint32(randomUint64())
+	probe := NewPacket(BINDING_PACKET, 0, transaction, 0, nil)
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if err := c.sendTo(probe, addr); err != nil {
+			return err
+		}
+		_, err := c.receive(time.Now().Add(c.timeout), func(p *Packet) bool {
+			return p.Type == BINDING_PACKET && p.HasAck() && p.AckNum == transaction
+		})
+		if err == nil {
+			return nil
+		}
+		if err != errClientTimeout {
+			return err
+		}
+	}
+	c.paths = slices.DeleteFunc(c.paths, func(path SocketAddr) bool { return path == addr })
+	return fmt.Errorf("no reply over %s:%d after %d attempts", ip, port, c.retries+1)
+}
@@ -0,0 +1,119 @@
+package ultrafast
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMultipathSchedulesLowestRTTFirst(t *testing.T) {
+	paths := newMultipath(10 * time.Millisecond)
+	second := newBoundSocket(t)
+	peer := SocketAddr{IP: "127.0.0.1", Port: 9}
+	if !paths.addPath(second, peer) || paths.addPath(second, peer) {
+		t.Fatal("Expected the path added once")
+	}
+
+	// The new path is probed first, and measured at 2ms
+	now := time.Now()
+	if path := paths.schedule(2, 4, now); path != paths.paths[1] {
+		t.Fatal("The unmeasured path should be probed")
+	}
+	paths.acked(2, now.Add(2*time.Millisecond))
+
+	// The faster path takes its half of the window, the main path the rest
+	var got []*sendPath
+	for seq := uint32(3); seq < 8; seq++ {
+		got = append(got, paths.schedule(seq, 4, now))
+	}
+	want := []*sendPath{paths.paths[1], paths.paths[1], paths.paths[0], paths.paths[0], paths.paths[0]}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Packet %d took the wrong path", i+3)
+		}
+	}
+
+	// A path losing packets in a row is left out until one is acked
+	for seq := uint32(5); seq < 8; seq++ {
+		paths.acked(seq, now.Add(10*time.Millisecond))
+	}
+	paths.lost(3)
+	paths.lost(4)
+	if path := paths.schedule(8, 4, now); path != paths.paths[1] {
+		t.Fatal("Two losses should not yet fail a path")
+	}
+	paths.expire(now.Add(time.Second), 100*time.Millisecond)
+	if path := paths.schedule(9, 4, now); path != paths.paths[0] {
+		t.Error("A failed path should not be scheduled")
+	}
+	infos := paths.infos()
+	if infos[1].Lost != 3 || infos[1].RTT != 2*time.Millisecond || infos[1].Local != second.GetLocalAddr() {
+		t.Errorf("Unexpected second path: %+v", infos[1])
+	}
+
+	// An ACK for a packet no longer in flight changes nothing
+	paths.acked(8, now)
+	if path := paths.schedule(10, 4, now); path != paths.paths[0] {
+		t.Error("An ACK for an expired packet should not revive the path")
+	}
+}
+
+func TestServerMultipathStripesResponse(t *testing.T) {
+	server := startTestServer(t)
+	if err := server.EnableMultipath("127.0.0.1", 0); err != nil {
+		t.Fatalf("EnableMultipath failed: %v", err)
+	}
+	addr, ok := server.MultipathAddr()
+	if !ok {
+		t.Fatal("Expected a multipath address")
+	}
+	body := bytes.Repeat([]byte("x"), 20*MAX_PAYLOAD_SIZE)
+	server.HandleFunc("/large", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: body}
+	})
+
+	client := newTestClient(t, server)
+	if err := client.AddPath(addr.IP, addr.Port); err == nil {
+		t.Fatal("A path should need a connection first")
+	}
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if err := client.AddPath(addr.IP, addr.Port); err != nil {
+		t.Fatalf("AddPath failed: %v", err)
+	}
+
+	response, err := client.Get("/large")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !bytes.HasSuffix(response, body) {
+		t.Fatalf("Expected the whole body, got %d bytes", len(response))
+	}
+
+	// The last ACKs reach the server after the response reaches us
+	infos := server.Connections()
+	for deadline := time.Now().Add(time.Second); len(infos) == 1 && len(infos[0].Paths) == 2 && time.Now().Before(deadline); infos = server.Connections() {
+		if infos[0].Paths[0].Acked > 0 && infos[0].Paths[1].Acked > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(infos) != 1 || len(infos[0].Paths) != 2 {
+		t.Fatalf("Expected one connection with two paths, got %+v", infos)
+	}
+	for i, path := range infos[0].Paths {
+		if path.Sent == 0 || path.Acked == 0 || path.RTT == 0 {
+			t.Errorf("Path %d carried nothing: %+v", i, path)
+		}
+	}
+	if infos[0].Paths[1].Local != addr {
+		t.Errorf("Expected the second path from %v, got %v", addr, infos[0].Paths[1].Local)
+	}
+
+	server.DisableMultipath()
+	if _, ok := server.MultipathAddr(); ok || server.Connections()[0].Paths != nil {
+		t.Error("Expected multipath off and the connection back on one path")
+	}
+}
@@ -0,0 +1,189 @@
+package ultrafast
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+)
+
+// bindingAddressSize is the payload of a BINDING reply: IPv4 address and port
+const bindingAddressSize = 6
+
+// punchInterval is how often a hole punch resends its SYN while waiting
+// for the peer's to get through
+const punchInterval = 50 * time.Millisecond
+
+// encodeBindingAddress packs the address a BINDING reply reports
+func encodeBindingAddress(addr SocketAddr) []byte {
+	payload := make([]byte, bindingAddressSize)
+	copy(payload[:4], parseIPv4(addr.IP))
+	binary.BigEndian.PutUint16(payload[4:], addr.Port)
+	return payload
+}
+
+// decodeBindingAddress unpacks the address in a BINDING reply
+func decodeBindingAddress(payload []byte) (SocketAddr, error) {
+	if len(payload) != bindingAddressSize {
+		return SocketAddr{}, fmt.Errorf("BINDING reply has %d bytes, want %d", len(payload), bindingAddressSize)
+	}
+	return SocketAddr{
+		IP:   fmt.Sprintf("%d.%d.%d.%d", payload[0], payload[1], payload[2], payload[3]),
+		Port: binary.BigEndian.Uint16(payload[4:]),
+	}, nil
+}
+
+// handleBindingRequest tells a peer the address its packet came from, so
+// a client behind a NAT learns its public mapping. The reply echoes the
+// request's sequence number and needs no connection; at 22 bytes it stays
+// well inside the amplification limit.
+func (h *HTTPSocketHandler) handleBindingRequest(packet *Packet, from SocketAddr) {
+	if packet.HasAck() {
+		return // a reply, not a request
+	}
+	reply := NewPacket(BINDING_PACKET, ACK_FLAG, 0, packet.SeqNum, encodeBindingAddress(from))
+	h.sendPacket(reply, from)
+}
+
+// PublicAddress asks the server which address the client's packets arrive
+// from. Behind a NAT this is the public mapping that a peer must send to,
+// and it stays valid while the client keeps using the same socket.
+func (c *UltraFastClient) PublicAddress() (SocketAddr, error) {
+	transaction := uint32(randomUint64())
+	request := NewPacket(BINDING_PACKET, 0, transaction, 0, nil)
+	reply, err := c.exchange(request, func(p *Packet) bool {
+		return p.Type == BINDING_PACKET && p.HasAck() && p.AckNum == transaction
+	})
+	if err != nil {
+		return SocketAddr{}, err
+	}
+	return decodeBindingAddress(reply.Payload)
+}
+
+// PeerConn is a direct path to another client opened by PunchHole. It
+// carries DATA packets as plain datagrams: delivery is not guaranteed.
+type PeerConn struct {
+	socket    *LinuxUDPSocket
+	peer      SocketAddr
+	localSeq  uint32
+	remoteSeq uint32
+	buffer    []byte
+}
+
+// PunchHole opens a direct path to a peer, typically another client behind
+// a NAT, from the client's socket. Both sides call it at about the same
+// time with each other's public address, as learned from PublicAddress
+// and exchanged through the server or some other channel. Each side keeps
+// sending SYNs; the first ones open its own NAT for the peer's replies,
+// and the handshake completes as a simultaneous open once a SYN gets
+// through in each direction.
+//
+// The client must not be used for requests while the PeerConn is open,
+// since both read the same socket.
+func (c *UltraFastClient) PunchHole(peer SocketAddr, timeout time.Duration) (*PeerConn, error) {
+	pc := &PeerConn{
+		socket:   c.socket,
+		peer:     peer,
+		localSeq: uint32(randomUint64()),
+		buffer:   make([]byte, MAX_PACKET_SIZE),
+	}
+
+	deadline := time.Now().Add(timeout)
+	peerSynSeen := false
+	for time.Now().Before(deadline) {
+		// A SYN-ACK once the peer's SYN is in, so it can finish too
+		flags := uint8(SYN_FLAG)
+		if peerSynSeen {
+			flags |= ACK_FLAG
+		}
+		pc.send(NewPacket(SYN_PACKET, flags, pc.localSeq, pc.remoteSeq+1, nil))
+
+		wait := time.Now().Add(punchInterval)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		for {
+			packet, err := pc.read(wait)
+			if err != nil {
+				break // resend
+			}
+			switch {
+			case packet.IsSynPacket() && packet.HasAck() && packet.AckNum == pc.localSeq+1:
+				// Our SYN got through and so did theirs
+				pc.remoteSeq = packet.SeqNum
+				pc.send(NewPacket(ACK_PACKET, ACK_FLAG, pc.localSeq+1, pc.remoteSeq+1, nil))
+				return pc, nil
+			case packet.IsSynPacket() && !packet.HasAck():
+				peerSynSeen = true
+				pc.remoteSeq = packet.SeqNum
+				pc.send(NewPacket(SYN_PACKET, SYN_FLAG|ACK_FLAG, pc.localSeq, pc.remoteSeq+1, nil))
+			case packet.IsAckPacket() && peerSynSeen && packet.AckNum == pc.localSeq+1:
+				return pc, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("hole punch to %s timed out", peer)
+}
+
+// Peer returns the address of the other side
+func (pc *PeerConn) Peer() SocketAddr {
+	return pc.peer
+}
+
+// Send sends one datagram to the peer
+func (pc *PeerConn) Send(data []byte) error {
+	if len(data) > MAX_PAYLOAD_SIZE {
+		return fmt.Errorf("datagram of %d bytes exceeds %d", len(data), MAX_PAYLOAD_SIZE)
+	}
+	pc.localSeq++
+	return pc.send(NewPacket(DATA_PACKET, 0, pc.localSeq, 0, data))
+}
+
+// Receive waits up to timeout for the next datagram from the peer
+func (pc *PeerConn) Receive(timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		packet, err := pc.read(deadline)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case packet.IsDataPacket():
+			return packet.Payload, nil
+		case packet.IsSynPacket() && packet.HasAck():
+			// Our final ACK of the punch was lost; the peer is still waiting
+			pc.send(NewPacket(ACK_PACKET, ACK_FLAG, pc.localSeq+1, packet.SeqNum+1, nil))
+		case packet.IsFinPacket():
+			return nil, closedError("peer closed the connection")
+		}
+	}
+}
+
+// Close tells the peer the path is no longer in use. The socket stays
+// with the client.
+func (pc *PeerConn) Close() error {
+	return pc.send(NewPacket(FIN_PACKET, FIN_FLAG, pc.localSeq+1, 0, nil))
+}
+
+// send writes a packet to the peer
+func (pc *PeerConn) send(packet *Packet) error {
+	_, err := pc.socket.SendPacket(packet, pc.peer.IP, pc.peer.Port)
+	return err
+}
+
+// read returns the next valid packet from the peer, ignoring all others
+func (pc *PeerConn) read(deadline time.Time) (*Packet, error) {
+	for {
+		pc.socket.SetReadDeadline(deadline)
+		n, from, err := pc.socket.RecvFrom(pc.buffer)
+		if err == os.ErrDeadlineExceeded {
+			return nil, errClientTimeout
+		}
+		if err != nil || from != pc.peer {
+			continue
+		}
+		if packet, err := DeserializePacket(pc.buffer[:n]); err == nil && pc.socket.verifyPacket(packet) {
+			return packet, nil
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package ultrafast
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBindingAddressEncoding(t *testing.T) {
+	addr := SocketAddr{IP: "203.0.113.7", Port: 40000}
+	decoded, err := decodeBindingAddress(encodeBindingAddress(addr))
+	if err != nil || decoded != addr {
+		t.Errorf("Expected %v, got %v, %v", addr, decoded, err)
+	}
+	if _, err := decodeBindingAddress([]byte{1, 2, 3}); err == nil {
+		t.Error("Expected a short payload to be rejected")
+	}
+}
+
+func TestClientPublicAddress(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+
+	addr, err := client.PublicAddress()
+	if err != nil {
+		t.Fatalf("PublicAddress failed: %v", err)
+	}
+	local := client.socket.GetLocalAddr()
+	if addr.IP != "127.0.0.1" || addr.Port == 0 {
+		t.Errorf("Expected the loopback mapping, got %v", addr)
+	}
+	if local.Port != 0 && local.Port != addr.Port {
+		t.Errorf("Expected port %d, got %d", local.Port, addr.Port)
+	}
+}
+
+func TestPunchHole(t *testing.T) {
+	server := startTestServer(t)
+	alice := newTestClient(t, server)
+	bob := newTestClient(t, server)
+
+	// Each learns its public address from the server and, in a real
+	// deployment, passes it to the other through the server
+	aliceAddr, err := alice.PublicAddress()
+	if err != nil {
+		t.Fatalf("PublicAddress failed: %v", err)
+	}
+	bobAddr, err := bob.PublicAddress()
+	if err != nil {
+		t.Fatalf("PublicAddress failed: %v", err)
+	}
+
+	type result struct {
+		conn *PeerConn
+		err  error
+	}
+	bobDone := make(chan result, 1)
+	go func() {
+		conn, err := bob.PunchHole(aliceAddr, 2*time.Second)
+		bobDone <- result{conn, err}
+	}()
+	aliceConn, err := alice.PunchHole(bobAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("Alice's hole punch failed: %v", err)
+	}
+	bobResult := <-bobDone
+	if bobResult.err != nil {
+		t.Fatalf("Bob's hole punch failed: %v", bobResult.err)
+	}
+	bobConn := bobResult.conn
+
+	if err := aliceConn.Send([]byte("hello bob")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if data, err := bobConn.Receive(time.Second); err != nil || string(data) != "hello bob" {
+		t.Errorf("Expected %q, got %q, %v", "hello bob", data, err)
+	}
+	if err := bobConn.Send([]byte("hi alice")); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if data, err := aliceConn.Receive(time.Second); err != nil || string(data) != "hi alice" {
+		t.Errorf("Expected %q, got %q, %v", "hi alice", data, err)
+	}
+
+	aliceConn.Close()
+	if _, err := bobConn.Receive(time.Second); err == nil {
+		t.Error("Expected Receive to report the peer closing")
+	}
+}
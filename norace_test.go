@@ -0,0 +1,5 @@
+//go:build !race
+
+package ultrafast
+
+const raceEnabled = false
@@ -0,0 +1,234 @@
+package ultrafast
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxReorderSegments is how many segments arriving ahead of a missing
+// one a reader holds; past that they are dropped and resent by the peer
+const maxReorderSegments = connectionTableSize
+
+// OrderedReader returns the payload bytes of a connection's DATA packets
+// in sequence order, whatever order they arrived in: packets ahead of a
+// missing one wait for it, and copies of packets already delivered are
+// dropped. Read blocks until bytes arrive; TryRead returns at once. It
+// starts where the connection's receive side has got to when it is
+// taken, the peer's first DATA packet or the one after the request that
+// switched the connection to a stream, so a packet overtaken by later
+// ones is still waited for. A layer that never learned the peer's
+// sequence numbers starts it from the first packet handed to it.
+type OrderedReader struct {
+	mu       sync.Mutex
+	synced   bool
+	next     uint32            // the sequence number whose payload is due next
+	pending  map[uint32][]byte // payloads that arrived ahead of next
+	buf      []byte            // in order and not yet read
+	eof      bool
+	closed   bool
+	err      error // why the connection was aborted, if it was
+	deadline time.Time
+
+	readable chan struct{} // signalled when data, EOF, an error or a deadline change arrives
+}
+
+// Reader returns the layer's ordered reader. Once it is taken,
+// ReceivePacket hands DATA payloads to it rather than queueing packets
+// for GetOrderedPackets.
+func (rf *LockFreeReliabilityLayer) Reader() *OrderedReader {
+	if reader := rf.reader.Load(); reader != nil {
+		return reader
+	}
+	reader := newOrderedReader()
+	if next, synced := rf.acks.expected(); synced {
+		reader.startAt(next)
+	}
+	if !rf.reader.CompareAndSwap(nil, reader) {
+		return rf.reader.Load()
+	}
+	return reader
+}
+
+// Reader returns the ordered bytes the peer sends on the connection. A
+// connection carrying a stream reads through it; on others, once taken,
+// it receives the DATA packets that would otherwise be served as
+// requests.
+func (c *Connection) Reader() *OrderedReader {
+	return c.reliability.Reader()
+}
+
+// newOrderedReader creates a reader
+func newOrderedReader() *OrderedReader {
+	return &OrderedReader{readable: make(chan struct{}, 1)}
+}
+
+// startAt makes seq the first sequence number the reader delivers. It
+// must be called before anything is pushed.
+func (r *OrderedReader) startAt(seq uint32) {
+	r.mu.Lock()
+	r.next, r.synced = seq, true
+	r.mu.Unlock()
+}
+
+// push hands the reader a DATA packet's payload, which it copies. It
+// reports false for a packet dropped for arriving too far ahead of a
+// missing one to be held.
+func (r *OrderedReader) push(seq uint32, payload []byte) bool {
+	r.mu.Lock()
+	if !r.synced {
+		r.next, r.synced = seq, true
+	}
+	if r.closed || r.eof || r.err != nil {
+		r.mu.Unlock()
+		return true
+	}
+
+	switch offset := seq - r.next; {
+	case offset == 0:
+		r.buf = append(r.buf, payload...)
+		r.next++
+		for {
+			payload, ok := r.pending[r.next]
+			if !ok {
+				break
+			}
+			r.buf = append(r.buf, payload...)
+			delete(r.pending, r.next)
+			r.next++
+		}
+	case int32(offset) < 0:
+		// Delivered already, retransmitted after its ACK was lost
+	case offset >= ackTrackerSpan || len(r.pending) >= maxReorderSegments:
+		r.mu.Unlock()
+		return false
+	default:
+		if r.pending == nil {
+			r.pending = make(map[uint32][]byte)
+		}
+		if _, ok := r.pending[seq]; !ok {
+			r.pending[seq] = append([]byte(nil), payload...)
+		}
+		r.mu.Unlock()
+		return true
+	}
+	r.mu.Unlock()
+
+	notify(r.readable)
+	return true
+}
+
+// Read reads bytes in order, blocking until some arrive, the peer closes
+// the connection or the read deadline passes. After the peer's FIN and
+// everything before it, it returns io.EOF.
+func (r *OrderedReader) Read(b []byte) (int, error) {
+	for {
+		n, err := r.TryRead(b)
+		if err != ErrWouldBlock {
+			return n, err
+		}
+
+		r.mu.Lock()
+		deadline := r.deadline
+		r.mu.Unlock()
+		if err := r.wait(deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// TryRead is Read without blocking: with no bytes to read it returns
+// ErrWouldBlock at once
+func (r *OrderedReader) TryRead(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case len(r.buf) > 0:
+		n := copy(b, r.buf)
+		r.buf = r.buf[n:]
+		if len(r.buf) == 0 {
+			r.buf = nil // let the backing array go
+		}
+		return n, nil
+	case r.closed:
+		return 0, errUseOfClosed
+	case r.err != nil:
+		return 0, r.err
+	case r.eof:
+		return 0, io.EOF
+	}
+	return 0, ErrWouldBlock
+}
+
+// Buffered returns how many bytes can be read without blocking
+func (r *OrderedReader) Buffered() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.buf)
+}
+
+// SetReadDeadline sets the deadline for pending and future Reads
+func (r *OrderedReader) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	r.deadline = t
+	r.mu.Unlock()
+	notify(r.readable)
+	return nil
+}
+
+// wait blocks until the reader is signalled or the deadline passes
+func (r *OrderedReader) wait(deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-r.readable:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// finish marks the end of the peer's data, read as io.EOF once the bytes
+// before it are
+func (r *OrderedReader) finish() {
+	r.mu.Lock()
+	r.eof = true
+	r.mu.Unlock()
+	notify(r.readable)
+}
+
+// fail ends the reader with the error that aborted its connection
+func (r *OrderedReader) fail(err error) {
+	r.mu.Lock()
+	r.err = err
+	r.mu.Unlock()
+	notify(r.readable)
+}
+
+// taking reports whether the reader still takes data, not having been
+// closed
+func (r *OrderedReader) taking() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.closed
+}
+
+// close makes blocked and later Reads return an error matching
+// ErrConnClosed, and drops what was held
+func (r *OrderedReader) close() {
+	r.mu.Lock()
+	r.closed = true
+	r.pending = nil
+	r.mu.Unlock()
+	notify(r.readable)
+}
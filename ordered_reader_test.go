@@ -0,0 +1,158 @@
+package ultrafast
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOrderedReaderReassembles(t *testing.T) {
+	reader := newOrderedReader()
+	buf := make([]byte, 64)
+	if _, err := reader.TryRead(buf); !errors.Is(err, ErrWouldBlock) {
+		t.Fatalf("Expected ErrWouldBlock with nothing buffered, got %v", err)
+	}
+
+	// Across the wraparound, out of order and with duplicates
+	for _, seg := range []struct {
+		seq     uint32
+		payload string
+	}{
+		{0xFFFFFFFE, "a"},
+		{0, "c"},
+		{0, "c"},
+		{0xFFFFFFFE, "a"},
+		{1, "d"},
+	} {
+		if !reader.push(seg.seq, []byte(seg.payload)) {
+			t.Fatalf("Segment %d dropped", seg.seq)
+		}
+	}
+	if n := reader.Buffered(); n != 1 {
+		t.Fatalf("Expected only the first byte readable before the gap fills, got %d", n)
+	}
+	reader.push(0xFFFFFFFF, []byte("b"))
+	if n, err := reader.TryRead(buf); err != nil || string(buf[:n]) != "abcd" {
+		t.Fatalf("Expected %q, got %q, %v", "abcd", buf[:n], err)
+	}
+
+	// Too far ahead to hold
+	if reader.push(2+ackTrackerSpan, []byte("x")) {
+		t.Error("Expected a segment past the span dropped")
+	}
+
+	// Read blocks until data arrives, and ends at the peer's FIN
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		reader.push(2, []byte("e"))
+		reader.finish()
+	}()
+	data, err := io.ReadAll(reader)
+	if err != nil || string(data) != "e" {
+		t.Errorf("Expected %q then EOF, got %q, %v", "e", data, err)
+	}
+}
+
+func TestOrderedReaderDeadlineAndClose(t *testing.T) {
+	reader := newOrderedReader()
+	reader.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := reader.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the deadline to pass, got %v", err)
+	}
+
+	reader.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		reader.close()
+	}()
+	if _, err := reader.Read(make([]byte, 1)); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("Expected a blocked Read to end with the close, got %v", err)
+	}
+}
+
+func TestLockFreeReliabilityReader(t *testing.T) {
+	rel := NewLockFreeReliabilityLayer()
+	reader := rel.Reader()
+	if rel.Reader() != reader {
+		t.Fatal("Expected the same reader each time")
+	}
+	for _, seq := range []uint32{5, 7, 6, 6} {
+		rel.ReceivePacket(NewPacket(DATA_PACKET, 0, seq, 0, []byte{byte('0' + seq)}))
+	}
+	if packets := rel.GetOrderedPackets(); len(packets) != 0 {
+		t.Errorf("Expected nothing queued once the reader is taken, got %d packets", len(packets))
+	}
+	buf := make([]byte, 8)
+	if n, err := reader.TryRead(buf); err != nil || string(buf[:n]) != "567" {
+		t.Errorf("Expected %q, got %q, %v", "567", buf[:n], err)
+	}
+}
+
+func TestOrderedReaderLateFirstSegment(t *testing.T) {
+	// The handshake told the layer where the peer's data starts, so a
+	// reader taken then waits for a first segment the second overtook
+	rel := NewLockFreeReliabilityLayer()
+	rel.acks.sync(10)
+	reader := rel.Reader()
+	for _, seg := range []struct {
+		seq     uint32
+		payload string
+	}{
+		{11, "world"},
+		{10, "hello "},
+	} {
+		packet := NewPacket(DATA_PACKET, 0, seg.seq, 0, []byte(seg.payload))
+		rel.AckReceived(packet)
+		rel.ReceivePacket(packet)
+	}
+	buf := make([]byte, 16)
+	if n, err := reader.TryRead(buf); err != nil || string(buf[:n]) != "hello world" {
+		t.Errorf("Expected %q, got %q, %v", "hello world", buf[:n], err)
+	}
+
+	// Taken later, it starts after what was acknowledged before
+	rel = NewLockFreeReliabilityLayer()
+	rel.acks.sync(10)
+	rel.AckReceived(NewPacket(DATA_PACKET, 0, 10, 0, nil))
+	reader = rel.Reader()
+	rel.ReceivePacket(NewPacket(DATA_PACKET, 0, 12, 0, []byte("!")))
+	rel.ReceivePacket(NewPacket(DATA_PACKET, 0, 11, 0, []byte("hi")))
+	if n, err := reader.TryRead(buf); err != nil || string(buf[:n]) != "hi!" {
+		t.Errorf("Expected %q, got %q, %v", "hi!", buf[:n], err)
+	}
+}
+
+func TestServerConnectionReader(t *testing.T) {
+	server := startTestServer(t)
+	received := make(chan string, 1)
+	server.OnConnection(func(conn *Connection) {
+		if conn.Reader() != conn.Stream().Reader() {
+			received <- "a second reader"
+			return
+		}
+		buf := make([]byte, 5)
+		n, err := io.ReadFull(conn.Reader(), buf)
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		received <- string(buf[:n])
+	})
+
+	stream := dialTestStream(t, server)
+	for _, chunk := range []string{"he", "llo"} {
+		if _, err := stream.Write([]byte(chunk)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	select {
+	case got := <-received:
+		if got != "hello" {
+			t.Errorf("Expected %q, got %q", "hello", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Nothing read")
+	}
+}
@@ -0,0 +1,192 @@
+package ultrafast
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pacerBurst is how much sending an idle server may save up under a
+// bandwidth limit, as time at the limit
+const pacerBurst = 10 * time.Millisecond
+
+// Pacer caps the server's egress in bytes per second with one token
+// bucket shared by every connection. Each datagram sent is charged to the
+// bucket, but only DATA packets carrying responses on a connection wait
+// for it: ACKs, handshakes, FINs, retransmissions and QUIC datagrams go
+// out at once and may leave the bucket in debt, which the next responses
+// pay off. A DATA packet is let
+// out while the bucket is not in debt, so the limit may be overshot by a
+// packet; averaged over time the server sends no faster than the rate.
+type Pacer struct {
+	mu        sync.Mutex
+	rate      float64 // bytes per second
+	burst     float64
+	tokens    float64
+	lastFill  time.Time
+	waiting   map[*Connection]struct{}
+	timer     *time.Timer // pending release of the waiting connections, nil if none
+	release   func(*Connection)
+	throttled uint64 // atomic
+}
+
+// NewPacer creates a pacer sending at most bytesPerSecond. release is
+// called, from a timer goroutine, for each connection whose held packets
+// may go out again.
+func NewPacer(bytesPerSecond float64, release func(*Connection)) *Pacer {
+	p := &Pacer{
+		waiting:  make(map[*Connection]struct{}),
+		lastFill: clockNow(),
+		release:  release,
+	}
+	p.SetRate(bytesPerSecond)
+	p.tokens = p.burst
+	return p
+}
+
+// SetRate changes the limit at runtime; savings beyond the new burst
+// are lost
+func (p *Pacer) SetRate(bytesPerSecond float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.refill(clockNow())
+	p.rate = bytesPerSecond
+	p.burst = max(bytesPerSecond*pacerBurst.Seconds(), MAX_PACKET_SIZE)
+	p.tokens = min(p.tokens, p.burst)
+	if len(p.waiting) > 0 {
+		p.schedule()
+	}
+}
+
+// Rate returns the limit in bytes per second
+func (p *Pacer) Rate() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rate
+}
+
+// Throttled returns how many times a connection was made to wait for
+// the limit
+func (p *Pacer) Throttled() uint64 {
+	return atomic.LoadUint64(&p.throttled)
+}
+
+// Ready reports whether conn may send a DATA packet now. If not, conn
+// is released once the bucket has paid off its debt. A nil pacer is
+// always ready.
+func (p *Pacer) Ready(conn *Connection) bool {
+	if p == nil {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.refill(clockNow())
+	if p.tokens > 0 || p.rate <= 0 {
+		return true
+	}
+	atomic.AddUint64(&p.throttled, 1)
+	p.waiting[conn] = struct{}{}
+	p.schedule()
+	return false
+}
+
+// Charge takes size bytes just sent from the bucket
+func (p *Pacer) Charge(size int) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.refill(clockNow())
+	p.tokens -= float64(size)
+}
+
+// refill adds the tokens earned since the last fill; caller must hold p.mu
+func (p *Pacer) refill(now time.Time) {
+	if elapsed := now.Sub(p.lastFill).Seconds(); elapsed > 0 {
+		p.tokens = min(p.tokens+elapsed*p.rate, p.burst)
+		p.lastFill = now
+	}
+}
+
+// schedule arms the timer for when the bucket is out of debt, unless it
+// is armed already; caller must hold p.mu
+func (p *Pacer) schedule() {
+	if p.timer != nil {
+		return
+	}
+	wait := time.Duration(-p.tokens / p.rate * float64(time.Second))
+	p.timer = time.AfterFunc(max(wait, time.Millisecond), p.fire)
+}
+
+// fire releases the waiting connections; those the bucket cannot serve
+// yet wait again
+func (p *Pacer) fire() {
+	p.mu.Lock()
+	waiting := p.waiting
+	p.waiting = make(map[*Connection]struct{})
+	p.timer = nil
+	p.mu.Unlock()
+
+	for conn := range waiting {
+		p.release(conn)
+	}
+}
+
+// Stop releases every waiting connection and stops the timer, for a
+// pacer taken out of use
+func (p *Pacer) Stop() {
+	p.mu.Lock()
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	waiting := p.waiting
+	p.waiting = make(map[*Connection]struct{})
+	p.mu.Unlock()
+
+	for conn := range waiting {
+		p.release(conn)
+	}
+}
+
+// SetBandwidthLimit caps the server's egress at bytesPerSecond, enforced
+// by a Pacer. Responses over the limit wait on their connection, like
+// those the congestion window holds. The limit can be changed while the
+// server runs; zero or less removes it.
+func (s *UltraFastHTTPServer) SetBandwidthLimit(bytesPerSecond float64) {
+	if bytesPerSecond <= 0 {
+		if pacer := s.pacer.Swap(nil); pacer != nil {
+			pacer.Stop()
+		}
+		return
+	}
+	if pacer := s.pacer.Load(); pacer != nil {
+		pacer.SetRate(bytesPerSecond)
+		return
+	}
+	s.pacer.Store(NewPacer(bytesPerSecond, s.releasePaced))
+}
+
+// BandwidthLimit returns the egress limit in bytes per second, 0 if none
+func (s *UltraFastHTTPServer) BandwidthLimit() float64 {
+	if pacer := s.pacer.Load(); pacer != nil {
+		return pacer.Rate()
+	}
+	return 0
+}
+
+// releasePaced sends what a connection held for the bandwidth limit, on
+// the event loop, unless the connection has gone since
+func (s *UltraFastHTTPServer) releasePaced(conn *Connection) {
+	s.eventLoop.Submit(func() {
+		h := s.handler.Load()
+		peer := s.connections.PeerOf(conn)
+		if h != nil && s.connections.Get(peer) == conn {
+			h.releaseWindow(conn, peer)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package ultrafast
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPacerReleasesAfterDebt(t *testing.T) {
+	released := make(chan *Connection, 1)
+	pacer := NewPacer(100000, func(conn *Connection) { released <- conn })
+	conn := &Connection{}
+
+	if !pacer.Ready(conn) {
+		t.Fatal("A fresh pacer should have its burst to spend")
+	}
+
+	// 5000 bytes of debt take 50ms to pay off at 100KB/s
+	pacer.Charge(int(pacer.burst) + 5000)
+	start := time.Now()
+	if pacer.Ready(conn) {
+		t.Fatal("A pacer in debt should hold DATA packets")
+	}
+	select {
+	case got := <-released:
+		if got != conn {
+			t.Errorf("Released the wrong connection")
+		}
+		if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+			t.Errorf("Released after %v, before the debt was paid", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("The waiting connection was never released")
+	}
+	if !pacer.Ready(conn) || pacer.Throttled() != 1 {
+		t.Errorf("Expected the pacer ready after one hold, throttled %d", pacer.Throttled())
+	}
+}
+
+func TestServerBandwidthLimit(t *testing.T) {
+	server := startTestServer(t)
+	admin := NewAdminServer("")
+	server.registerAdminCommands(admin)
+	if reply := admin.Execute("bandwidth 200000"); reply != "bandwidth=200000\nOK\n" {
+		t.Fatalf("Unexpected bandwidth reply: %q", reply)
+	}
+	if limit := server.BandwidthLimit(); limit != 200000 {
+		t.Fatalf("Expected a 200000 B/s limit, got %v", limit)
+	}
+
+	body := bytes.Repeat([]byte("x"), 20*MAX_PAYLOAD_SIZE)
+	server.HandleFunc("/large", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: body}
+	})
+
+	// 28KB at 200KB/s, less the burst, takes well over 100ms
+	client := newTestClient(t, server)
+	start := time.Now()
+	response, err := client.Get("/large")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Response took %v, faster than the limit allows", elapsed)
+	}
+	if !bytes.HasSuffix(response, body) {
+		t.Fatalf("Expected the whole body, got %d bytes", len(response))
+	}
+	if reply := admin.Execute("bandwidth"); !strings.HasPrefix(reply, "bandwidth=200000 throttled=") ||
+		strings.Contains(reply, "throttled=0\n") {
+		t.Errorf("Expected throttled packets, got %q", reply)
+	}
+
+	if reply := admin.Execute("bandwidth off"); reply != "bandwidth off\nOK\n" || server.BandwidthLimit() != 0 {
+		t.Errorf("Expected the limit removed, got %q", reply)
+	}
+	if reply := admin.Execute("bandwidth -5"); !strings.HasPrefix(reply, "ERR") {
+		t.Errorf("Expected a negative rate refused, got %q", reply)
+	}
+}
@@ -1,17 +1,25 @@
-package main
+package ultrafast
 
 import (
+	"encoding/binary"
 	"fmt"
-	"unsafe"
+	"slices"
 )
 
 // Packet types
 const (
-	DATA_PACKET = 0x01
-	ACK_PACKET  = 0x02
-	SYN_PACKET  = 0x03
-	FIN_PACKET  = 0x04
-	RST_PACKET  = 0x05
+	DATA_PACKET           = 0x01
+	ACK_PACKET            = 0x02
+	SYN_PACKET            = 0x03
+	FIN_PACKET            = 0x04
+	RST_PACKET            = 0x05
+	RETRY_PACKET          = 0x06 // Address validation challenge sent in reply to a SYN
+	HELLO_PACKET          = 0x07 // Peer discovery announcement, sent to a multicast group
+	BINDING_PACKET        = 0x08 // Asks for the sender's address as seen by the server; the ACK reply carries it
+	ECHO_REQUEST_PACKET   = 0x09 // Latency probe stamped with the sender's clock
+	ECHO_REPLY_PACKET     = 0x0A // Answer to a probe: its stamp, then the server's receive and send times
+	PATH_CHALLENGE_PACKET = 0x0B // Asks a connection's peer to prove it receives at a new address
+	PATH_RESPONSE_PACKET  = 0x0C // Echoes a PATH_CHALLENGE's payload back from the address it reached
 )
 
 // Packet flags
@@ -20,8 +28,27 @@ const (
 	SYN_FLAG = 0x02
 	FIN_FLAG = 0x04
 	RST_FLAG = 0x08
+	OPT_FLAG = 0x10 // Option TLVs follow the header
 )
 
+// Option types carried in the TLV area between header and payload.
+// Each option is type (1 byte), length (1 byte), value; OPT_END closes the list.
+const (
+	OPT_END           = 0x00
+	OPT_CONNECTION_ID = 0x01 // 8-byte connection ID that survives NAT rebinding
+	OPT_REQUEST_ID    = 0x04 // 4-byte ID matching a response to its request
+	OPT_FRAGMENT      = 0x05 // 4-byte offset + 4-byte total of a multi-packet request or response
+)
+
+// CHECKSUM_NONE in the checksum field means the sender left the checksum
+// to the kernel's UDP checksum. A computed checksum is never zero: the
+// folded sum fits 16 bits, so its complement has the top bits set.
+const CHECKSUM_NONE = 0
+
+// FRAGMENT_TOTAL_OPEN is the total carried by fragments of a streamed
+// response before its length is known; the last fragment has the real total
+const FRAGMENT_TOTAL_OPEN = 0xFFFFFFFF
+
 // Protocol constants
 const (
 	PROTOCOL_VERSION = 0x01
@@ -39,9 +66,16 @@ type Packet struct {
 	SeqNum     uint32  // Sequence number
 	AckNum     uint32  // Acknowledgment number
 	Checksum   uint32  // Packet checksum
+	Options    []PacketOption // Option TLVs, present when OPT_FLAG is set
 	Payload    []byte  // Packet payload
 }
 
+// PacketOption is a single type-length-value header option
+type PacketOption struct {
+	Type  uint8
+	Value []byte
+}
+
 // NewPacket creates a new packet with the specified parameters
 func NewPacket(packetType uint8, flags uint8, seqNum uint32, ackNum uint32, payload []byte) *Packet {
 	if len(payload) > MAX_PAYLOAD_SIZE {
@@ -60,115 +94,291 @@ func NewPacket(packetType uint8, flags uint8, seqNum uint32, ackNum uint32, payl
 	}
 }
 
+// optionsSize returns the encoded size of the option TLVs, including OPT_END
+func (p *Packet) optionsSize() int {
+	if len(p.Options) == 0 {
+		return 0
+	}
+	size := 1 // OPT_END
+	for _, opt := range p.Options {
+		size += 2 + len(opt.Value)
+	}
+	return size
+}
+
+// SetOption adds or replaces a header option
+func (p *Packet) SetOption(optType uint8, value []byte) {
+	for i := range p.Options {
+		if p.Options[i].Type == optType {
+			p.Options[i].Value = value
+			p.Length = uint16(PACKET_HEADER_SIZE + p.optionsSize() + len(p.Payload))
+			return
+		}
+	}
+	p.Options = append(p.Options, PacketOption{Type: optType, Value: value})
+	p.Flags |= OPT_FLAG
+	p.Length = uint16(PACKET_HEADER_SIZE + p.optionsSize() + len(p.Payload))
+}
+
+// GetOption returns the value of a header option
+func (p *Packet) GetOption(optType uint8) ([]byte, bool) {
+	for _, opt := range p.Options {
+		if opt.Type == optType {
+			return opt.Value, true
+		}
+	}
+	return nil, false
+}
+
+// SetConnectionID attaches a connection ID option to the packet
+func (p *Packet) SetConnectionID(id uint64) {
+	value := binary.BigEndian.AppendUint64(nil, id)
+	p.SetOption(OPT_CONNECTION_ID, value)
+}
+
+// ConnectionID returns the packet's connection ID, if it carries one
+func (p *Packet) ConnectionID() (uint64, bool) {
+	value, exists := p.GetOption(OPT_CONNECTION_ID)
+	if !exists || len(value) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(value), true
+}
+
+// SetRequestID tags a request, or the response to it, with a request ID
+func (p *Packet) SetRequestID(id uint32) {
+	value := binary.BigEndian.AppendUint32(nil, id)
+	p.SetOption(OPT_REQUEST_ID, value)
+}
+
+// RequestID returns the packet's request ID, if it carries one
+func (p *Packet) RequestID() (uint32, bool) {
+	value, exists := p.GetOption(OPT_REQUEST_ID)
+	if !exists || len(value) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(value), true
+}
+
+// SetFragment marks the packet as the part of a multi-packet message
+// starting at offset within total bytes
+func (p *Packet) SetFragment(offset, total uint32) {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint32(value[0:], offset)
+	binary.BigEndian.PutUint32(value[4:], total)
+	p.SetOption(OPT_FRAGMENT, value)
+}
+
+// Fragment returns the packet's offset and total message size, if it is
+// part of a multi-packet message
+func (p *Packet) Fragment() (offset, total uint32, ok bool) {
+	value, exists := p.GetOption(OPT_FRAGMENT)
+	if !exists || len(value) != 8 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint32(value[0:]), binary.BigEndian.Uint32(value[4:]), true
+}
+
 // Serialize converts the packet to byte array for transmission
 func (p *Packet) Serialize() []byte {
-	buffer := make([]byte, p.Length)
-	
+	buffer := p.encodeHeader(make([]byte, 0, p.encodedSize()), true)
+	return append(buffer, p.Payload...)
+}
+
+// encodedSize returns the packet's length on the wire
+func (p *Packet) encodedSize() int {
+	return PACKET_HEADER_SIZE + p.optionsSize() + len(p.Payload)
+}
+
+// encodeHeader appends the header and options to buffer and returns it,
+// leaving the payload to be sent from its own slice. The checksum still
+// covers the payload, and Length is updated to include it. Without
+// checksum the field is sent as CHECKSUM_NONE.
+func (p *Packet) encodeHeader(buffer []byte, checksum bool) []byte {
+	optionsSize := p.optionsSize()
+	p.Length = uint16(PACKET_HEADER_SIZE + optionsSize + len(p.Payload))
+	start := len(buffer)
+	buffer = slices.Grow(buffer, PACKET_HEADER_SIZE+optionsSize)[:start+PACKET_HEADER_SIZE+optionsSize]
+	header := PacketHeader(buffer[start:])
+
 	// Pack header fields in network byte order
-	buffer[0] = (p.Version << 4) | (p.Type & 0x0F)
-	buffer[1] = p.Flags
-	*(*uint16)(unsafe.Pointer(&buffer[2])) = htons(p.Length)
-	*(*uint32)(unsafe.Pointer(&buffer[4])) = htonl(p.SeqNum)
-	*(*uint32)(unsafe.Pointer(&buffer[8])) = htonl(p.AckNum)
-	
-	// Copy payload
-	if len(p.Payload) > 0 {
-		copy(buffer[PACKET_HEADER_SIZE:], p.Payload)
+	header.SetVersion(p.Version)
+	header.SetType(p.Type)
+	header.SetFlags(p.Flags)
+	header.SetLength(p.Length)
+	header.SetSeqNum(p.SeqNum)
+	header.SetAckNum(p.AckNum)
+
+	// Encode options after the fixed header
+	if optionsSize > 0 {
+		offset := PACKET_HEADER_SIZE
+		for _, opt := range p.Options {
+			header[offset] = opt.Type
+			header[offset+1] = uint8(len(opt.Value))
+			copy(header[offset+2:], opt.Value)
+			offset += 2 + len(opt.Value)
+		}
+		header[offset] = OPT_END
 	}
-	
+
 	// Calculate and set checksum (exclude checksum field itself)
-	p.Checksum = calculateChecksum(buffer[:12], buffer[PACKET_HEADER_SIZE:])
-	*(*uint32)(unsafe.Pointer(&buffer[12])) = htonl(p.Checksum)
-	
+	p.Checksum = CHECKSUM_NONE
+	if checksum {
+		p.Checksum = checksumParts(header[:headerChecksumOffset], header[PACKET_HEADER_SIZE:], p.Payload)
+	}
+	header.SetChecksum(p.Checksum)
+
 	return buffer
 }
 
-// Deserialize converts byte array back to packet structure
+// Deserialize converts byte array back to packet structure. The payload
+// is copied, so data may be reused afterwards.
 func DeserializePacket(data []byte) (*Packet, error) {
+	return deserializePacket(data, true)
+}
+
+// deserializePacket is DeserializePacket, verifying the checksum only
+// if asked to
+func deserializePacket(data []byte, verify bool) (*Packet, error) {
 	if len(data) < PACKET_HEADER_SIZE {
-		return nil, fmt.Errorf("packet too short: %d bytes", len(data))
+		return nil, packetErrorf(ErrMalformed, "packet too short: %d bytes", len(data))
+	}
+
+	p, err := decodePacket(data[:PACKET_HEADER_SIZE], data[PACKET_HEADER_SIZE:], verify)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Payload) > 0 {
+		p.Payload = append([]byte(nil), p.Payload...)
+	}
+	return p, nil
+}
+
+// decodePacket parses a packet received as its fixed header and the body
+// after it (options and payload). The payload aliases body. Unless verify
+// is set the checksum is not checked, as when the kernel's UDP checksum
+// already covers the datagram.
+func decodePacket(header, body []byte, verify bool) (*Packet, error) {
+	if len(header) < PACKET_HEADER_SIZE {
+		return nil, packetErrorf(ErrMalformed, "packet too short: %d bytes", len(header))
 	}
-	
-	p := &Packet{}
 	
 	// Unpack header fields from network byte order
-	versionType := data[0]
-	p.Version = (versionType >> 4) & 0x0F
-	p.Type = versionType & 0x0F
-	p.Flags = data[1]
-	p.Length = ntohs(*(*uint16)(unsafe.Pointer(&data[2])))
-	p.SeqNum = ntohl(*(*uint32)(unsafe.Pointer(&data[4])))
-	p.AckNum = ntohl(*(*uint32)(unsafe.Pointer(&data[8])))
-	p.Checksum = ntohl(*(*uint32)(unsafe.Pointer(&data[12])))
+	h := PacketHeader(header)
+	p := &Packet{
+		Version:  h.Version(),
+		Type:     h.Type(),
+		Flags:    h.Flags(),
+		Length:   h.Length(),
+		SeqNum:   h.SeqNum(),
+		AckNum:   h.AckNum(),
+		Checksum: h.Checksum(),
+	}
 	
 	// Validate packet length
-	if int(p.Length) != len(data) {
-		return nil, fmt.Errorf("packet length mismatch: expected %d, got %d", p.Length, len(data))
+	if int(p.Length) != PACKET_HEADER_SIZE+len(body) {
+		return nil, packetErrorf(ErrMalformed, "packet length mismatch: expected %d, got %d", p.Length, PACKET_HEADER_SIZE+len(body))
 	}
 	
 	// Validate protocol version
 	if p.Version != PROTOCOL_VERSION {
-		return nil, fmt.Errorf("unsupported protocol version: %d", p.Version)
+		return nil, packetErrorf(ErrVersion, "unsupported protocol version: %d", p.Version)
 	}
 	
-	// Extract payload
-	if p.Length > PACKET_HEADER_SIZE {
-		payloadLen := p.Length - PACKET_HEADER_SIZE
-		p.Payload = make([]byte, payloadLen)
-		copy(p.Payload, data[PACKET_HEADER_SIZE:])
+	// Parse options, if present, then extract payload
+	payloadStart := 0
+	if p.Flags&OPT_FLAG != 0 {
+		options, consumed, err := parseOptions(body)
+		if err != nil {
+			return nil, err
+		}
+		p.Options = options
+		payloadStart = consumed
+	}
+	if len(body) > payloadStart {
+		p.Payload = body[payloadStart:]
 	}
 	
 	// Verify checksum
-	expectedChecksum := calculateChecksum(data[:12], data[PACKET_HEADER_SIZE:])
-	if p.Checksum != expectedChecksum {
-		return nil, fmt.Errorf("checksum mismatch: expected 0x%08X, got 0x%08X", 
-			expectedChecksum, p.Checksum)
+	if verify {
+		expectedChecksum := calculateChecksum(header[:headerChecksumOffset], body)
+		if p.Checksum != expectedChecksum {
+			return nil, packetErrorf(ErrChecksum, "checksum mismatch: expected 0x%08X, got 0x%08X",
+				expectedChecksum, p.Checksum)
+		}
 	}
 	
 	return p, nil
 }
 
-// calculateChecksum computes a simple checksum for the packet
-// This is a basic implementation - in production, use CRC32 or similar
-func calculateChecksum(header []byte, payload []byte) uint32 {
-	var sum uint32
-	
-	// Checksum header (excluding checksum field)
-	for i := 0; i < len(header); i += 4 {
-		if i+4 <= len(header) {
-			word := ntohl(*(*uint32)(unsafe.Pointer(&header[i])))
-			sum += word
-		} else {
-			// Handle remaining bytes
-			word := uint32(0)
-			for j := i; j < len(header); j++ {
-				word |= uint32(header[j]) << (8 * (3 - (j - i)))
-			}
-			sum += word
+// parseOptions decodes option TLVs up to and including OPT_END, returning
+// the options and the number of bytes consumed
+func parseOptions(data []byte) ([]PacketOption, int, error) {
+	var options []PacketOption
+	offset := 0
+	for {
+		if offset >= len(data) {
+			return nil, 0, packetErrorf(ErrMalformed, "unterminated packet options")
+		}
+		optType := data[offset]
+		if optType == OPT_END {
+			return options, offset + 1, nil
 		}
+		if offset+2 > len(data) {
+			return nil, 0, packetErrorf(ErrMalformed, "truncated packet option header")
+		}
+		optLen := int(data[offset+1])
+		if offset+2+optLen > len(data) {
+			return nil, 0, packetErrorf(ErrMalformed, "packet option %d overruns packet: length %d", optType, optLen)
+		}
+		value := make([]byte, optLen)
+		copy(value, data[offset+2:offset+2+optLen])
+		options = append(options, PacketOption{Type: optType, Value: value})
+		offset += 2 + optLen
 	}
-	
-	// Checksum payload
-	for i := 0; i < len(payload); i += 4 {
-		if i+4 <= len(payload) {
-			word := ntohl(*(*uint32)(unsafe.Pointer(&payload[i])))
-			sum += word
-		} else {
-			// Handle remaining bytes
-			word := uint32(0)
-			for j := i; j < len(payload); j++ {
-				word |= uint32(payload[j]) << (8 * (3 - (j - i)))
+}
+
+// calculateChecksum computes a simple checksum for the packet: the
+// header (excluding the checksum field) and payload are each summed as
+// big-endian 32-bit words, zero-padded, then folded to 16 bits. The word
+// sums run through sumWords, which is vectorized where the CPU allows.
+func calculateChecksum(header []byte, payload []byte) uint32 {
+	return foldChecksum(sumPadded(header) + sumPadded(payload))
+}
+
+// checksumParts computes calculateChecksum(header, payload) for a payload
+// split across parts, without joining them. Words run across the
+// boundaries between parts as they would in the joined payload.
+func checksumParts(header []byte, parts ...[]byte) uint32 {
+	var sum, word uint32
+	filled := 0 // bytes of word taken from the end of the previous part
+	add := func(part []byte) {
+		i := 0
+		for ; filled > 0 && i < len(part); i++ {
+			word |= uint32(part[i]) << (8 * (3 - filled))
+			if filled++; filled == 4 {
+				sum += word
+				word, filled = 0, 0
 			}
-			sum += word
+		}
+		n := (len(part) - i) &^ 3
+		sum += sumWords(part[i : i+n])
+		i += n
+		for ; i < len(part); i++ {
+			word |= uint32(part[i]) << (8 * (3 - filled))
+			filled++
 		}
 	}
-	
-	// Fold carry bits
-	for (sum >> 16) > 0 {
-		sum = (sum & 0xFFFF) + (sum >> 16)
+
+	// The header is padded on its own, like calculateChecksum does
+	add(header)
+	sum += word
+	word, filled = 0, 0
+	for _, part := range parts {
+		add(part)
 	}
-	
-	return ^sum & 0xFFFFFFFF
+	sum += word
+	return foldChecksum(sum)
 }
 
 // IsDataPacket returns true if this is a data packet
@@ -196,6 +406,11 @@ func (p *Packet) IsRstPacket() bool {
 	return p.Type == RST_PACKET
 }
 
+// IsRetryPacket returns true if this is an address validation retry packet
+func (p *Packet) IsRetryPacket() bool {
+	return p.Type == RETRY_PACKET
+}
+
 // HasAck returns true if ACK flag is set
 func (p *Packet) HasAck() bool {
 	return (p.Flags & ACK_FLAG) != 0
@@ -230,6 +445,20 @@ func (p *Packet) String() string {
 		typeStr = "FIN"
 	case RST_PACKET:
 		typeStr = "RST"
+	case RETRY_PACKET:
+		typeStr = "RETRY"
+	case HELLO_PACKET:
+		typeStr = "HELLO"
+	case BINDING_PACKET:
+		typeStr = "BINDING"
+	case ECHO_REQUEST_PACKET:
+		typeStr = "ECHO_REQUEST"
+	case ECHO_REPLY_PACKET:
+		typeStr = "ECHO_REPLY"
+	case PATH_CHALLENGE_PACKET:
+		typeStr = "PATH_CHALLENGE"
+	case PATH_RESPONSE_PACKET:
+		typeStr = "PATH_RESPONSE"
 	default:
 		typeStr = fmt.Sprintf("UNKNOWN(%d)", p.Type)
 	}
@@ -247,6 +476,9 @@ func (p *Packet) String() string {
 	if p.HasRst() {
 		flags = append(flags, "RST")
 	}
+	if p.Flags&OPT_FLAG != 0 {
+		flags = append(flags, "OPT")
+	}
 	
 	flagStr := ""
 	if len(flags) > 0 {
@@ -0,0 +1,158 @@
+package ultrafast
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OPT_AUTH_TAG carries a packet's 8-byte packet number, then its
+// authentication tag: HMAC-SHA256 under a pre-shared key, truncated to
+// authTagSize bytes
+const OPT_AUTH_TAG = 0x0A
+
+// authTagSize is the truncated tag length, 128 bits as in RFC 4868
+const authTagSize = 16
+
+// authOptionSize is the OPT_AUTH_TAG value: packet number and tag
+const authOptionSize = 8 + authTagSize
+
+// minAuthKeySize is the shortest pre-shared key accepted
+const minAuthKeySize = 16
+
+// packetAuthKey tags and verifies packets under one pre-shared key. The
+// HMAC states are pooled, as a socket signs and verifies on several
+// goroutines.
+type packetAuthKey struct {
+	macs sync.Pool
+
+	// Number given to the last packet sent. It starts from the clock in
+	// nanoseconds, so a restarted sender carries on above every number
+	// it sent before and the receiver's replay window still holds.
+	lastNumber atomic.Uint64
+}
+
+// newPacketAuthKey copies key into a new packetAuthKey
+func newPacketAuthKey(key []byte) *packetAuthKey {
+	key = append([]byte(nil), key...)
+	k := &packetAuthKey{macs: sync.Pool{New: func() any { return hmac.New(sha256.New, key) }}}
+	k.lastNumber.Store(uint64(time.Now().UnixNano()))
+	return k
+}
+
+// tag computes the tag of a packet with the given number. It covers the
+// number and every header field but the length and checksum, which
+// follow from the rest, and every option but the tag itself. OPT_FLAG is
+// taken as set, as it will be once the tag is added.
+func (k *packetAuthKey) tag(p *Packet, number uint64, dst []byte) []byte {
+	mac := k.macs.Get().(hash.Hash)
+	defer k.macs.Put(mac)
+	mac.Reset()
+
+	var fixed [19]byte
+	binary.BigEndian.PutUint64(fixed[0:], number)
+	fixed[8], fixed[9], fixed[10] = p.Version, p.Type, p.Flags|OPT_FLAG
+	binary.BigEndian.PutUint32(fixed[11:], p.SeqNum)
+	binary.BigEndian.PutUint32(fixed[15:], p.AckNum)
+	mac.Write(fixed[:])
+	for _, opt := range p.Options {
+		if opt.Type != OPT_AUTH_TAG {
+			mac.Write([]byte{opt.Type, uint8(len(opt.Value))})
+			mac.Write(opt.Value)
+		}
+	}
+	mac.Write([]byte{OPT_END})
+	mac.Write(p.Payload)
+
+	var sum [sha256.Size]byte
+	return append(dst, mac.Sum(sum[:0])[:authTagSize]...)
+}
+
+// SetPacketAuth turns on per-packet authentication: every packet the
+// socket sends carries an OPT_AUTH_TAG computed with key, and received
+// packets are only accepted if their tag verifies. This authenticates
+// without encrypting. Both ends need the same key, of at least 16
+// bytes; nil turns authentication off.
+func (s *LinuxUDPSocket) SetPacketAuth(key []byte) error {
+	if key == nil {
+		s.packetAuth.Store(nil)
+		return nil
+	}
+	if len(key) < minAuthKeySize {
+		return fmt.Errorf("packet auth key is %d bytes, at least %d required", len(key), minAuthKeySize)
+	}
+	s.packetAuth.Store(newPacketAuthKey(key))
+	return nil
+}
+
+// PacketAuthEnabled reports whether the socket authenticates packets
+func (s *LinuxUDPSocket) PacketAuthEnabled() bool {
+	return s.packetAuth.Load() != nil
+}
+
+// signPacket numbers and tags a packet about to be sent. A retransmitted
+// packet gets a new number, replacing the tag from its first send, so
+// the receiver does not take it for a replay.
+func (s *LinuxUDPSocket) signPacket(packet *Packet) {
+	key := s.packetAuth.Load()
+	if key == nil {
+		return
+	}
+	value, _ := packet.GetOption(OPT_AUTH_TAG)
+	if cap(value) < authOptionSize {
+		value = make([]byte, 0, authOptionSize)
+	}
+	number := key.lastNumber.Add(1)
+	value = binary.BigEndian.AppendUint64(value[:0], number)
+	packet.SetOption(OPT_AUTH_TAG, key.tag(packet, number, value))
+}
+
+// verifyPacket reports whether a received packet carries a valid tag, or
+// true if the socket does not authenticate packets. The comparison takes
+// the same time wherever the tags differ.
+func (s *LinuxUDPSocket) verifyPacket(packet *Packet) bool {
+	key := s.packetAuth.Load()
+	if key == nil {
+		return true
+	}
+	value, ok := packet.GetOption(OPT_AUTH_TAG)
+	if !ok || len(value) != authOptionSize {
+		return false
+	}
+	var buffer [authTagSize]byte
+	return hmac.Equal(value[8:], key.tag(packet, binary.BigEndian.Uint64(value), buffer[:0]))
+}
+
+// packetNumber returns the number an authenticated packet was sent with
+func packetNumber(packet *Packet) (uint64, bool) {
+	value, ok := packet.GetOption(OPT_AUTH_TAG)
+	if !ok || len(value) != authOptionSize {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(value), true
+}
+
+// SetPacketAuth turns on per-packet authentication with a pre-shared
+// key on the server's sockets, see LinuxUDPSocket.SetPacketAuth. Packets
+// failing it are dropped before they reach a connection, and counted in
+// AuthFailed.
+func (s *UltraFastHTTPServer) SetPacketAuth(key []byte) error {
+	if err := s.socket.SetPacketAuth(key); err != nil {
+		return err
+	}
+	if paths := s.multipath.Load(); paths != nil {
+		paths.socket.packetAuth.Store(s.socket.packetAuth.Load())
+	}
+	return nil
+}
+
+// SetPacketAuth turns on per-packet authentication on the client's
+// socket; the key has to match the server's
+func (c *UltraFastClient) SetPacketAuth(key []byte) error {
+	return c.socket.SetPacketAuth(key)
+}
@@ -0,0 +1,84 @@
+package ultrafast
+
+import "testing"
+
+func TestPacketAuthTag(t *testing.T) {
+	signer, verifier, other := &LinuxUDPSocket{}, &LinuxUDPSocket{}, &LinuxUDPSocket{}
+	if err := signer.SetPacketAuth([]byte("short")); err == nil {
+		t.Error("A key under 16 bytes should be refused")
+	}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	signer.SetPacketAuth(key)
+	verifier.SetPacketAuth(key)
+	other.SetPacketAuth([]byte("fedcba9876543210fedcba9876543210"))
+
+	// The tag has to survive the wire, whatever options came before it
+	packet := NewPacket(DATA_PACKET, 0, 7, 3, []byte("hello"))
+	packet.SetRequestID(9)
+	signer.signPacket(packet)
+	received, err := DeserializePacket(packet.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifier.verifyPacket(received) {
+		t.Fatal("Tag did not verify under the same key")
+	}
+	if other.verifyPacket(received) {
+		t.Error("Tag verified under another key")
+	}
+	if (&LinuxUDPSocket{}).verifyPacket(NewPacket(DATA_PACKET, 0, 7, 3, nil)) != true {
+		t.Error("A socket without a key should accept every packet")
+	}
+
+	// Signing again, as a retransmission does, keeps a single tag
+	signer.signPacket(packet)
+	if len(packet.Options) != 2 {
+		t.Errorf("Expected the request ID and one tag, got %v", packet.Options)
+	}
+
+	tamper := map[string]func(p *Packet){
+		"payload":    func(p *Packet) { p.Payload[0] ^= 1 },
+		"sequence":   func(p *Packet) { p.SeqNum++ },
+		"ack":        func(p *Packet) { p.AckNum++ },
+		"flags":      func(p *Packet) { p.Flags |= FIN_FLAG },
+		"option":     func(p *Packet) { p.SetRequestID(10) },
+		"tag":        func(p *Packet) { tag, _ := p.GetOption(OPT_AUTH_TAG); tag[0] ^= 1 },
+		"short tag":  func(p *Packet) { p.SetOption(OPT_AUTH_TAG, make([]byte, 8)) },
+		"no options": func(p *Packet) { p.Options = nil },
+	}
+	for name, change := range tamper {
+		p, _ := DeserializePacket(packet.Serialize())
+		change(p)
+		if verifier.verifyPacket(p) {
+			t.Errorf("Packet with changed %s verified", name)
+		}
+	}
+}
+
+func TestServerPacketAuth(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	server := startTestServer(t)
+	if err := server.SetPacketAuth(key); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(t, server)
+	client.SetPacketAuth(key)
+	if _, err := client.Get("/benchmark"); err != nil {
+		t.Fatalf("Request with the key failed: %v", err)
+	}
+
+	for _, clientKey := range [][]byte{nil, []byte("fedcba9876543210fedcba9876543210")} {
+		client := newTestClient(t, server)
+		client.SetPacketAuth(clientKey)
+		if err := client.Connect(); err == nil {
+			t.Errorf("Handshake with key %q succeeded", clientKey)
+		}
+	}
+	if failed := server.GetStats().AuthFailed; failed == 0 {
+		t.Error("Expected unauthenticated packets to be counted")
+	}
+	if n := server.connections.Len(); n != 1 {
+		t.Errorf("Expected only the authenticated connection, got %d", n)
+	}
+}
@@ -0,0 +1,20 @@
+package ultrafast
+
+//go:generate go run ./cmd/headergen -o header_fields.go
+
+// PacketHeader is the fixed header at the start of a wire buffer. Its
+// accessors, generated into header_fields.go, read and write each field
+// at its offset in network byte order, so a serialized or received packet
+// can be inspected or patched in place without decoding it into a Packet.
+// The buffer must hold at least PACKET_HEADER_SIZE bytes.
+type PacketHeader []byte
+
+// UpdateChecksum recomputes the checksum after the header was patched,
+// over the body that follows it: options and payload, in as many parts as
+// they are held in. A packet sent without a checksum keeps none.
+func (h PacketHeader) UpdateChecksum(body ...[]byte) {
+	if h.Checksum() == CHECKSUM_NONE {
+		return
+	}
+	h.SetChecksum(checksumParts(h[:headerChecksumOffset], body...))
+}
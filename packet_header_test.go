@@ -0,0 +1,46 @@
+package ultrafast
+
+import "testing"
+
+func TestPacketHeaderPatchInPlace(t *testing.T) {
+	packet := NewPacket(ACK_PACKET, ACK_FLAG, 10, 20, []byte("body"))
+	packet.SetConnectionID(7)
+	data := packet.Serialize()
+
+	h := PacketHeader(data)
+	if h.Version() != PROTOCOL_VERSION || h.Type() != ACK_PACKET || h.Flags() != ACK_FLAG|OPT_FLAG ||
+		int(h.Length()) != len(data) || h.SeqNum() != 10 || h.AckNum() != 20 || h.Checksum() != packet.Checksum {
+		t.Fatalf("Accessors disagree with the packet %v", packet)
+	}
+
+	// Rewriting the ACK number needs the checksum redone to stay valid
+	h.SetAckNum(99)
+	if _, err := DeserializePacket(data); err == nil {
+		t.Fatal("A patched header with a stale checksum should be rejected")
+	}
+	h.UpdateChecksum(data[PACKET_HEADER_SIZE:])
+	patched, err := DeserializePacket(data)
+	if err != nil {
+		t.Fatalf("Patched packet should decode: %v", err)
+	}
+	if patched.AckNum != 99 || string(patched.Payload) != "body" {
+		t.Errorf("Expected ack 99 with the body intact, got %v", patched)
+	}
+
+	// Setting one nibble leaves the other alone
+	h.SetType(DATA_PACKET)
+	if h.Version() != PROTOCOL_VERSION || h.Type() != DATA_PACKET {
+		t.Errorf("Expected version %d and type %d, got %d and %d", PROTOCOL_VERSION, DATA_PACKET, h.Version(), h.Type())
+	}
+}
+
+func TestPacketHeaderKeepsChecksumNone(t *testing.T) {
+	packet := NewPacket(DATA_PACKET, 0, 1, 0, []byte("x"))
+	data := packet.encodeHeader(nil, false)
+	h := PacketHeader(data)
+	h.SetSeqNum(2)
+	h.UpdateChecksum(data[PACKET_HEADER_SIZE:], packet.Payload)
+	if h.Checksum() != CHECKSUM_NONE {
+		t.Errorf("A packet without a checksum should keep none, got 0x%08X", h.Checksum())
+	}
+}
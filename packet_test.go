@@ -1,4 +1,4 @@
-package main
+package ultrafast
 
 import (
 	"bytes"
@@ -436,4 +436,78 @@ func containsString(haystack, needle string) bool {
 		}
 	}
 	return false
-}
\ No newline at end of file
+}
+// Test header options and connection IDs
+func TestPacketOptions(t *testing.T) {
+	packet := NewPacket(DATA_PACKET, 0, 42, 0, []byte("payload after options"))
+	packet.SetConnectionID(0x0123456789ABCDEF)
+	packet.SetOption(0x7F, []byte{1, 2, 3})
+
+	if packet.Flags&OPT_FLAG == 0 {
+		t.Fatal("Setting an option should set OPT_FLAG")
+	}
+
+	serialized := packet.Serialize()
+	expectedLen := PACKET_HEADER_SIZE + (2 + 8) + (2 + 3) + 1 + len(packet.Payload)
+	if len(serialized) != expectedLen {
+		t.Errorf("Expected serialized length %d, got %d", expectedLen, len(serialized))
+	}
+
+	deserialized, err := DeserializePacket(serialized)
+	if err != nil {
+		t.Fatalf("Failed to deserialize packet with options: %v", err)
+	}
+
+	id, ok := deserialized.ConnectionID()
+	if !ok || id != 0x0123456789ABCDEF {
+		t.Errorf("Expected connection ID 0x0123456789ABCDEF, got 0x%X (present=%v)", id, ok)
+	}
+	if value, ok := deserialized.GetOption(0x7F); !ok || !bytes.Equal(value, []byte{1, 2, 3}) {
+		t.Errorf("Expected option 0x7F value [1 2 3], got %v (present=%v)", value, ok)
+	}
+	if !bytes.Equal(deserialized.Payload, packet.Payload) {
+		t.Errorf("Payload mismatch: expected %q, got %q", packet.Payload, deserialized.Payload)
+	}
+
+	t.Run("Unterminated options", func(t *testing.T) {
+		bad := NewPacket(DATA_PACKET, OPT_FLAG, 1, 0, []byte{OPT_CONNECTION_ID, 8, 0})
+		if _, err := DeserializePacket(bad.Serialize()); err == nil {
+			t.Error("Expected error for malformed options")
+		}
+	})
+}
+
+func TestPacketRequestID(t *testing.T) {
+	packet := NewPacket(DATA_PACKET, 0, 1, 0, []byte("GET / HTTP/1.1\r\n\r\n"))
+	if _, ok := packet.RequestID(); ok {
+		t.Error("New packet should not carry a request ID")
+	}
+
+	packet.SetConnectionID(42)
+	packet.SetRequestID(0xDEADBEEF)
+	decoded, err := DeserializePacket(packet.Serialize())
+	if err != nil {
+		t.Fatalf("Failed to deserialize: %v", err)
+	}
+	if id, ok := decoded.RequestID(); !ok || id != 0xDEADBEEF {
+		t.Errorf("Expected request ID 0xDEADBEEF, got %x (present=%v)", id, ok)
+	}
+	if id, _ := decoded.ConnectionID(); id != 42 {
+		t.Errorf("Connection ID should survive alongside the request ID, got %d", id)
+	}
+}
+
+func TestPacketFragment(t *testing.T) {
+	packet := NewPacket(DATA_PACKET, 0, 1, 0, []byte("part"))
+	packet.SetRequestID(7)
+	packet.SetFragment(2800, 5000)
+
+	decoded, err := DeserializePacket(packet.Serialize())
+	if err != nil {
+		t.Fatalf("Failed to deserialize: %v", err)
+	}
+	offset, total, ok := decoded.Fragment()
+	if !ok || offset != 2800 || total != 5000 {
+		t.Errorf("Expected fragment 2800/5000, got %d/%d (present=%v)", offset, total, ok)
+	}
+}
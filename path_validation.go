@@ -0,0 +1,88 @@
+package ultrafast
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// pathTokenLifetime bounds how long a PATH_CHALLENGE can be answered
+const pathTokenLifetime = 10 * time.Second
+
+// pathTokenMACSize is the truncated MAC length in a path token
+const pathTokenMACSize = 16
+
+// PathToken mints the payload of a PATH_CHALLENGE sent to peer for the
+// connection with ID id. Like a retry token it needs no state: the peer
+// proves it receives at its address by echoing it in a PATH_RESPONSE.
+func (j *SynCookieJar) PathToken(id uint64, peer SocketAddr) []byte {
+	token := make([]byte, 4, 4+pathTokenMACSize)
+	binary.BigEndian.PutUint32(token, uint32(j.now().Unix()))
+	return append(token, j.pathMAC(id, peer, token[:4])...)
+}
+
+// ValidatePathToken checks a token peer echoed back for connection id
+func (j *SynCookieJar) ValidatePathToken(id uint64, peer SocketAddr, token []byte) error {
+	if len(token) != 4+pathTokenMACSize {
+		return fmt.Errorf("path token has wrong length: %d bytes", len(token))
+	}
+	if !hmac.Equal(token[4:], j.pathMAC(id, peer, token[:4])) {
+		return fmt.Errorf("path token authentication failed")
+	}
+
+	issuedAt := time.Unix(int64(binary.BigEndian.Uint32(token[:4])), 0)
+	if age := j.now().Sub(issuedAt); age > pathTokenLifetime || age < -time.Second {
+		return fmt.Errorf("path token expired")
+	}
+	return nil
+}
+
+// pathMAC binds a path token timestamp to the connection ID and the
+// peer's full address
+func (j *SynCookieJar) pathMAC(id uint64, peer SocketAddr, timestamp []byte) []byte {
+	h := hmac.New(sha256.New, j.secret[:])
+
+	var buf [11]byte
+	buf[0] = 'P'
+	binary.BigEndian.PutUint16(buf[1:3], peer.Port)
+	binary.BigEndian.PutUint64(buf[3:], id)
+	h.Write(buf[:])
+	h.Write(timestamp)
+	h.Write([]byte(peer.IP))
+
+	return h.Sum(nil)[:pathTokenMACSize]
+}
+
+// challengePath answers a packet of size bytes carrying connection ID id
+// from an address other than its connection's peer with a PATH_CHALLENGE
+// there. The connection stays at its old address, and the packet is
+// dropped, until the new one answers: a forged ID alone cannot redirect
+// it. As the address is unproven, the challenge is only sent within the
+// amplification limit of the packet that prompted it.
+func (h *HTTPSocketHandler) challengePath(id uint64, size int, from SocketAddr) {
+	challenge := NewPacket(PATH_CHALLENGE_PACKET, 0, 0, 0, h.server.synCookies.PathToken(id, from))
+	challenge.SetConnectionID(id)
+	if challenge.encodedSize() > amplificationFactor*size {
+		return
+	}
+	h.sendPacket(challenge, from)
+}
+
+// handlePathResponse moves the connection with ID id to the address that
+// answered its PATH_CHALLENGE, e.g. after a NAT rebinding
+func (h *HTTPSocketHandler) handlePathResponse(conn *Connection, id uint64, packet *Packet, from SocketAddr) {
+	if err := h.server.synCookies.ValidatePathToken(id, from, packet.Payload); err != nil {
+		atomic.AddUint64(&h.server.stats.AuthFailed, 1)
+		return
+	}
+	oldPeer := h.server.connections.PeerOf(conn)
+	if oldPeer == from {
+		return // a repeated response
+	}
+	h.server.connections.Migrate(conn, from)
+	logInfof("Connection %016x migrated from %s:%d to %s:%d",
+		id, oldPeer.IP, oldPeer.Port, from.IP, from.Port)
+}
@@ -0,0 +1,144 @@
+package ultrafast
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPathToken(t *testing.T) {
+	jar, err := NewSynCookieJar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	jar.now = func() time.Time { return now }
+	peer := SocketAddr{IP: "192.168.1.10", Port: 5555}
+	token := jar.PathToken(42, peer)
+
+	tampered := append([]byte(nil), token...)
+	tampered[len(tampered)-1] ^= 1
+	testCases := []struct {
+		name  string
+		id    uint64
+		peer  SocketAddr
+		token []byte
+		age   time.Duration
+		valid bool
+	}{
+		{"Fresh token", 42, peer, token, 0, true},
+		{"Expired token", 42, peer, token, pathTokenLifetime + time.Second, false},
+		{"Other connection", 43, peer, token, 0, false},
+		{"Other address", 42, SocketAddr{IP: peer.IP, Port: 5556}, token, 0, false},
+		{"Tampered token", 42, peer, tampered, 0, false},
+		{"Retry token", 42, peer, jar.RetryToken(peer), 0, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			jar.now = func() time.Time { return now.Add(tc.age) }
+			err := jar.ValidatePathToken(tc.id, tc.peer, tc.token)
+			if (err == nil) != tc.valid {
+				t.Errorf("Expected valid=%v, got error %v", tc.valid, err)
+			}
+		})
+	}
+}
+
+func TestServerMigrationNeedsPathValidation(t *testing.T) {
+	server, err := NewUltraFastHTTPServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	handler := &HTTPSocketHandler{server: server}
+
+	const id = 0xC0FFEE
+	oldPeer := SocketAddr{IP: "203.0.113.5", Port: 40000}
+	conn, _ := server.connections.GetOrCreate(oldPeer)
+	server.connections.AssignID(conn, id)
+
+	// A packet with the connection's ID from elsewhere is challenged, and
+	// the connection stays where it was
+	rebound, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rebound.Close()
+	if err := rebound.Bind("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	from := rebound.GetLocalAddr()
+	request := NewPacket(DATA_PACKET, 0, 100, 0, []byte("GET / HTTP/1.1\r\n\r\n"))
+	request.SetConnectionID(id)
+	data := request.Serialize()
+	handler.processIncomingData(data[:PACKET_HEADER_SIZE], data[PACKET_HEADER_SIZE:], from)
+
+	buf := make([]byte, 2048)
+	n, _, err := rebound.RecvFrom(buf)
+	if err != nil {
+		t.Fatalf("Expected a PATH_CHALLENGE: %v", err)
+	}
+	challenge, err := DeserializePacket(buf[:n])
+	if err != nil || challenge.Type != PATH_CHALLENGE_PACKET {
+		t.Fatalf("Expected a PATH_CHALLENGE, got %v, %v", challenge, err)
+	}
+	if peer := server.connections.PeerOf(conn); peer != oldPeer {
+		t.Fatalf("Connection moved to %v before the new address was validated", peer)
+	}
+
+	// A wrong answer leaves it; the right one moves it
+	respond := func(payload []byte) {
+		response := NewPacket(PATH_RESPONSE_PACKET, 0, 101, 0, payload)
+		response.SetConnectionID(id)
+		data := response.Serialize()
+		handler.processIncomingData(data[:PACKET_HEADER_SIZE], data[PACKET_HEADER_SIZE:], from)
+	}
+	forged := append([]byte(nil), challenge.Payload...)
+	forged[len(forged)-1] ^= 1
+	respond(forged)
+	if peer := server.connections.PeerOf(conn); peer != oldPeer {
+		t.Fatalf("Connection moved to %v on a forged response", peer)
+	}
+	respond(challenge.Payload)
+	if peer := server.connections.PeerOf(conn); peer != from || server.connections.Get(from) != conn {
+		t.Fatalf("Expected the connection moved to %v, still at %v", from, peer)
+	}
+	if failed := server.GetStats().AuthFailed; failed != 1 {
+		t.Errorf("Expected the forged response counted, got %d auth failures", failed)
+	}
+}
+
+func TestClientAnswersPathChallenge(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); server.connections.Len() == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	conns := server.connections.Snapshot()
+	if len(conns) != 1 {
+		t.Fatalf("Expected 1 connection, got %d", len(conns))
+	}
+	conn := conns[0]
+	oldPeer := server.connections.PeerOf(conn)
+
+	// As if the client's NAT gave it a new port
+	rebound, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.socket.Close()
+	client.socket = rebound
+
+	var response []byte
+	for attempt := 0; attempt < 5 && !containsString(string(response), "Ultra-Fast"); attempt++ {
+		response, _ = client.Get("/")
+	}
+	if !containsString(string(response), "Ultra-Fast") {
+		t.Fatalf("Expected the request served after migrating, got %q", response)
+	}
+	if peer := server.connections.PeerOf(conn); peer == oldPeer {
+		t.Errorf("Expected the connection moved to the new address, still at %v", peer)
+	}
+}
@@ -0,0 +1,229 @@
+package ultrafast
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Benchmarks for the hot paths. Run them with scripts/bench.sh, which
+// repeats each one enough times for benchstat to compare two runs.
+
+var benchmarkPayloadSizes = []int{0, 64, 512, MAX_PAYLOAD_SIZE}
+
+// benchmarkPacket builds a DATA packet like a typical request: a request ID
+// option followed by size bytes of payload
+func benchmarkPacket(size int) *Packet {
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	packet := NewPacket(DATA_PACKET, 0, 12345, 0, payload)
+	packet.SetRequestID(7)
+	return packet
+}
+
+func BenchmarkPacketSerialize(b *testing.B) {
+	for _, size := range benchmarkPayloadSizes {
+		b.Run(fmt.Sprintf("payload=%d", size), func(b *testing.B) {
+			packet := benchmarkPacket(size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for b.Loop() {
+				packet.Serialize()
+			}
+		})
+	}
+}
+
+func BenchmarkPacketDeserialize(b *testing.B) {
+	for _, size := range benchmarkPayloadSizes {
+		b.Run(fmt.Sprintf("payload=%d", size), func(b *testing.B) {
+			data := benchmarkPacket(size).Serialize()
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := DeserializePacket(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkChecksum(b *testing.B) {
+	for _, size := range benchmarkPayloadSizes {
+		b.Run(fmt.Sprintf("payload=%d", size), func(b *testing.B) {
+			data := benchmarkPacket(size).Serialize()
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				calculateChecksum(data[:12], data[PACKET_HEADER_SIZE:])
+			}
+		})
+	}
+}
+
+// BenchmarkReliability measures tracking a sent packet and retiring it on
+// its ACK, for the lock-free layer the server uses and the mutex-based one
+// it replaced
+func BenchmarkReliability(b *testing.B) {
+	b.Run("layer=lockfree", func(b *testing.B) {
+		rel := NewLockFreeReliabilityLayer()
+		b.ReportAllocs()
+		for b.Loop() {
+			seq := rel.GetNextSeqNum()
+			rel.SendPacket(NewPacket(DATA_PACKET, 0, seq, 0, nil))
+			if !rel.HandleAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, seq+1, nil)) {
+				b.Fatalf("ACK for %d was not matched", seq)
+			}
+		}
+	})
+
+	b.Run("layer=mutex", func(b *testing.B) {
+		rel := NewReliabilityLayer()
+		b.ReportAllocs()
+		for b.Loop() {
+			seq := rel.GetNextSeqNum()
+			rel.SendPacket(NewPacket(DATA_PACKET, 0, seq, 0, nil))
+			if err := rel.HandleAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, seq+1, nil)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkCopy compares copying into a fresh heap buffer with copying
+// into the zero-copy socket's mmap buffer
+func BenchmarkCopy(b *testing.B) {
+	zcs, err := NewZeroCopySocket()
+	if err != nil {
+		b.Skipf("Zero-copy socket unavailable: %v", err)
+	}
+	defer zcs.Close()
+
+	data := make([]byte, 1024*1024)
+	b.Run("target=heap", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for b.Loop() {
+			buffer := make([]byte, len(data))
+			copy(buffer, data)
+		}
+	})
+	b.Run("target=mmap", func(b *testing.B) {
+		b.SetBytes(int64(len(data)))
+		for b.Loop() {
+			copy(zcs.mmapBuffer, data)
+		}
+	})
+}
+
+// startBenchmarkServer starts a server with a small fixed response. Its
+// log lines are discarded: they would split benchmark result lines.
+func startBenchmarkServer(b *testing.B) *UltraFastHTTPServer {
+	b.Helper()
+
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(output) })
+
+	server, err := NewUltraFastHTTPServer("127.0.0.1", 0)
+	if err != nil {
+		b.Fatalf("Failed to create server: %v", err)
+	}
+	server.HandleFunc("/bench", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Body: []byte("ok")}
+	})
+	go server.Start()
+	b.Cleanup(func() { server.Close() })
+	return server
+}
+
+// newBenchmarkClient connects a client to a benchmark server
+func newBenchmarkClient(b *testing.B, server *UltraFastHTTPServer) *UltraFastClient {
+	addr := server.socket.GetLocalAddr()
+	client, err := NewUltraFastClient(addr.IP, addr.Port)
+	if err != nil {
+		b.Fatalf("Failed to create client: %v", err)
+	}
+	if err := client.Connect(); err != nil {
+		client.Close()
+		b.Fatalf("Handshake failed: %v", err)
+	}
+	return client
+}
+
+// BenchmarkLoopbackRequest measures whole request/response round trips
+// over loopback, one client per goroutine; req/s is the aggregate rate
+func BenchmarkLoopbackRequest(b *testing.B) {
+	for _, clients := range []int{1, 8} {
+		b.Run(fmt.Sprintf("clients=%d", clients), func(b *testing.B) {
+			server := startBenchmarkServer(b)
+			conns := make([]*UltraFastClient, clients)
+			for i := range conns {
+				conns[i] = newBenchmarkClient(b, server)
+				defer conns[i].Close()
+			}
+
+			// Each client takes requests off a shared count until b.N are done
+			var remaining atomic.Int64
+			remaining.Store(int64(b.N))
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for _, client := range conns {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for remaining.Add(-1) >= 0 {
+						if _, err := client.Get("/bench"); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+		})
+	}
+}
+
+// BenchmarkLoopbackService measures the transport alone: round trips to
+// the ECHO service, and acknowledged sends to the DISCARD service, with no
+// HTTP parsing in the path. Latency probes run alongside the echoes.
+func BenchmarkLoopbackService(b *testing.B) {
+	payload := make([]byte, 1024)
+	b.Run("service=echo", func(b *testing.B) {
+		server := startBenchmarkServer(b)
+		server.SetService(SERVICE_ECHO)
+		client := newBenchmarkClient(b, server)
+		defer client.Close()
+		client.EnablePing(10 * time.Millisecond)
+		b.SetBytes(int64(len(payload)))
+		for b.Loop() {
+			if _, err := client.Do(payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if latency := client.Latency(); latency.Samples > 0 {
+			b.ReportMetric(float64(latency.SmoothedRTT.Microseconds()), "rtt-µs")
+			b.ReportMetric(float64(latency.ForwardJitter+latency.ReturnJitter)/float64(time.Microsecond), "jitter-µs")
+		}
+	})
+	b.Run("service=discard", func(b *testing.B) {
+		server := startBenchmarkServer(b)
+		server.SetService(SERVICE_DISCARD)
+		client := newBenchmarkClient(b, server)
+		defer client.Close()
+		b.SetBytes(int64(len(payload)))
+		for b.Loop() {
+			if err := client.Send(payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
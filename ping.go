@@ -0,0 +1,168 @@
+package ultrafast
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// echoRequestSize is the payload of an ECHO_REQUEST: the sender's clock
+// when it went out, in Unix nanoseconds
+const echoRequestSize = 8
+
+// echoReplySize is the payload of an ECHO_REPLY: the request's timestamp,
+// then the server's clock when the request arrived and when the reply
+// left. The server holding the probe is taken out of the round trip.
+const echoReplySize = 24
+
+// jitterGain is the weight of a new sample in the jitter estimates, as in
+// RFC 3550's interarrival jitter
+const jitterGain = 16
+
+// LatencyStats are the round trips and jitter measured by a client's
+// ECHO_REQUEST probes. One-way jitter compares successive samples of the
+// same direction, so the offset between the clocks cancels out; one-way
+// delays are corrected by the estimated offset, see ClockOffset.
+type LatencyStats struct {
+	Samples       uint64        // replies received
+	RTT           time.Duration // latest round trip
+	MinRTT        time.Duration
+	SmoothedRTT   time.Duration // weighted as RFC 6298 weighs its SRTT
+	ForwardJitter time.Duration // variation of the client to server delay
+	ReturnJitter  time.Duration // variation of the server to client delay
+	ForwardDelay  time.Duration // latest client to server delay
+	ReturnDelay   time.Duration // latest server to client delay
+}
+
+// pingState is a client's probing: how often, and what it measured
+type pingState struct {
+	interval time.Duration // between probes sent while waiting, 0 for none
+	lastSent time.Time
+	nextID   uint32
+	stats    LatencyStats
+
+	// One-way transit of the previous sample, skewed by the clock offset
+	forward, back int64
+
+	clock ClockSync // the server's clock, from the same probes
+}
+
+// handleEchoRequest answers a latency probe with its timestamp and the
+// server's receive and send times. Like a BINDING request it needs no
+// connection, and the reply is well inside the amplification limit.
+func (h *HTTPSocketHandler) handleEchoRequest(packet *Packet, from SocketAddr) {
+	if len(packet.Payload) != echoRequestSize {
+		return
+	}
+	received := clockNow()
+	payload := make([]byte, echoReplySize)
+	copy(payload, packet.Payload)
+	binary.BigEndian.PutUint64(payload[8:], uint64(received.UnixNano()))
+	binary.BigEndian.PutUint64(payload[16:], uint64(clockNow().UnixNano()))
+	h.sendPacket(NewPacket(ECHO_REPLY_PACKET, 0, 0, packet.SeqNum, payload), from)
+}
+
+// EnablePing makes the client probe the server's latency every interval
+// for as long as it waits on the server, so round trips and jitter are
+// measured continuously while requests are in flight. Passing 0 stops
+// the probes; the measurements are kept.
+func (c *UltraFastClient) EnablePing(interval time.Duration) {
+	c.ping.interval = interval
+}
+
+// Ping sends one latency probe and waits for its reply, returning the
+// round trip. The sample is added to Latency.
+func (c *UltraFastClient) Ping() (time.Duration, error) {
+	id := c.sendPing()
+	reply, err := c.exchange(c.pingPacket(id), func(p *Packet) bool {
+		return p.Type == ECHO_REPLY_PACKET && p.AckNum == id
+	})
+	if err != nil {
+		return 0, fmt.Errorf("ping failed: %v", err)
+	}
+	if _, ok := decodeEchoReply(reply.Payload, time.Now()); !ok {
+		return 0, fmt.Errorf("ping failed: malformed ECHO_REPLY")
+	}
+	return c.ping.stats.RTT, nil
+}
+
+// Latency returns what the client's probes measured so far
+func (c *UltraFastClient) Latency() LatencyStats {
+	return c.ping.stats
+}
+
+// sendPing numbers a new probe
+func (c *UltraFastClient) sendPing() uint32 {
+	c.ping.nextID++
+	c.ping.lastSent = time.Now()
+	return c.ping.nextID
+}
+
+// pingPacket builds the probe numbered id, stamped now
+func (c *UltraFastClient) pingPacket(id uint32) *Packet {
+	stamp := make([]byte, echoRequestSize)
+	binary.BigEndian.PutUint64(stamp, uint64(time.Now().UnixNano()))
+	return NewPacket(ECHO_REQUEST_PACKET, 0, id, 0, stamp)
+}
+
+// maybePing sends a probe if one is due
+func (c *UltraFastClient) maybePing() {
+	if c.ping.interval > 0 && time.Since(c.ping.lastSent) >= c.ping.interval {
+		c.send(c.pingPacket(c.sendPing()))
+	}
+}
+
+// recordEcho adds the sample an ECHO_REPLY carries to the measurements
+func (c *UltraFastClient) recordEcho(packet *Packet) {
+	now := time.Now()
+	rtt, ok := decodeEchoReply(packet.Payload, now)
+	if !ok {
+		return
+	}
+	sent := int64(binary.BigEndian.Uint64(packet.Payload[0:]))
+	received := int64(binary.BigEndian.Uint64(packet.Payload[8:]))
+	replied := int64(binary.BigEndian.Uint64(packet.Payload[16:]))
+	forward, back := received-sent, now.UnixNano()-replied
+
+	p := &c.ping
+	s := &p.stats
+	if s.Samples == 0 {
+		s.MinRTT, s.SmoothedRTT = rtt, rtt
+	} else {
+		s.MinRTT = min(s.MinRTT, rtt)
+		s.SmoothedRTT += (rtt - s.SmoothedRTT) / 8
+		s.ForwardJitter += (absDuration(forward-p.forward) - s.ForwardJitter) / jitterGain
+		s.ReturnJitter += (absDuration(back-p.back) - s.ReturnJitter) / jitterGain
+	}
+	s.RTT = rtt
+	s.Samples++
+	p.forward, p.back = forward, back
+
+	p.clock.Add(ClockSample{
+		Sent:     time.Unix(0, sent),
+		Received: time.Unix(0, received),
+		Replied:  time.Unix(0, replied),
+		Returned: now,
+	})
+	offset := int64(p.clock.Estimate().Offset)
+	s.ForwardDelay, s.ReturnDelay = time.Duration(forward-offset), time.Duration(back+offset)
+}
+
+// decodeEchoReply returns the round trip of an ECHO_REPLY received at
+// now, less the time the server held the probe
+func decodeEchoReply(payload []byte, now time.Time) (time.Duration, bool) {
+	if len(payload) != echoReplySize {
+		return 0, false
+	}
+	sent := int64(binary.BigEndian.Uint64(payload[0:]))
+	held := int64(binary.BigEndian.Uint64(payload[16:]) - binary.BigEndian.Uint64(payload[8:]))
+	return time.Duration(now.UnixNano() - sent - held), true
+}
+
+// absDuration is the magnitude of a difference in nanoseconds
+func absDuration(ns int64) time.Duration {
+	if ns < 0 {
+		ns = -ns
+	}
+	return time.Duration(ns)
+}
@@ -0,0 +1,78 @@
+package ultrafast
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+
+	// A probe needs no connection
+	rtt, err := client.Ping()
+	if err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if rtt <= 0 || rtt > time.Second {
+		t.Errorf("Unexpected round trip %v", rtt)
+	}
+	if stats := client.Latency(); stats.Samples != 1 || stats.MinRTT != rtt || stats.SmoothedRTT != rtt {
+		t.Errorf("Expected the sample recorded, got %+v", stats)
+	}
+}
+
+func TestPingWhileRequesting(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+	client.EnablePing(time.Nanosecond) // a probe every time the client waits
+
+	for i := 0; i < 5; i++ {
+		if _, err := client.Get("/benchmark"); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+	}
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	stats := client.Latency()
+	if stats.Samples < 2 {
+		t.Errorf("Expected probes answered alongside the requests, got %+v", stats)
+	}
+	if stats.MinRTT > stats.RTT {
+		t.Errorf("Minimum round trip above the latest: %+v", stats)
+	}
+}
+
+func TestRecordEchoJitter(t *testing.T) {
+	client := &UltraFastClient{}
+	reply := func(sent, received, replied time.Time) *Packet {
+		payload := make([]byte, echoReplySize)
+		binary.BigEndian.PutUint64(payload[0:], uint64(sent.UnixNano()))
+		binary.BigEndian.PutUint64(payload[8:], uint64(received.UnixNano()))
+		binary.BigEndian.PutUint64(payload[16:], uint64(replied.UnixNano()))
+		return NewPacket(ECHO_REPLY_PACKET, 0, 0, 1, payload)
+	}
+
+	// The server's clock is an hour ahead; only the forward delay varies
+	skew := time.Hour
+	now := time.Now()
+	client.recordEcho(reply(now.Add(-2*time.Millisecond), now.Add(skew-time.Millisecond), now.Add(skew-time.Millisecond)))
+	now = time.Now()
+	client.recordEcho(reply(now.Add(-18*time.Millisecond), now.Add(skew-time.Millisecond), now.Add(skew-time.Millisecond)))
+
+	stats := client.Latency()
+	if stats.Samples != 2 {
+		t.Fatalf("Expected 2 samples, got %d", stats.Samples)
+	}
+	if stats.ForwardJitter < 900*time.Microsecond || stats.ForwardJitter > 1100*time.Microsecond {
+		t.Errorf("Expected about 16ms/16 of forward jitter, got %v", stats.ForwardJitter)
+	}
+	if stats.ReturnJitter > 100*time.Microsecond {
+		t.Errorf("Expected no return jitter, got %v", stats.ReturnJitter)
+	}
+	if stats.MinRTT < 2*time.Millisecond || stats.MinRTT > 3*time.Millisecond {
+		t.Errorf("Expected a 2ms minimum round trip, got %v", stats.MinRTT)
+	}
+}
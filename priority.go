@@ -0,0 +1,166 @@
+package ultrafast
+
+import (
+	"container/heap"
+	"strconv"
+	"strings"
+)
+
+// Request priorities are urgencies as in RFC 9218: 0 is the most urgent
+// and 7 the least. A request without a Priority header gets
+// PriorityDefault.
+const (
+	PriorityHighest = 0
+	PriorityDefault = 3
+	PriorityLowest  = 7
+)
+
+// parsePriority reads the urgency from a Priority header value such as
+// "u=1, i". Parameters other than u are ignored, as is the header if u
+// is missing or out of range.
+func parsePriority(value string) (int, bool) {
+	for value != "" {
+		var param string
+		param, value, _ = strings.Cut(value, ",")
+		name, urgency, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found || name != "u" {
+			continue
+		}
+		u, err := strconv.Atoi(urgency)
+		if err != nil || u < PriorityHighest || u > PriorityLowest {
+			return 0, false
+		}
+		return u, true
+	}
+	return 0, false
+}
+
+// requestPriority returns the urgency a request asked for
+func requestPriority(request *HTTPRequest) int {
+	if urgency, ok := parsePriority(request.Header("Priority")); ok {
+		return urgency
+	}
+	return PriorityDefault
+}
+
+// priorityWeight is a response's share of its connection under weighted
+// fair queueing. Each step of urgency doubles it, so a response at
+// urgency 0 gets 8 times the share of one at the default.
+func priorityWeight(urgency int) float64 {
+	return float64(uint(1) << (PriorityLowest - urgency))
+}
+
+// SetPriority changes the urgency of a request's response, for the
+// packets it has not yet queued. It lasts until the request ends.
+func (c *Connection) SetPriority(requestID uint32, urgency int) {
+	urgency = min(max(urgency, PriorityHighest), PriorityLowest)
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+	if _, active := c.activeRequests[requestID]; !active {
+		return
+	}
+	if c.priorities == nil {
+		c.priorities = make(map[uint32]int)
+	}
+	c.priorities[requestID] = urgency
+}
+
+// priority returns the urgency of a request's response
+func (c *Connection) priority(requestID uint32) int {
+	c.requestsMu.Lock()
+	defer c.requestsMu.Unlock()
+	if urgency, ok := c.priorities[requestID]; ok {
+		return urgency
+	}
+	return PriorityDefault
+}
+
+// outboundQueue orders the DATA packets a connection holds for its
+// congestion window by weighted fair queueing, with each request's
+// response as a flow weighted by its urgency. It uses self-clocked fair
+// queueing: a packet's finish tag is its flow's previous tag, or the
+// tag of the packet last sent if later, plus its size over the flow's
+// weight, and the smallest tag goes next. A small urgent response thus
+// goes out ahead of most of a bulk transfer queued before it, while
+// responses of equal urgency share the window, and none is starved.
+type outboundQueue struct {
+	packets queuedPackets
+	flows   map[uint32]*outboundFlow
+	virtual float64 // finish tag of the packet last taken
+	order   uint64  // breaks ties between equal tags in arrival order
+}
+
+// outboundFlow is the state of one response with packets queued
+type outboundFlow struct {
+	finish float64 // tag of its last queued packet
+	queued int
+}
+
+// queuedPacket is a packet waiting in an outboundQueue
+type queuedPacket struct {
+	packet *Packet
+	flow   uint32
+	finish float64
+	order  uint64
+}
+
+// push queues a packet of the response to requestID
+func (q *outboundQueue) push(packet *Packet, requestID uint32, urgency int) {
+	if q.flows == nil {
+		q.flows = make(map[uint32]*outboundFlow)
+	}
+	flow := q.flows[requestID]
+	if flow == nil {
+		flow = &outboundFlow{}
+		q.flows[requestID] = flow
+	}
+	flow.finish = max(flow.finish, q.virtual) + float64(packet.encodedSize())/priorityWeight(urgency)
+	flow.queued++
+
+	q.order++
+	heap.Push(&q.packets, queuedPacket{packet: packet, flow: requestID, finish: flow.finish, order: q.order})
+}
+
+// pop takes the packet with the smallest finish tag, or nil if none
+func (q *outboundQueue) pop() *Packet {
+	if len(q.packets) == 0 {
+		return nil
+	}
+	next := heap.Pop(&q.packets).(queuedPacket)
+	q.virtual = next.finish
+	if flow := q.flows[next.flow]; flow != nil {
+		if flow.queued--; flow.queued == 0 {
+			delete(q.flows, next.flow)
+		}
+	}
+	return next.packet
+}
+
+// len returns the number of packets queued
+func (q *outboundQueue) len() int {
+	return len(q.packets)
+}
+
+// queuedPackets is a min-heap of packets by finish tag
+type queuedPackets []queuedPacket
+
+func (p queuedPackets) Len() int { return len(p) }
+
+func (p queuedPackets) Less(i, j int) bool {
+	if p[i].finish != p[j].finish {
+		return p[i].finish < p[j].finish
+	}
+	return p[i].order < p[j].order
+}
+
+func (p queuedPackets) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+func (p *queuedPackets) Push(x any) { *p = append(*p, x.(queuedPacket)) }
+
+func (p *queuedPackets) Pop() any {
+	old := *p
+	last := old[len(old)-1]
+	old[len(old)-1] = queuedPacket{}
+	*p = old[:len(old)-1]
+	return last
+}
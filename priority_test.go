@@ -0,0 +1,128 @@
+package ultrafast
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParsePriority(t *testing.T) {
+	tests := []struct {
+		value   string
+		urgency int
+		ok      bool
+	}{
+		{"u=0", 0, true},
+		{"i, u=5", 5, true},
+		{" u=7 ,i", 7, true},
+		{"u=8", 0, false},
+		{"u=high", 0, false},
+		{"i", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		urgency, ok := parsePriority(tt.value)
+		if urgency != tt.urgency || ok != tt.ok {
+			t.Errorf("parsePriority(%q) = %d, %t; want %d, %t", tt.value, urgency, ok, tt.urgency, tt.ok)
+		}
+	}
+}
+
+func TestOutboundQueueWeightedFair(t *testing.T) {
+	var queue outboundQueue
+	packet := func(id uint32) *Packet {
+		p := NewPacket(DATA_PACKET, 0, 0, 0, make([]byte, 1000))
+		p.SetRequestID(id)
+		return p
+	}
+	popIDs := func(n int) []uint32 {
+		var ids []uint32
+		for i := 0; i < n; i++ {
+			id, _ := queue.pop().RequestID()
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	// Two bulk responses at the default urgency take turns, and an urgent
+	// one queued after them goes first
+	for i := 0; i < 3; i++ {
+		queue.push(packet(1), 1, PriorityDefault)
+	}
+	for i := 0; i < 3; i++ {
+		queue.push(packet(2), 2, PriorityDefault)
+	}
+	queue.push(packet(3), 3, PriorityHighest)
+	want := []uint32{3, 1, 2, 1, 2, 1, 2}
+	if got := popIDs(7); !slices.Equal(got, want) {
+		t.Errorf("Expected order %v, got %v", want, got)
+	}
+	if queue.pop() != nil || len(queue.flows) != 0 {
+		t.Error("Expected the queue empty")
+	}
+
+	// A low priority response still gets its share of the window rather
+	// than waiting for the whole bulk transfer
+	for i := 0; i < 20; i++ {
+		queue.push(packet(4), 4, PriorityDefault)
+	}
+	queue.push(packet(5), 5, PriorityLowest)
+	if got := popIDs(21); slices.Index(got, 5) == 20 {
+		t.Errorf("A low priority response should not be starved, got %v", got)
+	}
+}
+
+func TestServerSendsUrgentResponseFirst(t *testing.T) {
+	server := startTestServer(t)
+	server.DisableWorkerPool() // handlers run in arrival order on the loop
+	body := bytes.Repeat([]byte("x"), 20*MAX_PAYLOAD_SIZE)
+	server.HandleFunc("/bulk", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: body}
+	})
+	urgent := bytes.Repeat([]byte("u"), 2*MAX_PAYLOAD_SIZE)
+	server.HandleFunc("/urgent", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: urgent}
+	})
+
+	client := newTestClient(t, server)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+
+	// The bulk response fills the initial window, and the urgent one,
+	// asked for after it, is queued behind the rest of it
+	requests := map[uint32][]byte{
+		1: []byte("GET /bulk HTTP/1.1\r\n\r\n"),
+		2: []byte("GET /urgent HTTP/1.1\r\nPriority: u=0\r\n\r\n"),
+	}
+	for id := uint32(1); id <= 2; id++ {
+		for _, packet := range client.requestPackets(id, requests[id]) {
+			if err := client.send(packet); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		}
+	}
+
+	var order []uint32
+	done := map[uint32]bool{}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(done) < 2 {
+		reply, err := client.receive(deadline, func(p *Packet) bool { return p.IsDataPacket() })
+		if err != nil {
+			t.Fatalf("Response lost after %v: %v", order, err)
+		}
+		id, _ := reply.RequestID()
+		order = append(order, id)
+		if _, complete := client.assemble(id, reply); complete {
+			done[id] = true
+		}
+	}
+
+	// Only the first packet of the bulk response goes ahead of the three
+	// of the urgent one; at equal urgency they would take turns
+	if len(order) < 4 || !slices.Equal(order[:4], []uint32{1, 2, 2, 2}) {
+		t.Errorf("Expected the urgent response right after the first bulk packet, got %v", order)
+	}
+}
@@ -0,0 +1,58 @@
+package ultrafast
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// privateSocketDir makes sure the directory that will hold a unix socket
+// at path is this user's alone. It is created mode 0700 if missing; one
+// that exists must be a directory we own that no one else can enter, since
+// in a shared directory such as /tmp other local users could reach the
+// socket or put their own in its place.
+func privateSocketDir(path string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create socket directory: %v", err)
+	}
+
+	var st unix.Stat_t
+	if err := unix.Lstat(dir, &st); err != nil {
+		return fmt.Errorf("failed to check socket directory: %v", err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return fmt.Errorf("socket directory %s is not a directory", dir)
+	}
+	if int(st.Uid) != os.Geteuid() || st.Mode&0077 != 0 {
+		return fmt.Errorf("socket directory %s must belong to uid %d and be closed to others (mode 0700), is uid %d mode %#o",
+			dir, os.Geteuid(), st.Uid, st.Mode&0777)
+	}
+	return nil
+}
+
+// bindPrivate binds fd to a unix socket path in a private directory,
+// replacing a socket file left there, and makes the socket file readable
+// and writable by its owner only
+func bindPrivate(fd int, path string) error {
+	if err := privateSocketDir(path); err != nil {
+		return err
+	}
+	unix.Unlink(path)
+	if err := unix.Bind(fd, &unix.SockaddrUnix{Name: path}); err != nil {
+		return err
+	}
+	return unix.Chmod(path, 0600)
+}
+
+// peerUID returns the uid of the process that connected a unix socket,
+// as the kernel recorded it when it connected
+func peerUID(fd int) (int, error) {
+	cred, err := unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return -1, err
+	}
+	return int(cred.Uid), nil
+}
@@ -0,0 +1,99 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// nobodyUID is the user tests connect as to play a foreign local user
+const nobodyUID = 65534
+
+// dialUnixAs connects a unix socket of sotype to path from a thread
+// running as uid, so the listener sees a peer of another user. The thread
+// cannot get its credentials back, so it exits with its goroutine.
+func dialUnixAs(t *testing.T, uid, sotype int, path string) int {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("Connecting as another user needs root")
+	}
+
+	type dialed struct {
+		fd  int
+		err error
+	}
+	done := make(chan dialed, 1)
+	go func() {
+		runtime.LockOSThread() // never unlocked
+		if _, _, errno := unix.RawSyscall(unix.SYS_SETRESUID, ^uintptr(0), uintptr(uid), ^uintptr(0)); errno != 0 {
+			done <- dialed{-1, errno}
+			return
+		}
+		fd, err := unix.Socket(unix.AF_UNIX, sotype|unix.SOCK_CLOEXEC, 0)
+		if err == nil {
+			if err = unix.Connect(fd, &unix.SockaddrUnix{Name: path}); err != nil {
+				unix.Close(fd)
+			}
+		}
+		done <- dialed{fd, err}
+	}()
+	d := <-done
+	if d.err != nil {
+		t.Fatalf("Failed to connect as uid %d: %v", uid, d.err)
+	}
+	t.Cleanup(func() { unix.Close(d.fd) })
+	return d.fd
+}
+
+// exposeSocket opens a private socket and the test directories above it
+// to every user, as a misconfigured or shared directory would, leaving
+// the peer check as the only guard
+func exposeSocket(t *testing.T, path string) {
+	t.Helper()
+	for dir := filepath.Dir(path); dir != os.TempDir() && dir != "/"; dir = filepath.Dir(dir) {
+		if err := os.Chmod(dir, 0711); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(path, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrivateSocketDir(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "test.sock")
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	if err := bindPrivate(fd, path); err != nil {
+		t.Fatalf("bindPrivate failed: %v", err)
+	}
+	for file, want := range map[string]os.FileMode{filepath.Dir(path): 0700, path: 0600} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want {
+			t.Errorf("Expected %s mode %#o, got %#o", file, want, info.Mode().Perm())
+		}
+	}
+
+	// A directory others can enter is refused, as is a file in its place
+	shared := t.TempDir()
+	os.Chmod(shared, 0755)
+	if err := privateSocketDir(filepath.Join(shared, "test.sock")); err == nil {
+		t.Error("Expected a directory open to others refused")
+	}
+	notDir := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(notDir, nil, 0600)
+	if err := privateSocketDir(filepath.Join(notDir, "test.sock")); err == nil {
+		t.Error("Expected a file in place of the directory refused")
+	}
+}
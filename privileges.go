@@ -0,0 +1,66 @@
+package ultrafast
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+)
+
+// PrivilegeDrop names the unprivileged identity a server started as root
+// switches to
+type PrivilegeDrop struct {
+	User   string `json:"user"`   // user name or uid
+	Group  string `json:"group"`  // group name or gid; the user's primary group if empty
+	Chroot string `json:"chroot"` // directory to confine the process to, none if empty
+}
+
+// credentials resolves the user and group to ids. It must run before any
+// chroot, which hides the user database.
+func (p *PrivilegeDrop) credentials() (uid, gid int, err error) {
+	account, err := user.Lookup(p.User)
+	if err != nil {
+		if account, err = user.LookupId(p.User); err != nil {
+			return 0, 0, fmt.Errorf("unknown user: %q", p.User)
+		}
+	}
+	uid, _ = strconv.Atoi(account.Uid)
+	gid, _ = strconv.Atoi(account.Gid)
+	if p.Group != "" {
+		group, err := user.LookupGroup(p.Group)
+		if err != nil {
+			if group, err = user.LookupGroupId(p.Group); err != nil {
+				return 0, 0, fmt.Errorf("unknown group: %q", p.Group)
+			}
+		}
+		gid, _ = strconv.Atoi(group.Gid)
+	}
+	return uid, gid, nil
+}
+
+// SetPrivilegeDrop has Start, once the server's sockets are bound and in
+// the event loop, chroot to drop.Chroot if set, then give up root for
+// drop.User and drop.Group, so the server can bind privileged ports
+// without serving as root. It runs before any sandbox is installed.
+// After a chroot, paths such as static directories and the config file
+// are resolved inside it. Passing nil keeps the process's identity.
+func (s *UltraFastHTTPServer) SetPrivilegeDrop(drop *PrivilegeDrop) {
+	s.privilegeDrop.Store(drop)
+}
+
+// applyPrivilegeDrop drops privileges as SetPrivilegeDrop configured, if
+// it was called
+func (s *UltraFastHTTPServer) applyPrivilegeDrop() error {
+	drop := s.privilegeDrop.Load()
+	if drop == nil {
+		return nil
+	}
+	uid, gid, err := drop.credentials()
+	if err != nil {
+		return fmt.Errorf("failed to drop privileges: %v", err)
+	}
+	if err := dropPrivileges(uid, gid, drop.Chroot); err != nil {
+		return fmt.Errorf("failed to drop privileges: %v", err)
+	}
+	logInfof("Running as uid %d, gid %d", uid, gid)
+	return nil
+}
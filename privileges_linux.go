@@ -0,0 +1,38 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropPrivileges chroots to dir, if set, then switches every thread to
+// uid and gid with gid as the only group. Groups go first, while the
+// process may still change them, and regaining root is checked to fail.
+func dropPrivileges(uid, gid int, dir string) error {
+	if dir != "" {
+		if err := unix.Chroot(dir); err != nil {
+			return fmt.Errorf("chroot %s: %v", dir, err)
+		}
+		if err := unix.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	// The syscall package applies these to all threads, not just this one
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("root could be regained")
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrivilegeDropCredentials(t *testing.T) {
+	uid, gid, err := (&PrivilegeDrop{User: "0"}).credentials()
+	if err != nil || uid != 0 || gid != 0 {
+		t.Errorf("Expected uid 0 to resolve to root, got %d %d %v", uid, gid, err)
+	}
+	if _, _, err := (&PrivilegeDrop{User: "no-such-user"}).credentials(); err == nil {
+		t.Error("Expected an unknown user to be refused")
+	}
+	if _, _, err := (&PrivilegeDrop{User: "0", Group: "no-such-group"}).credentials(); err == nil {
+		t.Error("Expected an unknown group to be refused")
+	}
+}
+
+// TestPrivilegeDrop drops to nobody in a child process, since root
+// cannot be regained afterwards
+func TestPrivilegeDrop(t *testing.T) {
+	if dir := os.Getenv("PRIVILEGE_TEST_CHROOT"); dir != "" {
+		runUnprivilegedServer(t, dir)
+		return
+	}
+	if os.Getuid() != 0 {
+		t.Skip("needs root")
+	}
+	if _, _, err := (&PrivilegeDrop{User: "nobody"}).credentials(); err != nil {
+		t.Skip("no nobody user")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPrivilegeDrop$", "-test.v")
+	cmd.Env = append(os.Environ(), "PRIVILEGE_TEST_CHROOT="+t.TempDir())
+	output, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "--- PASS: TestPrivilegeDrop") {
+		t.Fatalf("Unprivileged server failed: %v\n%s", err, output)
+	}
+}
+
+// runUnprivilegedServer serves a request after dropping to nobody inside
+// a chroot
+func runUnprivilegedServer(t *testing.T, dir string) {
+	server, err := NewUltraFastHTTPServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := newTestClient(t, server)
+	server.SetPrivilegeDrop(&PrivilegeDrop{User: "nobody", Chroot: dir})
+	go server.Start()
+	for deadline := time.Now().Add(2 * time.Second); !server.Ready(); {
+		if time.Now().After(deadline) {
+			t.Fatal("Unprivileged server did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := client.Get("/benchmark"); err != nil {
+		t.Fatalf("Request after dropping privileges failed: %v", err)
+	}
+	if os.Getuid() == 0 || os.Getgid() == 0 {
+		t.Errorf("Still running as uid %d, gid %d", os.Getuid(), os.Getgid())
+	}
+	if _, err := os.Stat("/etc/passwd"); err == nil {
+		t.Error("Expected the chroot to hide /etc")
+	}
+}
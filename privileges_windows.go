@@ -0,0 +1,8 @@
+package ultrafast
+
+import "fmt"
+
+// dropPrivileges is not supported on Windows
+func dropPrivileges(uid, gid int, dir string) error {
+	return fmt.Errorf("dropping privileges is not supported on this platform")
+}
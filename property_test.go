@@ -0,0 +1,186 @@
+package ultrafast
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// quickConfig runs each property over enough random cases to reach the
+// sequence number wraparound often, without slowing the suite
+var quickConfig = &quick.Config{MaxCount: 500}
+
+// randomPacket is a valid packet with random fields, options and payload
+type randomPacket struct {
+	*Packet
+}
+
+// Generate makes randomPacket usable with testing/quick
+func (randomPacket) Generate(rand *rand.Rand, size int) reflect.Value {
+	payload := make([]byte, rand.Intn(MAX_PAYLOAD_SIZE+1))
+	rand.Read(payload)
+	if len(payload) == 0 {
+		payload = nil
+	}
+	packet := NewPacket(uint8(rand.Intn(16)), uint8(rand.Intn(16)), randomSeq(rand), randomSeq(rand), payload)
+	for i := rand.Intn(4); i > 0; i-- {
+		value := make([]byte, rand.Intn(24))
+		rand.Read(value)
+		packet.SetOption(uint8(1+rand.Intn(255)), value)
+	}
+	return reflect.ValueOf(randomPacket{packet})
+}
+
+// randomSeq returns a sequence number, often close to wrapping around
+func randomSeq(rand *rand.Rand) uint32 {
+	if rand.Intn(2) == 0 {
+		return math.MaxUint32 - uint32(rand.Intn(64))
+	}
+	return rand.Uint32()
+}
+
+func TestPropertySerializeRoundTrip(t *testing.T) {
+	roundTrip := func(p randomPacket) bool {
+		data := p.Serialize()
+		decoded, err := DeserializePacket(data)
+		if err != nil {
+			t.Logf("%v failed to deserialize: %v", p.Packet, err)
+			return false
+		}
+		return decoded.Version == p.Version && decoded.Type == p.Type &&
+			decoded.Flags == p.Flags && decoded.Length == p.Length &&
+			decoded.SeqNum == p.SeqNum && decoded.AckNum == p.AckNum &&
+			decoded.Checksum == p.Checksum &&
+			reflect.DeepEqual(decoded.Options, p.Options) &&
+			bytes.Equal(decoded.Payload, p.Payload) &&
+			bytes.Equal(decoded.Serialize(), data)
+	}
+	if err := quick.Check(roundTrip, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+// receiveSchedule is a run of sequence numbers starting anywhere, often
+// across the wraparound, in the order they arrive: shuffled with
+// duplicates, and where GetOrderedPackets is called along the way
+type receiveSchedule struct {
+	First   uint32
+	Arrival []uint32
+	Drain   []bool // drain after the arrival at the same index
+}
+
+// Generate makes receiveSchedule usable with testing/quick
+func (receiveSchedule) Generate(rand *rand.Rand, size int) reflect.Value {
+	s := receiveSchedule{First: randomSeq(rand)}
+	n := 1 + rand.Intn(200)
+	for i := 0; i < n; i++ {
+		s.Arrival = append(s.Arrival, s.First+uint32(i))
+	}
+	for i := rand.Intn(n); i > 0; i-- {
+		s.Arrival = append(s.Arrival, s.First+uint32(rand.Intn(n)))
+	}
+	rand.Shuffle(len(s.Arrival), func(i, j int) {
+		s.Arrival[i], s.Arrival[j] = s.Arrival[j], s.Arrival[i]
+	})
+	for range s.Arrival {
+		s.Drain = append(s.Drain, rand.Intn(8) == 0)
+	}
+	return reflect.ValueOf(s)
+}
+
+// distinct returns how many different sequence numbers arrive
+func (s receiveSchedule) distinct() int {
+	seen := make(map[uint32]bool)
+	for _, seq := range s.Arrival {
+		seen[seq] = true
+	}
+	return len(seen)
+}
+
+func TestPropertyOrderedPacketsSortedAndGapFree(t *testing.T) {
+	ordered := func(s receiveSchedule) bool {
+		rl := NewReliabilityLayer()
+		rl.SetPeerISN(s.First - 1)
+		var delivered []*Packet
+		for i, seq := range s.Arrival {
+			if err := rl.ReceivePacket(NewPacket(DATA_PACKET, 0, seq, 0, nil)); err != nil {
+				t.Logf("Packet %d refused: %v", seq, err)
+				return false
+			}
+			if s.Drain[i] {
+				delivered = append(delivered, rl.GetOrderedPackets()...)
+			}
+		}
+		delivered = append(delivered, rl.GetOrderedPackets()...)
+
+		// Every packet once, each the one after the last
+		if len(delivered) != s.distinct() {
+			t.Logf("Delivered %d of %d packets from %d", len(delivered), s.distinct(), s.First)
+			return false
+		}
+		for i, packet := range delivered {
+			if packet.SeqNum != s.First+uint32(i) {
+				t.Logf("Packet %d delivered as number %d from %d", packet.SeqNum, i, s.First)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(ordered, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPropertyLateDuplicatesNotRedelivered(t *testing.T) {
+	redelivered := func(s receiveSchedule, replay []uint8) bool {
+		rl := NewReliabilityLayer()
+		rl.SetPeerISN(s.First - 1)
+		for _, seq := range s.Arrival {
+			rl.ReceivePacket(NewPacket(DATA_PACKET, 0, seq, 0, nil))
+		}
+		rl.GetOrderedPackets()
+
+		// Copies of anything delivered, retransmitted after its ACK was lost
+		for _, i := range replay {
+			seq := s.Arrival[int(i)%len(s.Arrival)]
+			rl.ReceivePacket(NewPacket(DATA_PACKET, 0, seq, 0, nil))
+		}
+		return len(rl.GetOrderedPackets()) == 0
+	}
+	if err := quick.Check(redelivered, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPropertyInOrderAcksNeverFastRetransmit(t *testing.T) {
+	// Sends start anywhere in the sequence space, as after 2^32 packets
+	inOrder := func(first uint32, count uint8) bool {
+		rel := newConnectionReliabilityLayer(NewEpochDomain(releaseUnackedEntry), NewEpochDomain(releaseQueueNode))
+		rel.nextSeqNum, rel.sndUna, rel.sentNext = uint64(first), first, first
+		n := 1 + int(count)%32
+		for i := 0; i < n; i++ {
+			rel.SendPacket(NewPacket(DATA_PACKET, 0, rel.GetNextSeqNum(), 0, nil))
+		}
+		for i := 0; i < n; i++ {
+			result := rel.ProcessAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, first+uint32(i)+1, nil))
+			if !result.Matched || result.Retransmit != nil {
+				t.Logf("ACK %d of %d from %d: %+v", i, n, first, result)
+				return false
+			}
+		}
+		return rel.advanceUna() == first+uint32(n) && rel.GetStats().FastRetransmits == 0
+	}
+	config := &quick.Config{
+		MaxCount: quickConfig.MaxCount,
+		Values: func(args []reflect.Value, rand *rand.Rand) {
+			args[0] = reflect.ValueOf(randomSeq(rand))
+			args[1] = reflect.ValueOf(uint8(rand.Intn(256)))
+		},
+	}
+	if err := quick.Check(inOrder, config); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,245 @@
+package ultrafast
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Reverse proxying: requests arriving over the custom protocol are sent
+// on to conventional HTTP servers over TCP, so the fast transport can
+// front existing backends. Unlike the data path this uses the standard
+// library's sockets; a sandboxed server needs socket, connect and the
+// like in its ExtraSyscalls.
+
+// Defaults for ProxyConfig
+const (
+	defaultProxyIdlePerUpstream = 32
+	defaultProxyRetries         = 2
+	defaultProxyTimeout         = 30 * time.Second
+	defaultProxyMaxResponse     = 16 * 1024 * 1024
+)
+
+// proxyIdleTimeout closes pooled upstream connections left unused this long
+const proxyIdleTimeout = 90 * time.Second
+
+// hopHeaders are meaningful only on one hop, so a proxy never forwards
+// them (RFC 9110, section 7.6.1)
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate",
+	"Proxy-Authorization", "TE", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// ProxyConfig configures a reverse proxy. Zero values take the defaults.
+type ProxyConfig struct {
+	IdlePerUpstream  int           // pooled idle connections kept per upstream, default 32
+	Retries          int           // further attempts after a failed one, default 2; -1 for none
+	Timeout          time.Duration // per attempt, default 30s
+	MaxResponseBytes int64         // larger upstream bodies fail with 502, default 16MB
+	StripPrefix      string        // removed from the path before it is forwarded
+}
+
+// ProxyStats counts reverse proxy activity
+type ProxyStats struct {
+	Forwarded uint64 // requests an upstream answered
+	Retried   uint64 // attempts repeated on another upstream after a failure
+	Failed    uint64 // requests answered with 502 or 504
+}
+
+// ReverseProxy forwards requests to a set of upstream HTTP servers, in
+// turn. Connections to them are pooled and reused across requests. A
+// request whose attempt fails before any response is tried again on the
+// next upstream if its method is idempotent.
+type ReverseProxy struct {
+	upstreams []*url.URL
+	config    ProxyConfig
+	transport *http.Transport
+	next      atomic.Uint64 // round-robin position
+
+	forwarded atomic.Uint64
+	retried   atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// NewReverseProxy creates a proxy to upstreams, given as base URLs such
+// as "http://10.0.0.2:8080"
+func NewReverseProxy(upstreams []string, config ProxyConfig) (*ReverseProxy, error) {
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams")
+	}
+	if config.IdlePerUpstream <= 0 {
+		config.IdlePerUpstream = defaultProxyIdlePerUpstream
+	}
+	if config.Retries == 0 {
+		config.Retries = defaultProxyRetries
+	}
+	if config.Retries < 0 {
+		config.Retries = 0
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultProxyTimeout
+	}
+	if config.MaxResponseBytes <= 0 {
+		config.MaxResponseBytes = defaultProxyMaxResponse
+	}
+
+	p := &ReverseProxy{config: config}
+	for _, upstream := range upstreams {
+		u, err := parseUpstream(upstream)
+		if err != nil {
+			return nil, err
+		}
+		p.upstreams = append(p.upstreams, u)
+	}
+	p.transport = &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: config.Timeout, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConnsPerHost: config.IdlePerUpstream,
+		IdleConnTimeout:     proxyIdleTimeout,
+	}
+	return p, nil
+}
+
+// parseUpstream parses an upstream's base URL
+func parseUpstream(upstream string) (*url.URL, error) {
+	u, err := url.Parse(upstream)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream: %q", upstream)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return u, nil
+}
+
+// ServeRequest forwards a request and returns the upstream's response. It
+// is a RequestHandler, to register for the paths to proxy:
+//
+//	server.HandlePrefix("/api/", proxy.ServeRequest)
+func (p *ReverseProxy) ServeRequest(ctx context.Context, r *HTTPRequest) *HTTPResponse {
+	start := p.next.Add(1)
+	attempts := 1
+	if isIdempotent(r.Method) {
+		attempts += p.config.Retries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			p.retried.Add(1)
+		}
+		upstream := p.upstreams[(start+uint64(attempt))%uint64(len(p.upstreams))]
+		var response *HTTPResponse
+		if response, err = p.forward(ctx, upstream, r); err == nil {
+			p.forwarded.Add(1)
+			return response
+		}
+		logDebugf("Proxying %s %s to %s failed: %v", r.Method, r.Path, upstream.Host, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	p.failed.Add(1)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &HTTPResponse{StatusCode: 504, Body: []byte("504 Gateway Timeout")}
+	}
+	return &HTTPResponse{StatusCode: 502, Body: []byte("502 Bad Gateway")}
+}
+
+// forward makes one attempt at a request on upstream
+func (p *ReverseProxy) forward(ctx context.Context, upstream *url.URL, r *HTTPRequest) (*HTTPResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+
+	target := *upstream
+	path, query, _ := strings.Cut(strings.TrimPrefix(r.Path, p.config.StripPrefix), "?")
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	target.Path += path
+	target.RawQuery = query
+
+	outgoing, err := http.NewRequestWithContext(ctx, r.Method, target.String(), bytes.NewReader(r.Body))
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range r.Headers {
+		outgoing.Header.Set(name, value)
+	}
+	removeHopHeaders(outgoing.Header)
+	outgoing.Header.Del("Content-Length")
+	outgoing.Host = r.Header("Host")
+	forwardedFor := r.Peer.IP
+	if prior := outgoing.Header.Get("X-Forwarded-For"); prior != "" {
+		forwardedFor = prior + ", " + forwardedFor
+	}
+	outgoing.Header.Set("X-Forwarded-For", forwardedFor)
+
+	upstreamResponse, err := p.transport.RoundTrip(outgoing)
+	if err != nil {
+		return nil, err
+	}
+	defer upstreamResponse.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(upstreamResponse.Body, p.config.MaxResponseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > p.config.MaxResponseBytes {
+		return nil, fmt.Errorf("response larger than %d bytes", p.config.MaxResponseBytes)
+	}
+
+	removeHopHeaders(upstreamResponse.Header)
+	response := &HTTPResponse{
+		StatusCode: upstreamResponse.StatusCode,
+		Headers:    make(map[string]string, len(upstreamResponse.Header)),
+		Body:       body,
+	}
+	for name, values := range upstreamResponse.Header {
+		response.Headers[name] = strings.Join(values, ", ")
+	}
+	return response, nil
+}
+
+// removeHopHeaders deletes the hop-by-hop headers, including those the
+// Connection header names
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// isIdempotent reports whether a request with method may be sent again
+// after an attempt whose outcome is unknown (RFC 9110, section 9.2.2)
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Stats returns the proxy's counters
+func (p *ReverseProxy) Stats() ProxyStats {
+	return ProxyStats{
+		Forwarded: p.forwarded.Load(),
+		Retried:   p.retried.Load(),
+		Failed:    p.failed.Load(),
+	}
+}
+
+// Close closes the pooled upstream connections. Requests still in
+// flight finish; connections they open afterwards are closed when idle.
+func (p *ReverseProxy) Close() {
+	p.transport.CloseIdleConnections()
+}
@@ -0,0 +1,115 @@
+package ultrafast
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// deadUpstream returns the URL of a port nothing listens on
+func deadUpstream(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return "http://" + addr
+}
+
+func TestReverseProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Backend", "yes")
+		w.Header().Set("Connection", "close")
+		fmt.Fprintf(w, "%s %s?%s from %s: %s", r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("X-Forwarded-For"), body)
+	}))
+	defer backend.Close()
+
+	server := startTestServer(t)
+	proxy, err := NewReverseProxy([]string{backend.URL}, ProxyConfig{StripPrefix: "/api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	server.HandlePrefix("/api/", proxy.ServeRequest)
+	client := newTestClient(t, server)
+
+	response, err := client.Get("/api/items?page=2")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	text := string(response)
+	if !strings.Contains(text, "GET /items?page=2 from 127.0.0.1") || !strings.Contains(text, "X-Backend: yes") {
+		t.Errorf("Unexpected proxied response %q", text)
+	}
+	if strings.Contains(text, "Connection: close") {
+		t.Error("The upstream's hop-by-hop headers should not be forwarded")
+	}
+
+	addr := server.LocalAddr()
+	post := fmt.Sprintf("POST /api/items HTTP/1.1\r\nHost: %s\r\nContent-Length: 5\r\n\r\nhello", addr)
+	if response, err = client.Do([]byte(post)); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !strings.Contains(string(response), "POST /items? from 127.0.0.1: hello") {
+		t.Errorf("Expected the body forwarded, got %q", response)
+	}
+	if stats := proxy.Stats(); stats.Forwarded != 2 || stats.Failed != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestReverseProxyRetries(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "alive")
+	}))
+	defer backend.Close()
+	dead := deadUpstream(t)
+
+	server := startTestServer(t)
+	proxy, err := NewReverseProxy([]string{dead, backend.URL}, ProxyConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.HandlePrefix("/", proxy.ServeRequest)
+	client := newTestClient(t, server)
+
+	// Round robin starts on either; a GET that hits the dead one is retried
+	for i := 0; i < 2; i++ {
+		response, err := client.Get("/")
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if !strings.Contains(string(response), "alive") {
+			t.Errorf("Expected the live upstream's response, got %q", response)
+		}
+	}
+	if stats := proxy.Stats(); stats.Retried != 1 || stats.Forwarded != 2 {
+		t.Errorf("Expected one retry, got %+v", stats)
+	}
+
+	// A POST is not retried
+	only, _ := NewReverseProxy([]string{dead}, ProxyConfig{})
+	server.HandleFunc("/post", only.ServeRequest)
+	post := fmt.Sprintf("POST /post HTTP/1.1\r\nHost: %s\r\n\r\n", server.LocalAddr())
+	response, err := client.Do([]byte(post))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !strings.Contains(string(response), "502") {
+		t.Errorf("Expected 502, got %q", response)
+	}
+	if stats := only.Stats(); stats.Retried != 0 || stats.Failed != 1 {
+		t.Errorf("Expected one failure without retries, got %+v", stats)
+	}
+
+	if _, err := NewReverseProxy([]string{"10.0.0.1:80"}, ProxyConfig{}); err == nil {
+		t.Error("Expected an upstream without a scheme to be rejected")
+	}
+}
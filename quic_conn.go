@@ -0,0 +1,925 @@
+package ultrafast
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// QUIC mode limits. The windows granted to clients are generous because
+// hq-interop requests are a single line.
+const (
+	quicALPN               = "hq-interop"
+	quicIdleTimeout        = 30 * time.Second
+	quicInitialPTO         = 200 * time.Millisecond
+	quicMaxPTOBackoff      = 6
+	quicMaxData            = 16 << 20
+	quicMaxStreamData      = 1 << 20
+	quicMaxStreams         = 100
+	quicMaxDatagramSize    = 1200
+	quicMaxFrameData       = 1000 // CRYPTO and STREAM chunks fit any packet
+	quicAmplificationLimit = 3
+	quicMaxAckRanges       = 32
+	quicMaxCryptoBuffer    = 64 << 10 // out-of-order CRYPTO data held per space
+)
+
+// Packet number spaces
+const (
+	quicSpaceInitial = iota
+	quicSpaceHandshake
+	quicSpaceApplication
+	quicSpaceCount
+)
+
+// quicEndpoint serves QUIC connections on the server's socket. All of its
+// state is touched only on the event loop goroutine.
+type quicEndpoint struct {
+	config *tls.Config
+	conns  map[string]*quicConn // by connection ID, ours and the client's original
+}
+
+// EnableQUIC makes the server answer QUIC v1 on its socket alongside its
+// own protocol, so standard QUIC clients and tooling work against it.
+// Datagrams are told apart by their first byte: every packet of ours
+// starts with 0x1X, and QUIC sets the fixed bit 0x40.
+//
+// QUIC mode speaks the hq-interop application protocol, HTTP/0.9 over
+// QUIC streams as used by the QUIC interop runner: a client opens a
+// bidirectional stream, sends "GET /path" and reads the body back. Only
+// the subset needed for that is implemented: no 0-RTT, Retry, connection
+// migration or key updates, and only the AES-GCM cipher suites. config
+// must hold a certificate; its ALPN list defaults to hq-interop.
+func (s *UltraFastHTTPServer) EnableQUIC(config *tls.Config) error {
+	if config == nil || len(config.Certificates) == 0 && config.GetCertificate == nil {
+		return fmt.Errorf("QUIC requires a TLS certificate")
+	}
+	config = config.Clone()
+	config.MinVersion = tls.VersionTLS13
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{quicALPN}
+	}
+	s.quic.Store(&quicEndpoint{config: config, conns: make(map[string]*quicConn)})
+	return nil
+}
+
+// DisableQUIC stops accepting QUIC packets. Open QUIC connections are
+// dropped and time out on the client.
+func (s *UltraFastHTTPServer) DisableQUIC() {
+	if e := s.quic.Swap(nil); e != nil {
+		s.eventLoop.Submit(e.close)
+	}
+}
+
+// isQUICPacket reports whether a datagram carries QUIC rather than our
+// own protocol
+func isQUICPacket(data []byte) bool {
+	return len(data) > 0 && data[0]&0x40 != 0
+}
+
+// quicSentPacket is an ack-eliciting packet awaiting acknowledgement
+type quicSentPacket struct {
+	frames [][]byte // retransmittable frames, resent as-is if it is lost
+	sent   time.Time
+}
+
+// quicSpace is one packet number space with its keys
+type quicSpace struct {
+	read, write *quicKeys
+	nextPN      uint64
+	largestRecv uint64
+	recvRanges  []quicAckRange // received packet numbers, highest first
+	ackPending  bool           // an ack-eliciting packet is unacknowledged
+
+	cryptoRecv       map[uint64][]byte // out-of-order CRYPTO data by offset, never overlapping
+	cryptoRecvBytes  int               // held in cryptoRecv
+	cryptoRecvOffset uint64
+	cryptoSendOffset uint64
+
+	frames   [][]byte // queued frames, each sent in one packet
+	sent     map[uint64]*quicSentPacket
+	ptoCount int
+}
+
+// received records a packet number, reporting false for a duplicate.
+// Only the most recent ranges are kept; older packets are not acked again.
+func (sp *quicSpace) received(pn uint64) bool {
+	defer func() {
+		if len(sp.recvRanges) > quicMaxAckRanges {
+			sp.recvRanges = sp.recvRanges[:quicMaxAckRanges]
+		}
+	}()
+	for i, r := range sp.recvRanges {
+		switch {
+		case pn > r.largest+1:
+			sp.recvRanges = append(sp.recvRanges[:i], append([]quicAckRange{{pn, pn}}, sp.recvRanges[i:]...)...)
+			return true
+		case pn == r.largest+1:
+			sp.recvRanges[i].largest = pn
+			return true
+		case pn >= r.smallest:
+			return false
+		case pn+1 == r.smallest:
+			sp.recvRanges[i].smallest = pn
+			if i+1 < len(sp.recvRanges) && sp.recvRanges[i+1].largest+1 == pn {
+				sp.recvRanges[i].smallest = sp.recvRanges[i+1].smallest
+				sp.recvRanges = append(sp.recvRanges[:i+1], sp.recvRanges[i+2:]...)
+			}
+			return true
+		}
+	}
+	sp.recvRanges = append(sp.recvRanges, quicAckRange{pn, pn})
+	return true
+}
+
+// queueCrypto splits handshake data into CRYPTO frames
+func (sp *quicSpace) queueCrypto(data []byte) {
+	for len(data) > 0 {
+		n := min(len(data), quicMaxFrameData)
+		sp.frames = append(sp.frames, quicAppendCrypto(nil, sp.cryptoSendOffset, data[:n]))
+		sp.cryptoSendOffset += uint64(n)
+		data = data[n:]
+	}
+}
+
+// quicStream is a client-initiated bidirectional stream carrying one
+// hq-interop request and its response
+type quicStream struct {
+	id         uint64
+	recv       []byte
+	pending    map[uint64][]byte // out-of-order data by offset
+	finalSize  int64             // -1 until the FIN arrives
+	served     bool
+	send       []byte // response bytes not yet framed
+	sendOffset uint64
+	maxSend    uint64 // the client's flow control limit
+	responded  bool   // the whole response is in send
+}
+
+// quicConn is the server side of one QUIC connection
+type quicConn struct {
+	endpoint     *quicEndpoint
+	handler      *HTTPSocketHandler
+	peer         SocketAddr
+	tls          *tls.QUICConn
+	localCID     []byte
+	remoteCID    []byte
+	originalDCID []byte
+	spaces       [quicSpaceCount]*quicSpace
+
+	handshakeDone bool
+	validated     bool // a Handshake packet proved the client's address
+	closed        bool
+	bytesIn       int
+	bytesOut      int
+	lastActivity  time.Time
+	idleTimeout   time.Duration
+
+	streams        map[uint64]*quicStream
+	openedStreams  uint64 // bidi streams opened by the client so far
+	closedStreams  uint64
+	grantedStreams uint64
+	maxData        uint64 // connection flow control limit for our sends
+	streamLimit    uint64 // the client's initial limit per stream
+	dataSent       uint64
+	dataReceived   uint64
+	grantedData    uint64
+}
+
+// receive handles one datagram, which may hold several coalesced packets
+func (e *quicEndpoint) receive(h *HTTPSocketHandler, datagram []byte, from SocketAddr) {
+	var conn *quicConn
+	for data := datagram; len(data) > 0; {
+		header, err := parseQUICHeader(data)
+		if err != nil {
+			return
+		}
+		packet := data[:header.end]
+		data = data[header.end:]
+
+		if header.long && header.version != quicVersion1 {
+			// Version 0 is itself a Version Negotiation packet
+			if header.version != 0 && len(datagram) >= quicMinInitialDatagramSize {
+				h.server.socket.SendTo(quicVersionNegotiation(header), from.IP, from.Port)
+			}
+			return
+		}
+
+		c := e.conns[string(header.dcid)]
+		if c == nil {
+			// Only a full-sized Initial opens a connection
+			if !header.long || header.packetType != quicPacketInitial ||
+				len(datagram) < quicMinInitialDatagramSize || len(header.dcid) < 8 ||
+				h.server.IsDraining() {
+				continue
+			}
+			if c, err = e.accept(h, header, from); err != nil {
+				logDebugf("QUIC connection from %s refused: %v", from, err)
+				return
+			}
+		}
+		if c.closed {
+			continue
+		}
+		if conn == nil {
+			conn = c
+			conn.bytesIn += len(datagram)
+		}
+		c.peer = from
+		c.receivePacket(header, packet)
+	}
+	if conn != nil && !conn.closed {
+		conn.flush()
+	}
+}
+
+// accept starts a connection for a client's first Initial packet
+func (e *quicEndpoint) accept(h *HTTPSocketHandler, header *quicHeader, from SocketAddr) (*quicConn, error) {
+	c := &quicConn{
+		endpoint:       e,
+		handler:        h,
+		peer:           from,
+		localCID:       make([]byte, quicConnectionIDLength),
+		remoteCID:      append([]byte(nil), header.scid...),
+		originalDCID:   append([]byte(nil), header.dcid...),
+		lastActivity:   time.Now(),
+		idleTimeout:    quicIdleTimeout,
+		streams:        make(map[uint64]*quicStream),
+		grantedStreams: quicMaxStreams,
+		grantedData:    quicMaxData,
+	}
+	binary.BigEndian.PutUint64(c.localCID, randomUint64())
+	for i := range c.spaces {
+		c.spaces[i] = &quicSpace{
+			cryptoRecv: make(map[uint64][]byte),
+			sent:       make(map[uint64]*quicSentPacket),
+		}
+	}
+	clientKeys, serverKeys := quicInitialKeys(c.originalDCID)
+	c.spaces[quicSpaceInitial].read = clientKeys
+	c.spaces[quicSpaceInitial].write = serverKeys
+
+	params := &quicTransportParams{
+		originalDCID:         c.originalDCID,
+		initialSCID:          c.localCID,
+		maxIdleTimeout:       uint64(quicIdleTimeout / time.Millisecond),
+		initialMaxData:       quicMaxData,
+		maxStreamDataBidiRem: quicMaxStreamData,
+		maxStreamsBidi:       quicMaxStreams,
+	}
+	c.tls = tls.QUICServer(&tls.QUICConfig{TLSConfig: e.config})
+	c.tls.SetTransportParameters(params.marshal())
+	if err := c.tls.Start(context.Background()); err != nil {
+		return nil, err
+	}
+
+	e.conns[string(c.originalDCID)] = c
+	e.conns[string(c.localCID)] = c
+	atomic.AddUint64(&h.server.stats.ConnectionsActive, 1)
+	logDebugf("QUIC connection from %s", from)
+	return c, nil
+}
+
+// tick retransmits lost packets and drops idle connections
+func (e *quicEndpoint) tick(now time.Time) {
+	seen := make(map[*quicConn]bool)
+	for _, c := range e.conns {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		if now.Sub(c.lastActivity) > c.idleTimeout {
+			logDebugf("QUIC connection from %s idle, dropping", c.peer)
+			c.remove()
+			continue
+		}
+		if c.detectLoss(now) {
+			c.flush()
+		}
+	}
+}
+
+// close drops every connection
+func (e *quicEndpoint) close() {
+	for _, c := range e.conns {
+		if !c.closed {
+			c.close(quicNoError, "server shutting down")
+		}
+	}
+}
+
+// receivePacket decrypts and handles one packet
+func (c *quicConn) receivePacket(header *quicHeader, packet []byte) {
+	level := quicSpaceApplication
+	if header.long {
+		switch header.packetType {
+		case quicPacketInitial:
+			level = quicSpaceInitial
+		case quicPacketHandshake:
+			level = quicSpaceHandshake
+		default:
+			return // 0-RTT is not accepted
+		}
+	}
+	space := c.spaces[level]
+	if space == nil || space.read == nil {
+		return // keys discarded or not yet available
+	}
+	pn, payload, err := space.read.open(packet, header.pnOffset, space.largestRecv)
+	if err != nil {
+		return
+	}
+	if !space.received(pn) {
+		return
+	}
+	space.largestRecv = max(space.largestRecv, pn)
+	c.lastActivity = time.Now()
+
+	frames, err := parseQUICFrames(payload)
+	if err != nil {
+		c.close(quicFrameEncodingError, err.Error())
+		return
+	}
+
+	// The client's first Handshake packet proves its address and ends
+	// the use of Initial keys
+	if level == quicSpaceHandshake && !c.validated {
+		c.validated = true
+		c.spaces[quicSpaceInitial] = nil
+	}
+
+	for i := range frames {
+		f := &frames[i]
+		if f.ackEliciting() {
+			space.ackPending = true
+		}
+		if err := c.handleFrame(level, f); err != nil {
+			if !c.closed {
+				var code uint64 = quicProtocolViolation
+				var alert tls.AlertError
+				if errors.As(err, &alert) {
+					code = quicCryptoError + uint64(alert)
+				}
+				c.close(code, err.Error())
+			}
+			return
+		}
+		if c.closed {
+			return
+		}
+	}
+}
+
+// handleFrame acts on one frame received at an encryption level
+func (c *quicConn) handleFrame(level int, f *quicFrame) error {
+	space := c.spaces[level]
+	if level != quicSpaceApplication {
+		switch f.frameType {
+		case quicFramePing, quicFrameAck, quicFrameAckECN, quicFrameCrypto, quicFrameConnectionClose:
+		default:
+			return fmt.Errorf("frame 0x%x not allowed before the handshake completes", f.frameType)
+		}
+	}
+
+	switch f.frameType {
+	case quicFrameAck, quicFrameAckECN:
+		c.onAck(space, f.ackRanges)
+	case quicFrameCrypto:
+		return c.receiveCrypto(level, f.offset, f.data)
+	case quicFrameStream:
+		return c.receiveStream(f)
+	case quicFrameResetStream, quicFrameStopSending:
+		// The client gave up on the request; stop answering it
+		if stream := c.streams[f.stream]; stream != nil {
+			c.finishStream(stream)
+		}
+	case quicFrameMaxData:
+		c.maxData = max(c.maxData, f.value)
+		c.sendStreams()
+	case quicFrameMaxStreamData:
+		if stream := c.streams[f.stream]; stream != nil {
+			stream.maxSend = max(stream.maxSend, f.value)
+			c.sendStreams()
+		}
+	case quicFramePathChallenge:
+		response := quicAppendVarint(nil, quicFramePathResponse)
+		space.frames = append(space.frames, append(response, f.data...))
+	case quicFrameConnectionClose, quicFrameApplicationClose:
+		if f.value != quicNoError {
+			logDebugf("QUIC connection from %s closed by peer: 0x%x %s", c.peer, f.value, f.reason)
+		}
+		c.remove()
+	case quicFrameHandshakeDone:
+		return fmt.Errorf("client sent HANDSHAKE_DONE")
+	}
+	return nil
+}
+
+// receiveCrypto feeds in-order handshake data to TLS
+func (c *quicConn) receiveCrypto(level int, offset uint64, data []byte) error {
+	space := c.spaces[level]
+	if end := offset + uint64(len(data)); end <= space.cryptoRecvOffset {
+		return nil // retransmitted
+	} else if offset > space.cryptoRecvOffset {
+		return space.bufferCrypto(offset, data)
+	}
+
+	tlsLevel := [quicSpaceCount]tls.QUICEncryptionLevel{
+		tls.QUICEncryptionLevelInitial,
+		tls.QUICEncryptionLevelHandshake,
+		tls.QUICEncryptionLevelApplication,
+	}[level]
+	for {
+		data = data[space.cryptoRecvOffset-offset:]
+		if err := c.tls.HandleData(tlsLevel, data); err != nil {
+			return err
+		}
+		space.cryptoRecvOffset += uint64(len(data))
+
+		// Anything buffered that is now contiguous goes in next
+		next := false
+		for o, buffered := range space.cryptoRecv {
+			if o <= space.cryptoRecvOffset {
+				delete(space.cryptoRecv, o)
+				space.cryptoRecvBytes -= len(buffered)
+				if o+uint64(len(buffered)) > space.cryptoRecvOffset {
+					offset, data, next = o, buffered, true
+					break
+				}
+			}
+		}
+		if !next {
+			break
+		}
+	}
+	return c.handleTLSEvents()
+}
+
+// bufferCrypto holds CRYPTO data that arrived ahead of the next offset
+// expected, trimmed of what is already held: a range covered by one held
+// is dropped, and a held range the new one covers is replaced by it. The
+// data held stays within quicMaxCryptoBuffer of the next offset.
+func (sp *quicSpace) bufferCrypto(offset uint64, data []byte) error {
+	end := offset + uint64(len(data))
+	if end-sp.cryptoRecvOffset > quicMaxCryptoBuffer {
+		return fmt.Errorf("too much out-of-order CRYPTO data")
+	}
+
+	// The new range only shrinks, so one pass finds every overlap
+	for o, held := range sp.cryptoRecv {
+		heldEnd := o + uint64(len(held))
+		switch {
+		case heldEnd <= offset || o >= end:
+		case o <= offset && heldEnd >= end:
+			return nil // a retransmission of what is held
+		case o >= offset && heldEnd <= end:
+			delete(sp.cryptoRecv, o)
+			sp.cryptoRecvBytes -= len(held)
+		case o < offset:
+			data, offset = data[heldEnd-offset:], heldEnd
+		default:
+			data, end = data[:o-offset], o
+		}
+	}
+
+	if sp.cryptoRecvBytes+len(data) > quicMaxCryptoBuffer {
+		return fmt.Errorf("too much out-of-order CRYPTO data")
+	}
+	sp.cryptoRecv[offset] = append([]byte(nil), data...)
+	sp.cryptoRecvBytes += len(data)
+	return nil
+}
+
+// handleTLSEvents applies what the handshake produced: keys, handshake
+// messages to send, the client's transport parameters and completion
+func (c *quicConn) handleTLSEvents() error {
+	for {
+		event := c.tls.NextEvent()
+		switch event.Kind {
+		case tls.QUICNoEvent:
+			return nil
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			space := c.levelSpace(event.Level)
+			if space == nil {
+				continue // 0-RTT keys; early data is not accepted
+			}
+			keys, err := newQUICKeys(event.Suite, event.Data)
+			if err != nil {
+				return err
+			}
+			if event.Kind == tls.QUICSetReadSecret {
+				space.read = keys
+			} else {
+				space.write = keys
+			}
+		case tls.QUICWriteData:
+			if space := c.levelSpace(event.Level); space != nil {
+				space.queueCrypto(event.Data)
+			}
+		case tls.QUICTransportParameters:
+			if err := c.applyTransportParams(event.Data); err != nil {
+				return err
+			}
+		case tls.QUICHandshakeDone:
+			// The client's Finished confirms the handshake on our side
+			c.handshakeDone = true
+			app := c.spaces[quicSpaceApplication]
+			app.frames = append(app.frames, quicAppendVarint(nil, quicFrameHandshakeDone))
+			c.spaces[quicSpaceHandshake] = nil
+			logDebugf("QUIC handshake with %s done, ALPN %q", c.peer, c.tls.ConnectionState().NegotiatedProtocol)
+		}
+	}
+}
+
+// levelSpace maps a TLS encryption level to its packet number space
+func (c *quicConn) levelSpace(level tls.QUICEncryptionLevel) *quicSpace {
+	switch level {
+	case tls.QUICEncryptionLevelInitial:
+		return c.spaces[quicSpaceInitial]
+	case tls.QUICEncryptionLevelHandshake:
+		return c.spaces[quicSpaceHandshake]
+	case tls.QUICEncryptionLevelApplication:
+		return c.spaces[quicSpaceApplication]
+	}
+	return nil
+}
+
+// applyTransportParams checks and adopts the client's transport parameters
+func (c *quicConn) applyTransportParams(data []byte) error {
+	params, err := parseQUICTransportParams(data)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(params.initialSCID, c.remoteCID) {
+		return fmt.Errorf("initial_source_connection_id does not match")
+	}
+	if params.originalDCID != nil {
+		return fmt.Errorf("client sent original_destination_connection_id")
+	}
+	if params.maxIdleTimeout > 0 {
+		c.idleTimeout = min(c.idleTimeout, time.Duration(params.maxIdleTimeout)*time.Millisecond)
+	}
+	c.maxData = params.initialMaxData
+	c.streamLimit = params.maxStreamDataBidiLoc // streams the client opens are local to it
+	return nil
+}
+
+// receiveStream adds STREAM data to a request
+func (c *quicConn) receiveStream(f *quicFrame) error {
+	if f.stream&0x3 != 0 {
+		return nil // only client-initiated bidirectional streams carry requests
+	}
+	index := f.stream / 4
+	if index >= c.grantedStreams {
+		return fmt.Errorf("stream %d over the limit", f.stream)
+	}
+	for ; c.openedStreams <= index; c.openedStreams++ {
+		id := c.openedStreams * 4
+		c.streams[id] = &quicStream{id: id, finalSize: -1, pending: make(map[uint64][]byte), maxSend: c.streamLimit}
+	}
+	stream := c.streams[f.stream]
+	if stream == nil || stream.served {
+		return nil // finished already, or the request is complete
+	}
+
+	end := f.offset + uint64(len(f.data))
+	if end > quicMaxStreamData {
+		return fmt.Errorf("stream %d exceeds its flow control limit", f.stream)
+	}
+	if f.fin {
+		stream.finalSize = int64(end)
+	}
+	received := uint64(len(stream.recv))
+	if end > received {
+		c.dataReceived += end - max(f.offset, received)
+	}
+	if f.offset > received {
+		stream.pending[f.offset] = append([]byte(nil), f.data...)
+	} else if end > received {
+		stream.recv = append(stream.recv, f.data[received-f.offset:]...)
+	}
+	for progress := true; progress; {
+		progress = false
+		for o, data := range stream.pending {
+			received := uint64(len(stream.recv))
+			if o <= received {
+				delete(stream.pending, o)
+				if e := o + uint64(len(data)); e > received {
+					stream.recv = append(stream.recv, data[received-o:]...)
+				}
+				progress = true
+			}
+		}
+	}
+
+	if c.dataReceived > c.grantedData {
+		return fmt.Errorf("connection flow control limit exceeded")
+	}
+	if c.grantedData-c.dataReceived < quicMaxData/2 {
+		c.grantedData = c.dataReceived + quicMaxData
+		frame := quicAppendVarint(nil, quicFrameMaxData)
+		c.queue(quicAppendVarint(frame, c.grantedData))
+	}
+
+	if stream.finalSize >= 0 && int64(len(stream.recv)) == stream.finalSize {
+		stream.served = true
+		c.serveStream(stream)
+	}
+	return nil
+}
+
+// serveStream answers an hq-interop request ("GET /path") through the
+// server's handlers, on the worker pool when there is one
+func (c *quicConn) serveStream(stream *quicStream) {
+	h := c.handler
+	fields := strings.Fields(string(stream.recv))
+	stream.recv = nil
+	if len(fields) < 2 || fields[0] != "GET" || !strings.HasPrefix(fields[1], "/") {
+		c.respondStream(stream, []byte("Bad Request\n"))
+		return
+	}
+
+	request := &HTTPRequest{
+		Method:   "GET",
+		Path:     fields[1],
+		Headers:  make(map[string]string),
+		Peer:     c.peer,
+		received: time.Now(),
+	}
+	if name := c.tls.ConnectionState().ServerName; name != "" {
+		request.Headers["Host"] = name
+	}
+	ctx, cancel := h.newRequestContext(nil, RequestInfo{Peer: c.peer, Received: request.received})
+
+	// HTTP/0.9 has no status line or headers: the client gets the body
+	handle := func() ([]byte, int) {
+		defer cancel()
+		response := h.handleHTTPRequest(ctx, request)
+		defer releaseResponse(response)
+		body, err := quicResponseBody(response)
+		if err != nil {
+			logWarnf("Failed to read response body for %s: %v", c.peer, err)
+		}
+		return body, response.StatusCode
+	}
+	respond := func(body []byte, status int) {
+		h.server.logAccess(request, status, int64(len(body)))
+		if !c.closed {
+			c.respondStream(stream, body)
+			c.flush()
+		}
+	}
+
+	pool := h.server.workers.Load()
+	if pool == nil {
+		respond(handle())
+		return
+	}
+	submitted := pool.Submit(func() {
+		body, status := handle()
+		h.server.sendOnLoop(func() {
+			respond(body, status)
+		})
+	})
+	if !submitted {
+		atomic.AddUint64(&h.server.stats.HandlerRejected, 1)
+		cancel()
+		respond([]byte("Service Unavailable\n"), 503)
+	}
+}
+
+// quicResponseBody returns the body of a response, reading any file
+// body into memory
+func quicResponseBody(response *HTTPResponse) ([]byte, error) {
+	var body bytes.Buffer
+	if w := response.writer; w != nil {
+		body.Write(w.body)
+	} else {
+		body.Write(response.Body)
+	}
+	if response.file.size() > 0 {
+		if _, err := response.file.WriteTo(&body); err != nil {
+			return nil, err
+		}
+	}
+	return body.Bytes(), nil
+}
+
+// respondStream queues a response body on its stream
+func (c *quicConn) respondStream(stream *quicStream, body []byte) {
+	if c.streams[stream.id] != stream {
+		return // reset by the client meanwhile
+	}
+	stream.send = body
+	stream.responded = true
+	atomic.AddUint64(&c.handler.server.stats.ResponsesSent, 1)
+	c.sendStreams()
+}
+
+// sendStreams frames response data within the client's flow control
+// limits
+func (c *quicConn) sendStreams() {
+	for _, stream := range c.streams {
+		if !stream.responded {
+			continue
+		}
+		for {
+			n := min(uint64(len(stream.send)), quicMaxFrameData,
+				stream.maxSend-stream.sendOffset, c.maxData-c.dataSent)
+			if n == 0 && len(stream.send) > 0 {
+				break // blocked until the client raises its limits
+			}
+			fin := n == uint64(len(stream.send))
+			c.queue(quicAppendStream(nil, stream.id, stream.sendOffset, stream.send[:n], fin))
+			stream.send = stream.send[n:]
+			stream.sendOffset += n
+			c.dataSent += n
+			if fin {
+				c.finishStream(stream)
+				break
+			}
+		}
+	}
+}
+
+// finishStream forgets a stream and lets the client open another
+func (c *quicConn) finishStream(stream *quicStream) {
+	delete(c.streams, stream.id)
+	c.closedStreams++
+	if c.grantedStreams-c.closedStreams < quicMaxStreams/2 {
+		c.grantedStreams = c.closedStreams + quicMaxStreams
+		frame := quicAppendVarint(nil, quicFrameMaxStreamsBidi)
+		c.queue(quicAppendVarint(frame, c.grantedStreams))
+	}
+}
+
+// queue adds a frame to the application packet number space
+func (c *quicConn) queue(frame []byte) {
+	app := c.spaces[quicSpaceApplication]
+	app.frames = append(app.frames, frame)
+}
+
+// onAck stops tracking acknowledged packets
+func (c *quicConn) onAck(space *quicSpace, ranges []quicAckRange) {
+	for pn := range space.sent {
+		for _, r := range ranges {
+			if pn >= r.smallest && pn <= r.largest {
+				delete(space.sent, pn)
+				space.ptoCount = 0
+				break
+			}
+		}
+	}
+}
+
+// detectLoss requeues the frames of packets unacknowledged for longer
+// than the probe timeout, which doubles with each expiry. There is no
+// RTT estimate; the initial timeout is used throughout.
+func (c *quicConn) detectLoss(now time.Time) bool {
+	lost := false
+	for _, space := range c.spaces {
+		if space == nil || len(space.sent) == 0 {
+			continue
+		}
+		pto := quicInitialPTO << min(space.ptoCount, quicMaxPTOBackoff)
+		var oldest time.Time
+		for _, p := range space.sent {
+			if oldest.IsZero() || p.sent.Before(oldest) {
+				oldest = p.sent
+			}
+		}
+		if now.Sub(oldest) < pto {
+			continue
+		}
+		var frames [][]byte
+		for pn, p := range space.sent {
+			frames = append(frames, p.frames...)
+			delete(space.sent, pn)
+		}
+		space.frames = append(frames, space.frames...)
+		space.ptoCount++
+		lost = true
+	}
+	return lost
+}
+
+// flush sends queued frames and acknowledgements, one packet per
+// datagram. Until the client's address is validated, sends stop at three
+// times what it has sent us.
+func (c *quicConn) flush() {
+	for level, space := range c.spaces {
+		if space == nil || space.write == nil {
+			continue
+		}
+		for space.ackPending || len(space.frames) > 0 {
+			datagram, consumed := c.buildPacket(level, space)
+			if consumed == 0 && !space.ackPending {
+				break // cannot happen: every queued frame fits an empty packet
+			}
+			if !c.validated && c.bytesOut+len(datagram) > quicAmplificationLimit*c.bytesIn {
+				atomic.AddUint64(&c.handler.server.stats.AmplificationLimited, 1)
+				return
+			}
+			space.nextPN++
+			space.ackPending = false
+			if consumed > 0 {
+				space.sent[space.nextPN-1] = &quicSentPacket{frames: space.frames[:consumed:consumed], sent: time.Now()}
+				space.frames = space.frames[consumed:]
+			}
+			c.send(datagram)
+		}
+	}
+}
+
+// buildPacket protects the next packet of a space: an ACK if one is due,
+// then as many queued frames as fit. It returns the datagram and how many
+// queued frames it carries.
+func (c *quicConn) buildPacket(level int, space *quicSpace) ([]byte, int) {
+	const overhead = 1 + 4 + 1 + 20 + 1 + 20 + 1 + 2 + 4 + 16 // worst-case long header and tag
+	var payload []byte
+	if space.ackPending && len(space.recvRanges) > 0 {
+		payload = quicAppendAck(payload, space.recvRanges)
+	}
+	consumed := 0
+	for _, frame := range space.frames {
+		if len(payload)+len(frame) > quicMaxDatagramSize-overhead {
+			break
+		}
+		payload = append(payload, frame...)
+		consumed++
+	}
+
+	pn := space.nextPN
+	if level == quicSpaceApplication {
+		return space.write.seal(quicShortHeader(c.remoteCID, pn), 4, pn, payload), consumed
+	}
+
+	packetType := uint8(quicPacketInitial)
+	if level == quicSpaceHandshake {
+		packetType = quicPacketHandshake
+	}
+	// A datagram carrying an ack-eliciting Initial is padded to the
+	// minimum size, as the client's was
+	if level == quicSpaceInitial && consumed > 0 {
+		header := quicLongHeader(packetType, c.remoteCID, c.localCID, nil, pn, len(payload))
+		if short := quicMaxDatagramSize - (len(header) + len(payload) + 16); short > 0 {
+			payload = append(payload, make([]byte, short)...)
+		}
+	}
+	header := quicLongHeader(packetType, c.remoteCID, c.localCID, nil, pn, len(payload))
+	return space.write.seal(header, 4, pn, payload), consumed
+}
+
+// send writes a datagram to the client
+func (c *quicConn) send(datagram []byte) {
+	server := c.handler.server
+	if _, err := server.socket.SendTo(datagram, c.peer.IP, c.peer.Port); err != nil {
+		atomic.AddUint64(&server.stats.Errors, 1)
+		return
+	}
+	c.bytesOut += len(datagram)
+	atomic.AddUint64(&server.stats.BytesSent, uint64(len(datagram)))
+	server.pacer.Load().Charge(len(datagram))
+}
+
+// close sends CONNECTION_CLOSE at the highest level the client can read
+// and forgets the connection
+func (c *quicConn) close(code uint64, reason string) {
+	if code != quicNoError {
+		logDebugf("Closing QUIC connection from %s: 0x%x %s", c.peer, code, reason)
+	}
+	level := quicSpaceInitial
+	switch {
+	case c.handshakeDone:
+		level = quicSpaceApplication
+	case c.spaces[quicSpaceHandshake] != nil && c.spaces[quicSpaceHandshake].write != nil:
+		level = quicSpaceHandshake
+	}
+	if space := c.spaces[level]; space != nil && space.write != nil {
+		if level != quicSpaceApplication {
+			reason = "" // a reason could leak details before the handshake completes
+		}
+		space.ackPending = false
+		space.frames = [][]byte{quicAppendConnectionClose(nil, code, reason)}
+		datagram, _ := c.buildPacket(level, space)
+		c.send(datagram)
+	}
+	c.remove()
+}
+
+// remove forgets the connection without telling the client
+func (c *quicConn) remove() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.tls.Close()
+	delete(c.endpoint.conns, string(c.originalDCID))
+	delete(c.endpoint.conns, string(c.localCID))
+	atomic.AddUint64(&c.handler.server.stats.ConnectionsActive, ^uint64(0))
+}
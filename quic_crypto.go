@@ -0,0 +1,215 @@
+package ultrafast
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// QUIC packet protection (RFC 9001 section 5)
+
+// quicInitialSalt derives the Initial secrets of QUIC version 1
+var quicInitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+// quicSampleSize is the ciphertext sampled for header protection
+const quicSampleSize = 16
+
+var errQUICDecrypt = errors.New("quic: packet decryption failed")
+
+// quicKeys protects packets in one direction at one encryption level
+type quicKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label from TLS 1.3 with an empty context
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	full := "tls13 " + label
+	info := make([]byte, 0, 4+len(full))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(full)))
+	info = append(info, full...)
+	info = append(info, 0)
+	out, err := hkdf.Expand(h, secret, string(info), length)
+	if err != nil {
+		panic(err) // only for lengths HKDF cannot produce
+	}
+	return out
+}
+
+// newQUICKeys derives packet protection keys from a TLS traffic secret.
+// Only the AES-GCM suites are supported.
+func newQUICKeys(suite uint16, secret []byte) (*quicKeys, error) {
+	var h func() hash.Hash
+	var keyLen int
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		h, keyLen = sha256.New, 16
+	case tls.TLS_AES_256_GCM_SHA384:
+		h, keyLen = sha512.New384, 32
+	default:
+		return nil, fmt.Errorf("quic: unsupported cipher suite %s", tls.CipherSuiteName(suite))
+	}
+	key := hkdfExpandLabel(h, secret, "quic key", keyLen)
+	iv := hkdfExpandLabel(h, secret, "quic iv", 12)
+	hpKey := hkdfExpandLabel(h, secret, "quic hp", keyLen)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, err
+	}
+	return &quicKeys{aead: aead, iv: iv, hp: hp}, nil
+}
+
+// quicInitialKeys derives the Initial keys from the client's first
+// destination connection ID, returning the client's and the server's
+func quicInitialKeys(dcid []byte) (client, server *quicKeys) {
+	initial, err := hkdf.Extract(sha256.New, dcid, quicInitialSalt)
+	if err != nil {
+		panic(err)
+	}
+	clientSecret := hkdfExpandLabel(sha256.New, initial, "client in", sha256.Size)
+	serverSecret := hkdfExpandLabel(sha256.New, initial, "server in", sha256.Size)
+	client, _ = newQUICKeys(tls.TLS_AES_128_GCM_SHA256, clientSecret)
+	server, _ = newQUICKeys(tls.TLS_AES_128_GCM_SHA256, serverSecret)
+	return client, server
+}
+
+// nonce returns the AEAD nonce for a packet number
+func (k *quicKeys) nonce(pn uint64) []byte {
+	nonce := make([]byte, len(k.iv))
+	copy(nonce, k.iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return nonce
+}
+
+// headerMask computes the header protection mask from a ciphertext sample
+func (k *quicKeys) headerMask(sample []byte) []byte {
+	mask := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(mask, sample)
+	return mask
+}
+
+// seal encrypts payload behind header, whose last pnLen bytes hold the
+// packet number, and applies header protection. The header of a long
+// packet must already count the pnLen, payload and tag in its Length.
+func (k *quicKeys) seal(header []byte, pnLen int, pn uint64, payload []byte) []byte {
+	// Header protection samples 4 bytes past the packet number start
+	if short := pnLen + len(payload) - 4; short < 0 {
+		panic("quic: payload too short to sample")
+	}
+	packet := k.aead.Seal(header, k.nonce(pn), payload, header)
+	pnOffset := len(header) - pnLen
+	mask := k.headerMask(packet[pnOffset+4 : pnOffset+4+quicSampleSize])
+	if packet[0]&0x80 != 0 {
+		packet[0] ^= mask[0] & 0x0f
+	} else {
+		packet[0] ^= mask[0] & 0x1f
+	}
+	for i := 0; i < pnLen; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+// open removes header protection and decrypts one packet in place,
+// returning its full packet number and plaintext. largest is the highest
+// packet number received so far in the same space.
+func (k *quicKeys) open(packet []byte, pnOffset int, largest uint64) (uint64, []byte, error) {
+	if len(packet) < pnOffset+4+quicSampleSize {
+		return 0, nil, errQUICTruncated
+	}
+	mask := k.headerMask(packet[pnOffset+4 : pnOffset+4+quicSampleSize])
+	first := packet[0]
+	if first&0x80 != 0 {
+		first ^= mask[0] & 0x0f
+	} else {
+		first ^= mask[0] & 0x1f
+	}
+	pnLen := int(first&0x03) + 1
+	var truncated uint64
+	for i := 0; i < pnLen; i++ {
+		truncated = truncated<<8 | uint64(packet[pnOffset+i]^mask[1+i])
+	}
+	pn := quicDecodePacketNumber(largest, truncated, pnLen*8)
+
+	// Decrypt a copy of the header so a failed attempt leaves the packet
+	// intact for another key
+	header := make([]byte, pnOffset+pnLen)
+	copy(header, packet)
+	header[0] = first
+	for i := 0; i < pnLen; i++ {
+		header[pnOffset+i] ^= mask[1+i]
+	}
+	payload, err := k.aead.Open(packet[pnOffset+pnLen:pnOffset+pnLen], k.nonce(pn),
+		packet[pnOffset+pnLen:], header)
+	if err != nil {
+		return 0, nil, errQUICDecrypt
+	}
+	return pn, payload, nil
+}
+
+// quicDecodePacketNumber recovers a full packet number from its truncated
+// form (RFC 9000 appendix A.3)
+func quicDecodePacketNumber(largest, truncated uint64, bits int) uint64 {
+	expected := largest + 1
+	window := uint64(1) << bits
+	half := window / 2
+	candidate := (expected &^ (window - 1)) | truncated
+	switch {
+	case candidate+half <= expected && candidate < (1<<62)-window:
+		return candidate + window
+	case candidate > expected+half && candidate >= window:
+		return candidate - window
+	}
+	return candidate
+}
+
+// quicLongHeader builds a long header up to and including a 4-byte packet
+// number. payloadLen is the plaintext that will follow.
+func quicLongHeader(packetType uint8, dcid, scid, token []byte, pn uint64, payloadLen int) []byte {
+	const pnLen = 4
+	b := []byte{0xc0 | packetType<<4 | (pnLen - 1)}
+	b = binary.BigEndian.AppendUint32(b, quicVersion1)
+	b = append(b, byte(len(dcid)))
+	b = append(b, dcid...)
+	b = append(b, byte(len(scid)))
+	b = append(b, scid...)
+	if packetType == quicPacketInitial {
+		b = quicAppendVarint(b, uint64(len(token)))
+		b = append(b, token...)
+	}
+	length := uint64(pnLen + payloadLen + 16)
+	// A fixed two-byte Length keeps padding arithmetic simple
+	b = append(b, 0x40|byte(length>>8), byte(length))
+	return binary.BigEndian.AppendUint32(b, uint32(pn))
+}
+
+// quicShortHeader builds a short header with a 4-byte packet number
+func quicShortHeader(dcid []byte, pn uint64) []byte {
+	const pnLen = 4
+	b := []byte{0x40 | (pnLen - 1)}
+	b = append(b, dcid...)
+	return binary.BigEndian.AppendUint32(b, uint32(pn))
+}
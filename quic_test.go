@@ -0,0 +1,411 @@
+package ultrafast
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestQUICPacketProtection(t *testing.T) {
+	// RFC 9001 appendix A: keys and the server's Initial packet
+	client, server := quicInitialKeys(decodeHex(t, "8394c8f03e515708"))
+	if !bytes.Equal(client.iv, decodeHex(t, "fa044b2f42a3fd3b46fb255c")) ||
+		!bytes.Equal(server.iv, decodeHex(t, "0ac1493ca1905853b0bba03e")) {
+		t.Fatalf("Unexpected Initial IVs %x %x", client.iv, server.iv)
+	}
+
+	header := decodeHex(t, "c1000000010008f067a5502a4262b50040750001")
+	payload := decodeHex(t, "02000000000600405a020000560303eefce7f7b37ba1d1632e96677825ddf73988cfc7"+
+		"9825df566dc5430b9a045a1200130100002e00330024001d00209d3c940d89690b84d08a60993c144eca684d10"+
+		"81287c834d5311bcf32bb9da1a002b00020304")
+	want := decodeHex(t, "cf000000010008f067a5502a4262b5004075c0d95a482cd0991cd25b0aac406a5816b6394100f3"+
+		"7a1c69797554780bb38cc5a99f5ede4cf73c3ec2493a1839b3dbcba3f6ea46c5b7684df3548e7ddeb9c3bf9c73cc3f"+
+		"3bded74b562bfb19fb84022f8ef4cdd93795d77d06edbb7aaf2f58891850abbdca3d20398c276456cbc42158407dd074ee")
+	packet := server.seal(header, 2, 1, payload)
+	if !bytes.Equal(packet, want) {
+		t.Fatalf("Protected packet mismatch:\n got %x\nwant %x", packet, want)
+	}
+
+	parsed, err := parseQUICHeader(packet)
+	if err != nil || parsed.packetType != quicPacketInitial || parsed.end != len(packet) {
+		t.Fatalf("Failed to parse header: %+v, %v", parsed, err)
+	}
+	pn, plain, err := server.open(packet, parsed.pnOffset, 0)
+	if err != nil || pn != 1 || !bytes.Equal(plain, payload) {
+		t.Fatalf("Failed to open packet: pn %d, %v", pn, err)
+	}
+	frames, err := parseQUICFrames(plain)
+	if err != nil || len(frames) != 2 || frames[0].frameType != quicFrameAck || frames[1].frameType != quicFrameCrypto {
+		t.Fatalf("Unexpected frames %+v, %v", frames, err)
+	}
+
+	if _, _, err := client.open(packet, parsed.pnOffset, 0); err == nil {
+		t.Error("Opening with the wrong keys should fail")
+	}
+}
+
+func TestQUICWireEncoding(t *testing.T) {
+	for _, v := range []uint64{0, 63, 64, 16383, 16384, 1<<30 - 1, 1 << 30, quicMaxVarint} {
+		encoded := quicAppendVarint(nil, v)
+		decoded, n, err := quicReadVarint(encoded)
+		if err != nil || decoded != v || n != len(encoded) || n != quicVarintLen(v) {
+			t.Errorf("Varint %d round trip gave %d (%d bytes), %v", v, decoded, n, err)
+		}
+	}
+	// RFC 9000 appendix A.3
+	if pn := quicDecodePacketNumber(0xa82f30ea, 0x9b32, 16); pn != 0xa82f9b32 {
+		t.Errorf("Expected packet number 0xa82f9b32, got %x", pn)
+	}
+
+	space := &quicSpace{}
+	for _, pn := range []uint64{0, 1, 5, 3, 4, 9} {
+		if !space.received(pn) {
+			t.Errorf("Packet %d reported as duplicate", pn)
+		}
+	}
+	if space.received(4) {
+		t.Error("Packet 4 should be a duplicate")
+	}
+	want := []quicAckRange{{9, 9}, {3, 5}, {0, 1}}
+	if len(space.recvRanges) != len(want) {
+		t.Fatalf("Expected ranges %v, got %v", want, space.recvRanges)
+	}
+	frames, err := parseQUICFrames(quicAppendAck(nil, space.recvRanges))
+	if err != nil || len(frames) != 1 {
+		t.Fatalf("Failed to parse ACK: %v", err)
+	}
+	for i, r := range frames[0].ackRanges {
+		if r != want[i] || space.recvRanges[i] != want[i] {
+			t.Errorf("Range %d: expected %v, got %v and %v", i, want[i], r, space.recvRanges[i])
+		}
+	}
+
+	params := &quicTransportParams{initialSCID: []byte{1, 2, 3}, maxIdleTimeout: 30000, initialMaxData: 1 << 20}
+	decoded, err := parseQUICTransportParams(params.marshal())
+	if err != nil || !bytes.Equal(decoded.initialSCID, params.initialSCID) ||
+		decoded.maxIdleTimeout != 30000 || decoded.initialMaxData != 1<<20 {
+		t.Errorf("Transport parameters round trip gave %+v, %v", decoded, err)
+	}
+}
+
+// quicTestClient is just enough of a QUIC client to complete a handshake
+// and fetch over hq-interop. It expects loopback to deliver in order.
+type quicTestClient struct {
+	t       *testing.T
+	conn    *net.UDPConn
+	tls     *tls.QUICConn
+	dcid    []byte
+	scid    []byte
+	spaces  [quicSpaceCount]*quicSpace
+	done    bool // HANDSHAKE_DONE received
+	streams map[uint64][]byte
+	fin     map[uint64]bool
+	next    uint64
+}
+
+func dialQUICTest(t *testing.T, server *UltraFastHTTPServer, roots *x509.CertPool) *quicTestClient {
+	t.Helper()
+	addr := server.socket.GetLocalAddr()
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP(addr.IP), Port: int(addr.Port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &quicTestClient{
+		t:       t,
+		conn:    conn,
+		dcid:    binary.BigEndian.AppendUint64(nil, randomUint64()),
+		scid:    binary.BigEndian.AppendUint64(nil, randomUint64()),
+		streams: make(map[uint64][]byte),
+		fin:     make(map[uint64]bool),
+	}
+	for i := range c.spaces {
+		c.spaces[i] = &quicSpace{sent: make(map[uint64]*quicSentPacket)}
+	}
+	clientKeys, serverKeys := quicInitialKeys(c.dcid)
+	c.spaces[quicSpaceInitial].write, c.spaces[quicSpaceInitial].read = clientKeys, serverKeys
+
+	c.tls = tls.QUICClient(&tls.QUICConfig{TLSConfig: &tls.Config{
+		ServerName: "localhost",
+		RootCAs:    roots,
+		NextProtos: []string{quicALPN},
+		MinVersion: tls.VersionTLS13,
+	}})
+	params := &quicTransportParams{
+		initialSCID:          c.scid,
+		maxIdleTimeout:       10000,
+		initialMaxData:       1 << 20,
+		maxStreamDataBidiLoc: 1 << 20,
+	}
+	c.tls.SetTransportParameters(params.marshal())
+	if err := c.tls.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.events()
+	c.run(func() bool { return c.done })
+	return c
+}
+
+// events queues handshake data and installs keys
+func (c *quicTestClient) events() {
+	levels := map[tls.QUICEncryptionLevel]int{
+		tls.QUICEncryptionLevelInitial:     quicSpaceInitial,
+		tls.QUICEncryptionLevelHandshake:   quicSpaceHandshake,
+		tls.QUICEncryptionLevelApplication: quicSpaceApplication,
+	}
+	for {
+		e := c.tls.NextEvent()
+		switch e.Kind {
+		case tls.QUICNoEvent:
+			return
+		case tls.QUICSetReadSecret, tls.QUICSetWriteSecret:
+			keys, err := newQUICKeys(e.Suite, e.Data)
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			if e.Kind == tls.QUICSetReadSecret {
+				c.spaces[levels[e.Level]].read = keys
+			} else {
+				c.spaces[levels[e.Level]].write = keys
+			}
+		case tls.QUICWriteData:
+			c.spaces[levels[e.Level]].queueCrypto(e.Data)
+		}
+	}
+}
+
+// run sends what is queued and handles replies until done reports true
+func (c *quicTestClient) run(done func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	buffer := make([]byte, 2048)
+	for {
+		c.flush()
+		if done() {
+			return
+		}
+		c.conn.SetReadDeadline(deadline)
+		n, err := c.conn.Read(buffer)
+		if err != nil {
+			c.t.Fatalf("QUIC exchange failed: %v", err)
+		}
+		c.receive(buffer[:n])
+	}
+}
+
+func (c *quicTestClient) flush() {
+	for level, space := range c.spaces {
+		for space.write != nil && (space.ackPending || len(space.frames) > 0) {
+			var payload []byte
+			if space.ackPending {
+				payload = quicAppendAck(payload, space.recvRanges)
+				space.ackPending = false
+			}
+			for len(space.frames) > 0 && len(payload)+len(space.frames[0]) < 1100 {
+				payload = append(payload, space.frames[0]...)
+				space.frames = space.frames[1:]
+			}
+
+			pn := space.nextPN
+			space.nextPN++
+			var packet []byte
+			switch level {
+			case quicSpaceApplication:
+				packet = space.write.seal(quicShortHeader(c.dcid, pn), 4, pn, payload)
+			case quicSpaceInitial:
+				header := quicLongHeader(quicPacketInitial, c.dcid, c.scid, nil, pn, len(payload))
+				payload = append(payload, make([]byte, quicMinInitialDatagramSize-len(header)-len(payload)-16)...)
+				packet = space.write.seal(quicLongHeader(quicPacketInitial, c.dcid, c.scid, nil, pn, len(payload)), 4, pn, payload)
+			default:
+				packet = space.write.seal(quicLongHeader(quicPacketHandshake, c.dcid, c.scid, nil, pn, len(payload)), 4, pn, payload)
+			}
+			if _, err := c.conn.Write(packet); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+	}
+}
+
+func (c *quicTestClient) receive(datagram []byte) {
+	for data := datagram; len(data) > 0; {
+		header, err := parseQUICHeader(data)
+		if err != nil {
+			c.t.Fatalf("Bad packet from server: %v", err)
+		}
+		packet := data[:header.end]
+		data = data[header.end:]
+
+		level := quicSpaceApplication
+		if header.long {
+			level = quicSpaceInitial
+			if header.packetType == quicPacketHandshake {
+				level = quicSpaceHandshake
+			}
+			c.dcid = append([]byte(nil), header.scid...)
+		}
+		space := c.spaces[level]
+		pn, payload, err := space.read.open(packet, header.pnOffset, space.largestRecv)
+		if err != nil {
+			c.t.Fatalf("Failed to open packet at level %d: %v", level, err)
+		}
+		space.received(pn)
+		space.largestRecv = max(space.largestRecv, pn)
+		frames, err := parseQUICFrames(payload)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		for _, f := range frames {
+			space.ackPending = space.ackPending || f.ackEliciting()
+			switch f.frameType {
+			case quicFrameCrypto:
+				if f.offset != space.cryptoRecvOffset {
+					c.t.Fatalf("CRYPTO data out of order")
+				}
+				space.cryptoRecvOffset += uint64(len(f.data))
+				tlsLevel := []tls.QUICEncryptionLevel{tls.QUICEncryptionLevelInitial,
+					tls.QUICEncryptionLevelHandshake, tls.QUICEncryptionLevelApplication}[level]
+				if err := c.tls.HandleData(tlsLevel, f.data); err != nil {
+					c.t.Fatalf("TLS handshake failed: %v", err)
+				}
+				c.events()
+			case quicFrameStream:
+				if f.offset != uint64(len(c.streams[f.stream])) {
+					c.t.Fatalf("STREAM data out of order")
+				}
+				c.streams[f.stream] = append(c.streams[f.stream], f.data...)
+				c.fin[f.stream] = c.fin[f.stream] || f.fin
+			case quicFrameHandshakeDone:
+				c.done = true
+			case quicFrameConnectionClose:
+				c.t.Fatalf("Server closed the connection: 0x%x %s", f.value, f.reason)
+			}
+		}
+	}
+}
+
+// get fetches a path on a new stream
+func (c *quicTestClient) get(path string) string {
+	id := c.next
+	c.next += 4
+	c.spaces[quicSpaceApplication].frames = append(c.spaces[quicSpaceApplication].frames,
+		quicAppendStream(nil, id, 0, []byte("GET "+path+"\r\n"), true))
+	c.run(func() bool { return c.fin[id] })
+	return string(c.streams[id])
+}
+
+func TestQUICCryptoBuffer(t *testing.T) {
+	space := &quicSpace{cryptoRecv: make(map[uint64][]byte)}
+	data := bytes.Repeat([]byte{'x'}, 1000)
+
+	// Overlapping ranges are trimmed to what is not yet held
+	for _, r := range []struct{ offset, end uint64 }{
+		{100, 200}, {150, 250}, {100, 200}, {120, 180}, {50, 300},
+	} {
+		if err := space.bufferCrypto(r.offset, data[:r.end-r.offset]); err != nil {
+			t.Fatalf("Range %d-%d refused: %v", r.offset, r.end, err)
+		}
+	}
+	if space.cryptoRecvBytes != 250 {
+		t.Errorf("Expected 250 bytes held for 50-300, got %d", space.cryptoRecvBytes)
+	}
+	var held int
+	for _, b := range space.cryptoRecv {
+		held += len(b)
+	}
+	if held != space.cryptoRecvBytes {
+		t.Errorf("Held %d bytes, counted %d", held, space.cryptoRecvBytes)
+	}
+
+	// Resending the same ranges holds nothing more, and the window caps
+	// what is held however it is split
+	for i := 0; i < 3; i++ {
+		for offset := uint64(1000); offset+1000 <= quicMaxCryptoBuffer; offset += 1000 {
+			if err := space.bufferCrypto(offset, data); err != nil {
+				t.Fatalf("Offset %d refused: %v", offset, err)
+			}
+		}
+	}
+	if space.cryptoRecvBytes > quicMaxCryptoBuffer {
+		t.Errorf("Expected at most %d bytes held, got %d", quicMaxCryptoBuffer, space.cryptoRecvBytes)
+	}
+	if err := space.bufferCrypto(quicMaxCryptoBuffer, data[:1]); err == nil {
+		t.Error("Expected data past the window refused")
+	}
+}
+
+func TestServerQUIC(t *testing.T) {
+	server := startTestServer(t)
+	cert, roots := newTestCertificate(t)
+	if err := server.EnableQUIC(&tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+		t.Fatalf("EnableQUIC failed: %v", err)
+	}
+	large := strings.Repeat("0123456789", 500)
+	server.HandleFunc("/hello", func(ctx context.Context, r *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Body: []byte("hello over " + r.Header("Host"))}
+	})
+	server.HandleFunc("/large", func(ctx context.Context, r *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Body: []byte(large)}
+	})
+
+	client := dialQUICTest(t, server, roots)
+	if state := client.tls.ConnectionState(); state.NegotiatedProtocol != quicALPN {
+		t.Errorf("Expected ALPN %q, got %q", quicALPN, state.NegotiatedProtocol)
+	}
+	if body := client.get("/hello"); body != "hello over localhost" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	if body := client.get("/large"); body != large {
+		t.Errorf("Large body mismatch: got %d bytes", len(body))
+	}
+
+	// The server's own protocol still works on the same socket
+	if response, err := newTestClient(t, server).Get("/hello"); err != nil ||
+		!strings.Contains(string(response), "hello over") {
+		t.Errorf("Plain request failed alongside QUIC: %q, %v", response, err)
+	}
+}
+
+func TestServerQUICVersionNegotiation(t *testing.T) {
+	server := startTestServer(t)
+	cert, _ := newTestCertificate(t)
+	if err := server.EnableQUIC(&tls.Config{Certificates: []tls.Certificate{cert}}); err != nil {
+		t.Fatal(err)
+	}
+	addr := server.socket.GetLocalAddr()
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.ParseIP(addr.IP), Port: int(addr.Port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	probe := []byte{0xc0, 0x1a, 0x2a, 0x3a, 0x4a, 4, 1, 2, 3, 4, 2, 5, 6}
+	probe = append(probe, make([]byte, quicMinInitialDatagramSize-len(probe))...)
+	conn.Write(probe)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply := make([]byte, 64)
+	n, err := conn.Read(reply)
+	if err != nil {
+		t.Fatalf("Expected Version Negotiation: %v", err)
+	}
+	want := []byte{0, 0, 0, 0, 2, 5, 6, 4, 1, 2, 3, 4, 0, 0, 0, 1}
+	if n != 1+len(want) || reply[0]&0x80 == 0 || !bytes.Equal(reply[1:n], want) {
+		t.Errorf("Unexpected Version Negotiation packet %x", reply[:n])
+	}
+}
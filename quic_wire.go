@@ -0,0 +1,509 @@
+package ultrafast
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// QUIC v1 wire format (RFC 9000): variable-length integers, long and
+// short packet headers, and frames
+
+// quicVersion1 is the only QUIC version spoken
+const quicVersion1 = 0x00000001
+
+// Long header packet types
+const (
+	quicPacketInitial   = 0x0
+	quicPacket0RTT      = 0x1
+	quicPacketHandshake = 0x2
+	quicPacketRetry     = 0x3
+)
+
+// Frame types
+const (
+	quicFramePadding            = 0x00
+	quicFramePing               = 0x01
+	quicFrameAck                = 0x02
+	quicFrameAckECN             = 0x03
+	quicFrameResetStream        = 0x04
+	quicFrameStopSending        = 0x05
+	quicFrameCrypto             = 0x06
+	quicFrameNewToken           = 0x07
+	quicFrameStream             = 0x08 // through 0x0f, with OFF, LEN and FIN bits
+	quicFrameMaxData            = 0x10
+	quicFrameMaxStreamData      = 0x11
+	quicFrameMaxStreamsBidi     = 0x12
+	quicFrameMaxStreamsUni      = 0x13
+	quicFrameDataBlocked        = 0x14
+	quicFrameStreamDataBlocked  = 0x15
+	quicFrameStreamsBlockedBidi = 0x16
+	quicFrameStreamsBlockedUni  = 0x17
+	quicFrameNewConnectionID    = 0x18
+	quicFrameRetireConnectionID = 0x19
+	quicFramePathChallenge      = 0x1a
+	quicFramePathResponse       = 0x1b
+	quicFrameConnectionClose    = 0x1c
+	quicFrameApplicationClose   = 0x1d
+	quicFrameHandshakeDone      = 0x1e
+)
+
+// STREAM frame type bits
+const (
+	quicStreamFin = 0x01
+	quicStreamLen = 0x02
+	quicStreamOff = 0x04
+)
+
+// Transport error codes
+const (
+	quicNoError                = 0x0
+	quicInternalError          = 0x1
+	quicFlowControlError       = 0x3
+	quicStreamLimitError       = 0x4
+	quicFrameEncodingError     = 0x7
+	quicTransportParamError    = 0x8
+	quicProtocolViolation      = 0xa
+	quicCryptoError            = 0x100 // plus the TLS alert
+	quicMaxVarint              = 1<<62 - 1
+	quicMinInitialDatagramSize = 1200
+)
+
+// quicConnectionIDLength is the length of the connection IDs this server
+// issues, which short headers rely on
+const quicConnectionIDLength = 8
+
+var errQUICTruncated = errors.New("quic: truncated")
+
+// quicAppendVarint appends v as a QUIC variable-length integer
+func quicAppendVarint(dst []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(dst, byte(v))
+	case v < 1<<14:
+		return append(dst, 0x40|byte(v>>8), byte(v))
+	case v < 1<<30:
+		return append(dst, 0x80|byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(dst, 0xc0|byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// quicVarintLen returns the encoded size of v
+func quicVarintLen(v uint64) int {
+	switch {
+	case v < 1<<6:
+		return 1
+	case v < 1<<14:
+		return 2
+	case v < 1<<30:
+		return 4
+	default:
+		return 8
+	}
+}
+
+// quicReadVarint decodes a variable-length integer, returning it and the
+// bytes consumed
+func quicReadVarint(data []byte) (uint64, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errQUICTruncated
+	}
+	n := 1 << (data[0] >> 6)
+	if len(data) < n {
+		return 0, 0, errQUICTruncated
+	}
+	v := uint64(data[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(data[i])
+	}
+	return v, n, nil
+}
+
+// quicReader walks a buffer of QUIC fields
+type quicReader struct {
+	data []byte
+	err  error
+}
+
+func (r *quicReader) varint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n, err := quicReadVarint(r.data)
+	if err != nil {
+		r.err = err
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+func (r *quicReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.data)) < n {
+		r.err = errQUICTruncated
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *quicReader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// quicHeader is the unprotected part of a QUIC packet header
+type quicHeader struct {
+	long       bool
+	packetType uint8 // long header packet type
+	version    uint32
+	dcid       []byte
+	scid       []byte
+	token      []byte
+	pnOffset   int // where the protected packet number starts
+	end        int // end of this packet within the datagram
+}
+
+// parseQUICHeader parses the header of the first packet in a datagram.
+// Short headers carry no length, so the packet runs to the end.
+func parseQUICHeader(data []byte) (*quicHeader, error) {
+	if len(data) < 1 || data[0]&0x40 == 0 && data[0]&0x80 == 0 {
+		return nil, fmt.Errorf("quic: not a QUIC packet")
+	}
+	h := &quicHeader{}
+	if data[0]&0x80 == 0 {
+		if len(data) < 1+quicConnectionIDLength {
+			return nil, errQUICTruncated
+		}
+		h.dcid = data[1 : 1+quicConnectionIDLength]
+		h.pnOffset = 1 + quicConnectionIDLength
+		h.end = len(data)
+		return h, nil
+	}
+
+	h.long = true
+	h.packetType = (data[0] >> 4) & 0x3
+	r := quicReader{data: data[1:]}
+	version := r.bytes(4)
+	dcid := r.bytes(uint64(r.byte()))
+	scid := r.bytes(uint64(r.byte()))
+	if r.err != nil {
+		return nil, r.err
+	}
+	h.version = binary.BigEndian.Uint32(version)
+	h.dcid, h.scid = dcid, scid
+	if h.version != quicVersion1 {
+		h.end = len(data)
+		return h, nil // version negotiation needed; the rest is opaque
+	}
+	if len(h.dcid) > 20 || len(h.scid) > 20 {
+		return nil, fmt.Errorf("quic: connection ID too long")
+	}
+
+	switch h.packetType {
+	case quicPacketRetry:
+		return nil, fmt.Errorf("quic: unexpected Retry packet")
+	case quicPacketInitial:
+		h.token = r.bytes(r.varint())
+	}
+	length := r.varint()
+	if r.err != nil {
+		return nil, r.err
+	}
+	h.pnOffset = len(data) - len(r.data)
+	if uint64(len(r.data)) < length {
+		return nil, errQUICTruncated
+	}
+	h.end = h.pnOffset + int(length)
+	return h, nil
+}
+
+// quicAckRange is an inclusive range of acknowledged packet numbers
+type quicAckRange struct {
+	smallest, largest uint64
+}
+
+// quicFrame is one decoded frame; only the fields of its type are set
+type quicFrame struct {
+	frameType uint64
+	stream    uint64 // STREAM, RESET_STREAM, STOP_SENDING, MAX_STREAM_DATA
+	offset    uint64 // CRYPTO, STREAM
+	data      []byte // CRYPTO, STREAM, PATH_CHALLENGE
+	fin       bool   // STREAM
+	value     uint64 // MAX_DATA, MAX_STREAM_DATA, MAX_STREAMS, error code of CONNECTION_CLOSE
+	reason    string // CONNECTION_CLOSE
+	ackRanges []quicAckRange
+}
+
+// ackEliciting reports whether a frame obliges the peer to acknowledge it
+func (f *quicFrame) ackEliciting() bool {
+	switch f.frameType {
+	case quicFramePadding, quicFrameAck, quicFrameAckECN,
+		quicFrameConnectionClose, quicFrameApplicationClose:
+		return false
+	}
+	return true
+}
+
+// parseQUICFrames decodes the frames of a packet payload
+func parseQUICFrames(payload []byte) ([]quicFrame, error) {
+	var frames []quicFrame
+	r := quicReader{data: payload}
+	for len(r.data) > 0 && r.err == nil {
+		f := quicFrame{frameType: r.varint()}
+		switch t := f.frameType; {
+		case t == quicFramePadding:
+			continue // runs of padding are common; don't keep them
+		case t == quicFramePing, t == quicFrameHandshakeDone:
+		case t == quicFrameAck || t == quicFrameAckECN:
+			largest := r.varint()
+			r.varint() // ack delay
+			count := r.varint()
+			first := r.varint()
+			if first > largest {
+				return nil, fmt.Errorf("quic: invalid ACK range")
+			}
+			f.ackRanges = append(f.ackRanges, quicAckRange{largest - first, largest})
+			smallest := largest - first
+			for i := uint64(0); i < count && r.err == nil; i++ {
+				gap, length := r.varint(), r.varint()
+				if smallest < gap+2 || smallest-gap-2 < length {
+					return nil, fmt.Errorf("quic: invalid ACK range")
+				}
+				largest = smallest - gap - 2
+				smallest = largest - length
+				f.ackRanges = append(f.ackRanges, quicAckRange{smallest, largest})
+			}
+			if t == quicFrameAckECN {
+				r.varint()
+				r.varint()
+				r.varint()
+			}
+		case t == quicFrameResetStream:
+			f.stream, f.value = r.varint(), r.varint()
+			r.varint() // final size
+		case t == quicFrameStopSending:
+			f.stream, f.value = r.varint(), r.varint()
+		case t == quicFrameCrypto:
+			f.offset = r.varint()
+			f.data = r.bytes(r.varint())
+		case t == quicFrameNewToken:
+			r.bytes(r.varint())
+		case t >= quicFrameStream && t <= quicFrameStream|0x07:
+			f.stream = r.varint()
+			if t&quicStreamOff != 0 {
+				f.offset = r.varint()
+			}
+			if t&quicStreamLen != 0 {
+				f.data = r.bytes(r.varint())
+			} else {
+				f.data = r.bytes(uint64(len(r.data)))
+			}
+			f.fin = t&quicStreamFin != 0
+			f.frameType = quicFrameStream
+		case t == quicFrameMaxData, t == quicFrameMaxStreamsBidi, t == quicFrameMaxStreamsUni,
+			t == quicFrameDataBlocked, t == quicFrameStreamsBlockedBidi, t == quicFrameStreamsBlockedUni,
+			t == quicFrameRetireConnectionID:
+			f.value = r.varint()
+		case t == quicFrameMaxStreamData, t == quicFrameStreamDataBlocked:
+			f.stream, f.value = r.varint(), r.varint()
+		case t == quicFrameNewConnectionID:
+			r.varint() // sequence number
+			r.varint() // retire prior to
+			r.bytes(uint64(r.byte()))
+			r.bytes(16) // stateless reset token
+		case t == quicFramePathChallenge, t == quicFramePathResponse:
+			f.data = r.bytes(8)
+		case t == quicFrameConnectionClose:
+			f.value = r.varint()
+			r.varint() // offending frame type
+			f.reason = string(r.bytes(r.varint()))
+		case t == quicFrameApplicationClose:
+			f.value = r.varint()
+			f.reason = string(r.bytes(r.varint()))
+		default:
+			return nil, fmt.Errorf("quic: unknown frame type 0x%x", t)
+		}
+		if r.err == nil {
+			frames = append(frames, f)
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("quic: malformed frame: %v", r.err)
+	}
+	return frames, nil
+}
+
+// quicAppendAck appends an ACK frame for ranges, which must be sorted from
+// the highest packet numbers down and not overlap
+func quicAppendAck(dst []byte, ranges []quicAckRange) []byte {
+	dst = quicAppendVarint(dst, quicFrameAck)
+	dst = quicAppendVarint(dst, ranges[0].largest)
+	dst = quicAppendVarint(dst, 0) // ack delay
+	dst = quicAppendVarint(dst, uint64(len(ranges)-1))
+	dst = quicAppendVarint(dst, ranges[0].largest-ranges[0].smallest)
+	for i := 1; i < len(ranges); i++ {
+		gap := ranges[i-1].smallest - ranges[i].largest - 2
+		dst = quicAppendVarint(dst, gap)
+		dst = quicAppendVarint(dst, ranges[i].largest-ranges[i].smallest)
+	}
+	return dst
+}
+
+// quicAppendCrypto appends a CRYPTO frame
+func quicAppendCrypto(dst []byte, offset uint64, data []byte) []byte {
+	dst = quicAppendVarint(dst, quicFrameCrypto)
+	dst = quicAppendVarint(dst, offset)
+	dst = quicAppendVarint(dst, uint64(len(data)))
+	return append(dst, data...)
+}
+
+// quicAppendStream appends a STREAM frame with explicit offset and length
+func quicAppendStream(dst []byte, stream, offset uint64, data []byte, fin bool) []byte {
+	frameType := uint64(quicFrameStream | quicStreamOff | quicStreamLen)
+	if fin {
+		frameType |= quicStreamFin
+	}
+	dst = quicAppendVarint(dst, frameType)
+	dst = quicAppendVarint(dst, stream)
+	dst = quicAppendVarint(dst, offset)
+	dst = quicAppendVarint(dst, uint64(len(data)))
+	return append(dst, data...)
+}
+
+// quicAppendConnectionClose appends a transport CONNECTION_CLOSE frame
+func quicAppendConnectionClose(dst []byte, code uint64, reason string) []byte {
+	dst = quicAppendVarint(dst, quicFrameConnectionClose)
+	dst = quicAppendVarint(dst, code)
+	dst = quicAppendVarint(dst, 0) // frame type
+	dst = quicAppendVarint(dst, uint64(len(reason)))
+	return append(dst, reason...)
+}
+
+// Transport parameter IDs (RFC 9000 section 18.2)
+const (
+	quicParamOriginalDCID         = 0x00
+	quicParamMaxIdleTimeout       = 0x01
+	quicParamMaxUDPPayloadSize    = 0x03
+	quicParamInitialMaxData       = 0x04
+	quicParamMaxStreamDataBidiLoc = 0x05
+	quicParamMaxStreamDataBidiRem = 0x06
+	quicParamMaxStreamDataUni     = 0x07
+	quicParamMaxStreamsBidi       = 0x08
+	quicParamMaxStreamsUni        = 0x09
+	quicParamInitialSCID          = 0x0f
+)
+
+// quicTransportParams holds the parameters this server acts on
+type quicTransportParams struct {
+	originalDCID         []byte
+	initialSCID          []byte
+	maxIdleTimeout       uint64 // milliseconds
+	initialMaxData       uint64
+	maxStreamDataBidiLoc uint64
+	maxStreamDataBidiRem uint64
+	maxStreamDataUni     uint64
+	maxStreamsBidi       uint64
+	maxStreamsUni        uint64
+}
+
+// appendQUICParam appends one integer transport parameter
+func appendQUICParam(dst []byte, id, value uint64) []byte {
+	dst = quicAppendVarint(dst, id)
+	dst = quicAppendVarint(dst, uint64(quicVarintLen(value)))
+	return quicAppendVarint(dst, value)
+}
+
+// marshal encodes the parameters for the TLS extension
+func (p *quicTransportParams) marshal() []byte {
+	var b []byte
+	if p.originalDCID != nil {
+		b = quicAppendVarint(b, quicParamOriginalDCID)
+		b = quicAppendVarint(b, uint64(len(p.originalDCID)))
+		b = append(b, p.originalDCID...)
+	}
+	b = quicAppendVarint(b, quicParamInitialSCID)
+	b = quicAppendVarint(b, uint64(len(p.initialSCID)))
+	b = append(b, p.initialSCID...)
+	b = appendQUICParam(b, quicParamMaxIdleTimeout, p.maxIdleTimeout)
+	b = appendQUICParam(b, quicParamInitialMaxData, p.initialMaxData)
+	b = appendQUICParam(b, quicParamMaxStreamDataBidiLoc, p.maxStreamDataBidiLoc)
+	b = appendQUICParam(b, quicParamMaxStreamDataBidiRem, p.maxStreamDataBidiRem)
+	b = appendQUICParam(b, quicParamMaxStreamDataUni, p.maxStreamDataUni)
+	b = appendQUICParam(b, quicParamMaxStreamsBidi, p.maxStreamsBidi)
+	b = appendQUICParam(b, quicParamMaxStreamsUni, p.maxStreamsUni)
+	return b
+}
+
+// parseQUICTransportParams decodes the peer's parameters, skipping those
+// this server does not use
+func parseQUICTransportParams(data []byte) (*quicTransportParams, error) {
+	p := &quicTransportParams{}
+	r := quicReader{data: data}
+	for len(r.data) > 0 && r.err == nil {
+		id := r.varint()
+		value := r.bytes(r.varint())
+		if r.err != nil {
+			break
+		}
+		var n uint64
+		switch id {
+		case quicParamOriginalDCID:
+			p.originalDCID = value
+			continue
+		case quicParamInitialSCID:
+			p.initialSCID = value
+			continue
+		case quicParamMaxIdleTimeout, quicParamInitialMaxData, quicParamMaxStreamDataBidiLoc,
+			quicParamMaxStreamDataBidiRem, quicParamMaxStreamDataUni, quicParamMaxStreamsBidi,
+			quicParamMaxStreamsUni:
+			v, size, err := quicReadVarint(value)
+			if err != nil || size != len(value) {
+				return nil, fmt.Errorf("quic: malformed transport parameter 0x%x", id)
+			}
+			n = v
+		default:
+			continue
+		}
+		switch id {
+		case quicParamMaxIdleTimeout:
+			p.maxIdleTimeout = n
+		case quicParamInitialMaxData:
+			p.initialMaxData = n
+		case quicParamMaxStreamDataBidiLoc:
+			p.maxStreamDataBidiLoc = n
+		case quicParamMaxStreamDataBidiRem:
+			p.maxStreamDataBidiRem = n
+		case quicParamMaxStreamDataUni:
+			p.maxStreamDataUni = n
+		case quicParamMaxStreamsBidi:
+			p.maxStreamsBidi = n
+		case quicParamMaxStreamsUni:
+			p.maxStreamsUni = n
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("quic: malformed transport parameters: %v", r.err)
+	}
+	return p, nil
+}
+
+// quicVersionNegotiation builds a Version Negotiation packet answering a
+// long header packet of an unsupported version
+func quicVersionNegotiation(h *quicHeader) []byte {
+	b := []byte{0x80 | byte(randomUint64()&0x7f), 0, 0, 0, 0}
+	b = append(b, byte(len(h.scid)))
+	b = append(b, h.scid...)
+	b = append(b, byte(len(h.dcid)))
+	b = append(b, h.dcid...)
+	return binary.BigEndian.AppendUint32(b, quicVersion1)
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package ultrafast
+
+// raceEnabled reports whether the race detector is on; it adds
+// allocations of its own, so allocation counts are not checked
+const raceEnabled = true
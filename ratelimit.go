@@ -0,0 +1,206 @@
+package ultrafast
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimitAction selects what happens to traffic over the limit
+type RateLimitAction int
+
+const (
+	RATE_LIMIT_DROP RateLimitAction = iota // Silently discard excess packets
+	RATE_LIMIT_RST                         // Discard and answer with a RST packet
+)
+
+// RateLimitConfig configures per-source token buckets. A zero rate
+// disables that dimension of the limit.
+type RateLimitConfig struct {
+	PacketsPerSecond float64
+	PacketBurst      float64
+	BytesPerSecond   float64
+	ByteBurst        float64
+	Action           RateLimitAction
+	MaxSources       int // sources tracked at once, default defaultRateLimitSources
+}
+
+// rateLimitIdleTimeout is how long an idle source keeps its bucket
+const rateLimitIdleTimeout = 60 * time.Second
+
+// defaultRateLimitSources bounds the sources tracked at once, so a flood
+// from spoofed addresses cannot grow the table without limit
+const defaultRateLimitSources = 65536
+
+// tokenBucket holds the remaining packet and byte allowance for one source
+type tokenBucket struct {
+	ip       string
+	packets  float64
+	bytes    float64
+	lastFill time.Time
+}
+
+// RateLimiter applies token-bucket limits keyed by source IP. At most
+// MaxSources buckets are kept; a new source at the cap takes the bucket
+// of the one heard from least recently, which starts afresh if it comes
+// back.
+type RateLimiter struct {
+	mu        sync.Mutex
+	config    RateLimitConfig
+	lru       *list.List // of *tokenBucket, front is most recently used
+	buckets   map[string]*list.Element
+	lastPrune time.Time
+	dropped   uint64 // atomic
+	evicted   uint64 // atomic
+}
+
+// NewRateLimiter creates a rate limiter with the given configuration
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		config:    normalizeRateLimitConfig(config),
+		lru:       list.New(),
+		buckets:   make(map[string]*list.Element),
+		lastPrune: time.Now(),
+	}
+}
+
+// normalizeRateLimitConfig defaults each burst to one second of its rate
+// and the source cap to defaultRateLimitSources
+func normalizeRateLimitConfig(config RateLimitConfig) RateLimitConfig {
+	if config.PacketBurst <= 0 {
+		config.PacketBurst = config.PacketsPerSecond
+	}
+	if config.ByteBurst <= 0 {
+		config.ByteBurst = config.BytesPerSecond
+	}
+	if config.MaxSources <= 0 {
+		config.MaxSources = defaultRateLimitSources
+	}
+	return config
+}
+
+// SetConfig replaces the limits at runtime; existing buckets are clamped,
+// and the least recent dropped if the source cap shrank
+func (rl *RateLimiter) SetConfig(config RateLimitConfig) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.config = normalizeRateLimitConfig(config)
+	for element := rl.lru.Front(); element != nil; element = element.Next() {
+		bucket := element.Value.(*tokenBucket)
+		if bucket.packets > rl.config.PacketBurst {
+			bucket.packets = rl.config.PacketBurst
+		}
+		if bucket.bytes > rl.config.ByteBurst {
+			bucket.bytes = rl.config.ByteBurst
+		}
+	}
+	for rl.lru.Len() > rl.config.MaxSources {
+		rl.removeElement(rl.lru.Back())
+		atomic.AddUint64(&rl.evicted, 1)
+	}
+}
+
+// Config returns the active limits
+func (rl *RateLimiter) Config() RateLimitConfig {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.config
+}
+
+// Allow reports whether a packet of size bytes from ip is within its limits
+func (rl *RateLimiter) Allow(ip string, size int, now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastPrune) > rateLimitIdleTimeout {
+		rl.pruneIdle(now)
+	}
+
+	bucket := rl.bucket(ip, now)
+
+	// Refill both buckets for the time elapsed since the last packet
+	elapsed := now.Sub(bucket.lastFill).Seconds()
+	if elapsed > 0 {
+		bucket.packets += elapsed * rl.config.PacketsPerSecond
+		if bucket.packets > rl.config.PacketBurst {
+			bucket.packets = rl.config.PacketBurst
+		}
+		bucket.bytes += elapsed * rl.config.BytesPerSecond
+		if bucket.bytes > rl.config.ByteBurst {
+			bucket.bytes = rl.config.ByteBurst
+		}
+		bucket.lastFill = now
+	}
+
+	packetLimited := rl.config.PacketsPerSecond > 0 && bucket.packets < 1
+	byteLimited := rl.config.BytesPerSecond > 0 && bucket.bytes < float64(size)
+	if packetLimited || byteLimited {
+		atomic.AddUint64(&rl.dropped, 1)
+		return false
+	}
+
+	bucket.packets--
+	bucket.bytes -= float64(size)
+	return true
+}
+
+// bucket returns the bucket of ip, marked most recently used, creating a
+// full one if ip has none; caller must hold rl.mu
+func (rl *RateLimiter) bucket(ip string, now time.Time) *tokenBucket {
+	if element, exists := rl.buckets[ip]; exists {
+		rl.lru.MoveToFront(element)
+		return element.Value.(*tokenBucket)
+	}
+
+	if rl.lru.Len() >= rl.config.MaxSources {
+		rl.removeElement(rl.lru.Back())
+		atomic.AddUint64(&rl.evicted, 1)
+	}
+	bucket := &tokenBucket{
+		ip:       ip,
+		packets:  rl.config.PacketBurst,
+		bytes:    rl.config.ByteBurst,
+		lastFill: now,
+	}
+	rl.buckets[ip] = rl.lru.PushFront(bucket)
+	return bucket
+}
+
+// removeElement forgets a source; caller must hold rl.mu
+func (rl *RateLimiter) removeElement(element *list.Element) {
+	rl.lru.Remove(element)
+	delete(rl.buckets, element.Value.(*tokenBucket).ip)
+}
+
+// pruneIdle forgets sources that have been quiet long enough to have
+// refilled completely. The idlest are at the back, so it stops at the
+// first source heard from since; caller must hold rl.mu.
+func (rl *RateLimiter) pruneIdle(now time.Time) {
+	for element := rl.lru.Back(); element != nil; element = rl.lru.Back() {
+		if now.Sub(element.Value.(*tokenBucket).lastFill) <= rateLimitIdleTimeout {
+			break
+		}
+		rl.removeElement(element)
+	}
+	rl.lastPrune = now
+}
+
+// Dropped returns the number of packets rejected by the limiter
+func (rl *RateLimiter) Dropped() uint64 {
+	return atomic.LoadUint64(&rl.dropped)
+}
+
+// Evicted returns the number of sources forgotten to make room for new
+// ones at the source cap
+func (rl *RateLimiter) Evicted() uint64 {
+	return atomic.LoadUint64(&rl.evicted)
+}
+
+// TrackedSources returns the number of sources with a live bucket
+func (rl *RateLimiter) TrackedSources() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.lru.Len()
+}
@@ -0,0 +1,93 @@
+package ultrafast
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterPackets(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{PacketsPerSecond: 10, PacketBurst: 3})
+	now := time.Now()
+
+	// The burst is available immediately
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("10.0.0.1", 100, now) {
+			t.Errorf("Packet %d should be within the burst", i)
+		}
+	}
+	if limiter.Allow("10.0.0.1", 100, now) {
+		t.Error("Packet beyond the burst should be limited")
+	}
+
+	// Other sources have their own bucket
+	if !limiter.Allow("10.0.0.2", 100, now) {
+		t.Error("A different source should not be limited")
+	}
+
+	// 100ms at 10 pps refills one token
+	if !limiter.Allow("10.0.0.1", 100, now.Add(100*time.Millisecond)) {
+		t.Error("Bucket should refill over time")
+	}
+
+	if limiter.Dropped() != 1 {
+		t.Errorf("Expected 1 dropped packet, got %d", limiter.Dropped())
+	}
+}
+
+func TestRateLimiterBytes(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{BytesPerSecond: 1000})
+	now := time.Now()
+
+	if !limiter.Allow("10.0.0.1", 800, now) {
+		t.Error("First packet should fit in the byte burst")
+	}
+	if limiter.Allow("10.0.0.1", 800, now) {
+		t.Error("Second packet should exceed the byte budget")
+	}
+	if !limiter.Allow("10.0.0.1", 800, now.Add(time.Second)) {
+		t.Error("Byte budget should refill after a second")
+	}
+}
+
+func TestRateLimiterPrunesIdleSources(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{PacketsPerSecond: 10})
+	now := time.Now()
+
+	limiter.Allow("10.0.0.1", 1, now)
+	limiter.Allow("10.0.0.2", 1, now.Add(2*rateLimitIdleTimeout))
+
+	if limiter.TrackedSources() != 1 {
+		t.Errorf("Expected idle source to be pruned, tracking %d", limiter.TrackedSources())
+	}
+}
+
+func TestRateLimiterBoundsSources(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitConfig{PacketsPerSecond: 10, PacketBurst: 1, MaxSources: 100})
+	now := time.Now()
+
+	// A source over its limit stays tracked while a flood of others passes,
+	// since it keeps being heard from
+	limiter.Allow("10.0.0.1", 1, now)
+	for i := 0; i < 10000; i++ {
+		source := fmt.Sprintf("192.0.%d.%d", i/256, i%256)
+		if !limiter.Allow(source, 1, now) {
+			t.Fatalf("New source %s should get a full bucket", source)
+		}
+		if i%50 == 0 && limiter.Allow("10.0.0.1", 1, now) {
+			t.Fatal("A limited source should stay limited")
+		}
+		if tracked := limiter.TrackedSources(); tracked > 100 {
+			t.Fatalf("Tracking %d sources, more than the cap of 100", tracked)
+		}
+	}
+	if evicted := limiter.Evicted(); evicted != 10000+1-100 {
+		t.Errorf("Expected %d sources evicted, got %d", 10000+1-100, evicted)
+	}
+
+	// Shrinking the cap drops the least recent
+	limiter.SetConfig(RateLimitConfig{PacketsPerSecond: 10, PacketBurst: 1, MaxSources: 10})
+	if tracked := limiter.TrackedSources(); tracked != 10 {
+		t.Errorf("Expected 10 sources after shrinking the cap, got %d", tracked)
+	}
+}
@@ -0,0 +1,138 @@
+package ultrafast
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnectionTableEvictsLeastRecentlyActive(t *testing.T) {
+	table := NewConnectionTable()
+	table.SetCapacity(2)
+	var evicted []*Connection
+	table.OnEvict(func(conn *Connection) { evicted = append(evicted, conn) })
+
+	first, _ := table.GetOrCreate(SocketAddr{IP: "10.0.0.1", Port: 1})
+	second, _ := table.GetOrCreate(SocketAddr{IP: "10.0.0.2", Port: 2})
+	atomic.StoreInt64(&second.lastActive, time.Now().Add(-time.Minute).UnixNano())
+	first.RecordIn(10)
+
+	third, created := table.GetOrCreate(SocketAddr{IP: "10.0.0.3", Port: 3})
+	if !created || table.Len() != 2 {
+		t.Fatalf("Expected the new connection within the cap of 2, have %d", table.Len())
+	}
+	if len(evicted) != 1 || evicted[0] != second {
+		t.Fatalf("Expected the idlest connection evicted, got %v", evicted)
+	}
+	if table.Get(SocketAddr{IP: "10.0.0.2", Port: 2}) != nil || second.Context().Err() == nil {
+		t.Error("Evicted connection should be removed and cancelled")
+	}
+	if table.Get(SocketAddr{IP: "10.0.0.1", Port: 1}) != first || table.Get(SocketAddr{IP: "10.0.0.3", Port: 3}) != third {
+		t.Error("Active connections should stay")
+	}
+}
+
+func TestLockFreeReliabilityExpiresPackets(t *testing.T) {
+	rel := NewLockFreeReliabilityLayer()
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, 1, 0, nil))
+
+	for i := 0; i < maxRetransmissions; i++ {
+		atomic.StoreUint64(&rel.timeoutBase, 0)
+		if timedOut := rel.GetTimedOutPackets(); len(timedOut) != 1 {
+			t.Fatalf("Retransmission %d: expected the packet, got %d", i+1, len(timedOut))
+		}
+	}
+
+	atomic.StoreUint64(&rel.timeoutBase, 0)
+	if timedOut := rel.GetTimedOutPackets(); len(timedOut) != 0 {
+		t.Fatalf("Expected no retransmission past the limit, got %d", len(timedOut))
+	}
+	if stats := rel.GetStats(); stats.PacketsExpired != 1 || rel.UnackedCount() != 0 {
+		t.Errorf("Expected the packet expired and untracked, got %+v with %d unacked", stats, rel.UnackedCount())
+	}
+}
+
+func TestLockFreeReliabilityReceiveWindow(t *testing.T) {
+	rel := newConnectionReliabilityLayer(NewEpochDomain(releaseUnackedEntry), NewEpochDomain(releaseQueueNode))
+	for seq := uint32(1); seq <= connectionTableSize; seq++ {
+		if !rel.ReceivePacket(NewPacket(DATA_PACKET, 0, seq, 0, nil)) {
+			t.Fatalf("Packet %d should fit the receive window", seq)
+		}
+	}
+	if rel.ReceivePacket(NewPacket(DATA_PACKET, 0, connectionTableSize+1, 0, nil)) {
+		t.Fatal("A full receive window should drop the packet")
+	}
+	if delivered := rel.GetOrderedPackets(); len(delivered) != connectionTableSize {
+		t.Fatalf("Expected %d packets delivered, got %d", connectionTableSize, len(delivered))
+	}
+	if !rel.ReceivePacket(NewPacket(DATA_PACKET, 0, connectionTableSize+1, 0, nil)) {
+		t.Error("Delivery should open the receive window")
+	}
+}
+
+func TestReliabilityLayerReceiveWindow(t *testing.T) {
+	rel := NewReliabilityLayer()
+	for seq := uint32(1); seq <= 3; seq++ {
+		rel.ReceivePacket(NewPacket(DATA_PACKET, 0, seq, 0, nil))
+	}
+	if delivered := rel.GetOrderedPackets(); len(delivered) != 3 {
+		t.Fatalf("Expected 3 packets delivered, got %d", len(delivered))
+	}
+	if len(rel.receivedSeqs) != 0 {
+		t.Errorf("Delivered sequence numbers should be forgotten, %d remain", len(rel.receivedSeqs))
+	}
+
+	if !rel.IsPacketDuplicate(NewPacket(DATA_PACKET, 0, 2, 0, nil)) {
+		t.Error("A delivered packet should still be detected as a duplicate")
+	}
+	if err := rel.ReceivePacket(NewPacket(DATA_PACKET, 0, 4+uint32(rel.maxBufferSize), 0, nil)); err == nil {
+		t.Error("A packet beyond the receive window should be refused")
+	}
+}
+
+func TestServerEvictsAtConnectionCap(t *testing.T) {
+	server := startTestServer(t)
+	server.SetKeepAlive(KeepAliveConfig{MaxConnections: 1})
+	first := newTestClient(t, server)
+	second := newTestClient(t, server)
+
+	if _, err := first.Get("/benchmark"); err != nil {
+		t.Fatalf("First request failed: %v", err)
+	}
+	if _, err := second.Get("/benchmark"); err != nil {
+		t.Fatalf("Second request failed: %v", err)
+	}
+	if evicted := server.GetStats().ConnectionsEvicted; evicted != 1 || server.connections.Len() != 1 {
+		t.Fatalf("Expected 1 eviction and 1 connection, got %d and %d", evicted, server.connections.Len())
+	}
+
+	// The evicted client's next request is refused; the one after that
+	// reconnects
+	if _, err := first.Get("/benchmark"); err == nil {
+		t.Fatal("Request on the evicted connection should fail")
+	}
+	response, err := first.Get("/benchmark")
+	if err != nil || !strings.Contains(string(response), "200 OK") {
+		t.Fatalf("Evicted client should reconnect, got %q, %v", response, err)
+	}
+	if active := server.GetStats().ConnectionsActive; active != 1 {
+		t.Errorf("Expected 1 active connection, got %d", active)
+	}
+}
+
+func TestServerReapsDeadPeer(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+	if _, err := client.Get("/benchmark"); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	// The layer giving up on a packet marks the peer as gone
+	conn := server.connections.Snapshot()[0]
+	atomic.AddUint64(&conn.reliability.packetsExpired, 1)
+	waitForConnections(t, server, 0)
+	if reaped := server.GetStats().ConnectionsReaped; reaped != 1 {
+		t.Errorf("Expected 1 reaped connection, got %d", reaped)
+	}
+}
@@ -0,0 +1,95 @@
+package ultrafast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// errHandlerPanic ends a streamed response whose handler panicked after
+// the headers went out
+var errHandlerPanic = errors.New("handler panicked")
+
+// ErrorCallback receives errors the server recovers from, such as a
+// panicking handler or a connection aborted past its retransmission
+// budget
+type ErrorCallback func(err error)
+
+// HandlerPanicError describes a handler that panicked. The client was
+// answered 500 Internal Server Error.
+type HandlerPanicError struct {
+	Method    string
+	Path      string
+	Peer      SocketAddr
+	RequestID uint32
+	Value     interface{} // the value passed to panic
+	Stack     []byte      // the panicking goroutine's stack
+}
+
+// Error describes the panic
+func (e *HandlerPanicError) Error() string {
+	return fmt.Sprintf("handler for %s %s panicked: %v", e.Method, e.Path, e.Value)
+}
+
+// OnError registers a callback for errors the server recovers from.
+// Passing nil restores the default, which logs them with their stack.
+func (s *UltraFastHTTPServer) OnError(callback ErrorCallback) {
+	if callback == nil {
+		s.errorCallback.Store(nil)
+		return
+	}
+	s.errorCallback.Store(&callback)
+}
+
+// reportError hands an error to the error callback, or logs it
+func (s *UltraFastHTTPServer) reportError(err error) {
+	if callback := s.errorCallback.Load(); callback != nil {
+		(*callback)(err)
+		return
+	}
+	if panicErr, ok := err.(*HandlerPanicError); ok {
+		logErrorf("%v\n%s", panicErr, panicErr.Stack)
+		return
+	}
+	logErrorf("%v", err)
+}
+
+// callHandler runs a handler, converting a panic into a 500 response so
+// one faulty handler cannot take the server down. The panic and its stack
+// go to the error callback.
+func (h *HTTPSocketHandler) callHandler(ctx context.Context, handler RequestHandler, request *HTTPRequest) (response *HTTPResponse) {
+	defer func() {
+		value := recover()
+		if value == nil {
+			return
+		}
+		atomic.AddUint64(&h.server.stats.HandlerPanics, 1)
+		h.server.reportError(&HandlerPanicError{
+			Method:    request.Method,
+			Path:      request.Path,
+			Peer:      request.Peer,
+			RequestID: request.ID,
+			Value:     value,
+			Stack:     debug.Stack(),
+		})
+
+		// A writer handler may already have streamed part of its response;
+		// the status can no longer change, so the stream is cut off instead
+		if w := request.writer; w != nil {
+			if w.streaming {
+				w.sendErr = errHandlerPanic
+				response = w.Response()
+				return
+			}
+			w.release()
+		}
+		response = &HTTPResponse{
+			StatusCode: 500,
+			Headers:    map[string]string{"Content-Type": "text/plain"},
+			Body:       []byte("Internal Server Error"),
+		}
+	}()
+	return handler(ctx, request)
+}
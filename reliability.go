@@ -1,4 +1,4 @@
-package main
+package ultrafast
 
 import (
 	"fmt"
@@ -15,6 +15,7 @@ type ReliabilityLayer struct {
 	// Unacknowledged packets for retransmission
 	unackedPackets map[uint32]*UnackedPacket
 	unackedMutex   sync.RWMutex
+	sentNext       uint32 // one past the latest sequence number sent, under unackedMutex
 	
 	// Received packets for duplicate detection and ordering
 	receivedSeqs   map[uint32]bool
@@ -23,7 +24,7 @@ type ReliabilityLayer struct {
 	// Packet ordering buffer
 	orderingBuffer map[uint32]*Packet
 	orderingMutex  sync.RWMutex
-	nextExpectedSeq uint32
+	nextExpectedSeq uint32 // the peer's ISN+1 once SetPeerISN is called
 	
 	// Flow control
 	windowSize     uint32
@@ -34,14 +35,14 @@ type ReliabilityLayer struct {
 	ssthresh        uint32 // Slow start threshold
 	congestionMutex sync.RWMutex
 	
-	// RTT measurement
-	rttSamples    []time.Duration
+	// RTT measurement (RFC 6298 SRTT and RTTVAR)
+	rtt           rttEstimator
 	rttMutex      sync.RWMutex
-	averageRTT    time.Duration
 	
 	// Configuration
 	retransmissionTimeout time.Duration
 	maxBufferSize        int
+	onFailure            func(*Packet) // see OnDeliveryFailure, under unackedMutex
 }
 
 // UnackedPacket stores packet with timestamp for retransmission
@@ -49,6 +50,7 @@ type UnackedPacket struct {
 	Packet    *Packet
 	SentTime  time.Time
 	RetryCount int
+	Timeout   time.Duration // the packet's backed off RTO once retransmitted
 }
 
 // NewReliabilityLayer creates a new reliability layer
@@ -56,16 +58,15 @@ func NewReliabilityLayer() *ReliabilityLayer {
 	return &ReliabilityLayer{
 		nextSeqNum:            1,
 		unackedPackets:       make(map[uint32]*UnackedPacket),
+		sentNext:             1,
 		receivedSeqs:         make(map[uint32]bool),
 		orderingBuffer:       make(map[uint32]*Packet),
 		nextExpectedSeq:      1,
 		windowSize:           32, // Default window size
 		congestionWindow:     1,  // Start with 1 (slow start)
 		ssthresh:            32, // Initial slow start threshold
-		retransmissionTimeout: 1000 * time.Millisecond,
+		retransmissionTimeout: initialRTO,
 		maxBufferSize:        1000,
-		rttSamples:           make([]time.Duration, 0),
-		averageRTT:           100 * time.Millisecond, // Initial estimate
 	}
 }
 
@@ -97,6 +98,9 @@ func (r *ReliabilityLayer) SendPacketWithTimestamp(packet *Packet, timestamp tim
 			SentTime:   timestamp,
 			RetryCount: 0,
 		}
+		if int32(packet.SeqNum+1-r.sentNext) > 0 {
+			r.sentNext = packet.SeqNum + 1
+		}
 		r.unackedMutex.Unlock()
 	}
 }
@@ -109,66 +113,147 @@ func (r *ReliabilityLayer) HasUnackedPacket(seqNum uint32) bool {
 	return exists
 }
 
-// Acknowledgment handling
+// Acknowledgment handling. An ACK acknowledges every packet before its
+// AckNum, as long as AckNum is not past the next sequence number to be
+// sent, and the packets in its SACK blocks.
 func (r *ReliabilityLayer) HandleAck(ackPacket *Packet) error {
 	if !ackPacket.HasAck() {
-		return fmt.Errorf("packet is not an acknowledgment")
+		return packetErrorf(ErrProtocol, "packet is not an acknowledgment")
 	}
 	
 	ackNum := ackPacket.AckNum
+	next := r.NextSeqNum()
 	
 	r.unackedMutex.Lock()
 	defer r.unackedMutex.Unlock()
 	
-	// Find corresponding unacked packet (ACK number - 1)
-	seqNum := ackNum - 1
-	unackedPacket, exists := r.unackedPackets[seqNum]
+	// Packets may be sent with sequence numbers not taken from the layer
+	if int32(r.sentNext-next) > 0 {
+		next = r.sentNext
+	}
+	
+	// Remove every packet the ACK covers, sampling the RTT from the most
+	// recently sent; retransmitted packets are skipped, since their ACK
+	// may be for either copy (Karn's algorithm)
+	acked := 0
+	var newest *UnackedPacket
+	for seqNum, unackedPacket := range r.unackedPackets {
+		if !ackPacket.acknowledges(seqNum, next) {
+			continue
+		}
+		delete(r.unackedPackets, seqNum)
+		acked++
+		if unackedPacket.RetryCount == 0 && (newest == nil || unackedPacket.SentTime.After(newest.SentTime)) {
+			newest = unackedPacket
+		}
+	}
 	
-	if !exists {
+	if acked == 0 {
 		// This might be a duplicate ACK or invalid ACK
-		if seqNum > r.nextSeqNum {
-			return fmt.Errorf("ACK for future packet: ack=%d, next_seq=%d", ackNum, r.nextSeqNum)
+		if int32(ackNum-next) > 0 {
+			return packetErrorf(ErrProtocol, "ACK for future packet: ack=%d, next_seq=%d", ackNum, next)
 		}
 		return nil // Ignore duplicate/old ACKs
 	}
-	
-	// Calculate RTT and update measurements
-	rtt := time.Since(unackedPacket.SentTime)
-	r.updateRTT(rtt)
-	
-	// Remove from unacked packets
-	delete(r.unackedPackets, seqNum)
+	if newest != nil {
+		r.updateRTT(time.Since(newest.SentTime))
+	}
 	
 	// Update congestion control
-	r.handleSuccessfulAck()
+	for ; acked > 0; acked-- {
+		r.handleSuccessfulAck()
+	}
 	
 	return nil
 }
 
-// Get packets that have timed out
+// Get packets that have timed out. They count as retransmitted from now
+// on, and the timeout backs off until a fresh RTT sample; each packet
+// also backs off on its own, waiting twice as long as the timeout that
+// expired for it. Packets past maxRetransmissions are dropped instead
+// and reported to OnDeliveryFailure.
 func (r *ReliabilityLayer) GetTimedOutPackets() []*Packet {
-	r.unackedMutex.RLock()
-	defer r.unackedMutex.RUnlock()
+	return r.AppendTimedOutPackets(nil)
+}
+
+// AppendTimedOutPackets is GetTimedOutPackets appending to dst, so a
+// caller scanning every tick can reuse one slice instead of allocating
+func (r *ReliabilityLayer) AppendTimedOutPackets(dst []*Packet) []*Packet {
+	r.ForEachTimedOutPacket(func(packet *Packet) {
+		dst = append(dst, packet)
+	})
+	return dst
+}
+
+// ForEachTimedOutPacket is GetTimedOutPackets calling fn with each packet
+// instead of collecting them. fn runs with the layer locked, so it must
+// not call back into the layer.
+func (r *ReliabilityLayer) ForEachTimedOutPacket(fn func(*Packet)) {
+	r.unackedMutex.Lock()
+	defer r.unackedMutex.Unlock()
 	
 	now := time.Now()
-	var timedOut []*Packet
-	
-	for _, unackedPacket := range r.unackedPackets {
-		if now.Sub(unackedPacket.SentTime) > r.retransmissionTimeout {
-			timedOut = append(timedOut, unackedPacket.Packet)
+	timedOut := false
+	
+	for seqNum, unackedPacket := range r.unackedPackets {
+		timeout := max(r.retransmissionTimeout, unackedPacket.Timeout)
+		if now.Sub(unackedPacket.SentTime) > timeout {
+			if unackedPacket.RetryCount >= maxRetransmissions {
+				// Give up: the peer is presumed gone
+				delete(r.unackedPackets, seqNum)
+				if r.onFailure != nil {
+					r.onFailure(unackedPacket.Packet)
+				}
+				continue
+			}
+			fn(unackedPacket.Packet)
+			timedOut = true
+			unackedPacket.RetryCount++
+			unackedPacket.Timeout = min(2*timeout, maxRTO)
+			unackedPacket.SentTime = now
 		}
 	}
 	
-	return timedOut
+	if timedOut {
+		r.retransmissionTimeout = backoffRTO(r.retransmissionTimeout)
+	}
+}
+
+// OnDeliveryFailure registers fn to be called with every packet given up
+// on after maxRetransmissions. It runs with the layer locked, so it must
+// not call back into the layer. Passing nil removes it.
+func (r *ReliabilityLayer) OnDeliveryFailure(fn func(packet *Packet)) {
+	r.unackedMutex.Lock()
+	r.onFailure = fn
+	r.unackedMutex.Unlock()
 }
 
-// Packet receiving and duplicate detection
+// Packet receiving and duplicate detection. Sequence numbers are only
+// remembered until delivered; anything older than the next expected one
+// is a duplicate. Sequence numbers compare in serial arithmetic (RFC
+// 1982), so ordering holds across the wraparound.
 func (r *ReliabilityLayer) IsPacketDuplicate(packet *Packet) bool {
+	r.orderingMutex.RLock()
+	delivered := int32(packet.SeqNum-r.nextExpectedSeq) < 0
+	r.orderingMutex.RUnlock()
+	if delivered {
+		return true
+	}
+	
 	r.receivedMutex.RLock()
 	defer r.receivedMutex.RUnlock()
 	return r.receivedSeqs[packet.SeqNum]
 }
 
+// SetPeerISN sets the peer's initial sequence number, learned from its
+// SYN or SYN-ACK, so delivery starts with the packet after it however
+// late that one arrives
+func (r *ReliabilityLayer) SetPeerISN(isn uint32) {
+	r.orderingMutex.Lock()
+	r.nextExpectedSeq = isn + 1
+	r.orderingMutex.Unlock()
+}
+
 func (r *ReliabilityLayer) MarkPacketReceived(packet *Packet) {
 	r.receivedMutex.Lock()
 	r.receivedSeqs[packet.SeqNum] = true
@@ -179,12 +264,18 @@ func (r *ReliabilityLayer) ReceivePacket(packet *Packet) error {
 	// Check buffer size limit
 	r.orderingMutex.RLock()
 	bufferSize := len(r.orderingBuffer)
+	windowEnd := r.nextExpectedSeq + uint32(r.maxBufferSize)
 	r.orderingMutex.RUnlock()
 	
 	if bufferSize >= r.maxBufferSize {
 		return fmt.Errorf("receive buffer overflow: size=%d, max=%d", bufferSize, r.maxBufferSize)
 	}
 	
+	// Packets too far ahead would wait in the buffer indefinitely
+	if int32(packet.SeqNum-windowEnd) >= 0 {
+		return packetErrorf(ErrProtocol, "packet outside receive window: seq=%d, window_end=%d", packet.SeqNum, windowEnd)
+	}
+	
 	// Check for duplicates
 	if r.IsPacketDuplicate(packet) {
 		return nil // Ignore duplicates silently
@@ -220,6 +311,15 @@ func (r *ReliabilityLayer) GetOrderedPackets() []*Packet {
 		r.nextExpectedSeq++
 	}
 	
+	// Delivered packets are now detected as duplicates by sequence alone
+	if len(orderedPackets) > 0 {
+		r.receivedMutex.Lock()
+		for _, packet := range orderedPackets {
+			delete(r.receivedSeqs, packet.SeqNum)
+		}
+		r.receivedMutex.Unlock()
+	}
+	
 	return orderedPackets
 }
 
@@ -277,39 +377,28 @@ func (r *ReliabilityLayer) SimulatePacketLoss() {
 	r.congestionWindow = r.ssthresh
 }
 
-// RTT measurement
+// RTT measurement; the caller holds unackedMutex, which guards the timeout
 func (r *ReliabilityLayer) updateRTT(sample time.Duration) {
 	r.rttMutex.Lock()
 	defer r.rttMutex.Unlock()
 	
-	// Keep last 10 samples for moving average
-	r.rttSamples = append(r.rttSamples, sample)
-	if len(r.rttSamples) > 10 {
-		r.rttSamples = r.rttSamples[1:]
-	}
-	
-	// Calculate average
-	var total time.Duration
-	for _, rtt := range r.rttSamples {
-		total += rtt
-	}
-	r.averageRTT = total / time.Duration(len(r.rttSamples))
-	
-	// Update retransmission timeout based on RTT
-	// RTO = average_RTT * 2 (simplified)
-	r.retransmissionTimeout = r.averageRTT * 2
-	if r.retransmissionTimeout < 100*time.Millisecond {
-		r.retransmissionTimeout = 100 * time.Millisecond
-	}
-	if r.retransmissionTimeout > 5*time.Second {
-		r.retransmissionTimeout = 5 * time.Second
-	}
+	// RTO = SRTT + 4*RTTVAR, which also ends any backoff
+	r.rtt = r.rtt.sample(sample)
+	r.retransmissionTimeout = r.rtt.rto()
 }
 
+// GetAverageRTT returns the smoothed RTT, 0 before the first sample
 func (r *ReliabilityLayer) GetAverageRTT() time.Duration {
 	r.rttMutex.RLock()
 	defer r.rttMutex.RUnlock()
-	return r.averageRTT
+	return r.rtt.srtt
+}
+
+// GetRetransmissionTimeout returns the current RTO, including any backoff
+func (r *ReliabilityLayer) GetRetransmissionTimeout() time.Duration {
+	r.unackedMutex.RLock()
+	defer r.unackedMutex.RUnlock()
+	return r.retransmissionTimeout
 }
 
 // Configuration
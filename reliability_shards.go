@@ -0,0 +1,279 @@
+package ultrafast
+
+import (
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReliabilityShards gives every connection its own reliability layer, so
+// each peer has a separate sequence space, retransmission queue and
+// congestion window. Connections are spread over shards by peer address;
+// each shard is scanned for retransmissions by its own worker and keeps
+// its own epoch domains, so connections on different shards share no
+// cache lines. Packets to peers without a connection use one shared
+// connectionless layer.
+type ReliabilityShards struct {
+	shards         []reliabilityShard
+	mask           uint64
+	seed           maphash.Seed
+	algorithm      atomic.Uint32                        // CongestionAlgorithm for new layers
+	budget         atomic.Pointer[RetransmissionBudget] // for new layers, nil for the default
+	ackDelay       atomic.Int64                         // nanoseconds, for new layers
+	onFailure      atomic.Pointer[DeliveryFailureHandler]
+	connectionless *LockFreeReliabilityLayer
+}
+
+// reliabilityShard holds the layers of the connections hashed to it
+type reliabilityShard struct {
+	mu       sync.Mutex
+	layers   map[*LockFreeReliabilityLayer]*Connection
+	detached ReliabilityStats // counters of layers whose connection closed
+
+	// Recycled entries and queue nodes of this shard's layers
+	entries *EpochDomain
+	nodes   *EpochDomain
+
+	_ [64]byte // keep neighbouring shards' locks on separate cache lines
+}
+
+// NewReliabilityShards creates n shards, rounded up to a power of two
+func NewReliabilityShards(n int) *ReliabilityShards {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+
+	rs := &ReliabilityShards{
+		shards:         make([]reliabilityShard, size),
+		mask:           uint64(size - 1),
+		seed:           maphash.MakeSeed(),
+		connectionless: NewLockFreeReliabilityLayer(),
+	}
+	rs.connectionless.selective = true // its peers share one sequence space
+	rs.connectionless.OnDeliveryFailure(func(packet *Packet) {
+		rs.deliveryFailed(packet, SocketAddr{})
+	})
+	for i := range rs.shards {
+		shard := &rs.shards[i]
+		shard.layers = make(map[*LockFreeReliabilityLayer]*Connection)
+		shard.entries = NewEpochDomain(releaseUnackedEntry)
+		shard.nodes = NewEpochDomain(releaseQueueNode)
+	}
+	return rs
+}
+
+// Shards returns the number of shards
+func (rs *ReliabilityShards) Shards() int {
+	return len(rs.shards)
+}
+
+// Attach gives a new connection its reliability layer on the shard its
+// peer hashes to
+func (rs *ReliabilityShards) Attach(conn *Connection, peer SocketAddr) {
+	index := int(maphash.Comparable(rs.seed, peer) & rs.mask)
+	shard := &rs.shards[index]
+
+	layer := newConnectionReliabilityLayer(shard.entries, shard.nodes)
+	layer.SetCongestionAlgorithm(CongestionAlgorithm(rs.algorithm.Load()))
+	if budget := rs.budget.Load(); budget != nil {
+		layer.SetRetransmissionBudget(*budget)
+	}
+	layer.SetAckDelay(time.Duration(rs.ackDelay.Load()))
+	layer.OnDeliveryFailure(func(packet *Packet) {
+		rs.deliveryFailed(packet, peer)
+	})
+
+	shard.mu.Lock()
+	shard.layers[layer] = conn
+	shard.mu.Unlock()
+
+	conn.reliability = layer
+	conn.shard = index
+}
+
+// Detach stops tracking a closed connection's layer and releases its
+// state back to the slabs. Its counters stay in the aggregate stats.
+func (rs *ReliabilityShards) Detach(conn *Connection) {
+	layer := conn.reliability
+	if layer == nil {
+		return
+	}
+	shard := &rs.shards[conn.shard]
+
+	shard.mu.Lock()
+	_, exists := shard.layers[layer]
+	if exists {
+		delete(shard.layers, layer)
+		shard.detached.addCounters(layer.GetStats())
+	}
+	shard.mu.Unlock()
+
+	if exists {
+		layer.Release()
+	}
+}
+
+// Connectionless returns the layer for peers that have no connection
+func (rs *ReliabilityShards) Connectionless() *LockFreeReliabilityLayer {
+	return rs.connectionless
+}
+
+// TimedOut returns the packets of one shard's connections, and of the
+// connectionless layer when scanning shard 0, that need retransmission
+func (rs *ReliabilityShards) TimedOut(index int) []*Packet {
+	return rs.AppendTimedOut(index, nil)
+}
+
+// AppendTimedOut is TimedOut appending to dst, so a worker scanning its
+// shard every tick can reuse one slice
+func (rs *ReliabilityShards) AppendTimedOut(index int, dst []*Packet) []*Packet {
+	if index == 0 {
+		dst = rs.connectionless.AppendTimedOutPackets(dst)
+	}
+
+	shard := &rs.shards[index]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	for layer := range shard.layers {
+		dst = layer.AppendTimedOutPackets(dst)
+	}
+	return dst
+}
+
+// ForEachTimedOut is TimedOut calling fn with each packet instead of
+// collecting them. fn runs with the shard locked, so it must not block.
+func (rs *ReliabilityShards) ForEachTimedOut(index int, fn func(*Packet)) {
+	if index == 0 {
+		rs.connectionless.ForEachTimedOutPacket(fn)
+	}
+
+	shard := &rs.shards[index]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	for layer := range shard.layers {
+		layer.ForEachTimedOutPacket(fn)
+	}
+}
+
+// SetCongestionAlgorithm switches every layer, and those created later,
+// to the given algorithm
+func (rs *ReliabilityShards) SetCongestionAlgorithm(cc CongestionAlgorithm) {
+	rs.algorithm.Store(uint32(cc))
+	rs.connectionless.SetCongestionAlgorithm(cc)
+	rs.forEachLayer(func(layer *LockFreeReliabilityLayer) {
+		layer.SetCongestionAlgorithm(cc)
+	})
+}
+
+// GetCongestionAlgorithm returns the algorithm new layers start with
+func (rs *ReliabilityShards) GetCongestionAlgorithm() CongestionAlgorithm {
+	return CongestionAlgorithm(rs.algorithm.Load())
+}
+
+// SetRetransmissionBudget applies a retransmission budget to every layer,
+// and those created later
+func (rs *ReliabilityShards) SetRetransmissionBudget(budget RetransmissionBudget) {
+	rs.budget.Store(&budget)
+	rs.connectionless.SetRetransmissionBudget(budget)
+	rs.forEachLayer(func(layer *LockFreeReliabilityLayer) {
+		layer.SetRetransmissionBudget(budget)
+	})
+}
+
+// RetransmissionBudget returns the budget new layers start with
+func (rs *ReliabilityShards) RetransmissionBudget() RetransmissionBudget {
+	if budget := rs.budget.Load(); budget != nil {
+		return *budget
+	}
+	return RetransmissionBudget{MaxRetries: maxRetransmissions}
+}
+
+// OnDeliveryFailure registers handler for the packets every layer gives
+// up on past the retransmission budget. It runs during the shard's scan,
+// with the shard locked, or as a connection is aborted, so it must not
+// block. Passing nil removes it.
+func (rs *ReliabilityShards) OnDeliveryFailure(handler DeliveryFailureHandler) {
+	if handler == nil {
+		rs.onFailure.Store(nil)
+		return
+	}
+	rs.onFailure.Store(&handler)
+}
+
+// deliveryFailed hands a packet given up on to the handler, if any
+func (rs *ReliabilityShards) deliveryFailed(packet *Packet, peer SocketAddr) {
+	if handler := rs.onFailure.Load(); handler != nil {
+		(*handler)(packet, peer)
+	}
+}
+
+// UnackedCount returns the packets awaiting acknowledgment over all layers
+func (rs *ReliabilityShards) UnackedCount() int {
+	count := rs.connectionless.UnackedCount()
+	rs.forEachLayer(func(layer *LockFreeReliabilityLayer) {
+		count += layer.UnackedCount()
+	})
+	return count
+}
+
+// GetStats returns the aggregate view: counters are summed over every
+// layer, closed connections included, and bytes in flight over open
+// ones, while the congestion window, RTT estimates and timeout are
+// averaged over open connections. With none open they come from the
+// connectionless layer.
+func (rs *ReliabilityShards) GetStats() ReliabilityStats {
+	stats := rs.connectionless.GetStats()
+
+	var cwnd uint64
+	var rtt, rttvar, timeout time.Duration
+	open := 0
+	for i := range rs.shards {
+		shard := &rs.shards[i]
+		shard.mu.Lock()
+		stats.addCounters(shard.detached)
+		for layer := range shard.layers {
+			layerStats := layer.GetStats()
+			stats.addCounters(layerStats)
+			stats.BytesInFlight += layerStats.BytesInFlight
+			cwnd += uint64(layerStats.CongestionWindow)
+			rtt += layerStats.RTTEstimate
+			rttvar += layerStats.RTTVariance
+			timeout += layerStats.TimeoutValue
+			open++
+		}
+		shard.mu.Unlock()
+	}
+
+	if open > 0 {
+		stats.CongestionWindow = uint32(cwnd / uint64(open))
+		stats.RTTEstimate = rtt / time.Duration(open)
+		stats.RTTVariance = rttvar / time.Duration(open)
+		stats.TimeoutValue = timeout / time.Duration(open)
+	}
+	return stats
+}
+
+// forEachLayer calls fn for every open connection's layer
+func (rs *ReliabilityShards) forEachLayer(fn func(*LockFreeReliabilityLayer)) {
+	for i := range rs.shards {
+		shard := &rs.shards[i]
+		shard.mu.Lock()
+		for layer := range shard.layers {
+			fn(layer)
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// addCounters adds another layer's packet counters to s
+func (s *ReliabilityStats) addCounters(other ReliabilityStats) {
+	s.PacketsSent += other.PacketsSent
+	s.PacketsReceived += other.PacketsReceived
+	s.PacketsLost += other.PacketsLost
+	s.PacketsRetransmitted += other.PacketsRetransmitted
+	s.FastRetransmits += other.FastRetransmits
+	s.PacketsExpired += other.PacketsExpired
+	s.ReceiveQueueFull += other.ReceiveQueueFull
+}
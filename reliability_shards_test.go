@@ -0,0 +1,164 @@
+package ultrafast
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReliabilityShardsSeparateSequenceSpaces(t *testing.T) {
+	table := NewConnectionTable()
+	a, _ := table.GetOrCreate(SocketAddr{IP: "10.0.0.1", Port: 4000})
+	b, _ := table.GetOrCreate(SocketAddr{IP: "10.0.0.2", Port: 4000})
+	if a.Reliability() == nil || a.Reliability() == b.Reliability() {
+		t.Fatal("Each connection should own its reliability layer")
+	}
+
+	for _, conn := range []*Connection{a, b} {
+		if seq := conn.Reliability().GetNextSeqNum(); seq != 1 {
+			t.Errorf("Expected each connection to start at sequence 1, got %d", seq)
+		}
+		conn.Reliability().SendPacket(NewPacket(DATA_PACKET, 0, 1, 0, nil))
+	}
+
+	// An ACK for a's packet does not touch b's identically numbered one
+	if !a.Reliability().HandleAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, 2, nil)) {
+		t.Fatal("ACK should match a's packet")
+	}
+	if a.Reliability().UnackedCount() != 0 || b.Reliability().UnackedCount() != 1 {
+		t.Errorf("Expected 0 and 1 unacked, got %d and %d",
+			a.Reliability().UnackedCount(), b.Reliability().UnackedCount())
+	}
+}
+
+func TestReliabilityShardsAggregateStats(t *testing.T) {
+	table := NewConnectionTable()
+	shards := table.Reliability()
+
+	var conns []*Connection
+	for i := 0; i < 3; i++ {
+		conn, _ := table.GetOrCreate(SocketAddr{IP: "10.0.0.1", Port: uint16(4000 + i)})
+		conn.Reliability().SendPacket(NewPacket(DATA_PACKET, 0, 1, 0, nil))
+		conn.Reliability().SendPacket(NewPacket(DATA_PACKET, 0, 2, 0, nil))
+		conns = append(conns, conn)
+	}
+	shards.Connectionless().SendPacket(NewPacket(DATA_PACKET, 0, 1, 0, nil))
+	atomic.StoreUint32(&conns[0].Reliability().congWindow, 7)
+
+	stats := shards.GetStats()
+	if stats.PacketsSent != 7 {
+		t.Errorf("Expected 7 packets sent over all layers, got %d", stats.PacketsSent)
+	}
+	if stats.CongestionWindow != 3 {
+		t.Errorf("Expected the mean cwnd of open connections, 3, got %d", stats.CongestionWindow)
+	}
+	if shards.UnackedCount() != 7 {
+		t.Errorf("Expected 7 unacked packets, got %d", shards.UnackedCount())
+	}
+
+	// A closed connection's counters stay in the totals
+	table.Remove(SocketAddr{IP: "10.0.0.1", Port: 4000})
+	stats = shards.GetStats()
+	if stats.PacketsSent != 7 {
+		t.Errorf("Expected 7 packets sent after a close, got %d", stats.PacketsSent)
+	}
+	if stats.CongestionWindow != 1 {
+		t.Errorf("Expected cwnd 1 once the larger window closed, got %d", stats.CongestionWindow)
+	}
+	if shards.UnackedCount() != 5 {
+		t.Errorf("Expected the closed connection's packets dropped, got %d unacked", shards.UnackedCount())
+	}
+}
+
+func TestReliabilityShardsTimedOutByShard(t *testing.T) {
+	shards := NewReliabilityShards(4)
+	if shards.Shards() != 4 {
+		t.Fatalf("Expected 4 shards, got %d", shards.Shards())
+	}
+
+	perShard := make([]int, shards.Shards())
+	for i := 0; i < 64; i++ {
+		conn := &Connection{}
+		shards.Attach(conn, SocketAddr{IP: fmt.Sprintf("10.0.1.%d", i), Port: 4000})
+		atomic.StoreUint64(&conn.Reliability().timeoutBase, 0) // everything is overdue
+		conn.Reliability().SendPacket(NewPacket(DATA_PACKET, 0, 1, 0, nil))
+		perShard[conn.shard]++
+	}
+
+	total := 0
+	for shard, expected := range perShard {
+		if expected == 0 {
+			t.Errorf("Shard %d got no connections out of 64", shard)
+		}
+		if got := len(shards.TimedOut(shard)); got != expected {
+			t.Errorf("Shard %d: expected %d timed out packets, got %d", shard, expected, got)
+		}
+		total += expected
+	}
+	if total != 64 {
+		t.Errorf("Expected 64 connections over all shards, got %d", total)
+	}
+}
+
+func TestReliabilityShardsAppendTimedOut(t *testing.T) {
+	shards := NewReliabilityShards(1)
+	layers := make([]*LockFreeReliabilityLayer, 4)
+	for i := range layers {
+		conn := &Connection{}
+		shards.Attach(conn, SocketAddr{IP: fmt.Sprintf("10.0.2.%d", i), Port: 4000})
+		layers[i] = conn.Reliability()
+		layers[i].SendPacket(NewPacket(DATA_PACKET, 0, 1, 0, nil))
+		layers[i].SendPacket(NewPacket(DATA_PACKET, 0, 2, 0, nil))
+	}
+	overdue := func() {
+		for _, layer := range layers {
+			atomic.StoreUint64(&layer.timeoutBase, 0)
+		}
+	}
+
+	// Appended after what dst already holds, in the slice passed in
+	marker := NewPacket(DATA_PACKET, 0, 99, 0, nil)
+	scratch := make([]*Packet, 1, 16)
+	scratch[0] = marker
+	overdue()
+	timedOut := shards.AppendTimedOut(0, scratch)
+	if len(timedOut) != 9 || timedOut[0] != marker || &timedOut[0] != &scratch[0] {
+		t.Fatalf("Expected 8 packets appended in place, got %d", len(timedOut)-1)
+	}
+
+	overdue()
+	count := 0
+	shards.ForEachTimedOut(0, func(packet *Packet) { count++ })
+	if count != 8 {
+		t.Errorf("Expected 8 packets visited, got %d", count)
+	}
+
+	if raceEnabled {
+		return // the race detector changes allocation counts
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		overdue()
+		timedOut = shards.AppendTimedOut(0, timedOut[:0])
+	})
+	if allocs != 0 {
+		t.Errorf("Expected a reused slice to need no allocation, got %.1f per scan", allocs)
+	}
+}
+
+func TestReliabilityShardsCongestionAlgorithm(t *testing.T) {
+	table := NewConnectionTable()
+	shards := table.Reliability()
+	before, _ := table.GetOrCreate(SocketAddr{IP: "10.0.0.1", Port: 4000})
+
+	shards.SetCongestionAlgorithm(CC_FIXED)
+	after, _ := table.GetOrCreate(SocketAddr{IP: "10.0.0.2", Port: 4000})
+
+	for _, layer := range []*LockFreeReliabilityLayer{before.Reliability(), after.Reliability(), shards.Connectionless()} {
+		if layer.GetCongestionAlgorithm() != CC_FIXED {
+			t.Errorf("Expected every layer on %v, got %v", CC_FIXED, layer.GetCongestionAlgorithm())
+		}
+	}
+	if shards.GetCongestionAlgorithm() != CC_FIXED {
+		t.Errorf("Expected %v, got %v", CC_FIXED, shards.GetCongestionAlgorithm())
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package ultrafast
 
 import (
 	"testing"
@@ -126,8 +126,31 @@ func TestReliabilityLayer(t *testing.T) {
 }
 
 // Test packet ordering
+func TestReliabilityLayerForEachTimedOutPacket(t *testing.T) {
+	rel := NewReliabilityLayer()
+	sent := time.Now().Add(-time.Minute)
+	for seq := uint32(1); seq <= 3; seq++ {
+		rel.SendPacketWithTimestamp(NewPacket(DATA_PACKET, 0, seq, 0, nil), sent)
+	}
+
+	var seen []uint32
+	rel.ForEachTimedOutPacket(func(packet *Packet) { seen = append(seen, packet.SeqNum) })
+	if len(seen) != 3 {
+		t.Fatalf("Expected 3 timed out packets, got %v", seen)
+	}
+	if rel.retransmissionTimeout <= initialRTO {
+		t.Errorf("Expected the timeout backed off, got %v", rel.retransmissionTimeout)
+	}
+
+	// Just retransmitted, so nothing is due yet
+	if timedOut := rel.AppendTimedOutPackets(make([]*Packet, 0, 3)); len(timedOut) != 0 {
+		t.Errorf("Expected nothing due right after a timeout, got %d", len(timedOut))
+	}
+}
+
 func TestPacketOrdering(t *testing.T) {
 	rel := NewReliabilityLayer()
+	rel.SetPeerISN(500) // from the peer's SYN
 	
 	// Receive packets out of order
 	packet3 := NewPacket(DATA_PACKET, 0, 503, 0, []byte("packet 3"))
@@ -156,6 +179,23 @@ func TestPacketOrdering(t *testing.T) {
 	}
 }
 
+// A first packet overtaken by the next is waited for, not skipped
+func TestPacketOrderingLateFirstPacket(t *testing.T) {
+	rel := NewReliabilityLayer()
+	rel.SetPeerISN(500)
+	
+	rel.ReceivePacket(NewPacket(DATA_PACKET, 0, 502, 0, []byte("packet 2")))
+	if packets := rel.GetOrderedPackets(); len(packets) != 0 {
+		t.Fatalf("Expected nothing before packet 501, got %d packets", len(packets))
+	}
+	
+	rel.ReceivePacket(NewPacket(DATA_PACKET, 0, 501, 0, []byte("packet 1")))
+	packets := rel.GetOrderedPackets()
+	if len(packets) != 2 || packets[0].SeqNum != 501 || packets[1].SeqNum != 502 {
+		t.Errorf("Expected packets 501 and 502, got %v", packets)
+	}
+}
+
 // Test congestion control simulation
 func TestCongestionControl(t *testing.T) {
 	rel := NewReliabilityLayer()
@@ -0,0 +1,438 @@
+package ultrafast
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Magic numbers opening a capture file, as written on a little-endian
+// machine. The pcapng magic reads the same either way.
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+	pcapngMagic     = 0x0a0d0d0a
+)
+
+// Link types of the captures replay reads: whatever tcpdump writes for
+// Ethernet, loopback, "any" and raw IP interfaces
+const (
+	linkTypeNull      = 0
+	linkTypeEthernet  = 1
+	linkTypeRaw       = 101
+	linkTypeLinuxSLL  = 113
+	linkTypeIPv4      = 228
+	linkTypeLinuxSLL2 = 276
+)
+
+// maxCaptureRecord bounds a record's length, so a corrupt file fails
+// instead of allocating whatever its header claims
+const maxCaptureRecord = 256 << 10
+
+// CapturedDatagram is a UDP datagram read from a capture
+type CapturedDatagram struct {
+	Time     time.Time
+	From, To SocketAddr
+	Payload  []byte
+}
+
+// ReadCapture reads the UDP over IPv4 datagrams from a libpcap capture,
+// as written by tcpdump -w. Frames that are not, and truncated or
+// fragmented datagrams, are counted as skipped. pcapng files must first
+// be converted, as with editcap -F pcap.
+func ReadCapture(r io.Reader) (datagrams []CapturedDatagram, skipped int, err error) {
+	reader := bufio.NewReader(r)
+	var header [24]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, 0, fmt.Errorf("failed to read capture header: %v", err)
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(header[0:4])
+	if magic != pcapMagicMicros && magic != pcapMagicNanos {
+		order = binary.BigEndian
+		magic = order.Uint32(header[0:4])
+	}
+	var unit time.Duration
+	switch magic {
+	case pcapMagicMicros:
+		unit = time.Microsecond
+	case pcapMagicNanos:
+		unit = time.Nanosecond
+	case pcapngMagic:
+		return nil, 0, fmt.Errorf("pcapng captures are not supported; convert with editcap -F pcap")
+	default:
+		return nil, 0, fmt.Errorf("not a pcap capture: magic %08x", magic)
+	}
+	linkType := order.Uint32(header[20:24]) & 0xffff
+
+	var record [16]byte
+	for {
+		if _, err := io.ReadFull(reader, record[:]); err == io.EOF {
+			return datagrams, skipped, nil
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("failed to read capture record %d: %v", len(datagrams)+skipped+1, err)
+		}
+		stamp := time.Unix(int64(order.Uint32(record[0:4])), int64(order.Uint32(record[4:8]))*int64(unit))
+		length := order.Uint32(record[8:12])
+		if length > maxCaptureRecord {
+			return nil, 0, fmt.Errorf("capture record %d claims %d bytes", len(datagrams)+skipped+1, length)
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return nil, 0, fmt.Errorf("failed to read capture record %d: %v", len(datagrams)+skipped+1, err)
+		}
+		if length < order.Uint32(record[12:16]) {
+			skipped++ // cut short by the snapshot length
+			continue
+		}
+
+		datagram, ok := parseFrame(linkType, frame)
+		if !ok {
+			skipped++
+			continue
+		}
+		datagram.Time = stamp
+		datagrams = append(datagrams, datagram)
+	}
+}
+
+// parseFrame extracts the UDP datagram from a captured frame
+func parseFrame(linkType uint32, frame []byte) (CapturedDatagram, bool) {
+	var ip []byte
+	switch linkType {
+	case linkTypeNull:
+		// The address family, in the capturing machine's byte order
+		if len(frame) < 4 || binary.LittleEndian.Uint32(frame) != 2 && binary.BigEndian.Uint32(frame) != 2 {
+			return CapturedDatagram{}, false
+		}
+		ip = frame[4:]
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return CapturedDatagram{}, false
+		}
+		etherType, offset := binary.BigEndian.Uint16(frame[12:14]), 14
+		if etherType == 0x8100 && len(frame) >= 18 { // 802.1Q VLAN tag
+			etherType, offset = binary.BigEndian.Uint16(frame[16:18]), 18
+		}
+		if etherType != 0x0800 {
+			return CapturedDatagram{}, false
+		}
+		ip = frame[offset:]
+	case linkTypeRaw, linkTypeIPv4:
+		ip = frame
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 || binary.BigEndian.Uint16(frame[14:16]) != 0x0800 {
+			return CapturedDatagram{}, false
+		}
+		ip = frame[16:]
+	case linkTypeLinuxSLL2:
+		if len(frame) < 20 || binary.BigEndian.Uint16(frame[0:2]) != 0x0800 {
+			return CapturedDatagram{}, false
+		}
+		ip = frame[20:]
+	default:
+		return CapturedDatagram{}, false
+	}
+	return parseIPv4UDP(ip)
+}
+
+// parseIPv4UDP extracts the UDP datagram from an IPv4 packet. Fragments
+// are not reassembled.
+func parseIPv4UDP(ip []byte) (CapturedDatagram, bool) {
+	if len(ip) < 20 || ip[0]>>4 != 4 || ip[9] != 17 {
+		return CapturedDatagram{}, false
+	}
+	headerLen := int(ip[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(ip[2:4]))
+	if headerLen < 20 || totalLen < headerLen+8 || totalLen > len(ip) {
+		return CapturedDatagram{}, false
+	}
+	if binary.BigEndian.Uint16(ip[6:8])&0x3fff != 0 { // more fragments, or an offset
+		return CapturedDatagram{}, false
+	}
+	udp := ip[headerLen:totalLen]
+	udpLen := int(binary.BigEndian.Uint16(udp[4:6]))
+	if udpLen < 8 || udpLen > len(udp) {
+		return CapturedDatagram{}, false
+	}
+	return CapturedDatagram{
+		From: SocketAddr{
+			IP:   fmt.Sprintf("%d.%d.%d.%d", ip[12], ip[13], ip[14], ip[15]),
+			Port: binary.BigEndian.Uint16(udp[0:2]),
+		},
+		To: SocketAddr{
+			IP:   fmt.Sprintf("%d.%d.%d.%d", ip[16], ip[17], ip[18], ip[19]),
+			Port: binary.BigEndian.Uint16(udp[2:4]),
+		},
+		Payload: udp[8:udpLen],
+	}, true
+}
+
+// ReplayConfig configures a replay
+type ReplayConfig struct {
+	// Server is the server's address in the capture. A zero port takes
+	// the destination of the first SYN; an empty IP matches any address.
+	Server SocketAddr
+}
+
+// ReplayEvent is a packet fed to the server during a replay, or one the
+// server sent in response
+type ReplayEvent struct {
+	At      time.Duration // since the first datagram in the capture
+	Inbound bool
+	Peer    SocketAddr
+	Packet  *Packet // nil for an inbound datagram that is not a valid packet
+}
+
+// String formats the event as a line of a replay timeline
+func (e ReplayEvent) String() string {
+	direction := "out"
+	if e.Inbound {
+		direction = "in "
+	}
+	packet := "(invalid)"
+	if e.Packet != nil {
+		packet = e.Packet.String()
+	}
+	return fmt.Sprintf("%12.6fs %s %s %s", e.At.Seconds(), direction, e.Peer, packet)
+}
+
+// ReplayResult is what a replay fed the server and what it sent back
+type ReplayResult struct {
+	Events   []ReplayEvent
+	Fed      int            // datagrams fed to the server
+	Skipped  int            // datagrams neither to nor from the server
+	Captured map[string]int // packets the server sent in the capture, by kind
+	Replayed map[string]int // packets the server sent in the replay, by kind
+	Duration time.Duration  // virtual time the capture spans
+}
+
+// Diverged lists the kinds of packet, such as "DATA [OPT]", that the
+// server sent a different number of in the replay than in the capture
+func (r *ReplayResult) Diverged() []string {
+	var kinds []string
+	for kind, count := range r.Captured {
+		if r.Replayed[kind] != count {
+			kinds = append(kinds, kind)
+		}
+	}
+	for kind := range r.Replayed {
+		if _, ok := r.Captured[kind]; !ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// packetKind names a packet's type and flags, as Packet.String does
+func packetKind(packet *Packet) string {
+	kind, _, _ := strings.Cut(packet.String(), " seq=")
+	return kind
+}
+
+// handshakeMap maps what the captured server derived from its secrets
+// during each handshake, the SYN cookie and the connection ID, to what
+// the replaying server derived for the same SYN
+type handshakeMap struct {
+	captured map[SocketAddr]*Packet // latest SYN-ACK to each peer
+	replayed map[SocketAddr]*Packet
+	cookies  map[SocketAddr][2]uint32 // captured and replayed cookie
+	ids      map[uint64]uint64        // captured connection ID to replayed
+}
+
+func newHandshakeMap() *handshakeMap {
+	return &handshakeMap{
+		captured: make(map[SocketAddr]*Packet),
+		replayed: make(map[SocketAddr]*Packet),
+		cookies:  make(map[SocketAddr][2]uint32),
+		ids:      make(map[uint64]uint64),
+	}
+}
+
+// record notes a SYN-ACK to peer, from the capture or the replay, and
+// maps the handshake once both are known
+func (m *handshakeMap) record(synAcks map[SocketAddr]*Packet, peer SocketAddr, synAck *Packet) {
+	synAcks[peer] = synAck
+	captured, replayed := m.captured[peer], m.replayed[peer]
+	if captured == nil || replayed == nil || captured.AckNum != replayed.AckNum {
+		return
+	}
+	m.cookies[peer] = [2]uint32{captured.SeqNum, replayed.SeqNum}
+	capturedID, ok := captured.ConnectionID()
+	replayedID, replayedOK := replayed.ConnectionID()
+	if ok && replayedOK {
+		m.ids[capturedID] = replayedID
+	}
+}
+
+// translate rewrites a packet from peer to echo the replaying server's
+// cookie and connection ID where it echoed the captured server's. It
+// reports whether the packet changed.
+func (m *handshakeMap) translate(packet *Packet, peer SocketAddr) bool {
+	changed := false
+	if cookies, ok := m.cookies[peer]; ok && packet.HasAck() && packet.AckNum == cookies[0]+1 {
+		packet.AckNum = cookies[1] + 1
+		changed = true
+	}
+	if id, ok := packet.ConnectionID(); ok {
+		if replayed, mapped := m.ids[id]; mapped {
+			packet.SetConnectionID(replayed)
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Replay feeds the client side of a captured conversation with the server
+// to s, as it arrived, to reproduce bugs seen in production. The stack's
+// clock runs on the capture's timestamps, and timeouts and retransmission
+// timers fire as virtual time passes, so a capture spanning an hour
+// replays in moments and gives the same result every time.
+//
+// The server must be configured as the captured one was, and not
+// started. Nothing is sent on its socket: the packets it sends are
+// collected in the result, to compare with those the captured server
+// sent. Handlers run inline, one request at a time. SYN cookies and
+// connection IDs the client echoes are mapped to the replaying server's;
+// session tickets and retry tokens cannot be, so resumed and retried
+// handshakes replay as refused ones. While a replay runs the virtual
+// clock applies to every server in the process.
+func (s *UltraFastHTTPServer) Replay(r io.Reader, config ReplayConfig) (*ReplayResult, error) {
+	if atomic.LoadInt32(&s.running) == 1 {
+		return nil, fmt.Errorf("cannot replay into a running server")
+	}
+	datagrams, skipped, err := ReadCapture(r)
+	if err != nil {
+		return nil, err
+	}
+	server := config.Server
+	if server.Port == 0 {
+		server = firstSynDestination(datagrams)
+		if server.Port == 0 {
+			return nil, fmt.Errorf("no SYN in the capture to find the server by")
+		}
+	}
+	isServer := func(addr SocketAddr) bool {
+		return addr.Port == server.Port && (server.IP == "" || addr.IP == server.IP)
+	}
+
+	result := &ReplayResult{
+		Skipped:  skipped,
+		Captured: make(map[string]int),
+		Replayed: make(map[string]int),
+	}
+	if len(datagrams) == 0 {
+		return result, nil
+	}
+	start := datagrams[0].Time
+	result.Duration = datagrams[len(datagrams)-1].Time.Sub(start)
+
+	// A fixed secret makes the cookies, and so every replay, the same
+	secret := s.synCookies.secret
+	s.synCookies.secret = [32]byte{}
+	defer func() { s.synCookies.secret = secret }()
+
+	handshakes := newHandshakeMap()
+	var now time.Time
+	divert := func(packet *Packet, to SocketAddr) {
+		sent, err := DeserializePacket(packet.Serialize())
+		if err != nil {
+			return
+		}
+		result.Replayed[packetKind(sent)]++
+		result.Events = append(result.Events, ReplayEvent{At: now.Sub(start), Peer: to, Packet: sent})
+		if sent.HasSyn() && sent.HasAck() {
+			handshakes.record(handshakes.replayed, to, sent)
+		}
+	}
+	s.divert.Store(&divert)
+	defer s.divert.Store(nil)
+	if pool := s.workers.Swap(nil); pool != nil {
+		defer s.workers.Store(pool)
+	}
+	defer setVirtualTime(time.Time{})
+
+	h := &HTTPSocketHandler{server: s}
+	s.connections.OnEvict(h.evictConnection)
+
+	// The workers' periodic checks run at their interval of virtual time
+	nextSweep := start.Add(requestSweepInterval)
+	advance := func(to time.Time) {
+		for !nextSweep.After(to) {
+			now = nextSweep
+			setVirtualTime(now)
+			s.expireTimedOut()
+			s.sweepConnections(h, now)
+			s.eventLoop.runTasks()
+			nextSweep = nextSweep.Add(requestSweepInterval)
+		}
+		now = to
+		setVirtualTime(now)
+		s.expireTimedOut()
+		s.eventLoop.runTasks()
+	}
+
+	for _, datagram := range datagrams {
+		switch {
+		case isServer(datagram.From):
+			// What the captured server sent, to compare with the replay
+			if packet, err := deserializePacket(datagram.Payload, false); err == nil {
+				result.Captured[packetKind(packet)]++
+				if packet.HasSyn() && packet.HasAck() {
+					handshakes.record(handshakes.captured, datagram.To, packet)
+				}
+			}
+		case isServer(datagram.To):
+			advance(datagram.Time)
+			payload := datagram.Payload
+			packet, err := deserializePacket(payload, false)
+			if err == nil && handshakes.translate(packet, datagram.From) {
+				payload = packet.Serialize()
+			}
+			if err != nil {
+				packet = nil
+			}
+			result.Events = append(result.Events, ReplayEvent{
+				At: now.Sub(start), Inbound: true, Peer: datagram.From, Packet: packet,
+			})
+			result.Fed++
+
+			header, body := payload, []byte(nil)
+			if len(payload) > PACKET_HEADER_SIZE {
+				header, body = payload[:PACKET_HEADER_SIZE], payload[PACKET_HEADER_SIZE:]
+			}
+			h.processIncomingData(header, body, datagram.From)
+			s.eventLoop.runTasks()
+		default:
+			result.Skipped++
+		}
+	}
+	return result, nil
+}
+
+// expireTimedOut runs the reliability workers' retransmission timeout
+// check once on every shard
+func (s *UltraFastHTTPServer) expireTimedOut() {
+	for shard := 0; shard < s.reliability.Shards(); shard++ {
+		s.reliability.TimedOut(shard)
+	}
+}
+
+// firstSynDestination returns the address the first SYN in a capture was
+// sent to, or the zero address if there is none
+func firstSynDestination(datagrams []CapturedDatagram) SocketAddr {
+	for _, datagram := range datagrams {
+		packet, err := deserializePacket(datagram.Payload, false)
+		if err == nil && packet.IsSynPacket() && !packet.HasAck() {
+			return datagram.To
+		}
+	}
+	return SocketAddr{}
+}
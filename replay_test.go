@@ -0,0 +1,224 @@
+package ultrafast
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	replayServerAddr = SocketAddr{IP: "10.0.0.1", Port: 8080}
+	replayClientAddr = SocketAddr{IP: "10.0.0.2", Port: 40000}
+)
+
+// newReplayTestServer creates an unstarted server with a /hello route
+func newReplayTestServer(t *testing.T) *UltraFastHTTPServer {
+	t.Helper()
+	server, err := NewUltraFastHTTPServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	server.HandleFunc("/hello", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: []byte("hello")}
+	})
+	return server
+}
+
+// captureRecorder stands in for tcpdump on a server: it feeds the server
+// client packets and records them, with what the server sends back
+type captureRecorder struct {
+	t         *testing.T
+	server    *UltraFastHTTPServer
+	handler   *HTTPSocketHandler
+	datagrams []CapturedDatagram
+	at        time.Time
+	sent      []*Packet
+}
+
+func newCaptureRecorder(t *testing.T) *captureRecorder {
+	r := &captureRecorder{t: t, server: newReplayTestServer(t), at: time.Unix(1700000000, 0)}
+	r.server.DisableWorkerPool()
+	r.handler = &HTTPSocketHandler{server: r.server}
+	divert := func(packet *Packet, to SocketAddr) {
+		data := packet.Serialize()
+		sent, _ := DeserializePacket(data)
+		r.sent = append(r.sent, sent)
+		r.datagrams = append(r.datagrams, CapturedDatagram{Time: r.at, From: replayServerAddr, To: to, Payload: data})
+	}
+	r.server.divert.Store(&divert)
+	return r
+}
+
+// send delivers a client packet after delay and returns what the server
+// sent in reply
+func (r *captureRecorder) send(delay time.Duration, packet *Packet) []*Packet {
+	r.at = r.at.Add(delay)
+	data := packet.Serialize()
+	r.datagrams = append(r.datagrams, CapturedDatagram{Time: r.at, From: replayClientAddr, To: replayServerAddr, Payload: data})
+	before := len(r.sent)
+	r.handler.processIncomingData(data[:PACKET_HEADER_SIZE], data[PACKET_HEADER_SIZE:], replayClientAddr)
+	r.server.eventLoop.runTasks()
+	return r.sent[before:]
+}
+
+// handshake connects and returns the connection ID
+func (r *captureRecorder) handshake(isn uint32) uint64 {
+	replies := r.send(0, NewPacket(SYN_PACKET, SYN_FLAG, isn, 0, nil))
+	if len(replies) != 1 || !replies[0].HasSyn() {
+		r.t.Fatalf("Expected a SYN-ACK, got %v", replies)
+	}
+	id, _ := replies[0].ConnectionID()
+	ack := NewPacket(ACK_PACKET, ACK_FLAG, isn+1, replies[0].SeqNum+1, nil)
+	ack.SetConnectionID(id)
+	r.send(10*time.Millisecond, ack)
+	return id
+}
+
+// pcap writes the recorded datagrams as an Ethernet capture
+func (r *captureRecorder) pcap() *bytes.Buffer {
+	return writeTestCapture(r.datagrams)
+}
+
+func writeTestCapture(datagrams []CapturedDatagram) *bytes.Buffer {
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	b.Write(le.AppendUint32(nil, pcapMagicMicros))
+	b.Write([]byte{2, 0, 4, 0})
+	b.Write(make([]byte, 8))
+	b.Write(le.AppendUint32(nil, 65535))
+	b.Write(le.AppendUint32(nil, linkTypeEthernet))
+	for _, d := range datagrams {
+		frame := make([]byte, 14, 42+len(d.Payload))
+		binary.BigEndian.PutUint16(frame[12:], 0x0800)
+		ip := make([]byte, 20)
+		ip[0], ip[8], ip[9] = 0x45, 64, 17
+		binary.BigEndian.PutUint16(ip[2:], uint16(28+len(d.Payload)))
+		copy(ip[12:16], parseIPv4(d.From.IP))
+		copy(ip[16:20], parseIPv4(d.To.IP))
+		udp := make([]byte, 8)
+		binary.BigEndian.PutUint16(udp[0:], d.From.Port)
+		binary.BigEndian.PutUint16(udp[2:], d.To.Port)
+		binary.BigEndian.PutUint16(udp[4:], uint16(8+len(d.Payload)))
+		frame = append(append(append(frame, ip...), udp...), d.Payload...)
+
+		b.Write(le.AppendUint32(nil, uint32(d.Time.Unix())))
+		b.Write(le.AppendUint32(nil, uint32(d.Time.Nanosecond()/1000)))
+		b.Write(le.AppendUint32(nil, uint32(len(frame))))
+		b.Write(le.AppendUint32(nil, uint32(len(frame))))
+		b.Write(frame)
+	}
+	return &b
+}
+
+func TestReplayReproducesCapturedExchange(t *testing.T) {
+	recorder := newCaptureRecorder(t)
+	id := recorder.handshake(1000)
+	request := NewPacket(DATA_PACKET, 0, 1001, 0, buildGetRequest("/hello", replayServerAddr))
+	request.SetRequestID(1)
+	request.SetConnectionID(id)
+	replies := recorder.send(5*time.Millisecond, request)
+	if len(replies) != 2 {
+		t.Fatalf("Expected an ACK and a response, got %v", replies)
+	}
+	ack := NewPacket(ACK_PACKET, ACK_FLAG, 1002, replies[1].SeqNum+1, nil)
+	ack.SetConnectionID(id)
+	recorder.send(time.Millisecond, ack)
+	capture := recorder.pcap().Bytes()
+
+	var timelines []string
+	for i := 0; i < 2; i++ {
+		server := newReplayTestServer(t)
+		result, err := server.Replay(bytes.NewReader(capture), ReplayConfig{})
+		if err != nil {
+			t.Fatalf("Replay failed: %v", err)
+		}
+		if result.Fed != 4 || result.Skipped != 0 {
+			t.Errorf("Expected 4 datagrams fed and none skipped, got %d and %d", result.Fed, result.Skipped)
+		}
+		if diverged := result.Diverged(); len(diverged) > 0 {
+			t.Errorf("Expected the replay to match the capture, diverged in %v: %v, %v", diverged, result.Captured, result.Replayed)
+		}
+		var timeline []string
+		for _, event := range result.Events {
+			timeline = append(timeline, event.String())
+		}
+		timelines = append(timelines, strings.Join(timeline, "\n"))
+
+		// The handshake held up although this server's cookies differ
+		if stats := server.GetStats(); stats.ConnectionsActive != 1 {
+			t.Errorf("Expected the replayed connection established, got %d", stats.ConnectionsActive)
+		}
+		if !strings.Contains(timelines[i], "DATA [OPT]") || !strings.Contains(timelines[i], "0.015000s out 10.0.0.2:40000") {
+			t.Errorf("Expected the response at the request's capture time, got:\n%s", timelines[i])
+		}
+	}
+	if timelines[0] != timelines[1] {
+		t.Errorf("Expected replays to match each other:\n%s\n---\n%s", timelines[0], timelines[1])
+	}
+}
+
+func TestReplayFiresTimersOnVirtualTime(t *testing.T) {
+	recorder := newCaptureRecorder(t)
+	recorder.handshake(5000)
+	recorder.send(45*time.Second, NewPacket(ACK_PACKET, ACK_FLAG, 5001, 1, nil))
+
+	server := newReplayTestServer(t)
+	started := time.Now()
+	result, err := server.Replay(recorder.pcap(), ReplayConfig{Server: replayServerAddr})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("Expected virtual time to skip the idle gap, took %v", elapsed)
+	}
+	if !clockNow().After(started) || virtualTime.Load() != 0 {
+		t.Error("Expected the wall clock back after the replay")
+	}
+
+	// The capture has no FIN: the idle timeout only fires in the replay
+	var fin *ReplayEvent
+	for i, event := range result.Events {
+		if !event.Inbound && event.Packet.IsFinPacket() {
+			fin = &result.Events[i]
+		}
+	}
+	if fin == nil {
+		t.Fatalf("Expected the idle connection closed, got %v", result.Events)
+	}
+	if idle := defaultIdleTimeout; fin.At < idle || fin.At > idle+time.Second {
+		t.Errorf("Expected the FIN about %v in, got %v", idle, fin.At)
+	}
+	if diverged := result.Diverged(); len(diverged) != 1 || !strings.HasPrefix(diverged[0], "FIN") {
+		t.Errorf("Expected only the FIN diverging, got %v", diverged)
+	}
+}
+
+func TestReadCapture(t *testing.T) {
+	datagram := CapturedDatagram{Time: time.Unix(1700000000, 250000000), From: replayClientAddr, To: replayServerAddr, Payload: []byte("payload")}
+	capture := writeTestCapture([]CapturedDatagram{datagram, datagram}).Bytes()
+
+	// Make the second frame ARP
+	second := 24 + 16 + 42 + len(datagram.Payload) + 16
+	binary.BigEndian.PutUint16(capture[second+12:], 0x0806)
+
+	datagrams, skipped, err := ReadCapture(bytes.NewReader(capture))
+	if err != nil {
+		t.Fatalf("ReadCapture failed: %v", err)
+	}
+	if len(datagrams) != 1 || skipped != 1 {
+		t.Fatalf("Expected 1 datagram and 1 skipped, got %d and %d", len(datagrams), skipped)
+	}
+	got := datagrams[0]
+	if !got.Time.Equal(datagram.Time) || got.From != datagram.From || got.To != datagram.To || string(got.Payload) != "payload" {
+		t.Errorf("Expected %+v, got %+v", datagram, got)
+	}
+
+	pcapng := binary.LittleEndian.AppendUint32(make([]byte, 0, 24), pcapngMagic)
+	if _, _, err := ReadCapture(bytes.NewReader(append(pcapng, make([]byte, 20)...))); err == nil || !strings.Contains(err.Error(), "pcapng") {
+		t.Errorf("Expected pcapng refused, got %v", err)
+	}
+}
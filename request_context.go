@@ -0,0 +1,83 @@
+package ultrafast
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// defaultHandlerTimeout bounds how long a registered handler may run
+// before the server answers 503 on its behalf
+const defaultHandlerTimeout = 10 * time.Second
+
+// RequestInfo describes where a request came from. Handlers retrieve it
+// from their context with RequestInfoFromContext.
+type RequestInfo struct {
+	Peer         SocketAddr
+	RequestID    uint32 // 0 if the client did not tag the request
+	ConnectionID uint64 // 0 if the peer has no connection or no ID
+	EarlyData    bool   // the request arrived as 0-RTT data
+	Stateless    bool   // the request is answered without connection state
+	Received     time.Time
+}
+
+// requestInfoKey is the context key for RequestInfo
+type requestInfoKey struct{}
+
+// RequestInfoFromContext returns the request info stored in a handler's context
+func RequestInfoFromContext(ctx context.Context) (RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(RequestInfo)
+	return info, ok
+}
+
+// SetHandlerTimeout sets the deadline given to each handler's context.
+// A handler still running when it expires is abandoned and the client
+// gets 503 Service Unavailable. Zero disables the timeout.
+func (s *UltraFastHTTPServer) SetHandlerTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&s.handlerTimeout, int64(timeout))
+}
+
+// HandlerTimeout returns the per-request handler deadline
+func (s *UltraFastHTTPServer) HandlerTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.handlerTimeout))
+}
+
+// newRequestContext derives a request's context from its connection, so
+// closing the connection cancels the handler, and applies the handler
+// timeout
+func (h *HTTPSocketHandler) newRequestContext(conn *Connection, info RequestInfo) (context.Context, context.CancelFunc) {
+	parent := context.Background()
+	if conn != nil {
+		parent = conn.Context()
+		info.ConnectionID = conn.ID
+	}
+	ctx := context.WithValue(parent, requestInfoKey{}, info)
+
+	if timeout := h.server.HandlerTimeout(); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// runHandler runs a registered handler and waits for it to respond or for
+// its context to end. A handler that overruns its deadline is left to
+// finish in the background and the client gets 503 instead.
+func (h *HTTPSocketHandler) runHandler(ctx context.Context, handler RequestHandler, request *HTTPRequest) *HTTPResponse {
+	done := make(chan *HTTPResponse, 1)
+	go func() {
+		done <- h.callHandler(ctx, handler, request)
+	}()
+
+	select {
+	case response := <-done:
+		return response
+	case <-ctx.Done():
+		atomic.AddUint64(&h.server.stats.HandlerTimeouts, 1)
+		logWarnf("Handler for %s %s abandoned: %v", request.Method, request.Path, ctx.Err())
+		return &HTTPResponse{
+			StatusCode: 503,
+			Headers:    map[string]string{"Content-Type": "text/plain"},
+			Body:       []byte("Service Unavailable"),
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package ultrafast
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHandlerContext(t *testing.T) {
+	server := startTestServer(t)
+
+	infos := make(chan RequestInfo, 1)
+	server.HandleFunc("/whoami", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		info, _ := RequestInfoFromContext(ctx)
+		infos <- info
+		return &HTTPResponse{StatusCode: 200, Body: []byte(info.Peer.String())}
+	})
+
+	client := newTestClient(t, server)
+	if _, err := client.Get("/whoami"); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+
+	info := <-infos
+	if info.Peer.IP != "127.0.0.1" || info.Peer.Port == 0 {
+		t.Errorf("Expected a loopback peer, got %v", info.Peer)
+	}
+	if info.RequestID == 0 {
+		t.Error("Request ID should be carried in the context")
+	}
+	if id, _ := client.ConnectionID(); info.ConnectionID != id {
+		t.Errorf("Expected connection ID %x, got %x", id, info.ConnectionID)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	server := startTestServer(t)
+	server.SetHandlerTimeout(50 * time.Millisecond)
+
+	cancelled := make(chan error, 1)
+	server.HandleFunc("/slow", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return &HTTPResponse{StatusCode: 200}
+	})
+
+	client := newTestClient(t, server)
+	response, err := client.Get("/slow")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !containsString(string(response), "HTTP/1.1 503 Service Unavailable") {
+		t.Errorf("Expected 503 after the handler timeout, got %q", response)
+	}
+	if err := <-cancelled; err != context.DeadlineExceeded {
+		t.Errorf("Handler context should report DeadlineExceeded, got %v", err)
+	}
+	if server.GetStats().HandlerTimeouts != 1 {
+		t.Errorf("Expected 1 handler timeout, got %d", server.GetStats().HandlerTimeouts)
+	}
+}
+
+func TestHandlerCancelledOnClose(t *testing.T) {
+	table := NewConnectionTable()
+	peer := SocketAddr{IP: "10.1.1.1", Port: 1234}
+	conn, _ := table.GetOrCreate(peer)
+
+	ctx := conn.Context()
+	table.Remove(peer)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Removing a connection should cancel its context")
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	server := startTestServer(t)
+	errs := make(chan error, 1)
+	server.OnError(func(err error) { errs <- err })
+	server.HandleFunc("/panic", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		panic("boom")
+	})
+
+	client := newTestClient(t, server)
+	response, err := client.Get("/panic")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !containsString(string(response), "HTTP/1.1 500 Internal Server Error") {
+		t.Errorf("Expected 500 from a panicking handler, got %q", response)
+	}
+
+	var panicErr *HandlerPanicError
+	select {
+	case err := <-errs:
+		panicErr, _ = err.(*HandlerPanicError)
+	case <-time.After(time.Second):
+	}
+	if panicErr == nil || panicErr.Value != "boom" || panicErr.Path != "/panic" {
+		t.Fatalf("Expected the panic to reach the error callback, got %+v", panicErr)
+	}
+	if !containsString(string(panicErr.Stack), "TestHandlerPanic") {
+		t.Errorf("Stack should include the panicking handler:\n%s", panicErr.Stack)
+	}
+
+	// The server keeps serving
+	if response, err := client.Get("/benchmark"); err != nil || !containsString(string(response), "200 OK") {
+		t.Errorf("Expected the server to keep serving, got %q, %v", response, err)
+	}
+	if server.GetStats().HandlerPanics != 1 {
+		t.Errorf("Expected 1 handler panic, got %d", server.GetStats().HandlerPanics)
+	}
+}
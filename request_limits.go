@@ -0,0 +1,194 @@
+package ultrafast
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Request limit defaults
+const (
+	defaultMaxHeaderBytes = 8 * 1024
+	defaultMaxBodyBytes   = 1024 * 1024
+	defaultReceiveTimeout = 5 * time.Second
+	maxPartialRequests    = 16 // per connection
+	requestSweepInterval  = 100 * time.Millisecond
+)
+
+// RequestLimits bounds the requests the server accepts. Zero values take
+// the defaults.
+type RequestLimits struct {
+	MaxHeaderBytes int           // request line and headers, default 8KB
+	MaxBodyBytes   int           // default 1MB
+	ReceiveTimeout time.Duration // to receive every packet of a request, default 5s
+}
+
+// errRequestTooLarge is returned when a streamed request exceeds a limit
+var errRequestTooLarge = fmt.Errorf("request exceeds size limits")
+
+// partialRequest collects the fragments of a request sent over several
+// DATA packets
+type partialRequest struct {
+	data     []byte
+	received map[uint32]bool // fragment offsets already copied
+	filled   int
+	total    int
+	deadline time.Time
+}
+
+// SetRequestLimits replaces the request limits. A request over a size
+// limit is answered 413 and one not received in time 408; either way the
+// connection is reset, since the rest of its packets cannot be trusted.
+func (s *UltraFastHTTPServer) SetRequestLimits(limits RequestLimits) {
+	if limits.MaxHeaderBytes <= 0 {
+		limits.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if limits.MaxBodyBytes <= 0 {
+		limits.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if limits.ReceiveTimeout <= 0 {
+		limits.ReceiveTimeout = defaultReceiveTimeout
+	}
+	s.requestLimits.Store(&limits)
+}
+
+// RequestLimits returns the current request limits
+func (s *UltraFastHTTPServer) RequestLimits() RequestLimits {
+	return *s.requestLimits.Load()
+}
+
+// withinRequestLimits reports whether a complete request's headers and
+// body fit the limits
+func withinRequestLimits(data []byte, limits RequestLimits) bool {
+	headerEnd := bytes.Index(data, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		return len(data) <= limits.MaxHeaderBytes
+	}
+	headerEnd += 4
+	return headerEnd <= limits.MaxHeaderBytes && len(data)-headerEnd <= limits.MaxBodyBytes
+}
+
+// addRequestFragment adds a fragment to its request and returns the whole
+// request once every fragment has arrived. A non-zero status means the
+// request is refused.
+func (c *Connection) addRequestFragment(requestID, offset, total uint32, payload []byte,
+	limits RequestLimits, now time.Time) ([]byte, int) {
+	if total == 0 || total == FRAGMENT_TOTAL_OPEN {
+		return nil, 400
+	}
+	if int64(total) > int64(limits.MaxHeaderBytes)+int64(limits.MaxBodyBytes) {
+		return nil, 413
+	}
+	end := uint64(offset) + uint64(len(payload))
+	if end > uint64(total) {
+		return nil, 400
+	}
+
+	c.partialMu.Lock()
+	defer c.partialMu.Unlock()
+	if c.partialRequests == nil {
+		c.partialRequests = make(map[uint32]*partialRequest)
+	}
+	partial := c.partialRequests[requestID]
+	if partial == nil {
+		if len(c.partialRequests) >= maxPartialRequests {
+			return nil, 503
+		}
+		partial = &partialRequest{
+			received: make(map[uint32]bool),
+			total:    int(total),
+			deadline: now.Add(limits.ReceiveTimeout),
+		}
+		c.partialRequests[requestID] = partial
+	}
+	if partial.total != int(total) {
+		delete(c.partialRequests, requestID)
+		return nil, 400
+	}
+
+	// Retransmitted fragments are copied once
+	if !partial.received[offset] {
+		partial.received[offset] = true
+		if int(end) > len(partial.data) {
+			partial.data = append(partial.data, make([]byte, int(end)-len(partial.data))...)
+		}
+		partial.filled += copy(partial.data[offset:], payload)
+	}
+	if partial.filled < partial.total {
+		return nil, 0
+	}
+	delete(c.partialRequests, requestID)
+	return partial.data, 0
+}
+
+// expiredRequests drops the partial requests whose deadline has passed
+// and returns their IDs
+func (c *Connection) expiredRequests(now time.Time) []uint32 {
+	c.partialMu.Lock()
+	defer c.partialMu.Unlock()
+	var expired []uint32
+	for id, partial := range c.partialRequests {
+		if now.After(partial.deadline) {
+			expired = append(expired, id)
+			delete(c.partialRequests, id)
+		}
+	}
+	return expired
+}
+
+// receiveRequestFragment assembles a request sent over several packets and
+// serves it once complete. Only peers with a connection may fragment
+// requests, since reassembly keeps state for them.
+func (h *HTTPSocketHandler) receiveRequestFragment(packet *Packet, from SocketAddr, requestID uint32) {
+	conn := h.server.connections.Get(from)
+	if conn == nil || requestID == 0 {
+		h.rejectRequest(from, 413, requestID)
+		return
+	}
+
+	offset, total, _ := packet.Fragment()
+	data, status := conn.addRequestFragment(requestID, offset, total, packet.Payload,
+		h.server.RequestLimits(), clockNow())
+	switch {
+	case status == 503:
+		h.sendErrorResponse(from, status, getStatusText(status), requestID)
+	case status != 0:
+		h.rejectRequest(from, status, requestID)
+	case data != nil:
+		h.serveRequest(data, requestID, from, false)
+	}
+}
+
+// rejectRequest answers a request that broke a limit, then resets the
+// peer's connection
+func (h *HTTPSocketHandler) rejectRequest(to SocketAddr, statusCode int, requestID uint32) {
+	atomic.AddUint64(&h.server.stats.RequestsRejected, 1)
+	logDebugf("Rejecting request %d from %s:%d: %d %s", requestID, to.IP, to.Port,
+		statusCode, getStatusText(statusCode))
+	h.sendErrorResponse(to, statusCode, getStatusText(statusCode), requestID)
+	h.resetConnection(to)
+}
+
+// resetConnection sends RST to a peer and forgets its connection
+func (h *HTTPSocketHandler) resetConnection(peer SocketAddr) {
+	h.sendPacket(NewPacket(RST_PACKET, RST_FLAG, 0, 0, nil), peer)
+	h.dropConnection(peer)
+}
+
+// expireRequests answers 408 for a connection's requests whose fragments
+// stopped arriving, so a slow sender cannot hold reassembly buffers open
+func (s *UltraFastHTTPServer) expireRequests(h *HTTPSocketHandler, conn *Connection, now time.Time) {
+	expired := conn.expiredRequests(now)
+	if len(expired) == 0 {
+		return
+	}
+	peer := s.connections.PeerOf(conn)
+	s.eventLoop.Submit(func() {
+		for _, id := range expired {
+			atomic.AddUint64(&s.stats.RequestsRejected, 1)
+			h.sendErrorResponse(peer, 408, getStatusText(408), id)
+		}
+		h.resetConnection(peer)
+	})
+}
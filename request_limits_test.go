@@ -0,0 +1,119 @@
+package ultrafast
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithinRequestLimits(t *testing.T) {
+	limits := RequestLimits{MaxHeaderBytes: 64, MaxBodyBytes: 8}
+
+	tests := []struct {
+		request string
+		within  bool
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\n", true},
+		{"POST / HTTP/1.1\r\n\r\n12345678", true},
+		{"POST / HTTP/1.1\r\n\r\n123456789", false},
+		{"GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("x", 64) + "\r\n\r\n", false},
+		{"GET / HTTP/1.1\r\nX-Unterminated: " + strings.Repeat("x", 64), false},
+	}
+	for _, test := range tests {
+		if within := withinRequestLimits([]byte(test.request), limits); within != test.within {
+			t.Errorf("withinRequestLimits(%q) = %v, want %v", test.request, within, test.within)
+		}
+	}
+}
+
+func TestConnectionRequestFragments(t *testing.T) {
+	conn := &Connection{}
+	limits := RequestLimits{MaxHeaderBytes: 16, MaxBodyBytes: 16, ReceiveTimeout: time.Second}
+	now := time.Now()
+
+	// Out of order, with a retransmitted fragment
+	if data, status := conn.addRequestFragment(1, 4, 8, []byte("5678"), limits, now); data != nil || status != 0 {
+		t.Fatalf("Expected incomplete request, got %q status %d", data, status)
+	}
+	if data, status := conn.addRequestFragment(1, 4, 8, []byte("5678"), limits, now); data != nil || status != 0 {
+		t.Fatalf("Expected duplicate to be ignored, got %q status %d", data, status)
+	}
+	data, status := conn.addRequestFragment(1, 0, 8, []byte("1234"), limits, now)
+	if string(data) != "12345678" || status != 0 {
+		t.Fatalf("Expected assembled request, got %q status %d", data, status)
+	}
+
+	if _, status := conn.addRequestFragment(2, 0, 33, []byte("x"), limits, now); status != 413 {
+		t.Errorf("Expected 413 for oversized request, got %d", status)
+	}
+	if _, status := conn.addRequestFragment(3, 6, 8, []byte("xyz"), limits, now); status != 400 {
+		t.Errorf("Expected 400 for fragment past the total, got %d", status)
+	}
+
+	conn.addRequestFragment(4, 0, 8, []byte("1234"), limits, now)
+	if expired := conn.expiredRequests(now); len(expired) != 0 {
+		t.Errorf("Expected no expired requests yet, got %v", expired)
+	}
+	if expired := conn.expiredRequests(now.Add(2 * time.Second)); len(expired) != 1 || expired[0] != 4 {
+		t.Errorf("Expected request 4 to expire, got %v", expired)
+	}
+}
+
+func TestServerRequestLimits(t *testing.T) {
+	server := startTestServer(t)
+	server.HandleFunc("/echo", func(ctx context.Context, r *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: r.Body}
+	})
+
+	post := func(body string) []byte {
+		return []byte(fmt.Sprintf("POST /echo HTTP/1.1\r\nContent-Length: %d\r\n\r\n%s", len(body), body))
+	}
+
+	// A request spanning several packets is reassembled
+	body := strings.Repeat("0123456789", 500)
+	client := newTestClient(t, server)
+	response, err := client.Do(post(body))
+	if err != nil {
+		t.Fatalf("Fragmented request failed: %v", err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 200 OK\r\n") || !strings.HasSuffix(string(response), body) {
+		t.Fatalf("Expected echoed body, got %.80q", response)
+	}
+
+	// Over the body limit: 413, then the connection is reset
+	server.SetRequestLimits(RequestLimits{MaxBodyBytes: 1000})
+	response, err = client.Do(post(body))
+	if err != nil {
+		t.Fatalf("Oversized request failed: %v", err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 413 ") {
+		t.Errorf("Expected 413, got %.80q", response)
+	}
+
+	// A request whose remaining fragments never arrive times out with 408
+	server.SetRequestLimits(RequestLimits{ReceiveTimeout: 100 * time.Millisecond})
+	slow := newTestClient(t, server)
+	if err := slow.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	packets := slow.requestPackets(slow.newRequestID(), post(body))
+	if err := slow.send(packets[0]); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	reply, err := slow.receive(time.Now().Add(2*time.Second), func(p *Packet) bool { return p.IsDataPacket() })
+	if err != nil {
+		t.Fatalf("Expected 408 response: %v", err)
+	}
+	if !strings.HasPrefix(string(reply.Payload), "HTTP/1.1 408 ") {
+		t.Errorf("Expected 408, got %.80q", reply.Payload)
+	}
+	if _, err := slow.receive(time.Now().Add(time.Second), func(p *Packet) bool { return false }); err == nil ||
+		!strings.Contains(err.Error(), "reset") {
+		t.Errorf("Expected connection reset after timeout, got %v", err)
+	}
+	if server.GetStats().RequestsRejected != 2 {
+		t.Errorf("Expected 2 rejected requests, got %d", server.GetStats().RequestsRejected)
+	}
+}
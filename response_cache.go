@@ -0,0 +1,252 @@
+package ultrafast
+
+import (
+	"container/list"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ResponseCacheConfig sizes the response cache. Zero values take the defaults.
+type ResponseCacheConfig struct {
+	Capacity    int           // entries kept, default 1024
+	TTL         time.Duration // how long an entry is served, default 1s
+	MaxBodySize int           // larger responses are not cached, default 64KB
+}
+
+// ResponseCacheStats is a snapshot of cache activity
+type ResponseCacheStats struct {
+	Entries   int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+// cachedResponse is an immutable copy of a response held by the cache
+type cachedResponse struct {
+	key        string
+	statusCode int
+	headers    map[string]string
+	body       []byte
+	expires    time.Time
+}
+
+// ResponseCache is an LRU cache of GET responses keyed by method, host
+// and path, so hot endpoints are answered without running their handlers.
+// Only complete 200 responses built as an HTTPResponse are stored;
+// responses marked Cache-Control: no-store or private are skipped.
+type ResponseCache struct {
+	config ResponseCacheConfig
+
+	mu      sync.Mutex
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+
+	hits      uint64 // atomic
+	misses    uint64 // atomic
+	evictions uint64 // atomic
+}
+
+// NewResponseCache creates an empty cache
+func NewResponseCache(config ResponseCacheConfig) *ResponseCache {
+	if config.Capacity <= 0 {
+		config.Capacity = 1024
+	}
+	if config.TTL <= 0 {
+		config.TTL = time.Second
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = 64 * 1024
+	}
+	return &ResponseCache{
+		config:  config,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// responseCacheKey returns the cache key for a request, or "" if the
+// request is not cacheable. The virtual host is part of the key, since
+// hosts may answer the same path differently.
+func responseCacheKey(request *HTTPRequest) string {
+	if request.Method != "GET" && request.Method != "HEAD" {
+		return ""
+	}
+	return request.Method + " " + request.vhost + request.Path
+}
+
+// Get returns a copy of the cached response for a request
+func (c *ResponseCache) Get(request *HTTPRequest) (*HTTPResponse, bool) {
+	key := responseCacheKey(request)
+	if key == "" {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	element, exists := c.entries[key]
+	if exists && time.Now().After(element.Value.(*cachedResponse).expires) {
+		c.removeElement(element)
+		exists = false
+	}
+	if !exists {
+		c.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	entry := element.Value.(*cachedResponse)
+	c.mu.Unlock()
+
+	atomic.AddUint64(&c.hits, 1)
+	headers := make(map[string]string, len(entry.headers))
+	for name, value := range entry.headers {
+		headers[name] = value
+	}
+	return &HTTPResponse{StatusCode: entry.statusCode, Headers: headers, Body: entry.body}, true
+}
+
+// Put stores a response if it is cacheable
+func (c *ResponseCache) Put(request *HTTPRequest, response *HTTPResponse) {
+	key := responseCacheKey(request)
+	if key == "" || !c.cacheable(response) {
+		return
+	}
+
+	entry := &cachedResponse{
+		key:        key,
+		statusCode: response.StatusCode,
+		headers:    make(map[string]string, len(response.Headers)),
+		body:       append([]byte(nil), response.Body...),
+		expires:    time.Now().Add(c.config.TTL),
+	}
+	for name, value := range response.Headers {
+		entry.headers[name] = value
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, exists := c.entries[key]; exists {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.config.Capacity {
+		c.removeElement(c.lru.Back())
+		atomic.AddUint64(&c.evictions, 1)
+	}
+}
+
+// cacheable reports whether a response may be stored
+func (c *ResponseCache) cacheable(response *HTTPResponse) bool {
+	if response.StatusCode != 200 || response.writer != nil || response.file != nil ||
+		len(response.Body) > c.config.MaxBodySize {
+		return false
+	}
+	control := strings.ToLower(response.Headers["Cache-Control"])
+	return !strings.Contains(control, "no-store") && !strings.Contains(control, "private")
+}
+
+// removeElement drops an entry; c.mu must be held
+func (c *ResponseCache) removeElement(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*cachedResponse).key)
+}
+
+// Purge empties the cache
+func (c *ResponseCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// Config returns the cache's configuration
+func (c *ResponseCache) Config() ResponseCacheConfig {
+	return c.config
+}
+
+// Stats returns a snapshot of cache activity
+func (c *ResponseCache) Stats() ResponseCacheStats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+	return ResponseCacheStats{
+		Entries:   entries,
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+}
+
+// EnableResponseCache caches GET responses, replacing any existing cache
+func (s *UltraFastHTTPServer) EnableResponseCache(config ResponseCacheConfig) {
+	s.responseCache.Store(NewResponseCache(config))
+}
+
+// DisableResponseCache stops caching responses
+func (s *UltraFastHTTPServer) DisableResponseCache() {
+	s.responseCache.Store(nil)
+}
+
+// ResponseCache returns the response cache, or nil if caching is off
+func (s *UltraFastHTTPServer) ResponseCache() *ResponseCache {
+	return s.responseCache.Load()
+}
+
+// bodyETag derives a strong entity tag from a response body
+func bodyETag(body []byte) string {
+	hash := fnv.New64a()
+	hash.Write(body)
+	return `"` + strconv.FormatUint(hash.Sum64(), 16) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches etag. The
+// comparison is weak, as RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// tagResponse gives a successful GET response built in memory an ETag
+// derived from its body, unless the handler set one
+func tagResponse(request *HTTPRequest, response *HTTPResponse) {
+	if response.StatusCode != 200 || response.writer != nil || response.file != nil ||
+		(request.Method != "GET" && request.Method != "HEAD") {
+		return
+	}
+	if _, tagged := response.Headers["ETag"]; !tagged {
+		response.Headers["ETag"] = bodyETag(response.Body)
+	}
+}
+
+// checkNotModified replaces a response with 304 Not Modified when the
+// client's If-None-Match already names its ETag
+func checkNotModified(request *HTTPRequest, response *HTTPResponse) *HTTPResponse {
+	if response.StatusCode != 200 || response.writer != nil {
+		return response
+	}
+	etag := response.Headers["ETag"]
+	ifNoneMatch := request.Header("If-None-Match")
+	if etag == "" || ifNoneMatch == "" || !etagMatches(ifNoneMatch, etag) {
+		return response
+	}
+
+	notModified := &HTTPResponse{StatusCode: 304, Headers: map[string]string{"ETag": etag}}
+	for _, name := range []string{"Cache-Control", "Last-Modified", "Vary"} {
+		if value, exists := response.Headers[name]; exists {
+			notModified.Headers[name] = value
+		}
+	}
+	releaseResponse(response)
+	return notModified
+}
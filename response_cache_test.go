@@ -0,0 +1,102 @@
+package ultrafast
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheLRU(t *testing.T) {
+	cache := NewResponseCache(ResponseCacheConfig{Capacity: 2, TTL: 50 * time.Millisecond})
+	request := func(path string) *HTTPRequest { return &HTTPRequest{Method: "GET", Path: path} }
+	ok := func(body string) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: []byte(body)}
+	}
+
+	cache.Put(request("/a"), ok("a"))
+	cache.Put(request("/b"), ok("b"))
+	cache.Get(request("/a")) // /b is now least recently used
+	cache.Put(request("/c"), ok("c"))
+
+	if _, hit := cache.Get(request("/b")); hit {
+		t.Error("Least recently used entry should have been evicted")
+	}
+	if response, hit := cache.Get(request("/a")); !hit || string(response.Body) != "a" {
+		t.Error("Recently used entry should survive eviction")
+	}
+
+	cache.Put(&HTTPRequest{Method: "POST", Path: "/d"}, ok("d"))
+	cache.Put(request("/e"), &HTTPResponse{StatusCode: 200, Headers: map[string]string{"Cache-Control": "no-store"}})
+	cache.Put(request("/f"), &HTTPResponse{StatusCode: 404, Headers: map[string]string{}})
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Evictions != 1 {
+		t.Errorf("Uncacheable responses should not be stored: %+v", stats)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, hit := cache.Get(request("/a")); hit {
+		t.Error("Entries should expire after the TTL")
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		match  bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`*`, true},
+		{`"xyz"`, false},
+	}
+	for _, test := range tests {
+		if got := etagMatches(test.header, `"abc"`); got != test.match {
+			t.Errorf("etagMatches(%q) = %v, want %v", test.header, got, test.match)
+		}
+	}
+}
+
+func TestServerResponseCache(t *testing.T) {
+	server := startTestServer(t)
+	server.EnableResponseCache(ResponseCacheConfig{TTL: time.Minute})
+
+	var calls int32
+	server.HandleFunc("/hot", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		n := atomic.AddInt32(&calls, 1)
+		return &HTTPResponse{StatusCode: 200, Body: []byte(fmt.Sprintf("call %d", n))}
+	})
+
+	client := newTestClient(t, server)
+	first, err := client.Get("/hot")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	second, err := client.Get("/hot")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if atomic.LoadInt32(&calls) != 1 || string(first) != string(second) {
+		t.Errorf("Second request should be served from the cache (handler ran %d times)", atomic.LoadInt32(&calls))
+	}
+
+	headers, _ := splitResponse(t, first)
+	etag := bodyETag([]byte("call 1"))
+	if !containsString(headers, "ETag: "+etag) {
+		t.Fatalf("Expected ETag %s in %q", etag, headers)
+	}
+
+	conditional := []byte("GET /hot HTTP/1.1\r\nIf-None-Match: " + etag + "\r\n\r\n")
+	response, err := client.Do(conditional)
+	if err != nil {
+		t.Fatalf("Conditional request failed: %v", err)
+	}
+	if headers, body := splitResponse(t, response); !containsString(headers, "HTTP/1.1 304 Not Modified") || len(body) != 0 {
+		t.Errorf("Expected an empty 304 for a matching ETag, got %q", response)
+	}
+
+	if stats := server.ResponseCache().Stats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("Expected 2 hits and 1 miss, got %+v", stats)
+	}
+}
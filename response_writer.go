@@ -0,0 +1,247 @@
+package ultrafast
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Initial buffer sizes for pooled response writers; they grow as needed
+// and keep their capacity when returned to the pool
+const (
+	responseHeaderBufferSize = 512
+	responseBodyBufferSize   = 4096
+)
+
+// serverHeader is sent on every response
+const serverHeader = "UltraFastServer/1.0"
+
+// ResponseWriter builds an HTTP response in reusable byte buffers instead
+// of a header map and formatted strings. Writers come from a pool, so
+// serializing a response does not allocate once the buffers have grown to
+// fit. The Server and Content-Length headers are always set by the writer.
+type ResponseWriter struct {
+	response      HTTPResponse // handed to the server; points back at the writer
+	header        []byte       // "Name: value\r\n" lines
+	body          []byte
+	out           []byte // serialized response, rebuilt by Bytes
+	fileLength    int64  // body bytes sent from a file after out
+	status        int
+	wroteHeader   bool
+	hasConnection bool
+	hasEncoding   bool
+	contentType   string
+	keepAlive     bool // send "Connection: keep-alive" rather than close
+
+	sink      responseSink // set when the response can be streamed
+	streaming bool         // headers have been sent; the body is chunked
+	sendErr   error
+	sent      int64 // bytes handed to the sink
+}
+
+// WriterHandler handles a request by writing its response into w. The
+// writer is recycled once the response is sent and must not be kept.
+type WriterHandler func(ctx context.Context, w *ResponseWriter, r *HTTPRequest)
+
+var responseWriterPool = sync.Pool{
+	New: func() interface{} {
+		w := &ResponseWriter{
+			header: make([]byte, 0, responseHeaderBufferSize),
+			body:   make([]byte, 0, responseBodyBufferSize),
+		}
+		w.response.writer = w
+		return w
+	},
+}
+
+// acquireResponseWriter returns an empty writer from the pool
+func acquireResponseWriter() *ResponseWriter {
+	return responseWriterPool.Get().(*ResponseWriter)
+}
+
+// release resets the writer and returns it to the pool
+func (w *ResponseWriter) release() {
+	w.Reset()
+	responseWriterPool.Put(w)
+}
+
+// Reset clears the response while keeping the buffers
+func (w *ResponseWriter) Reset() {
+	w.header = w.header[:0]
+	w.body = w.body[:0]
+	w.out = w.out[:0]
+	w.fileLength = 0
+	w.status = 0
+	w.wroteHeader = false
+	w.hasConnection = false
+	w.hasEncoding = false
+	w.contentType = ""
+	w.keepAlive = false
+	w.sink = nil
+	w.streaming = false
+	w.sendErr = nil
+	w.sent = 0
+	w.response.StatusCode = 0
+}
+
+// Header adds a response header. Server and Content-Length are managed
+// by the writer and ignored here, as are headers added after Flush.
+func (w *ResponseWriter) Header(name, value string) {
+	if w.streaming || !w.headerName(name) {
+		return
+	}
+	if strings.EqualFold(name, "Content-Type") {
+		w.contentType = value
+	}
+	w.header = append(w.header, value...)
+	w.header = append(w.header, "\r\n"...)
+}
+
+// HeaderInt adds a header with an integer value, formatted without allocating
+func (w *ResponseWriter) HeaderInt(name string, value int64) {
+	if w.streaming || !w.headerName(name) {
+		return
+	}
+	w.header = strconv.AppendInt(w.header, value, 10)
+	w.header = append(w.header, "\r\n"...)
+}
+
+// headerName starts a header line, reporting false for managed headers
+func (w *ResponseWriter) headerName(name string) bool {
+	if strings.EqualFold(name, "Server") || strings.EqualFold(name, "Content-Length") {
+		return false
+	}
+	if strings.EqualFold(name, "Connection") {
+		w.hasConnection = true
+	}
+	if strings.EqualFold(name, "Content-Encoding") {
+		w.hasEncoding = true
+	}
+	w.header = append(w.header, name...)
+	w.header = append(w.header, ": "...)
+	return true
+}
+
+// WriteHeader sets the status code. Only the first call has any effect;
+// writing a body first implies 200 OK.
+func (w *ResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.status = statusCode
+	w.wroteHeader = true
+}
+
+// Write appends to the response body. When the response can be streamed,
+// a large buffered body is flushed as a chunk.
+func (w *ResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(200)
+	w.body = append(w.body, p...)
+	return len(p), w.flushFull()
+}
+
+// WriteString appends a string to the response body
+func (w *ResponseWriter) WriteString(s string) (int, error) {
+	w.WriteHeader(200)
+	w.body = append(w.body, s...)
+	return len(s), w.flushFull()
+}
+
+// flushFull flushes the body once it reaches the chunk size
+func (w *ResponseWriter) flushFull() error {
+	if w.sink != nil && len(w.body) >= chunkFlushSize {
+		return w.Flush()
+	}
+	return w.sendErr
+}
+
+// WriteInt appends a decimal integer to the response body
+func (w *ResponseWriter) WriteInt(value int64) {
+	w.WriteHeader(200)
+	w.body = strconv.AppendInt(w.body, value, 10)
+}
+
+// Status returns the status code, 200 if none was set
+func (w *ResponseWriter) Status() int {
+	if !w.wroteHeader {
+		return 200
+	}
+	return w.status
+}
+
+// Bytes serializes the response. The result is reused by the next call
+// and by Reset, so callers that keep it must copy it.
+func (w *ResponseWriter) Bytes() []byte {
+	out := appendStatusLine(w.out[:0], w.Status())
+	out = append(out, w.header...)
+	out = append(out, "Server: "+serverHeader+"\r\nContent-Length: "...)
+	out = strconv.AppendInt(out, int64(len(w.body))+w.fileLength, 10)
+	out = append(out, "\r\n"...)
+	out = w.appendConnection(out)
+	out = append(out, "\r\n"...)
+	out = append(out, w.body...)
+	w.out = out
+	return out
+}
+
+// appendConnection appends the Connection header, unless the handler set one
+func (w *ResponseWriter) appendConnection(dst []byte) []byte {
+	switch {
+	case w.hasConnection:
+		return dst
+	case w.keepAlive:
+		return append(dst, "Connection: keep-alive\r\n"...)
+	default:
+		return append(dst, "Connection: close\r\n"...)
+	}
+}
+
+// Response returns the writer as an HTTPResponse, for returning from a
+// RequestHandler. The server releases the writer after sending it.
+func (w *ResponseWriter) Response() *HTTPResponse {
+	w.response.StatusCode = w.Status()
+	return &w.response
+}
+
+// appendStatusLine appends "HTTP/1.1 <code> <text>\r\n"
+func appendStatusLine(dst []byte, statusCode int) []byte {
+	dst = append(dst, "HTTP/1.1 "...)
+	dst = strconv.AppendInt(dst, int64(statusCode), 10)
+	dst = append(dst, ' ')
+	dst = append(dst, getStatusText(statusCode)...)
+	return append(dst, "\r\n"...)
+}
+
+// HandleWriter registers a handler that writes its response into a
+// pooled ResponseWriter rather than building an HTTPResponse. The handler
+// may call Flush to stream its body with chunked transfer encoding.
+func (s *UltraFastHTTPServer) HandleWriter(path string, handler WriterHandler) {
+	s.router.HandleWriter(path, handler)
+}
+
+// HandleWriter registers a WriterHandler for an exact request path
+func (rt *Router) HandleWriter(path string, handler WriterHandler) {
+	rt.HandleFunc(path, func(ctx context.Context, r *HTTPRequest) *HTTPResponse {
+		w := acquireResponseWriter()
+		w.sink = r.sink
+		w.keepAlive = r.keepAlive
+		r.writer = w
+		handler(ctx, w, r)
+		return w.Response()
+	})
+}
+
+// releaseResponse returns a writer-backed response's buffers to the pool
+// and closes its file body
+func releaseResponse(response *HTTPResponse) {
+	if response == nil {
+		return
+	}
+	if response.file != nil {
+		response.file.Close()
+	}
+	if response.writer != nil {
+		response.writer.release()
+	}
+}
@@ -0,0 +1,76 @@
+package ultrafast
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResponseWriter(t *testing.T) {
+	w := acquireResponseWriter()
+	defer w.release()
+
+	w.WriteHeader(404)
+	w.WriteHeader(500) // ignored: the status is already set
+	w.Header("Content-Type", "text/plain")
+	w.Header("Content-Length", "999") // managed by the writer
+	w.HeaderInt("X-Items", 42)
+	w.WriteString("missing ")
+	w.WriteInt(7)
+
+	expected := "HTTP/1.1 404 Not Found\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"X-Items: 42\r\n" +
+		"Server: UltraFastServer/1.0\r\n" +
+		"Content-Length: 9\r\n" +
+		"Connection: close\r\n" +
+		"\r\n" +
+		"missing 7"
+	if got := string(w.Bytes()); got != expected {
+		t.Errorf("Unexpected serialization:\n%q\nwant\n%q", got, expected)
+	}
+
+	w.Reset()
+	w.Header("Connection", "keep-alive")
+	if got := string(w.Bytes()); got != "HTTP/1.1 200 OK\r\nConnection: keep-alive\r\n"+
+		"Server: UltraFastServer/1.0\r\nContent-Length: 0\r\n\r\n" {
+		t.Errorf("Reset writer should default to 200 and keep an explicit Connection, got %q", got)
+	}
+}
+
+func TestResponseWriterAllocations(t *testing.T) {
+	w := acquireResponseWriter()
+	defer w.release()
+	body := []byte("hello, world")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		w.Reset()
+		w.WriteHeader(200)
+		w.Header("Content-Type", "text/plain")
+		w.HeaderInt("X-Request-Count", 12345)
+		w.Write(body)
+		w.Bytes()
+	})
+	if allocs != 0 {
+		t.Errorf("Expected a warmed-up writer not to allocate, got %v allocations", allocs)
+	}
+}
+
+func TestServerHandleWriter(t *testing.T) {
+	server := startTestServer(t)
+	server.HandleWriter("/count", func(ctx context.Context, w *ResponseWriter, r *HTTPRequest) {
+		w.Header("Content-Type", "text/plain")
+		w.WriteString("count=")
+		w.WriteInt(3)
+	})
+
+	client := newTestClient(t, server)
+	response, err := client.Get("/count")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !containsString(string(response), "HTTP/1.1 200 OK") ||
+		!containsString(string(response), "Content-Length: 7\r\n") ||
+		!containsString(string(response), "\r\n\r\ncount=3") {
+		t.Errorf("Unexpected response %q", response)
+	}
+}
@@ -0,0 +1,95 @@
+package ultrafast
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// RetransmissionBudget bounds how long the server keeps retransmitting to
+// a peer that has stopped acknowledging. Zero values take the defaults.
+type RetransmissionBudget struct {
+	MaxRetries int           // retransmissions of one packet, default maxRetransmissions
+	MaxTime    time.Duration // retransmitting with no ACK since the first timeout, 0 for no limit
+}
+
+// SetRetransmissionBudget configures when a connection is given up on.
+// Once a packet has been retransmitted MaxRetries times, or MaxTime has
+// passed since the first unanswered timeout with no ACK arriving, the
+// server aborts the connection: it sends the peer a RST, frees the
+// connection's state and reports a *ConnAbortedError to the OnError
+// callback. The same error is returned by the connection's Err, and by
+// Read and Write on its stream.
+func (s *UltraFastHTTPServer) SetRetransmissionBudget(budget RetransmissionBudget) {
+	if budget.MaxRetries <= 0 {
+		budget.MaxRetries = maxRetransmissions
+	}
+	if budget.MaxTime < 0 {
+		budget.MaxTime = 0
+	}
+	s.connections.Reliability().SetRetransmissionBudget(budget)
+}
+
+// RetransmissionBudget returns the retransmission budget
+func (s *UltraFastHTTPServer) RetransmissionBudget() RetransmissionBudget {
+	return s.connections.Reliability().RetransmissionBudget()
+}
+
+// DeliveryFailureHandler receives a packet that was never acknowledged
+// and the peer it was sent to, the zero SocketAddr if it was sent
+// outside a connection
+type DeliveryFailureHandler func(packet *Packet, peer SocketAddr)
+
+// OnDeliveryFailure registers a handler for packets the server gives up
+// retransmitting past the retransmission budget, so the application
+// learns which data never arrived. The connection is then aborted as
+// SetRetransmissionBudget describes, and the packets it still had in
+// flight are reported too. The handler runs on a reliability worker or
+// the event loop and must not block. Passing nil removes it.
+func (s *UltraFastHTTPServer) OnDeliveryFailure(handler DeliveryFailureHandler) {
+	s.connections.Reliability().OnDeliveryFailure(handler)
+}
+
+// ConnAbortedError reports a connection the server reset because its
+// peer stopped acknowledging within the retransmission budget. It
+// matches ErrConnAborted and ErrConnClosed.
+type ConnAbortedError struct {
+	Peer        SocketAddr
+	ID          uint64 // connection ID, 0 if none was negotiated
+	Retransmits uint64 // packets retransmitted to the peer over the connection's life
+}
+
+func (e *ConnAbortedError) Error() string {
+	return fmt.Sprintf("connection to %s aborted: peer stopped acknowledging after %d retransmissions",
+		e.Peer, e.Retransmits)
+}
+
+func (e *ConnAbortedError) Is(target error) bool {
+	return target == ErrConnAborted || target == ErrConnClosed
+}
+
+// peerGone reports whether the reliability layer gave up on a packet to
+// the peer past the retransmission budget, so the peer is presumed dead
+func (c *Connection) peerGone() bool {
+	return atomic.LoadUint64(&c.reliability.packetsExpired) > 0
+}
+
+// abortConnection resets a connection whose peer stopped acknowledging,
+// unless it is already gone. The abort becomes the connection's Err
+// before it is dropped, so its requests and stream see why it ended.
+func (h *HTTPSocketHandler) abortConnection(conn *Connection) {
+	peer := h.server.connections.PeerOf(conn)
+	if h.server.connections.Get(peer) != conn {
+		return
+	}
+	err := &ConnAbortedError{
+		Peer:        peer,
+		ID:          conn.ID,
+		Retransmits: conn.Reliability().GetStats().PacketsRetransmitted,
+	}
+	atomic.AddUint64(&h.server.stats.ConnectionsReaped, 1)
+	conn.reliability.expireUnacked(true) // the rest in flight is undeliverable too
+	conn.cancel(err)
+	h.resetConnection(peer)
+	h.server.reportError(err)
+}
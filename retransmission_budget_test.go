@@ -0,0 +1,206 @@
+package ultrafast
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetransmissionBudgetRetries(t *testing.T) {
+	rel := NewLockFreeReliabilityLayer()
+	rel.SetRetransmissionBudget(RetransmissionBudget{MaxRetries: 2})
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, 1, 0, nil))
+
+	for i := 0; i < 2; i++ {
+		atomic.StoreUint64(&rel.timeoutBase, 0)
+		if timedOut := rel.GetTimedOutPackets(); len(timedOut) != 1 {
+			t.Fatalf("Retransmission %d: expected the packet, got %d", i+1, len(timedOut))
+		}
+	}
+
+	atomic.StoreUint64(&rel.timeoutBase, 0)
+	if timedOut := rel.GetTimedOutPackets(); len(timedOut) != 0 {
+		t.Fatalf("Expected no retransmission past 2 retries, got %d", len(timedOut))
+	}
+	if expired := rel.GetStats().PacketsExpired; expired != 1 {
+		t.Errorf("Expected the packet expired, got %d", expired)
+	}
+}
+
+func TestRetransmissionBudgetTime(t *testing.T) {
+	rel := NewLockFreeReliabilityLayer()
+	rel.SetRetransmissionBudget(RetransmissionBudget{MaxRetries: 100, MaxTime: 20 * time.Millisecond})
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, 1, 0, nil))
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, 2, 0, nil))
+
+	atomic.StoreUint64(&rel.timeoutBase, 0)
+	if timedOut := rel.GetTimedOutPackets(); len(timedOut) != 2 {
+		t.Fatalf("Expected both packets retransmitted, got %d", len(timedOut))
+	}
+
+	// An ACK shows the peer is alive and restarts the clock
+	time.Sleep(30 * time.Millisecond)
+	rel.HandleAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, 2, nil))
+	atomic.StoreUint64(&rel.timeoutBase, 0)
+	if timedOut := rel.GetTimedOutPackets(); len(timedOut) != 1 {
+		t.Fatalf("Expected the unacked packet retransmitted after an ACK, got %d", len(timedOut))
+	}
+
+	// Past the budget with no ACK every packet in flight is given up on,
+	// whether or not its own timeout came
+	time.Sleep(30 * time.Millisecond)
+	atomic.StoreUint64(&rel.timeoutBase, uint64(time.Hour))
+	if timedOut := rel.GetTimedOutPackets(); len(timedOut) != 0 {
+		t.Fatalf("Expected no retransmission past the time budget, got %d", len(timedOut))
+	}
+	if expired := rel.GetStats().PacketsExpired; expired != 1 || rel.UnackedCount() != 0 {
+		t.Errorf("Expected the packet expired and untracked, got %d expired with %d unacked",
+			expired, rel.UnackedCount())
+	}
+}
+
+func TestRetransmissionPerPacketBackoff(t *testing.T) {
+	start := time.Now()
+	defer setVirtualTime(time.Time{})
+	rel := NewLockFreeReliabilityLayer()
+	scanAt := func(elapsed time.Duration) int {
+		setVirtualTime(start.Add(elapsed))
+		return len(rel.GetTimedOutPackets())
+	}
+
+	var failed []*Packet
+	rel.OnDeliveryFailure(func(packet *Packet) { failed = append(failed, packet) })
+	rel.SetRetransmissionBudget(RetransmissionBudget{MaxRetries: 2})
+	setVirtualTime(start)
+	packet := NewPacket(DATA_PACKET, 0, 1, 0, nil)
+	rel.SendPacket(packet)
+
+	if n := scanAt(initialRTO + time.Millisecond); n != 1 {
+		t.Fatalf("Expected the packet to time out after the initial RTO, got %d", n)
+	}
+
+	// A fresh sample from other packets shortens the RTO, but this packet
+	// keeps waiting twice its last timeout
+	atomic.StoreUint64(&rel.timeoutBase, uint64(minRTO))
+	if n := scanAt(2 * initialRTO); n != 0 {
+		t.Fatalf("Expected the retransmitted packet backed off, got %d", n)
+	}
+	if n := scanAt(3*initialRTO + 2*time.Millisecond); n != 1 {
+		t.Fatalf("Expected the packet to time out after its own backoff, got %d", n)
+	}
+
+	// Out of retries, the packet is reported once its next timeout passes
+	if n := scanAt(5 * initialRTO); n != 0 || len(failed) != 0 {
+		t.Fatalf("Expected nothing before 4s of backoff, got %d and %d failed", n, len(failed))
+	}
+	if n := scanAt(7*initialRTO + 3*time.Millisecond); n != 0 || len(failed) != 1 || failed[0] != packet {
+		t.Fatalf("Expected the packet reported undeliverable, got %d and %v", n, failed)
+	}
+	if stats := rel.GetStats(); stats.PacketsExpired != 1 || rel.UnackedCount() != 0 {
+		t.Errorf("Expected the packet expired and untracked, got %d expired with %d unacked",
+			stats.PacketsExpired, rel.UnackedCount())
+	}
+}
+
+func TestReliabilityShardsDeliveryFailure(t *testing.T) {
+	shards := NewReliabilityShards(1)
+	shards.SetRetransmissionBudget(RetransmissionBudget{MaxRetries: 0})
+	type failure struct {
+		seq  uint32
+		peer SocketAddr
+	}
+	var failures []failure
+	shards.OnDeliveryFailure(func(packet *Packet, peer SocketAddr) {
+		failures = append(failures, failure{packet.SeqNum, peer})
+	})
+
+	conn := &Connection{}
+	peer := SocketAddr{IP: "127.0.0.1", Port: 9000}
+	shards.Attach(conn, peer)
+	conn.reliability.SendPacket(NewPacket(DATA_PACKET, 0, 7, 0, nil))
+	shards.Connectionless().SendPacket(NewPacket(DATA_PACKET, 0, 8, 0, nil))
+	atomic.StoreUint64(&conn.reliability.timeoutBase, 0)
+	atomic.StoreUint64(&shards.Connectionless().timeoutBase, 0)
+
+	if timedOut := shards.TimedOut(0); len(timedOut) != 0 {
+		t.Fatalf("Expected no retries allowed, got %d", len(timedOut))
+	}
+	if len(failures) != 2 {
+		t.Fatalf("Expected both packets reported, got %v", failures)
+	}
+	for _, f := range failures {
+		if (f.seq == 7 && f.peer != peer) || (f.seq == 8 && f.peer != SocketAddr{}) {
+			t.Errorf("Packet %d reported for the wrong peer %v", f.seq, f.peer)
+		}
+	}
+
+	// Dropping a closed connection's packets is no delivery failure
+	shards.OnDeliveryFailure(nil)
+	conn.reliability.SendPacket(NewPacket(DATA_PACKET, 0, 9, 0, nil))
+	shards.OnDeliveryFailure(func(*Packet, SocketAddr) { t.Error("Released packet reported") })
+	shards.Detach(conn)
+}
+
+func TestServerAbortsConnectionPastBudget(t *testing.T) {
+	server := startTestServer(t)
+	server.SetRetransmissionBudget(RetransmissionBudget{MaxTime: time.Second})
+	if budget := server.RetransmissionBudget(); budget.MaxRetries != maxRetransmissions || budget.MaxTime != time.Second {
+		t.Fatalf("Expected the default retries and a 1s limit, got %+v", budget)
+	}
+
+	reported := make(chan error, 1)
+	server.OnError(func(err error) { reported <- err })
+	readErr := make(chan error, 1)
+	server.OnConnection(func(conn *Connection) {
+		buffer := make([]byte, 16)
+		for {
+			if _, err := conn.Read(buffer); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	})
+
+	stream := dialTestStream(t, server)
+	if _, err := stream.Write([]byte("hi")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	waitForConnections(t, server, 1)
+	conn := server.connections.Snapshot()[0]
+	peer := server.connections.PeerOf(conn)
+	if conn.Err() != nil {
+		t.Fatalf("An open connection should have no error, got %v", conn.Err())
+	}
+
+	// The layer giving up on a packet aborts the connection
+	atomic.AddUint64(&conn.reliability.packetsExpired, 1)
+	waitForConnections(t, server, 0)
+
+	select {
+	case err := <-reported:
+		var aborted *ConnAbortedError
+		if !errors.As(err, &aborted) || aborted.Peer != peer {
+			t.Errorf("Expected a ConnAbortedError for %v, got %v", peer, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("The abort was not reported")
+	}
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, ErrConnAborted) || !errors.Is(err, ErrConnClosed) {
+			t.Errorf("Expected Read to fail with the abort, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Read did not return after the abort")
+	}
+
+	if !errors.Is(conn.Err(), ErrConnAborted) || !errors.Is(context.Cause(conn.Context()), ErrConnAborted) {
+		t.Errorf("Expected the connection's Err and context to carry the abort, got %v", conn.Err())
+	}
+	stats := server.GetStats()
+	if stats.ConnectionsReaped != 1 || stats.Errors != 0 {
+		t.Errorf("Expected 1 aborted connection and no errors, got %d and %d", stats.ConnectionsReaped, stats.Errors)
+	}
+}
@@ -0,0 +1,184 @@
+package ultrafast
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// prefixRoute maps every path under a prefix to a handler
+type prefixRoute struct {
+	prefix  string
+	handler RequestHandler
+}
+
+// Router maps request paths to handlers: exact paths first, then the
+// longest matching prefix. The server routes through its own Router
+// unless a virtual host matches the request's Host header.
+type Router struct {
+	mu           sync.RWMutex
+	routes       map[string]RequestHandler
+	prefixRoutes []prefixRoute // longest prefix first
+}
+
+// NewRouter creates an empty router
+func NewRouter() *Router {
+	return &Router{routes: make(map[string]RequestHandler)}
+}
+
+// HandleFunc registers a handler for an exact request path
+func (rt *Router) HandleFunc(path string, handler RequestHandler) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.routes[path] = handler
+}
+
+// HandlePrefix registers a handler for every path under prefix that has
+// no exact route. The longest matching prefix wins.
+func (rt *Router) HandlePrefix(prefix string, handler RequestHandler) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.addPrefix(prefix, handler)
+}
+
+// addPrefix registers a prefix route; the caller holds mu
+func (rt *Router) addPrefix(prefix string, handler RequestHandler) {
+	for i := range rt.prefixRoutes {
+		if rt.prefixRoutes[i].prefix == prefix {
+			rt.prefixRoutes[i].handler = handler
+			return
+		}
+	}
+	rt.prefixRoutes = append(rt.prefixRoutes, prefixRoute{prefix: prefix, handler: handler})
+	sort.Slice(rt.prefixRoutes, func(i, j int) bool {
+		return len(rt.prefixRoutes[i].prefix) > len(rt.prefixRoutes[j].prefix)
+	})
+}
+
+// replaceRoutes removes one set of routes and registers another under a
+// single lock, so no request sees a half-applied change
+func (rt *Router) replaceRoutes(old, routes []configuredRoute) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, route := range old {
+		if !route.prefix {
+			delete(rt.routes, route.path)
+			continue
+		}
+		for i := range rt.prefixRoutes {
+			if rt.prefixRoutes[i].prefix == route.path {
+				rt.prefixRoutes = append(rt.prefixRoutes[:i], rt.prefixRoutes[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, route := range routes {
+		if route.prefix {
+			rt.addPrefix(route.path, route.handler)
+		} else {
+			rt.routes[route.path] = route.handler
+		}
+	}
+}
+
+// route finds the registered handler for a request path, and the path
+// or prefix it was registered under
+func (rt *Router) route(path string) (RequestHandler, string, bool) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	if handler, exists := rt.routes[path]; exists {
+		return handler, path, true
+	}
+	for _, route := range rt.prefixRoutes {
+		if strings.HasPrefix(path, route.prefix) {
+			return route.handler, route.prefix, true
+		}
+	}
+	return nil, "", false
+}
+
+// Host returns the router for requests whose Host header names host,
+// creating it on first use. The port and letter case are ignored.
+func (s *UltraFastHTTPServer) Host(host string) *Router {
+	host = normalizeHost(host)
+	s.hostsMu.Lock()
+	defer s.hostsMu.Unlock()
+	router, exists := s.hosts[host]
+	if !exists {
+		router = NewRouter()
+		s.hosts[host] = router
+		s.purgeResponseCache()
+	}
+	return router
+}
+
+// RemoveHost stops serving a virtual host; its requests fall back to the
+// default host
+func (s *UltraFastHTTPServer) RemoveHost(host string) {
+	host = normalizeHost(host)
+	s.hostsMu.Lock()
+	defer s.hostsMu.Unlock()
+	delete(s.hosts, host)
+	if s.defaultHost == host {
+		s.defaultHost = ""
+	}
+	s.purgeResponseCache()
+}
+
+// SetDefaultHost makes a virtual host answer requests whose Host header
+// matches no other host, or that have none. An empty host restores the
+// server's own routes, including the built-in endpoints.
+func (s *UltraFastHTTPServer) SetDefaultHost(host string) {
+	host = normalizeHost(host)
+	if host != "" {
+		s.Host(host)
+	}
+	s.hostsMu.Lock()
+	defer s.hostsMu.Unlock()
+	s.defaultHost = host
+	s.purgeResponseCache()
+}
+
+// purgeResponseCache drops cached responses after the host mapping
+// changes, since they may have come from another router
+func (s *UltraFastHTTPServer) purgeResponseCache() {
+	if cache := s.responseCache.Load(); cache != nil {
+		cache.Purge()
+	}
+}
+
+// hostRouter picks the router for a request by its Host header and
+// returns the virtual host's name, or "" for the server's own router,
+// which also serves the built-in endpoints
+func (s *UltraFastHTTPServer) hostRouter(request *HTTPRequest) (*Router, string) {
+	s.hostsMu.RLock()
+	defer s.hostsMu.RUnlock()
+	if len(s.hosts) == 0 {
+		return s.router, ""
+	}
+	host := normalizeHost(request.Header("Host"))
+	if router, exists := s.hosts[host]; exists {
+		return router, host
+	}
+	if router, exists := s.hosts[s.defaultHost]; exists {
+		return router, s.defaultHost
+	}
+	return s.router, ""
+}
+
+// normalizeHost lower-cases a Host header and strips its port and any
+// trailing dot
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if strings.HasPrefix(host, "[") {
+		// IPv6 literal: "[::1]:8080"
+		if end := strings.IndexByte(host, ']'); end >= 0 {
+			return host[:end+1]
+		}
+		return host
+	}
+	if colon := strings.LastIndexByte(host, ':'); colon >= 0 {
+		host = host[:colon]
+	}
+	return strings.TrimSuffix(host, ".")
+}
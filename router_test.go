@@ -0,0 +1,75 @@
+package ultrafast
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := map[string]string{
+		"Example.COM":      "example.com",
+		"example.com:8080": "example.com",
+		"example.com.":     "example.com",
+		" api.example.com": "api.example.com",
+		"[::1]:8080":       "[::1]",
+		"127.0.0.1:80":     "127.0.0.1",
+		"":                 "",
+	}
+	for host, want := range tests {
+		if got := normalizeHost(host); got != want {
+			t.Errorf("normalizeHost(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestServerVirtualHosts(t *testing.T) {
+	server := startTestServer(t)
+	text := func(body string) RequestHandler {
+		return func(ctx context.Context, r *HTTPRequest) *HTTPResponse {
+			return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: []byte(body)}
+		}
+	}
+	server.HandleFunc("/", text("default site"))
+	server.Host("a.example").HandleFunc("/", text("site a"))
+	server.Host("B.example").HandlePrefix("/", text("site b"))
+	server.EnableResponseCache(ResponseCacheConfig{})
+	client := newTestClient(t, server)
+
+	get := func(host, path string) string {
+		t.Helper()
+		response, err := client.Do([]byte("GET " + path + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+		if err != nil {
+			t.Fatalf("GET %s%s failed: %v", host, path, err)
+		}
+		return string(response)
+	}
+
+	tests := []struct {
+		host, path, want string
+	}{
+		{"a.example", "/", "site a"},
+		{"a.example:9000", "/", "site a"},
+		{"b.example", "/", "site b"},
+		{"b.example", "/any/path", "site b"},
+		{"unknown.example", "/", "default site"},
+		{"unknown.example", "/benchmark", "Benchmark response"},
+		{"a.example", "/benchmark", "404 Not Found"}, // built-ins stay on the default host
+	}
+	for _, test := range tests {
+		if response := get(test.host, test.path); !strings.HasSuffix(response, test.want) &&
+			!strings.Contains(response, test.want) {
+			t.Errorf("GET %s%s: expected %q, got %q", test.host, test.path, test.want, response)
+		}
+	}
+
+	// A virtual host can take over as the fallback
+	server.SetDefaultHost("b.example")
+	if response := get("unknown.example", "/"); !strings.HasSuffix(response, "site b") {
+		t.Errorf("Expected fallback to site b, got %q", response)
+	}
+	server.RemoveHost("b.example")
+	if response := get("b.example", "/"); !strings.HasSuffix(response, "default site") {
+		t.Errorf("Expected removed host to fall back to the default site, got %q", response)
+	}
+}
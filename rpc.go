@@ -0,0 +1,467 @@
+package ultrafast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RPC: Go functions registered by name and called from a remote client
+// as if they were local. A call is a POST to RPCPath plus the method's
+// name, its arguments encoded by the codec its Content-Type names; the
+// transport's request ID correlates it with its result, so one
+// connection carries many calls at once. The caller's deadline travels
+// in an Rpc-Timeout header, and a call the caller abandons is cancelled
+// on the server with a request naming its ID in Rpc-Cancel.
+
+// RPCPath is the path prefix RPC calls are sent to
+const RPCPath = "/rpc/"
+
+// rpcPollInterval is how often a client checks for calls whose packets
+// need sending again
+const rpcPollInterval = 50 * time.Millisecond
+
+// RPC status codes, carried as the HTTP status of the response
+const (
+	RPC_BAD_REQUEST       = 400 // the arguments could not be decoded
+	RPC_UNKNOWN_METHOD    = 404
+	RPC_CANCELLED         = 499 // the caller cancelled the call
+	RPC_APPLICATION       = 500 // the method returned an error
+	RPC_DEADLINE_EXCEEDED = 504
+)
+
+// RPCError is an error reported by the server for a call: an error the
+// method returned, or a failure to run it
+type RPCError struct {
+	Code    int // one of the RPC status codes, or another HTTP status
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// Is makes a deadline the server enforced match context.DeadlineExceeded
+// and a cancelled call match context.Canceled
+func (e *RPCError) Is(target error) bool {
+	switch e.Code {
+	case RPC_DEADLINE_EXCEEDED:
+		return target == context.DeadlineExceeded
+	case RPC_CANCELLED:
+		return target == context.Canceled
+	}
+	return false
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// rpcMethod is a registered function
+type rpcMethod struct {
+	fn       reflect.Value
+	argsType reflect.Type
+}
+
+// rpcCallKey identifies a call in progress on the server: its request ID
+// on the caller's connection, or from the caller's address when the
+// request carried no connection ID
+type rpcCallKey struct {
+	conn      uint64
+	peer      SocketAddr
+	requestID uint32
+}
+
+// RPCServer dispatches RPC calls to registered functions
+type RPCServer struct {
+	mu      sync.RWMutex
+	methods map[string]*rpcMethod
+	codecs  map[string]RPCCodec // by content type
+
+	callsMu sync.Mutex
+	calls   map[rpcCallKey]context.CancelFunc // calls running, for Rpc-Cancel
+}
+
+// NewRPCServer creates an RPC server understanding JSONCodec and
+// BinaryCodec
+func NewRPCServer() *RPCServer {
+	s := &RPCServer{
+		methods: make(map[string]*rpcMethod),
+		codecs:  make(map[string]RPCCodec),
+		calls:   make(map[rpcCallKey]context.CancelFunc),
+	}
+	s.RegisterCodec(JSONCodec)
+	s.RegisterCodec(BinaryCodec)
+	return s
+}
+
+// RegisterCodec adds a codec calls may use, in addition to the built-in
+// ones
+func (s *RPCServer) RegisterCodec(codec RPCCodec) {
+	s.mu.Lock()
+	s.codecs[codec.ContentType()] = codec
+	s.mu.Unlock()
+}
+
+// Register makes fn callable as name. fn must have the form
+//
+//	func(ctx context.Context, args A) (R, error)
+//
+// for any types A and R the codecs can encode. The context ends when the
+// caller's deadline passes, the caller cancels or the connection closes.
+func (s *RPCServer) Register(name string, fn any) error {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.NumOut() != 2 ||
+		t.In(0) != contextType || t.Out(1) != errorType {
+		return fmt.Errorf("rpc method %s must be func(context.Context, A) (R, error), not %s", name, t)
+	}
+	if name == "" || strings.ContainsAny(name, "/? ") {
+		return fmt.Errorf("invalid rpc method name: %q", name)
+	}
+	s.mu.Lock()
+	s.methods[name] = &rpcMethod{fn: v, argsType: t.In(1)}
+	s.mu.Unlock()
+	return nil
+}
+
+// ServeRequest runs an RPC call. It is a RequestHandler, to register for
+// RPCPath:
+//
+//	server.HandlePrefix(ultrafast.RPCPath, rpc.ServeRequest)
+//
+// The server's handler timeout still bounds every call; raise it with
+// SetHandlerTimeout for methods that run longer.
+func (s *RPCServer) ServeRequest(ctx context.Context, r *HTTPRequest) *HTTPResponse {
+	info, _ := RequestInfoFromContext(ctx)
+	if id := r.Header("Rpc-Cancel"); id != "" {
+		if requestID, err := strconv.ParseUint(id, 10, 32); err == nil {
+			s.cancel(callKey(info, uint32(requestID)))
+		}
+		return &HTTPResponse{StatusCode: 204}
+	}
+	if r.Method != "POST" {
+		return rpcErrorResponse(405, "rpc calls must be POST")
+	}
+	name := strings.TrimPrefix(r.Path, RPCPath)
+
+	s.mu.RLock()
+	method := s.methods[name]
+	codec := s.codecs[r.Header("Content-Type")]
+	s.mu.RUnlock()
+	if codec == nil {
+		return rpcErrorResponse(415, "unsupported codec "+r.Header("Content-Type"))
+	}
+	if method == nil {
+		return rpcErrorResponse(RPC_UNKNOWN_METHOD, "unknown method "+name)
+	}
+	args := reflect.New(method.argsType)
+	if err := codec.Unmarshal(r.Body, args.Interface()); err != nil {
+		return rpcErrorResponse(RPC_BAD_REQUEST, "decoding arguments: "+err.Error())
+	}
+
+	var cancel context.CancelFunc
+	if timeout, err := strconv.ParseInt(r.Header("Rpc-Timeout"), 10, 64); err == nil && timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	if info.RequestID != 0 {
+		key := callKey(info, info.RequestID)
+		s.callsMu.Lock()
+		s.calls[key] = cancel
+		s.callsMu.Unlock()
+		defer func() {
+			s.callsMu.Lock()
+			delete(s.calls, key)
+			s.callsMu.Unlock()
+		}()
+	}
+
+	out := method.fn.Call([]reflect.Value{reflect.ValueOf(ctx), args.Elem()})
+	if err, _ := out[1].Interface().(error); err != nil {
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			return rpcErrorResponse(RPC_DEADLINE_EXCEEDED, err.Error())
+		case errors.Is(ctx.Err(), context.Canceled):
+			return rpcErrorResponse(RPC_CANCELLED, err.Error())
+		}
+		return rpcErrorResponse(RPC_APPLICATION, err.Error())
+	}
+	body, err := codec.Marshal(out[0].Interface())
+	if err != nil {
+		return rpcErrorResponse(RPC_APPLICATION, "encoding result: "+err.Error())
+	}
+	return &HTTPResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": codec.ContentType()},
+		Body:       body,
+	}
+}
+
+// callKey identifies the call with requestID from the peer info describes
+func callKey(info RequestInfo, requestID uint32) rpcCallKey {
+	if info.ConnectionID != 0 {
+		return rpcCallKey{conn: info.ConnectionID, requestID: requestID}
+	}
+	return rpcCallKey{peer: info.Peer, requestID: requestID}
+}
+
+// cancel ends a running call's context
+func (s *RPCServer) cancel(key rpcCallKey) {
+	s.callsMu.Lock()
+	cancel := s.calls[key]
+	s.callsMu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// rpcErrorResponse reports a failed call, the message as its body
+func rpcErrorResponse(code int, message string) *HTTPResponse {
+	return &HTTPResponse{
+		StatusCode: code,
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       []byte(message),
+	}
+}
+
+// rpcCall is a call a client is waiting on
+type rpcCall struct {
+	unacked map[uint32]*Packet // request packets by sequence number
+	sentAt  time.Time          // when the unacked packets last went out
+	done    chan []byte        // receives the raw response
+}
+
+// RPCClient calls methods on an RPCServer. It is safe for concurrent use;
+// calls from several goroutines share the connection and are answered in
+// whatever order they finish. Once the connection fails every call
+// returns the error, and a new client must be dialled.
+type RPCClient struct {
+	client *UltraFastClient
+	codec  RPCCodec
+
+	mu      sync.Mutex
+	seq     uint32 // next request packet's sequence number
+	nextID  uint32
+	calls   map[uint32]*rpcCall // by request ID
+	err     error               // why the connection failed, if it has
+	closed  bool
+	stopped chan struct{}
+}
+
+// DialRPC connects to the RPC server at server. A nil codec is JSONCodec.
+func DialRPC(server SocketAddr, codec RPCCodec) (*RPCClient, error) {
+	if codec == nil {
+		codec = JSONCodec
+	}
+	client, err := NewUltraFastClient(server.IP, server.Port)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Connect(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	rc := &RPCClient{
+		client:  client,
+		codec:   codec,
+		seq:     client.nextSeq,
+		nextID:  client.nextReqID,
+		calls:   make(map[uint32]*rpcCall),
+		stopped: make(chan struct{}),
+	}
+	go rc.receive()
+	return rc, nil
+}
+
+// Call calls method with args and decodes its result into reply, which
+// must be a pointer. ctx's deadline is sent along for the server to
+// enforce; if ctx ends first, Call returns its error and asks the server
+// to cancel the call. Errors from the server are *RPCError.
+func (rc *RPCClient) Call(ctx context.Context, method string, args, reply any) error {
+	body, err := rc.codec.Marshal(args)
+	if err != nil {
+		return fmt.Errorf("encoding arguments: %v", err)
+	}
+	request := fmt.Sprintf("POST %s%s HTTP/1.1\r\nHost: %s\r\nContent-Type: %s\r\nContent-Length: %d\r\n",
+		RPCPath, method, rc.client.server, rc.codec.ContentType(), len(body))
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return context.DeadlineExceeded
+		}
+		request += fmt.Sprintf("Rpc-Timeout: %d\r\n", (remaining+time.Millisecond-1)/time.Millisecond)
+	}
+
+	id, call, err := rc.start(append([]byte(request+"\r\n"), body...))
+	if err != nil {
+		return err
+	}
+	select {
+	case raw, ok := <-call.done:
+		if !ok {
+			rc.mu.Lock()
+			err := rc.err
+			rc.mu.Unlock()
+			return err
+		}
+		status, body, err := parseRawResponse(raw)
+		if err != nil {
+			return err
+		}
+		if status != 200 {
+			return &RPCError{Code: status, Message: string(body)}
+		}
+		if reply == nil {
+			return nil
+		}
+		return rc.codec.Unmarshal(body, reply)
+	case <-ctx.Done():
+		rc.abandon(id)
+		return ctx.Err()
+	}
+}
+
+// start registers a call and sends its request
+func (rc *RPCClient) start(request []byte) (uint32, *rpcCall, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return 0, nil, errUseOfClosed
+	}
+	if rc.err != nil {
+		return 0, nil, rc.err
+	}
+	id := rc.newRequestID()
+	call := &rpcCall{unacked: make(map[uint32]*Packet), sentAt: time.Now(), done: make(chan []byte, 1)}
+	for _, packet := range splitRequest(&rc.seq, id, request) {
+		call.unacked[packet.SeqNum] = packet
+		if err := rc.client.send(packet); err != nil {
+			return 0, nil, fmt.Errorf("rpc call failed: %v", err)
+		}
+	}
+	rc.calls[id] = call
+	return id, call, nil
+}
+
+// abandon forgets a call the caller stopped waiting for and asks the
+// server to cancel it. The cancellation is sent once; if it is lost the
+// call runs until its deadline.
+func (rc *RPCClient) abandon(id uint32) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, waiting := rc.calls[id]; !waiting || rc.closed || rc.err != nil {
+		return
+	}
+	delete(rc.calls, id)
+	request := fmt.Sprintf("POST %s HTTP/1.1\r\nHost: %s\r\nRpc-Cancel: %d\r\n\r\n", RPCPath, rc.client.server, id)
+	for _, packet := range splitRequest(&rc.seq, rc.newRequestID(), []byte(request)) {
+		rc.client.send(packet)
+	}
+}
+
+// newRequestID returns the next request ID; IDs are never 0. The caller
+// holds mu.
+func (rc *RPCClient) newRequestID() uint32 {
+	rc.nextID++
+	if rc.nextID == 0 {
+		rc.nextID = 1
+	}
+	return rc.nextID
+}
+
+// receive reads responses and acknowledgments until the client closes,
+// handing each response to its call and sending again request packets
+// the server has not acknowledged
+func (rc *RPCClient) receive() {
+	defer close(rc.stopped)
+	for {
+		packet, err := rc.client.receive(time.Now().Add(rpcPollInterval), func(p *Packet) bool {
+			return p.IsDataPacket() || p.IsAckPacket() || p.IsFinPacket()
+		})
+
+		rc.mu.Lock()
+		if rc.closed {
+			rc.mu.Unlock()
+			return
+		}
+		switch {
+		case err == errClientTimeout:
+			rc.retransmit()
+		case err != nil:
+			rc.fail(err)
+		case packet.IsFinPacket():
+			rc.fail(closedError("connection closed by server"))
+		case packet.IsAckPacket():
+			for _, call := range rc.calls {
+				for seq := range call.unacked {
+					if packet.acknowledges(seq, rc.seq) {
+						delete(call.unacked, seq)
+					}
+				}
+			}
+		default:
+			id, _ := packet.RequestID()
+			if call := rc.calls[id]; call != nil {
+				if response, complete := rc.client.assemble(id, packet); complete {
+					delete(rc.calls, id)
+					call.done <- append([]byte(nil), response...)
+				}
+			}
+		}
+		failed := rc.err != nil
+		rc.mu.Unlock()
+		if failed {
+			return
+		}
+	}
+}
+
+// retransmit sends again the request packets of calls the server has not
+// acknowledged within the client's timeout. The caller holds mu.
+func (rc *RPCClient) retransmit() {
+	now := time.Now()
+	for _, call := range rc.calls {
+		if len(call.unacked) == 0 || now.Sub(call.sentAt) < rc.client.timeout {
+			continue
+		}
+		call.sentAt = now
+		for _, packet := range call.unacked {
+			rc.client.send(packet)
+		}
+	}
+}
+
+// fail ends every waiting call with the error that broke the connection.
+// The caller holds mu.
+func (rc *RPCClient) fail(err error) {
+	rc.err = fmt.Errorf("rpc connection failed: %w", err)
+	for id, call := range rc.calls {
+		delete(rc.calls, id)
+		close(call.done)
+	}
+}
+
+// Close closes the connection. Calls still waiting return an error.
+func (rc *RPCClient) Close() error {
+	rc.mu.Lock()
+	if rc.closed {
+		rc.mu.Unlock()
+		return nil
+	}
+	rc.closed = true
+	rc.fail(errUseOfClosed)
+	rc.mu.Unlock()
+
+	<-rc.stopped
+	return rc.client.Close()
+}
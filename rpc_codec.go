@@ -0,0 +1,287 @@
+package ultrafast
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// RPCCodec serializes RPC arguments and results. The content type names
+// the codec on the wire, so the server answers in the codec a call used.
+type RPCCodec interface {
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec encodes with encoding/json, readable and usable from other
+// languages
+var JSONCodec RPCCodec = jsonCodec{}
+
+// BinaryCodec is a compact codec for Go callers on both ends. Values are
+// written in declaration order with no field names or type information:
+// integers as varints, floats as 8 bytes, strings, slices and maps with
+// a varint length, and pointers after a presence byte. Both ends must
+// use the same types. Empty slices and maps decode as nil. Interfaces,
+// channels and functions are refused.
+var BinaryCodec RPCCodec = binaryCodec{}
+
+// maxBinaryLength bounds a decoded length, so a corrupt length cannot
+// allocate more than the message could hold
+const maxBinaryLength = 64 * 1024 * 1024
+
+// jsonCodec is JSONCodec
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string                { return "application/json" }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// binaryCodec is BinaryCodec
+type binaryCodec struct{}
+
+func (binaryCodec) ContentType() string { return "application/x-ultrafast-rpc" }
+
+func (binaryCodec) Marshal(v any) ([]byte, error) {
+	return appendBinary(nil, reflect.ValueOf(v))
+}
+
+func (binaryCodec) Unmarshal(data []byte, v any) error {
+	target := reflect.ValueOf(v)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return fmt.Errorf("unmarshal needs a non-nil pointer, got %T", v)
+	}
+	d := binaryDecoder{data: data}
+	if err := d.decode(target.Elem()); err != nil {
+		return err
+	}
+	if len(d.data) != 0 {
+		return fmt.Errorf("%d bytes left over after decoding %T", len(d.data), v)
+	}
+	return nil
+}
+
+// appendBinary appends the binary encoding of v to dst
+func appendBinary(dst []byte, v reflect.Value) ([]byte, error) {
+	if !v.IsValid() {
+		return nil, fmt.Errorf("cannot encode a nil interface")
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(dst, 1), nil
+		}
+		return append(dst, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return binary.AppendVarint(dst, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return binary.AppendUvarint(dst, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return binary.BigEndian.AppendUint64(dst, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		dst = binary.AppendUvarint(dst, uint64(v.Len()))
+		return append(dst, v.String()...), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			dst = binary.AppendUvarint(dst, uint64(v.Len()))
+			return append(dst, v.Bytes()...), nil
+		}
+		dst = binary.AppendUvarint(dst, uint64(v.Len()))
+		fallthrough
+	case reflect.Array:
+		var err error
+		for i := 0; i < v.Len() && err == nil; i++ {
+			dst, err = appendBinary(dst, v.Index(i))
+		}
+		return dst, err
+	case reflect.Map:
+		dst = binary.AppendUvarint(dst, uint64(v.Len()))
+		var err error
+		for it := v.MapRange(); it.Next() && err == nil; {
+			if dst, err = appendBinary(dst, it.Key()); err == nil {
+				dst, err = appendBinary(dst, it.Value())
+			}
+		}
+		return dst, err
+	case reflect.Struct:
+		var err error
+		for i := 0; i < v.NumField() && err == nil; i++ {
+			if v.Type().Field(i).IsExported() {
+				dst, err = appendBinary(dst, v.Field(i))
+			}
+		}
+		return dst, err
+	case reflect.Pointer:
+		if v.IsNil() {
+			return append(dst, 0), nil
+		}
+		return appendBinary(append(dst, 1), v.Elem())
+	}
+	return nil, fmt.Errorf("cannot encode %s", v.Type())
+}
+
+// binaryDecoder reads values from the front of data
+type binaryDecoder struct {
+	data []byte
+}
+
+// decode reads into v, which must be settable
+func (d *binaryDecoder) decode(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := d.byte()
+		v.SetBool(b != 0)
+		return err
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, size := binary.Varint(d.data)
+		if size <= 0 {
+			return errShortBinary
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("%d overflows %s", n, v.Type())
+		}
+		d.data = d.data[size:]
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(n) {
+			return fmt.Errorf("%d overflows %s", n, v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		if len(d.data) < 8 {
+			return errShortBinary
+		}
+		v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(d.data)))
+		d.data = d.data[8:]
+	case reflect.String:
+		b, err := d.bytes()
+		v.SetString(string(b))
+		return err
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.bytes()
+			if len(b) == 0 {
+				v.SetZero()
+			} else {
+				v.SetBytes(append([]byte(nil), b...))
+			}
+			return err
+		}
+		n, err := d.length(minBinarySize(v.Type().Elem()))
+		if err != nil || n == 0 {
+			v.SetZero()
+			return err
+		}
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		for i := 0; i < n; i++ {
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		n, err := d.length(minBinarySize(v.Type().Key()) + minBinarySize(v.Type().Elem()))
+		if err != nil || n == 0 {
+			v.SetZero()
+			return err
+		}
+		v.Set(reflect.MakeMapWithSize(v.Type(), n))
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				if err := d.decode(v.Field(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Pointer:
+		present, err := d.byte()
+		if err != nil || present == 0 {
+			v.SetZero()
+			return err
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+		return d.decode(v.Elem())
+	default:
+		return fmt.Errorf("cannot decode %s", v.Type())
+	}
+	return nil
+}
+
+// minBinarySize is the fewest bytes a value of type t encodes to: none
+// for types without data, such as struct{}, and at least one otherwise
+func minBinarySize(t reflect.Type) int {
+	if t.Size() == 0 {
+		return 0
+	}
+	return 1
+}
+
+// errShortBinary is returned when a message ends inside a value
+var errShortBinary = fmt.Errorf("binary RPC message truncated")
+
+// byte reads one byte
+func (d *binaryDecoder) byte() (byte, error) {
+	if len(d.data) == 0 {
+		return 0, errShortBinary
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b, nil
+}
+
+// uvarint reads an unsigned varint
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	n, size := binary.Uvarint(d.data)
+	if size <= 0 {
+		return 0, errShortBinary
+	}
+	d.data = d.data[size:]
+	return n, nil
+}
+
+// length reads the length prefix of items that each encode to at least
+// minSize bytes, refusing one the rest of the message cannot hold
+func (d *binaryDecoder) length(minSize int) (int, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > maxBinaryLength || n*uint64(minSize) > uint64(len(d.data)) {
+		return 0, fmt.Errorf("binary RPC length %d too large", n)
+	}
+	return int(n), nil
+}
+
+// bytes reads a length-prefixed byte string, aliasing the message
+func (d *binaryDecoder) bytes() ([]byte, error) {
+	n, err := d.length(1)
+	if err != nil {
+		return nil, err
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b, nil
+}
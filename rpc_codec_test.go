@@ -0,0 +1,82 @@
+package ultrafast
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type codecSample struct {
+	Name    string
+	Count   int
+	Ratio   float64
+	Flags   []bool
+	Data    []byte
+	Labels  map[string]uint16
+	Next    *codecSample
+	Fixed   [2]int8
+	private int
+}
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	in := codecSample{
+		Name:   "root",
+		Count:  -12345,
+		Ratio:  0.25,
+		Flags:  []bool{true, false},
+		Data:   []byte{0, 1, 2},
+		Labels: map[string]uint16{"a": 1, "b": 65535},
+		Next:   &codecSample{Name: "leaf"},
+		Fixed:  [2]int8{-1, 1},
+	}
+	data, err := BinaryCodec.Marshal(in)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var out codecSample
+	if err := BinaryCodec.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Round trip changed the value:\n%+v\n%+v", in, out)
+	}
+
+	// No names or types on the wire, unlike JSON
+	jsonData, _ := JSONCodec.Marshal(in)
+	if len(data) >= len(jsonData)/2 {
+		t.Errorf("Binary encoding is %d bytes, JSON %d", len(data), len(jsonData))
+	}
+}
+
+func TestBinaryCodecRejects(t *testing.T) {
+	if _, err := BinaryCodec.Marshal(make(chan int)); err == nil {
+		t.Error("Expected an error encoding a channel")
+	}
+	var n int
+	if err := BinaryCodec.Unmarshal([]byte{2}, n); err == nil {
+		t.Error("Expected an error decoding into a non-pointer")
+	}
+
+	var small int8
+	data, _ := BinaryCodec.Marshal(300)
+	if err := BinaryCodec.Unmarshal(data, &small); err == nil || !strings.Contains(err.Error(), "overflows") {
+		t.Errorf("Expected an overflow error, got %v", err)
+	}
+
+	data, _ = BinaryCodec.Marshal(codecSample{Name: "truncated", Data: []byte("xyz")})
+	var out codecSample
+	for i := 0; i < len(data); i++ {
+		if err := BinaryCodec.Unmarshal(data[:i], &out); err == nil {
+			t.Fatalf("Expected an error for a message cut at %d of %d bytes", i, len(data))
+		}
+	}
+	if err := BinaryCodec.Unmarshal(append(data, 0), &out); err == nil {
+		t.Error("Expected an error for trailing bytes")
+	}
+
+	// A length no message of this size could hold allocates nothing
+	var huge []int
+	if err := BinaryCodec.Unmarshal([]byte{0xFF, 0xFF, 0xFF, 0x0F}, &huge); err == nil {
+		t.Error("Expected an error for an impossible length")
+	}
+}
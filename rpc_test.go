@@ -0,0 +1,202 @@
+package ultrafast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type addArgs struct {
+	A, B int
+}
+
+// startRPCServer runs a test server with an RPC server mounted on it
+func startRPCServer(t *testing.T) (*UltraFastHTTPServer, *RPCServer) {
+	t.Helper()
+	server := startTestServer(t)
+	rpc := NewRPCServer()
+	server.HandlePrefix(RPCPath, rpc.ServeRequest)
+	return server, rpc
+}
+
+// dialTestRPC connects an RPC client to a test server
+func dialTestRPC(t *testing.T, server *UltraFastHTTPServer, codec RPCCodec) *RPCClient {
+	t.Helper()
+	client, err := DialRPC(server.socket.GetLocalAddr(), codec)
+	if err != nil {
+		t.Fatalf("DialRPC failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestRPCCall(t *testing.T) {
+	server, rpc := startRPCServer(t)
+	rpc.Register("Add", func(ctx context.Context, args addArgs) (int, error) {
+		return args.A + args.B, nil
+	})
+	rpc.Register("Fail", func(ctx context.Context, reason string) (struct{}, error) {
+		return struct{}{}, errors.New(reason)
+	})
+
+	for _, codec := range []RPCCodec{JSONCodec, BinaryCodec} {
+		t.Run(codec.ContentType(), func(t *testing.T) {
+			client := dialTestRPC(t, server, codec)
+			var sum int
+			if err := client.Call(context.Background(), "Add", addArgs{2, 3}, &sum); err != nil || sum != 5 {
+				t.Fatalf("Expected 5, got %d, %v", sum, err)
+			}
+
+			var rpcErr *RPCError
+			err := client.Call(context.Background(), "Fail", "out of stock", nil)
+			if !errors.As(err, &rpcErr) || rpcErr.Code != RPC_APPLICATION || rpcErr.Message != "out of stock" {
+				t.Errorf("Expected the method's error, got %v", err)
+			}
+			err = client.Call(context.Background(), "Missing", 1, nil)
+			if !errors.As(err, &rpcErr) || rpcErr.Code != RPC_UNKNOWN_METHOD {
+				t.Errorf("Expected an unknown method error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRPCConcurrentCalls(t *testing.T) {
+	server, rpc := startRPCServer(t)
+	rpc.Register("Double", func(ctx context.Context, n int) (int, error) {
+		time.Sleep(time.Duration(n%5) * time.Millisecond) // finish out of order
+		return 2 * n, nil
+	})
+	client := dialTestRPC(t, server, BinaryCodec)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			var doubled int
+			if err := client.Call(context.Background(), "Double", n, &doubled); err != nil {
+				errs <- err
+			} else if doubled != 2*n {
+				errs <- fmt.Errorf("call %d answered %d", n, doubled)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestRPCDeadline(t *testing.T) {
+	server, rpc := startRPCServer(t)
+	sawDeadline := make(chan bool, 1)
+	rpc.Register("Slow", func(ctx context.Context, _ int) (int, error) {
+		_, ok := ctx.Deadline()
+		sawDeadline <- ok
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	client := dialTestRPC(t, server, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := client.Call(ctx, "Slow", 0, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to expire, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Call took %v despite a 100ms deadline", elapsed)
+	}
+	if !<-sawDeadline {
+		t.Error("The deadline should reach the method's context")
+	}
+}
+
+func TestRPCCancellation(t *testing.T) {
+	server, rpc := startRPCServer(t)
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	rpc.Register("Wait", func(ctx context.Context, _ int) (int, error) {
+		close(started)
+		select {
+		case <-ctx.Done():
+			cancelled <- ctx.Err()
+		case <-time.After(5 * time.Second):
+			cancelled <- nil
+		}
+		return 0, ctx.Err()
+	})
+	client := dialTestRPC(t, server, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	if err := client.Call(ctx, "Wait", 0, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the call to be cancelled, got %v", err)
+	}
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("The method's context should be cancelled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Cancelling the call did not reach the server")
+	}
+
+	// The connection carries calls after a cancellation
+	rpc.Register("Ping", func(ctx context.Context, _ int) (string, error) { return "pong", nil })
+	var reply string
+	if err := client.Call(context.Background(), "Ping", 0, &reply); err != nil || reply != "pong" {
+		t.Errorf("Expected pong, got %q, %v", reply, err)
+	}
+}
+
+func TestRPCRegisterRejectsSignatures(t *testing.T) {
+	rpc := NewRPCServer()
+	for _, fn := range []any{
+		func(int) (int, error) { return 0, nil },
+		func(context.Context, int) int { return 0 },
+		func(context.Context, int) (int, int) { return 0, 0 },
+		"not a function",
+	} {
+		if err := rpc.Register("Bad", fn); err == nil {
+			t.Errorf("Expected %T to be rejected", fn)
+		}
+	}
+	if err := rpc.Register("a/b", func(context.Context, int) (int, error) { return 0, nil }); err == nil {
+		t.Error("Expected a name with a slash to be rejected")
+	}
+}
+
+func TestRPCClientClose(t *testing.T) {
+	server, rpc := startRPCServer(t)
+	rpc.Register("Block", func(ctx context.Context, _ int) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	client := dialTestRPC(t, server, nil)
+
+	done := make(chan error, 1)
+	go func() { done <- client.Call(context.Background(), "Block", 0, nil) }()
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrConnClosed) {
+			t.Errorf("Expected a closed connection error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not end the waiting call")
+	}
+	if err := client.Call(context.Background(), "Block", 0, nil); err == nil {
+		t.Error("Calls after Close should fail")
+	}
+}
@@ -0,0 +1,90 @@
+package ultrafast
+
+import "time"
+
+// Retransmission timeout bounds, per RFC 6298. The floor is lower than the
+// RFC's one second since most peers of this server are on a LAN; the
+// ceiling is the RFC's 60 seconds, which exponential backoff stops at.
+const (
+	initialRTO          = 1 * time.Second
+	minRTO              = 100 * time.Millisecond
+	maxRTO              = 60 * time.Second
+	rtoClockGranularity = time.Millisecond
+)
+
+// maxRetransmissions is how many times a packet is retransmitted before
+// the peer is presumed gone, unless a RetransmissionBudget says otherwise;
+// with backoff from the floor that is about half a minute of silence
+const maxRetransmissions = 8
+
+// rttEstimator tracks the smoothed round-trip time and its variation as
+// RFC 6298 specifies. The zero value has seen no samples.
+type rttEstimator struct {
+	sampled bool
+	srtt    time.Duration
+	rttvar  time.Duration
+}
+
+// sample returns the estimate with one more measurement folded in, using
+// the RFC's gains of 1/8 for SRTT and 1/4 for RTTVAR. Under Karn's
+// algorithm, ACKs of retransmitted packets must not be sampled: there is
+// no telling which transmission they acknowledge.
+func (e rttEstimator) sample(r time.Duration) rttEstimator {
+	if !e.sampled {
+		return rttEstimator{sampled: true, srtt: r, rttvar: r / 2}
+	}
+
+	delta := e.srtt - r
+	if delta < 0 {
+		delta = -delta
+	}
+	return rttEstimator{
+		sampled: true,
+		srtt:    (7*e.srtt + r) / 8,
+		rttvar:  (3*e.rttvar + delta) / 4,
+	}
+}
+
+// rto returns SRTT + max(G, 4*RTTVAR) within the bounds, or the initial
+// timeout before any sample
+func (e rttEstimator) rto() time.Duration {
+	if !e.sampled {
+		return initialRTO
+	}
+	return clampRTO(e.srtt + max(rtoClockGranularity, 4*e.rttvar))
+}
+
+// backoffRTO doubles the timeout after a retransmission, up to maxRTO. It
+// stays backed off until a fresh sample recomputes it.
+func backoffRTO(rto time.Duration) time.Duration {
+	return clampRTO(2 * rto)
+}
+
+// clampRTO bounds a timeout to [minRTO, maxRTO]
+func clampRTO(rto time.Duration) time.Duration {
+	return min(max(rto, minRTO), maxRTO)
+}
+
+// pack encodes the estimate in one word so the lock-free layer can update
+// it with a single compare-and-swap: a sampled bit, then SRTT in 31 bits
+// and RTTVAR in 32 bits, both in microseconds
+func (e rttEstimator) pack() uint64 {
+	if !e.sampled {
+		return 0
+	}
+	srtt := min(uint64(e.srtt/time.Microsecond), 1<<31-1)
+	rttvar := min(uint64(e.rttvar/time.Microsecond), 1<<32-1)
+	return 1<<63 | srtt<<32 | rttvar
+}
+
+// unpackRTT decodes an estimate packed by pack
+func unpackRTT(word uint64) rttEstimator {
+	if word>>63 == 0 {
+		return rttEstimator{}
+	}
+	return rttEstimator{
+		sampled: true,
+		srtt:    time.Duration(word>>32&(1<<31-1)) * time.Microsecond,
+		rttvar:  time.Duration(word&(1<<32-1)) * time.Microsecond,
+	}
+}
@@ -0,0 +1,127 @@
+package ultrafast
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRTTEstimatorRFC6298(t *testing.T) {
+	var e rttEstimator
+	if e.rto() != initialRTO {
+		t.Errorf("Expected the initial RTO %v before any sample, got %v", initialRTO, e.rto())
+	}
+
+	// First sample: SRTT = R, RTTVAR = R/2
+	e = e.sample(200 * time.Millisecond)
+	if e.srtt != 200*time.Millisecond || e.rttvar != 100*time.Millisecond {
+		t.Errorf("Expected SRTT 200ms and RTTVAR 100ms, got %v and %v", e.srtt, e.rttvar)
+	}
+	if e.rto() != 600*time.Millisecond {
+		t.Errorf("Expected RTO 600ms, got %v", e.rto())
+	}
+
+	// RTTVAR = 3/4*100 + 1/4*|200-120|, SRTT = 7/8*200 + 1/8*120
+	e = e.sample(120 * time.Millisecond)
+	if e.srtt != 190*time.Millisecond || e.rttvar != 95*time.Millisecond {
+		t.Errorf("Expected SRTT 190ms and RTTVAR 95ms, got %v and %v", e.srtt, e.rttvar)
+	}
+	if e.rto() != 570*time.Millisecond {
+		t.Errorf("Expected RTO 570ms, got %v", e.rto())
+	}
+
+	// Steady tiny samples bottom out at the floor
+	for i := 0; i < 100; i++ {
+		e = e.sample(50 * time.Microsecond)
+	}
+	if e.rto() != minRTO {
+		t.Errorf("Expected RTO at the %v floor, got %v", minRTO, e.rto())
+	}
+
+	if got := unpackRTT(e.pack()); got.srtt != e.srtt.Truncate(time.Microsecond) ||
+		got.rttvar != e.rttvar.Truncate(time.Microsecond) || !got.sampled {
+		t.Errorf("Packing lost the estimate: %+v became %+v", e, got)
+	}
+	if unpackRTT(rttEstimator{}.pack()).sampled {
+		t.Error("An empty estimate should stay unsampled through packing")
+	}
+}
+
+func TestRTOBackoff(t *testing.T) {
+	rto := 400 * time.Millisecond
+	for _, expected := range []time.Duration{800 * time.Millisecond, 1600 * time.Millisecond, 3200 * time.Millisecond} {
+		if rto = backoffRTO(rto); rto != expected {
+			t.Fatalf("Expected backoff to %v, got %v", expected, rto)
+		}
+	}
+	if backoffRTO(45*time.Second) != maxRTO {
+		t.Errorf("Expected backoff capped at %v", maxRTO)
+	}
+}
+
+func TestLockFreeReliabilityKarn(t *testing.T) {
+	rel := NewLockFreeReliabilityLayer()
+	ack := func(seq uint32) {
+		if !rel.HandleAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, seq+1, nil)) {
+			t.Fatalf("ACK for %d was not matched", seq)
+		}
+	}
+
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, 1, 0, nil))
+	time.Sleep(time.Millisecond) // the estimate has microsecond resolution
+	ack(1)
+	first := rel.GetStats()
+	if first.RTTEstimate == 0 || first.TimeoutValue < minRTO {
+		t.Fatalf("Expected a sample and an RTO at or above the floor, got %+v", first)
+	}
+
+	// A timed out packet backs the RTO off once per scan
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, 2, 0, nil))
+	atomic.StoreUint64(&rel.timeoutBase, 0)
+	if timedOut := rel.GetTimedOutPackets(); len(timedOut) != 1 {
+		t.Fatalf("Expected 1 timed out packet, got %d", len(timedOut))
+	}
+	if rto := rel.GetStats().TimeoutValue; rto != minRTO {
+		t.Errorf("Expected backoff from 0 to reach the %v floor, got %v", minRTO, rto)
+	}
+	rel.backoffTimeout()
+	if rto := rel.GetStats().TimeoutValue; rto != 2*minRTO {
+		t.Errorf("Expected RTO doubled to %v, got %v", 2*minRTO, rto)
+	}
+
+	// Its ACK is ambiguous: no sample, and the backed off RTO stays
+	time.Sleep(5 * time.Millisecond)
+	ack(2)
+	if stats := rel.GetStats(); stats.RTTEstimate != first.RTTEstimate || stats.TimeoutValue != 2*minRTO {
+		t.Errorf("ACK of a retransmitted packet changed the estimate: %+v", stats)
+	}
+
+	// A fresh sample recomputes the RTO
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, 3, 0, nil))
+	ack(3)
+	if rto := rel.GetStats().TimeoutValue; rto == 2*minRTO {
+		t.Errorf("Expected a fresh sample to end the backoff, got %v", rto)
+	}
+}
+
+func TestReliabilityLayerKarn(t *testing.T) {
+	rel := NewReliabilityLayer()
+	sentAt := time.Now().Add(-20 * time.Millisecond)
+	rel.SendPacketWithTimestamp(NewPacket(DATA_PACKET, 0, 1, 0, nil), sentAt)
+	rel.HandleAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, 2, nil))
+	srtt := rel.GetAverageRTT()
+
+	rel.SendPacketWithTimestamp(NewPacket(DATA_PACKET, 0, 2, 0, nil), sentAt)
+	rel.SetRetransmissionTimeout(10 * time.Millisecond)
+	if len(rel.GetTimedOutPackets()) != 1 {
+		t.Fatal("Expected packet 2 to time out")
+	}
+	if rto := rel.GetRetransmissionTimeout(); rto != minRTO {
+		t.Errorf("Expected backoff to reach the %v floor, got %v", minRTO, rto)
+	}
+
+	rel.HandleAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, 3, nil))
+	if rel.GetAverageRTT() != srtt {
+		t.Errorf("ACK of a retransmitted packet changed SRTT from %v to %v", srtt, rel.GetAverageRTT())
+	}
+}
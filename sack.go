@@ -0,0 +1,226 @@
+package ultrafast
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Acknowledgments are cumulative, as in TCP: an ACK's AckNum is the next
+// sequence number its sender expects, so it acknowledges every packet
+// before that and one ACK covers a whole burst. Packets that arrived
+// beyond a gap are listed in SACK blocks (RFC 2018), so the sender
+// neither resends them nor waits for their ACKs to see the gap. The
+// connectionless layer is the exception: its peers share one sequence
+// space, so there an ACK acknowledges AckNum-1 alone.
+
+// OPT_SACK lists blocks of sequence numbers received beyond an ACK's
+// AckNum, each a 4-byte start and a 4-byte end one past its last packet
+const OPT_SACK = 0x0B
+
+// maxSACKBlocks is how many blocks one ACK carries
+const maxSACKBlocks = 4
+
+// maxTrackedRanges is how many ranges beyond the cumulative point a
+// receiver remembers; past that the highest are forgotten and their
+// packets resent
+const maxTrackedRanges = 16
+
+// ackTrackerSpan is how far from the cumulative point a packet is taken
+// to belong to the sequence space being tracked
+const ackTrackerSpan = 1 << 16
+
+// SACKBlock is a range of received sequence numbers, End exclusive
+type SACKBlock struct {
+	Start uint32
+	End   uint32
+}
+
+// contains reports whether seq lies in the block
+func (b SACKBlock) contains(seq uint32) bool {
+	return seq-b.Start < b.End-b.Start
+}
+
+// SetSACK attaches SACK blocks to an ACK, at most maxSACKBlocks of them
+func (p *Packet) SetSACK(blocks []SACKBlock) {
+	blocks = blocks[:min(len(blocks), maxSACKBlocks)]
+	value := make([]byte, 0, 8*len(blocks))
+	for _, block := range blocks {
+		value = binary.BigEndian.AppendUint32(value, block.Start)
+		value = binary.BigEndian.AppendUint32(value, block.End)
+	}
+	p.SetOption(OPT_SACK, value)
+}
+
+// SACK returns the packet's SACK blocks, nil if it carries none or they
+// are malformed
+func (p *Packet) SACK() []SACKBlock {
+	var buf [maxSACKBlocks]SACKBlock
+	return append([]SACKBlock(nil), p.sackBlocks(&buf)...)
+}
+
+// sackBlocks is SACK decoding into buf
+func (p *Packet) sackBlocks(buf *[maxSACKBlocks]SACKBlock) []SACKBlock {
+	value, exists := p.GetOption(OPT_SACK)
+	if !exists || len(value) == 0 || len(value)%8 != 0 || len(value) > 8*maxSACKBlocks {
+		return nil
+	}
+	blocks := buf[:0]
+	for ; len(value) > 0; value = value[8:] {
+		block := SACKBlock{Start: binary.BigEndian.Uint32(value), End: binary.BigEndian.Uint32(value[4:])}
+		if int32(block.End-block.Start) <= 0 {
+			return nil
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// acknowledges reports whether the ACK covers seq, a packet sent before
+// next: cumulatively, with AckNum past seq but not past next, or in one
+// of its SACK blocks
+func (p *Packet) acknowledges(seq, next uint32) bool {
+	if ahead := p.AckNum - seq; ahead > 0 && ahead <= next-seq {
+		return true
+	}
+	var buf [maxSACKBlocks]SACKBlock
+	for _, block := range p.sackBlocks(&buf) {
+		if block.contains(seq) {
+			return true
+		}
+	}
+	return false
+}
+
+// ackTracker builds the ACKs for the DATA packets from one peer: the
+// cumulative point, and SACK blocks for what arrived beyond it. Both
+// ends sync it to the peer's first sequence number at the handshake; a
+// tracker never synced learns it from the first packet.
+type ackTracker struct {
+	mu     sync.Mutex
+	synced bool
+	next   uint32      // every packet before it has arrived
+	ranges []SACKBlock // arrived beyond next, ascending and disjoint
+
+	// Unix nanoseconds by which the ACK held back must be sent, 0 if
+	// none is; read without the lock by flush
+	due atomic.Int64
+}
+
+// sync starts the tracker at next, the peer's first sequence number
+func (t *ackTracker) sync(next uint32) {
+	t.mu.Lock()
+	t.next, t.synced = next, true
+	t.ranges = t.ranges[:0]
+	t.due.Store(0)
+	t.mu.Unlock()
+}
+
+// expected returns the sequence number the tracker waits for next, and
+// whether it knows where the peer's numbers start
+func (t *ackTracker) expected() (uint32, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.next, t.synced
+}
+
+// ack records the arrival of seq and returns the ACK for it, with no
+// sequence number of its own, or nil if it is held back for up to
+// delay. Only an in-order packet with nothing missing is held, and only
+// while no other ACK is, so every second one is acknowledged at once as
+// RFC 1122 asks. A packet out of order, filling a gap or arriving again
+// is acknowledged at once, which gives the sender the duplicate ACKs
+// fast retransmit counts. One far outside the tracked window, such as
+// from a separate sequence space, is acknowledged by a SACK block of
+// its own.
+func (t *ackTracker) ack(seq uint32, delay time.Duration) *Packet {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.synced {
+		t.next, t.synced = seq, true
+	}
+
+	packet := NewPacket(ACK_PACKET, ACK_FLAG, 0, t.next, nil)
+	switch offset := seq - t.next; {
+	case offset == 0:
+		t.next++
+		if len(t.ranges) == 0 && delay > 0 && t.due.Load() == 0 {
+			t.due.Store(clockNow().Add(delay).UnixNano())
+			return nil
+		}
+		if len(t.ranges) > 0 && t.ranges[0].Start == t.next {
+			t.next = t.ranges[0].End
+			t.ranges = append(t.ranges[:0], t.ranges[1:]...)
+		}
+		packet.AckNum = t.next
+	case offset < ackTrackerSpan:
+		t.insert(seq)
+	case -offset > ackTrackerSpan:
+		packet.SetSACK([]SACKBlock{{Start: seq, End: seq + 1}})
+		return packet
+	}
+	t.due.Store(0) // this ACK covers the one held back
+	if len(t.ranges) > 0 {
+		packet.SetSACK(t.report(seq))
+	}
+	return packet
+}
+
+// flush returns the ACK held back once it is due at now, nil if none is
+func (t *ackTracker) flush(now time.Time) *Packet {
+	if due := t.due.Load(); due == 0 || now.UnixNano() < due {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if due := t.due.Load(); due == 0 || now.UnixNano() < due {
+		return nil // a later packet's ACK went out first
+	}
+	t.due.Store(0)
+	return NewPacket(ACK_PACKET, ACK_FLAG, 0, t.next, nil)
+}
+
+// insert adds seq, beyond next, to the ranges
+func (t *ackTracker) insert(seq uint32) {
+	offset := seq - t.next
+	i := 0
+	for i < len(t.ranges) && t.ranges[i].End-t.next < offset {
+		i++
+	}
+	switch {
+	case i < len(t.ranges) && t.ranges[i].contains(seq):
+	case i < len(t.ranges) && t.ranges[i].End == seq:
+		t.ranges[i].End++
+		if i+1 < len(t.ranges) && t.ranges[i+1].Start == t.ranges[i].End {
+			t.ranges[i].End = t.ranges[i+1].End
+			t.ranges = append(t.ranges[:i+1], t.ranges[i+2:]...)
+		}
+	case i < len(t.ranges) && t.ranges[i].Start == seq+1:
+		t.ranges[i].Start = seq
+	default:
+		t.ranges = append(t.ranges, SACKBlock{})
+		copy(t.ranges[i+1:], t.ranges[i:])
+		t.ranges[i] = SACKBlock{Start: seq, End: seq + 1}
+		if len(t.ranges) > maxTrackedRanges {
+			t.ranges = t.ranges[:maxTrackedRanges]
+		}
+	}
+}
+
+// report picks the blocks for an ACK: the one holding the packet just
+// received first, as RFC 2018 asks, then the highest of the others
+func (t *ackTracker) report(seq uint32) []SACKBlock {
+	blocks := make([]SACKBlock, 0, maxSACKBlocks)
+	for _, r := range t.ranges {
+		if r.contains(seq) {
+			blocks = append(blocks, r)
+		}
+	}
+	for i := len(t.ranges) - 1; i >= 0 && len(blocks) < maxSACKBlocks; i-- {
+		if !t.ranges[i].contains(seq) {
+			blocks = append(blocks, t.ranges[i])
+		}
+	}
+	return blocks
+}
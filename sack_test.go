@@ -0,0 +1,166 @@
+package ultrafast
+
+import (
+	"reflect"
+	"testing"
+)
+
+// sackPacket builds an ACK up to ackNum carrying blocks
+func sackPacket(ackNum uint32, blocks ...SACKBlock) *Packet {
+	packet := NewPacket(ACK_PACKET, ACK_FLAG, 0, ackNum, nil)
+	if len(blocks) > 0 {
+		packet.SetSACK(blocks)
+	}
+	return packet
+}
+
+func TestSACKOption(t *testing.T) {
+	blocks := []SACKBlock{{Start: 7, End: 9}, {Start: 0xFFFFFFFE, End: 2}}
+	packet, err := DeserializePacket(sackPacket(5, blocks...).Serialize())
+	if err != nil {
+		t.Fatalf("Failed to deserialize: %v", err)
+	}
+	if got := packet.SACK(); !reflect.DeepEqual(got, blocks) {
+		t.Errorf("Expected %v, got %v", blocks, got)
+	}
+
+	// Past maxSACKBlocks the rest are dropped
+	packet.SetSACK(make([]SACKBlock, maxSACKBlocks+2))
+	if value, _ := packet.GetOption(OPT_SACK); len(value) != 8*maxSACKBlocks {
+		t.Errorf("Expected %d blocks encoded, got %d bytes", maxSACKBlocks, len(value))
+	}
+
+	for _, value := range [][]byte{
+		{},
+		{0, 0, 0, 1, 0, 0, 0},
+		{0, 0, 0, 5, 0, 0, 0, 5}, // empty
+		{0, 0, 0, 5, 0, 0, 0, 4}, // backwards
+		make([]byte, 8*(maxSACKBlocks+1)),
+	} {
+		packet.SetOption(OPT_SACK, value)
+		if got := packet.SACK(); got != nil {
+			t.Errorf("Expected % x rejected, got %v", value, got)
+		}
+	}
+}
+
+func TestPacketAcknowledges(t *testing.T) {
+	ack := sackPacket(10, SACKBlock{Start: 12, End: 14})
+	tests := []struct {
+		seq, next uint32
+		acked     bool
+	}{
+		{9, 20, true},   // before AckNum
+		{10, 20, false}, // the next expected
+		{12, 20, true},  // in the SACK block
+		{14, 20, false}, // past it
+		{5, 8, false},   // AckNum past what was sent
+		{9, 10, true},   // AckNum exactly the next to send
+	}
+	for _, tt := range tests {
+		if got := ack.acknowledges(tt.seq, tt.next); got != tt.acked {
+			t.Errorf("acknowledges(%d, %d) = %v", tt.seq, tt.next, got)
+		}
+	}
+
+	// Across the wraparound
+	if !NewPacket(ACK_PACKET, ACK_FLAG, 0, 3, nil).acknowledges(0xFFFFFFFF, 4) {
+		t.Error("Expected a cumulative ACK to cover the packet before the wrap")
+	}
+}
+
+func TestLockFreeReliabilityCumulativeAck(t *testing.T) {
+	rel := NewLockFreeReliabilityLayer()
+	for i := 0; i < 8; i++ {
+		rel.SendPacket(NewPacket(DATA_PACKET, 0, rel.GetNextSeqNum(), 0, nil))
+	}
+
+	// One ACK for a burst, the window growing by one per packet
+	if !rel.HandleAck(sackPacket(5)) {
+		t.Fatal("Cumulative ACK was not matched")
+	}
+	if count, cwnd := rel.UnackedCount(), rel.GetStats().CongestionWindow; count != 4 || cwnd != 5 {
+		t.Errorf("Expected 4 packets left and cwnd 5, got %d and %d", count, cwnd)
+	}
+
+	// Selected packets beyond a gap
+	if !rel.HandleAck(sackPacket(5, SACKBlock{Start: 6, End: 8})) || rel.UnackedCount() != 2 {
+		t.Errorf("Expected packets 6 and 7 selected, %d left", rel.UnackedCount())
+	}
+
+	// Nothing new, and an AckNum past anything sent covers nothing
+	if rel.HandleAck(sackPacket(5, SACKBlock{Start: 6, End: 8})) || rel.HandleAck(sackPacket(100)) {
+		t.Error("Expected old and out-of-window ACKs ignored")
+	}
+	if !rel.HandleAck(sackPacket(9)) || rel.UnackedCount() != 0 {
+		t.Errorf("Expected everything acknowledged, %d left", rel.UnackedCount())
+	}
+}
+
+func TestConnectionlessAckIsSelective(t *testing.T) {
+	rel := NewReliabilityShards(1).Connectionless()
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, rel.GetNextSeqNum(), 0, nil))
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, rel.GetNextSeqNum(), 0, nil))
+
+	// Packet 1 went to another peer, whose ACK this is not
+	if !rel.HandleAck(sackPacket(3)) || rel.UnackedCount() != 1 {
+		t.Errorf("Expected only packet 2 acknowledged, %d left", rel.UnackedCount())
+	}
+}
+
+func TestReliabilityLayerCumulativeAck(t *testing.T) {
+	rel := NewReliabilityLayer()
+	for seq := uint32(1); seq <= 6; seq++ {
+		rel.SendPacket(NewPacket(DATA_PACKET, 0, seq, 0, nil))
+	}
+
+	if err := rel.HandleAck(sackPacket(3, SACKBlock{Start: 5, End: 6})); err != nil {
+		t.Fatalf("HandleAck failed: %v", err)
+	}
+	for seq, acked := range map[uint32]bool{1: true, 2: true, 3: false, 4: false, 5: true, 6: false} {
+		if rel.HasUnackedPacket(seq) == acked {
+			t.Errorf("Packet %d acknowledged: expected %v", seq, acked)
+		}
+	}
+	if cwnd := rel.GetCongestionWindow(); cwnd != 4 {
+		t.Errorf("Expected cwnd grown by 3, got %d", cwnd)
+	}
+}
+
+func TestAckTracker(t *testing.T) {
+	var tracker ackTracker
+	tests := []struct {
+		seq    uint32
+		ackNum uint32
+		blocks []SACKBlock
+	}{
+		{100, 101, nil}, // the first packet sets the start
+		{101, 102, nil},
+		{103, 102, []SACKBlock{{103, 104}}},
+		{106, 102, []SACKBlock{{106, 107}, {103, 104}}},
+		{105, 102, []SACKBlock{{105, 107}, {103, 104}}},
+		{104, 102, []SACKBlock{{103, 107}}},               // fills the gap between the ranges
+		{101, 102, []SACKBlock{{103, 107}}},               // a duplicate repeats the ACK
+		{102, 107, nil},                                   // fills the hole
+		{1 << 31, 107, []SACKBlock{{1 << 31, 1<<31 + 1}}}, // another sequence space
+	}
+	for _, tt := range tests {
+		ack := tracker.ack(tt.seq, 0)
+		if ack.AckNum != tt.ackNum || !reflect.DeepEqual(ack.SACK(), tt.blocks) {
+			t.Errorf("After %d: expected %d %v, got %d %v", tt.seq, tt.ackNum, tt.blocks, ack.AckNum, ack.SACK())
+		}
+	}
+
+	// Only so many ranges are remembered, the highest forgotten first
+	tracker.sync(0)
+	for seq := uint32(1); seq <= 2*maxTrackedRanges+1; seq += 2 {
+		tracker.ack(seq, 0)
+	}
+	ack := tracker.ack(1, 0)
+	if len(tracker.ranges) != maxTrackedRanges || tracker.ranges[maxTrackedRanges-1].Start != 2*maxTrackedRanges-1 {
+		t.Errorf("Expected %d ranges ending at %d, got %v", maxTrackedRanges, 2*maxTrackedRanges-1, tracker.ranges)
+	}
+	if blocks := ack.SACK(); len(blocks) != maxSACKBlocks || blocks[0] != (SACKBlock{1, 2}) {
+		t.Errorf("Expected the block just received first, got %v", blocks)
+	}
+}
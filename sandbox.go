@@ -0,0 +1,80 @@
+package ultrafast
+
+import "fmt"
+
+// SandboxAction selects what happens to a system call outside the sandbox
+type SandboxAction int
+
+const (
+	SANDBOX_DENY SandboxAction = iota // Fail it with EPERM (default)
+	SANDBOX_KILL                      // Kill the process
+	SANDBOX_LOG                       // Allow it, logging it to the kernel audit log
+)
+
+// ParseSandboxAction converts an action name into a SandboxAction
+func ParseSandboxAction(name string) (SandboxAction, error) {
+	switch name {
+	case "deny":
+		return SANDBOX_DENY, nil
+	case "kill":
+		return SANDBOX_KILL, nil
+	case "log":
+		return SANDBOX_LOG, nil
+	}
+	return 0, fmt.Errorf("unknown sandbox action: %s", name)
+}
+
+// SandboxConfig configures the seccomp sandbox
+type SandboxConfig struct {
+	// Syscalls allowed beyond those the data path needs, by name or
+	// number; for instance "socket" and "connect" to change the flow
+	// collector, or "execve" for live upgrades
+	ExtraSyscalls []string
+	Action        SandboxAction
+}
+
+// sandboxSyscalls are the system calls the Go runtime, the event loop,
+// the reliability workers and the admin socket make once the server's
+// sockets exist. Creating sockets, executing programs and changing
+// credentials are left out.
+var sandboxSyscalls = []string{
+	// Runtime: memory, threads, signals and timers
+	"mmap", "munmap", "madvise", "mprotect", "brk",
+	"clone", "clone3", "futex", "gettid", "getpid", "tgkill", "tkill", "rseq", "set_robust_list",
+	"rt_sigaction", "rt_sigprocmask", "rt_sigreturn", "sigaltstack",
+	"nanosleep", "clock_nanosleep", "clock_gettime", "gettimeofday",
+	"sched_yield", "sched_getaffinity", "setitimer", "timer_create", "timer_settime", "timer_delete",
+	"exit", "exit_group", "restart_syscall", "getrandom", "uname", "prlimit64",
+	// Files: static routes, config reloads and logging
+	"read", "write", "readv", "writev", "close", "pipe2", "fcntl", "ioctl",
+	"openat", "newfstatat", "fstat", "statx", "lseek", "pread64", "getdents64",
+	// Event loop
+	"epoll_create1", "epoll_ctl", "epoll_wait", "epoll_pwait", "epoll_pwait2", "eventfd2", "ppoll", "poll",
+	// Sockets in use
+	"recvfrom", "sendto", "recvmsg", "sendmsg", "recvmmsg", "sendmmsg",
+	"getsockopt", "setsockopt", "getsockname", "getpeername", "shutdown", "accept", "accept4",
+	"sendfile", "splice",
+}
+
+// SetSandbox has Start confine the process with a seccomp filter once the
+// server's sockets are in the event loop, just before it runs, allowing
+// the system calls the data path needs and config.ExtraSyscalls. The
+// filter covers every thread and cannot be lifted, so anything set up
+// afterwards that needs more, such as EnableFlowExport, must be listed.
+// Passing nil leaves the process unconfined.
+func (s *UltraFastHTTPServer) SetSandbox(config *SandboxConfig) {
+	s.sandbox.Store(config)
+}
+
+// applySandbox installs the sandbox configured with SetSandbox, if any
+func (s *UltraFastHTTPServer) applySandbox() error {
+	config := s.sandbox.Load()
+	if config == nil {
+		return nil
+	}
+	if err := installSandbox(config); err != nil {
+		return fmt.Errorf("failed to install sandbox: %v", err)
+	}
+	logInfof("Sandboxed to %d system calls", len(sandboxSyscalls)+len(config.ExtraSyscalls))
+	return nil
+}
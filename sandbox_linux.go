@@ -0,0 +1,131 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Offsets into struct seccomp_data, which seccomp filters read
+const (
+	seccompNrOffset   = 0
+	seccompArchOffset = 4
+)
+
+// seccompX32Bit marks x32 system calls, which share the x86-64 audit
+// architecture
+const seccompX32Bit = 0x40000000
+
+// maxSandboxSyscalls keeps every allow jump within a classic BPF jump's
+// 8-bit offset
+const maxSandboxSyscalls = 250
+
+// seccompProgram builds the classic BPF filter for config: system calls
+// of another architecture kill the process, the allowed ones proceed and
+// the rest meet config.Action
+func seccompProgram(config *SandboxConfig) ([]BPFInstruction, error) {
+	if seccompArch == 0 {
+		return nil, fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+	allowed := make(map[uint32]bool)
+	var numbers []uint32
+	allow := func(number uint32) {
+		if !allowed[number] {
+			allowed[number] = true
+			numbers = append(numbers, number)
+		}
+	}
+	for _, name := range sandboxSyscalls {
+		if number, ok := syscallNumbers[name]; ok { // not every architecture has them all
+			allow(number)
+		}
+	}
+	for _, name := range config.ExtraSyscalls {
+		number, ok := syscallNumbers[name]
+		if !ok {
+			n, err := strconv.ParseUint(name, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("unknown system call: %q", name)
+			}
+			number = uint32(n)
+		}
+		allow(number)
+	}
+	if len(numbers) > maxSandboxSyscalls {
+		return nil, fmt.Errorf("sandbox allows %d system calls, more than %d", len(numbers), maxSandboxSyscalls)
+	}
+
+	var otherwise uint32
+	switch config.Action {
+	case SANDBOX_DENY:
+		otherwise = unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+	case SANDBOX_KILL:
+		otherwise = unix.SECCOMP_RET_KILL_PROCESS
+	case SANDBOX_LOG:
+		otherwise = unix.SECCOMP_RET_LOG
+	default:
+		return nil, fmt.Errorf("invalid sandbox action: %d", config.Action)
+	}
+
+	program := []BPFInstruction{
+		{Op: bpfLdWAbs, K: seccompArchOffset},
+		{Op: bpfJeqK, K: seccompArch, Jt: 1, Jf: 0},
+		{Op: bpfRetK, K: unix.SECCOMP_RET_KILL_PROCESS},
+		{Op: bpfLdWAbs, K: seccompNrOffset},
+	}
+	if seccompArch == unix.AUDIT_ARCH_X86_64 {
+		// x32 system calls skip the comparisons to the default
+		program = append(program, BPFInstruction{Op: bpfJgeK, K: seccompX32Bit, Jt: uint8(len(numbers)), Jf: 0})
+	}
+	for i, number := range numbers {
+		// Past the remaining comparisons and the default return
+		program = append(program, BPFInstruction{Op: bpfJeqK, K: number, Jt: uint8(len(numbers) - i), Jf: 0})
+	}
+	program = append(program,
+		BPFInstruction{Op: bpfRetK, K: otherwise},
+		BPFInstruction{Op: bpfRetK, K: unix.SECCOMP_RET_ALLOW},
+	)
+	return program, nil
+}
+
+// installSandbox installs the seccomp filter for config on every thread
+// of the process. Without CAP_SYS_ADMIN the kernel requires no_new_privs,
+// which is set first and, like the filter, spreads to the other threads.
+func installSandbox(config *SandboxConfig) error {
+	program, err := seccompProgram(config)
+	if err != nil {
+		return err
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("PR_SET_NO_NEW_PRIVS: %v", err)
+	}
+	fprog := unix.SockFprog{
+		Len:    uint16(len(program)),
+		Filter: (*unix.SockFilter)(unsafe.Pointer(&program[0])),
+	}
+	// With TSYNC a positive return names a thread that could not be synced
+	r, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC,
+		uintptr(unsafe.Pointer(&fprog)))
+	runtime.KeepAlive(program)
+	if errno != 0 {
+		return fmt.Errorf("seccomp: %v", errno)
+	}
+	if r != 0 {
+		return fmt.Errorf("seccomp: thread %d could not be synchronized", r)
+	}
+	return nil
+}
+
+// checkSandbox reports whether a sandbox can be built for config
+func checkSandbox(config *SandboxConfig) error {
+	_, err := seccompProgram(config)
+	return err
+}
@@ -0,0 +1,117 @@
+//go:build linux && amd64
+
+package ultrafast
+
+import "golang.org/x/sys/unix"
+
+// seccompArch is the audit architecture of this build's system calls
+const seccompArch = unix.AUDIT_ARCH_X86_64
+
+// syscallNumbers names the system calls a sandbox can allow
+var syscallNumbers = map[string]uint32{
+	"accept":            unix.SYS_ACCEPT,
+	"accept4":           unix.SYS_ACCEPT4,
+	"bind":              unix.SYS_BIND,
+	"bpf":               unix.SYS_BPF,
+	"brk":               unix.SYS_BRK,
+	"chdir":             unix.SYS_CHDIR,
+	"chroot":            unix.SYS_CHROOT,
+	"clock_gettime":     unix.SYS_CLOCK_GETTIME,
+	"clock_nanosleep":   unix.SYS_CLOCK_NANOSLEEP,
+	"clone":             unix.SYS_CLONE,
+	"clone3":            unix.SYS_CLONE3,
+	"close":             unix.SYS_CLOSE,
+	"connect":           unix.SYS_CONNECT,
+	"dup":               unix.SYS_DUP,
+	"dup3":              unix.SYS_DUP3,
+	"epoll_create1":     unix.SYS_EPOLL_CREATE1,
+	"epoll_ctl":         unix.SYS_EPOLL_CTL,
+	"epoll_pwait":       unix.SYS_EPOLL_PWAIT,
+	"epoll_pwait2":      unix.SYS_EPOLL_PWAIT2,
+	"epoll_wait":        unix.SYS_EPOLL_WAIT,
+	"eventfd2":          unix.SYS_EVENTFD2,
+	"execve":            unix.SYS_EXECVE,
+	"execveat":          unix.SYS_EXECVEAT,
+	"exit":              unix.SYS_EXIT,
+	"exit_group":        unix.SYS_EXIT_GROUP,
+	"fchdir":            unix.SYS_FCHDIR,
+	"fcntl":             unix.SYS_FCNTL,
+	"fdatasync":         unix.SYS_FDATASYNC,
+	"fstat":             unix.SYS_FSTAT,
+	"fsync":             unix.SYS_FSYNC,
+	"ftruncate":         unix.SYS_FTRUNCATE,
+	"futex":             unix.SYS_FUTEX,
+	"getdents64":        unix.SYS_GETDENTS64,
+	"getpeername":       unix.SYS_GETPEERNAME,
+	"getpid":            unix.SYS_GETPID,
+	"getrandom":         unix.SYS_GETRANDOM,
+	"getsockname":       unix.SYS_GETSOCKNAME,
+	"getsockopt":        unix.SYS_GETSOCKOPT,
+	"gettid":            unix.SYS_GETTID,
+	"gettimeofday":      unix.SYS_GETTIMEOFDAY,
+	"ioctl":             unix.SYS_IOCTL,
+	"kill":              unix.SYS_KILL,
+	"listen":            unix.SYS_LISTEN,
+	"lseek":             unix.SYS_LSEEK,
+	"madvise":           unix.SYS_MADVISE,
+	"memfd_create":      unix.SYS_MEMFD_CREATE,
+	"mkdirat":           unix.SYS_MKDIRAT,
+	"mmap":              unix.SYS_MMAP,
+	"mount":             unix.SYS_MOUNT,
+	"mprotect":          unix.SYS_MPROTECT,
+	"munmap":            unix.SYS_MUNMAP,
+	"nanosleep":         unix.SYS_NANOSLEEP,
+	"newfstatat":        unix.SYS_NEWFSTATAT,
+	"openat":            unix.SYS_OPENAT,
+	"pipe2":             unix.SYS_PIPE2,
+	"poll":              unix.SYS_POLL,
+	"ppoll":             unix.SYS_PPOLL,
+	"prctl":             unix.SYS_PRCTL,
+	"pread64":           unix.SYS_PREAD64,
+	"prlimit64":         unix.SYS_PRLIMIT64,
+	"ptrace":            unix.SYS_PTRACE,
+	"read":              unix.SYS_READ,
+	"readv":             unix.SYS_READV,
+	"recvfrom":          unix.SYS_RECVFROM,
+	"recvmmsg":          unix.SYS_RECVMMSG,
+	"recvmsg":           unix.SYS_RECVMSG,
+	"renameat":          unix.SYS_RENAMEAT,
+	"restart_syscall":   unix.SYS_RESTART_SYSCALL,
+	"rseq":              unix.SYS_RSEQ,
+	"rt_sigaction":      unix.SYS_RT_SIGACTION,
+	"rt_sigprocmask":    unix.SYS_RT_SIGPROCMASK,
+	"rt_sigreturn":      unix.SYS_RT_SIGRETURN,
+	"sched_getaffinity": unix.SYS_SCHED_GETAFFINITY,
+	"sched_yield":       unix.SYS_SCHED_YIELD,
+	"seccomp":           unix.SYS_SECCOMP,
+	"sendfile":          unix.SYS_SENDFILE,
+	"sendmmsg":          unix.SYS_SENDMMSG,
+	"sendmsg":           unix.SYS_SENDMSG,
+	"sendto":            unix.SYS_SENDTO,
+	"set_robust_list":   unix.SYS_SET_ROBUST_LIST,
+	"setgid":            unix.SYS_SETGID,
+	"setgroups":         unix.SYS_SETGROUPS,
+	"setitimer":         unix.SYS_SETITIMER,
+	"setresgid":         unix.SYS_SETRESGID,
+	"setresuid":         unix.SYS_SETRESUID,
+	"setsockopt":        unix.SYS_SETSOCKOPT,
+	"setuid":            unix.SYS_SETUID,
+	"shutdown":          unix.SYS_SHUTDOWN,
+	"sigaltstack":       unix.SYS_SIGALTSTACK,
+	"socket":            unix.SYS_SOCKET,
+	"socketpair":        unix.SYS_SOCKETPAIR,
+	"splice":            unix.SYS_SPLICE,
+	"statx":             unix.SYS_STATX,
+	"tgkill":            unix.SYS_TGKILL,
+	"timer_create":      unix.SYS_TIMER_CREATE,
+	"timer_delete":      unix.SYS_TIMER_DELETE,
+	"timer_settime":     unix.SYS_TIMER_SETTIME,
+	"tkill":             unix.SYS_TKILL,
+	"umount2":           unix.SYS_UMOUNT2,
+	"uname":             unix.SYS_UNAME,
+	"unlinkat":          unix.SYS_UNLINKAT,
+	"wait4":             unix.SYS_WAIT4,
+	"waitid":            unix.SYS_WAITID,
+	"write":             unix.SYS_WRITE,
+	"writev":            unix.SYS_WRITEV,
+}
@@ -0,0 +1,9 @@
+//go:build linux && !amd64 && !arm64
+
+package ultrafast
+
+// seccompArch is unset: sandbox filters are only built for amd64 and arm64
+const seccompArch = 0
+
+// syscallNumbers is empty where sandboxes are unsupported
+var syscallNumbers = map[string]uint32{}
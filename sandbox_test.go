@@ -0,0 +1,95 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSeccompProgram(t *testing.T) {
+	if seccompArch == 0 {
+		t.Skip("no seccomp support on this architecture")
+	}
+	program, err := seccompProgram(&SandboxConfig{ExtraSyscalls: []string{"socket", "9999"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every allow jump must land on the final SECCOMP_RET_ALLOW
+	last := len(program) - 1
+	if program[last].K != unix.SECCOMP_RET_ALLOW || program[last-1].K != unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM) {
+		t.Fatalf("Unexpected returns %+v %+v", program[last-1], program[last])
+	}
+	allowed := make(map[uint32]bool)
+	for i, insn := range program {
+		if insn.Op == bpfJeqK && insn.Jt > 0 && i > 3 {
+			if i+1+int(insn.Jt) != last {
+				t.Errorf("Instruction %d jumps to %d, not the allow return", i, i+1+int(insn.Jt))
+			}
+			allowed[insn.K] = true
+		}
+	}
+	if !allowed[uint32(unix.SYS_SOCKET)] || !allowed[9999] || !allowed[uint32(unix.SYS_RECVMMSG)] {
+		t.Error("Expected the data path's and the extra system calls allowed")
+	}
+	if allowed[uint32(unix.SYS_EXECVE)] {
+		t.Error("execve should not be allowed by default")
+	}
+
+	if _, err := seccompProgram(&SandboxConfig{ExtraSyscalls: []string{"no_such_call"}}); err == nil {
+		t.Error("Expected an unknown system call to be refused")
+	}
+	if _, err := seccompProgram(&SandboxConfig{Action: 7}); err == nil {
+		t.Error("Expected an invalid action to be refused")
+	}
+}
+
+// TestSandbox runs a sandboxed server in a child process, since the
+// filter cannot be lifted once installed
+func TestSandbox(t *testing.T) {
+	if os.Getenv("SANDBOX_TEST_CHILD") == "1" {
+		runSandboxedServer(t)
+		return
+	}
+	if seccompArch == 0 {
+		t.Skip("no seccomp support on this architecture")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSandbox$", "-test.v")
+	cmd.Env = append(os.Environ(), "SANDBOX_TEST_CHILD=1")
+	output, err := cmd.CombinedOutput()
+	if err != nil || !strings.Contains(string(output), "--- PASS: TestSandbox") {
+		t.Fatalf("Sandboxed server failed: %v\n%s", err, output)
+	}
+}
+
+// runSandboxedServer serves a request under the sandbox, which must
+// refuse to create sockets
+func runSandboxedServer(t *testing.T) {
+	server, err := NewUltraFastHTTPServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client := newTestClient(t, server) // its socket must exist beforehand too
+	server.SetSandbox(&SandboxConfig{})
+	go server.Start()
+	for deadline := time.Now().Add(2 * time.Second); !server.Ready(); {
+		if time.Now().After(deadline) {
+			t.Fatal("Sandboxed server did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := client.Get("/benchmark"); err != nil {
+		t.Fatalf("Request under the sandbox failed: %v", err)
+	}
+	if _, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0); !errors.Is(err, unix.EPERM) {
+		t.Errorf("Expected socket creation refused with EPERM, got %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+package ultrafast
+
+import "fmt"
+
+// installSandbox is not supported on Windows
+func installSandbox(config *SandboxConfig) error {
+	return fmt.Errorf("seccomp is not supported on this platform")
+}
+
+// checkSandbox is not supported on Windows
+func checkSandbox(config *SandboxConfig) error {
+	return fmt.Errorf("seccomp is not supported on this platform")
+}
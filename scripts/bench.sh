@@ -0,0 +1,16 @@
+#!/bin/sh
+# Runs the benchmarks in a form benchstat can compare:
+#
+#   scripts/bench.sh > old.txt
+#   (make a change)
+#   scripts/bench.sh > new.txt
+#   benchstat old.txt new.txt
+#
+# BENCH selects benchmarks (default all), COUNT sets the repetitions
+# (default 10, enough for benchstat's significance test) and BENCHTIME is
+# passed to -benchtime.
+set -eu
+
+cd "$(dirname "$0")/.."
+exec go test -run '^$' -bench "${BENCH:-.}" -benchmem \
+	-count "${COUNT:-10}" -benchtime "${BENCHTIME:-1s}" .
@@ -0,0 +1,57 @@
+package ultrafast
+
+import "sync/atomic"
+
+// holdForWindow queues a DATA packet on the connection if its congestion
+// window is full, the pacer has no bandwidth for it, or earlier packets
+// still wait, and reports whether it did. Waiting packets leave in the
+// order of the connection's outboundQueue, which lets urgent responses
+// overtake bulk ones; they take their sequence numbers as they leave.
+func (c *Connection) holdForWindow(packet *Packet, pacer *Pacer) bool {
+	requestID, _ := packet.RequestID()
+	urgency := c.priority(requestID)
+
+	c.windowMu.Lock()
+	defer c.windowMu.Unlock()
+	if c.windowQueue.len() == 0 && c.reliability.CanSend() && pacer.Ready(c) {
+		return false
+	}
+	c.windowQueue.push(packet, requestID, urgency)
+	return true
+}
+
+// nextInWindow takes the next waiting packet if the window and the
+// pacer have room for it, or returns nil
+func (c *Connection) nextInWindow(pacer *Pacer) *Packet {
+	c.windowMu.Lock()
+	defer c.windowMu.Unlock()
+	if c.windowQueue.len() == 0 || !c.reliability.CanSend() || !pacer.Ready(c) {
+		return nil
+	}
+	return c.windowQueue.pop()
+}
+
+// windowQueued returns the number of packets waiting for the window
+func (c *Connection) windowQueued() int {
+	c.windowMu.Lock()
+	defer c.windowMu.Unlock()
+	return c.windowQueue.len()
+}
+
+// releaseWindow sends the packets waiting on a connection for as long as
+// its window and the pacer have room. A connection whose close was put off for them is
+// closed once they have all gone out.
+func (h *HTTPSocketHandler) releaseWindow(conn *Connection, peer SocketAddr) {
+	for {
+		packet := conn.nextInWindow(h.server.pacer.Load())
+		if packet == nil {
+			break
+		}
+		if _, err := h.transmitDataPacket(packet, conn, peer); err != nil {
+			atomic.AddUint64(&h.server.stats.Errors, 1)
+		}
+	}
+	if conn.windowQueued() == 0 {
+		h.closeAfterResponse(conn)
+	}
+}
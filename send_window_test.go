@@ -0,0 +1,72 @@
+package ultrafast
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLockFreeReliabilityBytesInFlight(t *testing.T) {
+	rel := NewLockFreeReliabilityLayer()
+	if !rel.CanSend() {
+		t.Fatal("An empty window should have room")
+	}
+
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, 1, 0, make([]byte, 100)))
+	if rel.BytesInFlight() != 100 || rel.CanSend() {
+		t.Fatalf("Expected 100 bytes in flight filling the initial window, got %d", rel.BytesInFlight())
+	}
+	rel.HandleAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, 2, nil))
+	if rel.BytesInFlight() != 0 || !rel.CanSend() {
+		t.Fatalf("Expected the ACK to empty the window, got %d bytes in flight", rel.BytesInFlight())
+	}
+
+	// A timed-out packet is presumed lost and leaves the window
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, 2, 0, make([]byte, 50)))
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, 3, 0, make([]byte, 70)))
+	atomic.StoreUint64(&rel.timeoutBase, 0)
+	rel.GetTimedOutPackets()
+	if rel.BytesInFlight() != 0 || !rel.CanSend() {
+		t.Fatalf("Expected timed-out packets out of flight, got %d bytes", rel.BytesInFlight())
+	}
+
+	// A late ACK for it is not counted twice
+	rel.HandleAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, 3, nil))
+	rel.SendPacket(NewPacket(DATA_PACKET, 0, 4, 0, make([]byte, 10)))
+	if stats := rel.GetStats(); stats.BytesInFlight != 10 {
+		t.Errorf("Expected 10 bytes in flight, got %d", stats.BytesInFlight)
+	}
+	rel.Release()
+	if rel.BytesInFlight() != 0 {
+		t.Errorf("Expected nothing in flight after release, got %d bytes", rel.BytesInFlight())
+	}
+}
+
+func TestServerQueuesBeyondCongestionWindow(t *testing.T) {
+	server := startTestServer(t)
+	body := bytes.Repeat([]byte("x"), 20*MAX_PAYLOAD_SIZE)
+	server.HandleFunc("/large", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: body}
+	})
+
+	client := newTestClient(t, server)
+	response, err := client.Do([]byte("GET /large HTTP/1.1\r\nConnection: close\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !strings.Contains(string(response), "200 OK") || !bytes.HasSuffix(response, body) {
+		t.Fatalf("Expected the whole body, got %d bytes", len(response))
+	}
+
+	// The window starts at one packet, so most of the response waited for
+	// ACKs; the FIN waits for it too, then the connection closes
+	if limited := server.GetStats().CongestionLimited; limited == 0 {
+		t.Error("Expected packets queued for the congestion window")
+	}
+	waitForConnections(t, server, 0)
+	if inFlight := server.reliability.GetStats().BytesInFlight; inFlight != 0 {
+		t.Errorf("Expected nothing in flight once closed, got %d bytes", inFlight)
+	}
+}
@@ -0,0 +1,167 @@
+package ultrafast
+
+import "sync/atomic"
+
+// defaultSendQueueLength bounds the outbound queue between handler
+// goroutines and the event loop
+const defaultSendQueueLength = 4096
+
+// sendQueueSlot holds one queued send. seq tells producers and the
+// consumer whose turn the slot is: it equals the slot's position while
+// free and position+1 once filled.
+type sendQueueSlot struct {
+	seq  atomic.Uint64
+	send func()
+}
+
+// SendQueue is a bounded lock-free multi-producer, single-consumer queue
+// carrying outbound sends from handler goroutines to the event loop.
+// Producers claim slots with a compare-and-swap on the tail; only the
+// loop reads, so the head is advanced by one goroutine. An eventfd wakes
+// the loop, written only when it is not already signaled.
+type SendQueue struct {
+	slots []sendQueueSlot
+	mask  uint64
+
+	_    [56]byte // keep the producers' tail off the consumer's cache line
+	tail atomic.Uint64
+	_    [56]byte
+	head atomic.Uint64 // written by the consumer only
+
+	eventFd  int
+	signaled atomic.Bool
+}
+
+// NewSendQueue creates a queue holding up to length sends, rounded up to
+// a power of two
+func NewSendQueue(length int) (*SendQueue, error) {
+	size := 1
+	for size < length {
+		size <<= 1
+	}
+
+	eventFd, err := newWakeFD()
+	if err != nil {
+		return nil, err
+	}
+
+	q := &SendQueue{
+		slots:   make([]sendQueueSlot, size),
+		mask:    uint64(size - 1),
+		eventFd: eventFd,
+	}
+	for i := range q.slots {
+		q.slots[i].seq.Store(uint64(i))
+	}
+	return q, nil
+}
+
+// Push queues a send for the event loop. It is safe to call from any
+// goroutine and reports false, queueing nothing, when the queue is full.
+func (q *SendQueue) Push(send func()) bool {
+	for {
+		pos := q.tail.Load()
+		slot := &q.slots[pos&q.mask]
+		switch diff := int64(slot.seq.Load() - pos); {
+		case diff == 0:
+			if q.tail.CompareAndSwap(pos, pos+1) {
+				slot.send = send
+				slot.seq.Store(pos + 1)
+				q.signal()
+				return true
+			}
+		case diff < 0:
+			return false // the consumer has not freed this slot yet
+		}
+		// Another producer claimed the slot first; try the next one
+	}
+}
+
+// signal wakes the consumer unless a wakeup is already pending
+func (q *SendQueue) signal() {
+	if q.signaled.CompareAndSwap(false, true) {
+		signalWakeFD(q.eventFd)
+	}
+}
+
+// pop removes the oldest send, or returns nil if none is ready. Only the
+// consumer may call it.
+func (q *SendQueue) pop() func() {
+	head := q.head.Load()
+	slot := &q.slots[head&q.mask]
+	if slot.seq.Load() != head+1 {
+		return nil
+	}
+	send := slot.send
+	slot.send = nil
+	slot.seq.Store(head + uint64(len(q.slots)))
+	q.head.Store(head + 1)
+	return send
+}
+
+// Drain runs queued sends on the calling goroutine, at most one queue's
+// worth so a busy producer cannot starve other events. It returns how many
+// ran. Only the consumer may call it.
+func (q *SendQueue) Drain() int {
+	// Clear the wakeup first: a push after this point signals again
+	clearWakeFD(q.eventFd)
+	q.signaled.Store(false)
+
+	ran := 0
+	for ran < len(q.slots) {
+		send := q.pop()
+		if send == nil {
+			return ran
+		}
+		send()
+		ran++
+	}
+
+	// Stopped at the limit; come back after other events
+	q.signal()
+	return ran
+}
+
+// Len returns the number of queued sends
+func (q *SendQueue) Len() int {
+	tail, head := q.tail.Load(), q.head.Load()
+	if tail < head {
+		return 0 // the consumer moved past a tail we read earlier
+	}
+	return int(tail - head)
+}
+
+// EventFD returns the descriptor that becomes readable when sends are queued
+func (q *SendQueue) EventFD() int {
+	return q.eventFd
+}
+
+// Close releases the eventfd; queued sends are dropped
+func (q *SendQueue) Close() error {
+	return closeWakeFD(q.eventFd)
+}
+
+// sendOnLoop hands a response prepared on a handler goroutine to the
+// event loop. When the send queue is full it falls back to the loop's
+// task queue, which takes a lock but has no bound.
+func (s *UltraFastHTTPServer) sendOnLoop(send func()) {
+	if !s.sendQueue.Push(send) {
+		atomic.AddUint64(&s.stats.SendQueueFull, 1)
+		s.eventLoop.Submit(send)
+	}
+}
+
+// OnRead drains the queue when the event loop sees the eventfd readable
+func (q *SendQueue) OnRead(fd int) error {
+	q.Drain()
+	return nil
+}
+
+// OnWrite is unused; the eventfd is only watched for reads
+func (q *SendQueue) OnWrite(fd int) error { return nil }
+
+// OnError is unused; eventfds do not fail once created
+func (q *SendQueue) OnError(fd int, err error) {}
+
+// OnClose is called when the eventfd leaves the event loop
+func (q *SendQueue) OnClose(fd int) {}
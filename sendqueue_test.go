@@ -0,0 +1,216 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestSendQueue creates a send queue closed at the end of the test
+func newTestSendQueue(tb testing.TB, length int) *SendQueue {
+	tb.Helper()
+
+	q, err := NewSendQueue(length)
+	if err != nil {
+		tb.Fatalf("Failed to create send queue: %v", err)
+	}
+	tb.Cleanup(func() { q.Close() })
+	return q
+}
+
+func TestSendQueueOrderAndBound(t *testing.T) {
+	q := newTestSendQueue(t, 3) // rounded up to 4
+
+	var order []int
+	for i := 0; i < 4; i++ {
+		if !q.Push(func() { order = append(order, i) }) {
+			t.Fatalf("Push %d failed with room left", i)
+		}
+	}
+	if q.Push(func() {}) {
+		t.Error("Push should fail when the queue is full")
+	}
+	if q.Len() != 4 {
+		t.Errorf("Expected 4 queued sends, got %d", q.Len())
+	}
+
+	if ran := q.Drain(); ran != 4 {
+		t.Errorf("Expected Drain to run 4 sends, ran %d", ran)
+	}
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("Sends ran out of order: %v", order)
+		}
+	}
+
+	// Slots are reused once drained
+	if !q.Push(func() {}) || q.Len() != 1 {
+		t.Error("Push should succeed after a drain")
+	}
+}
+
+func TestSendQueueWakeup(t *testing.T) {
+	q := newTestSendQueue(t, 16)
+	readable := func() bool {
+		fds := []syscall.EpollEvent{{Events: syscall.EPOLLIN, Fd: int32(q.EventFD())}}
+		epfd, err := syscall.EpollCreate1(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(epfd)
+		syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, q.EventFD(), &fds[0])
+		n, _ := syscall.EpollWait(epfd, fds, 0)
+		return n == 1
+	}
+
+	if readable() {
+		t.Fatal("Empty queue should not be signaled")
+	}
+	q.Push(func() {})
+	q.Push(func() {})
+	if !readable() {
+		t.Fatal("Push should make the eventfd readable")
+	}
+	q.Drain()
+	if readable() {
+		t.Error("Drain should clear the eventfd")
+	}
+}
+
+func TestSendQueueConcurrentProducers(t *testing.T) {
+	q := newTestSendQueue(t, 64)
+	el := newTestEventLoop(t)
+	if err := el.AddFD(q.EventFD(), q); err != nil {
+		t.Fatalf("AddFD failed: %v", err)
+	}
+	go el.Run()
+
+	const producers, perProducer = 8, 2000
+	seen := make([]int, producers*perProducer) // only touched on the loop
+	done := make(chan struct{})
+	remaining := len(seen)
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				id := p*perProducer + i
+				send := func() {
+					seen[id]++
+					if remaining--; remaining == 0 {
+						close(done)
+					}
+				}
+				for !q.Push(send) {
+					time.Sleep(10 * time.Microsecond) // full: let the loop drain
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Loop did not run every send")
+	}
+	for id, count := range seen {
+		if count != 1 {
+			t.Fatalf("Send %d ran %d times", id, count)
+		}
+	}
+}
+
+// The send queue against the baseline it replaces, the loop's
+// mutex-guarded task queue, and a buffered channel. Producers push while
+// one consumer drains, as the event loop does.
+func BenchmarkSendQueue(b *testing.B) {
+	for _, producers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("queue=lockfree/producers=%d", producers), func(b *testing.B) {
+			q := newTestSendQueue(b, defaultSendQueueLength)
+			benchmarkProducers(b, producers, func(send func()) bool { return q.Push(send) }, func() int { return q.Drain() })
+		})
+		b.Run(fmt.Sprintf("queue=channel/producers=%d", producers), func(b *testing.B) {
+			ch := make(chan func(), defaultSendQueueLength)
+			push := func(send func()) bool {
+				select {
+				case ch <- send:
+					return true
+				default:
+					return false
+				}
+			}
+			drain := func() int {
+				for n := 0; ; n++ {
+					select {
+					case send := <-ch:
+						send()
+					default:
+						return n
+					}
+				}
+			}
+			benchmarkProducers(b, producers, push, drain)
+		})
+		b.Run(fmt.Sprintf("queue=mutex/producers=%d", producers), func(b *testing.B) {
+			var mu sync.Mutex
+			var tasks []func()
+			push := func(send func()) bool {
+				mu.Lock()
+				tasks = append(tasks, send)
+				mu.Unlock()
+				return true
+			}
+			drain := func() int {
+				mu.Lock()
+				batch := tasks
+				tasks = nil
+				mu.Unlock()
+				for _, send := range batch {
+					send()
+				}
+				return len(batch)
+			}
+			benchmarkProducers(b, producers, push, drain)
+		})
+	}
+}
+
+// benchmarkProducers splits b.N pushes across producer goroutines while
+// the benchmark goroutine consumes
+func benchmarkProducers(b *testing.B, producers int, push func(func()) bool, drain func() int) {
+	send := func() {}
+	var wg sync.WaitGroup
+	b.ReportAllocs()
+	b.ResetTimer()
+	for p := 0; p < producers; p++ {
+		n := b.N / producers
+		if p < b.N%producers {
+			n++
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				for !push(send) {
+					runtime.Gosched() // full: let the consumer run
+				}
+			}
+		}()
+	}
+	for consumed := 0; consumed < b.N; {
+		n := drain()
+		if n == 0 {
+			runtime.Gosched()
+		}
+		consumed += n
+	}
+	wg.Wait()
+}
@@ -0,0 +1,105 @@
+package ultrafast
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Server is the stack as a component of a larger program: it binds on
+// New, serves from Start until its context ends or Shutdown is called,
+// and leaves logging, flags and signals to the program embedding it.
+// Engine gives access to every other feature of the underlying server.
+type Server struct {
+	engine    *UltraFastHTTPServer
+	shutdown  atomic.Bool
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// New creates a server bound to addr, an "ip:port" pair. Port 0 picks a
+// free port, which Addr reports.
+func New(addr string) (*Server, error) {
+	bind, err := ParseSocketAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	engine, err := NewUltraFastHTTPServer(bind.IP, bind.Port)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{engine: engine}, nil
+}
+
+// NewFromConfig creates a server from a startup config, see
+// LoadStartupConfig
+func NewFromConfig(config *StartupConfig) (*Server, error) {
+	engine, err := NewServerFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{engine: engine}, nil
+}
+
+// RegisterHandler registers a handler for an exact request path. It may
+// be called before or while the server runs.
+func (s *Server) RegisterHandler(path string, handler RequestHandler) {
+	s.engine.HandleFunc(path, handler)
+}
+
+// Start serves until ctx is done, when the server is closed at once and
+// ctx's error returned, or until Shutdown, when it returns nil. The
+// server cannot be started again after either.
+func (s *Server) Start(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() { done <- s.engine.Start() }()
+
+	select {
+	case err := <-done:
+		s.close()
+		if s.shutdown.Load() {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+		s.close()
+		<-done
+		if s.shutdown.Load() {
+			return nil
+		}
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting connections and waits for in-flight responses
+// to be acknowledged, or for ctx to be done, then closes the server. It
+// returns ctx's error if the wait was cut short.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdown.Store(true)
+	err := s.engine.drain(ctx)
+	s.close()
+	return err
+}
+
+// close releases the engine once, whichever of Start and Shutdown ends
+// it first
+func (s *Server) close() error {
+	s.closeOnce.Do(func() { s.closeErr = s.engine.Close() })
+	return s.closeErr
+}
+
+// Stats returns a snapshot of the server's counters
+func (s *Server) Stats() ServerStats {
+	return *s.engine.GetStats()
+}
+
+// Addr returns the address the server is bound to
+func (s *Server) Addr() SocketAddr {
+	return s.engine.LocalAddr()
+}
+
+// Engine returns the underlying server, for the features Server does not
+// wrap
+func (s *Server) Engine() *UltraFastHTTPServer {
+	return s.engine
+}
@@ -0,0 +1,260 @@
+package ultrafast
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// startTestServer runs a server on a loopback ephemeral port
+func startTestServer(t *testing.T) *UltraFastHTTPServer {
+	t.Helper()
+
+	server, err := NewUltraFastHTTPServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go server.Start()
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+// newTestClient connects a client to a test server
+func newTestClient(t *testing.T, server *UltraFastHTTPServer) *UltraFastClient {
+	t.Helper()
+
+	addr := server.socket.GetLocalAddr()
+	client, err := NewUltraFastClient(addr.IP, addr.Port)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	client.SetTimeout(200 * time.Millisecond)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestServerRequestResponse(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if _, ok := client.ConnectionID(); !ok {
+		t.Error("Server should assign a connection ID during the handshake")
+	}
+
+	response, err := client.Get("/benchmark")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !containsString(string(response), "HTTP/1.1 200 OK") {
+		t.Errorf("Expected 200 response, got %q", response)
+	}
+}
+
+func TestServerZeroRTTResumption(t *testing.T) {
+	server := startTestServer(t)
+	first := newTestClient(t, server)
+
+	if _, err := first.Get("/benchmark"); err != nil {
+		t.Fatalf("Initial request failed: %v", err)
+	}
+	ticket := first.SessionTicket()
+	if ticket == nil {
+		t.Fatal("Expected a session ticket on the first response")
+	}
+	first.Close()
+
+	// A returning client sends its request inside the SYN. The index page
+	// is larger than the amplification limit allows before the client's
+	// ACK proves its address, so the response is held until then. Handlers
+	// run inline so the response is always ready before that ACK arrives.
+	server.DisableWorkerPool()
+	second := newTestClient(t, server)
+	second.SetSessionTicket(ticket)
+	response, err := second.Resume(buildGetRequest("/", server.socket.GetLocalAddr()))
+	if err != nil {
+		t.Fatalf("0-RTT request failed: %v", err)
+	}
+	if !containsString(string(response), "HTTP/1.1 200 OK") {
+		t.Errorf("Expected 200 response, got %q", response)
+	}
+	if server.GetStats().AmplificationLimited == 0 {
+		t.Error("Expected the 0-RTT response to be held by the amplification limit")
+	}
+
+	// Replaying the same ticket falls back to a full handshake
+	third := newTestClient(t, server)
+	third.SetSessionTicket(ticket)
+	if _, err := third.Resume(buildGetRequest("/benchmark", server.socket.GetLocalAddr())); err != nil {
+		t.Fatalf("Fallback after replayed ticket failed: %v", err)
+	}
+	if server.tickets.Replays() != 1 {
+		t.Errorf("Expected 1 rejected replay, got %d", server.tickets.Replays())
+	}
+}
+
+func TestServerRetry(t *testing.T) {
+	server := startTestServer(t)
+	server.SetRetryRequired(true)
+	client := newTestClient(t, server)
+
+	response, err := client.Get("/benchmark")
+	if err != nil {
+		t.Fatalf("Request after RETRY failed: %v", err)
+	}
+	if !containsString(string(response), "HTTP/1.1 200 OK") {
+		t.Errorf("Expected 200 response, got %q", response)
+	}
+
+	// A ticket can still be redeemed once the RETRY round trip is done
+	ticket := client.SessionTicket()
+	resumed := newTestClient(t, server)
+	resumed.SetSessionTicket(ticket)
+	if _, err := resumed.Resume(buildGetRequest("/", server.socket.GetLocalAddr())); err != nil {
+		t.Fatalf("Resumption after RETRY failed: %v", err)
+	}
+	if server.tickets.Replays() != 0 {
+		t.Error("RETRY should not consume the session ticket")
+	}
+}
+
+func TestServerPipelinedRequests(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+	addr := server.socket.GetLocalAddr()
+
+	paths := []string{"/benchmark", "/missing", "/", "/benchmark"}
+	requests := make([][]byte, len(paths))
+	for i, path := range paths {
+		requests[i] = buildGetRequest(path, addr)
+	}
+
+	responses, err := client.Pipeline(requests)
+	if err != nil {
+		t.Fatalf("Pipeline failed: %v", err)
+	}
+
+	expected := []string{"200 OK", "404 Not Found", "200 OK", "200 OK"}
+	for i, response := range responses {
+		if !containsString(string(response), "HTTP/1.1 "+expected[i]) {
+			t.Errorf("Response %d for %s: expected %s, got %q", i, paths[i], expected[i], response)
+		}
+	}
+	if !containsString(string(responses[2]), "Ultra-Fast HTTP Server") {
+		t.Error("Responses should be matched to requests by ID")
+	}
+}
+
+func TestServerStatsCallback(t *testing.T) {
+	start := time.Now()
+	defer setVirtualTime(time.Time{})
+	setVirtualTime(start)
+
+	server := startTestServer(t)
+	reports := make(chan ServerStats, 16)
+	server.OnStats(func(stats ServerStats, _ ReliabilityStats) { reports <- stats })
+	server.SetStatsInterval(time.Hour)
+
+	// The worker polls every 100ms; with the clock still, nothing is due
+	expectReports := func(want int) {
+		t.Helper()
+		got := 0
+		for timeout := time.After(300 * time.Millisecond); ; {
+			select {
+			case <-reports:
+				got++
+				continue
+			case <-timeout:
+			}
+			break
+		}
+		if got != want {
+			t.Fatalf("Expected %d stats reports, got %d", want, got)
+		}
+	}
+	expectReports(0)
+
+	for _, elapsed := range []time.Duration{time.Hour, 2 * time.Hour} {
+		setVirtualTime(start.Add(elapsed))
+		expectReports(1)
+	}
+	setVirtualTime(start.Add(2*time.Hour + 59*time.Minute))
+	expectReports(0)
+
+	// None is due as it closes, and none comes after
+	server.Close()
+	time.Sleep(200 * time.Millisecond)
+	setVirtualTime(start.Add(10 * time.Hour))
+	expectReports(0)
+}
+
+func TestEmbeddedServerLifecycle(t *testing.T) {
+	server, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	server.RegisterHandler("/embedded", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Body: []byte("embedded")}
+	})
+	done := make(chan error, 1)
+	go func() { done <- server.Start(context.Background()) }()
+
+	client := newTestClient(t, server.Engine())
+	response, err := client.Get("/embedded")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !containsString(string(response), "embedded") {
+		t.Errorf("Expected the registered handler's body, got %q", response)
+	}
+	if stats := server.Stats(); stats.RequestsReceived == 0 {
+		t.Error("Stats should count the request")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Start should return nil after Shutdown, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start did not return after Shutdown")
+	}
+}
+
+func TestEmbeddedServerContextCancel(t *testing.T) {
+	server, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if server.Addr().Port == 0 {
+		t.Error("Addr should report the port picked")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Start(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start did not return after its context ended")
+	}
+}
+
+func TestEmbeddedServerInvalidAddress(t *testing.T) {
+	if _, err := New("localhost"); err == nil {
+		t.Error("Expected an error for an address without a port")
+	}
+}
@@ -0,0 +1,76 @@
+package ultrafast
+
+import "fmt"
+
+// Service chooses what answers the requests arriving on a server's port.
+// ECHO and DISCARD skip HTTP parsing and routing altogether, so a
+// benchmark against them measures the transport alone.
+type Service int
+
+const (
+	SERVICE_HTTP    Service = iota // Parse requests as HTTP and route them (default)
+	SERVICE_ECHO                   // Send every request's payload back as its response
+	SERVICE_DISCARD                // Acknowledge every request and answer nothing
+)
+
+// String returns the service's name
+func (s Service) String() string {
+	switch s {
+	case SERVICE_HTTP:
+		return "http"
+	case SERVICE_ECHO:
+		return "echo"
+	case SERVICE_DISCARD:
+		return "discard"
+	}
+	return fmt.Sprintf("Service(%d)", int(s))
+}
+
+// valid reports whether s is one of the defined services
+func (s Service) valid() bool {
+	return s >= SERVICE_HTTP && s <= SERVICE_DISCARD
+}
+
+// ParseService converts a service name into a Service
+func ParseService(name string) (Service, error) {
+	switch name {
+	case "http":
+		return SERVICE_HTTP, nil
+	case "echo":
+		return SERVICE_ECHO, nil
+	case "discard":
+		return SERVICE_DISCARD, nil
+	}
+	return 0, fmt.Errorf("unknown service: %s", name)
+}
+
+// SetService chooses what answers requests on the server's port. It may
+// be changed while the server runs; connections carrying a stream keep
+// their handler.
+func (s *UltraFastHTTPServer) SetService(service Service) error {
+	if !service.valid() {
+		return fmt.Errorf("invalid service: %d", int(service))
+	}
+	s.service.Store(int32(service))
+	return nil
+}
+
+// Service returns what answers requests on the server's port
+func (s *UltraFastHTTPServer) Service() Service {
+	return Service(s.service.Load())
+}
+
+// serveRaw answers a request with the echo or discard service, reporting
+// false if the server speaks HTTP. The request was acknowledged already.
+func (h *HTTPSocketHandler) serveRaw(payload []byte, requestID uint32, from SocketAddr) bool {
+	switch h.server.Service() {
+	case SERVICE_ECHO:
+		// The payload is the receive buffer's; the response outlives it
+		// while it waits to be acknowledged
+		h.sendResponseData(append([]byte(nil), payload...), nil, from, requestID)
+		return true
+	case SERVICE_DISCARD:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package ultrafast
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEchoService(t *testing.T) {
+	server := startTestServer(t)
+	if err := server.SetService(SERVICE_ECHO); err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(t, server)
+
+	// Not HTTP, and larger than a packet, so it arrives as fragments
+	payload := bytes.Repeat([]byte("echo\x00"), MAX_PAYLOAD_SIZE/2)
+	response, err := client.Do(payload)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	if !bytes.Equal(response, payload) {
+		t.Errorf("Expected the payload back, got %d bytes", len(response))
+	}
+}
+
+func TestDiscardService(t *testing.T) {
+	server := startTestServer(t)
+	server.SetService(SERVICE_DISCARD)
+	client := newTestClient(t, server)
+
+	for i := 0; i < 3; i++ {
+		if err := client.Send([]byte("GET / HTTP/1.1\r\n\r\n")); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if sent := server.GetStats().ResponsesSent; sent != 0 {
+		t.Errorf("Expected no responses, got %d", sent)
+	}
+
+	// Back to HTTP, the same connection is answered again
+	server.SetService(SERVICE_HTTP)
+	if _, err := client.Get("/benchmark"); err != nil {
+		t.Errorf("Request failed: %v", err)
+	}
+}
+
+func TestParseService(t *testing.T) {
+	for _, service := range []Service{SERVICE_HTTP, SERVICE_ECHO, SERVICE_DISCARD} {
+		parsed, err := ParseService(service.String())
+		if err != nil || parsed != service {
+			t.Errorf("ParseService(%q) = %v, %v", service.String(), parsed, err)
+		}
+	}
+	if _, err := ParseService("chargen"); err == nil {
+		t.Error("Expected an unknown service to be rejected")
+	}
+	if err := (&UltraFastHTTPServer{}).SetService(Service(7)); err == nil {
+		t.Error("Expected an invalid service to be rejected")
+	}
+}
@@ -0,0 +1,134 @@
+package ultrafast
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OPT_SESSION_TICKET carries a resumption ticket: server to client on an
+// established connection, client to server on a 0-RTT SYN
+const OPT_SESSION_TICKET = 0x02
+
+// defaultTicketLifetime bounds how long a ticket can be redeemed
+const defaultTicketLifetime = 10 * time.Minute
+
+// SessionTicketIssuer mints and redeems self-encrypted resumption tickets.
+// A ticket binds the client IP and issue time under an AEAD key only the
+// server knows, so no per-ticket state is needed until redemption. Each
+// ticket is single-use: redeemed nonces are remembered until the ticket
+// would have expired, which rejects replays of captured 0-RTT packets.
+type SessionTicketIssuer struct {
+	aead     cipher.AEAD
+	lifetime time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	redeemed  map[[12]byte]time.Time // nonce -> ticket expiry
+	lastPrune time.Time
+
+	replays uint64 // atomic
+}
+
+// NewSessionTicketIssuer creates an issuer with a random ticket key
+func NewSessionTicketIssuer(lifetime time.Duration) (*SessionTicketIssuer, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate ticket key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ticket cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ticket AEAD: %v", err)
+	}
+
+	if lifetime <= 0 {
+		lifetime = defaultTicketLifetime
+	}
+	return &SessionTicketIssuer{
+		aead:      aead,
+		lifetime:  lifetime,
+		now:       time.Now,
+		redeemed:  make(map[[12]byte]time.Time),
+		lastPrune: time.Now(),
+	}, nil
+}
+
+// Issue creates a ticket the peer can present to resume without a handshake
+func (ti *SessionTicketIssuer) Issue(peer SocketAddr) ([]byte, error) {
+	nonce := make([]byte, ti.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate ticket nonce: %v", err)
+	}
+
+	plaintext := make([]byte, 8, 8+len(peer.IP))
+	binary.BigEndian.PutUint64(plaintext, uint64(ti.now().UnixNano()))
+	plaintext = append(plaintext, peer.IP...)
+
+	return ti.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Redeem validates a ticket presented by peer and consumes it
+func (ti *SessionTicketIssuer) Redeem(ticket []byte, peer SocketAddr) error {
+	nonceSize := ti.aead.NonceSize()
+	if len(ticket) < nonceSize+ti.aead.Overhead()+8 {
+		return fmt.Errorf("session ticket too short: %d bytes", len(ticket))
+	}
+
+	plaintext, err := ti.aead.Open(nil, ticket[:nonceSize], ticket[nonceSize:], nil)
+	if err != nil {
+		return fmt.Errorf("session ticket authentication failed")
+	}
+
+	now := ti.now()
+	issuedAt := time.Unix(0, int64(binary.BigEndian.Uint64(plaintext[:8])))
+	expiry := issuedAt.Add(ti.lifetime)
+	if now.After(expiry) {
+		return fmt.Errorf("session ticket expired at %v", expiry)
+	}
+	if string(plaintext[8:]) != peer.IP {
+		return fmt.Errorf("session ticket issued to a different address")
+	}
+
+	var nonce [12]byte
+	copy(nonce[:], ticket[:nonceSize])
+
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	if now.Sub(ti.lastPrune) > ti.lifetime {
+		for seen, seenExpiry := range ti.redeemed {
+			if now.After(seenExpiry) {
+				delete(ti.redeemed, seen)
+			}
+		}
+		ti.lastPrune = now
+	}
+
+	if _, seen := ti.redeemed[nonce]; seen {
+		atomic.AddUint64(&ti.replays, 1)
+		return fmt.Errorf("session ticket replayed")
+	}
+	ti.redeemed[nonce] = expiry
+	return nil
+}
+
+// Replays returns the number of replayed tickets rejected
+func (ti *SessionTicketIssuer) Replays() uint64 {
+	return atomic.LoadUint64(&ti.replays)
+}
+
+// isSafeMethod reports whether a request may be executed from 0-RTT data.
+// Only idempotent reads qualify, since 0-RTT data could still be replayed
+// against a different server instance that does not share the replay cache.
+func isSafeMethod(method string) bool {
+	return method == "GET" || method == "HEAD"
+}
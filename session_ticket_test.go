@@ -0,0 +1,57 @@
+package ultrafast
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionTickets(t *testing.T) {
+	issuer, err := NewSessionTicketIssuer(time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create ticket issuer: %v", err)
+	}
+	peer := SocketAddr{IP: "198.51.100.7", Port: 3333}
+
+	t.Run("Redeem once", func(t *testing.T) {
+		ticket, err := issuer.Issue(peer)
+		if err != nil {
+			t.Fatalf("Failed to issue ticket: %v", err)
+		}
+		if len(ticket) > 255 {
+			t.Errorf("Ticket must fit in a packet option, got %d bytes", len(ticket))
+		}
+		if err := issuer.Redeem(ticket, SocketAddr{IP: peer.IP, Port: 4444}); err != nil {
+			t.Errorf("Ticket should be valid from a new port: %v", err)
+		}
+		if err := issuer.Redeem(ticket, peer); err == nil {
+			t.Error("Replayed ticket should be rejected")
+		}
+		if issuer.Replays() != 1 {
+			t.Errorf("Expected 1 replay, got %d", issuer.Replays())
+		}
+	})
+
+	t.Run("Wrong address", func(t *testing.T) {
+		ticket, _ := issuer.Issue(peer)
+		if err := issuer.Redeem(ticket, SocketAddr{IP: "198.51.100.8", Port: peer.Port}); err == nil {
+			t.Error("Ticket should be bound to the client IP")
+		}
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		ticket, _ := issuer.Issue(peer)
+		ticket[len(ticket)-1] ^= 0xFF
+		if err := issuer.Redeem(ticket, peer); err == nil {
+			t.Error("Tampered ticket should be rejected")
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		ticket, _ := issuer.Issue(peer)
+		issuer.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+		defer func() { issuer.now = time.Now }()
+		if err := issuer.Redeem(ticket, peer); err == nil {
+			t.Error("Expired ticket should be rejected")
+		}
+	})
+}
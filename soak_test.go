@@ -0,0 +1,337 @@
+//go:build soak
+
+package ultrafast
+
+// The soak test runs client/server pairs for minutes through links that
+// lose, duplicate and reorder packets in bursts, then checks that the
+// servers forgot every connection, that no goroutines were left behind
+// and that the heap did not grow. It only builds with the soak tag:
+//
+//	go test -tags soak -run TestSoak -timeout 30m -soak.duration 10m
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"runtime"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	soakDuration = flag.Duration("soak.duration", 2*time.Minute, "how long the soak test runs")
+	soakPairs    = flag.Int("soak.pairs", 4, "client/server pairs in the soak test")
+	soakSeed     = flag.Int64("soak.seed", 0, "seed for the links' impairments, 0 for the time")
+)
+
+// Impairments of a chaosLink, outside and during a burst
+const (
+	chaosBurstChance = 0.002 // of each packet starting a burst
+	chaosBurstMin    = 50 * time.Millisecond
+	chaosBurstMax    = 300 * time.Millisecond
+	chaosMaxDelay    = 20 * time.Millisecond // a reordered packet is held up to this long
+)
+
+type chaosImpairment struct {
+	loss, reorder, duplicate float64
+}
+
+var (
+	chaosCalm  = chaosImpairment{loss: 0.005, reorder: 0.01, duplicate: 0.002}
+	chaosBurst = chaosImpairment{loss: 0.25, reorder: 0.3, duplicate: 0.05}
+)
+
+// chaosLink relays datagrams between one client and a server, losing,
+// duplicating and reordering them: rarely, except during bursts
+type chaosLink struct {
+	front  *LinuxUDPSocket // the client sends here
+	back   *LinuxUDPSocket // the server sees the client here
+	server SocketAddr
+	client atomic.Pointer[SocketAddr]
+
+	mu         sync.Mutex
+	rand       *rand.Rand
+	burstUntil time.Time
+
+	closed     atomic.Bool
+	relays     sync.WaitGroup
+	dropped    atomic.Uint64
+	reordered  atomic.Uint64
+	duplicated atomic.Uint64
+}
+
+func newChaosLink(t *testing.T, server SocketAddr, seed int64) *chaosLink {
+	l := &chaosLink{server: server, rand: rand.New(rand.NewSource(seed))}
+	for _, socket := range []**LinuxUDPSocket{&l.front, &l.back} {
+		s, err := NewLinuxUDPSocket()
+		if err != nil {
+			t.Fatalf("Failed to create link socket: %v", err)
+		}
+		if err := s.Bind("127.0.0.1", 0); err != nil {
+			t.Fatalf("Failed to bind link socket: %v", err)
+		}
+		*socket = s
+	}
+	l.relays.Add(2)
+	go l.relay(l.front, l.back, func(from SocketAddr) (SocketAddr, bool) {
+		l.client.Store(&from)
+		return l.server, true
+	})
+	go l.relay(l.back, l.front, func(SocketAddr) (SocketAddr, bool) {
+		client := l.client.Load()
+		if client == nil {
+			return SocketAddr{}, false
+		}
+		return *client, true
+	})
+	return l
+}
+
+// relay forwards what arrives on in out of out, to where route says
+func (l *chaosLink) relay(in, out *LinuxUDPSocket, route func(SocketAddr) (SocketAddr, bool)) {
+	defer l.relays.Done()
+	buffer := make([]byte, 65536)
+	for !l.closed.Load() {
+		in.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, from, err := in.RecvFrom(buffer)
+		if err != nil {
+			continue
+		}
+		to, ok := route(from)
+		if !ok {
+			continue
+		}
+		datagram := append([]byte(nil), buffer[:n]...)
+
+		drop, delay, copies := l.fate()
+		switch {
+		case drop:
+			l.dropped.Add(1)
+		case delay > 0:
+			l.reordered.Add(1)
+			time.AfterFunc(delay, func() {
+				for i := 0; i < copies; i++ {
+					out.SendTo(datagram, to.IP, to.Port)
+				}
+			})
+		default:
+			for i := 0; i < copies; i++ {
+				out.SendTo(datagram, to.IP, to.Port)
+			}
+		}
+	}
+}
+
+// fate decides what happens to the next datagram: whether it is lost,
+// how long it is held back, and how many copies arrive
+func (l *chaosLink) fate() (drop bool, delay time.Duration, copies int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	impairment := chaosCalm
+	if now.Before(l.burstUntil) {
+		impairment = chaosBurst
+	} else if l.rand.Float64() < chaosBurstChance {
+		l.burstUntil = now.Add(chaosBurstMin + time.Duration(l.rand.Int63n(int64(chaosBurstMax-chaosBurstMin))))
+		impairment = chaosBurst
+	}
+
+	if l.rand.Float64() < impairment.loss {
+		return true, 0, 0
+	}
+	copies = 1
+	if l.rand.Float64() < impairment.duplicate {
+		copies = 2
+		l.duplicated.Add(1)
+	}
+	if l.rand.Float64() < impairment.reorder {
+		delay = time.Duration(1 + l.rand.Int63n(int64(chaosMaxDelay)))
+	}
+	return false, delay, copies
+}
+
+func (l *chaosLink) addr() SocketAddr {
+	return l.front.GetLocalAddr()
+}
+
+func (l *chaosLink) Close() {
+	l.closed.Store(true)
+	l.relays.Wait()
+	l.front.Close()
+	l.back.Close()
+}
+
+// soakBody is the response body for request n of a pair: long enough,
+// for some n, to need several packets
+func soakBody(pair, n int) []byte {
+	body := []byte(fmt.Sprintf("pair=%d n=%d\n", pair, n))
+	return append(body, bytes.Repeat([]byte{byte('a' + n%26)}, n%3000)...)
+}
+
+// soakPair is a server and the client hammering it over a chaosLink
+type soakPair struct {
+	index    int
+	server   *UltraFastHTTPServer
+	done     chan error // receives Start's result
+	link     *chaosLink
+	requests atomic.Uint64
+	failures atomic.Uint64
+}
+
+func startSoakPair(t *testing.T, index int, seed int64) *soakPair {
+	server, err := NewUltraFastHTTPServer("127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	server.SetKeepAlive(KeepAliveConfig{IdleTimeout: time.Second})
+	server.HandlePrefix("/soak/", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		var pair, n int
+		if _, err := fmt.Sscanf(request.Path, "/soak/%d/%d", &pair, &n); err != nil {
+			return &HTTPResponse{StatusCode: 400, Headers: map[string]string{}}
+		}
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: soakBody(pair, n)}
+	})
+
+	p := &soakPair{index: index, server: server, done: make(chan error, 1)}
+	go func() { p.done <- server.Start() }()
+	p.link = newChaosLink(t, server.socket.GetLocalAddr(), seed)
+	return p
+}
+
+// run sends requests until stop closes, and reports the first response
+// that is not the one asked for
+func (p *soakPair) run(stop <-chan struct{}) error {
+	addr := p.link.addr()
+	client, err := NewUltraFastClient(addr.IP, addr.Port)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	client.SetTimeout(100 * time.Millisecond)
+
+	for n := 0; ; n++ {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		p.requests.Add(1)
+		response, err := client.Get(fmt.Sprintf("/soak/%d/%d", p.index, n))
+		if err != nil {
+			p.failures.Add(1) // given up on after the client's retries
+			continue
+		}
+		_, body, found := bytes.Cut(response, []byte("\r\n\r\n"))
+		if !found || !bytes.HasPrefix(response, []byte("HTTP/1.1 200")) || !bytes.Equal(body, soakBody(p.index, n)) {
+			return fmt.Errorf("pair %d request %d answered with %.200q", p.index, n, response)
+		}
+	}
+}
+
+// heapInUse returns the live heap after a collection
+func heapInUse() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+func TestSoak(t *testing.T) {
+	seed := *soakSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("Soaking %d pairs for %v, seed %d", *soakPairs, *soakDuration, seed)
+	goroutines := runtime.NumGoroutine()
+
+	pairs := make([]*soakPair, *soakPairs)
+	for i := range pairs {
+		pairs[i] = startSoakPair(t, i, seed+int64(i))
+	}
+	stop := make(chan struct{})
+	errs := make(chan error, len(pairs))
+	for _, p := range pairs {
+		go func(p *soakPair) { errs <- p.run(stop) }(p)
+	}
+
+	// The heap is measured once the pairs are warmed up, then watched
+	// along with each server's view of its connections
+	var baseline uint64
+	deadline := time.Now().Add(*soakDuration)
+	ticker := time.NewTicker(*soakDuration / 20)
+	for running := true; running; {
+		select {
+		case err := <-errs:
+			close(stop)
+			t.Fatalf("State diverged: %v", err)
+		case now := <-ticker.C:
+			if baseline == 0 {
+				baseline = heapInUse()
+			}
+			for _, p := range pairs {
+				if n := p.server.connections.Len(); n > 1 {
+					t.Errorf("Pair %d server tracks %d connections for one client", p.index, n)
+				}
+			}
+			running = now.Before(deadline)
+		}
+	}
+	ticker.Stop()
+	grown := heapInUse()
+	close(stop)
+	for range pairs {
+		if err := <-errs; err != nil {
+			t.Errorf("State diverged: %v", err)
+		}
+	}
+
+	// Abandoned connections idle out, and nothing stays in flight
+	var requests, failures uint64
+	for _, p := range pairs {
+		requests += p.requests.Load()
+		failures += p.failures.Load()
+		t.Logf("Pair %d: %d requests, %d failed; link dropped %d, reordered %d, duplicated %d",
+			p.index, p.requests.Load(), p.failures.Load(),
+			p.link.dropped.Load(), p.link.reordered.Load(), p.link.duplicated.Load())
+
+		settle := time.Now().Add(5 * time.Second)
+		for (p.server.connections.Len() > 0 || p.server.reliability.UnackedCount() > 0) && time.Now().Before(settle) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if n, unacked := p.server.connections.Len(), p.server.reliability.UnackedCount(); n > 0 || unacked > 0 {
+			t.Errorf("Pair %d server kept %d connections and %d unacked packets", p.index, n, unacked)
+		}
+		if active := p.server.GetStats().ConnectionsActive; active != 0 {
+			t.Errorf("Pair %d server counts %d active connections with none left", p.index, active)
+		}
+	}
+	if requests == 0 || failures*10 > requests {
+		t.Errorf("Expected most requests to get through, %d of %d failed", failures, requests)
+	}
+	if limit := baseline + baseline/2 + 8<<20; grown > limit {
+		t.Errorf("Heap grew from %d to %d bytes", baseline, grown)
+	}
+
+	for _, p := range pairs {
+		p.link.Close()
+		p.server.Close()
+		if err := <-p.done; err != nil {
+			t.Errorf("Pair %d server failed: %v", p.index, err)
+		}
+	}
+	settle := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(settle) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		var profile strings.Builder
+		pprof.Lookup("goroutine").WriteTo(&profile, 1)
+		t.Errorf("Leaked %d goroutines:\n%s", n-goroutines, profile.String())
+	}
+}
@@ -0,0 +1,146 @@
+package ultrafast
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// LinuxUDPSocket represents a high-performance Linux UDP socket. On
+// Windows the same type wraps a Winsock socket, see socket_windows.go, so
+// the layers above build on either.
+type LinuxUDPSocket struct {
+	fd           atomic.Int64 // socketFD, see sock
+	localAddr    SocketAddr
+	nonBlocking  bool
+	checksumMode int32                         // ChecksumMode, see checksum_offload.go
+	tos          int32                         // atomic, IP_TOS byte last set, see tos.go
+	rxqOverflows uint32                        // atomic, datagrams the kernel dropped, see drops.go
+	packetAuth   atomic.Pointer[packetAuthKey] // nil when packets are not authenticated, see packet_auth.go
+
+	// Deadlines in Unix nanoseconds, 0 for none, and the kernel timeouts
+	// last applied to enforce them; see socket_deadline.go
+	readDeadline  int64
+	writeDeadline int64
+	recvTimeout   int64
+	sendTimeout   int64
+}
+
+// SocketAddr represents an IP address and port
+type SocketAddr struct {
+	IP   string
+	Port uint16
+}
+
+// Network names the transport, so a SocketAddr can serve as a net.Addr
+func (a SocketAddr) Network() string {
+	return "ultrafast"
+}
+
+// String formats the address as ip:port
+func (a SocketAddr) String() string {
+	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+}
+
+// wrapSocketFD makes a socket of an open descriptor
+func wrapSocketFD(fd socketFD) *LinuxUDPSocket {
+	s := &LinuxUDPSocket{}
+	s.fd.Store(int64(fd))
+	return s
+}
+
+// sock returns the socket's descriptor. Close swaps it for an invalid one
+// atomically, so a send or deadline change racing the Close fails on a
+// closed socket rather than reading the descriptor as it is written.
+func (s *LinuxUDPSocket) sock() socketFD {
+	return socketFD(s.fd.Load())
+}
+
+// ParseSocketAddr parses an IPv4 address and port written as ip:port
+func ParseSocketAddr(s string) (SocketAddr, error) {
+	ip, portText, found := strings.Cut(s, ":")
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if !found || err != nil || parseIPv4(ip) == nil {
+		return SocketAddr{}, fmt.Errorf("invalid address: %q", s)
+	}
+	return SocketAddr{IP: ip, Port: uint16(port)}, nil
+}
+
+// GetFD returns the socket file descriptor
+func (s *LinuxUDPSocket) GetFD() int {
+	return int(s.sock())
+}
+
+// GetLocalAddr returns the local address
+func (s *LinuxUDPSocket) GetLocalAddr() SocketAddr {
+	return s.localAddr
+}
+
+// IsNonBlocking returns whether socket is in non-blocking mode
+func (s *LinuxUDPSocket) IsNonBlocking() bool {
+	return s.nonBlocking
+}
+
+// parseIPv4 converts IP string to byte array
+func parseIPv4(ip string) []byte {
+	var result [4]byte
+	var octet int
+	var octetIndex int
+
+	for i := 0; i < len(ip); i++ {
+		c := ip[i]
+		if c >= '0' && c <= '9' {
+			octet = octet*10 + int(c-'0')
+			if octet > 255 {
+				return nil
+			}
+		} else if c == '.' {
+			if octetIndex >= 3 {
+				return nil
+			}
+			result[octetIndex] = byte(octet)
+			octet = 0
+			octetIndex++
+		} else {
+			return nil
+		}
+	}
+
+	if octetIndex != 3 {
+		return nil
+	}
+	result[octetIndex] = byte(octet)
+	return result[:]
+}
+
+// Network byte order conversion functions
+func htons(host uint16) uint16 {
+	return (host<<8)&0xff00 | (host>>8)&0x00ff
+}
+
+func ntohs(network uint16) uint16 {
+	return (network<<8)&0xff00 | (network>>8)&0x00ff
+}
+
+func htonl(host uint32) uint32 {
+	return ((host & 0x000000ff) << 24) |
+		((host & 0x0000ff00) << 8) |
+		((host & 0x00ff0000) >> 8) |
+		((host & 0xff000000) >> 24)
+}
+
+func ntohl(network uint32) uint32 {
+	return ((network & 0x000000ff) << 24) |
+		((network & 0x0000ff00) << 8) |
+		((network & 0x00ff0000) >> 8) |
+		((network & 0xff000000) >> 24)
+}
+
+func htonll(host uint64) uint64 {
+	return uint64(htonl(uint32(host)))<<32 | uint64(htonl(uint32(host>>32)))
+}
+
+func ntohll(network uint64) uint64 {
+	return htonll(network)
+}
@@ -0,0 +1,68 @@
+package ultrafast
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// SetDeadline sets both the read and write deadlines
+func (s *LinuxUDPSocket) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+// SetReadDeadline makes RecvFrom on a blocking socket give up with
+// os.ErrDeadlineExceeded once t passes. The zero time clears it. The
+// deadline is enforced with SO_RCVTIMEO when each call starts, so a call
+// already blocked keeps the deadline it started with.
+func (s *LinuxUDPSocket) SetReadDeadline(t time.Time) error {
+	atomic.StoreInt64(&s.readDeadline, deadlineNanos(t))
+	return nil
+}
+
+// SetWriteDeadline is SetReadDeadline for SendTo, enforced with SO_SNDTIMEO
+func (s *LinuxUDPSocket) SetWriteDeadline(t time.Time) error {
+	atomic.StoreInt64(&s.writeDeadline, deadlineNanos(t))
+	return nil
+}
+
+// deadlineNanos converts a deadline to Unix nanoseconds, 0 for none
+func deadlineNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// applyDeadline sets the kernel timeout option to what remains of the
+// deadline before a blocking call. Without a deadline the option is only
+// touched to clear a timeout applied earlier, so sockets that manage
+// SO_RCVTIMEO themselves are left alone.
+func (s *LinuxUDPSocket) applyDeadline(option int, deadline, applied *int64) error {
+	d := atomic.LoadInt64(deadline)
+	if d == 0 {
+		if atomic.LoadInt64(applied) == 0 {
+			return nil
+		}
+		atomic.StoreInt64(applied, 0)
+		return setTimeoutOption(s.sock(), option, 0)
+	}
+
+	remaining := d - time.Now().UnixNano()
+	if remaining <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	atomic.StoreInt64(applied, remaining)
+	return setTimeoutOption(s.sock(), option, remaining)
+}
+
+// deadlinePassed reports whether a failed call timed out on its deadline
+// rather than finding a non-blocking socket not ready
+func (s *LinuxUDPSocket) deadlinePassed(deadline *int64, err error) bool {
+	if !isTimeout(err) {
+		return false
+	}
+	d := atomic.LoadInt64(deadline)
+	return d != 0 && time.Now().UnixNano() >= d
+}
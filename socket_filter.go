@@ -0,0 +1,116 @@
+package ultrafast
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// BPFInstruction is one instruction of a classic BPF program, laid out as
+// the kernel's struct sock_filter. A socket filter returns how many bytes
+// of the datagram to keep, 0 dropping it before it is queued on the
+// socket. The datagram starts at its UDP header; the IP header is read
+// at offsets from bpfNetOffset.
+type BPFInstruction struct {
+	Op uint16
+	Jt uint8 // instructions to skip when a jump's condition holds
+	Jf uint8 // and when it does not
+	K  uint32
+}
+
+// Classic BPF opcodes used by ProtocolFilter, from linux/bpf_common.h
+const (
+	bpfLdWAbs  = 0x20       // A = 32-bit word at offset K
+	bpfLdBAbs  = 0x30       // A = byte at offset K
+	bpfLdLen   = 0x80       // A = datagram length
+	bpfAndK    = 0x54       // A &= K
+	bpfJeqK    = 0x15       // jump if A == K
+	bpfJgeK    = 0x35       // jump if A >= K
+	bpfJsetK   = 0x45       // jump if A & K != 0
+	bpfRetK    = 0x06       // return K
+	bpfNetOff  = 0xFFF00000 // SKF_NET_OFF: offsets from here read the IP header
+	bpfAcceptK = 0xFFFFFFFF // keep the whole datagram
+)
+
+// udpHeaderSize is the UDP header in front of the payload a socket
+// filter sees
+const udpHeaderSize = 8
+
+// maxFilterInstructions is the kernel's BPF_MAXINSNS for classic programs
+const maxFilterInstructions = 4096
+
+// ProtocolFilter builds a classic BPF program for the server's socket
+// that drops, in the kernel and before the event loop wakes, datagrams
+// from the IPv4 CIDRs in deny and datagrams that are not packets of this
+// protocol: shorter than the header, or of another version. QUIC packets
+// are let through if allowQUIC is set, as EnableQUIC shares the socket.
+func ProtocolFilter(deny []string, allowQUIC bool) ([]BPFInstruction, error) {
+	var program []BPFInstruction
+	for _, cidr := range deny {
+		prefix, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if !prefix.Addr().Is4() {
+			return nil, fmt.Errorf("filter CIDR is not IPv4: %s", prefix)
+		}
+		program = append(program,
+			BPFInstruction{Op: bpfLdWAbs, K: bpfNetOff + 12}, // source address
+			BPFInstruction{Op: bpfAndK, K: prefixMask(prefix)},
+			BPFInstruction{Op: bpfJeqK, K: ipv4Word(prefix.Addr()), Jt: 0, Jf: 1},
+			BPFInstruction{Op: bpfRetK, K: 0},
+		)
+	}
+
+	program = append(program,
+		BPFInstruction{Op: bpfLdLen},
+		BPFInstruction{Op: bpfJgeK, K: udpHeaderSize + PACKET_HEADER_SIZE, Jt: 1, Jf: 0},
+		BPFInstruction{Op: bpfRetK, K: 0},
+		BPFInstruction{Op: bpfLdBAbs, K: udpHeaderSize + headerVersionTypeOffset},
+	)
+	if allowQUIC {
+		// Matches isQUICPacket; our first byte never has the bit set
+		program = append(program, BPFInstruction{Op: bpfJsetK, K: 0x40, Jt: 3, Jf: 0})
+	}
+	program = append(program,
+		BPFInstruction{Op: bpfAndK, K: 0xF0},
+		BPFInstruction{Op: bpfJeqK, K: PROTOCOL_VERSION << 4, Jt: 1, Jf: 0},
+		BPFInstruction{Op: bpfRetK, K: 0},
+		BPFInstruction{Op: bpfRetK, K: bpfAcceptK},
+	)
+
+	if len(program) > maxFilterInstructions {
+		return nil, fmt.Errorf("filter needs %d instructions, more than %d", len(program), maxFilterInstructions)
+	}
+	return program, nil
+}
+
+// prefixMask returns an IPv4 prefix's netmask as a word
+func prefixMask(prefix netip.Prefix) uint32 {
+	if prefix.Bits() == 0 {
+		return 0
+	}
+	return ^uint32(0) << (32 - prefix.Bits())
+}
+
+// ipv4Word returns an IPv4 address as a word, as BPF loads it
+func ipv4Word(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// AttachFilter attaches a classic BPF program to the server's main
+// socket, see LinuxUDPSocket.AttachFilter
+func (s *UltraFastHTTPServer) AttachFilter(program []BPFInstruction) error {
+	return s.socket.AttachFilter(program)
+}
+
+// AttachBPF attaches a loaded eBPF socket filter program to the server's
+// main socket, see LinuxUDPSocket.AttachBPF
+func (s *UltraFastHTTPServer) AttachBPF(programFD int) error {
+	return s.socket.AttachBPF(programFD)
+}
+
+// DetachFilter removes the filter from the server's main socket
+func (s *UltraFastHTTPServer) DetachFilter() error {
+	return s.socket.DetachFilter()
+}
@@ -0,0 +1,46 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// AttachFilter attaches a classic BPF program to the socket with
+// SO_ATTACH_FILTER, replacing any filter already attached. Datagrams it
+// drops never reach the receive queue, so they neither wake the event
+// loop nor take room in the receive buffer.
+func (s *LinuxUDPSocket) AttachFilter(program []BPFInstruction) error {
+	if len(program) == 0 || len(program) > maxFilterInstructions {
+		return fmt.Errorf("filter has %d instructions, expected 1 to %d", len(program), maxFilterInstructions)
+	}
+	fprog := unix.SockFprog{
+		Len:    uint16(len(program)),
+		Filter: (*unix.SockFilter)(unsafe.Pointer(&program[0])),
+	}
+	if err := unix.SetsockoptSockFprog(s.sock(), unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &fprog); err != nil {
+		return fmt.Errorf("SO_ATTACH_FILTER: %v", err)
+	}
+	return nil
+}
+
+// AttachBPF attaches an eBPF program of type BPF_PROG_TYPE_SOCKET_FILTER,
+// already loaded by the caller, with SO_ATTACH_BPF. The socket holds its
+// own reference, so the caller may close programFD afterwards.
+func (s *LinuxUDPSocket) AttachBPF(programFD int) error {
+	if err := unix.SetsockoptInt(s.sock(), unix.SOL_SOCKET, unix.SO_ATTACH_BPF, programFD); err != nil {
+		return fmt.Errorf("SO_ATTACH_BPF: %v", err)
+	}
+	return nil
+}
+
+// DetachFilter removes the socket's classic or eBPF filter
+func (s *LinuxUDPSocket) DetachFilter() error {
+	if err := unix.SetsockoptInt(s.sock(), unix.SOL_SOCKET, unix.SO_DETACH_FILTER, 0); err != nil {
+		return fmt.Errorf("SO_DETACH_FILTER: %v", err)
+	}
+	return nil
+}
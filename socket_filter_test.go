@@ -0,0 +1,90 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProtocolFilter(t *testing.T) {
+	receiver, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	if err := receiver.Bind("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	sender, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	addr := receiver.GetLocalAddr()
+
+	attach := func(deny []string, allowQUIC bool) {
+		t.Helper()
+		program, err := ProtocolFilter(deny, allowQUIC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := receiver.AttachFilter(program); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// send sends each datagram in turn, then reports the first received
+	send := func(datagrams ...[]byte) []byte {
+		t.Helper()
+		for _, data := range datagrams {
+			if _, err := sender.SendTo(data, addr.IP, addr.Port); err != nil {
+				t.Fatal(err)
+			}
+		}
+		buffer := make([]byte, 2048)
+		receiver.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := receiver.RecvFrom(buffer)
+		if err == os.ErrDeadlineExceeded {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buffer[:n]
+	}
+
+	packet := NewPacket(DATA_PACKET, 0, 1, 0, []byte("GET / HTTP/1.1\r\n\r\n")).Serialize()
+	garbage := []byte("* not a packet of ours, nor QUIC")
+	quic := append([]byte{0xC0}, bytes.Repeat([]byte{1}, 40)...)
+
+	attach(nil, false)
+	if got := send(garbage, packet[:PACKET_HEADER_SIZE-1], quic, packet); !bytes.Equal(got, packet) {
+		t.Fatalf("Expected only the packet through, got %q", got)
+	}
+	attach(nil, true)
+	if got := send(garbage, quic); !bytes.Equal(got, quic) {
+		t.Errorf("Expected the QUIC packet through, got %q", got)
+	}
+
+	attach([]string{"10.0.0.0/8", "127.0.0.0/8"}, false)
+	if got := send(packet); got != nil {
+		t.Errorf("Expected the denied source dropped, got %q", got)
+	}
+	attach([]string{"127.0.0.2"}, false)
+	if got := send(packet); !bytes.Equal(got, packet) {
+		t.Errorf("Expected a source outside the deny list through, got %q", got)
+	}
+
+	if err := receiver.DetachFilter(); err != nil {
+		t.Fatal(err)
+	}
+	if got := send(garbage); !bytes.Equal(got, garbage) {
+		t.Errorf("Expected everything through once detached, got %q", got)
+	}
+
+	if _, err := ProtocolFilter([]string{"::1/128"}, false); err == nil {
+		t.Error("Expected an IPv6 CIDR to be refused")
+	}
+}
@@ -0,0 +1,18 @@
+package ultrafast
+
+import "fmt"
+
+// AttachFilter is not supported on Windows
+func (s *LinuxUDPSocket) AttachFilter(program []BPFInstruction) error {
+	return fmt.Errorf("SO_ATTACH_FILTER is not supported on this platform")
+}
+
+// AttachBPF is not supported on Windows
+func (s *LinuxUDPSocket) AttachBPF(programFD int) error {
+	return fmt.Errorf("SO_ATTACH_BPF is not supported on this platform")
+}
+
+// DetachFilter is not supported on Windows
+func (s *LinuxUDPSocket) DetachFilter() error {
+	return fmt.Errorf("SO_DETACH_FILTER is not supported on this platform")
+}
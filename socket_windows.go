@@ -0,0 +1,236 @@
+package ultrafast
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// socketFD is how the platform names a socket: a Winsock handle here, a
+// file descriptor on Linux
+type socketFD = syscall.Handle
+
+// Winsock values the syscall package does not define
+const (
+	wsaEWOULDBLOCK syscall.Errno = 10035
+	wsaEMSGSIZE    syscall.Errno = 10040
+	wsaETIMEDOUT   syscall.Errno = 10060
+
+	wsaFIONBIO           = 0x8004667e
+	wsaSIO_UDP_CONNRESET = 0x9800000c
+
+	// Socket timeout options, named alike on every platform. Winsock
+	// takes them as a DWORD of milliseconds rather than a timeval.
+	soRcvTimeo = 0x1006
+	soSndTimeo = 0x1005
+)
+
+// NewLinuxUDPSocket creates a UDP socket set up like the Linux one
+func NewLinuxUDPSocket() (*LinuxUDPSocket, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket: %v", err)
+	}
+
+	socket := wrapSocketFD(fd)
+
+	if err := socket.setSocketOptions(); err != nil {
+		syscall.Closesocket(fd)
+		return nil, fmt.Errorf("failed to set socket options: %v", err)
+	}
+
+	return socket, nil
+}
+
+// newLinuxUDPSocketFromFD is not available: Windows sockets are never
+// handed over between processes here
+func newLinuxUDPSocketFromFD(fd int) (*LinuxUDPSocket, error) {
+	return nil, fmt.Errorf("socket handover is not supported on windows")
+}
+
+// SetBufferSizes sets the receive and send buffers, in bytes, overriding
+// the 2MB given to new sockets; 0 leaves one unchanged
+func (s *LinuxUDPSocket) SetBufferSizes(recv, send int) error {
+	if recv > 0 {
+		if err := syscall.SetsockoptInt(s.sock(), syscall.SOL_SOCKET, syscall.SO_RCVBUF, recv); err != nil {
+			return fmt.Errorf("SO_RCVBUF: %v", err)
+		}
+	}
+	if send > 0 {
+		if err := syscall.SetsockoptInt(s.sock(), syscall.SOL_SOCKET, syscall.SO_SNDBUF, send); err != nil {
+			return fmt.Errorf("SO_SNDBUF: %v", err)
+		}
+	}
+	return nil
+}
+
+// setSocketOptions configures the socket for high performance. Unlike on
+// Linux, SO_REUSEADDR is left off: Winsock would let another process bind
+// the same port and steal its datagrams.
+func (s *LinuxUDPSocket) setSocketOptions() error {
+	if err := syscall.SetsockoptInt(s.sock(), syscall.SOL_SOCKET, syscall.SO_RCVBUF, 2*1024*1024); err != nil {
+		return fmt.Errorf("SO_RCVBUF: %v", err)
+	}
+	if err := syscall.SetsockoptInt(s.sock(), syscall.SOL_SOCKET, syscall.SO_SNDBUF, 2*1024*1024); err != nil {
+		return fmt.Errorf("SO_SNDBUF: %v", err)
+	}
+
+	// Without this an ICMP port unreachable for an earlier send fails the
+	// next receive with WSAECONNRESET, which a server cannot act on
+	var off uint32
+	var returned uint32
+	if err := syscall.WSAIoctl(s.sock(), wsaSIO_UDP_CONNRESET, (*byte)(unsafe.Pointer(&off)),
+		uint32(unsafe.Sizeof(off)), nil, 0, &returned, nil, 0); err != nil {
+		// Not critical if this fails
+	}
+
+	return nil
+}
+
+// Bind binds the socket to a local address and port
+func (s *LinuxUDPSocket) Bind(ip string, port uint16) error {
+	ipBytes := parseIPv4(ip)
+	if ipBytes == nil {
+		return fmt.Errorf("invalid IP address: %s", ip)
+	}
+
+	addr := syscall.SockaddrInet4{
+		Port: int(port),
+		Addr: [4]byte{ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3]},
+	}
+	if err := syscall.Bind(s.sock(), &addr); err != nil {
+		return fmt.Errorf("failed to bind socket: %v", err)
+	}
+
+	boundAddr, err := syscall.Getsockname(s.sock())
+	if err != nil {
+		return fmt.Errorf("failed to get bound address: %v", err)
+	}
+	if boundInet4, ok := boundAddr.(*syscall.SockaddrInet4); ok {
+		s.localAddr = inet4Addr(boundInet4)
+	}
+	return nil
+}
+
+// SendTo sends data to a specific address
+func (s *LinuxUDPSocket) SendTo(data []byte, ip string, port uint16) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	ipBytes := parseIPv4(ip)
+	if ipBytes == nil {
+		return 0, fmt.Errorf("invalid IP address: %s", ip)
+	}
+
+	destAddr := &syscall.SockaddrInet4{
+		Port: int(port),
+		Addr: [4]byte{ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3]},
+	}
+	buf := syscall.WSABuf{Len: uint32(len(data)), Buf: &data[0]}
+
+	if err := s.applyDeadline(soSndTimeo, &s.writeDeadline, &s.sendTimeout); err != nil {
+		return 0, err
+	}
+	var sent uint32
+	if err := syscall.WSASendto(s.sock(), &buf, 1, &sent, 0, destAddr, nil, nil); err != nil {
+		err = wsaError(err)
+		if s.deadlinePassed(&s.writeDeadline, err) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return 0, &SocketError{Op: "sendto", Err: err}
+	}
+	return int(sent), nil
+}
+
+// RecvFrom receives data and returns sender address
+func (s *LinuxUDPSocket) RecvFrom(buffer []byte) (int, SocketAddr, error) {
+	if len(buffer) == 0 {
+		return 0, SocketAddr{}, fmt.Errorf("empty receive buffer")
+	}
+	if err := s.applyDeadline(soRcvTimeo, &s.readDeadline, &s.recvTimeout); err != nil {
+		return 0, SocketAddr{}, err
+	}
+
+	buf := syscall.WSABuf{Len: uint32(len(buffer)), Buf: &buffer[0]}
+	var from syscall.RawSockaddrAny
+	fromLen := int32(unsafe.Sizeof(from))
+	var received, flags uint32
+	if err := syscall.WSARecvFrom(s.sock(), &buf, 1, &received, &flags, &from, &fromLen, nil, nil); err != nil {
+		err = wsaError(err)
+		if s.deadlinePassed(&s.readDeadline, err) {
+			return 0, SocketAddr{}, os.ErrDeadlineExceeded
+		}
+		return 0, SocketAddr{}, &SocketError{Op: "recvfrom", Err: err}
+	}
+
+	var fromAddr SocketAddr
+	if sa, err := from.Sockaddr(); err == nil {
+		if fromInet4, ok := sa.(*syscall.SockaddrInet4); ok {
+			fromAddr = inet4Addr(fromInet4)
+		}
+	}
+	return int(received), fromAddr, nil
+}
+
+// SetNonBlocking sets non-blocking mode
+func (s *LinuxUDPSocket) SetNonBlocking(nonBlocking bool) error {
+	var mode uint32
+	if nonBlocking {
+		mode = 1
+	}
+	var returned uint32
+	if err := syscall.WSAIoctl(s.sock(), wsaFIONBIO, (*byte)(unsafe.Pointer(&mode)),
+		uint32(unsafe.Sizeof(mode)), nil, 0, &returned, nil, 0); err != nil {
+		return fmt.Errorf("failed to set non-blocking mode: %v", err)
+	}
+
+	s.nonBlocking = nonBlocking
+	return nil
+}
+
+// Close closes the socket
+func (s *LinuxUDPSocket) Close() error {
+	invalid := syscall.InvalidHandle
+	if fd := syscall.Handle(s.fd.Swap(int64(invalid))); fd != 0 && fd != invalid {
+		return syscall.Closesocket(fd)
+	}
+	return nil
+}
+
+// inet4Addr converts a Winsock address into a SocketAddr
+func inet4Addr(sa *syscall.SockaddrInet4) SocketAddr {
+	return SocketAddr{
+		IP:   fmt.Sprintf("%d.%d.%d.%d", sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+		Port: uint16(sa.Port),
+	}
+}
+
+// wsaError maps a would-block error onto syscall.EAGAIN, so the
+// SocketError wrapping it matches ErrWouldBlock as on Linux
+func wsaError(err error) error {
+	if err == wsaEWOULDBLOCK {
+		return syscall.EAGAIN
+	}
+	return err
+}
+
+// setTimeoutOption sets SO_RCVTIMEO or SO_SNDTIMEO to timeout, 0 for
+// none. Winsock counts whole milliseconds, so shorter timeouts are
+// rounded up rather than turned into no timeout at all.
+func setTimeoutOption(fd socketFD, option int, timeout int64) error {
+	ms := (timeout + 999999) / 1000000
+	return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, option, int(ms))
+}
+
+// isTimeout reports whether a blocking call failed because its socket
+// timeout expired
+func isTimeout(err error) bool {
+	return err == wsaETIMEDOUT
+}
+
+// keepUDPChecksum does nothing: Winsock always checksums UDP datagrams
+func keepUDPChecksum(fd socketFD) error {
+	return nil
+}
@@ -0,0 +1,437 @@
+package ultrafast
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// StartupConfig is the server binary's config file, in TOML: the settings
+// fixed when the server starts. The whole file is checked, key and
+// certificate files read included, before any socket is opened.
+//
+//	listen = "0.0.0.0:80"
+//	log_level = "info"
+//	config = "/etc/ultrafast/runtime.json"  # ServerConfig, reloaded on SIGHUP
+//
+//	[socket]
+//	trigger = "edge"        # edge, level or oneshot
+//	checksum = "loopback"   # always, loopback or offload
+//	dscp = 46
+//	recv_buffer = 8_388_608
+//
+//	[timeouts]
+//	handler = "10s"
+//	idle = "30s"
+//	receive = "5s"
+//
+//	[limits]
+//	max_connections = 10000
+//	max_header_bytes = 8192
+//	max_body_bytes = 1_048_576
+//
+//	[tls]
+//	cert = "/etc/ultrafast/cert.pem"
+//	key = "/etc/ultrafast/key.pem"
+//
+//	[keys]
+//	packet_auth = "/etc/ultrafast/packet.key"  # files of raw key bytes
+//
+//	[privileges]
+//	user = "nobody"
+//
+//	[mirror]
+//	target = "10.0.0.9:8080"  # shadow server, see EnableMirror
+//	sample_rate = 0.1
+//
+//	[[routes]]
+//	path = "/assets/"
+//	prefix = true
+//	dir = "/srv/public"
+type StartupConfig struct {
+	Listen        string         `json:"listen"`    // ip:port, default 127.0.0.1:8080
+	Multipath     string         `json:"multipath"` // second ip:port to serve on, none if empty
+	LogLevel      string         `json:"log_level"`
+	Service       string         `json:"service"` // http, echo or discard; http if empty
+	RuntimeConfig string         `json:"config"`  // JSON ServerConfig file, none if empty
+	Socket        SocketFile     `json:"socket"`
+	Timeouts      TimeoutsFile   `json:"timeouts"`
+	Limits        LimitsFile     `json:"limits"`
+	TLS           *TLSFile       `json:"tls"`
+	Keys          KeysFile       `json:"keys"`
+	Privileges    *PrivilegeDrop `json:"privileges"`
+	Sandbox       *SandboxFile   `json:"sandbox"`
+	Mirror        *MirrorFile    `json:"mirror"`
+	Routes        []RouteConfig  `json:"routes"`
+
+	trigger       TriggerMode
+	checksum      ChecksumMode
+	certificate   tls.Certificate
+	packetAuthKey []byte
+	statelessKey  []byte
+}
+
+// SocketFile sets options of the server's socket
+type SocketFile struct {
+	Trigger    string `json:"trigger"`     // epoll trigger mode, default edge
+	Checksum   string `json:"checksum"`    // when packets are checksummed, default always
+	DSCP       *int   `json:"dscp"`        // DiffServ code point of outgoing packets
+	RecvBuffer int    `json:"recv_buffer"` // kernel buffer sizes in bytes, default 2MB
+	SendBuffer int    `json:"send_buffer"`
+}
+
+// TimeoutsFile sets the server's timeouts; zero keeps the defaults
+type TimeoutsFile struct {
+	Handler Duration `json:"handler"` // per-request handler deadline
+	Idle    Duration `json:"idle"`    // keep-alive idle timeout
+	Receive Duration `json:"receive"` // to receive every packet of a request
+}
+
+// LimitsFile sets the server's limits; zero keeps the defaults
+type LimitsFile struct {
+	MaxConnections     int    `json:"max_connections"` // concurrent connections admitted, no limit by default
+	Backlog            int    `json:"backlog"`
+	TrackedConnections int    `json:"tracked_connections"` // keep-alive connections tracked at once
+	MaxRequests        uint64 `json:"max_requests"`        // per connection
+	MaxHeaderBytes     int    `json:"max_header_bytes"`
+	MaxBodyBytes       int    `json:"max_body_bytes"`
+}
+
+// TLSFile names the PEM certificate chain and key served over TLS
+type TLSFile struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// KeysFile names files holding raw key bytes
+type KeysFile struct {
+	PacketAuth string `json:"packet_auth"` // authenticates every packet, see SetPacketAuth
+	Stateless  string `json:"stateless"`   // enables stateless mode with a shared cookie key
+}
+
+// SandboxFile enables the seccomp sandbox, see SetSandbox
+type SandboxFile struct {
+	ExtraSyscalls []string `json:"extra_syscalls"`
+	Action        string   `json:"action"` // deny (default), kill or log
+}
+
+// MirrorFile copies a sample of requests to a shadow server
+type MirrorFile struct {
+	Target     string  `json:"target"`      // ip:port
+	SampleRate float64 `json:"sample_rate"` // fraction mirrored, default 1
+}
+
+// sandboxConfig converts the file form of a sandbox
+func (f *SandboxFile) sandboxConfig() (*SandboxConfig, error) {
+	config := &SandboxConfig{ExtraSyscalls: f.ExtraSyscalls}
+	if f.Action != "" {
+		action, err := ParseSandboxAction(f.Action)
+		if err != nil {
+			return nil, err
+		}
+		config.Action = action
+	}
+	return config, nil
+}
+
+// Duration is a time.Duration written as a string such as "1.5s"
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\"")
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil || parsed < 0 {
+		return fmt.Errorf("invalid duration: %q", text)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// LoadStartupConfig reads and checks a TOML startup config. Relative
+// paths in it are taken from the file's directory.
+func LoadStartupConfig(path string) (*StartupConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseStartupConfig(data, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// ParseStartupConfig parses and checks a TOML startup config, with
+// relative paths taken from the working directory
+func ParseStartupConfig(data []byte) (*StartupConfig, error) {
+	return parseStartupConfig(data, ".")
+}
+
+// parseStartupConfig parses a startup config, resolving relative paths
+// against dir
+func parseStartupConfig(data []byte, dir string) (*StartupConfig, error) {
+	var config StartupConfig
+	if err := decodeTOML(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	resolve := func(path *string) {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+	resolve(&config.RuntimeConfig)
+	resolve(&config.Keys.PacketAuth)
+	resolve(&config.Keys.Stateless)
+	if config.TLS != nil {
+		resolve(&config.TLS.Cert)
+		resolve(&config.TLS.Key)
+	}
+	for i := range config.Routes {
+		resolve(&config.Routes[i].Dir)
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// validate checks every setting and loads the files the config names
+func (c *StartupConfig) validate() error {
+	var err error
+	if c.Listen == "" {
+		c.Listen = "127.0.0.1:8080"
+	}
+	if _, err := ParseSocketAddr(c.Listen); err != nil {
+		return fmt.Errorf("invalid listen address: %v", err)
+	}
+	if c.Multipath != "" {
+		if _, err := ParseSocketAddr(c.Multipath); err != nil {
+			return fmt.Errorf("invalid multipath address: %v", err)
+		}
+	}
+	if c.LogLevel != "" {
+		if _, err := ParseLogLevel(c.LogLevel); err != nil {
+			return err
+		}
+	}
+	if c.Service != "" {
+		if _, err := ParseService(c.Service); err != nil {
+			return err
+		}
+	}
+	if c.RuntimeConfig != "" {
+		data, err := os.ReadFile(c.RuntimeConfig)
+		if err != nil {
+			return err
+		}
+		if _, err := ParseServerConfig(data); err != nil {
+			return fmt.Errorf("%s: %v", c.RuntimeConfig, err)
+		}
+	}
+
+	if c.Socket.Trigger != "" {
+		if c.trigger, err = ParseTriggerMode(c.Socket.Trigger); err != nil {
+			return err
+		}
+	}
+	if c.Socket.Checksum != "" {
+		if c.checksum, err = ParseChecksumMode(c.Socket.Checksum); err != nil {
+			return err
+		}
+	}
+	if dscp := c.Socket.DSCP; dscp != nil && (*dscp < 0 || *dscp > 63) {
+		return fmt.Errorf("invalid DSCP: %d", *dscp)
+	}
+	if c.Socket.RecvBuffer < 0 || c.Socket.SendBuffer < 0 {
+		return fmt.Errorf("buffer sizes must not be negative")
+	}
+
+	limits := c.Limits
+	if limits.MaxConnections < 0 || limits.Backlog < 0 || limits.TrackedConnections < 0 ||
+		limits.MaxHeaderBytes < 0 || limits.MaxBodyBytes < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+
+	if c.TLS != nil {
+		if c.certificate, err = tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key); err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+	}
+	if c.Keys.PacketAuth != "" {
+		if c.packetAuthKey, err = os.ReadFile(c.Keys.PacketAuth); err != nil {
+			return err
+		}
+		if len(c.packetAuthKey) < minAuthKeySize {
+			return fmt.Errorf("%s: packet authentication key must be at least %d bytes", c.Keys.PacketAuth, minAuthKeySize)
+		}
+	}
+	if c.Keys.Stateless != "" {
+		if c.statelessKey, err = os.ReadFile(c.Keys.Stateless); err != nil {
+			return err
+		}
+		if len(c.statelessKey) == 0 {
+			return fmt.Errorf("%s: stateless key is empty", c.Keys.Stateless)
+		}
+	}
+
+	if c.Privileges != nil {
+		if _, _, err := c.Privileges.credentials(); err != nil {
+			return err
+		}
+		if c.Privileges.Chroot != "" {
+			if info, err := os.Stat(c.Privileges.Chroot); err != nil || !info.IsDir() {
+				return fmt.Errorf("chroot %s is not a directory", c.Privileges.Chroot)
+			}
+		}
+	}
+	if c.Sandbox != nil {
+		sandbox, err := c.Sandbox.sandboxConfig()
+		if err != nil {
+			return err
+		}
+		if err := checkSandbox(sandbox); err != nil {
+			return err
+		}
+	}
+	if c.Mirror != nil {
+		if _, err := ParseSocketAddr(c.Mirror.Target); err != nil {
+			return fmt.Errorf("invalid mirror target: %v", err)
+		}
+		if c.Mirror.SampleRate < 0 || c.Mirror.SampleRate > 1 {
+			return fmt.Errorf("invalid sample rate: %v", c.Mirror.SampleRate)
+		}
+	}
+	return validateRoutes(c.Routes)
+}
+
+// NewServerFromConfig creates a server listening where config says, with
+// every setting of config applied. Its exported fields may be changed
+// after parsing, to start several servers from one file; the addresses
+// are parsed anew.
+func NewServerFromConfig(config *StartupConfig) (*UltraFastHTTPServer, error) {
+	listen, err := ParseSocketAddr(config.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address: %v", err)
+	}
+	server, err := NewUltraFastHTTPServer(listen.IP, listen.Port)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.apply(server); err != nil {
+		server.Close()
+		return nil, err
+	}
+	return server, nil
+}
+
+// apply configures a new server
+func (c *StartupConfig) apply(s *UltraFastHTTPServer) error {
+	if c.LogLevel != "" {
+		level, _ := ParseLogLevel(c.LogLevel)
+		SetLogLevel(level)
+	}
+	if c.Multipath != "" {
+		multipath, err := ParseSocketAddr(c.Multipath)
+		if err != nil {
+			return fmt.Errorf("invalid multipath address: %v", err)
+		}
+		if err := s.EnableMultipath(multipath.IP, multipath.Port); err != nil {
+			return err
+		}
+	}
+
+	if c.Service != "" {
+		service, err := ParseService(c.Service)
+		if err != nil {
+			return err
+		}
+		if err := s.SetService(service); err != nil {
+			return err
+		}
+	}
+
+	if err := s.SetTriggerMode(c.trigger); err != nil {
+		return err
+	}
+	if err := s.SetChecksumMode(c.checksum); err != nil {
+		return err
+	}
+	if c.Socket.DSCP != nil {
+		if err := s.SetDSCP(*c.Socket.DSCP); err != nil {
+			return err
+		}
+	}
+	if err := s.SetSocketBuffers(c.Socket.RecvBuffer, c.Socket.SendBuffer); err != nil {
+		return err
+	}
+
+	if c.Timeouts.Handler != 0 {
+		s.SetHandlerTimeout(time.Duration(c.Timeouts.Handler))
+	}
+	s.SetKeepAlive(KeepAliveConfig{
+		IdleTimeout:    time.Duration(c.Timeouts.Idle),
+		MaxRequests:    c.Limits.MaxRequests,
+		MaxConnections: c.Limits.TrackedConnections,
+	})
+	s.SetRequestLimits(RequestLimits{
+		MaxHeaderBytes: c.Limits.MaxHeaderBytes,
+		MaxBodyBytes:   c.Limits.MaxBodyBytes,
+		ReceiveTimeout: time.Duration(c.Timeouts.Receive),
+	})
+	s.SetConnectionLimits(ConnectionLimits{MaxConnections: c.Limits.MaxConnections, Backlog: c.Limits.Backlog})
+
+	if c.TLS != nil {
+		s.SetTLSConfig(&tls.Config{
+			Certificates: []tls.Certificate{c.certificate},
+			MinVersion:   tls.VersionTLS13,
+		})
+	}
+	if c.packetAuthKey != nil {
+		if err := s.SetPacketAuth(c.packetAuthKey); err != nil {
+			return err
+		}
+	}
+	if c.statelessKey != nil {
+		if err := s.EnableStateless(c.statelessKey); err != nil {
+			return err
+		}
+	}
+	s.SetPrivilegeDrop(c.Privileges)
+	if c.Sandbox != nil {
+		sandbox, err := c.Sandbox.sandboxConfig()
+		if err != nil {
+			return err
+		}
+		s.SetSandbox(sandbox)
+	} else {
+		s.SetSandbox(nil)
+	}
+	if c.Mirror != nil {
+		target, err := ParseSocketAddr(c.Mirror.Target)
+		if err != nil {
+			return fmt.Errorf("invalid mirror target: %v", err)
+		}
+		if _, err := s.EnableMirror(target, MirrorConfig{SampleRate: c.Mirror.SampleRate}); err != nil {
+			return err
+		}
+	}
+
+	for _, route := range c.Routes {
+		if route.Prefix {
+			s.HandlePrefix(route.Path, route.handler())
+		} else {
+			s.HandleFunc(route.Path, route.handler())
+		}
+	}
+	if c.RuntimeConfig != "" {
+		return s.LoadConfig(c.RuntimeConfig)
+	}
+	return nil
+}
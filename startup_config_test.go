@@ -0,0 +1,92 @@
+package ultrafast
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStartupConfig(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "auth.key"), []byte("0123456789abcdef0123"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "server.toml")
+	if err := os.WriteFile(path, []byte(`
+listen = "127.0.0.1:0"
+log_level = "warn"
+
+[socket]
+trigger = "level"
+checksum = "loopback"
+
+[timeouts]
+handler = "2s"
+idle = "1m"
+
+[limits]
+max_connections = 100
+max_body_bytes = 4096
+
+[keys]
+packet_auth = "auth.key"
+
+[[routes]]
+path = "/hello"
+body = "hi"
+
+[[routes]]
+path = "/files/"
+prefix = true
+dir = "."
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadStartupConfig(path)
+	if err != nil {
+		t.Fatalf("Valid config rejected: %v", err)
+	}
+	if config.trigger != TRIGGER_LEVEL || config.checksum != CHECKSUM_LOOPBACK ||
+		time.Duration(config.Timeouts.Idle) != time.Minute || config.Limits.MaxConnections != 100 ||
+		len(config.packetAuthKey) != 20 || len(config.Routes) != 2 || config.Routes[1].Dir != dir {
+		t.Errorf("Unexpected config %+v", config)
+	}
+
+	defer SetLogLevel(GetLogLevel())
+	server, err := NewServerFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if server.TriggerMode() != TRIGGER_LEVEL || server.HandlerTimeout() != 2*time.Second ||
+		server.RequestLimits().MaxBodyBytes != 4096 || server.ConnectionLimits().MaxConnections != 100 ||
+		!server.socket.PacketAuthEnabled() {
+		t.Error("Expected the config applied to the server")
+	}
+
+	invalid := map[string]string{
+		`listen = "localhost:80"`:                    "invalid listen address",
+		`log_level = "loud"`:                         "unknown log level",
+		`service = "chargen"`:                        "unknown service",
+		"[mirror]\ntarget = \"shadow\"":              "invalid mirror target",
+		"[socket]\ntrigger = \"sometimes\"":          "unknown trigger mode",
+		"[socket]\ndscp = 64":                        "invalid DSCP",
+		"[timeouts]\nidle = 30":                      "duration must be a string",
+		"[timeouts]\nidle = \"soon\"":                "invalid duration",
+		"[limits]\nmax_body_bytes = -1":              "must not be negative",
+		"[tls]\ncert = \"none.pem\"\nkey = \"none\"": "TLS certificate",
+		"[keys]\npacket_auth = \"missing.key\"":      "missing.key",
+		"[privileges]\nuser = \"no-such-user\"":      "unknown user",
+		"[[routes]]\npath = \"nope\"":                "must start with /",
+		`unknown = 1`:                                "unknown field",
+	}
+	for data, reason := range invalid {
+		_, err := ParseStartupConfig([]byte(data))
+		if err == nil || !strings.Contains(err.Error(), reason) {
+			t.Errorf("Expected %q to be rejected for %q, got %v", data, reason, err)
+		}
+	}
+}
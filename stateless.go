@@ -0,0 +1,295 @@
+package ultrafast
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// OPT_STATELESS asks for a request to be answered without connection
+// state. On a request it carries the client's cookie, empty if it has
+// none yet; on a RETRY it carries a fresh cookie; on a response it is
+// empty and tells the client not to acknowledge it.
+const OPT_STATELESS = 0x08
+
+// statelessCookieLifetime bounds how long a stateless cookie is accepted.
+// Cookies are not single-use, so one RETRY round trip serves a client for
+// this long.
+const statelessCookieLifetime = time.Hour
+
+// statelessCookieMACSize is the truncated MAC length in a stateless cookie
+const statelessCookieMACSize = 16
+
+// StatelessCookieJar mints and validates the cookies that let a client
+// send single-packet requests without a handshake. A cookie is bound to
+// the client's IP address but not its port, and to nothing else on the
+// server, so every server sharing the key accepts it: a client behind an
+// anycast address may reach a different server on each request.
+type StatelessCookieJar struct {
+	key [32]byte
+	now func() time.Time
+}
+
+// NewStatelessCookieJar creates a cookie jar keyed by key, or by a random
+// key if key is empty. Servers answering on one anycast address should
+// share a key.
+func NewStatelessCookieJar(key []byte) (*StatelessCookieJar, error) {
+	jar := &StatelessCookieJar{now: time.Now}
+	if len(key) == 0 {
+		if _, err := rand.Read(jar.key[:]); err != nil {
+			return nil, fmt.Errorf("failed to generate stateless cookie key: %v", err)
+		}
+		return jar, nil
+	}
+	jar.key = sha256.Sum256(key)
+	return jar, nil
+}
+
+// Mint returns a cookie for a client at ip
+func (j *StatelessCookieJar) Mint(ip string) []byte {
+	cookie := make([]byte, 4, 4+statelessCookieMACSize)
+	binary.BigEndian.PutUint32(cookie, uint32(j.now().Unix()))
+	return append(cookie, j.mac(ip, cookie[:4])...)
+}
+
+// Validate checks a cookie presented by a client at ip
+func (j *StatelessCookieJar) Validate(ip string, cookie []byte) error {
+	if len(cookie) != 4+statelessCookieMACSize {
+		return fmt.Errorf("stateless cookie has wrong length: %d bytes", len(cookie))
+	}
+	if !hmac.Equal(cookie[4:], j.mac(ip, cookie[:4])) {
+		return fmt.Errorf("stateless cookie authentication failed")
+	}
+
+	issuedAt := time.Unix(int64(binary.BigEndian.Uint32(cookie[:4])), 0)
+	if age := j.now().Sub(issuedAt); age > statelessCookieLifetime || age < -time.Second {
+		return fmt.Errorf("stateless cookie expired")
+	}
+	return nil
+}
+
+// mac binds a cookie timestamp to the client's IP address
+func (j *StatelessCookieJar) mac(ip string, timestamp []byte) []byte {
+	h := hmac.New(sha256.New, j.key[:])
+	h.Write([]byte{'S'})
+	h.Write(timestamp)
+	h.Write([]byte(ip))
+	return h.Sum(nil)[:statelessCookieMACSize]
+}
+
+// EnableStateless answers single-packet GET and HEAD requests carrying a
+// valid cookie without a handshake, acknowledgement or retransmission
+// state, which suits DNS-like workloads of many small lookups. The
+// client retransmits on timeout, so only requests safe to repeat are
+// served this way; others, and responses too large for one packet, are
+// refused with RST and the client falls back to a connection. An empty
+// key picks a random one; servers behind one anycast address should be
+// given the same key so a cookie from one is accepted by the others.
+func (s *UltraFastHTTPServer) EnableStateless(key []byte) error {
+	jar, err := NewStatelessCookieJar(key)
+	if err != nil {
+		return err
+	}
+	s.stateless.Store(jar)
+	return nil
+}
+
+// DisableStateless turns stateless mode off. Stateless requests are then
+// served like any other request from a peer without a connection.
+func (s *UltraFastHTTPServer) DisableStateless() {
+	s.stateless.Store(nil)
+}
+
+// StatelessEnabled reports whether stateless mode is on
+func (s *UltraFastHTTPServer) StatelessEnabled() bool {
+	return s.stateless.Load() != nil
+}
+
+// serveStateless answers a request carrying OPT_STATELESS. A missing or
+// invalid cookie gets a RETRY with a fresh one. A request smaller than
+// its RETRY is dropped instead, so a spoofed source address cannot be
+// used for amplification; a client's GET always outweighs the cookie.
+func (h *HTTPSocketHandler) serveStateless(packet *Packet, from SocketAddr, cookie []byte, jar *StatelessCookieJar) {
+	requestID, _ := packet.RequestID()
+	if err := jar.Validate(from.IP, cookie); err != nil {
+		if len(cookie) > 0 {
+			logDebugf("Rejected stateless cookie from %s:%d: %v", from.IP, from.Port, err)
+		}
+		retryPacket := NewPacket(RETRY_PACKET, 0, 0, packet.SeqNum+1, nil)
+		retryPacket.SetOption(OPT_STATELESS, jar.Mint(from.IP))
+		if requestID != 0 {
+			retryPacket.SetRequestID(requestID)
+		}
+		if retryPacket.encodedSize() > packet.encodedSize() {
+			atomic.AddUint64(&h.server.stats.AmplificationLimited, 1)
+			return
+		}
+		h.sendPacket(retryPacket, from)
+		return
+	}
+
+	if _, _, fragmented := packet.Fragment(); fragmented {
+		h.refuseStateless(from)
+		return
+	}
+	if !withinRequestLimits(packet.Payload, h.server.RequestLimits()) {
+		atomic.AddUint64(&h.server.stats.RequestsRejected, 1)
+		h.sendStateless(statelessError(413), nil, from, requestID)
+		return
+	}
+	request, err := h.parseHTTPRequest(packet.Payload)
+	if err != nil {
+		h.sendStateless(statelessError(400), nil, from, requestID)
+		return
+	}
+	if !isSafeMethod(request.Method) {
+		h.refuseStateless(from)
+		return
+	}
+	request.ID = requestID
+	request.Peer = from
+	request.received = clockNow()
+
+	ctx, cancel := h.newRequestContext(nil, RequestInfo{
+		Peer:      from,
+		RequestID: requestID,
+		Stateless: true,
+		Received:  request.received,
+	})
+	respond := func(response *HTTPResponse) {
+		cancel()
+		h.sendStateless(response, request, from, requestID)
+	}
+
+	pool := h.server.workers.Load()
+	if pool == nil {
+		respond(h.handleHTTPRequest(ctx, request))
+		return
+	}
+	submitted := pool.Submit(func() {
+		response := h.handleHTTPRequest(ctx, request)
+		h.server.sendOnLoop(func() {
+			respond(response)
+		})
+	})
+	if !submitted {
+		atomic.AddUint64(&h.server.stats.HandlerRejected, 1)
+		cancel()
+		h.sendStateless(statelessError(503), nil, from, requestID)
+	}
+}
+
+// sendStateless sends a response in one untracked DATA packet, or refuses
+// it with RST if it does not fit. request is nil for error responses
+// raised before a handler ran.
+func (h *HTTPSocketHandler) sendStateless(response *HTTPResponse, request *HTTPRequest, to SocketAddr, requestID uint32) {
+	defer releaseResponse(response)
+	responseData := h.serializeHTTPResponse(response, false)
+	if response.length(responseData) > MAX_PAYLOAD_SIZE {
+		h.refuseStateless(to)
+		return
+	}
+	if response.file != nil {
+		payload := make([]byte, response.length(responseData))
+		n := copy(payload, responseData)
+		if err := response.file.readAt(payload[n:], 0); err != nil {
+			logWarnf("Failed to read response body for %s:%d: %v", to.IP, to.Port, err)
+			atomic.AddUint64(&h.server.stats.Errors, 1)
+			return
+		}
+		responseData = payload
+	}
+
+	packet := NewPacket(DATA_PACKET, 0, 0, 0, responseData)
+	packet.SetOption(OPT_STATELESS, nil)
+	if requestID != 0 {
+		packet.SetRequestID(requestID)
+	}
+	sent, err := h.sendPacket(packet, to)
+	if err != nil {
+		atomic.AddUint64(&h.server.stats.Errors, 1)
+		return
+	}
+
+	atomic.AddUint64(&h.server.stats.StatelessServed, 1)
+	atomic.AddUint64(&h.server.stats.ResponsesSent, 1)
+	atomic.AddUint64(&h.server.stats.BytesSent, uint64(sent))
+	if request != nil {
+		h.server.logAccess(request, response.StatusCode, int64(len(responseData)))
+	}
+}
+
+// statelessError builds an error response small enough for one packet
+func statelessError(statusCode int) *HTTPResponse {
+	return &HTTPResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       []byte(getStatusText(statusCode)),
+	}
+}
+
+// refuseStateless tells the client to send the request over a connection
+// instead
+func (h *HTTPSocketHandler) refuseStateless(to SocketAddr) {
+	atomic.AddUint64(&h.server.stats.StatelessRefused, 1)
+	h.sendPacket(NewPacket(RST_PACKET, RST_FLAG, 0, 0, nil), to)
+}
+
+// StatelessCookie returns the cookie for stateless requests, if any
+func (c *UltraFastClient) StatelessCookie() []byte {
+	return c.cookie
+}
+
+// SetStatelessCookie installs a cookie saved from an earlier client, or
+// handed out by another server sharing the key
+func (c *UltraFastClient) SetStatelessCookie(cookie []byte) {
+	c.cookie = cookie
+}
+
+// GetStateless sends a GET request for path in a single packet, to be
+// answered without a handshake by a server in stateless mode. A client
+// without a valid cookie is sent one in a RETRY first. If the server
+// refuses to answer statelessly, or the client is already connected, the
+// request goes over a connection like Get.
+func (c *UltraFastClient) GetStateless(path string) ([]byte, error) {
+	request := buildGetRequest(path, c.server)
+	if c.connected || len(request) > MAX_PAYLOAD_SIZE {
+		return c.Do(request)
+	}
+
+	requestID := c.newRequestID()
+	packet := NewPacket(DATA_PACKET, 0, c.nextSeq, 0, request)
+	packet.SetRequestID(requestID)
+	accept := func(p *Packet) bool {
+		id, _ := p.RequestID()
+		return (p.IsRetryPacket() || p.IsDataPacket()) && id == requestID
+	}
+
+	for retried := false; ; retried = true {
+		packet.SetOption(OPT_STATELESS, c.cookie)
+		reply, err := c.exchange(packet, accept)
+		if errors.Is(err, ErrConnClosed) {
+			return c.Do(request)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !reply.IsRetryPacket() {
+			return reply.Payload, nil
+		}
+		if retried {
+			return nil, fmt.Errorf("server sent a second RETRY")
+		}
+
+		cookie, ok := reply.GetOption(OPT_STATELESS)
+		if !ok {
+			return nil, fmt.Errorf("RETRY packet carries no cookie")
+		}
+		c.cookie = cookie
+	}
+}
@@ -0,0 +1,158 @@
+package ultrafast
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatelessCookieJar(t *testing.T) {
+	key := []byte("anycast group key")
+	first, err := NewStatelessCookieJar(key)
+	if err != nil {
+		t.Fatalf("NewStatelessCookieJar failed: %v", err)
+	}
+	second, _ := NewStatelessCookieJar(key)
+	other, _ := NewStatelessCookieJar(nil)
+
+	cookie := first.Mint("10.0.0.1")
+	if err := second.Validate("10.0.0.1", cookie); err != nil {
+		t.Errorf("A server sharing the key should accept the cookie: %v", err)
+	}
+	if err := other.Validate("10.0.0.1", cookie); err == nil {
+		t.Error("A server with another key should refuse the cookie")
+	}
+	if err := first.Validate("10.0.0.2", cookie); err == nil {
+		t.Error("A cookie should not be accepted from another address")
+	}
+
+	first.now = func() time.Time { return time.Now().Add(statelessCookieLifetime + time.Minute) }
+	if err := first.Validate("10.0.0.1", cookie); err == nil {
+		t.Error("An expired cookie should be refused")
+	}
+}
+
+func TestServerStatelessGet(t *testing.T) {
+	key := []byte("anycast group key")
+	server := startTestServer(t)
+	if err := server.EnableStateless(key); err != nil {
+		t.Fatalf("EnableStateless failed: %v", err)
+	}
+	server.HandleFunc("/lookup", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		info, _ := RequestInfoFromContext(ctx)
+		if !info.Stateless {
+			return &HTTPResponse{StatusCode: 500, Headers: map[string]string{}, Body: []byte("stateful")}
+		}
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: []byte("10.1.2.3")}
+	})
+	body := bytes.Repeat([]byte("x"), 2*MAX_PAYLOAD_SIZE)
+	server.HandleFunc("/large", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: body}
+	})
+
+	// The first request is sent a cookie, then answered
+	client := newTestClient(t, server)
+	response, err := client.GetStateless("/lookup")
+	if err != nil {
+		t.Fatalf("Stateless request failed: %v", err)
+	}
+	if !bytes.HasSuffix(response, []byte("10.1.2.3")) || client.StatelessCookie() == nil {
+		t.Fatalf("Unexpected response %q", response)
+	}
+	if _, err := client.GetStateless("/lookup"); err != nil {
+		t.Fatalf("Second stateless request failed: %v", err)
+	}
+	if infos := server.Connections(); len(infos) != 0 {
+		t.Fatalf("Expected no connection, got %+v", infos)
+	}
+
+	// Another server sharing the key accepts a cookie it never minted
+	other := startTestServer(t)
+	other.EnableStateless(key)
+	other.HandleFunc("/lookup", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: []byte("10.1.2.4")}
+	})
+	jar, _ := NewStatelessCookieJar(key)
+	jar.now = func() time.Time { return time.Now().Add(-time.Minute) }
+	cookie := jar.Mint("127.0.0.1")
+	moved := newTestClient(t, other)
+	moved.SetStatelessCookie(cookie)
+	if response, err := moved.GetStateless("/lookup"); err != nil || !bytes.HasSuffix(response, []byte("10.1.2.4")) {
+		t.Fatalf("Expected an answer from the other server, got %q, %v", response, err)
+	}
+	if !bytes.Equal(moved.StatelessCookie(), cookie) {
+		t.Error("The other server should not have sent a new cookie")
+	}
+
+	// A response too large for one packet is fetched over a connection
+	response, err = client.GetStateless("/large")
+	if err != nil {
+		t.Fatalf("Fallback request failed: %v", err)
+	}
+	if !bytes.HasSuffix(response, body) {
+		t.Fatalf("Expected the whole body, got %d bytes", len(response))
+	}
+	if len(server.Connections()) != 1 || server.GetStats().StatelessRefused != 1 {
+		t.Errorf("Expected one refusal and a connection, got %+v", server.Connections())
+	}
+
+	admin := NewAdminServer("")
+	server.registerAdminCommands(admin)
+	if reply := admin.Execute("stateless"); reply != "stateless on served=2 refused=1\nOK\n" {
+		t.Errorf("Unexpected stateless reply: %q", reply)
+	}
+	if reply := admin.Execute("stateless off"); reply != "stateless off\nOK\n" || server.StatelessEnabled() {
+		t.Errorf("Expected stateless mode off, got %q", reply)
+	}
+	if reply := admin.Execute("stateless maybe"); !strings.HasPrefix(reply, "ERR") {
+		t.Errorf("Expected a bad argument refused, got %q", reply)
+	}
+}
+
+func TestStatelessRetryNoLargerThanRequest(t *testing.T) {
+	server := startTestServer(t)
+	if err := server.EnableStateless(nil); err != nil {
+		t.Fatalf("EnableStateless failed: %v", err)
+	}
+	spoofer, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spoofer.Close()
+	addr := server.socket.GetLocalAddr()
+
+	// Requests without a cookie, from empty to larger than a RETRY, are
+	// each answered with no more bytes than they carried, or dropped
+	buf := make([]byte, 2048)
+	for size := 0; size <= 2*statelessCookieMACSize; size++ {
+		request := NewPacket(DATA_PACKET, 0, 1, 0, bytes.Repeat([]byte("x"), size))
+		request.SetOption(OPT_STATELESS, nil)
+		limited := server.GetStats().AmplificationLimited
+		sent, err := spoofer.SendPacket(request, addr.IP, addr.Port)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for {
+			spoofer.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+			if n, _, err := spoofer.RecvFrom(buf); err == nil {
+				if n > sent {
+					t.Errorf("A %d byte request was answered with %d bytes", sent, n)
+				}
+				break
+			}
+			if server.GetStats().AmplificationLimited > limited {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("A %d byte request was neither answered nor dropped", sent)
+			}
+		}
+	}
+	if server.GetStats().AmplificationLimited == 0 {
+		t.Error("Expected the smallest requests dropped")
+	}
+}
@@ -0,0 +1,321 @@
+package ultrafast
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Static file serving defaults
+const (
+	defaultStatCacheTTL   = time.Second
+	maxStatCacheEntries   = 4096
+	contentSniffSize      = 512
+	maxFileResponseLength = 1<<32 - 1 - maxStreamHeaderSize // fragment offsets are 32-bit
+	httpTimeFormat        = "Mon, 02 Jan 2006 15:04:05 GMT"
+)
+
+// fileBody is a response body sent from a file region after the headers.
+// Over packets each fragment's payload is read straight from the file, so
+// the body is never buffered whole; over TLS streams it is copied in.
+// (ZeroCopySocket.SendFile and Splice cannot be used here: every packet
+// needs its header and a checksum computed over the payload.)
+type fileBody struct {
+	file     *os.File
+	offset   int64
+	length   int64
+	headOnly bool // HEAD request: Content-Length is reported, nothing is sent
+}
+
+// size returns the number of body bytes to send
+func (b *fileBody) size() int64 {
+	if b == nil || b.headOnly {
+		return 0
+	}
+	return b.length
+}
+
+// readAt fills p from the body starting at off
+func (b *fileBody) readAt(p []byte, off int64) error {
+	_, err := b.file.ReadAt(p, b.offset+off)
+	if err == io.EOF {
+		return fmt.Errorf("file truncated while sending")
+	}
+	return err
+}
+
+// WriteTo copies the body to w
+func (b *fileBody) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, io.NewSectionReader(b.file, b.offset, b.size()))
+}
+
+// Close closes the file
+func (b *fileBody) Close() error {
+	return b.file.Close()
+}
+
+// length returns the size of a response serialized as header, including
+// any file body that follows it
+func (r *HTTPResponse) length(header []byte) int {
+	return len(header) + int(r.file.size())
+}
+
+// fileStat is a cached stat result for a path under the root
+type fileStat struct {
+	name        string // resolved file, after directory index lookup
+	info        os.FileInfo
+	contentType string
+	err         error
+	expires     time.Time
+}
+
+// FileServer serves files from a directory: GET and HEAD, single byte
+// ranges, Content-Type by extension or content sniffing, and a short-lived
+// stat cache so hot files cost no syscalls beyond open and read
+type FileServer struct {
+	root  string
+	index string
+
+	mu      sync.RWMutex
+	ttl     time.Duration
+	entries map[string]*fileStat
+}
+
+// NewFileServer creates a file server rooted at dir
+func NewFileServer(dir string) *FileServer {
+	return &FileServer{
+		root:    dir,
+		index:   "index.html",
+		ttl:     defaultStatCacheTTL,
+		entries: make(map[string]*fileStat),
+	}
+}
+
+// SetStatCacheTTL sets how long stat results are reused. Zero disables
+// the cache.
+func (fs *FileServer) SetStatCacheTTL(ttl time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.ttl = ttl
+	fs.entries = make(map[string]*fileStat)
+}
+
+// ServeDir serves the files under dir at paths beginning with prefix and
+// returns the file server for further configuration
+func (s *UltraFastHTTPServer) ServeDir(prefix, dir string) *FileServer {
+	return s.router.ServeDir(prefix, dir)
+}
+
+// ServeDir serves the files under dir at paths beginning with prefix
+func (rt *Router) ServeDir(prefix, dir string) *FileServer {
+	fs := NewFileServer(dir)
+	rt.HandlePrefix(prefix, func(ctx context.Context, r *HTTPRequest) *HTTPResponse {
+		return fs.ServeFile(r, strings.TrimPrefix(r.Path, prefix))
+	})
+	return fs
+}
+
+// ServeFile answers a request with the file at name, relative to the root
+func (fs *FileServer) ServeFile(r *HTTPRequest, name string) *HTTPResponse {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		response := fileErrorResponse(405)
+		response.Headers["Allow"] = "GET, HEAD"
+		return response
+	}
+
+	if query := strings.IndexByte(name, '?'); query >= 0 {
+		name = name[:query]
+	}
+	name = path.Clean("/" + name) // rooted, so ".." cannot climb out
+
+	stat := fs.stat(name)
+	if stat.err != nil {
+		if os.IsNotExist(stat.err) {
+			return fileErrorResponse(404)
+		}
+		if os.IsPermission(stat.err) {
+			return fileErrorResponse(403)
+		}
+		logWarnf("Static file %s: %v", name, stat.err)
+		return fileErrorResponse(500)
+	}
+
+	size := stat.info.Size()
+	start, length := int64(0), size
+	status := 200
+	if spec := r.Header("Range"); spec != "" {
+		var ok bool
+		if start, length, ok = parseByteRange(spec, size); !ok {
+			response := fileErrorResponse(416)
+			response.Headers["Content-Range"] = "bytes */" + strconv.FormatInt(size, 10)
+			return response
+		}
+		if length != size {
+			status = 206
+		}
+	}
+	if length > maxFileResponseLength {
+		return fileErrorResponse(416)
+	}
+
+	file, err := os.Open(stat.name)
+	if err != nil {
+		fs.forget(name)
+		return fileErrorResponse(404)
+	}
+
+	response := &HTTPResponse{
+		StatusCode: status,
+		Headers: map[string]string{
+			"Content-Type":  stat.contentType,
+			"Last-Modified": stat.info.ModTime().UTC().Format(httpTimeFormat),
+			"Accept-Ranges": "bytes",
+			"ETag":          fileETag(stat.info),
+		},
+		file: &fileBody{file: file, offset: start, length: length, headOnly: r.Method == "HEAD"},
+	}
+	if status == 206 {
+		response.Headers["Content-Range"] = fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size)
+	}
+	return response
+}
+
+// stat returns the cached stat result for a cleaned name, refreshing it
+// once it expires
+func (fs *FileServer) stat(name string) *fileStat {
+	now := time.Now()
+	fs.mu.RLock()
+	entry, exists := fs.entries[name]
+	ttl := fs.ttl
+	fs.mu.RUnlock()
+	if exists && now.Before(entry.expires) {
+		return entry
+	}
+
+	entry = fs.lookup(name)
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+		fs.mu.Lock()
+		if len(fs.entries) >= maxStatCacheEntries {
+			fs.entries = make(map[string]*fileStat)
+		}
+		fs.entries[name] = entry
+		fs.mu.Unlock()
+	}
+	return entry
+}
+
+// forget drops a cached stat result
+func (fs *FileServer) forget(name string) {
+	fs.mu.Lock()
+	delete(fs.entries, name)
+	fs.mu.Unlock()
+}
+
+// lookup stats a file, resolving directories to their index file
+func (fs *FileServer) lookup(name string) *fileStat {
+	full := filepath.Join(fs.root, filepath.FromSlash(name))
+	info, err := os.Stat(full)
+	if err == nil && info.IsDir() {
+		full = filepath.Join(full, fs.index)
+		info, err = os.Stat(full)
+	}
+	if err != nil {
+		return &fileStat{err: err}
+	}
+	if !info.Mode().IsRegular() {
+		return &fileStat{err: os.ErrNotExist}
+	}
+	return &fileStat{name: full, info: info, contentType: detectContentType(full)}
+}
+
+// detectContentType picks a Content-Type from the file extension, falling
+// back to sniffing the start of the file for text
+func detectContentType(name string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(name)); contentType != "" {
+		return contentType
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+
+	head := make([]byte, contentSniffSize)
+	n, _ := io.ReadFull(file, head)
+	head = head[:n]
+	if utf8.Valid(head) && !strings.ContainsRune(string(head), 0) {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// parseByteRange parses a single "bytes=" range against a file of size
+// bytes. Multiple ranges are not supported and select the whole file.
+func parseByteRange(spec string, size int64) (start, length int64, ok bool) {
+	if !strings.HasPrefix(spec, "bytes=") {
+		return 0, size, true
+	}
+	spec = strings.TrimSpace(spec[len("bytes="):])
+	if strings.Contains(spec, ",") {
+		return 0, size, true
+	}
+
+	dash := strings.IndexByte(spec, '-')
+	if dash < 0 {
+		return 0, 0, false
+	}
+	first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+	if first == "" {
+		// Suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, size > 0
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
+
+// fileETag derives an ETag from a file's modification time and size
+func fileETag(info os.FileInfo) string {
+	return `"` + strconv.FormatInt(info.ModTime().UnixNano(), 16) + "-" + strconv.FormatInt(info.Size(), 16) + `"`
+}
+
+// fileErrorResponse builds a plain-text error response
+func fileErrorResponse(statusCode int) *HTTPResponse {
+	return &HTTPResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       []byte(getStatusText(statusCode)),
+	}
+}
@@ -0,0 +1,105 @@
+package ultrafast
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		spec          string
+		start, length int64
+		ok            bool
+	}{
+		{"bytes=0-99", 0, 100, true},
+		{"bytes=100-", 100, 900, true},
+		{"bytes=-100", 900, 100, true},
+		{"bytes=-5000", 0, 1000, true},
+		{"bytes=990-5000", 990, 10, true},
+		{"bytes=0-9,20-29", 0, 1000, true}, // multiple ranges: whole file
+		{"bytes=1000-", 0, 0, false},
+		{"bytes=50-10", 0, 0, false},
+		{"bytes=abc", 0, 0, false},
+	}
+	for _, test := range tests {
+		start, length, ok := parseByteRange(test.spec, 1000)
+		if ok != test.ok || ok && (start != test.start || length != test.length) {
+			t.Errorf("parseByteRange(%q) = %d, %d, %v; want %d, %d, %v",
+				test.spec, start, length, ok, test.start, test.length, test.ok)
+		}
+	}
+}
+
+// splitResponse separates a raw HTTP response into headers and body
+func splitResponse(t *testing.T, response []byte) (string, []byte) {
+	end := bytes.Index(response, []byte("\r\n\r\n"))
+	if end < 0 {
+		t.Fatalf("Malformed response %q", response)
+	}
+	return string(response[:end+2]), response[end+4:]
+}
+
+func TestServeDir(t *testing.T) {
+	dir := t.TempDir()
+	large := make([]byte, 20000) // spans many packets
+	for i := range large {
+		large[i] = byte(i * 7)
+	}
+	os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("hello, static world"), 0644)
+	os.WriteFile(filepath.Join(dir, "large.bin"), large, 0644)
+	os.Mkdir(filepath.Join(dir, "docs"), 0755)
+	os.WriteFile(filepath.Join(dir, "docs", "index.html"), []byte("<h1>docs</h1>"), 0644)
+
+	server := startTestServer(t)
+	server.ServeDir("/static/", dir)
+	client := newTestClient(t, server)
+
+	response, err := client.Get("/static/hello.txt")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	headers, body := splitResponse(t, response)
+	if !containsString(headers, "HTTP/1.1 200 OK") || !containsString(headers, "Content-Type: text/plain") ||
+		string(body) != "hello, static world" {
+		t.Errorf("Unexpected response %q", response)
+	}
+
+	response, err = client.Get("/static/large.bin")
+	if err != nil {
+		t.Fatalf("Large file request failed: %v", err)
+	}
+	if _, body := splitResponse(t, response); !bytes.Equal(body, large) {
+		t.Errorf("Large file body mismatch: got %d bytes, want %d", len(body), len(large))
+	}
+
+	ranged := []byte("GET /static/large.bin HTTP/1.1\r\nRange: bytes=100-199\r\n\r\n")
+	response, err = client.Do(ranged)
+	if err != nil {
+		t.Fatalf("Range request failed: %v", err)
+	}
+	headers, body = splitResponse(t, response)
+	if !containsString(headers, "HTTP/1.1 206 Partial Content") ||
+		!containsString(headers, "Content-Range: bytes 100-199/20000") || !bytes.Equal(body, large[100:200]) {
+		t.Errorf("Unexpected range response headers %q (%d body bytes)", headers, len(body))
+	}
+
+	response, err = client.Get("/static/docs/")
+	if err != nil {
+		t.Fatalf("Directory request failed: %v", err)
+	}
+	if _, body := splitResponse(t, response); string(body) != "<h1>docs</h1>" {
+		t.Errorf("Directory should serve its index, got %q", body)
+	}
+
+	for _, path := range []string{"/static/missing.txt", "/static/../static_test.go"} {
+		response, err := client.Get(path)
+		if err != nil {
+			t.Fatalf("Request for %s failed: %v", path, err)
+		}
+		if !containsString(string(response), "HTTP/1.1 404 Not Found") {
+			t.Errorf("Expected 404 for %s, got %q", path, response)
+		}
+	}
+}
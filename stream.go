@@ -0,0 +1,438 @@
+package ultrafast
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream send parameters
+const (
+	// streamSendBuffer is how many segments a server-side stream may have
+	// sent or queued for the window without their ACKs; Write blocks
+	// while it is full
+	streamSendBuffer = 64
+
+	// streamLinger bounds how long Close waits for the segments written
+	// to be acknowledged, when no write deadline is set
+	streamLinger = 5 * time.Second
+
+	// streamPollInterval is how often a client's stream wakes to run its
+	// retransmission timers when no packet arrives
+	streamPollInterval = 10 * time.Millisecond
+)
+
+// StreamConn presents one reliable connection as an ordered byte stream
+// and implements net.Conn, so standard libraries such as crypto/tls can
+// run on top of the custom protocol. DATA payloads carry the stream
+// bytes, read through the connection's OrderedReader. Segments are sent
+// through the connection's reliability layer, like responses: numbered
+// in its sequence space, held back by its congestion window and pacer,
+// and retransmitted on its RTO until acknowledged.
+type StreamConn struct {
+	local     SocketAddr
+	remote    func() SocketAddr
+	transport streamTransport
+	onClose   func()
+
+	writeMu sync.Mutex
+
+	in *OrderedReader
+
+	mu            sync.Mutex
+	closed        bool
+	wrote         bool  // a segment was handed to the transport
+	ended         bool  // the connection under the stream is gone
+	err           error // why the connection under the stream was aborted, if it was
+	writeDeadline time.Time
+
+	acked     chan struct{} // signalled when ACKs arrive, or the stream fails or ends
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+}
+
+// streamTransport carries a stream's segments over a connection's
+// reliability layer
+type streamTransport interface {
+	// transmit numbers a DATA segment, tracks it for retransmission and
+	// sends it, or queues it until the window has room
+	transmit(packet *Packet) error
+
+	// ready reports whether another segment may be handed to transmit
+	ready() bool
+
+	// unacked returns how many segments handed to transmit still await
+	// their ACK
+	unacked() int
+}
+
+// newStreamConn creates a stream that sends its segments over transport
+// and reads what arrives from in; onClose runs once when the stream is
+// closed
+func newStreamConn(local SocketAddr, remote func() SocketAddr, in *OrderedReader,
+	transport streamTransport, onClose func()) *StreamConn {
+	return &StreamConn{
+		local:     local,
+		remote:    remote,
+		transport: transport,
+		onClose:   onClose,
+		in:        in,
+		acked:     make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// Read reads stream bytes in order, blocking until data arrives
+func (sc *StreamConn) Read(b []byte) (int, error) {
+	return sc.in.Read(b)
+}
+
+// Reader returns the stream's receive side, for reads that must not block
+func (sc *StreamConn) Reader() *OrderedReader {
+	return sc.in
+}
+
+// Write sends b as DATA segments of at most MAX_PAYLOAD_SIZE bytes. It
+// returns once every segment is sent or queued for the window, blocking
+// while the send buffer is full; the reliability layer retransmits them
+// until acknowledged, and Close waits for that.
+func (sc *StreamConn) Write(b []byte) (int, error) {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		if err := sc.waitUntil(sc.transport.ready); err != nil {
+			return written, err
+		}
+		end := min(written+MAX_PAYLOAD_SIZE, len(b))
+
+		// Retransmissions keep referring to the payload
+		segment := NewPacket(DATA_PACKET, 0, 0, 0, bytes.Clone(b[written:end]))
+		if err := sc.transport.transmit(segment); err != nil {
+			return written, err
+		}
+		sc.mu.Lock()
+		sc.wrote = true
+		sc.mu.Unlock()
+		written = end
+	}
+	return written, nil
+}
+
+// drain waits until the peer has acknowledged every segment written, the
+// connection ends, or the write deadline, or failing that streamLinger,
+// passes
+func (sc *StreamConn) drain() error {
+	sc.mu.Lock()
+	wrote, deadline := sc.wrote, sc.writeDeadline
+	sc.mu.Unlock()
+	if !wrote {
+		return nil
+	}
+	if deadline.IsZero() {
+		deadline = time.Now().Add(streamLinger)
+	}
+	return sc.waitUntilDeadline(func() bool { return sc.transport.unacked() == 0 }, deadline)
+}
+
+// waitUntil blocks until cond holds, checking it whenever ACKs arrive,
+// or fails once the stream is closed, its connection fails or ends, or
+// the write deadline passes
+func (sc *StreamConn) waitUntil(cond func() bool) error {
+	sc.mu.Lock()
+	deadline := sc.writeDeadline
+	sc.mu.Unlock()
+	return sc.waitUntilDeadline(cond, deadline)
+}
+
+// waitUntilDeadline is waitUntil with its own deadline
+func (sc *StreamConn) waitUntilDeadline(cond func() bool, deadline time.Time) error {
+	for {
+		sc.mu.Lock()
+		closed, ended, failed := sc.closed, sc.ended, sc.err
+		sc.mu.Unlock()
+		switch {
+		case closed:
+			return errUseOfClosed
+		case failed != nil:
+			return failed
+		case cond():
+			return nil
+		case ended:
+			return errUseOfClosed
+		}
+		if err := sc.wait(sc.acked, deadline); err != nil {
+			return err
+		}
+	}
+}
+
+// wait blocks until ch is signalled, the stream closes, or the deadline passes
+func (sc *StreamConn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-sc.done:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// deliver hands an incoming DATA segment to the stream's reader, which
+// holds segments arriving ahead of a missing one and drops duplicates
+// from retransmission. It reports false for a segment dropped for
+// arriving too far ahead to be held.
+func (sc *StreamConn) deliver(seq uint32, payload []byte) bool {
+	return sc.in.push(seq, payload)
+}
+
+// ackArrived wakes a Write waiting for room in the window, or a Close
+// waiting for its segments to be acknowledged
+func (sc *StreamConn) ackArrived() {
+	notify(sc.acked)
+}
+
+// remoteClosed marks the end of the peer's data, and of the connection:
+// nothing still unacknowledged will be
+func (sc *StreamConn) remoteClosed() {
+	sc.mu.Lock()
+	sc.ended = true
+	sc.mu.Unlock()
+	sc.in.finish()
+	notify(sc.acked)
+}
+
+// fail ends the stream with the error that aborted its connection, which
+// blocked and later Reads and Writes return
+func (sc *StreamConn) fail(err error) {
+	sc.mu.Lock()
+	sc.err = err
+	sc.mu.Unlock()
+	sc.in.fail(err)
+	notify(sc.acked)
+}
+
+// Close closes the stream once the peer has acknowledged what was
+// written, waiting up to the write deadline, or streamLinger if none is
+// set; blocked Read and Write calls return an error matching
+// ErrConnClosed and net.ErrClosed
+func (sc *StreamConn) Close() error {
+	sc.closeOnce.Do(func() {
+		sc.drain()
+
+		sc.mu.Lock()
+		sc.closed = true
+		sc.mu.Unlock()
+		sc.in.close()
+		close(sc.done)
+
+		if sc.onClose != nil {
+			sc.onClose()
+		}
+	})
+	return nil
+}
+
+// LocalAddr returns the local address
+func (sc *StreamConn) LocalAddr() net.Addr {
+	return sc.local
+}
+
+// RemoteAddr returns the peer's current address
+func (sc *StreamConn) RemoteAddr() net.Addr {
+	return sc.remote()
+}
+
+// SetDeadline sets both the read and write deadlines
+func (sc *StreamConn) SetDeadline(t time.Time) error {
+	sc.SetReadDeadline(t)
+	return sc.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for pending and future Reads
+func (sc *StreamConn) SetReadDeadline(t time.Time) error {
+	return sc.in.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for future Writes
+func (sc *StreamConn) SetWriteDeadline(t time.Time) error {
+	sc.mu.Lock()
+	sc.writeDeadline = t
+	sc.mu.Unlock()
+	return nil
+}
+
+// notify signals a capacity-1 channel without blocking
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// newServerStream creates a stream over a server-side connection. The
+// stream follows the connection across migrations; closing it sends FIN
+// and returns the connection to plain request handling.
+func (h *HTTPSocketHandler) newServerStream(conn *Connection) *StreamConn {
+	table := h.server.connections
+	peer := func() SocketAddr { return table.PeerOf(conn) }
+
+	var stream *StreamConn
+	stream = newStreamConn(h.server.socket.GetLocalAddr(), peer, conn.Reliability().Reader(),
+		serverStreamTransport{h, conn},
+		func() {
+			conn.stream.CompareAndSwap(stream, nil)
+			if conn.Err() == nil { // an aborted peer already got a RST
+				h.sendPacket(NewPacket(FIN_PACKET, FIN_FLAG, 0, 0, nil), peer())
+			}
+		})
+	return stream
+}
+
+// serverStreamTransport sends a server-side stream's segments the way the
+// connection's responses go, so the server's reliability workers
+// retransmit them and ACKs release those held for the window
+type serverStreamTransport struct {
+	h    *HTTPSocketHandler
+	conn *Connection
+}
+
+func (t serverStreamTransport) transmit(packet *Packet) error {
+	_, err := t.h.sendDataPacket(packet, false, t.conn, t.h.server.connections.PeerOf(t.conn))
+	return err
+}
+
+func (t serverStreamTransport) ready() bool {
+	return t.unacked() < streamSendBuffer
+}
+
+func (t serverStreamTransport) unacked() int {
+	return t.conn.windowQueued() + t.conn.reliability.outstanding()
+}
+
+// Stream turns a connected client into a net.Conn. The client must not
+// be used directly afterwards; closing the stream closes the client.
+func (c *UltraFastClient) Stream() (*StreamConn, error) {
+	if !c.connected {
+		if err := c.Connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	server := c.server
+
+	// Segments continue the sequence numbers the handshake and any
+	// requests used, which the server acknowledges cumulatively
+	c.reliability.startAt(c.nextSeq)
+	stream := newStreamConn(c.socket.GetLocalAddr(), func() SocketAddr { return server },
+		c.reliability.Reader(), clientStreamTransport{c},
+		func() {
+			close(stop)
+			<-stopped
+			c.Close()
+		})
+	c.reliability.OnDeliveryFailure(func(*Packet) {
+		stream.fail(&ConnAbortedError{
+			Peer:        server,
+			ID:          c.connID,
+			Retransmits: c.reliability.GetStats().PacketsRetransmitted,
+		})
+	})
+
+	go c.pumpStream(stream, stop, stopped)
+	return stream, nil
+}
+
+// clientStreamTransport sends a client's stream segments through its
+// reliability layer, whose timers and ACKs pumpStream runs
+type clientStreamTransport struct {
+	c *UltraFastClient
+}
+
+func (t clientStreamTransport) transmit(packet *Packet) error {
+	packet.SeqNum = t.c.reliability.GetNextSeqNum()
+	t.c.reliability.SendPacket(packet)
+	return t.c.send(packet)
+}
+
+func (t clientStreamTransport) ready() bool {
+	return t.c.reliability.CanSend()
+}
+
+func (t clientStreamTransport) unacked() int {
+	return t.c.reliability.outstanding()
+}
+
+// pumpStream feeds packets from the server into a stream, and runs the
+// retransmission of its segments, until stopped
+func (c *UltraFastClient) pumpStream(stream *StreamConn, stop, stopped chan struct{}) {
+	defer close(stopped)
+
+	var timedOut []*Packet
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		timedOut = c.reliability.AppendTimedOutPackets(timedOut[:0])
+		for _, packet := range timedOut {
+			c.send(packet)
+		}
+
+		packet, err := c.receive(time.Now().Add(streamPollInterval), func(*Packet) bool { return true })
+		if err == errClientTimeout {
+			continue
+		}
+		if err != nil {
+			stream.remoteClosed()
+			continue
+		}
+
+		switch {
+		case packet.IsDataPacket():
+			stream.deliver(packet.SeqNum, packet.Payload)
+		case packet.IsAckPacket():
+			if lost := c.reliability.ProcessAck(packet).Retransmit; lost != nil {
+				c.send(lost)
+			}
+			stream.ackArrived()
+		case packet.IsFinPacket():
+			stream.remoteClosed()
+		}
+	}
+}
+
+// DialStream connects to an UltraFastHTTPServer and returns the
+// connection as a byte stream
+func DialStream(serverIP string, serverPort uint16) (*StreamConn, error) {
+	client, err := NewUltraFastClient(serverIP, serverPort)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := client.Stream()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return stream, nil
+}
@@ -0,0 +1,99 @@
+package ultrafast
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// StreamListener is a net.Listener over the server's connections: each
+// connection is accepted as a StreamConn, so libraries written against
+// net.Listener and net.Conn, such as grpc.Server or http.Server, run on
+// the reliable transport unchanged. Dial the other end with
+// DialStreamContext.
+type StreamListener struct {
+	server    *UltraFastHTTPServer
+	conns     chan *StreamConn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenStreams hands every new connection to the returned listener
+// instead of serving HTTP on it. It replaces any OnConnection handler.
+func (s *UltraFastHTTPServer) ListenStreams() *StreamListener {
+	l := &StreamListener{
+		server: s,
+		conns:  make(chan *StreamConn),
+		done:   make(chan struct{}),
+	}
+	s.OnConnection(l.handle)
+	return l
+}
+
+// handle passes a connection's stream to Accept and holds the connection
+// open until the stream is closed
+func (l *StreamListener) handle(conn *Connection) {
+	stream := conn.Stream()
+	select {
+	case l.conns <- stream:
+	case <-l.done:
+		return
+	}
+	<-stream.done
+}
+
+// Accept waits for the next connection
+func (l *StreamListener) Accept() (net.Conn, error) {
+	select {
+	case stream := <-l.conns:
+		return stream, nil
+	case <-l.done:
+		return nil, errUseOfClosed
+	}
+}
+
+// Close stops accepting and returns new connections to HTTP. Streams
+// already accepted stay open.
+func (l *StreamListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.server.OnConnection(nil)
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr returns the server's address
+func (l *StreamListener) Addr() net.Addr {
+	return l.server.socket.GetLocalAddr()
+}
+
+// DialStreamContext is DialStream for an "ip:port" address, giving up
+// when ctx ends. Its signature fits dialer hooks such as
+// grpc.WithContextDialer.
+func DialStreamContext(ctx context.Context, addr string) (net.Conn, error) {
+	server, err := ParseSocketAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	type dialed struct {
+		stream *StreamConn
+		err    error
+	}
+	result := make(chan dialed, 1)
+	go func() {
+		stream, err := DialStream(server.IP, server.Port)
+		result <- dialed{stream, err}
+	}()
+	select {
+	case r := <-result:
+		return r.stream, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-result; r.stream != nil {
+				r.stream.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,89 @@
+package ultrafast
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamListener(t *testing.T) {
+	server := startTestServer(t)
+	listener := server.ListenStreams()
+	defer listener.Close()
+	served := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer close(served)
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := DialStreamContext(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("DialStreamContext failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("through a listener")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	echo := make([]byte, len("through a listener"))
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "through a listener" {
+		t.Fatalf("Expected the echo, got %q, %v", echo, err)
+	}
+
+	// Closing the connection ends the server's copy and releases it
+	conn.Close()
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("The server's end did not see the close")
+	}
+	waitForConnections(t, server, 0)
+}
+
+func TestStreamListenerClose(t *testing.T) {
+	server := startTestServer(t)
+	listener := server.ListenStreams()
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := listener.Accept()
+		accepted <- err
+	}()
+	listener.Close()
+	select {
+	case err := <-accepted:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Expected net.ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Accept did not return after Close")
+	}
+
+	// New connections are HTTP again
+	if _, err := newTestClient(t, server).Get("/benchmark"); err != nil {
+		t.Errorf("Request after Close failed: %v", err)
+	}
+}
+
+func TestDialStreamContext(t *testing.T) {
+	if _, err := DialStreamContext(context.Background(), "localhost"); err == nil {
+		t.Error("Expected an error for an address without a port")
+	}
+
+	// Nothing answers, so the context ends first
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := DialStreamContext(ctx, "127.0.0.1:1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline to expire, got %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+package ultrafast
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// SYN cookie layout: the top 5 bits carry a coarse timestamp slot so the
+// server can tell which secret-window the cookie was minted in, and the
+// low 27 bits carry a truncated MAC of the peer and its initial sequence.
+const (
+	synCookieSlotBits   = 5
+	synCookieMACBits    = 32 - synCookieSlotBits
+	synCookieMACMask    = 1<<synCookieMACBits - 1
+	synCookieSlotMask   = 1<<synCookieSlotBits - 1
+	synCookieSlotPeriod = 64 * time.Second
+	synCookieMaxSlots   = 2 // a cookie is valid for the current and previous slot
+)
+
+// SynCookieJar mints and validates stateless SYN cookies so the server
+// only commits connection state once the handshake's final ACK proves the
+// peer can receive at its claimed address
+type SynCookieJar struct {
+	secret [32]byte
+	now    func() time.Time
+}
+
+// NewSynCookieJar creates a cookie jar with a random secret
+func NewSynCookieJar() (*SynCookieJar, error) {
+	jar := &SynCookieJar{now: clockNow}
+	if _, err := rand.Read(jar.secret[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate SYN cookie secret: %v", err)
+	}
+	return jar, nil
+}
+
+// Generate returns the cookie to use as the SYN-ACK sequence number
+func (j *SynCookieJar) Generate(peer SocketAddr, clientSeq uint32) uint32 {
+	slot := j.currentSlot()
+	return uint32(slot&synCookieSlotMask)<<synCookieMACBits | j.mac(peer, clientSeq, slot)
+}
+
+// Validate checks a cookie echoed back as AckNum-1 in the final ACK, where
+// clientSeq is the initial sequence number from the peer's SYN
+func (j *SynCookieJar) Validate(peer SocketAddr, clientSeq uint32, cookie uint32) bool {
+	cookieSlot := uint64(cookie >> synCookieMACBits)
+	current := j.currentSlot()
+
+	for age := uint64(0); age < synCookieMaxSlots && age <= current; age++ {
+		slot := current - age
+		if slot&synCookieSlotMask != cookieSlot {
+			continue
+		}
+		expected := j.mac(peer, clientSeq, slot)
+		return hmac.Equal(uint32Bytes(expected), uint32Bytes(cookie&synCookieMACMask))
+	}
+	return false
+}
+
+// ConnectionID derives the connection ID offered in the SYN-ACK. It is a
+// keyed hash of the handshake so the server can recompute it statelessly
+// when the final ACK arrives; it is never zero.
+func (j *SynCookieJar) ConnectionID(peer SocketAddr, clientSeq uint32) uint64 {
+	h := hmac.New(sha256.New, j.secret[:])
+
+	var buf [7]byte
+	buf[0] = 'C'
+	binary.BigEndian.PutUint16(buf[1:3], peer.Port)
+	binary.BigEndian.PutUint32(buf[3:7], clientSeq)
+	h.Write(buf[:])
+	h.Write([]byte(peer.IP))
+
+	id := binary.BigEndian.Uint64(h.Sum(nil)[:8])
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
+// currentSlot returns the timestamp slot cookies are minted in right now
+func (j *SynCookieJar) currentSlot() uint64 {
+	return uint64(j.now().Unix()) / uint64(synCookieSlotPeriod/time.Second)
+}
+
+// mac computes the truncated MAC binding a cookie to the peer and slot
+func (j *SynCookieJar) mac(peer SocketAddr, clientSeq uint32, slot uint64) uint32 {
+	h := hmac.New(sha256.New, j.secret[:])
+
+	var buf [14]byte
+	binary.BigEndian.PutUint16(buf[0:2], peer.Port)
+	binary.BigEndian.PutUint32(buf[2:6], clientSeq)
+	binary.BigEndian.PutUint64(buf[6:14], slot)
+	h.Write(buf[:])
+	h.Write([]byte(peer.IP))
+
+	sum := h.Sum(nil)
+	return binary.BigEndian.Uint32(sum[:4]) & synCookieMACMask
+}
+
+// randomUint64 returns a cryptographically random 64-bit value
+func randomUint64() uint64 {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed: %v", err))
+	}
+	return binary.BigEndian.Uint64(buf[:])
+}
+
+// uint32Bytes encodes a value for constant-time comparison
+func uint32Bytes(v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return buf[:]
+}
@@ -0,0 +1,44 @@
+package ultrafast
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSynCookies(t *testing.T) {
+	jar, err := NewSynCookieJar()
+	if err != nil {
+		t.Fatalf("Failed to create cookie jar: %v", err)
+	}
+	now := time.Unix(1700000000, 0)
+	jar.now = func() time.Time { return now }
+
+	peer := SocketAddr{IP: "192.168.1.10", Port: 5555}
+	cookie := jar.Generate(peer, 1000)
+
+	testCases := []struct {
+		name      string
+		peer      SocketAddr
+		clientSeq uint32
+		cookie    uint32
+		age       time.Duration
+		valid     bool
+	}{
+		{"Valid cookie", peer, 1000, cookie, 0, true},
+		{"Valid in previous slot", peer, 1000, cookie, synCookieSlotPeriod, true},
+		{"Expired cookie", peer, 1000, cookie, synCookieMaxSlots * synCookieSlotPeriod, false},
+		{"Wrong port", SocketAddr{IP: peer.IP, Port: 5556}, 1000, cookie, 0, false},
+		{"Wrong IP", SocketAddr{IP: "192.168.1.11", Port: peer.Port}, 1000, cookie, 0, false},
+		{"Wrong client sequence", peer, 1001, cookie, 0, false},
+		{"Tampered cookie", peer, 1000, cookie ^ 1, 0, false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			jar.now = func() time.Time { return now.Add(tc.age) }
+			if got := jar.Validate(tc.peer, tc.clientSeq, tc.cookie); got != tc.valid {
+				t.Errorf("Expected valid=%v, got %v", tc.valid, got)
+			}
+		})
+	}
+}
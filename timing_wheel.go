@@ -0,0 +1,221 @@
+package ultrafast
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Retransmission timers, after Varghese and Lauck's hierarchical timing
+// wheel: each level is a ring of slots one tick of the level below wide,
+// a timer sits in the lowest level whose ring reaches its deadline, and
+// timers cascade down a level whenever the level below wraps. A scan
+// then visits only the slots the clock passed since the last one and
+// the timers due in them, rather than every packet in flight.
+//
+// Timers are not cancelled when their packet is acknowledged. An ACK
+// would otherwise have to take the wheel's lock; instead a timer whose
+// packet left the unacked table is dropped when it fires, and one whose
+// packet was resent since fires early and is placed again.
+
+const (
+	wheelTick   = time.Millisecond
+	wheelBits   = 6
+	wheelSlots  = 1 << wheelBits
+	wheelLevels = 3 // 2^18 ticks, past maxRTO; later deadlines fire early and are placed again
+
+	// wheelMaxSteps is how far the clock may move between scans before
+	// the wheel is rebuilt around the new time rather than stepped
+	wheelMaxSteps = wheelSlots * wheelSlots
+)
+
+// wheelTimer is the timer armed for one unacked packet
+type wheelTimer struct {
+	deadline uint64         // in ticks
+	key      uint64         // the packet's sequence number
+	entry    unsafe.Pointer // *UnackedEntry, still current only while the table holds it with Timer pointing here
+	next     *wheelTimer
+}
+
+// wheelTimers recycles timers; unlike entries nothing reads them without
+// the wheel's lock, so they return to the slab directly
+var wheelTimers = NewSlab[wheelTimer](slabChunkSize)
+
+// timingWheel holds the retransmission timers of one reliability layer
+type timingWheel struct {
+	mu       sync.Mutex
+	incoming atomic.Pointer[wheelTimer] // armed by senders, placed by the next scan
+	tick     uint64                     // the last tick advanced to, 0 before the first scan
+	count    int                        // timers in the slots
+	slots    [wheelLevels][wheelSlots]*wheelTimer
+	armed    atomic.Uint64 // the longest timeout in nanoseconds a deadline was computed from
+}
+
+// wheelDeadline is the tick in which a packet sent at sent, in unix
+// nanoseconds, times out
+func wheelDeadline(sent, timeout uint64) uint64 {
+	return (sent + timeout) / uint64(wheelTick)
+}
+
+// schedule arms t without the lock; the next advance places it
+func (w *timingWheel) schedule(t *wheelTimer, timeout uint64) {
+	w.arm(timeout)
+	for {
+		head := w.incoming.Load()
+		t.next = head
+		if w.incoming.CompareAndSwap(head, t) {
+			return
+		}
+	}
+}
+
+// arm records that a deadline was computed from timeout
+func (w *timingWheel) arm(timeout uint64) {
+	for {
+		armed := w.armed.Load()
+		if timeout <= armed || w.armed.CompareAndSwap(armed, timeout) {
+			return
+		}
+	}
+}
+
+// rearm places t again at deadline, or the next tick if that has passed.
+// Requires mu.
+func (w *timingWheel) rearm(t *wheelTimer, deadline, timeout uint64) {
+	w.arm(timeout)
+	t.deadline = max(deadline, w.tick+1)
+	w.place(t, nil)
+}
+
+// place files t in its slot, or onto due if its deadline has come.
+// Requires mu.
+func (w *timingWheel) place(t *wheelTimer, due **wheelTimer) {
+	if t.deadline <= w.tick {
+		t.next = *due
+		*due = t
+		return
+	}
+	level := 0
+	for delta := t.deadline - w.tick; level < wheelLevels-1 && delta >= 1<<(wheelBits*(level+1)); level++ {
+	}
+	if limit := w.tick + 1<<(wheelBits*wheelLevels) - 1; t.deadline > limit {
+		t.deadline = limit
+	}
+	slot := &w.slots[level][t.deadline>>(wheelBits*level)&(wheelSlots-1)]
+	t.next = *slot
+	*slot = t
+	w.count++
+}
+
+// advance moves the wheel to now, in ticks, and calls fire with every
+// timer whose deadline has come. fire takes ownership of the timer: it
+// either rearms it or frees it. Requires mu.
+func (w *timingWheel) advance(now uint64, fire func(*wheelTimer)) {
+	var due *wheelTimer
+	incoming := w.incoming.Swap(nil)
+	if w.tick == 0 || now < w.tick || now-w.tick > wheelMaxSteps {
+		// First scan, or the clock jumped: place everything afresh
+		timers := w.take(nil)
+		w.tick = now
+		w.placeList(incoming, &due)
+		w.placeList(timers, &due)
+	} else {
+		w.placeList(incoming, &due)
+		for w.tick < now {
+			if w.count == 0 {
+				w.tick = now
+				break
+			}
+			w.step(&due)
+		}
+	}
+	for due != nil {
+		t := due
+		due = t.next
+		t.next = nil
+		fire(t)
+	}
+}
+
+// step advances one tick, cascading the levels that wrapped, and moves
+// the tick's timers onto due
+func (w *timingWheel) step(due **wheelTimer) {
+	w.tick++
+	for level := 1; level < wheelLevels; level++ {
+		if w.tick&(1<<(wheelBits*level)-1) != 0 {
+			break
+		}
+		slot := &w.slots[level][w.tick>>(wheelBits*level)&(wheelSlots-1)]
+		timers := *slot
+		*slot = nil
+		w.placeList(w.unlink(timers), due)
+	}
+	slot := &w.slots[0][w.tick&(wheelSlots-1)]
+	timers := w.unlink(*slot)
+	*slot = nil
+	for timers != nil {
+		t := timers
+		timers = t.next
+		t.next = *due
+		*due = t
+	}
+}
+
+// unlink stops counting the timers of a list taken out of a slot
+func (w *timingWheel) unlink(timers *wheelTimer) *wheelTimer {
+	for t := timers; t != nil; t = t.next {
+		w.count--
+	}
+	return timers
+}
+
+// placeList places every timer of a list
+func (w *timingWheel) placeList(timers *wheelTimer, due **wheelTimer) {
+	for timers != nil {
+		t := timers
+		timers = t.next
+		w.place(t, due)
+	}
+}
+
+// take empties the slots onto list and returns it. Requires mu.
+func (w *timingWheel) take(list *wheelTimer) *wheelTimer {
+	for level := range w.slots {
+		for i := range w.slots[level] {
+			for timers := w.slots[level][i]; timers != nil; {
+				t := timers
+				timers = t.next
+				t.next = list
+				list = t
+			}
+			w.slots[level][i] = nil
+		}
+	}
+	w.count = 0
+	return list
+}
+
+// expedite makes every timer due at the next advance, so each is checked
+// against a timeout shorter than the one its deadline was computed from.
+// Requires mu.
+func (w *timingWheel) expedite(timeout uint64) {
+	for t := w.take(w.incoming.Swap(nil)); t != nil; {
+		next := t.next
+		t.deadline = 0
+		w.schedule(t, 0)
+		t = next
+	}
+	w.armed.Store(timeout)
+}
+
+// clear frees every timer
+func (w *timingWheel) clear() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for t := w.take(w.incoming.Swap(nil)); t != nil; {
+		next := t.next
+		wheelTimers.Put(t)
+		t = next
+	}
+}
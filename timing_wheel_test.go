@@ -0,0 +1,161 @@
+package ultrafast
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// advanceWheel advances w to now and returns the timers that fired
+func advanceWheel(w *timingWheel, now uint64) []*wheelTimer {
+	var fired []*wheelTimer
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.advance(now, func(t *wheelTimer) { fired = append(fired, t) })
+	return fired
+}
+
+func TestTimingWheelFiresOnTime(t *testing.T) {
+	var w timingWheel
+	rng := rand.New(rand.NewSource(1))
+	start := uint64(1000003)
+	advanceWheel(&w, start)
+
+	// Deadlines across every level, reached in uneven strides
+	timers := make(map[*wheelTimer]bool)
+	for i := 0; i < 2000; i++ {
+		timer := &wheelTimer{deadline: start + 1 + uint64(rng.Int63n(1<<(wheelBits*wheelLevels)-1))}
+		timers[timer] = true
+		w.schedule(timer, 0)
+	}
+	for now := start; len(timers) > 0; {
+		previous := now
+		now += 1 + uint64(rng.Int63n(wheelSlots*3))
+		for _, timer := range advanceWheel(&w, now) {
+			if !timers[timer] {
+				t.Fatalf("Timer fired twice or was never armed: %+v", timer)
+			}
+			if timer.deadline <= previous || timer.deadline > now {
+				t.Fatalf("Timer for %d fired advancing from %d to %d", timer.deadline, previous, now)
+			}
+			delete(timers, timer)
+		}
+		if now > start+1<<(wheelBits*wheelLevels) {
+			t.Fatalf("%d timers never fired", len(timers))
+		}
+	}
+	if w.count != 0 {
+		t.Errorf("Expected an empty wheel, %d timers counted", w.count)
+	}
+}
+
+func TestTimingWheelClockJumps(t *testing.T) {
+	var w timingWheel
+	advanceWheel(&w, 5000)
+	early := &wheelTimer{deadline: 5010}
+	late := &wheelTimer{deadline: 5000 + 100000}
+	w.schedule(early, 0)
+	w.schedule(late, 0)
+	if fired := advanceWheel(&w, 5005); len(fired) != 0 {
+		t.Fatalf("Expected nothing due yet, got %d", len(fired))
+	}
+
+	// Backwards, the timers are kept and placed against the new time
+	if fired := advanceWheel(&w, 10); len(fired) != 0 {
+		t.Fatalf("Expected nothing due after the clock went back, got %d", len(fired))
+	}
+	// Far forward, everything passed fires at once rather than tick by tick
+	fired := advanceWheel(&w, 5010+wheelMaxSteps*2)
+	if len(fired) != 1 || fired[0] != early {
+		t.Fatalf("Expected only the early timer, got %v", fired)
+	}
+	// Past the wheel's span a timer fires early for its owner to place again
+	if fired := advanceWheel(&w, late.deadline+1); len(fired) != 1 || fired[0] != late {
+		t.Fatalf("Expected the late timer, got %v", fired)
+	}
+	if w.count != 0 {
+		t.Errorf("Expected an empty wheel, %d timers counted", w.count)
+	}
+}
+
+func TestLockFreeReliabilityTimerLifecycle(t *testing.T) {
+	rel := NewLockFreeReliabilityLayer()
+	before := wheelTimers.Stats().Live
+	for seq := uint32(1); seq <= 10; seq++ {
+		rel.SendPacket(NewPacket(DATA_PACKET, 0, seq, 0, nil))
+	}
+	if live := wheelTimers.Stats().Live; live != before+10 {
+		t.Fatalf("Expected a timer per packet, got %d more", live-before)
+	}
+
+	// Acknowledged packets keep their timers until they fire
+	for seq := uint32(1); seq <= 5; seq++ {
+		rel.HandleAck(NewPacket(ACK_PACKET, ACK_FLAG, 0, seq+1, nil))
+	}
+	if timedOut := rel.GetTimedOutPackets(); len(timedOut) != 0 {
+		t.Fatalf("Expected nothing due within the RTO, got %d", len(timedOut))
+	}
+
+	// A shorter RTO rechecks every packet; acknowledged ones are dropped
+	atomic.StoreUint64(&rel.timeoutBase, 0)
+	timedOut := rel.GetTimedOutPackets()
+	if len(timedOut) != 5 {
+		t.Fatalf("Expected the 5 unacknowledged packets, got %d", len(timedOut))
+	}
+	if live := wheelTimers.Stats().Live; live != before+5 {
+		t.Errorf("Expected the acknowledged packets' timers freed, got %d more", live-before)
+	}
+	if timedOut := rel.GetTimedOutPackets(); len(timedOut) != 0 {
+		t.Errorf("Expected retransmitted packets rearmed with the backed off RTO, got %d", len(timedOut))
+	}
+
+	rel.Release()
+	if live := wheelTimers.Stats().Live; live != before {
+		t.Errorf("Expected every timer freed on release, got %d more", live-before)
+	}
+}
+
+// fullTimedOutScan is the scan the timing wheel replaced: every packet in
+// flight is checked against the RTO
+func fullTimedOutScan(rel *LockFreeReliabilityLayer) (timedOut int) {
+	now := uint64(clockNow().UnixNano())
+	timeout := atomic.LoadUint64(&rel.timeoutBase)
+	guard := rel.entries.Pin()
+	defer guard.Unpin()
+	rel.unackedTable.ForEach(func(key uint64, valuePtr unsafe.Pointer) bool {
+		if now-atomic.LoadUint64(&(*UnackedEntry)(valuePtr).SendTime) > timeout {
+			timedOut++
+		}
+		return true
+	})
+	return timedOut
+}
+
+// A retransmission scan with many packets in flight and none due, as on
+// every 1ms tick of a healthy connection
+func BenchmarkTimedOutScan(b *testing.B) {
+	for _, inFlight := range []int{100, 1000, 10000} {
+		rel := NewLockFreeReliabilityLayer()
+		atomic.StoreUint64(&rel.timeoutBase, uint64(time.Hour))
+		for i := 0; i < inFlight; i++ {
+			rel.SendPacket(NewPacket(DATA_PACKET, 0, rel.GetNextSeqNum(), 0, nil))
+		}
+
+		b.Run(fmt.Sprintf("wheel/%d", inFlight), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				rel.ForEachTimedOutPacket(func(*Packet) { b.Fatal("Packet timed out") })
+			}
+		})
+		b.Run(fmt.Sprintf("scan/%d", inFlight), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if fullTimedOutScan(rel) != 0 {
+					b.Fatal("Packet timed out")
+				}
+			}
+		})
+		rel.Release()
+	}
+}
@@ -0,0 +1,222 @@
+package ultrafast
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long a peer may take to finish TLS setup
+const tlsHandshakeTimeout = 10 * time.Second
+
+// maxStreamHeaderSize is the room reserved for response headers ahead of
+// a file body sent over a stream
+const maxStreamHeaderSize = 64 * 1024
+
+// SetTLSConfig enables standard TLS over the reliable stream layer, as an
+// alternative to custom packet-level encryption. A connection whose first
+// DATA packet opens a TLS handshake is served through crypto/tls; plain
+// requests on other connections are unaffected. Pass nil to disable.
+func (s *UltraFastHTTPServer) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig.Store(config)
+}
+
+// LoadTLSCertificate enables TLS with a PEM certificate chain and key
+func (s *UltraFastHTTPServer) LoadTLSCertificate(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	s.SetTLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	})
+	return nil
+}
+
+// DialTLS connects to an UltraFastHTTPServer and runs a TLS handshake over
+// the reliable stream. config must set ServerName or RootCAs as usual.
+func DialTLS(serverIP string, serverPort uint16, config *tls.Config) (*tls.Conn, error) {
+	stream, err := DialStream(serverIP, serverPort)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(stream, config)
+	stream.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	stream.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// isTLSHandshake reports whether payload opens with a TLS handshake record
+func isTLSHandshake(payload []byte) bool {
+	return len(payload) >= 3 && payload[0] == 0x16 && payload[1] == 0x03
+}
+
+// startTLSStream switches a connection to stream mode and serves TLS on it
+func (h *HTTPSocketHandler) startTLSStream(conn *Connection, first *Packet, config *tls.Config) {
+	stream := h.newServerStream(conn)
+	if !conn.stream.CompareAndSwap(nil, stream) {
+		return
+	}
+
+	// The handshake's first packet was acknowledged before the stream
+	// existed, so its reader starts there
+	stream.in.startAt(first.SeqNum)
+	stream.deliver(first.SeqNum, first.Payload)
+	go h.serveTLSStream(conn, stream, config)
+}
+
+// serveTLSStream answers HTTP requests over TLS until the peer closes
+func (h *HTTPSocketHandler) serveTLSStream(conn *Connection, stream *StreamConn, config *tls.Config) {
+	tlsConn := tls.Server(stream, config)
+	defer tlsConn.Close()
+
+	stream.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		logDebugf("TLS handshake with %v failed: %v", stream.RemoteAddr(), err)
+		return
+	}
+	stream.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(tlsConn)
+	for {
+		// An idle stream is closed after the keep-alive idle timeout; the
+		// receive timeout starts with a request's first byte, so a request
+		// trickled in slowly is cut off too
+		stream.SetReadDeadline(time.Now().Add(h.server.KeepAlive().IdleTimeout))
+		if _, err := reader.Peek(1); err != nil {
+			if err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) {
+				logDebugf("TLS stream from %v: %v", stream.RemoteAddr(), err)
+			}
+			return
+		}
+		limits := h.server.RequestLimits()
+		stream.SetReadDeadline(time.Now().Add(limits.ReceiveTimeout))
+		data, err := readStreamRequest(reader, limits)
+		stream.SetReadDeadline(time.Time{})
+		if err != nil {
+			logDebugf("TLS stream from %v: %v", stream.RemoteAddr(), err)
+			status := 0
+			if err == errRequestTooLarge {
+				status = 413
+			} else if errors.Is(err, os.ErrDeadlineExceeded) {
+				status = 408
+			}
+			if status != 0 {
+				atomic.AddUint64(&h.server.stats.RequestsRejected, 1)
+				h.writeStreamResponse(tlsConn, fileErrorResponse(status), false)
+			}
+			return
+		}
+		peer := stream.remote()
+
+		var request *HTTPRequest
+		var response *HTTPResponse
+		keepAlive := false
+		cancel := context.CancelFunc(func() {})
+		if request, err = h.parseHTTPRequest(data); err != nil {
+			response = &HTTPResponse{
+				StatusCode: 400,
+				Headers:    map[string]string{"Content-Type": "text/plain"},
+				Body:       []byte("Bad Request"),
+			}
+		} else {
+			var ctx context.Context
+			request.Peer = peer
+			request.received = clockNow()
+			ctx, cancel = h.newRequestContext(conn, RequestInfo{Peer: peer, Received: request.received})
+			request.sink = &writerSink{ctx: ctx, w: tlsConn}
+			request.keepAlive = conn.countRequest(request, h.server.KeepAlive())
+			keepAlive = request.keepAlive
+			response = h.handleHTTPRequest(ctx, request)
+		}
+
+		status := response.StatusCode
+		sent, err := h.writeStreamResponse(tlsConn, response, keepAlive)
+		if request != nil {
+			h.server.logAccess(request, status, sent)
+		}
+		releaseResponse(response)
+		cancel()
+		if err != nil {
+			atomic.AddUint64(&h.server.stats.Errors, 1)
+			return
+		}
+		atomic.AddUint64(&h.server.stats.ResponsesSent, 1)
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// writeStreamResponse writes a response to a byte stream, finishing it if
+// the handler already streamed part of it, and returns the bytes written
+func (h *HTTPSocketHandler) writeStreamResponse(w io.Writer, response *HTTPResponse, keepAlive bool) (int64, error) {
+	if writer := response.writer; writer != nil && writer.streaming {
+		err := writer.finishStream()
+		return writer.sent, err
+	}
+
+	n, err := w.Write(h.serializeHTTPResponse(response, keepAlive))
+	sent := int64(n)
+	if err != nil || response.file.size() == 0 {
+		return sent, err
+	}
+	copied, err := response.file.WriteTo(w)
+	return sent + copied, err
+}
+
+// readStreamRequest reads one HTTP request, headers plus a Content-Length
+// body, from a byte stream. A request over the limits fails with
+// errRequestTooLarge before its body is read.
+func readStreamRequest(reader *bufio.Reader, limits RequestLimits) ([]byte, error) {
+	var request []byte
+	contentLength := 0
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && len(request) > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		request = append(request, line...)
+		if len(request) > limits.MaxHeaderBytes {
+			return nil, errRequestTooLarge
+		}
+
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+		if colon := strings.IndexByte(line, ':'); colon > 0 &&
+			strings.EqualFold(strings.TrimSpace(line[:colon]), "Content-Length") {
+			contentLength, err = strconv.Atoi(strings.TrimSpace(line[colon+1:]))
+			if err != nil || contentLength < 0 {
+				return nil, fmt.Errorf("invalid Content-Length")
+			}
+		}
+	}
+	if contentLength > limits.MaxBodyBytes {
+		return nil, errRequestTooLarge
+	}
+
+	body := make([]byte, contentLength)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	return append(request, body...), nil
+}
@@ -0,0 +1,192 @@
+package ultrafast
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCertificate creates a self-signed certificate for "localhost"
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, pool
+}
+
+// fakeTransport numbers a stream's segments from 1 and keeps them, with
+// room for window unacknowledged at a time
+type fakeTransport struct {
+	mu     sync.Mutex
+	sent   []*Packet
+	acked  int
+	window int
+}
+
+func (f *fakeTransport) transmit(packet *Packet) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	packet.SeqNum = uint32(len(f.sent) + 1)
+	f.sent = append(f.sent, packet)
+	return nil
+}
+
+func (f *fakeTransport) ready() bool {
+	return f.unacked() < f.window
+}
+
+func (f *fakeTransport) unacked() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.sent) - f.acked
+}
+
+// ack acknowledges every segment sent so far
+func (f *fakeTransport) ack() {
+	f.mu.Lock()
+	f.acked = len(f.sent)
+	f.mu.Unlock()
+}
+
+func TestStreamDelivery(t *testing.T) {
+	stream := newStreamConn(SocketAddr{}, func() SocketAddr { return SocketAddr{} }, newOrderedReader(),
+		&fakeTransport{window: 1}, nil)
+
+	stream.deliver(10, []byte("hello "))
+	stream.deliver(10, []byte("hello ")) // retransmitted duplicate
+	stream.deliver(12, []byte("!"))      // held until the gap fills
+	stream.deliver(11, []byte("world"))
+	stream.remoteClosed()
+
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(data) != "hello world!" {
+		t.Errorf("Expected %q, got %q", "hello world!", data)
+	}
+
+	stream.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := stream.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF after the peer closed, got %v", err)
+	}
+}
+
+func TestStreamWriteWindow(t *testing.T) {
+	transport := &fakeTransport{window: 2}
+	stream := newStreamConn(SocketAddr{}, func() SocketAddr { return SocketAddr{} }, newOrderedReader(),
+		transport, nil)
+
+	// Segments go out together as far as the window allows, each
+	// carrying its own bytes
+	data := bytes.Repeat([]byte("x"), 3*MAX_PAYLOAD_SIZE)
+	stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := stream.Write(data)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != 2*MAX_PAYLOAD_SIZE {
+		t.Fatalf("Expected 2 segments written before the deadline, got %d bytes, %v", n, err)
+	}
+	if len(transport.sent) != 2 || transport.sent[1].SeqNum != 2 || len(transport.sent[1].Payload) != MAX_PAYLOAD_SIZE {
+		t.Fatalf("Expected 2 full segments sent, got %d", len(transport.sent))
+	}
+	data[0] = 'y'
+	if transport.sent[0].Payload[0] != 'x' {
+		t.Error("A segment should keep its bytes for retransmission")
+	}
+
+	// ACKs open the window
+	stream.SetWriteDeadline(time.Now().Add(time.Second))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		transport.ack()
+		stream.ackArrived()
+	}()
+	if _, err := stream.Write(data[n:]); err != nil {
+		t.Fatalf("Write failed once ACKs arrived: %v", err)
+	}
+
+	// Close waits for the last segment's ACK, up to the write deadline
+	stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	stream.Close()
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Expected Close to wait for the unacknowledged segment, returned after %v", elapsed)
+	}
+	if _, err := stream.Write([]byte("late")); !errors.Is(err, ErrConnClosed) {
+		t.Errorf("Expected Write after Close to fail, got %v", err)
+	}
+}
+
+func TestTLSOverStream(t *testing.T) {
+	server := startTestServer(t)
+	cert, pool := newTestCertificate(t)
+	server.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+
+	addr := server.socket.GetLocalAddr()
+	conn, err := DialTLS(addr.IP, addr.Port, &tls.Config{ServerName: "localhost", RootCAs: pool})
+	if err != nil {
+		t.Fatalf("DialTLS failed: %v", err)
+	}
+	defer conn.Close()
+
+	if conn.ConnectionState().Version != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.3, got %x", conn.ConnectionState().Version)
+	}
+
+	// Two requests over the same encrypted stream
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write(buildGetRequest("/benchmark", addr)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		status, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if status != "HTTP/1.1 200 OK\r\n" {
+			t.Errorf("Expected 200 status line, got %q", status)
+		}
+		response, err := readStreamRequest(reader, server.RequestLimits())
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if !containsString(string(response), "Benchmark response") {
+			t.Errorf("Unexpected response body: %q", response)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package ultrafast
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// decodeTOML decodes a TOML document into v through v's JSON field tags,
+// refusing keys v has no field for
+func decodeTOML(data []byte, v any) error {
+	document, err := parseTOML(data)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// parseTOML parses the subset of TOML config files need: tables, arrays
+// of tables, and keys holding strings, integers, floats, booleans, arrays
+// and inline tables. Dates, multi-line strings and dotted keys outside
+// table headers are refused.
+func parseTOML(data []byte) (map[string]any, error) {
+	p := &tomlParser{data: data, line: 1}
+	root := make(map[string]any)
+	table := root
+	for {
+		p.skipSpace(true)
+		if p.pos >= len(p.data) {
+			return root, nil
+		}
+		var err error
+		if p.data[p.pos] == '[' {
+			table, err = p.parseHeader(root)
+		} else {
+			err = p.parseKeyValue(table)
+		}
+		if err == nil {
+			err = p.endOfLine()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", p.line, err)
+		}
+	}
+}
+
+// tomlParser is a position in a TOML document
+type tomlParser struct {
+	data []byte
+	pos  int
+	line int
+}
+
+// skipSpace skips blanks and comments, and newlines too if newlines is set
+func (p *tomlParser) skipSpace(newlines bool) {
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		case c == '#':
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine requires nothing but a comment before the next line
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace(false)
+	if p.pos < len(p.data) && p.data[p.pos] != '\n' {
+		return fmt.Errorf("unexpected %q", p.data[p.pos])
+	}
+	return nil
+}
+
+// expect consumes c
+func (p *tomlParser) expect(c byte) error {
+	if p.pos >= len(p.data) || p.data[p.pos] != c {
+		return fmt.Errorf("expected %q", c)
+	}
+	p.pos++
+	return nil
+}
+
+// parseHeader parses a [table] or [[array of tables]] header, returning
+// the table that keys below it go into
+func (p *tomlParser) parseHeader(root map[string]any) (map[string]any, error) {
+	p.pos++
+	array := p.pos < len(p.data) && p.data[p.pos] == '['
+	if array {
+		p.pos++
+	}
+	path, err := p.parseKeyPath()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(']'); err != nil {
+		return nil, err
+	}
+	if array {
+		if err := p.expect(']'); err != nil {
+			return nil, err
+		}
+	}
+
+	table := root
+	for i, key := range path {
+		last := i == len(path)-1
+		switch existing := table[key].(type) {
+		case nil:
+			next := make(map[string]any)
+			if last && array {
+				table[key] = []any{next}
+			} else {
+				table[key] = next
+			}
+			table = next
+		case map[string]any:
+			if last && array {
+				return nil, fmt.Errorf("%s is a table, not an array of tables", key)
+			}
+			table = existing
+		case []any:
+			tables, ok := existing[len(existing)-1].(map[string]any)
+			if !ok || (last && !array) {
+				return nil, fmt.Errorf("%s is already defined", key)
+			}
+			if last {
+				tables = make(map[string]any)
+				table[key] = append(existing, tables)
+			}
+			table = tables
+		default:
+			return nil, fmt.Errorf("%s is already defined", key)
+		}
+	}
+	return table, nil
+}
+
+// parseKeyPath parses keys separated by dots
+func (p *tomlParser) parseKeyPath() ([]string, error) {
+	var path []string
+	for {
+		p.skipSpace(false)
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, key)
+		p.skipSpace(false)
+		if p.pos >= len(p.data) || p.data[p.pos] != '.' {
+			return path, nil
+		}
+		p.pos++
+	}
+}
+
+// parseKey parses a bare or quoted key
+func (p *tomlParser) parseKey() (string, error) {
+	if p.pos < len(p.data) && (p.data[p.pos] == '"' || p.data[p.pos] == '\'') {
+		return p.parseString()
+	}
+	start := p.pos
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return "", fmt.Errorf("expected a key")
+	}
+	return string(p.data[start:p.pos]), nil
+}
+
+// parseKeyValue parses key = value into table
+func (p *tomlParser) parseKeyValue(table map[string]any) error {
+	key, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	p.skipSpace(false)
+	if err := p.expect('='); err != nil {
+		return err
+	}
+	p.skipSpace(false)
+	value, err := p.parseValue()
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	if _, ok := table[key]; ok {
+		return fmt.Errorf("%s is already defined", key)
+	}
+	table[key] = value
+	return nil
+}
+
+// parseValue parses a string, number, boolean, array or inline table
+func (p *tomlParser) parseValue() (any, error) {
+	if p.pos >= len(p.data) {
+		return nil, fmt.Errorf("expected a value")
+	}
+	switch p.data[p.pos] {
+	case '"', '\'':
+		return p.parseString()
+	case '[':
+		return p.parseArray()
+	case '{':
+		return p.parseInlineTable()
+	}
+
+	start := p.pos
+	for p.pos < len(p.data) && !strings.ContainsRune(" \t\r\n#,]}", rune(p.data[p.pos])) {
+		p.pos++
+	}
+	word := string(p.data[start:p.pos])
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	number := strings.ReplaceAll(word, "_", "")
+	if n, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil && !strings.HasPrefix(number, "0x") {
+		return f, nil
+	}
+	return nil, fmt.Errorf("invalid value %q", word)
+}
+
+// parseString parses a basic "string" with escapes or a literal 'string'
+func (p *tomlParser) parseString() (string, error) {
+	quote := p.data[p.pos]
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\n':
+			return "", fmt.Errorf("unterminated string")
+		case c == '\\' && quote == '"':
+			if err := p.parseEscape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+// parseEscape parses the escape sequence after a backslash
+func (p *tomlParser) parseEscape(b *strings.Builder) error {
+	if p.pos >= len(p.data) {
+		return fmt.Errorf("unterminated string")
+	}
+	c := p.data[p.pos]
+	p.pos++
+	switch c {
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case 'u', 'U':
+		digits := 4
+		if c == 'U' {
+			digits = 8
+		}
+		if p.pos+digits > len(p.data) {
+			return fmt.Errorf("invalid escape \\%c", c)
+		}
+		r, err := strconv.ParseUint(string(p.data[p.pos:p.pos+digits]), 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return fmt.Errorf("invalid escape \\%c%s", c, p.data[p.pos:p.pos+digits])
+		}
+		p.pos += digits
+		b.WriteRune(rune(r))
+	default:
+		return fmt.Errorf("invalid escape \\%c", c)
+	}
+	return nil
+}
+
+// parseArray parses an array, which may span lines and end with a comma
+func (p *tomlParser) parseArray() ([]any, error) {
+	p.pos++
+	values := []any{}
+	for {
+		p.skipSpace(true)
+		if p.pos < len(p.data) && p.data[p.pos] == ']' {
+			p.pos++
+			return values, nil
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		p.skipSpace(true)
+		if p.pos < len(p.data) && p.data[p.pos] == ',' {
+			p.pos++
+		} else if err := p.expect(']'); err != nil {
+			return nil, err
+		} else {
+			return values, nil
+		}
+	}
+}
+
+// parseInlineTable parses a { key = value, ... } table on one line
+func (p *tomlParser) parseInlineTable() (map[string]any, error) {
+	p.pos++
+	table := make(map[string]any)
+	p.skipSpace(false)
+	if p.pos < len(p.data) && p.data[p.pos] == '}' {
+		p.pos++
+		return table, nil
+	}
+	for {
+		p.skipSpace(false)
+		if err := p.parseKeyValue(table); err != nil {
+			return nil, err
+		}
+		p.skipSpace(false)
+		if p.pos < len(p.data) && p.data[p.pos] == ',' {
+			p.pos++
+		} else if err := p.expect('}'); err != nil {
+			return nil, err
+		} else {
+			return table, nil
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package ultrafast
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	document, err := parseTOML([]byte(`
+# comment
+name = "a \"quoted\" \u00e9"   # trailing comment
+path = 'C:\raw'
+count = 1_000
+ratio = 0.5
+on = true
+list = [
+  "x", 'y', # inside
+]
+inline = { a = 1, b = "two" }
+
+[server.socket]
+dscp = 46
+
+[[routes]]
+path = "/a"
+
+[[routes]]
+path = "/b"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]any{
+		"name":   "a \"quoted\" é",
+		"path":   `C:\raw`,
+		"count":  int64(1000),
+		"ratio":  0.5,
+		"on":     true,
+		"list":   []any{"x", "y"},
+		"inline": map[string]any{"a": int64(1), "b": "two"},
+		"server": map[string]any{"socket": map[string]any{"dscp": int64(46)}},
+		"routes": []any{map[string]any{"path": "/a"}, map[string]any{"path": "/b"}},
+	}
+	if !reflect.DeepEqual(document, expected) {
+		t.Errorf("Unexpected document %#v", document)
+	}
+
+	for _, invalid := range []string{
+		`key = `,
+		`key = "unterminated`,
+		`key = 1979-05-27`,
+		`key = 1 2`,
+		"key = 1\nkey = 2",
+		"[t]\n[[t]]",
+		`[table`,
+		`= 1`,
+		`key = "\q"`,
+	} {
+		if _, err := parseTOML([]byte(invalid)); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package ultrafast
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall"
+)
+
+// ecnMask covers the two ECN bits at the bottom of the TOS byte, which
+// DSCP marking leaves alone (RFC 3168)
+const ecnMask = 0x03
+
+// SetTOS sets the IPv4 Type of Service byte on every datagram the socket
+// sends: the DSCP in the top six bits and ECN in the bottom two
+func (s *LinuxUDPSocket) SetTOS(tos int) error {
+	if tos < 0 || tos > 255 {
+		return fmt.Errorf("invalid TOS: %d", tos)
+	}
+	if err := syscall.SetsockoptInt(s.sock(), syscall.IPPROTO_IP, syscall.IP_TOS, tos); err != nil {
+		return fmt.Errorf("IP_TOS: %v", err)
+	}
+	atomic.StoreInt32(&s.tos, int32(tos))
+	return nil
+}
+
+// TOS returns the TOS byte last set with SetTOS or SetDSCP, 0 if none
+func (s *LinuxUDPSocket) TOS() int {
+	return int(atomic.LoadInt32(&s.tos))
+}
+
+// SetDSCP marks every datagram the socket sends with a Differentiated
+// Services code point (RFC 2474), 0 to 63, such as 46 for Expedited
+// Forwarding. The ECN bits are kept.
+func (s *LinuxUDPSocket) SetDSCP(dscp int) error {
+	if dscp < 0 || dscp > 63 {
+		return fmt.Errorf("invalid DSCP: %d", dscp)
+	}
+	return s.SetTOS(dscp<<2 | s.TOS()&ecnMask)
+}
+
+// DSCP returns the code point the socket marks datagrams with
+func (s *LinuxUDPSocket) DSCP() int {
+	return s.TOS() >> 2
+}
+
+// SetDSCP marks the connection's packets with dscp in place of the
+// socket's marking, or restores the socket's if dscp is -1. Per-packet
+// marking needs Linux; elsewhere the socket's marking applies.
+func (c *Connection) SetDSCP(dscp int) error {
+	if dscp < -1 || dscp > 63 {
+		return fmt.Errorf("invalid DSCP: %d", dscp)
+	}
+	atomic.StoreInt32(&c.dscp, int32(dscp+1))
+	return nil
+}
+
+// DSCP returns the code point marking the connection's packets, or -1
+// if the socket's applies
+func (c *Connection) DSCP() int {
+	return int(atomic.LoadInt32(&c.dscp)) - 1
+}
+
+// packetTOS returns the TOS byte for a packet to conn sent on socket, or
+// -1 to leave the socket's. conn may be nil.
+func (c *Connection) packetTOS(socket *LinuxUDPSocket) int {
+	if c == nil {
+		return -1
+	}
+	dscp := c.DSCP()
+	if dscp < 0 {
+		return -1
+	}
+	return dscp<<2 | socket.TOS()&ecnMask
+}
+
+// SetDSCP marks the connection the request arrived on, as Connection.SetDSCP
+func (r *HTTPRequest) SetDSCP(dscp int) error {
+	if r.handler == nil {
+		return fmt.Errorf("request was not received over a connection")
+	}
+	conn := r.handler.server.connections.Get(r.Peer)
+	if conn == nil {
+		return fmt.Errorf("no connection for %v", r.Peer)
+	}
+	return conn.SetDSCP(dscp)
+}
+
+// SetDSCP marks every packet the server sends with dscp, unless its
+// connection sets its own, so the network can give them the matching
+// quality of service
+func (s *UltraFastHTTPServer) SetDSCP(dscp int) error {
+	return s.socket.SetDSCP(dscp)
+}
+
+// DSCP returns the code point the server marks packets with
+func (s *UltraFastHTTPServer) DSCP() int {
+	return s.socket.DSCP()
+}
@@ -0,0 +1,58 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetRecvTOS asks the kernel to report the TOS byte of each datagram
+// received, for RecvFromTOS
+func (s *LinuxUDPSocket) SetRecvTOS(enabled bool) error {
+	value := 0
+	if enabled {
+		value = 1
+	}
+	if err := unix.SetsockoptInt(s.sock(), unix.IPPROTO_IP, unix.IP_RECVTOS, value); err != nil {
+		return fmt.Errorf("IP_RECVTOS: %v", err)
+	}
+	return nil
+}
+
+// RecvFromTOS is RecvFrom that also returns the datagram's TOS byte, or
+// -1 if the kernel did not report one because SetRecvTOS is off
+func (s *LinuxUDPSocket) RecvFromTOS(buffer []byte) (int, SocketAddr, int, error) {
+	if err := s.applyDeadline(soRcvTimeo, &s.readDeadline, &s.recvTimeout); err != nil {
+		return 0, SocketAddr{}, -1, err
+	}
+	var oob [64]byte
+	n, oobn, _, from, err := unix.Recvmsg(s.sock(), buffer, oob[:], 0)
+	if err != nil {
+		if s.deadlinePassed(&s.readDeadline, err) {
+			return 0, SocketAddr{}, -1, os.ErrDeadlineExceeded
+		}
+		return 0, SocketAddr{}, -1, &SocketError{Op: "recvmsg", Err: err}
+	}
+
+	var fromAddr SocketAddr
+	if fromInet4, ok := from.(*unix.SockaddrInet4); ok {
+		fromAddr = SocketAddr{
+			IP: fmt.Sprintf("%d.%d.%d.%d",
+				fromInet4.Addr[0], fromInet4.Addr[1],
+				fromInet4.Addr[2], fromInet4.Addr[3]),
+			Port: uint16(fromInet4.Port),
+		}
+	}
+
+	tos := -1
+	messages, _ := unix.ParseSocketControlMessage(oob[:oobn])
+	for _, m := range messages {
+		if m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TOS && len(m.Data) > 0 {
+			tos = int(m.Data[0])
+		}
+	}
+	return n, fromAddr, tos, nil
+}
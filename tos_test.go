@@ -0,0 +1,113 @@
+package ultrafast
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recvTOS reads one datagram and returns its TOS byte
+func recvTOS(t *testing.T, socket *LinuxUDPSocket) int {
+	t.Helper()
+	buffer := make([]byte, 65536)
+	socket.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, tos, err := socket.RecvFromTOS(buffer)
+	if err != nil {
+		t.Fatalf("RecvFromTOS failed: %v", err)
+	}
+	return tos
+}
+
+func TestSocketDSCP(t *testing.T) {
+	sender := newBoundSocket(t)
+	receiver := newBoundSocket(t)
+	if err := receiver.SetRecvTOS(true); err != nil {
+		t.Fatalf("SetRecvTOS failed: %v", err)
+	}
+	to := receiver.GetLocalAddr()
+
+	if err := sender.SetTOS(0x01); err != nil {
+		t.Fatalf("SetTOS failed: %v", err)
+	}
+	if err := sender.SetDSCP(46); err != nil {
+		t.Fatalf("SetDSCP failed: %v", err)
+	}
+	if sender.TOS() != 46<<2|0x01 || sender.DSCP() != 46 {
+		t.Fatalf("Expected EF with the ECN bit kept, got TOS %#x", sender.TOS())
+	}
+	if err := sender.SetDSCP(64); err == nil {
+		t.Error("A DSCP over 63 should be refused")
+	}
+
+	sender.SetTOS(46 << 2)
+	if _, err := sender.SendTo([]byte("marked"), to.IP, to.Port); err != nil {
+		t.Fatalf("SendTo failed: %v", err)
+	}
+	if tos := recvTOS(t, receiver); tos != 46<<2 {
+		t.Errorf("Expected TOS %#x on the wire, got %#x", 46<<2, tos)
+	}
+
+	// A per-packet TOS overrides the socket's for that datagram only
+	packet := NewPacket(DATA_PACKET, 0, 1, 0, []byte("override"))
+	if _, err := sender.SendPacketTOS(packet, to.IP, to.Port, 10<<2); err != nil {
+		t.Fatalf("SendPacketTOS failed: %v", err)
+	}
+	if tos := recvTOS(t, receiver); tos != 10<<2 {
+		t.Errorf("Expected TOS %#x on the wire, got %#x", 10<<2, tos)
+	}
+	sender.SendPacket(packet, to.IP, to.Port)
+	if tos := recvTOS(t, receiver); tos != 46<<2 {
+		t.Errorf("Expected the socket's TOS back, got %#x", tos)
+	}
+}
+
+func TestConnectionDSCPOverride(t *testing.T) {
+	server := startTestServer(t)
+	server.DisableWorkerPool()
+	server.HandleFunc("/voice", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		if err := request.SetDSCP(46); err != nil {
+			return &HTTPResponse{StatusCode: 500, Headers: map[string]string{}}
+		}
+		return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: []byte("marked")}
+	})
+
+	admin := NewAdminServer("")
+	server.registerAdminCommands(admin)
+	if reply := admin.Execute("dscp 10"); reply != "dscp=10\nOK\n" || server.DSCP() != 10 {
+		t.Fatalf("Unexpected dscp reply: %q", reply)
+	}
+	if reply := admin.Execute("dscp 99"); !strings.HasPrefix(reply, "ERR") {
+		t.Errorf("Expected an out of range DSCP refused, got %q", reply)
+	}
+
+	client := newTestClient(t, server)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if err := client.socket.SetRecvTOS(true); err != nil {
+		t.Fatalf("SetRecvTOS failed: %v", err)
+	}
+
+	// The ACK goes out with the server's marking, the response with the
+	// one its handler set on the connection
+	for _, packet := range client.requestPackets(1, buildGetRequest("/voice", client.server)) {
+		client.send(packet)
+	}
+	if tos := recvTOS(t, client.socket); tos != 10<<2 {
+		t.Errorf("Expected the ACK marked with the server's DSCP, got TOS %#x", tos)
+	}
+	if tos := recvTOS(t, client.socket); tos != 46<<2 {
+		t.Errorf("Expected the response marked with the connection's DSCP, got TOS %#x", tos)
+	}
+
+	id, _ := client.ConnectionID()
+	conn := server.connections.GetByID(id)
+	if conn == nil || conn.DSCP() != 46 {
+		t.Fatal("Expected the connection's DSCP set")
+	}
+	conn.SetDSCP(-1)
+	if conn.DSCP() != -1 || conn.packetTOS(server.socket) != -1 {
+		t.Error("Expected the connection back on the server's DSCP")
+	}
+}
@@ -0,0 +1,15 @@
+package ultrafast
+
+import "fmt"
+
+// SetRecvTOS is not supported on Windows
+func (s *LinuxUDPSocket) SetRecvTOS(enabled bool) error {
+	return fmt.Errorf("IP_RECVTOS is not supported on this platform")
+}
+
+// RecvFromTOS is RecvFrom; Windows does not report the TOS byte, so it is
+// always -1
+func (s *LinuxUDPSocket) RecvFromTOS(buffer []byte) (int, SocketAddr, int, error) {
+	n, from, err := s.RecvFrom(buffer)
+	return n, from, -1, err
+}
@@ -0,0 +1,203 @@
+package ultrafast
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tunnels: a local TCP listener whose connections are each carried over a
+// reliable stream to a server, which opens a TCP connection of its own to
+// a fixed target and relays between the two, much like ssh -L. Streams
+// have no half-close, so a tunnelled connection ends as soon as either
+// end closes its side.
+
+// tunnelDialTimeout bounds how long the server waits to reach the target
+const tunnelDialTimeout = 10 * time.Second
+
+// TunnelStats counts a tunnel's connections and the bytes they carried
+type TunnelStats struct {
+	Accepted      uint64 // local connections accepted
+	Active        uint64 // connections being relayed now
+	Failed        uint64 // connections whose stream could not be opened
+	BytesSent     uint64 // from local connections to the remote end
+	BytesReceived uint64 // from the remote end to local connections
+}
+
+// Tunnel accepts TCP connections locally and relays each one over its own
+// stream to a server running TunnelTo
+type Tunnel struct {
+	listener net.Listener
+	remote   SocketAddr
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{} // local connections being relayed
+	wg    sync.WaitGroup
+	done  chan struct{}
+
+	accepted      uint64 // atomic
+	active        int64  // atomic
+	failed        uint64 // atomic
+	bytesSent     uint64 // atomic
+	bytesReceived uint64 // atomic
+}
+
+// ListenTunnel listens on the TCP address listen and tunnels every
+// connection to the server at remote
+func ListenTunnel(listen string, remote SocketAddr) (*Tunnel, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for tunnel: %v", err)
+	}
+	t := &Tunnel{
+		listener: listener,
+		remote:   remote,
+		conns:    make(map[net.Conn]struct{}),
+		done:     make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.accept()
+	return t, nil
+}
+
+// Addr returns the local address connections are accepted on
+func (t *Tunnel) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Remote returns the server connections are tunnelled to
+func (t *Tunnel) Remote() SocketAddr {
+	return t.remote
+}
+
+// accept takes local connections until the listener is closed
+func (t *Tunnel) accept() {
+	defer t.wg.Done()
+	for {
+		local, err := t.listener.Accept()
+		if err != nil {
+			select {
+			case <-t.done:
+			default:
+				logErrorf("Tunnel listener failed: %v", err)
+			}
+			return
+		}
+		atomic.AddUint64(&t.accepted, 1)
+		if !t.track(local) {
+			local.Close()
+			return
+		}
+		t.wg.Add(1)
+		go t.serve(local)
+	}
+}
+
+// track records a local connection so Close can end it, reporting false
+// once the tunnel is closed
+func (t *Tunnel) track(local net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.done:
+		return false
+	default:
+	}
+	t.conns[local] = struct{}{}
+	return true
+}
+
+// serve opens a stream for a local connection and relays between the two
+func (t *Tunnel) serve(local net.Conn) {
+	defer t.wg.Done()
+	defer func() {
+		t.mu.Lock()
+		delete(t.conns, local)
+		t.mu.Unlock()
+		local.Close()
+	}()
+
+	stream, err := DialStream(t.remote.IP, t.remote.Port)
+	if err != nil {
+		atomic.AddUint64(&t.failed, 1)
+		logDebugf("Tunnel to %s failed: %v", t.remote, err)
+		return
+	}
+	atomic.AddInt64(&t.active, 1)
+	defer atomic.AddInt64(&t.active, -1)
+
+	sent, received := relay(local, stream)
+	atomic.AddUint64(&t.bytesSent, uint64(sent))
+	atomic.AddUint64(&t.bytesReceived, uint64(received))
+}
+
+// Close stops accepting, ends the connections being relayed and waits
+// for them to finish
+func (t *Tunnel) Close() error {
+	t.mu.Lock()
+	select {
+	case <-t.done:
+		t.mu.Unlock()
+		return nil
+	default:
+	}
+	close(t.done)
+	for local := range t.conns {
+		local.Close()
+	}
+	t.mu.Unlock()
+
+	err := t.listener.Close()
+	t.wg.Wait()
+	return err
+}
+
+// Stats returns the tunnel's counters
+func (t *Tunnel) Stats() TunnelStats {
+	return TunnelStats{
+		Accepted:      atomic.LoadUint64(&t.accepted),
+		Active:        uint64(atomic.LoadInt64(&t.active)),
+		Failed:        atomic.LoadUint64(&t.failed),
+		BytesSent:     atomic.LoadUint64(&t.bytesSent),
+		BytesReceived: atomic.LoadUint64(&t.bytesReceived),
+	}
+}
+
+// TunnelTo returns a connection handler relaying every connection to the
+// TCP address target, the server end of a Tunnel:
+//
+//	server.OnConnection(ultrafast.TunnelTo("127.0.0.1:22"))
+//
+// A connection whose target cannot be reached is closed at once. Like the
+// reverse proxy this dials with the standard library, so a sandboxed
+// server needs socket, connect and the like in its ExtraSyscalls.
+func TunnelTo(target string) ConnectionHandler {
+	return func(conn *Connection) {
+		remote, err := net.DialTimeout("tcp", target, tunnelDialTimeout)
+		if err != nil {
+			logDebugf("Tunnel from %v to %s failed: %v", conn.Stream().RemoteAddr(), target, err)
+			return
+		}
+		defer remote.Close()
+		relay(remote, conn.Stream())
+	}
+}
+
+// relay copies between a TCP connection and a stream in both directions
+// until either side ends, then closes both. It returns the bytes copied
+// from conn to the stream and from the stream to conn.
+func relay(conn net.Conn, stream *StreamConn) (toStream, fromStream int64) {
+	done := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(conn, stream)
+		conn.Close()
+		done <- n
+	}()
+	toStream, _ = io.Copy(stream, conn)
+	stream.Close()
+	conn.Close()
+	return toStream, <-done
+}
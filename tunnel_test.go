@@ -0,0 +1,143 @@
+package ultrafast
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTCPTarget runs a TCP server that hands each connection to serve
+func startTCPTarget(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// startTestTunnel tunnels a local listener through a test server to target
+func startTestTunnel(t *testing.T, target string) (*UltraFastHTTPServer, *Tunnel) {
+	t.Helper()
+	server := startTestServer(t)
+	server.OnConnection(TunnelTo(target))
+	tunnel, err := ListenTunnel("127.0.0.1:0", server.socket.GetLocalAddr())
+	if err != nil {
+		t.Fatalf("ListenTunnel failed: %v", err)
+	}
+	t.Cleanup(func() { tunnel.Close() })
+	return server, tunnel
+}
+
+func TestTunnelRelaysBothWays(t *testing.T) {
+	target := startTCPTarget(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	_, tunnel := startTestTunnel(t, target)
+
+	local, err := net.Dial("tcp", tunnel.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer local.Close()
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Larger than one segment, so the stream splits and reassembles it
+	message := bytes.Repeat([]byte("tunnelled "), 2000)
+	go local.Write(message)
+	echo := make([]byte, len(message))
+	if _, err := io.ReadFull(local, echo); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(echo, message) {
+		t.Error("Echo through the tunnel differs from what was sent")
+	}
+
+	local.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for tunnel.Stats().Active != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Tunnelled connection still active after the local side closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := tunnel.Stats()
+	if stats.Accepted != 1 || stats.BytesSent != uint64(len(message)) || stats.BytesReceived != uint64(len(message)) {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestTunnelTargetSpeaksFirst(t *testing.T) {
+	target := startTCPTarget(t, func(conn net.Conn) { io.WriteString(conn, "SSH-2.0-banner\r\n") })
+	server, tunnel := startTestTunnel(t, target)
+
+	local, err := net.Dial("tcp", tunnel.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer local.Close()
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The target closing ends the tunnelled connection after its data
+	data, err := io.ReadAll(local)
+	if err != nil || string(data) != "SSH-2.0-banner\r\n" {
+		t.Fatalf("Expected the banner then EOF, got %q, %v", data, err)
+	}
+	waitForConnections(t, server, 0)
+}
+
+func TestTunnelUnreachableTarget(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	target := listener.Addr().String()
+	listener.Close()
+	_, tunnel := startTestTunnel(t, target)
+
+	local, err := net.Dial("tcp", tunnel.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer local.Close()
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+	if data, err := io.ReadAll(local); err != nil || len(data) != 0 {
+		t.Errorf("Expected the connection closed without data, got %q, %v", data, err)
+	}
+}
+
+func TestTunnelClose(t *testing.T) {
+	target := startTCPTarget(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+	_, tunnel := startTestTunnel(t, target)
+
+	local, err := net.Dial("tcp", tunnel.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer local.Close()
+	local.Write([]byte("open"))
+
+	closed := make(chan struct{})
+	go func() {
+		tunnel.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not end the connection being relayed")
+	}
+	if _, err := net.Dial("tcp", tunnel.Addr().String()); err == nil {
+		t.Error("Tunnel should stop accepting once closed")
+	}
+}
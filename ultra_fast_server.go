@@ -1,10 +1,16 @@
-package main
+package ultrafast
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
-	"syscall"
 	"time"
 )
 
@@ -12,12 +18,76 @@ import (
 type UltraFastHTTPServer struct {
 	socket         *LinuxUDPSocket
 	eventLoop      *EpollEventLoop
-	reliability    *LockFreeReliabilityLayer
+	sendQueue      *SendQueue // carries responses from handler goroutines to the loop
+	reliability    *ReliabilityShards // per-connection layers, owned by connections
 	zerocopySockets []*ZeroCopySocket
+	connections    *ConnectionTable
+	synCookies     *SynCookieJar
+	tickets        *SessionTicketIssuer
+	admin          *AdminServer
 	stats          *ServerStats
+	metrics        *serverMetrics // per-route and per-peer breakdown of stats
+	startMallocs   uint64 // heap allocations made before the server existed
 	running        int32 // atomic bool
+	draining       int32 // atomic bool, set during graceful shutdown
+	loopRunning    int32 // atomic bool, set once the event loop serves
+	notReady       int32 // atomic bool, set by SetReady(false)
+	capture        int32 // atomic bool, log every packet in and out
+	requireRetry   int32 // atomic bool, validate every address with a RETRY
+	peerInfoPublic int32 // atomic bool, serve peers' addresses to network clients
+	statsInterval  int64 // atomic time.Duration between stats reports
+	handlerTimeout int64 // atomic time.Duration, per-request handler deadline
+	statsMutex     sync.RWMutex
+	statsCallback  StatsCallback
+	rateLimiter    atomic.Pointer[RateLimiter] // nil when rate limiting is off
+	acl            atomic.Pointer[AccessList]  // nil lets every source through
+	xdp            atomic.Pointer[XDPOffload]  // nil when no XDP program is attached
+	sandbox        atomic.Pointer[SandboxConfig] // nil when the process is not sandboxed
+	privilegeDrop  atomic.Pointer[PrivilegeDrop] // nil to keep the process's identity
+	pacer          atomic.Pointer[Pacer]       // nil when egress bandwidth is unlimited
+	multipath      atomic.Pointer[pathHandler] // nil when multipath is off
+	stateless      atomic.Pointer[StatelessCookieJar] // nil when stateless mode is off
+	tlsConfig      atomic.Pointer[tls.Config]  // nil when TLS is off
+	router         *Router
+	hostsMu        sync.RWMutex
+	hosts          map[string]*Router // virtual hosts by normalized name
+	defaultHost    string             // host answering unmatched requests, "" for router
+	workers        atomic.Pointer[WorkerPool] // nil runs handlers on the event loop
+	responseCache  atomic.Pointer[ResponseCache] // nil when caching is off
+	encoder        atomic.Pointer[contentEncoder] // nil when compression is off
+	requestLimits  atomic.Pointer[RequestLimits]
+	keepAlive      atomic.Pointer[KeepAliveConfig]
+	coalesce       atomic.Pointer[CoalesceConfig] // nil when write coalescing is off
+	connLimits     atomic.Pointer[ConnectionLimits] // nil for no limits
+	accept         atomic.Pointer[acceptQueue] // nil serves connections without Accept
+	handler        atomic.Pointer[HTTPSocketHandler] // the main socket's, set by Start
+	connHandler    atomic.Pointer[ConnectionHandler] // nil serves connections as HTTP
+	handshakeAuth  atomic.Pointer[HandshakeAuthenticator] // nil admits every peer
+	accessLog      atomic.Pointer[AccessLogger] // nil when access logging is off
+	flowExport     atomic.Pointer[FlowExporter] // nil when flow export is off
+	mirror         atomic.Pointer[Mirror] // nil when mirroring is off
+	errorCallback  atomic.Pointer[ErrorCallback] // nil logs recovered errors
+	debug          atomic.Pointer[DebugConfig] // nil when profiling endpoints are off
+	divert         atomic.Pointer[func(*Packet, SocketAddr)] // nil sends to the socket; replay collects packets instead
+	configMu       sync.Mutex
+	configPath     string            // file for ReloadConfig, "" if none loaded
+	configRoutes   []configuredRoute // routes registered from the config file
+	reloadOnce     sync.Once
+	signals        chan os.Signal // SIGHUP notifications, nil until a config is loaded
+	upgrade        *upgradeListener // accepts a new process taking over, nil if disabled
+	upgradeConn    int              // unix socket to the process we took over from, -1 if none
+	discovery      atomic.Pointer[Discovery] // nil when peer discovery is off
+	quic           atomic.Pointer[quicEndpoint] // nil when QUIC mode is off
+	triggerMode    atomic.Int32 // TriggerMode for the main socket
+	service        atomic.Int32 // Service answering requests on the main socket
 }
 
+// StatsCallback receives periodic snapshots of server and reliability statistics
+type StatsCallback func(ServerStats, ReliabilityStats)
+
+// defaultStatsInterval is how often stats are reported unless configured
+const defaultStatsInterval = 10 * time.Second
+
 // ServerStats holds server performance statistics
 type ServerStats struct {
 	RequestsReceived  uint64
@@ -26,6 +96,26 @@ type ServerStats struct {
 	BytesSent         uint64
 	ConnectionsActive uint64
 	Errors           uint64
+	RateLimited      uint64 // packets dropped by the per-source rate limiter
+	AmplificationLimited uint64 // sends held or refused to unvalidated addresses
+	HandlerTimeouts      uint64 // handlers abandoned after their deadline, answered 503
+	RequestsRejected     uint64 // requests over a RequestLimits bound, answered 413 or 408
+	HandlerPanics        uint64 // handlers that panicked, answered 500
+	SendQueueFull        uint64 // responses passed to the loop's task queue because the send queue was full
+	ConnectionsEvicted   uint64 // least recently active connections dropped at KeepAliveConfig.MaxConnections
+	ConnectionsReaped    uint64 // connections reset after their peer stopped acknowledging within the retransmission budget
+	ConnectionsRefused   uint64 // SYNs answered with RST over ConnectionLimits
+	HandshakesRejected   uint64 // SYNs answered with RST after the HandshakeAuthenticator refused them
+	CongestionLimited    uint64 // DATA packets queued until the congestion window, or the bandwidth limit, had room
+	StatelessServed      uint64 // single-packet requests answered without connection state
+	StatelessRefused     uint64 // stateless requests refused with RST, to be retried over a connection
+	SocketOverflows      uint64 // datagrams the kernel dropped because the socket's receive buffer was full
+	AcceptQueueFull      uint64 // DATA packets dropped while their connection waited in the accept queue with its buffer full
+	OutOfOrderDropped    uint64 // stream segments dropped for arriving too far ahead of a missing one to hold
+	HandlerRejected      uint64 // requests the worker pool had no room for, answered 503
+	AuthFailed           uint64 // packets dropped for a missing or wrong authentication tag
+	ACLBlocked           uint64 // packets from sources the access list blocks, dropped before parsing
+	ReplaysRejected      uint64 // authenticated packets dropped as replays: seen before, older than the replay window or their connection, or DATA outside a connection
 	StartTime        time.Time
 }
 
@@ -35,6 +125,24 @@ type HTTPRequest struct {
 	Path    string
 	Headers map[string]string
 	Body    []byte
+	ID      uint32 // client-assigned request ID, 0 if none
+	Peer    SocketAddr
+	// Priority is the urgency of the response, from PriorityHighest to
+	// PriorityLowest, as asked for by the Priority header (RFC 9218). On a
+	// congested connection more urgent responses go out first. A handler
+	// may change it before returning; a streamed response keeps the
+	// priority the request arrived with.
+	Priority int
+
+	handler   *HTTPSocketHandler // set when the request arrived over DATA packets
+	upgraded  *MessageConn       // set by Upgrade
+	sink      responseSink       // where a streamed response goes, nil if it cannot stream
+	keepAlive bool               // the connection stays open after the response
+	router    *Router            // chosen by Host header before routing
+	vhost     string             // virtual host serving the request, "" for the default routes
+	route     string             // registered path or prefix that matched, "" if none
+	received  time.Time          // for access log latency
+	writer    *ResponseWriter    // set while a WriterHandler builds the response
 }
 
 // HTTPResponse represents an HTTP response
@@ -42,10 +150,29 @@ type HTTPResponse struct {
 	StatusCode int
 	Headers    map[string]string
 	Body       []byte
+
+	writer *ResponseWriter // set when the response was built by a ResponseWriter
+	file   *fileBody       // body streamed from a file after the headers
+}
+
+// Header returns the value of a request header, matching the name
+// case-insensitively
+func (r *HTTPRequest) Header(name string) string {
+	if value, exists := r.Headers[name]; exists {
+		return value
+	}
+	for key, value := range r.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
 }
 
-// RequestHandler function signature for handling HTTP requests
-type RequestHandler func(*HTTPRequest) *HTTPResponse
+// RequestHandler function signature for handling HTTP requests. The
+// context carries RequestInfo and is cancelled when the connection closes
+// or the server's handler timeout expires.
+type RequestHandler func(context.Context, *HTTPRequest) *HTTPResponse
 
 // NewUltraFastHTTPServer creates a new ultra-fast HTTP server
 func NewUltraFastHTTPServer(bindIP string, bindPort uint16) (*UltraFastHTTPServer, error) {
@@ -61,6 +188,16 @@ func NewUltraFastHTTPServer(bindIP string, bindPort uint16) (*UltraFastHTTPServe
 		return nil, fmt.Errorf("failed to bind to %s:%d: %v", bindIP, bindPort, err)
 	}
 
+	return newServerWithSocket(socket)
+}
+
+// newServerWithSocket builds a server around a bound socket, which it
+// owns from then on
+func newServerWithSocket(socket *LinuxUDPSocket) (*UltraFastHTTPServer, error) {
+	// Have the kernel report the datagrams it drops for a full receive
+	// buffer, where it can
+	socket.SetRxqOverflow(true)
+
 	// Create event loop for handling multiple connections
 	eventLoop, err := NewEpollEventLoop(10000) // Handle up to 10k concurrent connections
 	if err != nil {
@@ -68,8 +205,33 @@ func NewUltraFastHTTPServer(bindIP string, bindPort uint16) (*UltraFastHTTPServe
 		return nil, fmt.Errorf("failed to create event loop: %v", err)
 	}
 
-	// Create lock-free reliability layer
-	reliability := NewLockFreeReliabilityLayer()
+	// Responses from handler goroutines reach the loop without locking
+	sendQueue, err := NewSendQueue(defaultSendQueueLength)
+	if err != nil {
+		eventLoop.Close()
+		socket.Close()
+		return nil, err
+	}
+
+	// Each connection gets its own lock-free reliability layer, sharded
+	// by peer; the table attaches and detaches them
+	connections := NewConnectionTable()
+
+	// SYN cookies keep the handshake stateless until the final ACK
+	synCookies, err := NewSynCookieJar()
+	if err != nil {
+		eventLoop.Close()
+		socket.Close()
+		return nil, err
+	}
+
+	// Session tickets let returning clients resume with 0-RTT data
+	tickets, err := NewSessionTicketIssuer(defaultTicketLifetime)
+	if err != nil {
+		eventLoop.Close()
+		socket.Close()
+		return nil, err
+	}
 
 	// Create pool of zero-copy sockets for high-performance I/O
 	zerocopySockets := make([]*ZeroCopySocket, 4) // 4 sockets for load distribution
@@ -90,12 +252,26 @@ func NewUltraFastHTTPServer(bindIP string, bindPort uint16) (*UltraFastHTTPServe
 	server := &UltraFastHTTPServer{
 		socket:          socket,
 		eventLoop:       eventLoop,
-		reliability:     reliability,
+		sendQueue:       sendQueue,
+		reliability:     connections.Reliability(),
 		zerocopySockets: zerocopySockets,
+		connections:     connections,
+		synCookies:      synCookies,
+		tickets:         tickets,
+		router:          NewRouter(),
+		hosts:           make(map[string]*Router),
+		statsInterval:   int64(defaultStatsInterval),
+		handlerTimeout:  int64(defaultHandlerTimeout),
+		upgradeConn:     -1,
+		startMallocs:    heapAllocations(),
+		metrics:         newServerMetrics(),
 		stats: &ServerStats{
 			StartTime: time.Now(),
 		},
 	}
+	server.workers.Store(NewWorkerPool(WorkerPoolConfig{}))
+	server.SetRequestLimits(RequestLimits{})
+	server.SetKeepAlive(KeepAliveConfig{})
 
 	return server, nil
 }
@@ -107,20 +283,45 @@ func (s *UltraFastHTTPServer) Start() error {
 	// Set up event handler for the main socket
 	handler := &HTTPSocketHandler{
 		server: s,
-		buffer: make([]byte, 65536), // 64KB buffer
+		reader: NewPacketReader(s.socket),
 	}
+	s.handler.Store(handler)
+	s.connections.OnEvict(handler.evictConnection)
 
 	// Add main socket to event loop
-	if err := s.eventLoop.AddSocket(s.socket, handler); err != nil {
+	if err := s.eventLoop.AddSocketMode(s.socket, handler, s.TriggerMode()); err != nil {
 		return fmt.Errorf("failed to add socket to event loop: %v", err)
 	}
+	if err := s.eventLoop.AddFD(s.sendQueue.EventFD(), s.sendQueue); err != nil {
+		return err
+	}
+
+	// Every socket the data path needs exists by now. Privileges go
+	// first, as the sandbox disallows changing them.
+	if err := s.applyPrivilegeDrop(); err != nil {
+		return err
+	}
+	if err := s.applySandbox(); err != nil {
+		return err
+	}
 
-	// Start background reliability processing
-	go s.reliabilityWorker()
+	// Readiness waits until the loop is actually processing events
+	s.eventLoop.Submit(func() {
+		atomic.StoreInt32(&s.loopRunning, 1)
+		s.finishInherit()
+	})
+
+	// Start background reliability processing, one worker per shard
+	for shard := 0; shard < s.reliability.Shards(); shard++ {
+		go s.reliabilityWorker(shard)
+	}
 
 	// Start performance monitoring
 	go s.statsWorker()
 
+	// Expire stalled requests and idle connections
+	go s.connectionWorker(handler)
+
 	log.Printf("Ultra-fast HTTP server started on %v", s.socket.GetLocalAddr())
 	log.Printf("Performance target: >1M requests/second, <100μs latency")
 
@@ -131,13 +332,151 @@ func (s *UltraFastHTTPServer) Start() error {
 // Stop stops the server gracefully
 func (s *UltraFastHTTPServer) Stop() {
 	atomic.StoreInt32(&s.running, 0)
+	atomic.StoreInt32(&s.loopRunning, 0)
 	s.eventLoop.Stop()
 }
 
+// Shutdown stops accepting new connections, waits up to timeout for
+// in-flight responses to be acknowledged, then stops the event loop
+func (s *UltraFastHTTPServer) Shutdown(timeout time.Duration) {
+	logInfof("Graceful shutdown: draining for up to %v", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	s.drain(ctx)
+	s.Stop()
+}
+
+// drain stops accepting new connections and waits until in-flight
+// responses are acknowledged or ctx is done, returning ctx's error then
+func (s *UltraFastHTTPServer) drain(ctx context.Context) error {
+	atomic.StoreInt32(&s.draining, 1)
+	for s.reliability.UnackedCount() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// IsDraining reports whether a graceful shutdown is in progress
+func (s *UltraFastHTTPServer) IsDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// SetPacketCapture toggles logging of every packet sent and received
+func (s *UltraFastHTTPServer) SetPacketCapture(enabled bool) {
+	value := int32(0)
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&s.capture, value)
+}
+
+// SetPeerInfoPublic serves the connection table at /connections, and the
+// top talkers in /stats, to network clients. It is off by default, as it
+// reveals every client's address to any other; the admin socket's
+// connections and talkers commands show the same either way.
+func (s *UltraFastHTTPServer) SetPeerInfoPublic(public bool) {
+	value := int32(0)
+	if public {
+		value = 1
+	}
+	atomic.StoreInt32(&s.peerInfoPublic, value)
+}
+
+// PeerInfoPublic reports whether network clients are shown other peers
+func (s *UltraFastHTTPServer) PeerInfoPublic() bool {
+	return atomic.LoadInt32(&s.peerInfoPublic) == 1
+}
+
+// capturePacket logs a packet when packet capture is enabled
+func (s *UltraFastHTTPServer) capturePacket(direction string, packet *Packet, peer SocketAddr) {
+	if atomic.LoadInt32(&s.capture) == 1 {
+		logInfof("CAPTURE %s %s:%d %v", direction, peer.IP, peer.Port, packet)
+	}
+}
+
+// HandleFunc registers a handler for an exact request path. Registered
+// handlers take precedence over the built-in endpoints.
+func (s *UltraFastHTTPServer) HandleFunc(path string, handler RequestHandler) {
+	s.router.HandleFunc(path, handler)
+}
+
+// HandlePrefix registers a handler for every path under prefix that has
+// no exact route. The longest matching prefix wins.
+func (s *UltraFastHTTPServer) HandlePrefix(prefix string, handler RequestHandler) {
+	s.router.HandlePrefix(prefix, handler)
+}
+
+// SetRetryRequired makes every new connection validate its address with a
+// RETRY round trip before the server commits any state or sends more than
+// a small token. Useful while under a reflection or SYN flood attack.
+func (s *UltraFastHTTPServer) SetRetryRequired(required bool) {
+	value := int32(0)
+	if required {
+		value = 1
+	}
+	atomic.StoreInt32(&s.requireRetry, value)
+}
+
+// RetryRequired reports whether new connections must answer a RETRY
+func (s *UltraFastHTTPServer) RetryRequired() bool {
+	return atomic.LoadInt32(&s.requireRetry) == 1
+}
+
+// SetRateLimit enables per-source rate limiting, or updates the limits
+// in place if it is already enabled
+func (s *UltraFastHTTPServer) SetRateLimit(config RateLimitConfig) {
+	if limiter := s.rateLimiter.Load(); limiter != nil {
+		limiter.SetConfig(config)
+		return
+	}
+	s.rateLimiter.Store(NewRateLimiter(config))
+}
+
+// DisableRateLimit turns per-source rate limiting off
+func (s *UltraFastHTTPServer) DisableRateLimit() {
+	s.rateLimiter.Store(nil)
+}
+
+// LocalAddr returns the address the server's main socket is bound to
+func (s *UltraFastHTTPServer) LocalAddr() SocketAddr {
+	return s.socket.GetLocalAddr()
+}
+
+// SetSocketBuffers sizes the main socket's kernel buffers, see
+// LinuxUDPSocket.SetBufferSizes
+func (s *UltraFastHTTPServer) SetSocketBuffers(recv, send int) error {
+	return s.socket.SetBufferSizes(recv, send)
+}
+
+// EnableAdmin starts the control channel on a unix socket path
+func (s *UltraFastHTTPServer) EnableAdmin(path string) error {
+	admin := NewAdminServer(path)
+	s.registerAdminCommands(admin)
+	if err := admin.Start(); err != nil {
+		return err
+	}
+	s.admin = admin
+	return nil
+}
+
 // Close cleans up all resources
 func (s *UltraFastHTTPServer) Close() error {
 	s.Stop()
 
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	s.stopReloadSignal()
+	s.DisableUpgrade()
+	s.DisableDiscovery()
+	s.DisableQUIC()
+	s.DisableMultipath()
+	s.SetBandwidthLimit(0)
+
 	// Close zero-copy sockets
 	for _, zcSocket := range s.zerocopySockets {
 		if zcSocket != nil {
@@ -145,28 +484,53 @@ func (s *UltraFastHTTPServer) Close() error {
 		}
 	}
 
+	// Let in-flight handlers finish before the loop goes away
+	if pool := s.workers.Swap(nil); pool != nil {
+		pool.Close()
+	}
+	s.DisableAccessLog()
+	s.DisableMirror()
+
+	// Connections still open end with the server
+	if s.flowExport.Load() != nil {
+		for _, conn := range s.connections.Snapshot() {
+			s.exportFlow(conn, FLOW_END_FORCED)
+		}
+		s.DisableFlowExport()
+	}
+	s.DisableXDP()
+
 	// Close event loop
 	s.eventLoop.Close()
+	s.sendQueue.Close()
+	s.abandonInherit()
 
 	// Close main socket
 	return s.socket.Close()
 }
 
-// reliabilityWorker handles packet retransmission and reliability in background
-func (s *UltraFastHTTPServer) reliabilityWorker() {
+// reliabilityWorker handles packet retransmission and reliability in
+// background for the connections on one shard
+func (s *UltraFastHTTPServer) reliabilityWorker(shard int) {
 	ticker := time.NewTicker(1 * time.Millisecond) // Check every 1ms for ultra-low latency
 	defer ticker.Stop()
 
+	// Reused every tick, so the scan allocates nothing once it has grown
+	var timedOut []*Packet
+	var dueAcks []dueAck
+
 	for atomic.LoadInt32(&s.running) == 1 {
 		select {
 		case <-ticker.C:
-			// Check for timed-out packets that need retransmission
-			timedOutPackets := s.reliability.GetTimedOutPackets()
-			for range timedOutPackets {
-				// Count retransmission attempt (simplified - in real implementation,
-				// you'd track the original destination and retransmit there)
-				atomic.AddUint64(&s.stats.Errors, 1)
-			}
+			// Check for timed-out packets that need retransmission. They
+			// are counted in the reliability stats, and packets past the
+			// retransmission budget are given up on there; the connection
+			// worker aborts their connections. Neither is a socket error.
+			timedOut = s.reliability.AppendTimedOut(shard, timedOut[:0])
+			clear(timedOut) // nothing resends them, so drop the references
+
+			// Send the delayed ACKs whose time has come
+			dueAcks = s.sendDueAcks(shard, dueAcks)
 
 		default:
 			// Yield CPU to avoid busy waiting
@@ -175,29 +539,59 @@ func (s *UltraFastHTTPServer) reliabilityWorker() {
 	}
 }
 
-// statsWorker periodically logs performance statistics
+// OnStats registers a callback that receives stats every reporting interval
+// instead of them being logged. Passing nil restores the default logging.
+func (s *UltraFastHTTPServer) OnStats(callback StatsCallback) {
+	s.statsMutex.Lock()
+	s.statsCallback = callback
+	s.statsMutex.Unlock()
+}
+
+// SetStatsInterval changes how often stats are reported; it takes effect
+// at the next report, including while the server is running
+func (s *UltraFastHTTPServer) SetStatsInterval(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultStatsInterval
+	}
+	atomic.StoreInt64(&s.statsInterval, int64(interval))
+}
+
+// statsWorker periodically reports performance statistics
 func (s *UltraFastHTTPServer) statsWorker() {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+	lastReport := clockNow()
 
 	for atomic.LoadInt32(&s.running) == 1 {
-		select {
-		case <-ticker.C:
-			s.logStats()
-		default:
-			time.Sleep(1 * time.Second)
+		// Poll often enough to honour short intervals and a prompt Stop
+		time.Sleep(100 * time.Millisecond)
+
+		interval := time.Duration(atomic.LoadInt64(&s.statsInterval))
+		if now := clockNow(); now.Sub(lastReport) >= interval {
+			lastReport = now
+			s.reportStats()
 		}
 	}
 }
 
-// logStats logs current performance statistics
-func (s *UltraFastHTTPServer) logStats() {
-	uptime := time.Since(s.stats.StartTime)
-	requests := atomic.LoadUint64(&s.stats.RequestsReceived)
-	responses := atomic.LoadUint64(&s.stats.ResponsesSent)
-	bytesIn := atomic.LoadUint64(&s.stats.BytesReceived)
-	bytesOut := atomic.LoadUint64(&s.stats.BytesSent)
-	errors := atomic.LoadUint64(&s.stats.Errors)
+// reportStats delivers one stats snapshot to the callback or the log
+func (s *UltraFastHTTPServer) reportStats() {
+	s.statsMutex.RLock()
+	callback := s.statsCallback
+	s.statsMutex.RUnlock()
+
+	if callback == nil {
+		callback = logStats
+	}
+	callback(*s.GetStats(), s.reliability.GetStats())
+}
+
+// logStats logs performance statistics; it is the default stats callback
+func logStats(stats ServerStats, reliabilityStats ReliabilityStats) {
+	uptime := time.Since(stats.StartTime)
+	requests := stats.RequestsReceived
+	responses := stats.ResponsesSent
+	bytesIn := stats.BytesReceived
+	bytesOut := stats.BytesSent
+	errors := stats.Errors
 
 	rps := float64(requests) / uptime.Seconds()
 	avgLatency := time.Duration(0)
@@ -211,7 +605,6 @@ func (s *UltraFastHTTPServer) logStats() {
 		bytesIn, bytesOut, errors, avgLatency)
 
 	// Log reliability statistics
-	reliabilityStats := s.reliability.GetStats()
 	log.Printf("RELIABILITY: Sent=%d, Received=%d, Lost=%d, Retransmitted=%d, "+
 		"CongestionWindow=%d, RTT=%v",
 		reliabilityStats.PacketsSent, reliabilityStats.PacketsReceived,
@@ -219,6 +612,24 @@ func (s *UltraFastHTTPServer) logStats() {
 		reliabilityStats.CongestionWindow, reliabilityStats.RTTEstimate)
 }
 
+// reliabilityFor returns the layer tracking packets to a connection's
+// peer, or the shared connectionless layer when conn is nil
+func (s *UltraFastHTTPServer) reliabilityFor(conn *Connection) *LockFreeReliabilityLayer {
+	if conn == nil {
+		return s.reliability.Connectionless()
+	}
+	return conn.Reliability()
+}
+
+// Connections returns the state of every tracked peer, oldest first
+func (s *UltraFastHTTPServer) Connections() []ConnectionInfo {
+	infos := s.connections.Infos()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Established.Before(infos[j].Established)
+	})
+	return infos
+}
+
 // GetStats returns current server statistics
 func (s *UltraFastHTTPServer) GetStats() *ServerStats {
 	return &ServerStats{
@@ -228,6 +639,26 @@ func (s *UltraFastHTTPServer) GetStats() *ServerStats {
 		BytesSent:         atomic.LoadUint64(&s.stats.BytesSent),
 		ConnectionsActive: atomic.LoadUint64(&s.stats.ConnectionsActive),
 		Errors:           atomic.LoadUint64(&s.stats.Errors),
+		RateLimited:      atomic.LoadUint64(&s.stats.RateLimited),
+		AmplificationLimited: atomic.LoadUint64(&s.stats.AmplificationLimited),
+		HandlerTimeouts:      atomic.LoadUint64(&s.stats.HandlerTimeouts),
+		RequestsRejected:     atomic.LoadUint64(&s.stats.RequestsRejected),
+		HandlerPanics:        atomic.LoadUint64(&s.stats.HandlerPanics),
+		SendQueueFull:        atomic.LoadUint64(&s.stats.SendQueueFull),
+		ConnectionsEvicted:   atomic.LoadUint64(&s.stats.ConnectionsEvicted),
+		ConnectionsReaped:    atomic.LoadUint64(&s.stats.ConnectionsReaped),
+		ConnectionsRefused:   atomic.LoadUint64(&s.stats.ConnectionsRefused),
+		HandshakesRejected:   atomic.LoadUint64(&s.stats.HandshakesRejected),
+		CongestionLimited:    atomic.LoadUint64(&s.stats.CongestionLimited),
+		StatelessServed:      atomic.LoadUint64(&s.stats.StatelessServed),
+		StatelessRefused:     atomic.LoadUint64(&s.stats.StatelessRefused),
+		SocketOverflows:      s.socket.RxqOverflows(),
+		AcceptQueueFull:      atomic.LoadUint64(&s.stats.AcceptQueueFull),
+		OutOfOrderDropped:    atomic.LoadUint64(&s.stats.OutOfOrderDropped),
+		HandlerRejected:      atomic.LoadUint64(&s.stats.HandlerRejected),
+		AuthFailed:           atomic.LoadUint64(&s.stats.AuthFailed),
+		ReplaysRejected:      atomic.LoadUint64(&s.stats.ReplaysRejected),
+		ACLBlocked:           atomic.LoadUint64(&s.stats.ACLBlocked),
 		StartTime:        s.stats.StartTime,
 	}
 }
@@ -235,71 +666,357 @@ func (s *UltraFastHTTPServer) GetStats() *ServerStats {
 // HTTPSocketHandler handles HTTP requests over our custom UDP protocol
 type HTTPSocketHandler struct {
 	server *UltraFastHTTPServer
-	buffer []byte
+	reader *PacketReader // scatters each datagram into header and body
 }
 
 // OnRead handles incoming HTTP requests
 func (h *HTTPSocketHandler) OnRead(fd int) error {
 	for {
-		n, fromAddr, err := h.server.socket.RecvFrom(h.buffer)
+		header, body, fromAddr, err := h.reader.ReadDatagram()
 		if err != nil {
-			if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
+			if errors.Is(err, ErrWouldBlock) {
 				break // No more data available
 			}
 			return fmt.Errorf("recv error: %v", err)
 		}
 
-		if n > 0 {
-			h.processIncomingData(h.buffer[:n], fromAddr)
+		if len(header) > 0 {
+			h.processIncomingData(header, body, fromAddr)
 		}
 	}
 	return nil
 }
 
-// processIncomingData processes incoming packet data
-func (h *HTTPSocketHandler) processIncomingData(data []byte, from SocketAddr) {
+// processIncomingData processes an incoming datagram, received as the
+// fixed header and the body after it
+func (h *HTTPSocketHandler) processIncomingData(header, body []byte, from SocketAddr) {
+	// The access list runs before anything else is done with the packet
+	if !h.server.admitSource(from) {
+		return
+	}
+
+	size := len(header) + len(body)
+	h.server.metrics.countPeer(from.IP, size)
+
+	// Flood protection runs before any parsing work is spent on the packet
+	if limiter := h.server.rateLimiter.Load(); limiter != nil {
+		if !limiter.Allow(from.IP, size, clockNow()) {
+			atomic.AddUint64(&h.server.stats.RateLimited, 1)
+			h.server.blockAtXDP(from)
+			if limiter.Config().Action == RATE_LIMIT_RST {
+				h.sendPacket(NewPacket(RST_PACKET, RST_FLAG, 0, 0, nil), from)
+			}
+			return
+		}
+	}
+
 	atomic.AddUint64(&h.server.stats.RequestsReceived, 1)
-	atomic.AddUint64(&h.server.stats.BytesReceived, uint64(len(data)))
+	atomic.AddUint64(&h.server.stats.BytesReceived, uint64(size))
 
-	// Parse packet using our custom protocol
-	packet, err := DeserializePacket(data)
+	// QUIC shares the socket; its packets never look like ours. It parses
+	// whole datagrams, so only these are joined back together.
+	if endpoint := h.server.quic.Load(); endpoint != nil && isQUICPacket(header) {
+		endpoint.receive(h, append(header[:len(header):len(header)], body...), from)
+		return
+	}
+
+	// Parse packet using our custom protocol; the payload stays in body
+	packet, err := decodePacket(header, body, h.server.socket.checksumsFor(from))
 	if err != nil {
 		atomic.AddUint64(&h.server.stats.Errors, 1)
 		return
 	}
+	if !h.server.socket.verifyPacket(packet) {
+		atomic.AddUint64(&h.server.stats.AuthFailed, 1)
+		return
+	}
+	h.server.capturePacket("in", packet, from)
+	h.handlePacket(packet, size, from)
+}
+
+// handlePacket acts on a parsed packet of size bytes from a peer. Those
+// arriving over a second path in multipath mode come in here as if from
+// their connection's main peer.
+func (h *HTTPSocketHandler) handlePacket(packet *Packet, size int, from SocketAddr) {
+	if !h.checkReplay(packet, from) {
+		return
+	}
+
+	// Route by connection ID first so a peer whose NAT rebinds its port
+	// keeps its connection; the connection follows the new address once
+	// the peer proves it receives there
+	if id, hasID := packet.ConnectionID(); hasID {
+		if conn := h.server.connections.GetByID(id); conn != nil && h.server.connections.PeerOf(conn) != from {
+			if packet.Type == PATH_RESPONSE_PACKET {
+				h.handlePathResponse(conn, id, packet, from)
+			} else {
+				h.challengePath(id, size, from)
+			}
+			return
+		}
+	}
+
+	if conn := h.server.connections.Get(from); conn != nil {
+		conn.RecordIn(size)
+
+		// Echoing the connection ID we handed out proves the peer
+		// receives at this address, which lifts the amplification limit
+		if !conn.Validated() {
+			if id, hasID := packet.ConnectionID(); hasID && id == conn.ID {
+				h.validateConnection(conn, from)
+			}
+		}
+	}
 
 	// Handle different packet types
 	switch {
 	case packet.IsDataPacket():
 		h.handleDataPacket(packet, from)
 	case packet.IsAckPacket():
-		h.server.reliability.HandleAck(packet)
+		if h.handleHandshakeAck(packet, from) {
+			return
+		}
+		conn := h.server.connections.Get(from)
+		if conn == nil {
+			h.server.reliability.Connectionless().HandleAck(packet)
+			return
+		}
+		// Three ACKs past a missing packet resend it without waiting for
+		// the RTO; it is still counted in flight, so it needs no room in
+		// the window, unlike the queued packets the ACK may let out
+		now := clockNow()
+		result := conn.Reliability().processAck(packet, func(seqNum uint32) {
+			conn.TrackAcked(seqNum, now)
+			conn.pathAcked(seqNum, now)
+		})
+		if lost := result.Retransmit; lost != nil {
+			h.retransmit(lost, conn, from)
+		}
+		h.releaseWindow(conn, from)
+		if stream := conn.stream.Load(); stream != nil {
+			stream.ackArrived()
+		}
 	case packet.IsSynPacket():
 		h.handleConnectionRequest(packet, from)
 	case packet.IsFinPacket():
 		h.handleConnectionClose(packet, from)
+	case packet.Type == BINDING_PACKET:
+		h.handleBindingRequest(packet, from)
+	case packet.Type == ECHO_REQUEST_PACKET:
+		h.handleEchoRequest(packet, from)
 	}
 }
 
 // handleDataPacket processes HTTP request data packets
 func (h *HTTPSocketHandler) handleDataPacket(packet *Packet, from SocketAddr) {
-	// Send ACK for reliable delivery
-	ackPacket := NewPacket(ACK_PACKET, ACK_FLAG, 0, packet.SeqNum+1, nil)
-	ackData := ackPacket.Serialize()
-	h.server.socket.SendTo(ackData, from.IP, from.Port)
+	// A single-packet request asking for it is answered without a connection
+	if cookie, ok := packet.GetOption(OPT_STATELESS); ok && h.server.connections.Get(from) == nil {
+		if jar := h.server.stateless.Load(); jar != nil {
+			h.serveStateless(packet, from, cookie, jar)
+			return
+		}
+	}
+
+	// With packet authentication, requests are only served on a
+	// connection, whose replay window catches a captured packet sent again
+	if h.server.connections.Get(from) == nil && h.server.socket.PacketAuthEnabled() {
+		atomic.AddUint64(&h.server.stats.ReplaysRejected, 1)
+		return
+	}
+
+	// A connection waiting in the accept queue keeps its data for later
+	if conn := h.server.connections.Get(from); conn != nil {
+		if held, kept := conn.holdUntilAccepted(packet); held {
+			if kept {
+				if ack := conn.Reliability().AckReceived(packet); ack != nil {
+					h.sendPacket(ack, from)
+				}
+			} else {
+				atomic.AddUint64(&h.server.stats.AcceptQueueFull, 1)
+			}
+			return
+		}
+	}
+
+	// Send ACK for reliable delivery: cumulative on a connection, unless
+	// delayed, and for this packet alone to a peer sharing the
+	// connectionless sequence space
+	if ack := h.server.reliabilityFor(h.server.connections.Get(from)).AckReceived(packet); ack != nil {
+		h.sendPacket(ack, from)
+	}
+	h.dispatchData(packet, from)
+}
+
+// dispatchData hands an acknowledged DATA packet to the connection's
+// stream, or serves the request it carries
+func (h *HTTPSocketHandler) dispatchData(packet *Packet, from SocketAddr) {
+	// Connections carrying a byte stream hand their data to the stream
+	if conn := h.server.connections.Get(from); conn != nil {
+		if stream := conn.stream.Load(); stream != nil {
+			if !stream.deliver(packet.SeqNum, packet.Payload) {
+				atomic.AddUint64(&h.server.stats.OutOfOrderDropped, 1)
+			}
+			return
+		}
+		// As do those whose Reader was taken
+		if reader := conn.Reliability().reader.Load(); reader != nil && reader.taking() {
+			if !reader.push(packet.SeqNum, packet.Payload) {
+				atomic.AddUint64(&h.server.stats.OutOfOrderDropped, 1)
+			}
+			return
+		}
+		if config := h.server.tlsConfig.Load(); config != nil && isTLSHandshake(packet.Payload) {
+			h.startTLSStream(conn, packet, config)
+			return
+		}
+	}
+
+	// A request too large for one packet arrives as fragments
+	requestID, _ := packet.RequestID()
+	if _, _, fragmented := packet.Fragment(); fragmented {
+		h.receiveRequestFragment(packet, from, requestID)
+		return
+	}
+
+	h.serveRequest(packet.Payload, requestID, from, false)
+}
+
+// serveRequest parses, handles and answers an HTTP request received over
+// DATA packets. The response echoes the request's ID so a client with
+// several requests in flight can match them up. Requests arriving as 0-RTT
+// data are only executed if they are safe to replay.
+func (h *HTTPSocketHandler) serveRequest(payload []byte, requestID uint32, from SocketAddr, earlyData bool) {
+	if h.serveRaw(payload, requestID, from) {
+		return
+	}
+	if !withinRequestLimits(payload, h.server.RequestLimits()) {
+		h.rejectRequest(from, 413, requestID)
+		return
+	}
 
 	// Parse HTTP request from packet payload
-	request, err := h.parseHTTPRequest(packet.Payload)
+	request, err := h.parseHTTPRequest(payload)
 	if err != nil {
-		h.sendErrorResponse(from, 400, "Bad Request")
+		h.sendErrorResponse(from, 400, "Bad Request", requestID)
+		return
+	}
+
+	if earlyData && !isSafeMethod(request.Method) {
+		h.sendErrorResponse(from, 425, "Too Early", requestID)
 		return
 	}
+	request.ID = requestID
+	request.Peer = from
+	request.handler = h
+	request.received = clockNow()
+
+	// A retransmitted copy of a request still being handled is dropped;
+	// the response to the original answers both
+	conn := h.server.connections.Get(from)
+	if conn != nil && requestID != 0 {
+		if !conn.BeginRequest(requestID) {
+			logDebugf("Dropping duplicate request %d from %s:%d", requestID, from.IP, from.Port)
+			return
+		}
+		if request.Priority != PriorityDefault {
+			conn.SetPriority(requestID, request.Priority)
+		}
+	}
 
-	// Handle the HTTP request
-	response := h.handleHTTPRequest(request)
+	// The shadow sees each request once, retransmissions left out
+	h.server.mirrorRequest(payload)
+
+	ctx, cancel := h.newRequestContext(conn, RequestInfo{
+		Peer:      from,
+		RequestID: requestID,
+		EarlyData: earlyData,
+		Received:  request.received,
+	})
+	if conn != nil {
+		request.sink = &packetSink{handler: h, ctx: ctx, conn: conn, requestID: requestID}
+		request.keepAlive = conn.countRequest(request, h.server.KeepAlive())
+	}
+	finish := func() {
+		cancel()
+		if conn != nil && requestID != 0 {
+			conn.EndRequest(requestID)
+		}
+	}
+	respondAndFinish := func(response *HTTPResponse) {
+		h.respond(request, response, from, len(payload))
+		finish()
+		if conn != nil {
+			h.closeAfterResponse(conn)
+		}
+	}
+
+	pool := h.server.workers.Load()
+	if pool == nil {
+		respondAndFinish(h.handleHTTPRequest(ctx, request))
+		return
+	}
+
+	// The handler runs on a worker; the response goes back through the
+	// send queue so all sends stay on the loop goroutine
+	submitted := pool.Submit(func() {
+		response := h.handleHTTPRequest(ctx, request)
+		h.server.sendOnLoop(func() {
+			respondAndFinish(response)
+		})
+	})
+	if !submitted {
+		atomic.AddUint64(&h.server.stats.HandlerRejected, 1)
+		finish()
+		h.sendErrorResponse(from, 503, "Service Unavailable", requestID)
+	}
+}
+
+// respond sends a handler's response to a packet request
+func (h *HTTPSocketHandler) respond(request *HTTPRequest, response *HTTPResponse, from SocketAddr, requestSize int) {
+	// A streamed response already went out in part; send the rest
+	if w := response.writer; w != nil && w.streaming {
+		if err := w.finishStream(); err != nil {
+			logDebugf("Streamed response to %s:%d ended early: %v", from.IP, from.Port, err)
+			if err == errHandlerPanic {
+				// The body is cut short; don't let the client take it as whole
+				h.resetConnection(from)
+			}
+		}
+		h.server.logAccess(request, w.Status(), w.sent)
+		releaseResponse(response)
+		return
+	}
+
+	responseData := h.serializeHTTPResponse(response, request.keepAlive)
+	status := response.StatusCode
+	upgradeAccepted := status == 101
+	defer releaseResponse(response)
+
+	// A peer that skipped the handshake never proved its address, so it
+	// only gets a response within the amplification limit (counting the ACK)
+	conn := h.server.connections.Get(from)
+	if conn == nil {
+		budget := amplificationFactor * (PACKET_HEADER_SIZE + requestSize)
+		if 2*PACKET_HEADER_SIZE+response.length(responseData) > budget {
+			atomic.AddUint64(&h.server.stats.AmplificationLimited, 1)
+			h.sendPacket(NewPacket(RST_PACKET, RST_FLAG, 0, 0, nil), from)
+			return
+		}
+	}
+
+	// The handler may have changed the response's priority
+	if conn != nil && request.ID != 0 {
+		conn.SetPriority(request.ID, request.Priority)
+	}
 
 	// Send HTTP response
-	h.sendHTTPResponse(response, from)
+	h.sendResponseData(responseData, response.file, from, request.ID)
+	h.server.logAccess(request, status, int64(response.length(responseData)))
+
+	// Message traffic may only start once the upgrade response is out
+	if request.upgraded != nil {
+		request.upgraded.finishUpgrade(upgradeAccepted)
+	}
 }
 
 // parseHTTPRequest parses HTTP request from binary data
@@ -346,16 +1063,67 @@ func (h *HTTPSocketHandler) parseHTTPRequest(data []byte) (*HTTPRequest, error)
 			request.Headers[name] = value
 		}
 	}
+	request.Priority = requestPriority(request)
 
 	return request, nil
 }
 
 // handleHTTPRequest handles parsed HTTP requests
-func (h *HTTPSocketHandler) handleHTTPRequest(request *HTTPRequest) *HTTPResponse {
+func (h *HTTPSocketHandler) handleHTTPRequest(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+	request.router, request.vhost = h.server.hostRouter(request)
+	cache := h.server.responseCache.Load()
+	if cache != nil {
+		if response, hit := cache.Get(request); hit {
+			_, request.route, _ = request.router.route(request.Path)
+			return h.encodeResponse(request, checkNotModified(request, response))
+		}
+	}
+
+	response := h.routeHTTPRequest(ctx, request)
+	tagResponse(request, response)
+	if cache != nil {
+		cache.Put(request, response)
+	}
+	return h.encodeResponse(request, checkNotModified(request, response))
+}
+
+// encodeResponse compresses a response if compression is enabled
+func (h *HTTPSocketHandler) encodeResponse(request *HTTPRequest, response *HTTPResponse) *HTTPResponse {
+	if encoder := h.server.encoder.Load(); encoder != nil {
+		encoder.encodeResponse(request, response)
+	}
+	return response
+}
+
+// routeHTTPRequest runs the registered or built-in handler for a request
+func (h *HTTPSocketHandler) routeHTTPRequest(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+	if route, pattern, exists := request.router.route(request.Path); exists {
+		request.route = pattern
+		if response := h.runHandler(ctx, route, request); response != nil {
+			if response.Headers == nil {
+				response.Headers = make(map[string]string)
+			}
+			return response
+		}
+	}
+
+	// Probes must work whichever host the load balancer names
+	if response := h.server.probeResponse(request.Path); response != nil {
+		return response
+	}
+
 	response := &HTTPResponse{
 		Headers: make(map[string]string),
 	}
 
+	// Virtual hosts serve only their own routes
+	if request.vhost != "" {
+		response.StatusCode = 404
+		response.Headers["Content-Type"] = "text/plain"
+		response.Body = []byte("404 Not Found")
+		return response
+	}
+
 	// Simple routing based on path
 	switch request.Path {
 	case "/":
@@ -379,7 +1147,13 @@ func (h *HTTPSocketHandler) handleHTTPRequest(request *HTTPRequest) *HTTPRespons
 	case "/stats":
 		response.StatusCode = 200
 		response.Headers["Content-Type"] = "application/json"
+		response.Headers["Cache-Control"] = "no-store"
 		stats := h.server.GetStats()
+		talkers := "" // peers' addresses, only if made public
+		if h.server.PeerInfoPublic() {
+			talkers = `,
+  "top_talkers": ` + formatTalkersJSON(h.server.TopTalkers(statsTopTalkers))
+		}
 		response.Body = []byte(fmt.Sprintf(`{
   "uptime_seconds": %.0f,
   "requests_received": %d,
@@ -387,7 +1161,17 @@ func (h *HTTPSocketHandler) handleHTTPRequest(request *HTTPRequest) *HTTPRespons
   "bytes_received": %d,
   "bytes_sent": %d,
   "errors": %d,
-  "requests_per_second": %.2f
+  "rate_limited": %d,
+  "amplification_limited": %d,
+  "handler_timeouts": %d,
+  "handler_panics": %d,
+  "socket_overflows": %d,
+  "accept_queue_full": %d,
+  "out_of_order_dropped": %d,
+  "handler_rejected": %d,
+  "requests_per_second": %.2f,
+  "event_loop": %s,
+  "routes": %s%s
 }`,
 			time.Since(stats.StartTime).Seconds(),
 			stats.RequestsReceived,
@@ -395,9 +1179,32 @@ func (h *HTTPSocketHandler) handleHTTPRequest(request *HTTPRequest) *HTTPRespons
 			stats.BytesReceived,
 			stats.BytesSent,
 			stats.Errors,
+			stats.RateLimited,
+			stats.AmplificationLimited,
+			stats.HandlerTimeouts,
+			stats.HandlerPanics,
+			stats.SocketOverflows,
+			stats.AcceptQueueFull,
+			stats.OutOfOrderDropped,
+			stats.HandlerRejected,
 			float64(stats.RequestsReceived)/time.Since(stats.StartTime).Seconds(),
+			formatLoopStatsJSON(h.server.EventLoopStats()),
+			formatRoutesJSON(h.server.RouteStats()),
+			talkers,
 		))
 
+	case "/connections":
+		if !h.server.PeerInfoPublic() {
+			response.StatusCode = 404
+			response.Headers["Content-Type"] = "text/plain"
+			response.Body = []byte("404 Not Found")
+			break
+		}
+		response.StatusCode = 200
+		response.Headers["Content-Type"] = "application/json"
+		response.Headers["Cache-Control"] = "no-store"
+		response.Body = []byte(formatConnectionsJSON(h.server.Connections()))
+
 	case "/benchmark":
 		response.StatusCode = 200
 		response.Headers["Content-Type"] = "text/plain"
@@ -412,85 +1219,351 @@ func (h *HTTPSocketHandler) handleHTTPRequest(request *HTTPRequest) *HTTPRespons
 	return response
 }
 
-// sendHTTPResponse sends HTTP response back to client
-func (h *HTTPSocketHandler) sendHTTPResponse(response *HTTPResponse, to SocketAddr) {
+// sendHTTPResponse sends HTTP response back to client, tagged with the
+// request ID it answers (0 if the request carried none)
+func (h *HTTPSocketHandler) sendHTTPResponse(response *HTTPResponse, to SocketAddr, requestID uint32) {
 	// Serialize HTTP response to binary format
-	responseData := h.serializeHTTPResponse(response)
+	h.sendResponseData(h.serializeHTTPResponse(response, false), response.file, to, requestID)
+}
 
-	// Create packet with response data
-	packet := NewPacket(DATA_PACKET, 0, h.server.reliability.GetNextSeqNum(), 0, responseData)
+// sendResponseData sends a serialized HTTP response followed by the file
+// body, if any. A response larger than one packet is split into fragments
+// that carry their offset, so the client can reassemble them in any order.
+func (h *HTTPSocketHandler) sendResponseData(responseData []byte, file *fileBody, to SocketAddr, requestID uint32) {
+	total := int64(len(responseData)) + file.size()
+	fragmented := total > MAX_PAYLOAD_SIZE
 
-	// Send packet
-	packetData := packet.Serialize()
-	_, err := h.server.socket.SendTo(packetData, to.IP, to.Port)
-	if err != nil {
-		atomic.AddUint64(&h.server.stats.Errors, 1)
+	conn := h.server.connections.Get(to)
+	if !fragmented && file == nil && h.coalesceResponse(conn, responseData, requestID) {
 		return
 	}
+	if conn != nil {
+		h.flushBatch(conn) // responses held earlier go first
+	}
 
-	// Track packet for reliability
-	h.server.reliability.SendPacket(packet)
+	var bytesSent uint64
+	for offset := int64(0); offset == 0 || offset < total; {
+		size := total - offset
+		if size > MAX_PAYLOAD_SIZE {
+			size = MAX_PAYLOAD_SIZE
+		}
+
+		// Header bytes are sliced in place; file bytes are read straight
+		// into the fragment's payload
+		var payload []byte
+		if offset+size <= int64(len(responseData)) {
+			payload = responseData[offset : offset+size]
+		} else {
+			payload = make([]byte, size)
+			n := 0
+			if offset < int64(len(responseData)) {
+				n = copy(payload, responseData[offset:])
+			}
+			if err := file.readAt(payload[n:], offset+int64(n)-int64(len(responseData))); err != nil {
+				logWarnf("Failed to read response body for %s:%d: %v", to.IP, to.Port, err)
+				atomic.AddUint64(&h.server.stats.Errors, 1)
+				return
+			}
+		}
+
+		var fragmentTotal uint32
+		if fragmented {
+			fragmentTotal = uint32(total)
+		}
+		sent, err := h.sendResponsePacket(payload, uint32(offset), fragmentTotal, conn, to, requestID)
+		if err != nil {
+			atomic.AddUint64(&h.server.stats.Errors, 1)
+			return
+		}
+		bytesSent += uint64(sent)
+		offset += size
+	}
 
 	// Update statistics
 	atomic.AddUint64(&h.server.stats.ResponsesSent, 1)
-	atomic.AddUint64(&h.server.stats.BytesSent, uint64(len(packetData)))
+	atomic.AddUint64(&h.server.stats.BytesSent, bytesSent)
+}
+
+// sendResponsePacket sends one packet of a response. A non-zero total
+// marks it as the fragment at offset of a multi-packet response.
+func (h *HTTPSocketHandler) sendResponsePacket(payload []byte, offset, total uint32, conn *Connection,
+	to SocketAddr, requestID uint32) (int, error) {
+	// Create packet with response data; it is numbered when sent
+	packet := NewPacket(DATA_PACKET, 0, 0, 0, payload)
+	if requestID != 0 {
+		packet.SetRequestID(requestID)
+	}
+	if total != 0 {
+		packet.SetFragment(offset, total)
+	}
+	return h.sendDataPacket(packet, offset == 0, conn, to)
 }
 
-// serializeHTTPResponse serializes HTTP response to binary data
-func (h *HTTPSocketHandler) serializeHTTPResponse(response *HTTPResponse) []byte {
-	// Build HTTP response string
-	var responseStr string
-	responseStr = fmt.Sprintf("HTTP/1.1 %d %s\r\n", response.StatusCode, getStatusText(response.StatusCode))
+// sendDataPacket sends a DATA packet carrying response bytes and tracks
+// it for retransmission. The packet starting a connection's first
+// response carries a resumption ticket. A packet the connection's
+// congestion window has no room for waits on the connection until ACKs
+// open it, as does one over the bandwidth limit until the pacer lets it
+// out.
+func (h *HTTPSocketHandler) sendDataPacket(packet *Packet, startsResponse bool, conn *Connection, to SocketAddr) (int, error) {
+	if startsResponse && conn != nil && atomic.CompareAndSwapInt32(&conn.ticketIssued, 0, 1) {
+		if ticket, err := h.server.tickets.Issue(to); err == nil {
+			packet.SetOption(OPT_SESSION_TICKET, ticket)
+		}
+	}
 
-	// Add headers
-	response.Headers["Server"] = "UltraFastServer/1.0"
-	response.Headers["Content-Length"] = fmt.Sprintf("%d", len(response.Body))
-	response.Headers["Connection"] = "close"
+	if conn != nil && conn.holdForWindow(packet, h.server.pacer.Load()) {
+		atomic.AddUint64(&h.server.stats.CongestionLimited, 1)
+		return packet.encodedSize(), nil
+	}
+	return h.transmitDataPacket(packet, conn, to)
+}
 
-	for name, value := range response.Headers {
-		responseStr += fmt.Sprintf("%s: %s\r\n", name, value)
+// transmitDataPacket numbers a DATA packet, tracks it for retransmission
+// and sends it. Numbering here keeps sequence numbers in sending order
+// when held packets leave out of order. Tracking comes first: a response
+// streamed from a handler goroutine can otherwise be acknowledged before
+// it is counted in flight, and the ACK would find nothing to open the
+// window with.
+func (h *HTTPSocketHandler) transmitDataPacket(packet *Packet, conn *Connection, to SocketAddr) (int, error) {
+	reliability := h.server.reliabilityFor(conn)
+	packet.SeqNum = reliability.GetNextSeqNum()
+	reliability.SendPacket(packet)
+	if conn != nil {
+		conn.TrackSent(packet.SeqNum, clockNow())
+		if paths := conn.paths.Load(); paths != nil {
+			window := int(conn.Reliability().GetStats().CongestionWindow)
+			return h.sendOnPath(paths.schedule(packet.SeqNum, window, clockNow()), packet, conn, to)
+		}
 	}
+	return h.sendPacket(packet, to)
+}
 
-	responseStr += "\r\n"
+// sendPacket serializes and sends a packet, updating per-connection
+// accounting. Packets to an unvalidated peer beyond the amplification
+// limit are held on the connection until the peer proves its address.
+// A connection with its own DSCP has its packets marked with it.
+func (h *HTTPSocketHandler) sendPacket(packet *Packet, to SocketAddr) (int, error) {
+	size := packet.encodedSize()
+	conn := h.server.connections.Get(to)
+	if conn != nil && conn.HoldUnvalidated(packet, size) {
+		atomic.AddUint64(&h.server.stats.AmplificationLimited, 1)
+		return size, nil
+	}
 
-	// Combine headers and body
-	result := make([]byte, len(responseStr)+len(response.Body))
-	copy(result, []byte(responseStr))
-	copy(result[len(responseStr):], response.Body)
+	if divert := h.server.divert.Load(); divert != nil {
+		(*divert)(packet, to)
+	} else if _, err := h.server.socket.SendPacketTOS(packet, to.IP, to.Port, conn.packetTOS(h.server.socket)); err != nil {
+		return 0, err
+	}
 
-	return result
+	h.server.capturePacket("out", packet, to)
+	h.server.pacer.Load().Charge(size)
+	if conn != nil {
+		conn.RecordOut(size)
+	}
+	return size, nil
+}
+
+// validateConnection lifts a connection's amplification limit and sends
+// whatever it held back
+func (h *HTTPSocketHandler) validateConnection(conn *Connection, peer SocketAddr) {
+	for _, packet := range conn.MarkValidated() {
+		if _, err := h.sendPacket(packet, peer); err != nil {
+			atomic.AddUint64(&h.server.stats.Errors, 1)
+		}
+	}
+}
+
+// serializeHTTPResponse serializes HTTP response to binary data. Unless
+// the handler set a Connection header, it says whether the connection
+// stays open.
+func (h *HTTPSocketHandler) serializeHTTPResponse(response *HTTPResponse, keepAlive bool) []byte {
+	// The payload outlives the writer (it is kept for retransmission), so
+	// the serialized bytes are copied out of the pooled buffer
+	if response.writer != nil {
+		response.writer.keepAlive = keepAlive
+		return append([]byte(nil), response.writer.Bytes()...)
+	}
+
+	w := acquireResponseWriter()
+	defer w.release()
+	w.keepAlive = keepAlive
+
+	w.WriteHeader(response.StatusCode)
+	for name, value := range response.Headers {
+		w.Header(name, value)
+	}
+	w.Write(response.Body)
+	if response.file != nil {
+		w.fileLength = response.file.length
+	}
+	return append([]byte(nil), w.Bytes()...)
 }
 
 // handleConnectionRequest handles SYN packets for connection establishment
 func (h *HTTPSocketHandler) handleConnectionRequest(packet *Packet, from SocketAddr) {
-	atomic.AddUint64(&h.server.stats.ConnectionsActive, 1)
+	// Refuse new connections while draining for shutdown
+	if h.server.IsDraining() {
+		rstPacket := NewPacket(RST_PACKET, RST_FLAG, 0, packet.SeqNum+1, nil)
+		h.sendPacket(rstPacket, from)
+		return
+	}
+	if h.server.connections.Get(from) == nil && !h.server.admitConnection() {
+		h.refuseConnection(packet, from)
+		return
+	}
+
+	// A SYN echoing a RETRY token has already proven its address
+	addressValidated := false
+	if token, hasToken := packet.GetOption(OPT_RETRY_TOKEN); hasToken {
+		if err := h.server.synCookies.ValidateRetryToken(from, token); err == nil {
+			addressValidated = true
+		} else {
+			logDebugf("Rejected retry token from %s:%d: %v", from.IP, from.Port, err)
+		}
+	}
 
-	// Send SYN+ACK response
-	synAckPacket := NewPacket(SYN_PACKET, SYN_FLAG|ACK_FLAG, 
-		h.server.reliability.GetNextSeqNum(), packet.SeqNum+1, nil)
-	synAckData := synAckPacket.Serialize()
-	h.server.socket.SendTo(synAckData, from.IP, from.Port)
+	// When address validation is required, anything else gets a RETRY:
+	// a small stateless token the client must echo in a new SYN. Tickets
+	// are not redeemed yet, so the client can still resume afterwards.
+	if h.server.RetryRequired() && !addressValidated {
+		retryPacket := NewPacket(RETRY_PACKET, 0, 0, packet.SeqNum+1, nil)
+		retryPacket.SetOption(OPT_RETRY_TOKEN, h.server.synCookies.RetryToken(from))
+		h.sendPacket(retryPacket, from)
+		return
+	}
+
+	// Authenticate before anything is committed: redeeming a ticket
+	// spends it, and a cookie admits the final ACK
+	if err := h.server.authenticateHandshake(packet, from); err != nil {
+		h.rejectHandshake(packet, from, err)
+		return
+	}
+
+	// A SYN carrying a valid session ticket resumes immediately and may
+	// carry the first request as 0-RTT data
+	if ticket, hasTicket := packet.GetOption(OPT_SESSION_TICKET); hasTicket {
+		if err := h.server.tickets.Redeem(ticket, from); err == nil {
+			h.resumeConnection(packet, from, addressValidated)
+			return
+		} else {
+			logDebugf("Rejected session ticket from %s:%d: %v", from.IP, from.Port, err)
+		}
+	}
+
+	// Send SYN+ACK carrying a cookie as its sequence number; no state is
+	// kept until the peer echoes the cookie back in the final ACK
+	cookie := h.server.synCookies.Generate(from, packet.SeqNum)
+	synAckPacket := NewPacket(SYN_PACKET, SYN_FLAG|ACK_FLAG, cookie, packet.SeqNum+1, nil)
+
+	// Offer a connection ID; it is derived from the secret rather than
+	// stored, so it can be recomputed when the final ACK arrives
+	synAckPacket.SetConnectionID(h.server.synCookies.ConnectionID(from, packet.SeqNum))
+	h.sendPacket(synAckPacket, from)
+}
+
+// resumeConnection establishes a connection from a redeemed ticket without
+// waiting for a handshake round trip, then serves any 0-RTT request. Until
+// the peer echoes its new connection ID, replies are capped by the
+// amplification limit unless the SYN carried a valid RETRY token.
+func (h *HTTPSocketHandler) resumeConnection(packet *Packet, from SocketAddr, addressValidated bool) {
+	conn, created := h.server.connections.GetOrCreate(from)
+	if created {
+		atomic.AddUint64(&h.server.stats.ConnectionsActive, 1)
+		h.seedReplayWindow(conn, packet)
+		conn.Reliability().acks.sync(packet.SeqNum + 1) // the SYN's own 0-RTT data is acked by the SYN-ACK
+		conn.handler.Store(h)
+		conn.RecordIn(int(packet.Length))
+		if !h.queueForAccept(conn, from) {
+			return
+		}
+	}
+	if addressValidated {
+		conn.MarkValidated()
+	}
+
+	var id uint64
+	for id == 0 {
+		id = randomUint64()
+	}
+	h.server.connections.AssignID(conn, id)
+
+	synAckPacket := NewPacket(SYN_PACKET, SYN_FLAG|ACK_FLAG,
+		conn.Reliability().nextUntrackedSeqNum(), packet.SeqNum+1, nil)
+	synAckPacket.SetConnectionID(id)
+	synAckPacket.SetOption(OPT_SESSION_TICKET, nil) // empty ticket: 0-RTT accepted
+	h.sendPacket(synAckPacket, from)
+
+	if created && !conn.pendingAcceptance() {
+		h.startConnection(conn)
+	}
+
+	if len(packet.Payload) > 0 {
+		if held, _ := conn.holdUntilAccepted(packet); held {
+			return
+		}
+		h.serveEarlyData(packet, from)
+	}
+}
+
+// handleHandshakeAck completes a handshake when an ACK from an unknown peer
+// carries a valid SYN cookie. It reports whether the packet was consumed.
+func (h *HTTPSocketHandler) handleHandshakeAck(packet *Packet, from SocketAddr) bool {
+	if h.server.connections.Get(from) != nil || len(packet.Payload) > 0 {
+		return false
+	}
+
+	// Final ACK: seq = client ISN + 1, ack = cookie + 1
+	if !h.server.synCookies.Validate(from, packet.SeqNum-1, packet.AckNum-1) {
+		return false
+	}
+
+	conn, created := h.server.connections.GetOrCreate(from)
+	if created {
+		atomic.AddUint64(&h.server.stats.ConnectionsActive, 1)
+		h.seedReplayWindow(conn, packet)
+		conn.Reliability().acks.sync(packet.SeqNum) // the final ACK carries the first DATA sequence number
+		conn.Reliability().startAt(packet.AckNum)   // and our DATA follows the cookie
+		conn.handler.Store(h)
+		if !h.queueForAccept(conn, from) {
+			return true
+		}
+	}
+	h.server.connections.AssignID(conn, h.server.synCookies.ConnectionID(from, packet.SeqNum-1))
+
+	// Echoing the cookie proves the peer received our SYN-ACK
+	conn.MarkValidated()
+	if created && !conn.pendingAcceptance() {
+		h.startConnection(conn)
+	}
+	return true
 }
 
 // handleConnectionClose handles FIN packets for connection termination
 func (h *HTTPSocketHandler) handleConnectionClose(packet *Packet, from SocketAddr) {
-	atomic.AddUint64(&h.server.stats.ConnectionsActive, ^uint64(0)) // Atomic decrement
+	// Held responses go out before the connection ends
+	conn := h.server.connections.Get(from)
+	if conn != nil {
+		h.flushBatch(conn)
+	}
 
 	// Send FIN+ACK response
 	finAckPacket := NewPacket(FIN_PACKET, FIN_FLAG|ACK_FLAG,
-		h.server.reliability.GetNextSeqNum(), packet.SeqNum+1, nil)
-	finAckData := finAckPacket.Serialize()
-	h.server.socket.SendTo(finAckData, from.IP, from.Port)
+		h.server.reliabilityFor(conn).nextUntrackedSeqNum(), packet.SeqNum+1, nil)
+	h.sendPacket(finAckPacket, from)
+
+	h.dropConnection(from)
 }
 
 // sendErrorResponse sends an HTTP error response
-func (h *HTTPSocketHandler) sendErrorResponse(to SocketAddr, statusCode int, message string) {
+func (h *HTTPSocketHandler) sendErrorResponse(to SocketAddr, statusCode int, message string, requestID uint32) {
 	response := &HTTPResponse{
 		StatusCode: statusCode,
 		Headers:    map[string]string{"Content-Type": "text/plain"},
 		Body:       []byte(message),
 	}
-	h.sendHTTPResponse(response, to)
+	h.sendHTTPResponse(response, to, requestID)
 }
 
 // OnWrite handles write events (not typically needed for UDP)
@@ -509,18 +1582,81 @@ func (h *HTTPSocketHandler) OnClose(fd int) {
 	log.Printf("Socket closed: fd %d", fd)
 }
 
+// formatConnectionsJSON renders the connection table for the /connections endpoint
+func formatConnectionsJSON(infos []ConnectionInfo) string {
+	var body strings.Builder
+	body.WriteString("[")
+	for i, info := range infos {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `
+  {
+    "peer": "%s:%d",
+    "established": "%s",
+    "idle_ms": %d,
+    "rtt_us": %d,
+    "cwnd": %d,
+    "unacked": %d,
+    "bytes_in_flight": %d,
+    "queued": %d,
+    "app_limited": %t,
+    "active_requests": %d,
+    "bytes_in": %d,
+    "bytes_out": %d
+  }`,
+			info.Peer.IP, info.Peer.Port,
+			info.Established.UTC().Format(time.RFC3339),
+			info.IdleTime.Milliseconds(),
+			info.RTT.Microseconds(),
+			info.CongestionWindow,
+			info.UnackedPackets,
+			info.BytesInFlight,
+			info.QueuedPackets,
+			info.AppLimited,
+			info.ActiveRequests,
+			info.BytesIn,
+			info.BytesOut)
+	}
+	if len(infos) > 0 {
+		body.WriteString("\n")
+	}
+	body.WriteString("]")
+	return body.String()
+}
+
 // Utility functions
 
 func getStatusText(code int) string {
 	switch code {
+	case 101:
+		return "Switching Protocols"
 	case 200:
 		return "OK"
+	case 206:
+		return "Partial Content"
+	case 304:
+		return "Not Modified"
 	case 400:
 		return "Bad Request"
+	case 403:
+		return "Forbidden"
 	case 404:
 		return "Not Found"
+	case 405:
+		return "Method Not Allowed"
+	case 408:
+		return "Request Timeout"
+	case 413:
+		return "Content Too Large"
+	case 416:
+		return "Range Not Satisfiable"
+	case 425:
+		return "Too Early"
 	case 500:
 		return "Internal Server Error"
+	case 503:
+		return "Service Unavailable"
 	default:
 		return "Unknown"
 	}
@@ -569,30 +1705,3 @@ func trimSpace(s string) string {
 	
 	return s[start:end]
 }
-
-// Main function to run the ultra-fast server
-func main() {
-	server, err := NewUltraFastHTTPServer("127.0.0.1", 8080)
-	if err != nil {
-		log.Fatalf("Failed to create server: %v", err)
-	}
-	defer server.Close()
-
-	log.Printf("Starting Ultra-Fast HTTP Server...")
-	log.Printf("Features:")
-	log.Printf("  - Raw Linux syscalls (no net package)")
-	log.Printf("  - Zero-copy operations with mmap/sendfile")
-	log.Printf("  - Epoll-based async I/O (10k+ concurrent connections)")
-	log.Printf("  - Lock-free reliability layer")
-	log.Printf("  - Custom binary protocol over UDP")
-	log.Printf("  - Target: <100μs latency, >1M requests/second")
-	log.Printf("")
-	log.Printf("Try:")
-	log.Printf("  curl http://127.0.0.1:8080/")
-	log.Printf("  curl http://127.0.0.1:8080/stats")
-	log.Printf("  curl http://127.0.0.1:8080/benchmark")
-
-	if err := server.Start(); err != nil {
-		log.Fatalf("Server error: %v", err)
-	}
-}
\ No newline at end of file
@@ -0,0 +1,287 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// upgradeReadyTimeout is how long the old process waits for the new one
+// to start serving before giving up on the upgrade and carrying on
+const upgradeReadyTimeout = 30 * time.Second
+
+// defaultUpgradeDrain is how long the old process may take to finish the
+// requests it was handling when the new one took over
+const defaultUpgradeDrain = 10 * time.Second
+
+// upgradeReady is sent by the new process once its event loop is running
+const upgradeReady = 'R'
+
+// upgradeHandover travels with the socket to the new process
+type upgradeHandover struct {
+	Stats ServerStats `json:"stats"`
+}
+
+// upgradeListener waits on a unix socket for a process to take over
+type upgradeListener struct {
+	path     string
+	fd       int
+	drain    time.Duration
+	mu       sync.Mutex
+	detached bool // the socket was handed over, or the listener closed
+	wg       sync.WaitGroup
+}
+
+// EnableUpgrade listens on a unix socket for a new server process to take
+// over without downtime. The new process calls InheritServer with the same
+// path and receives the UDP socket over SCM_RIGHTS, along with the stats
+// counters. Once the new process is serving, this one stops reading,
+// finishes the requests it is handling for up to drain, and stops, so
+// Start returns.
+//
+// Packets arriving after the handover reach the new process, which has no
+// record of the old connections: their requests are answered without a
+// connection, and clients reconnect as their connections go idle.
+//
+// Whoever connects is handed the server's socket, so the socket is created
+// mode 0600 in a directory only this user can enter, made mode 0700 if it
+// does not exist, and a process running as another user, root aside, is
+// refused.
+func (s *UltraFastHTTPServer) EnableUpgrade(path string, drain time.Duration) error {
+	if drain <= 0 {
+		drain = defaultUpgradeDrain
+	}
+	s.DisableUpgrade()
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to create upgrade socket: %v", err)
+	}
+
+	// A stale socket file, or the one of the process we replaced, is replaced
+	if err := bindPrivate(fd, path); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to bind upgrade socket %s: %v", path, err)
+	}
+	if err := unix.Listen(fd, 1); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to listen on upgrade socket: %v", err)
+	}
+
+	l := &upgradeListener{path: path, fd: fd, drain: drain}
+	s.upgrade = l
+	l.wg.Add(1)
+	go s.acceptUpgrade(l)
+	return nil
+}
+
+// DisableUpgrade stops listening for a new process and removes the
+// socket file, unless the server has already handed over
+func (s *UltraFastHTTPServer) DisableUpgrade() {
+	l := s.upgrade
+	if l == nil || !l.detach() {
+		return
+	}
+	unix.Unlink(l.path)
+}
+
+// detach closes the listener, reporting false if it was already closed
+func (l *upgradeListener) detach() bool {
+	l.mu.Lock()
+	if l.detached {
+		l.mu.Unlock()
+		return false
+	}
+	l.detached = true
+	l.mu.Unlock()
+
+	// Shutdown wakes the goroutine blocked in accept()
+	unix.Shutdown(l.fd, unix.SHUT_RDWR)
+	l.wg.Wait()
+	unix.Close(l.fd)
+	return true
+}
+
+// acceptUpgrade hands the server over to the first new process that
+// starts serving. A process that fails before then is dropped and the
+// server keeps running and listening.
+func (s *UltraFastHTTPServer) acceptUpgrade(l *upgradeListener) {
+	defer l.wg.Done()
+
+	for {
+		conn, _, err := unix.Accept4(l.fd, unix.SOCK_CLOEXEC)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			l.mu.Lock()
+			detached := l.detached
+			l.mu.Unlock()
+			if !detached {
+				logErrorf("Upgrade accept failed: %v", err)
+			}
+			return
+		}
+
+		if uid, err := peerUID(conn); err != nil || uid != os.Geteuid() && uid != 0 {
+			logWarnf("Upgrade refused: uid %d is neither the server's nor root", uid)
+			unix.Close(conn)
+			continue
+		}
+		err = s.handOver(conn)
+		unix.Close(conn)
+		if err != nil {
+			logErrorf("Upgrade failed, still serving: %v", err)
+			continue
+		}
+
+		// The new process owns the socket path now
+		l.mu.Lock()
+		l.detached = true
+		l.mu.Unlock()
+		unix.Close(l.fd)
+		go s.drainAfterUpgrade(l.drain)
+		return
+	}
+}
+
+// handOver sends the UDP socket and stats to a new process and waits for
+// it to start serving
+func (s *UltraFastHTTPServer) handOver(conn int) error {
+	stats := s.GetStats()
+	stats.ConnectionsActive = 0 // connections stay with this process
+	data, err := json.Marshal(upgradeHandover{Stats: *stats})
+	if err != nil {
+		return err
+	}
+	rights := unix.UnixRights(s.socket.GetFD())
+	if err := unix.Sendmsg(conn, data, rights, nil, 0); err != nil {
+		return fmt.Errorf("failed to send socket: %v", err)
+	}
+
+	timeout := unix.NsecToTimeval(upgradeReadyTimeout.Nanoseconds())
+	unix.SetsockoptTimeval(conn, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout)
+	var ack [1]byte
+	n, err := unix.Read(conn, ack[:])
+	if err != nil {
+		return fmt.Errorf("no word from the new process: %v", err)
+	}
+	if n != 1 || ack[0] != upgradeReady {
+		return fmt.Errorf("new process exited before serving")
+	}
+	return nil
+}
+
+// drainAfterUpgrade stops reading the handed-over socket, lets running
+// requests finish for up to timeout, then stops the server
+func (s *UltraFastHTTPServer) drainAfterUpgrade(timeout time.Duration) {
+	atomic.StoreInt32(&s.draining, 1)
+	logInfof("Handed over to a new process; draining for up to %v", timeout)
+
+	if s.admin != nil {
+		s.admin.detach()
+	}
+	s.eventLoop.Submit(func() {
+		s.eventLoop.RemoveSocket(s.socket.GetFD())
+	})
+
+	deadline := time.Now().Add(timeout)
+	for s.activeRequests() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Stop()
+}
+
+// InheritServer takes over from a running server that called
+// EnableUpgrade on path, receiving its bound UDP socket and stats. The old
+// server keeps serving until this one's Start has its event loop running.
+func InheritServer(path string) (*UltraFastHTTPServer, error) {
+	conn, err := unix.Socket(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upgrade socket: %v", err)
+	}
+	if err := unix.Connect(conn, &unix.SockaddrUnix{Name: path}); err != nil {
+		unix.Close(conn)
+		return nil, fmt.Errorf("no server to take over at %s: %v", path, err)
+	}
+
+	data := make([]byte, 4096)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := unix.Recvmsg(conn, data, oob, unix.MSG_CMSG_CLOEXEC)
+	if err != nil {
+		unix.Close(conn)
+		return nil, fmt.Errorf("failed to receive socket: %v", err)
+	}
+	fd, err := parseInheritedFD(oob[:oobn])
+	if err != nil {
+		unix.Close(conn)
+		return nil, err
+	}
+
+	var handover upgradeHandover
+	if err := json.Unmarshal(data[:n], &handover); err != nil {
+		unix.Close(fd)
+		unix.Close(conn)
+		return nil, fmt.Errorf("invalid upgrade handover: %v", err)
+	}
+
+	socket, err := newLinuxUDPSocketFromFD(fd)
+	if err != nil {
+		unix.Close(fd)
+		unix.Close(conn)
+		return nil, err
+	}
+	server, err := newServerWithSocket(socket)
+	if err != nil {
+		unix.Close(conn)
+		return nil, err
+	}
+	*server.stats = handover.Stats
+	server.upgradeConn = conn
+	return server, nil
+}
+
+// parseInheritedFD extracts the single descriptor passed with SCM_RIGHTS
+func parseInheritedFD(oob []byte) (int, error) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil || len(messages) != 1 {
+		return -1, fmt.Errorf("no socket in upgrade handover")
+	}
+	fds, err := unix.ParseUnixRights(&messages[0])
+	if err != nil || len(fds) == 0 {
+		return -1, fmt.Errorf("no socket in upgrade handover")
+	}
+	for _, extra := range fds[1:] {
+		unix.Close(extra)
+	}
+	return fds[0], nil
+}
+
+// finishInherit tells the old process this one is serving, so it can
+// stop reading and drain. It runs on the event loop once it starts.
+func (s *UltraFastHTTPServer) finishInherit() {
+	if s.upgradeConn < 0 {
+		return
+	}
+	if _, err := unix.Write(s.upgradeConn, []byte{upgradeReady}); err != nil {
+		logErrorf("Failed to signal the old process: %v", err)
+	}
+	unix.Close(s.upgradeConn)
+	s.upgradeConn = -1
+	logInfof("Took over from the previous process")
+}
+
+// abandonInherit hangs up on the old process when this server closes
+// without having started serving, so the old one carries on
+func (s *UltraFastHTTPServer) abandonInherit() {
+	if s.upgradeConn >= 0 {
+		unix.Close(s.upgradeConn)
+		s.upgradeConn = -1
+	}
+}
@@ -0,0 +1,86 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestServerLiveUpgrade(t *testing.T) {
+	text := func(body string) RequestHandler {
+		return func(ctx context.Context, r *HTTPRequest) *HTTPResponse {
+			return &HTTPResponse{StatusCode: 200, Headers: map[string]string{}, Body: []byte(body)}
+		}
+	}
+	path := filepath.Join(t.TempDir(), "run", "upgrade.sock")
+
+	old := startTestServer(t)
+	old.HandleFunc("/who", text("old"))
+	if err := old.EnableUpgrade(path, 100*time.Millisecond); err != nil {
+		t.Fatalf("EnableUpgrade failed: %v", err)
+	}
+	client := newTestClient(t, old)
+	if response, err := client.Get("/who"); err != nil || !containsString(string(response), "old") {
+		t.Fatalf("Expected the old server, got %q, %v", response, err)
+	}
+	handedOver := old.GetStats().RequestsReceived
+
+	next, err := InheritServer(path)
+	if err != nil {
+		t.Fatalf("InheritServer failed: %v", err)
+	}
+	t.Cleanup(func() { next.Close() })
+	next.HandleFunc("/who", text("new"))
+	if next.socket.GetLocalAddr() != old.socket.GetLocalAddr() {
+		t.Errorf("Expected the inherited socket on %v, got %v",
+			old.socket.GetLocalAddr(), next.socket.GetLocalAddr())
+	}
+	if next.GetStats().RequestsReceived < handedOver {
+		t.Errorf("Expected at least %d requests carried over, got %d",
+			handedOver, next.GetStats().RequestsReceived)
+	}
+	go next.Start()
+
+	// The old server drains and stops once the new one is serving
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt32(&old.loopRunning) == 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&old.loopRunning) == 1 || !old.IsDraining() {
+		t.Fatal("Old server should stop after handing over")
+	}
+
+	fresh := newTestClient(t, next)
+	if response, err := fresh.Get("/who"); err != nil || !containsString(string(response), "new") {
+		t.Errorf("Expected the new server on the same address, got %q, %v", response, err)
+	}
+}
+
+func TestServerUpgradeRefusesOtherUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "upgrade.sock")
+	server := startTestServer(t)
+	if err := server.EnableUpgrade(path, 0); err != nil {
+		t.Fatalf("EnableUpgrade failed: %v", err)
+	}
+	exposeSocket(t, path)
+
+	fd := dialUnixAs(t, nobodyUID, unix.SOCK_SEQPACKET, path)
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := unix.Recvmsg(fd, make([]byte, 4096), oob, unix.MSG_CMSG_CLOEXEC)
+	if n > 0 || oobn > 0 {
+		t.Fatalf("Expected a process of another user refused, got %d bytes and %d of control data (%v)", n, oobn, err)
+	}
+
+	server.upgrade.mu.Lock()
+	detached := server.upgrade.detached
+	server.upgrade.mu.Unlock()
+	if detached {
+		t.Error("Expected the server still waiting for a process to take over")
+	}
+}
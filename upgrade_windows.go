@@ -0,0 +1,29 @@
+package ultrafast
+
+import (
+	"fmt"
+	"time"
+)
+
+// upgradeListener is never created on Windows, which cannot pass a
+// socket to another process the way SCM_RIGHTS does
+type upgradeListener struct{}
+
+// EnableUpgrade is not supported on Windows
+func (s *UltraFastHTTPServer) EnableUpgrade(path string, drain time.Duration) error {
+	return fmt.Errorf("live upgrade is not supported on windows")
+}
+
+// DisableUpgrade does nothing on Windows
+func (s *UltraFastHTTPServer) DisableUpgrade() {}
+
+// InheritServer is not supported on Windows
+func InheritServer(path string) (*UltraFastHTTPServer, error) {
+	return nil, fmt.Errorf("live upgrade is not supported on windows")
+}
+
+// finishInherit does nothing on Windows; no server is ever inherited
+func (s *UltraFastHTTPServer) finishInherit() {}
+
+// abandonInherit does nothing on Windows; no server is ever inherited
+func (s *UltraFastHTTPServer) abandonInherit() {}
@@ -0,0 +1,21 @@
+package ultrafast
+
+// Scatter/gather sizes. A PacketReader accepts datagrams as large as the
+// receive buffers used elsewhere, and carves packet bodies from slabs big
+// enough for several of those.
+const (
+	maxDatagramSize = 64 * 1024
+	recvSlabSize    = 4 * maxDatagramSize
+)
+
+// ReadPacket receives and decodes one packet, checking its checksum as the
+// socket's mode says. Its payload shares the body ReadDatagram returned
+// rather than being copied out of it.
+func (r *PacketReader) ReadPacket() (*Packet, SocketAddr, error) {
+	header, body, from, err := r.ReadDatagram()
+	if err != nil {
+		return nil, from, err
+	}
+	packet, err := decodePacket(header, body, r.socket.checksumsFor(from))
+	return packet, from, err
+}
@@ -0,0 +1,176 @@
+package ultrafast
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// packetWriter holds what one sendmsg needs. Writers are pooled so
+// sending allocates nothing per packet.
+type packetWriter struct {
+	header  []byte
+	iov     [2]unix.Iovec
+	name    unix.RawSockaddrInet4
+	msg     unix.Msghdr
+	control []byte // an IP_TOS control message, for SendPacketTOS
+}
+
+var packetWriterPool = sync.Pool{
+	New: func() any {
+		return &packetWriter{header: make([]byte, 0, 256), control: make([]byte, unix.CmsgSpace(4))}
+	},
+}
+
+// SendPacket sends a packet without serializing it into one buffer: the
+// header and options are encoded into a pooled buffer and sendmsg gathers
+// them with the payload straight from the packet. It returns the number
+// of bytes sent.
+func (s *LinuxUDPSocket) SendPacket(packet *Packet, ip string, port uint16) (int, error) {
+	return s.SendPacketTOS(packet, ip, port, -1)
+}
+
+// SendPacketTOS is SendPacket marking the datagram with the TOS byte tos
+// in place of the socket's, through an IP_TOS control message. A
+// negative tos leaves the socket's marking.
+func (s *LinuxUDPSocket) SendPacketTOS(packet *Packet, ip string, port uint16, tos int) (int, error) {
+	ipBytes := parseIPv4(ip)
+	if ipBytes == nil {
+		return 0, fmt.Errorf("invalid IP address: %s", ip)
+	}
+
+	w := packetWriterPool.Get().(*packetWriter)
+	defer packetWriterPool.Put(w)
+	s.signPacket(packet)
+	w.header = packet.encodeHeader(w.header[:0], s.checksumsFor(SocketAddr{IP: ip, Port: port}))
+	w.name = unix.RawSockaddrInet4{
+		Family: unix.AF_INET,
+		Port:   htons(port),
+		Addr:   [4]byte{ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3]},
+	}
+
+	w.iov[0].Base = &w.header[0]
+	w.iov[0].SetLen(len(w.header))
+	w.msg = unix.Msghdr{
+		Name:    (*byte)(unsafe.Pointer(&w.name)),
+		Namelen: unix.SizeofSockaddrInet4,
+		Iov:     &w.iov[0],
+		Iovlen:  1,
+	}
+	if len(packet.Payload) > 0 {
+		w.iov[1].Base = &packet.Payload[0]
+		w.iov[1].SetLen(len(packet.Payload))
+		w.msg.Iovlen = 2
+	}
+	if tos >= 0 {
+		cmsg := (*unix.Cmsghdr)(unsafe.Pointer(&w.control[0]))
+		cmsg.Level = unix.IPPROTO_IP
+		cmsg.Type = unix.IP_TOS
+		cmsg.SetLen(unix.CmsgLen(4))
+		*(*int32)(unsafe.Pointer(&w.control[unix.CmsgLen(0)])) = int32(tos)
+		w.msg.Control = &w.control[0]
+		w.msg.SetControllen(len(w.control))
+	}
+
+	if err := s.applyDeadline(soSndTimeo, &s.writeDeadline, &s.sendTimeout); err != nil {
+		return 0, err
+	}
+	n, err := sendmsg(s.sock(), &w.msg, 0)
+	w.iov[1].Base = nil // don't keep the payload alive from the pool
+	if err != nil {
+		if s.deadlinePassed(&s.writeDeadline, err) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return 0, &SocketError{Op: "sendmsg", Err: err}
+	}
+	return n, nil
+}
+
+// PacketReader receives datagrams with recvmsg, scattering each into a
+// fixed header buffer the reader reuses and a body carved from a slab.
+// Bodies are never reused, so packets decoded from them keep their
+// payloads without copying; a slab is freed once no packet refers to it.
+// A reader is not safe for concurrent use.
+type PacketReader struct {
+	socket  *LinuxUDPSocket
+	header  [PACKET_HEADER_SIZE]byte
+	slab    []byte
+	iov     [2]unix.Iovec
+	name    unix.RawSockaddrInet4
+	control [rxqOverflowControlSize]byte
+	msg     unix.Msghdr
+}
+
+// NewPacketReader creates a reader for socket
+func NewPacketReader(socket *LinuxUDPSocket) *PacketReader {
+	r := &PacketReader{socket: socket}
+	r.iov[0].Base = &r.header[0]
+	r.iov[0].SetLen(PACKET_HEADER_SIZE)
+	return r
+}
+
+// ReadDatagram receives one datagram. header is the reader's own buffer,
+// valid until the next call, and is shorter than PACKET_HEADER_SIZE only
+// for runt datagrams; body holds the rest and belongs to the caller.
+func (r *PacketReader) ReadDatagram() (header, body []byte, from SocketAddr, err error) {
+	s := r.socket
+	bodySize := maxDatagramSize - PACKET_HEADER_SIZE
+	if len(r.slab) < bodySize {
+		r.slab = make([]byte, recvSlabSize)
+	}
+
+	r.iov[1].Base = &r.slab[0]
+	r.iov[1].SetLen(bodySize)
+	r.msg = unix.Msghdr{
+		Name:    (*byte)(unsafe.Pointer(&r.name)),
+		Namelen: unix.SizeofSockaddrInet4,
+		Iov:     &r.iov[0],
+		Iovlen:  2,
+		Control: &r.control[0],
+	}
+	r.msg.SetControllen(len(r.control))
+
+	if err := s.applyDeadline(soRcvTimeo, &s.readDeadline, &s.recvTimeout); err != nil {
+		return nil, nil, SocketAddr{}, err
+	}
+	n, err := recvmsg(s.sock(), &r.msg, 0)
+	if err != nil {
+		if s.deadlinePassed(&s.readDeadline, err) {
+			return nil, nil, SocketAddr{}, os.ErrDeadlineExceeded
+		}
+		return nil, nil, SocketAddr{}, &SocketError{Op: "recvmsg", Err: err}
+	}
+	if r.msg.Controllen > 0 {
+		s.noteOverflows(r.control[:r.msg.Controllen])
+	}
+	if r.msg.Flags&unix.MSG_TRUNC != 0 {
+		return nil, nil, SocketAddr{}, packetErrorf(ErrMalformed, "datagram larger than %d bytes", maxDatagramSize)
+	}
+
+	from = SocketAddr{
+		IP:   fmt.Sprintf("%d.%d.%d.%d", r.name.Addr[0], r.name.Addr[1], r.name.Addr[2], r.name.Addr[3]),
+		Port: ntohs(r.name.Port),
+	}
+	if n <= PACKET_HEADER_SIZE {
+		return r.header[:n], nil, from, nil
+	}
+	bodyLen := n - PACKET_HEADER_SIZE
+	body = r.slab[:bodyLen:bodyLen]
+	r.slab = r.slab[bodyLen:]
+	return r.header[:], body, from, nil
+}
+
+// recvmsg wrapper for scatter reads
+func recvmsg(fd int, msg *unix.Msghdr, flags int) (int, error) {
+	r1, _, errno := unix.Syscall(unix.SYS_RECVMSG,
+		uintptr(fd),
+		uintptr(unsafe.Pointer(msg)),
+		uintptr(flags))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r1), nil
+}
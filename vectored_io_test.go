@@ -0,0 +1,111 @@
+package ultrafast
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestChecksumPartsMatchesJoined(t *testing.T) {
+	data := []byte("options and payload split at awkward places")
+	header := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+	want := calculateChecksum(header, data)
+	for _, split := range [][]int{{0}, {1}, {3, 5}, {2, 3, 4}, {7, 20, 21, 40}} {
+		var parts [][]byte
+		last := 0
+		for _, at := range split {
+			parts = append(parts, data[last:at])
+			last = at
+		}
+		parts = append(parts, data[last:])
+		if got := checksumParts(header, parts...); got != want {
+			t.Errorf("Split at %v: expected 0x%08X, got 0x%08X", split, want, got)
+		}
+	}
+}
+
+func TestEncodeHeaderMatchesSerialize(t *testing.T) {
+	packet := NewPacket(DATA_PACKET, ACK_FLAG, 7, 3, []byte("payload"))
+	packet.SetRequestID(42) // 6 bytes of options plus OPT_END leave the payload unaligned
+	serialized := packet.Serialize()
+
+	header := packet.encodeHeader(nil, true)
+	joined := append(header, packet.Payload...)
+	if !bytes.Equal(joined, serialized) {
+		t.Fatalf("Header and payload should join to the serialized packet:\n%x\n%x", joined, serialized)
+	}
+}
+
+func TestPacketReaderRoundTrip(t *testing.T) {
+	receiver := newBoundSocket(t)
+	sender := newBoundSocket(t)
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	addr := receiver.GetLocalAddr()
+
+	reader := NewPacketReader(receiver)
+	var received []*Packet
+	for _, payload := range []string{"first", "second"} {
+		packet := NewPacket(DATA_PACKET, 0, 1, 0, []byte(payload))
+		packet.SetRequestID(9)
+		if n, err := sender.SendPacket(packet, addr.IP, addr.Port); err != nil || n != int(packet.Length) {
+			t.Fatalf("SendPacket failed: sent %d of %d, %v", n, packet.Length, err)
+		}
+
+		got, from, err := reader.ReadPacket()
+		if err != nil {
+			t.Fatalf("ReadPacket failed: %v", err)
+		}
+		if from != sender.GetLocalAddr() {
+			t.Errorf("Expected the packet from %v, got %v", sender.GetLocalAddr(), from)
+		}
+		if id, _ := got.RequestID(); id != 9 || string(got.Payload) != payload {
+			t.Errorf("Expected request 9 with %q, got %d with %q", payload, id, got.Payload)
+		}
+		received = append(received, got)
+	}
+
+	// Each body has its own place in the slab, so later reads leave
+	// earlier payloads intact
+	if string(received[0].Payload) != "first" {
+		t.Errorf("First payload was overwritten: %q", received[0].Payload)
+	}
+}
+
+func BenchmarkSendSerialized(b *testing.B) {
+	socket, addr := benchmarkSockets(b)
+	packet := NewPacket(DATA_PACKET, 0, 1, 0, make([]byte, MAX_PAYLOAD_SIZE))
+	b.SetBytes(MAX_PACKET_SIZE)
+	for i := 0; i < b.N; i++ {
+		socket.SendTo(packet.Serialize(), addr.IP, addr.Port)
+	}
+}
+
+func BenchmarkSendVectored(b *testing.B) {
+	socket, addr := benchmarkSockets(b)
+	packet := NewPacket(DATA_PACKET, 0, 1, 0, make([]byte, MAX_PAYLOAD_SIZE))
+	b.SetBytes(MAX_PACKET_SIZE)
+	for i := 0; i < b.N; i++ {
+		socket.SendPacket(packet, addr.IP, addr.Port)
+	}
+}
+
+// benchmarkSockets returns a sender and the address of a receiver that
+// discards what it gets, so the benchmark measures the send path only
+func benchmarkSockets(b *testing.B) (*LinuxUDPSocket, SocketAddr) {
+	sender, err := NewLinuxUDPSocket()
+	if err != nil {
+		b.Fatalf("Failed to create socket: %v", err)
+	}
+	receiver, err := NewLinuxUDPSocket()
+	if err != nil {
+		b.Fatalf("Failed to create socket: %v", err)
+	}
+	b.Cleanup(func() {
+		sender.Close()
+		receiver.Close()
+	})
+	if err := receiver.Bind("127.0.0.1", 0); err != nil {
+		b.Fatalf("Failed to bind: %v", err)
+	}
+	return sender, receiver.GetLocalAddr()
+}
@@ -0,0 +1,131 @@
+package ultrafast
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// packetWriter holds what one WSASendTo needs. Writers are pooled so
+// sending allocates nothing per packet.
+type packetWriter struct {
+	header []byte
+	bufs   [2]syscall.WSABuf
+	name   syscall.SockaddrInet4
+}
+
+var packetWriterPool = sync.Pool{
+	New: func() any { return &packetWriter{header: make([]byte, 0, 256)} },
+}
+
+// SendPacket sends a packet without serializing it into one buffer: the
+// header and options are encoded into a pooled buffer and WSASendTo
+// gathers them with the payload straight from the packet. It returns the
+// number of bytes sent.
+func (s *LinuxUDPSocket) SendPacket(packet *Packet, ip string, port uint16) (int, error) {
+	ipBytes := parseIPv4(ip)
+	if ipBytes == nil {
+		return 0, fmt.Errorf("invalid IP address: %s", ip)
+	}
+
+	w := packetWriterPool.Get().(*packetWriter)
+	defer packetWriterPool.Put(w)
+	s.signPacket(packet)
+	w.header = packet.encodeHeader(w.header[:0], s.checksumsFor(SocketAddr{IP: ip, Port: port}))
+	w.name = syscall.SockaddrInet4{
+		Port: int(port),
+		Addr: [4]byte{ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3]},
+	}
+
+	w.bufs[0] = syscall.WSABuf{Len: uint32(len(w.header)), Buf: &w.header[0]}
+	count := uint32(1)
+	if len(packet.Payload) > 0 {
+		w.bufs[1] = syscall.WSABuf{Len: uint32(len(packet.Payload)), Buf: &packet.Payload[0]}
+		count = 2
+	}
+
+	if err := s.applyDeadline(soSndTimeo, &s.writeDeadline, &s.sendTimeout); err != nil {
+		return 0, err
+	}
+	var sent uint32
+	err := syscall.WSASendto(s.sock(), &w.bufs[0], count, &sent, 0, &w.name, nil, nil)
+	w.bufs[1].Buf = nil // don't keep the payload alive from the pool
+	if err != nil {
+		err = wsaError(err)
+		if s.deadlinePassed(&s.writeDeadline, err) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return 0, &SocketError{Op: "WSASendTo", Err: err}
+	}
+	return int(sent), nil
+}
+
+// SendPacketTOS is SendPacket; Winsock has no per-datagram TOS, so the
+// socket's marking applies whatever tos asks for
+func (s *LinuxUDPSocket) SendPacketTOS(packet *Packet, ip string, port uint16, tos int) (int, error) {
+	return s.SendPacket(packet, ip, port)
+}
+
+// PacketReader receives datagrams with WSARecvFrom, scattering each into
+// a fixed header buffer the reader reuses and a body carved from a slab.
+// Bodies are never reused, so packets decoded from them keep their
+// payloads without copying; a slab is freed once no packet refers to it.
+// A reader is not safe for concurrent use.
+type PacketReader struct {
+	socket *LinuxUDPSocket
+	header [PACKET_HEADER_SIZE]byte
+	slab   []byte
+	bufs   [2]syscall.WSABuf
+	name   syscall.RawSockaddrAny
+}
+
+// NewPacketReader creates a reader for socket
+func NewPacketReader(socket *LinuxUDPSocket) *PacketReader {
+	r := &PacketReader{socket: socket}
+	r.bufs[0] = syscall.WSABuf{Len: PACKET_HEADER_SIZE, Buf: &r.header[0]}
+	return r
+}
+
+// ReadDatagram receives one datagram. header is the reader's own buffer,
+// valid until the next call, and is shorter than PACKET_HEADER_SIZE only
+// for runt datagrams; body holds the rest and belongs to the caller.
+func (r *PacketReader) ReadDatagram() (header, body []byte, from SocketAddr, err error) {
+	s := r.socket
+	bodySize := maxDatagramSize - PACKET_HEADER_SIZE
+	if len(r.slab) < bodySize {
+		r.slab = make([]byte, recvSlabSize)
+	}
+	r.bufs[1] = syscall.WSABuf{Len: uint32(bodySize), Buf: &r.slab[0]}
+
+	if err := s.applyDeadline(soRcvTimeo, &s.readDeadline, &s.recvTimeout); err != nil {
+		return nil, nil, SocketAddr{}, err
+	}
+	nameLen := int32(unsafe.Sizeof(r.name))
+	var received, flags uint32
+	if err := syscall.WSARecvFrom(s.sock(), &r.bufs[0], 2, &received, &flags, &r.name, &nameLen, nil, nil); err != nil {
+		if err == wsaEMSGSIZE {
+			return nil, nil, SocketAddr{}, packetErrorf(ErrMalformed, "datagram larger than %d bytes", maxDatagramSize)
+		}
+		err = wsaError(err)
+		if s.deadlinePassed(&s.readDeadline, err) {
+			return nil, nil, SocketAddr{}, os.ErrDeadlineExceeded
+		}
+		return nil, nil, SocketAddr{}, &SocketError{Op: "WSARecvFrom", Err: err}
+	}
+
+	if sa, err := r.name.Sockaddr(); err == nil {
+		if inet4, ok := sa.(*syscall.SockaddrInet4); ok {
+			from = inet4Addr(inet4)
+		}
+	}
+	n := int(received)
+	if n <= PACKET_HEADER_SIZE {
+		return r.header[:n], nil, from, nil
+	}
+	bodyLen := n - PACKET_HEADER_SIZE
+	body = r.slab[:bodyLen:bodyLen]
+	r.slab = r.slab[bodyLen:]
+	return r.header[:], body, from, nil
+}
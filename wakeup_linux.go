@@ -0,0 +1,36 @@
+package ultrafast
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// newWakeFD creates a non-blocking eventfd that becomes readable once
+// signaled, for waking an event loop from other goroutines
+func newWakeFD() (int, error) {
+	fd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create eventfd: %v", err)
+	}
+	return fd, nil
+}
+
+// signalWakeFD makes the descriptor readable
+func signalWakeFD(fd int) {
+	var one [8]byte
+	binary.LittleEndian.PutUint64(one[:], 1)
+	unix.Write(fd, one[:])
+}
+
+// clearWakeFD consumes every signal so the descriptor is not readable
+func clearWakeFD(fd int) {
+	var counter [8]byte
+	unix.Read(fd, counter[:])
+}
+
+// closeWakeFD releases the descriptor
+func closeWakeFD(fd int) error {
+	return unix.Close(fd)
+}
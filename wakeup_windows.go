@@ -0,0 +1,56 @@
+package ultrafast
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// newWakeFD creates a non-blocking loopback UDP socket connected to
+// itself, for waking an event loop from other goroutines: Windows has no
+// eventfd, and WSAPoll only watches sockets
+func newWakeFD() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return -1, fmt.Errorf("failed to create wakeup socket: %v", err)
+	}
+	socket := wrapSocketFD(fd)
+	if err := socket.Bind("127.0.0.1", 0); err != nil {
+		socket.Close()
+		return -1, err
+	}
+	addr := socket.GetLocalAddr()
+	if err := syscall.Connect(fd, &syscall.SockaddrInet4{Port: int(addr.Port), Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		socket.Close()
+		return -1, fmt.Errorf("failed to connect wakeup socket: %v", err)
+	}
+	if err := socket.SetNonBlocking(true); err != nil {
+		socket.Close()
+		return -1, err
+	}
+	return int(fd), nil
+}
+
+// signalWakeFD makes the socket readable
+func signalWakeFD(fd int) {
+	var one [1]byte
+	buf := syscall.WSABuf{Len: 1, Buf: &one[0]}
+	var sent uint32
+	syscall.WSASend(syscall.Handle(fd), &buf, 1, &sent, 0, nil, nil)
+}
+
+// clearWakeFD consumes every signal so the socket is not readable
+func clearWakeFD(fd int) {
+	var data [16]byte
+	buf := syscall.WSABuf{Len: uint32(len(data)), Buf: &data[0]}
+	for {
+		var received, flags uint32
+		if err := syscall.WSARecv(syscall.Handle(fd), &buf, 1, &received, &flags, nil, nil); err != nil {
+			return
+		}
+	}
+}
+
+// closeWakeFD releases the socket
+func closeWakeFD(fd int) error {
+	return syscall.Closesocket(syscall.Handle(fd))
+}
@@ -0,0 +1,188 @@
+package ultrafast
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// PoolOverflowPolicy selects what happens to a job when the queue is full
+type PoolOverflowPolicy int
+
+const (
+	POOL_OVERFLOW_REJECT PoolOverflowPolicy = iota // Refuse the job; the server answers 503
+	POOL_OVERFLOW_INLINE                           // Run the job on the submitting goroutine
+	POOL_OVERFLOW_BLOCK                            // Wait for space in the queue
+)
+
+// ParsePoolOverflowPolicy converts a policy name into a PoolOverflowPolicy
+func ParsePoolOverflowPolicy(name string) (PoolOverflowPolicy, error) {
+	switch name {
+	case "reject":
+		return POOL_OVERFLOW_REJECT, nil
+	case "inline":
+		return POOL_OVERFLOW_INLINE, nil
+	case "block":
+		return POOL_OVERFLOW_BLOCK, nil
+	default:
+		return POOL_OVERFLOW_REJECT, fmt.Errorf("unknown overflow policy: %s", name)
+	}
+}
+
+// String returns the policy name
+func (p PoolOverflowPolicy) String() string {
+	switch p {
+	case POOL_OVERFLOW_REJECT:
+		return "reject"
+	case POOL_OVERFLOW_INLINE:
+		return "inline"
+	case POOL_OVERFLOW_BLOCK:
+		return "block"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(p))
+	}
+}
+
+// WorkerPoolConfig sizes a worker pool. Zero values take the defaults.
+type WorkerPoolConfig struct {
+	Workers     int // default: 4 per CPU
+	QueueLength int // default: 1024
+	Overflow    PoolOverflowPolicy
+}
+
+// WorkerPoolStats is a snapshot of pool activity
+type WorkerPoolStats struct {
+	Workers  int
+	Busy     int64
+	Queued   int
+	Rejected uint64
+}
+
+// WorkerPool runs jobs on a fixed set of goroutines fed by a bounded
+// queue, keeping slow request handlers off the event loop
+type WorkerPool struct {
+	config WorkerPoolConfig
+	jobs   chan func()
+	wg     sync.WaitGroup
+
+	mu     sync.RWMutex // guards closed against concurrent Submit
+	closed bool
+
+	busy     int64  // atomic
+	rejected uint64 // atomic
+}
+
+// NewWorkerPool starts a pool's workers
+func NewWorkerPool(config WorkerPoolConfig) *WorkerPool {
+	if config.Workers <= 0 {
+		config.Workers = 4 * runtime.NumCPU()
+	}
+	if config.QueueLength <= 0 {
+		config.QueueLength = 1024
+	}
+
+	pool := &WorkerPool{
+		config: config,
+		jobs:   make(chan func(), config.QueueLength),
+	}
+	for i := 0; i < config.Workers; i++ {
+		pool.wg.Add(1)
+		go pool.worker()
+	}
+	return pool
+}
+
+// worker runs queued jobs until the pool is closed
+func (p *WorkerPool) worker() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		atomic.AddInt64(&p.busy, 1)
+		job()
+		atomic.AddInt64(&p.busy, -1)
+	}
+}
+
+// Submit queues a job. When the queue is full the overflow policy
+// decides; Submit reports false only if the job was rejected.
+func (p *WorkerPool) Submit(job func()) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		atomic.AddUint64(&p.rejected, 1)
+		return false
+	}
+
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+	}
+
+	switch p.config.Overflow {
+	case POOL_OVERFLOW_INLINE:
+		job()
+		return true
+	case POOL_OVERFLOW_BLOCK:
+		p.jobs <- job
+		return true
+	default:
+		atomic.AddUint64(&p.rejected, 1)
+		return false
+	}
+}
+
+// Config returns the pool's configuration
+func (p *WorkerPool) Config() WorkerPoolConfig {
+	return p.config
+}
+
+// Stats returns a snapshot of the pool's activity
+func (p *WorkerPool) Stats() WorkerPoolStats {
+	return WorkerPoolStats{
+		Workers:  p.config.Workers,
+		Busy:     atomic.LoadInt64(&p.busy),
+		Queued:   len(p.jobs),
+		Rejected: atomic.LoadUint64(&p.rejected),
+	}
+}
+
+// Close stops accepting jobs, lets queued jobs finish, and waits for the
+// workers to exit
+func (p *WorkerPool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.jobs)
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+// SetWorkerPool runs request handlers on a new pool with the given
+// configuration. The previous pool finishes its queued handlers first.
+func (s *UltraFastHTTPServer) SetWorkerPool(config WorkerPoolConfig) {
+	if old := s.workers.Swap(NewWorkerPool(config)); old != nil {
+		go old.Close()
+	}
+}
+
+// DisableWorkerPool runs request handlers inline on the event loop
+func (s *UltraFastHTTPServer) DisableWorkerPool() {
+	if old := s.workers.Swap(nil); old != nil {
+		go old.Close()
+	}
+}
+
+// WorkerPoolStats returns the handler pool's activity and whether a pool
+// is in use
+func (s *UltraFastHTTPServer) WorkerPoolStats() (WorkerPoolStats, bool) {
+	pool := s.workers.Load()
+	if pool == nil {
+		return WorkerPoolStats{}, false
+	}
+	return pool.Stats(), true
+}
@@ -0,0 +1,100 @@
+package ultrafast
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fillPool occupies every worker and queue slot until release is closed
+func fillPool(t *testing.T, pool *WorkerPool, release chan struct{}) {
+	config := pool.Config()
+	started := make(chan struct{}, config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		pool.Submit(func() {
+			started <- struct{}{}
+			<-release
+		})
+	}
+	for i := 0; i < config.Workers; i++ {
+		<-started
+	}
+	for i := 0; i < config.QueueLength; i++ {
+		if !pool.Submit(func() { <-release }) {
+			t.Fatal("Queue should accept jobs up to its length")
+		}
+	}
+}
+
+func TestWorkerPoolOverflow(t *testing.T) {
+	release := make(chan struct{})
+	reject := NewWorkerPool(WorkerPoolConfig{Workers: 1, QueueLength: 1, Overflow: POOL_OVERFLOW_REJECT})
+	fillPool(t, reject, release)
+	if reject.Submit(func() {}) {
+		t.Error("A full pool with the reject policy should refuse jobs")
+	}
+	if stats := reject.Stats(); stats.Rejected != 1 || stats.Busy != 1 || stats.Queued != 1 {
+		t.Errorf("Unexpected stats for a full pool: %+v", stats)
+	}
+
+	inline := NewWorkerPool(WorkerPoolConfig{Workers: 1, QueueLength: 1, Overflow: POOL_OVERFLOW_INLINE})
+	fillPool(t, inline, release)
+	ran := false
+	if !inline.Submit(func() { ran = true }) || !ran {
+		t.Error("A full pool with the inline policy should run the job on the caller")
+	}
+
+	block := NewWorkerPool(WorkerPoolConfig{Workers: 1, QueueLength: 1, Overflow: POOL_OVERFLOW_BLOCK})
+	fillPool(t, block, release)
+	submitted := make(chan bool, 1)
+	go func() { submitted <- block.Submit(func() {}) }()
+	select {
+	case <-submitted:
+		t.Fatal("A full pool with the block policy should wait for space")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if !<-submitted {
+		t.Error("A blocked job should be queued once space frees up")
+	}
+	for _, pool := range []*WorkerPool{reject, inline, block} {
+		pool.Close()
+	}
+	if block.Submit(func() {}) {
+		t.Error("A closed pool should refuse jobs")
+	}
+}
+
+func TestSlowHandlerDoesNotStallLoop(t *testing.T) {
+	server := startTestServer(t)
+
+	release := make(chan struct{})
+	server.HandleFunc("/slow", func(ctx context.Context, request *HTTPRequest) *HTTPResponse {
+		<-release
+		return &HTTPResponse{StatusCode: 200}
+	})
+
+	// The slow request is never answered while the second one is served
+	slow := newTestClient(t, server)
+	slow.SetTimeout(20 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		slow.Get("/slow")
+	}()
+	defer func() {
+		close(release)
+		<-done // before the client is closed under it
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	fast := newTestClient(t, server)
+	response, err := fast.Get("/benchmark")
+	if err != nil {
+		t.Fatalf("Request behind a slow handler failed: %v", err)
+	}
+	if !containsString(string(response), "HTTP/1.1 200 OK") {
+		t.Errorf("Expected 200 response, got %q", response)
+	}
+}
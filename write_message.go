@@ -0,0 +1,60 @@
+package ultrafast
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+// WriteMessage sends data to the peer as DATA packets of at most
+// MAX_PAYLOAD_SIZE bytes. Like a response's, they take their sequence
+// numbers from the connection's reliability layer as they leave, are
+// retransmitted until acknowledged, and wait on the connection while the
+// congestion window, the flow control window or the bandwidth limit has
+// no room for them, leaving as ACKs open it. WriteMessage does not wait
+// for that: it returns once every packet is sent or queued, and data may
+// be reused at once. A message of more than one packet marks each with
+// its offset, as a multi-packet response does, so the peer can
+// reassemble it. Connections carrying a stream are written with Write
+// instead, as stream bytes have no message boundaries to mark.
+func (c *Connection) WriteMessage(data []byte) error {
+	h := c.handler.Load()
+	switch {
+	case h == nil:
+		return fmt.Errorf("connection was not established by a server")
+	case c.Err() != nil:
+		return c.Err()
+	case c.Context().Err() != nil:
+		return errUseOfClosed
+	case c.stream.Load() != nil:
+		return fmt.Errorf("connection carries a stream, which is written with Write")
+	}
+	peer := h.server.connections.PeerOf(c)
+	if h.server.connections.Get(peer) != c {
+		return errUseOfClosed
+	}
+
+	// Held and retransmitted packets keep referring to their payload
+	data = bytes.Clone(data)
+	total := len(data)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	var bytesSent uint64
+	for offset := 0; offset == 0 || offset < total; {
+		end := min(offset+MAX_PAYLOAD_SIZE, total)
+		packet := NewPacket(DATA_PACKET, 0, 0, 0, data[offset:end])
+		if total > MAX_PAYLOAD_SIZE {
+			packet.SetFragment(uint32(offset), uint32(total))
+		}
+		sent, err := h.sendDataPacket(packet, false, c, peer)
+		if err != nil {
+			atomic.AddUint64(&h.server.stats.Errors, 1)
+			return err
+		}
+		bytesSent += uint64(sent)
+		offset = end
+	}
+	atomic.AddUint64(&h.server.stats.BytesSent, bytesSent)
+	return nil
+}
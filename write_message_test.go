@@ -0,0 +1,84 @@
+package ultrafast
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestConnectionWriteMessage(t *testing.T) {
+	server := startTestServer(t)
+	client := newTestClient(t, server)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	waitForConnections(t, server, 1)
+	conn := server.connections.Snapshot()[0]
+
+	message := bytes.Repeat([]byte("segmented "), 300) // three packets
+	if err := conn.WriteMessage(message); err != nil {
+		t.Fatalf("WriteMessage failed: %v", err)
+	}
+	message[0] = 'X' // the caller's buffer is free once WriteMessage returns
+
+	// A congestion window of one lets the first packet out, the rest
+	// leave as the client's ACKs open it
+	if queued := conn.windowQueued(); queued != 2 {
+		t.Errorf("Expected 2 packets waiting for the window, got %d", queued)
+	}
+
+	var seqs []uint32
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		packet, err := client.receive(deadline, func(p *Packet) bool { return p.IsDataPacket() })
+		if err != nil {
+			t.Fatalf("Receive failed after %d packets: %v", len(seqs), err)
+		}
+		seqs = append(seqs, packet.SeqNum)
+		if len(packet.Payload) > MAX_PAYLOAD_SIZE {
+			t.Errorf("Packet of %d bytes is over MAX_PAYLOAD_SIZE", len(packet.Payload))
+		}
+		if data, complete := client.assemble(0, packet); complete {
+			message[0] = 's'
+			if !bytes.Equal(data, message) {
+				t.Errorf("Reassembled message differs from the one written")
+			}
+			break
+		}
+	}
+	if len(seqs) != 3 || seqs[1] != seqs[0]+1 || seqs[2] != seqs[1]+1 {
+		t.Errorf("Expected 3 consecutive sequence numbers, got %v", seqs)
+	}
+
+	// Every packet is tracked until acknowledged
+	for deadline := time.Now().Add(time.Second); conn.Reliability().UnackedCount() > 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected every packet acknowledged, %d left", conn.Reliability().UnackedCount())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnectionWriteMessageRefused(t *testing.T) {
+	if err := (&Connection{}).WriteMessage([]byte("x")); err == nil {
+		t.Error("Expected a connection outside a server refused")
+	}
+
+	server := startTestServer(t)
+	server.OnConnection(func(conn *Connection) {
+		if err := conn.WriteMessage([]byte("x")); err == nil {
+			conn.Write([]byte("accepted"))
+			return
+		}
+		conn.Write([]byte("refused"))
+	})
+	stream := dialTestStream(t, server)
+	if _, err := stream.Write([]byte("hi")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	reply := make([]byte, 16)
+	n, err := stream.Read(reply)
+	if err != nil || string(reply[:n]) != "refused" {
+		t.Errorf("Expected WriteMessage refused on a stream, got %q, %v", reply[:n], err)
+	}
+}
@@ -0,0 +1,77 @@
+package ultrafast
+
+import (
+	"net/netip"
+	"time"
+)
+
+// xdpBlockTime is how long the XDP program drops a source after the rate
+// limiter turned one of its packets away. Once it lapses the source's
+// packets reach the rate limiter again, which blocks it anew if it is
+// still over its limit.
+const xdpBlockTime = time.Second
+
+// XDPStats counts the packets the XDP program dropped
+type XDPStats struct {
+	Denied      uint64 // from sources in the access list's deny rules
+	RateLimited uint64 // from sources blocked for exceeding the rate limit
+}
+
+// EnableXDP loads an XDP program onto the network interface iface that
+// drops, at the driver and before the kernel builds a socket buffer,
+// UDP datagrams to the server's port from sources the access list denies
+// or the rate limiter has blocked. The deny rules are kept in sync with
+// SetAccessList and UpdateAccessList; allow rules stay with the access
+// list in the server, as do sources over the rate limit until the first
+// packet turned away. It needs CAP_BPF and CAP_NET_ADMIN. Drivers
+// without native XDP run the program in generic mode.
+func (s *UltraFastHTTPServer) EnableXDP(iface string) (*XDPOffload, error) {
+	offload, err := attachXDP(iface, s.socket.GetLocalAddr().Port)
+	if err != nil {
+		return nil, err
+	}
+	if old := s.xdp.Swap(offload); old != nil {
+		old.Close()
+	}
+	s.syncXDP()
+	return offload, nil
+}
+
+// DisableXDP detaches the XDP program
+func (s *UltraFastHTTPServer) DisableXDP() {
+	if old := s.xdp.Swap(nil); old != nil {
+		old.Close()
+	}
+}
+
+// XDP returns the XDP offload in use, or nil if it is off
+func (s *UltraFastHTTPServer) XDP() *XDPOffload {
+	return s.xdp.Load()
+}
+
+// syncXDP programs the XDP drop list with the access list's deny rules
+func (s *UltraFastHTTPServer) syncXDP() {
+	offload := s.xdp.Load()
+	if offload == nil {
+		return
+	}
+	var deny []netip.Prefix
+	if list := s.acl.Load(); list != nil {
+		deny = list.denyPrefixes()
+	}
+	if err := offload.SetDenyList(deny); err != nil {
+		logWarnf("Failed to update the XDP deny list: %v", err)
+	}
+}
+
+// blockAtXDP has the XDP program drop a source the rate limiter turned
+// away, for xdpBlockTime
+func (s *UltraFastHTTPServer) blockAtXDP(from SocketAddr) {
+	offload := s.xdp.Load()
+	if offload == nil {
+		return
+	}
+	if err := offload.BlockSource(from.IP, xdpBlockTime); err != nil {
+		logDebugf("Failed to block %s at XDP: %v", from.IP, err)
+	}
+}
@@ -0,0 +1,464 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// bpf(2) commands, map and program types, from linux/bpf.h
+const (
+	bpfMapCreate       = 0
+	bpfMapLookupElem   = 1
+	bpfMapUpdateElem   = 2
+	bpfMapDeleteElem   = 3
+	bpfProgLoad        = 5
+	bpfLinkCreate      = 28
+	bpfMapTypeLRUHash  = 9
+	bpfMapTypePerCPU   = 6 // BPF_MAP_TYPE_PERCPU_ARRAY
+	bpfMapTypeLPMTrie  = 11
+	bpfProgTypeXDP     = 6
+	bpfAttachXDP       = 37
+	bpfNoPrealloc      = 1 // BPF_F_NO_PREALLOC, required by LPM tries
+	bpfPseudoMapFD     = 1
+	bpfFuncMapLookup   = 1
+	bpfFuncKtimeGetNs  = 5
+	xdpDrop            = 1
+	xdpPass            = 2
+	xdpMapEntries      = 65536
+	xdpCounterDenied   = 0
+	xdpCounterLimited  = 1
+	xdpProgramLogSize  = 64 * 1024
+	xdpHeadersSize     = 14 + 20 + udpHeaderSize // Ethernet, IPv4 without options, UDP
+	xdpEtherTypeOffset = 12
+	xdpIPOffset        = 14
+)
+
+// XDPOffload is an XDP program attached to a network interface, with the
+// maps through which the server tells it what to drop
+type XDPOffload struct {
+	iface    string
+	deny     int // LPM trie: prefix length and IPv4 address -> 1
+	blocked  int // LRU hash: IPv4 address -> CLOCK_MONOTONIC nanoseconds to drop until
+	counters int // per-CPU array: packets dropped, by xdpCounter*
+	program  int
+	link     int
+
+	mu       sync.Mutex
+	denySet  map[netip.Prefix]bool // prefixes in the deny map
+	closed   bool
+	cpuCount int
+}
+
+// attachXDP loads the drop program for UDP port port and attaches it to
+// the interface named iface
+func attachXDP(iface string, port uint16) (*XDPOffload, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	cpus, err := possibleCPUs()
+	if err != nil {
+		return nil, err
+	}
+	x := &XDPOffload{iface: iface, deny: -1, blocked: -1, counters: -1, program: -1, link: -1,
+		denySet: make(map[netip.Prefix]bool), cpuCount: cpus}
+
+	if x.deny, err = bpfCreateMap(bpfMapTypeLPMTrie, 8, 1, xdpMapEntries, bpfNoPrealloc, "uf_deny"); err == nil {
+		if x.blocked, err = bpfCreateMap(bpfMapTypeLRUHash, 4, 8, xdpMapEntries, 0, "uf_blocked"); err == nil {
+			x.counters, err = bpfCreateMap(bpfMapTypePerCPU, 4, 8, 2, 0, "uf_counters")
+		}
+	}
+	if err == nil {
+		x.program, err = bpfLoadXDP(xdpDropProgram(port, x.deny, x.blocked, x.counters))
+	}
+	if err == nil {
+		x.link, err = bpfLinkXDP(x.program, ifi.Index)
+	}
+	if err != nil {
+		x.Close()
+		return nil, err
+	}
+	return x, nil
+}
+
+// Interface returns the name of the interface the program is attached to
+func (x *XDPOffload) Interface() string {
+	return x.iface
+}
+
+// SetDenyList replaces the IPv4 prefixes the program drops; others are
+// skipped, as the program only parses IPv4
+func (x *XDPOffload) SetDenyList(prefixes []netip.Prefix) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		return fmt.Errorf("XDP offload is closed")
+	}
+
+	want := make(map[netip.Prefix]bool, len(prefixes))
+	for _, prefix := range prefixes {
+		if prefix.Addr().Is4() {
+			want[prefix] = true
+		}
+	}
+	for prefix := range x.denySet {
+		if !want[prefix] {
+			if err := bpfDeleteElem(x.deny, lpmKey(prefix)); err != nil {
+				return err
+			}
+			delete(x.denySet, prefix)
+		}
+	}
+	for prefix := range want {
+		if !x.denySet[prefix] {
+			if err := bpfUpdateElem(x.deny, lpmKey(prefix), []byte{1}); err != nil {
+				return err
+			}
+			x.denySet[prefix] = true
+		}
+	}
+	return nil
+}
+
+// BlockSource has the program drop packets from an IPv4 source for
+// duration. The map of blocked sources evicts the least recently used
+// when full.
+func (x *XDPOffload) BlockSource(ip string, duration time.Duration) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is4() {
+		return fmt.Errorf("not an IPv4 address: %q", ip)
+	}
+	var now unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &now); err != nil {
+		return err
+	}
+	until := binary.NativeEndian.AppendUint64(nil, uint64(now.Nano()+duration.Nanoseconds()))
+	key := addr.As4()
+	return bpfUpdateElem(x.blocked, key[:], until)
+}
+
+// Stats sums the program's drop counters over every CPU
+func (x *XDPOffload) Stats() XDPStats {
+	return XDPStats{
+		Denied:      x.counter(xdpCounterDenied),
+		RateLimited: x.counter(xdpCounterLimited),
+	}
+}
+
+// counter sums one per-CPU counter
+func (x *XDPOffload) counter(index uint32) uint64 {
+	values := make([]byte, 8*x.cpuCount)
+	if err := bpfLookupElem(x.counters, binary.NativeEndian.AppendUint32(nil, index), values); err != nil {
+		return 0
+	}
+	var sum uint64
+	for i := 0; i < x.cpuCount; i++ {
+		sum += binary.NativeEndian.Uint64(values[8*i:])
+	}
+	return sum
+}
+
+// Close detaches the program and frees its maps
+func (x *XDPOffload) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		return nil
+	}
+	x.closed = true
+	for _, fd := range []int{x.link, x.program, x.deny, x.blocked, x.counters} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+	return nil
+}
+
+// lpmKey is an LPM trie key: the prefix length, then the address
+func lpmKey(prefix netip.Prefix) []byte {
+	addr := prefix.Addr().As4()
+	return append(binary.NativeEndian.AppendUint32(nil, uint32(prefix.Bits())), addr[:]...)
+}
+
+// possibleCPUs counts the CPUs a per-CPU map holds a value for
+func possibleCPUs() (int, error) {
+	data, err := os.ReadFile("/sys/devices/system/cpu/possible")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, span := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		first, last, found := strings.Cut(span, "-")
+		lo, err := strconv.Atoi(first)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected CPU list %q", data)
+		}
+		hi := lo
+		if found {
+			if hi, err = strconv.Atoi(last); err != nil {
+				return 0, fmt.Errorf("unexpected CPU list %q", data)
+			}
+		}
+		count += hi - lo + 1
+	}
+	return count, nil
+}
+
+// bpfInsn is one eBPF instruction, as struct bpf_insn
+type bpfInsn struct {
+	code uint8
+	regs uint8 // destination register in the low nibble, source in the high
+	off  int16
+	imm  int32
+}
+
+// xdpAsm assembles an eBPF program, resolving jumps to labels
+type xdpAsm struct {
+	insns  []bpfInsn
+	labels map[string]int
+	jumps  map[int]string // instruction -> label it jumps to
+}
+
+// Instruction classes, sizes, modes and operations, from linux/bpf.h
+const (
+	ebpfLdImmDW = 0x18
+	ebpfLdxW    = 0x61
+	ebpfLdxH    = 0x69
+	ebpfLdxB    = 0x71
+	ebpfLdxDW   = 0x79
+	ebpfStW     = 0x62
+	ebpfStxW    = 0x63
+	ebpfStxDW   = 0x7b
+	ebpfMovK    = 0xb7
+	ebpfMovX    = 0xbf
+	ebpfAddK    = 0x07
+	ebpfJa      = 0x05
+	ebpfJeqK    = 0x15
+	ebpfJneK    = 0x55
+	ebpfJgtX    = 0x2d
+	ebpfJgeX    = 0x3d
+	ebpfCall    = 0x85
+	ebpfExit    = 0x95
+)
+
+// op appends an instruction
+func (a *xdpAsm) op(code uint8, dst, src uint8, off int16, imm int32) {
+	a.insns = append(a.insns, bpfInsn{code: code, regs: dst | src<<4, off: off, imm: imm})
+}
+
+// jump appends a jump to label
+func (a *xdpAsm) jump(code uint8, dst, src uint8, imm int32, label string) {
+	a.jumps[len(a.insns)] = label
+	a.op(code, dst, src, 0, imm)
+}
+
+// label marks the next instruction
+func (a *xdpAsm) label(name string) {
+	a.labels[name] = len(a.insns)
+}
+
+// loadMap loads a map's file descriptor into dst, as a two-slot
+// instruction the kernel rewrites into the map's address
+func (a *xdpAsm) loadMap(dst uint8, fd int) {
+	a.op(ebpfLdImmDW, dst, bpfPseudoMapFD, 0, int32(fd))
+	a.op(0, 0, 0, 0, 0)
+}
+
+// assemble resolves the jumps
+func (a *xdpAsm) assemble() []bpfInsn {
+	for at, label := range a.jumps {
+		a.insns[at].off = int16(a.labels[label] - at - 1)
+	}
+	return a.insns
+}
+
+// xdpDropProgram builds the XDP program. For IPv4 UDP datagrams without
+// IP options to port, it looks the source up in the deny trie, then in
+// the blocked map, dropping the packet and counting it on a match;
+// everything else passes.
+func xdpDropProgram(port uint16, deny, blocked, counters int) []bpfInsn {
+	// Packet fields are compared as loaded, in network byte order
+	wire16 := func(v uint16) int32 {
+		return int32(binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v)))
+	}
+	a := &xdpAsm{labels: make(map[string]int), jumps: make(map[int]string)}
+
+	// r2 = data, r3 = data_end; the headers must fit before any is read
+	a.op(ebpfLdxW, 2, 1, 0, 0)
+	a.op(ebpfLdxW, 3, 1, 4, 0)
+	a.op(ebpfMovX, 4, 2, 0, 0)
+	a.op(ebpfAddK, 4, 0, 0, xdpHeadersSize)
+	a.jump(ebpfJgtX, 4, 3, 0, "pass")
+	a.op(ebpfLdxH, 4, 2, xdpEtherTypeOffset, 0)
+	a.jump(ebpfJneK, 4, 0, wire16(0x0800), "pass")
+	a.op(ebpfLdxB, 4, 2, xdpIPOffset, 0)
+	a.jump(ebpfJneK, 4, 0, 0x45, "pass") // IPv4, no options
+	a.op(ebpfLdxB, 4, 2, xdpIPOffset+9, 0)
+	a.jump(ebpfJneK, 4, 0, unix.IPPROTO_UDP, "pass")
+	a.op(ebpfLdxH, 4, 2, xdpIPOffset+20+2, 0)
+	a.jump(ebpfJneK, 4, 0, wire16(port), "pass")
+	a.op(ebpfLdxW, 7, 2, xdpIPOffset+12, 0) // r7 = source address
+
+	// Deny trie, keyed by prefix length 32 and the source at fp-8
+	a.op(ebpfStW, 10, 0, -8, 32)
+	a.op(ebpfStxW, 10, 7, -4, 0)
+	a.loadMap(1, deny)
+	a.op(ebpfMovX, 2, 10, 0, 0)
+	a.op(ebpfAddK, 2, 0, 0, -8)
+	a.op(ebpfCall, 0, 0, 0, bpfFuncMapLookup)
+	a.jump(ebpfJeqK, 0, 0, 0, "blocked")
+	a.op(ebpfMovK, 8, 0, 0, xdpCounterDenied)
+	a.jump(ebpfJa, 0, 0, 0, "drop")
+
+	// Blocked sources, keyed by the source at fp-12, until their expiry
+	a.label("blocked")
+	a.op(ebpfStxW, 10, 7, -12, 0)
+	a.loadMap(1, blocked)
+	a.op(ebpfMovX, 2, 10, 0, 0)
+	a.op(ebpfAddK, 2, 0, 0, -12)
+	a.op(ebpfCall, 0, 0, 0, bpfFuncMapLookup)
+	a.jump(ebpfJeqK, 0, 0, 0, "pass")
+	a.op(ebpfLdxDW, 9, 0, 0, 0)
+	a.op(ebpfCall, 0, 0, 0, bpfFuncKtimeGetNs)
+	a.jump(ebpfJgeX, 0, 9, 0, "pass")
+	a.op(ebpfMovK, 8, 0, 0, xdpCounterLimited)
+
+	// Count the drop against counter r8, keyed at fp-16
+	a.label("drop")
+	a.op(ebpfStxW, 10, 8, -16, 0)
+	a.loadMap(1, counters)
+	a.op(ebpfMovX, 2, 10, 0, 0)
+	a.op(ebpfAddK, 2, 0, 0, -16)
+	a.op(ebpfCall, 0, 0, 0, bpfFuncMapLookup)
+	a.jump(ebpfJeqK, 0, 0, 0, "dropped")
+	a.op(ebpfLdxDW, 1, 0, 0, 0)
+	a.op(ebpfAddK, 1, 0, 0, 1)
+	a.op(ebpfStxDW, 0, 1, 0, 0)
+	a.label("dropped")
+	a.op(ebpfMovK, 0, 0, 0, xdpDrop)
+	a.op(ebpfExit, 0, 0, 0, 0)
+
+	a.label("pass")
+	a.op(ebpfMovK, 0, 0, 0, xdpPass)
+	a.op(ebpfExit, 0, 0, 0, 0)
+	return a.assemble()
+}
+
+// bpf issues a bpf(2) command
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// bpfCreateMap creates a map, returning its file descriptor
+func bpfCreateMap(mapType, keySize, valueSize, maxEntries, flags uint32, name string) (int, error) {
+	attr := struct {
+		mapType, keySize, valueSize, maxEntries, flags, innerMap, numaNode uint32
+		name                                                               [16]byte
+	}{mapType: mapType, keySize: keySize, valueSize: valueSize, maxEntries: maxEntries, flags: flags}
+	copy(attr.name[:15], name)
+	fd, err := bpf(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("creating BPF map %s: %v", name, err)
+	}
+	return fd, nil
+}
+
+// bpfMapElemAttr is the bpf_attr of the map element commands
+type bpfMapElemAttr struct {
+	mapFD uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+// bpfMapElem runs a map element command on key and value
+func bpfMapElem(cmd int, fd int, key, value []byte) error {
+	attr := bpfMapElemAttr{mapFD: uint32(fd), key: uint64(uintptr(unsafe.Pointer(&key[0])))}
+	if value != nil {
+		attr.value = uint64(uintptr(unsafe.Pointer(&value[0])))
+	}
+	_, err := bpf(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(key)
+	runtime.KeepAlive(value)
+	return err
+}
+
+// bpfUpdateElem sets a map element
+func bpfUpdateElem(fd int, key, value []byte) error {
+	return bpfMapElem(bpfMapUpdateElem, fd, key, value)
+}
+
+// bpfDeleteElem removes a map element
+func bpfDeleteElem(fd int, key []byte) error {
+	return bpfMapElem(bpfMapDeleteElem, fd, key, nil)
+}
+
+// bpfLookupElem reads a map element into value
+func bpfLookupElem(fd int, key, value []byte) error {
+	return bpfMapElem(bpfMapLookupElem, fd, key, value)
+}
+
+// bpfLoadXDP loads an XDP program, returning its file descriptor. A
+// program the verifier refuses is reported with the verifier's log.
+func bpfLoadXDP(insns []bpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	log := make([]byte, xdpProgramLogSize)
+	attr := struct {
+		progType, insnCount uint32
+		insns, license      uint64
+		logLevel, logSize   uint32
+		logBuf              uint64
+		kernVersion, flags  uint32
+		name                [16]byte
+		ifindex, attachType uint32
+	}{
+		progType:   bpfProgTypeXDP,
+		insnCount:  uint32(len(insns)),
+		insns:      uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:    uint64(uintptr(unsafe.Pointer(&license[0]))),
+		logLevel:   1,
+		logSize:    uint32(len(log)),
+		logBuf:     uint64(uintptr(unsafe.Pointer(&log[0]))),
+		attachType: bpfAttachXDP,
+	}
+	copy(attr.name[:], "uf_xdp_drop")
+	fd, err := bpf(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		message := strings.TrimRight(string(log), "\x00")
+		return -1, fmt.Errorf("loading XDP program: %v\n%s", err, message)
+	}
+	return fd, nil
+}
+
+// bpfLinkXDP attaches an XDP program to an interface through a BPF link,
+// which detaches it when closed
+func bpfLinkXDP(program, ifindex int) (int, error) {
+	attr := struct {
+		programFD, ifindex, attachType, flags uint32
+	}{programFD: uint32(program), ifindex: uint32(ifindex), attachType: bpfAttachXDP}
+	fd, err := bpf(bpfLinkCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, fmt.Errorf("attaching XDP program: %v", err)
+	}
+	return fd, nil
+}
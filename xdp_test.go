@@ -0,0 +1,131 @@
+//go:build linux
+
+package ultrafast
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestXDPOffload(t *testing.T) {
+	receiver, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	if err := receiver.Bind("127.0.0.1", 0); err != nil {
+		t.Fatal(err)
+	}
+	sender, err := NewLinuxUDPSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if err := sender.Bind("127.0.0.2", 0); err != nil {
+		t.Fatal(err)
+	}
+	addr := receiver.GetLocalAddr()
+
+	offload, err := attachXDP("lo", addr.Port)
+	if errors.Is(err, unix.EPERM) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL) {
+		t.Skipf("XDP unavailable: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offload.Close()
+
+	packet := NewPacket(DATA_PACKET, 0, 1, 0, []byte("GET / HTTP/1.1\r\n\r\n")).Serialize()
+	// send reports whether the packet reached the receiver
+	send := func() bool {
+		t.Helper()
+		if _, err := sender.SendTo(packet, addr.IP, addr.Port); err != nil {
+			t.Fatal(err)
+		}
+		buffer := make([]byte, 2048)
+		receiver.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := receiver.RecvFrom(buffer)
+		if err == os.ErrDeadlineExceeded {
+			return false
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Equal(buffer[:n], packet)
+	}
+
+	if !send() {
+		t.Fatal("Expected the packet through with an empty deny list")
+	}
+	deny := []netip.Prefix{netip.MustParsePrefix("127.0.0.2/32"), netip.MustParsePrefix("::1/128")}
+	if err := offload.SetDenyList(deny); err != nil {
+		t.Fatal(err)
+	}
+	if send() {
+		t.Error("Expected the denied source dropped")
+	}
+	if stats := offload.Stats(); stats.Denied == 0 || stats.RateLimited != 0 {
+		t.Errorf("Expected the drop counted as denied, got %+v", stats)
+	}
+
+	if err := offload.SetDenyList(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := offload.BlockSource("127.0.0.2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if send() {
+		t.Error("Expected the blocked source dropped")
+	}
+	if stats := offload.Stats(); stats.RateLimited == 0 {
+		t.Errorf("Expected the drop counted as rate limited, got %+v", stats)
+	}
+	if err := offload.BlockSource("127.0.0.2", -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !send() {
+		t.Error("Expected the source through once its block lapsed")
+	}
+	if err := offload.BlockSource("::1", time.Second); err == nil {
+		t.Error("Expected an IPv6 source to be refused")
+	}
+}
+
+func TestServerXDP(t *testing.T) {
+	server := startTestServer(t)
+	if _, err := server.EnableXDP("lo"); err != nil {
+		t.Skipf("XDP unavailable: %v", err)
+	}
+	admin := NewAdminServer("")
+	server.registerAdminCommands(admin)
+
+	admin.Execute("acl deny 127.0.0.0/8")
+	if err := newTestClient(t, server).Connect(); err == nil {
+		t.Fatal("Handshake from a denied source succeeded")
+	}
+	if server.XDP().Stats().Denied == 0 {
+		t.Error("Expected the deny rule enforced at XDP")
+	}
+	if server.GetStats().ACLBlocked != 0 {
+		t.Error("Expected denied packets dropped before reaching the server")
+	}
+
+	admin.Execute("acl off")
+	if _, err := newTestClient(t, server).Get("/benchmark"); err != nil {
+		t.Fatalf("Request failed once the rule was removed: %v", err)
+	}
+	if reply := admin.Execute("xdp"); !strings.Contains(reply, "xdp on lo") {
+		t.Errorf("Expected the program listed, got %q", reply)
+	}
+	admin.Execute("xdp off")
+	if server.XDP() != nil {
+		t.Error("xdp off should detach the program")
+	}
+}
@@ -0,0 +1,40 @@
+package ultrafast
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// XDPOffload is not supported on Windows
+type XDPOffload struct{}
+
+// attachXDP is not supported on Windows
+func attachXDP(iface string, port uint16) (*XDPOffload, error) {
+	return nil, fmt.Errorf("XDP is not supported on this platform")
+}
+
+// Interface is not supported on Windows
+func (x *XDPOffload) Interface() string {
+	return ""
+}
+
+// SetDenyList is not supported on Windows
+func (x *XDPOffload) SetDenyList(prefixes []netip.Prefix) error {
+	return fmt.Errorf("XDP is not supported on this platform")
+}
+
+// BlockSource is not supported on Windows
+func (x *XDPOffload) BlockSource(ip string, duration time.Duration) error {
+	return fmt.Errorf("XDP is not supported on this platform")
+}
+
+// Stats is not supported on Windows
+func (x *XDPOffload) Stats() XDPStats {
+	return XDPStats{}
+}
+
+// Close is not supported on Windows
+func (x *XDPOffload) Close() error {
+	return nil
+}
@@ -1,16 +1,19 @@
-package main
+//go:build linux
+
+package ultrafast
 
 import (
 	"fmt"
 	"os"
-	"syscall"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
-// Linux splice constants (not available in Go syscall package)
+// Linux splice constants
 const (
-	SPLICE_F_MOVE = 0x01
-	SPLICE_F_MORE = 0x04
+	SPLICE_F_MOVE = unix.SPLICE_F_MOVE
+	SPLICE_F_MORE = unix.SPLICE_F_MORE
 )
 
 // ZeroCopySocket extends LinuxUDPSocket with zero-copy capabilities
@@ -44,9 +47,9 @@ func NewZeroCopySocket() (*ZeroCopySocket, error) {
 // initMmapBuffer creates a memory-mapped buffer for zero-copy operations
 func (zcs *ZeroCopySocket) initMmapBuffer() error {
 	// Create anonymous memory mapping
-	mmapBuffer, err := syscall.Mmap(-1, 0, zcs.bufferSize,
-		syscall.PROT_READ|syscall.PROT_WRITE,
-		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	mmapBuffer, err := unix.Mmap(-1, 0, zcs.bufferSize,
+		unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
 	if err != nil {
 		return fmt.Errorf("mmap failed: %v", err)
 	}
@@ -76,11 +79,11 @@ func (zcs *ZeroCopySocket) SendFile(filePath string, destIP string, destPort uin
 	// and send via UDP packets, or use other zero-copy techniques
 
 	// Create a temporary TCP socket for demonstration
-	tcpFd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	tcpFd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create TCP socket: %v", err)
 	}
-	defer syscall.Close(tcpFd)
+	defer unix.Close(tcpFd)
 
 	// Parse destination address
 	ipBytes := parseIPv4(destIP)
@@ -88,19 +91,19 @@ func (zcs *ZeroCopySocket) SendFile(filePath string, destIP string, destPort uin
 		return 0, fmt.Errorf("invalid IP address: %s", destIP)
 	}
 
-	destAddr := &syscall.SockaddrInet4{
+	destAddr := &unix.SockaddrInet4{
 		Port: int(destPort),
 		Addr: [4]byte{ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3]},
 	}
 
 	// Connect (for demonstration)
-	if err := syscall.Connect(tcpFd, destAddr); err != nil {
+	if err := unix.Connect(tcpFd, destAddr); err != nil {
 		// For demo purposes, we'll simulate the sendfile operation
 		return zcs.simulateZeroCopyFileSend(file, fileSize, destIP, destPort)
 	}
 
 	// Use sendfile for zero-copy transfer
-	n, err := syscall.Sendfile(tcpFd, int(file.Fd()), nil, int(fileSize))
+	n, err := unix.Sendfile(tcpFd, int(file.Fd()), nil, int(fileSize))
 	return int64(n), err
 }
 
@@ -171,14 +174,14 @@ func (zcs *ZeroCopySocket) Splice(inputFd int, outputFd int, length int) (int64,
 	defer pipeWrite.Close()
 
 	// Splice from input to pipe
-	n1, err := syscall.Splice(inputFd, nil, int(pipeWrite.Fd()), nil, length,
+	n1, err := unix.Splice(inputFd, nil, int(pipeWrite.Fd()), nil, length,
 		SPLICE_F_MOVE|SPLICE_F_MORE)
 	if err != nil {
 		return 0, fmt.Errorf("splice input->pipe failed: %v", err)
 	}
 
 	// Splice from pipe to output
-	n2, err := syscall.Splice(int(pipeRead.Fd()), nil, outputFd, nil, int(n1),
+	n2, err := unix.Splice(int(pipeRead.Fd()), nil, outputFd, nil, int(n1),
 		SPLICE_F_MOVE)
 	if err != nil {
 		return n1, fmt.Errorf("splice pipe->output failed: %v", err)
@@ -201,7 +204,7 @@ func (zcs *ZeroCopySocket) GetBufferSize() int {
 func (zcs *ZeroCopySocket) Close() error {
 	// Unmap the memory-mapped buffer
 	if zcs.mmapBuffer != nil {
-		if err := syscall.Munmap(zcs.mmapBuffer); err != nil {
+		if err := unix.Munmap(zcs.mmapBuffer); err != nil {
 			// Log error but continue cleanup
 		}
 		zcs.mmapBuffer = nil
@@ -214,7 +217,7 @@ func (zcs *ZeroCopySocket) Close() error {
 // Advanced zero-copy techniques
 
 // MSG_ZEROCOPY flag for Linux zero-copy send (requires kernel 4.14+)
-const MSG_ZEROCOPY = 0x4000000
+const MSG_ZEROCOPY = unix.MSG_ZEROCOPY
 
 // SendZeroCopy sends data using kernel zero-copy (Linux 4.14+)
 func (zcs *ZeroCopySocket) SendZeroCopy(data []byte, destIP string, destPort uint16) (int, error) {
@@ -224,15 +227,15 @@ func (zcs *ZeroCopySocket) SendZeroCopy(data []byte, destIP string, destPort uin
 	}
 
 	// Prepare destination address
-	destAddr := syscall.RawSockaddrInet4{
-		Family: syscall.AF_INET,
+	destAddr := unix.RawSockaddrInet4{
+		Family: unix.AF_INET,
 		Port:   htons(destPort),
 		Addr:   [4]byte{ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3]},
 	}
 
 	// Prepare message header for sendmsg
-	var msg syscall.Msghdr
-	var iov syscall.Iovec
+	var msg unix.Msghdr
+	var iov unix.Iovec
 
 	iov.Base = &data[0]
 	iov.Len = uint64(len(data))
@@ -243,7 +246,7 @@ func (zcs *ZeroCopySocket) SendZeroCopy(data []byte, destIP string, destPort uin
 	msg.Iovlen = 1
 
 	// Send with zero-copy flag
-	n, err := sendmsg(zcs.fd, &msg, MSG_ZEROCOPY)
+	n, err := sendmsg(zcs.sock(), &msg, MSG_ZEROCOPY)
 	if err != nil {
 		// Fallback to regular send if zero-copy not supported
 		return zcs.SendTo(data, destIP, destPort)
@@ -253,8 +256,8 @@ func (zcs *ZeroCopySocket) SendZeroCopy(data []byte, destIP string, destPort uin
 }
 
 // sendmsg wrapper for zero-copy operations
-func sendmsg(fd int, msg *syscall.Msghdr, flags int) (int, error) {
-	r1, _, errno := syscall.Syscall(syscall.SYS_SENDMSG,
+func sendmsg(fd int, msg *unix.Msghdr, flags int) (int, error) {
+	r1, _, errno := unix.Syscall(unix.SYS_SENDMSG,
 		uintptr(fd),
 		uintptr(unsafe.Pointer(msg)),
 		uintptr(flags))
@@ -263,54 +266,3 @@ func sendmsg(fd int, msg *syscall.Msghdr, flags int) (int, error) {
 	}
 	return int(r1), nil
 }
-
-// PerformanceBenchmark measures zero-copy vs regular copy performance
-func (zcs *ZeroCopySocket) PerformanceBenchmark(dataSize int, iterations int) (*PerformanceResults, error) {
-	results := &PerformanceResults{}
-	
-	// Create test data
-	testData := make([]byte, dataSize)
-	for i := range testData {
-		testData[i] = byte(i % 256)
-	}
-
-	// Benchmark regular copy
-	var start, end syscall.Timeval
-	syscall.Gettimeofday(&start)
-	for i := 0; i < iterations; i++ {
-		buffer := make([]byte, len(testData))
-		copy(buffer, testData)
-	}
-	syscall.Gettimeofday(&end)
-	results.RegularCopyNs = (end.Sec-start.Sec)*1e9 + (end.Usec-start.Usec)*1e3
-
-	// Benchmark memory-mapped operations
-	syscall.Gettimeofday(&start)
-	for i := 0; i < iterations; i++ {
-		if len(testData) <= len(zcs.mmapBuffer) {
-			copy(zcs.mmapBuffer, testData)
-		}
-	}
-	syscall.Gettimeofday(&end)
-	results.MmapCopyNs = (end.Sec-start.Sec)*1e9 + (end.Usec-start.Usec)*1e3
-
-	// Calculate performance improvement
-	if results.RegularCopyNs > 0 {
-		results.ImprovementRatio = float64(results.RegularCopyNs) / float64(results.MmapCopyNs)
-	}
-
-	return results, nil
-}
-
-// PerformanceResults holds benchmark results
-type PerformanceResults struct {
-	RegularCopyNs     int64
-	MmapCopyNs        int64
-	ImprovementRatio  float64
-}
-
-// String returns a formatted string of performance results
-func (pr *PerformanceResults) String() string {
-	return fmt.Sprintf("Regular copy: %d ns, Mmap copy: %d ns, Improvement: %.2fx",
-		pr.RegularCopyNs, pr.MmapCopyNs, pr.ImprovementRatio)
-}
\ No newline at end of file
@@ -0,0 +1,100 @@
+package ultrafast
+
+import (
+	"fmt"
+	"os"
+)
+
+// ZeroCopySocket extends LinuxUDPSocket with the zero-copy API. Windows
+// has no mmap'd socket buffers, splice or MSG_ZEROCOPY, so this fallback
+// stages data in an ordinary buffer and sends it with regular writes.
+type ZeroCopySocket struct {
+	*LinuxUDPSocket
+	mmapBuffer []byte
+	bufferSize int
+}
+
+// NewZeroCopySocket creates a socket with a staging buffer
+func NewZeroCopySocket() (*ZeroCopySocket, error) {
+	baseSocket, err := NewLinuxUDPSocket()
+	if err != nil {
+		return nil, err
+	}
+
+	bufferSize := 2 * 1024 * 1024 // 2MB buffer
+	return &ZeroCopySocket{
+		LinuxUDPSocket: baseSocket,
+		mmapBuffer:     make([]byte, bufferSize),
+		bufferSize:     bufferSize,
+	}, nil
+}
+
+// SendFile sends a file as a series of datagrams read through the
+// staging buffer
+func (zcs *ZeroCopySocket) SendFile(filePath string, destIP string, destPort uint16) (int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	const chunkSize = 1400 // MTU-safe UDP packet size
+	var totalSent int64
+	for {
+		n, err := file.Read(zcs.mmapBuffer[:chunkSize])
+		if n > 0 {
+			sent, sendErr := zcs.SendTo(zcs.mmapBuffer[:n], destIP, destPort)
+			if sendErr != nil {
+				return totalSent, fmt.Errorf("failed to send chunk: %v", sendErr)
+			}
+			totalSent += int64(sent)
+		}
+		if err != nil {
+			return totalSent, nil // io.EOF, or a read error after what was sent
+		}
+	}
+}
+
+// SendMmapped sends data through the staging buffer
+func (zcs *ZeroCopySocket) SendMmapped(data []byte, destIP string, destPort uint16) (int, error) {
+	if len(data) > len(zcs.mmapBuffer) {
+		return 0, fmt.Errorf("data size %d exceeds mmap buffer size %d", len(data), len(zcs.mmapBuffer))
+	}
+	copy(zcs.mmapBuffer, data)
+	return zcs.SendTo(zcs.mmapBuffer[:len(data)], destIP, destPort)
+}
+
+// RecvMmapped receives data into the staging buffer
+func (zcs *ZeroCopySocket) RecvMmapped() ([]byte, SocketAddr, error) {
+	n, fromAddr, err := zcs.RecvFrom(zcs.mmapBuffer)
+	if err != nil {
+		return nil, SocketAddr{}, err
+	}
+	return zcs.mmapBuffer[:n], fromAddr, nil
+}
+
+// Splice is not supported on Windows
+func (zcs *ZeroCopySocket) Splice(inputFd int, outputFd int, length int) (int64, error) {
+	return 0, fmt.Errorf("splice is not supported on windows")
+}
+
+// GetMmapBuffer returns the staging buffer for direct access
+func (zcs *ZeroCopySocket) GetMmapBuffer() []byte {
+	return zcs.mmapBuffer
+}
+
+// GetBufferSize returns the size of the staging buffer
+func (zcs *ZeroCopySocket) GetBufferSize() int {
+	return zcs.bufferSize
+}
+
+// Close closes the socket
+func (zcs *ZeroCopySocket) Close() error {
+	zcs.mmapBuffer = nil
+	return zcs.LinuxUDPSocket.Close()
+}
+
+// SendZeroCopy sends data with a regular write
+func (zcs *ZeroCopySocket) SendZeroCopy(data []byte, destIP string, destPort uint16) (int, error) {
+	return zcs.SendTo(data, destIP, destPort)
+}